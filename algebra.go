@@ -0,0 +1,104 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"math"
+)
+
+// The raster algebra functions compute images of floating point samples
+// pixel by pixel from others of the same bounds, such as the difference of
+// two elevation models. NaN samples hold no data: a pixel with no data in
+// any image it depends on has none in the result. NoDataToNaN turns the
+// NoData value of an image into NaN beforehand.
+
+// Add returns the sum of a and b.
+func Add(a, b *GrayFloat32) (*GrayFloat32, error) {
+	return combine(a, b, func(x, y float32) float32 { return x + y })
+}
+
+// Subtract returns the difference of a and b.
+func Subtract(a, b *GrayFloat32) (*GrayFloat32, error) {
+	return combine(a, b, func(x, y float32) float32 { return x - y })
+}
+
+// Multiply returns the product of a and b.
+func Multiply(a, b *GrayFloat32) (*GrayFloat32, error) {
+	return combine(a, b, func(x, y float32) float32 { return x * y })
+}
+
+// ScaleOffset returns a with each sample v replaced by v*scale + offset,
+// which adds, subtracts or multiplies by a scalar.
+func ScaleOffset(a *GrayFloat32, scale, offset float32) *GrayFloat32 {
+	dst := NewGrayFloat32(a.Rect)
+	b := a.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		out := dst.Pix[dst.PixOffset(b.Min.X, y):]
+		for i, v := range a.Pix[a.PixOffset(b.Min.X, y):][:b.Dx()] {
+			out[i] = math.Float32bits(math.Float32frombits(v)*scale + offset)
+		}
+	}
+	return dst
+}
+
+// Where returns an image with the samples of a where cond is nonzero and
+// those of b elsewhere, as for masking; its pixels have no data where cond
+// has none or the sample picked has none.
+func Where(cond, a, b *GrayFloat32) (*GrayFloat32, error) {
+	if cond.Rect != a.Rect || cond.Rect != b.Rect {
+		return nil, fmt.Errorf("tiff: Where of images of bounds %v, %v and %v", cond.Rect, a.Rect, b.Rect)
+	}
+	nan := math.Float32bits(float32(math.NaN()))
+	dst := NewGrayFloat32(a.Rect)
+	r := a.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		out := dst.Pix[dst.PixOffset(r.Min.X, y):]
+		pa, pb := a.Pix[a.PixOffset(r.Min.X, y):], b.Pix[b.PixOffset(r.Min.X, y):]
+		for i, c := range cond.Pix[cond.PixOffset(r.Min.X, y):][:r.Dx()] {
+			switch f := float64(math.Float32frombits(c)); {
+			case math.IsNaN(f):
+				out[i] = nan
+			case f != 0:
+				out[i] = pa[i]
+			default:
+				out[i] = pb[i]
+			}
+		}
+	}
+	return dst, nil
+}
+
+// NoDataToNaN replaces the samples of a equal to nodata by NaN, in place.
+func NoDataToNaN(a *GrayFloat32, nodata float32) {
+	nan := math.Float32bits(float32(math.NaN()))
+	b := a.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := a.Pix[a.PixOffset(b.Min.X, y):][:b.Dx()]
+		for i, v := range row {
+			if math.Float32frombits(v) == nodata {
+				row[i] = nan
+			}
+		}
+	}
+}
+
+// combine returns the image of f applied to the samples of a and b, which
+// must have the same bounds. NaN propagates through f.
+func combine(a, b *GrayFloat32, f func(x, y float32) float32) (*GrayFloat32, error) {
+	if a.Rect != b.Rect {
+		return nil, fmt.Errorf("tiff: images of bounds %v and %v combined", a.Rect, b.Rect)
+	}
+	dst := NewGrayFloat32(a.Rect)
+	r := a.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		out := dst.Pix[dst.PixOffset(r.Min.X, y):]
+		pb := b.Pix[b.PixOffset(r.Min.X, y):]
+		for i, v := range a.Pix[a.PixOffset(r.Min.X, y):][:r.Dx()] {
+			out[i] = math.Float32bits(f(math.Float32frombits(v), math.Float32frombits(pb[i])))
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math"
+	"time"
+)
+
+// AnimationOptions are the parameters of EncodeAnimation.
+type AnimationOptions struct {
+	// Delay is the time each frame is shown for, in steps of 10ms. If
+	// zero, it is half a second.
+	Delay time.Duration
+	// LoopCount is the number of times the animation is shown, as for
+	// gif.GIF: 0 to loop forever, -1 to show it once, n to show it n+1
+	// times.
+	LoopCount int
+	// Size, if not zero, is the size the slices of a Stack are read at by
+	// Stack.EncodeAnimation, resampled with ResampleAverage, so that large
+	// rasters give small previews without being decoded whole.
+	Size image.Point
+}
+
+// EncodeAnimation writes frames to w as an animated GIF image, each
+// rendered as Colorize does with ramp and s, but with a stretch common to
+// all of them: if s.Min and s.Max are equal, they are worked out from the
+// samples of every frame taken together, so that the colors of the frames
+// can be compared, as for the differences of a time series of elevation
+// models. The colors of ramp are reduced to the 255 of a GIF palette. The
+// frames must be of the same size.
+func EncodeAnimation(w io.Writer, frames []*GrayFloat32, ramp ColorRamp, s Stretch, opt *AnimationOptions) error {
+	if len(frames) == 0 {
+		return errors.New("tiff: animation without frames")
+	}
+	if len(ramp.Stops) == 0 {
+		return errors.New("tiff: animation with a ramp without stops")
+	}
+	size := frames[0].Bounds().Size()
+	for i, f := range frames {
+		if f.Bounds().Size() != size {
+			return fmt.Errorf("tiff: frame %d of size %v, not %v", i, f.Bounds().Size(), size)
+		}
+	}
+	var o AnimationOptions
+	if opt != nil {
+		o = *opt
+	}
+	if o.Delay <= 0 {
+		o.Delay = 500 * time.Millisecond
+	}
+	delay := max(1, int(o.Delay/(10*time.Millisecond)))
+
+	lo, hi, _ := s.bounds(frames...)
+	palette := rampPalette(ramp)
+	g := &gif.GIF{LoopCount: o.LoopCount}
+	for _, f := range frames {
+		g.Image = append(g.Image, s.paletted(f, lo, hi, palette))
+		g.Delay = append(g.Delay, delay)
+		// Clear each frame before the next, which would otherwise show
+		// through its transparent pixels.
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// EncodeAnimation writes the slices of the stack to w, in order, as an
+// animated GIF image, as EncodeAnimation does. The slices must be of
+// floating point samples, and are read at opt.Size if it is set.
+func (s *Stack) EncodeAnimation(w io.Writer, ramp ColorRamp, st Stretch, opt *AnimationOptions) error {
+	frames := make([]*GrayFloat32, len(s.pages))
+	for t, r := range s.pages {
+		var (
+			m   image.Image
+			err error
+		)
+		if opt != nil && opt.Size != (image.Point{}) {
+			m, err = r.ReadRegionScaled(r.Bounds(), opt.Size, ResampleAverage)
+		} else {
+			m, err = r.ReadRegion(r.Bounds())
+		}
+		if err != nil {
+			return err
+		}
+		f, ok := m.(*GrayFloat32)
+		if !ok {
+			return UnsupportedError{Feature: fmt.Sprintf("animation of a %T", m)}
+		}
+		frames[t] = f
+	}
+	return EncodeAnimation(w, frames, ramp, st, opt)
+}
+
+// rampPalette returns a palette of a transparent color followed by 255
+// colors of ramp, evenly spaced from 0 to 1.
+func rampPalette(ramp ColorRamp) color.Palette {
+	p := make(color.Palette, 256)
+	p[0] = color.NRGBA{}
+	for i := 1; i < len(p); i++ {
+		p[i] = ramp.at(float64(i-1) / float64(len(p)-2))
+	}
+	return p
+}
+
+// paletted renders img with the colors of palette, made by rampPalette, its
+// samples being stretched from lo to hi. The image has bounds at the
+// origin.
+func (s Stretch) paletted(img *GrayFloat32, lo, hi float64, palette color.Palette) *image.Paletted {
+	b := img.Bounds()
+	dst := image.NewPaletted(image.Rectangle{Max: b.Size()}, palette)
+	steps := float64(len(palette) - 2)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := dst.Pix[(y-b.Min.Y)*dst.Stride:]
+		for i, v := range img.Pix[img.PixOffset(b.Min.X, y):][:b.Dx()] {
+			f := float64(math.Float32frombits(v))
+			if s.noData(f) {
+				continue
+			}
+			t := 0.5
+			if lo != hi {
+				t = (f - lo) / (hi - lo)
+			}
+			row[i] = 1 + uint8(math.Round(min(max(t, 0), 1)*steps))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import "sync"
+
+// DefaultArenaSlabSize is the slab size used by NewArena if none is given.
+const DefaultArenaSlabSize = 64 << 20
+
+// An Arena hands out the pixel buffers of many decoded images from a few
+// large slabs, so that loading hundreds of tiles costs the garbage collector
+// a handful of objects instead of hundreds. The images are released together
+// by Reset or Free. An Arena may be shared by several Readers and used from
+// several goroutines at once.
+type Arena struct {
+	mu       sync.Mutex
+	slabSize int // In samples.
+	slabs    [][]uint32
+	cur      int // Index of the slab being filled.
+	off      int // Samples of slabs[cur] handed out.
+}
+
+// NewArena returns an Arena allocating slabs of slabSize bytes. If slabSize
+// is zero, DefaultArenaSlabSize is used. Images larger than a slab get a
+// buffer of their own.
+func NewArena(slabSize int) *Arena {
+	if slabSize <= 0 {
+		slabSize = DefaultArenaSlabSize
+	}
+	n := slabSize / 4
+	if n < 1 {
+		n = 1
+	}
+	return &Arena{slabSize: n}
+}
+
+// alloc returns a zeroed buffer of n samples.
+func (a *Arena) alloc(n int) []uint32 {
+	if n > a.slabSize {
+		return make([]uint32, n)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.cur < len(a.slabs) && a.off+n > len(a.slabs[a.cur]) {
+		a.cur++
+		a.off = 0
+	}
+	if a.cur == len(a.slabs) {
+		a.slabs = append(a.slabs, make([]uint32, a.slabSize))
+	}
+	p := a.slabs[a.cur][a.off : a.off+n : a.off+n]
+	a.off += n
+	clear(p)
+	return p
+}
+
+// Reset makes the memory of all images allocated from a available again,
+// keeping the slabs for the next batch. The images must no longer be used.
+func (a *Arena) Reset() {
+	a.mu.Lock()
+	a.cur, a.off = 0, 0
+	a.mu.Unlock()
+}
+
+// Free releases the slabs to the garbage collector. The images allocated
+// from a must no longer be used; a remains usable and allocates new slabs as
+// needed.
+func (a *Arena) Free() {
+	a.mu.Lock()
+	a.slabs = nil
+	a.cur, a.off = 0, 0
+	a.mu.Unlock()
+}
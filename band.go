@@ -0,0 +1,61 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import "io"
+
+// Large images whose rows have to be packed are serialized in bands of
+// roughly bandBytes bytes by several goroutines, while the bands already
+// finished are written out in order.
+var (
+	bandBytes        = 1 << 20
+	parallelMinBytes = 4 << 20
+)
+
+// A band is a run of serialized rows waiting to be written.
+type band struct {
+	buf  *[]byte
+	done chan struct{}
+}
+
+// writeBands writes nrows rows of rowBytes bytes each to w. The rows are
+// produced by pack, which fills dst with the rows [y0, y1) and is called
+// concurrently for distinct bands. sem is a counting semaphore bounding the
+// number of pack calls in flight, possibly shared with other writeBands
+// calls; at most cap(sem) bands are buffered ahead of the one being written.
+func writeBands(w io.Writer, sem chan struct{}, rowBytes, nrows int, pack func(dst []byte, y0, y1 int)) error {
+	bandRows := bandBytes / rowBytes
+	if bandRows < 1 {
+		bandRows = 1
+	}
+	queue := make(chan band, cap(sem))
+	go func() {
+		for y0 := 0; y0 < nrows; y0 += bandRows {
+			y1 := y0 + bandRows
+			if y1 > nrows {
+				y1 = nrows
+			}
+			b := band{getBuffer((y1 - y0) * rowBytes), make(chan struct{})}
+			queue <- b
+			sem <- struct{}{}
+			go func(y0, y1 int) {
+				pack(*b.buf, y0, y1)
+				<-sem
+				close(b.done)
+			}(y0, y1)
+		}
+		close(queue)
+	}()
+
+	var err error
+	for b := range queue {
+		<-b.done
+		if err == nil {
+			_, err = w.Write(*b.buf)
+		}
+		putBuffer(b.buf)
+	}
+	return err
+}
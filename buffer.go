@@ -0,0 +1,73 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// buffer buffers an io.Reader to satisfy io.ReaderAt.
+type buffer struct {
+	r   io.Reader
+	buf []byte
+}
+
+const fillChunkSize = 10 << 20 // 10 MB
+
+// fill reads data from b.r until the buffer contains at least end bytes.
+func (b *buffer) fill(end int) error {
+	m := len(b.buf)
+	for m < end {
+		next := end - m
+		if next > fillChunkSize {
+			next = fillChunkSize
+		}
+		if cap(b.buf) < m+next {
+			newbuf := make([]byte, m, 2*cap(b.buf)+next)
+			copy(newbuf, b.buf)
+			b.buf = newbuf
+		}
+		n, err := io.ReadFull(b.r, b.buf[m:m+next])
+		m += n
+		b.buf = b.buf[:m]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *buffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("tiff: invalid ReadAt offset")
+	}
+	end64 := off + int64(len(p))
+	if end64 < off || end64 > math.MaxInt {
+		return 0, io.ErrUnexpectedEOF
+	}
+	end := int(end64)
+
+	err := b.fill(end)
+	if end > len(b.buf) {
+		end = len(b.buf)
+	}
+	if int(off) > end {
+		return 0, err
+	}
+	return copy(p, b.buf[off:end]), err
+}
+
+// newReaderAt converts an io.Reader into an io.ReaderAt.
+func newReaderAt(r io.Reader) io.ReaderAt {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return ra
+	}
+	return &buffer{
+		r:   r,
+		buf: make([]byte, 0, 1024),
+	}
+}
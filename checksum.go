@@ -0,0 +1,101 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// blockChecksumsEntry returns the TagBlockChecksums entry of the blocks
+// stored one after the other in data, of the given sizes.
+func blockChecksumsEntry(data []byte, counts []uint32) ifdEntry {
+	sums := make([]byte, 8*len(counts))
+	for k, n := range counts {
+		binary.LittleEndian.PutUint64(sums[8*k:], xxhash64(data[:n]))
+		data = data[n:]
+	}
+	return ifdEntry{TagBlockChecksums, TypeUndefined, tagData(TypeUndefined, sums)}
+}
+
+// checkBlockChecksums records the checksums of the blocks of the image, if
+// it has them and the VerifyChecksums option asks for them to be checked.
+func (d *decoder) checkBlockChecksums() error {
+	if !d.verifyChecksums {
+		return nil
+	}
+	_, sums, ok, err := d.entryData(TagBlockChecksums)
+	if err != nil || !ok {
+		return err
+	}
+	// Volumes have checksums for the blocks of every slice.
+	if n := d.blocksAcross * d.blocksDown; len(sums) != 8*n && len(sums) != 8*n*d.depth() {
+		return FormatError(fmt.Sprintf("%d bytes of block checksums for %d blocks", len(sums), n))
+	}
+	d.blockChecksums = sums
+	return nil
+}
+
+// verifyBlock checks the stored data of block (i, j) against its checksum,
+// returning the data so that it need not be read again. raw holds the data
+// if it has already been fetched.
+func (d *decoder) verifyBlock(i, j int, raw []byte) ([]byte, error) {
+	k := j*d.blocksAcross + i
+	if raw == nil {
+		var err error
+		if raw, err = safeReadAt(d.r, uint64(d.blockCounts[k]), int64(d.blockOffsets[k])); err != nil {
+			return nil, err
+		}
+	}
+	if xxhash64(raw) != binary.LittleEndian.Uint64(d.blockChecksums[8*k:]) {
+		return nil, FormatError(fmt.Sprintf("%s does not match its checksum", d.blockName(i, j)))
+	}
+	return raw, nil
+}
+
+// putBlockChecksum sets the checksum of block k in e, a TagBlockChecksums
+// entry, to that of data, the new stored data of the block.
+func putBlockChecksum(e *ifdEntry, k int, data []byte) error {
+	if e.datatype != TypeUndefined || len(e.data) < 8*(k+1) {
+		return FormatError("block checksums do not match the blocks")
+	}
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], xxhash64(data))
+	for b, v := range sum {
+		e.data[8*k+b] = uint32(v)
+	}
+	return nil
+}
+
+// patchBlockChecksums overwrites in f the checksums of the given blocks,
+// whose stored data was changed in place, if the image has a
+// TagBlockChecksums field, so that they still match the blocks.
+func (d *decoder) patchBlockChecksums(f io.WriteSeeker, blocks []int) error {
+	p, ok := d.ifd[TagBlockChecksums]
+	if !ok {
+		return nil
+	}
+	n := int(d.byteOrder.Uint32(p[4:8]))
+	off := int64(d.byteOrder.Uint32(p[8:12]))
+	var sum [8]byte
+	for _, k := range blocks {
+		if d.byteOrder.Uint16(p[2:4]) != TypeUndefined || n < 8*(k+1) {
+			return FormatError("block checksums do not match the blocks")
+		}
+		raw, err := safeReadAt(d.r, uint64(d.blockCounts[k]), int64(d.blockOffsets[k]))
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(sum[:], xxhash64(raw))
+		if _, err := f.Seek(off+int64(8*k), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := f.Write(sum[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
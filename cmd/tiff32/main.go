@@ -0,0 +1,112 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+// Command tiff32 works on TIFF files of 32-bit images.
+//
+// Usage:
+//
+//	tiff32 recompress [flags] in.tif out.tif
+//
+// recompress stores the pixels of every image of in.tif anew in out.tif,
+// strip by strip, with the compression and predictor given by its flags,
+// keeping only a few strips in memory at a time. Throughput is reported on
+// standard error.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	tiff "github.com/hongping1224/go-tiff32"
+	xtiff "golang.org/x/image/tiff"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: tiff32 recompress [flags] in.tif out.tif\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "recompress":
+		if err := recompress(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "tiff32: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
+
+func recompress(args []string) error {
+	fs := flag.NewFlagSet("recompress", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: tiff32 recompress [flags] in.tif out.tif\n")
+		fs.PrintDefaults()
+	}
+	compression := fs.String("compression", "deflate", "compression of the output: none, deflate or lzw")
+	predictor := fs.Bool("predictor", false, "use the horizontal differencing predictor")
+	workers := fs.Int("workers", 0, "strips compressed concurrently (0 for one per CPU)")
+	quiet := fs.Bool("q", false, "do not report progress")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opt := &tiff.RecompressOptions{Options: &xtiff.Options{Predictor: *predictor}, Workers: *workers}
+	switch *compression {
+	case "none":
+		opt.Options.Compression = xtiff.Uncompressed
+	case "deflate":
+		opt.Options.Compression = xtiff.Deflate
+	case "lzw":
+		opt.Options.Compression = xtiff.LZW
+	default:
+		return fmt.Errorf("unknown compression %q", *compression)
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	var last tiff.RecompressProgress
+	var reported time.Time
+	report := func(p tiff.RecompressProgress) {
+		elapsed := time.Since(start).Seconds()
+		fmt.Fprintf(os.Stderr, "\rimage %d: %d/%d rows, %.1f MB read, %.1f MB written, %.1f MB/s",
+			p.Image, p.Rows, p.Height, float64(p.Read)/1e6, float64(p.Written)/1e6, float64(p.Read)/1e6/max(elapsed, 1e-9))
+	}
+	if !*quiet {
+		opt.Progress = func(p tiff.RecompressProgress) {
+			last = p
+			if now := time.Now(); now.Sub(reported) >= time.Second/4 {
+				reported = now
+				report(p)
+			}
+		}
+	}
+	err = tiff.Recompress(out, in, opt)
+	if !*quiet && !reported.IsZero() {
+		report(last)
+		fmt.Fprintln(os.Stderr)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fs.Arg(1))
+	}
+	return err
+}
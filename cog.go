@@ -0,0 +1,136 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The GDAL structural metadata, or ghost area, is text following the
+// header of cloud optimized GeoTIFFs, before the first IFD. Its first line
+// gives the size of the rest, and the others describe the layout of the
+// file as KEY=VALUE pairs.
+const (
+	ghostPrefix    = "GDAL_STRUCTURAL_METADATA_SIZE="
+	ghostFirstLine = len(ghostPrefix + "000000 bytes\n")
+	maxGhostSize   = 64 << 10
+)
+
+// ghostArea returns the structural metadata of the files the encoder
+// writes with GhostArea set. ifdsFirst tells whether all IFDs precede the
+// pixel data.
+func ghostArea(ifdsFirst bool) []byte {
+	var body strings.Builder
+	if ifdsFirst {
+		body.WriteString("LAYOUT=IFDS_BEFORE_DATA\n")
+	}
+	body.WriteString("BLOCK_ORDER=ROW_MAJOR\n")
+	body.WriteString("BLOCK_LEADER=SIZE_AS_UINT4\n")
+	body.WriteString("BLOCK_TRAILER=LAST_4_BYTES_REPEATED\n")
+	body.WriteString("KNOWN_INCOMPATIBLE_EDITION=NO\n")
+	if (ghostFirstLine+body.Len())%2 != 0 {
+		// What follows must start on a word boundary.
+		body.WriteByte(' ')
+	}
+	return fmt.Appendf(nil, "%s%06d bytes\n%s", ghostPrefix, body.Len(), body.String())
+}
+
+// blockTrailer returns the trailer of a block ending with tail: its last
+// 4 bytes, preceded by zeros if it is shorter.
+func blockTrailer(tail []byte) []byte {
+	var t [4]byte
+	if len(tail) > 4 {
+		tail = tail[len(tail)-4:]
+	}
+	copy(t[4-len(tail):], tail)
+	return t[:]
+}
+
+// StructuralMetadata returns the GDAL structural metadata of the file by
+// key, such as "BLOCK_LEADER", or nil if the file has none. Cloud
+// optimized GeoTIFFs, and the files written by an Encoder with
+// GhostArea set, carry it after their header. With the Strict option, the
+// block leaders and trailers it describes are checked along with the
+// blocks, so that files edited since they were written without updating
+// them are rejected.
+func (r *Reader) StructuralMetadata() (map[string]string, error) {
+	return r.d.structuralMetadata()
+}
+
+func (d *decoder) structuralMetadata() (map[string]string, error) {
+	if d.ifdOffset < int64(8+ghostFirstLine) {
+		return nil, nil
+	}
+	p, err := safeReadAt(d.r, uint64(ghostFirstLine), 8)
+	if err != nil {
+		return nil, err
+	}
+	size, ok := strings.CutPrefix(string(p), ghostPrefix)
+	if !ok {
+		return nil, nil
+	}
+	size, ok = strings.CutSuffix(size, " bytes\n")
+	n, err := strconv.Atoi(size)
+	if !ok || err != nil || n < 0 || n > maxGhostSize || int64(8+ghostFirstLine+n) > d.ifdOffset {
+		return nil, FormatError("malformed GDAL structural metadata")
+	}
+	if p, err = safeReadAt(d.r, uint64(n), int64(8+ghostFirstLine)); err != nil {
+		return nil, err
+	}
+	md := make(map[string]string)
+	for _, line := range strings.Split(string(p), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			md[k] = v
+		}
+	}
+	return md, nil
+}
+
+// checkLeaders reports a FormatError if a non-empty block does not have
+// the leader and trailer the structural metadata of the file, if any,
+// describes.
+func (d *decoder) checkLeaders() error {
+	md, err := d.structuralMetadata()
+	if err != nil || md == nil {
+		return err
+	}
+	leaders := md["BLOCK_LEADER"] == "SIZE_AS_UINT4"
+	trailers := md["BLOCK_TRAILER"] == "LAST_4_BYTES_REPEATED"
+	for j := 0; j < d.blocksDown; j++ {
+		for i := 0; i < d.blocksAcross; i++ {
+			k := j*d.blocksAcross + i
+			off, n := int64(d.blockOffsets[k]), int64(d.blockCounts[k])
+			if n == 0 {
+				continue
+			}
+			if leaders {
+				if off < 4 {
+					return FormatError(fmt.Sprintf("%s has no room for its leader", d.blockName(i, j)))
+				}
+				p, err := safeReadAt(d.r, 4, off-4)
+				if err != nil {
+					return err
+				}
+				if v := int64(d.byteOrder.Uint32(p)); v != n {
+					return FormatError(fmt.Sprintf("%s leader gives %d bytes, expected %d", d.blockName(i, j), v, n))
+				}
+			}
+			if trailers {
+				m := min(n, 4)
+				p, err := safeReadAt(d.r, uint64(m+4), off+n-m)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(blockTrailer(p[:m]), p[m:]) {
+					return FormatError(fmt.Sprintf("%s trailer does not repeat its last bytes", d.blockName(i, j)))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -29,7 +29,7 @@ func gray32Model(c color.Color) color.Color {
 	//
 	// Note that 19595 + 38470 + 7471 equals 65536.
 	//Need to fix let total = 4294967295,1284195221, 2521145802,489626272
-	y := (1284195221*uint32(r) + 2521145802*uint32(g) + 489626272*uint32(b) + 1<<31) >> 32
+	y := (1284195221*uint64(r) + 2521145802*uint64(g) + 489626272*uint64(b) + 1<<31) >> 32
 
 	return Gray32Color{Y: uint32(y)}
 }
@@ -57,7 +57,7 @@ func gray32FloatModel(c color.Color) color.Color {
 	//
 	// Note that 19595 + 38470 + 7471 equals 65536.
 	//Need to fix let total = 4294967295,1284195221, 2521145802,489626272
-	y := (1284195221*uint32(r) + 2521145802*uint32(g) + 489626272*uint32(b) + 1<<31) >> 32
+	y := (1284195221*uint64(r) + 2521145802*uint64(g) + 489626272*uint64(b) + 1<<31) >> 32
 
 	return Gray32Color{Y: uint32(y)}
 }
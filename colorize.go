@@ -0,0 +1,223 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"slices"
+	"sort"
+)
+
+// A ColorStop is a color of a ColorRamp and the position it is at, from 0
+// for the low end of the ramp to 1 for the high end.
+type ColorStop struct {
+	At    float64
+	Color color.NRGBA
+}
+
+// A ColorRamp maps the values of a raster, once stretched between 0 and 1,
+// to colors. Values between two stops are given a blend of their colors,
+// and values beyond the first or last stop the color of that stop.
+type ColorRamp struct {
+	// Stops are the colors of the ramp, by increasing position. There
+	// must be at least one.
+	Stops []ColorStop
+	// Discrete makes values take the color of the last stop at or below
+	// them instead of a blend, as for the classes of a lookup table.
+	Discrete bool
+}
+
+// The built-in ramps.
+var (
+	// GrayscaleRamp goes from black to white.
+	GrayscaleRamp = ColorRamp{Stops: []ColorStop{
+		{0, color.NRGBA{0, 0, 0, 255}},
+		{1, color.NRGBA{255, 255, 255, 255}},
+	}}
+	// ViridisRamp is the perceptually uniform ramp of matplotlib, from
+	// dark blue through green to yellow.
+	ViridisRamp = ColorRamp{Stops: []ColorStop{
+		{0, color.NRGBA{0x44, 0x01, 0x54, 255}},
+		{0.125, color.NRGBA{0x48, 0x28, 0x78, 255}},
+		{0.25, color.NRGBA{0x3e, 0x49, 0x89, 255}},
+		{0.375, color.NRGBA{0x31, 0x68, 0x8e, 255}},
+		{0.5, color.NRGBA{0x26, 0x82, 0x8e, 255}},
+		{0.625, color.NRGBA{0x1f, 0x9e, 0x89, 255}},
+		{0.75, color.NRGBA{0x35, 0xb7, 0x79, 255}},
+		{0.875, color.NRGBA{0x6e, 0xce, 0x58, 255}},
+		{1, color.NRGBA{0xfd, 0xe7, 0x25, 255}},
+	}}
+	// TerrainRamp is the elevation ramp of matplotlib, from sea blue
+	// through green lowlands and brown uplands to white peaks.
+	TerrainRamp = ColorRamp{Stops: []ColorStop{
+		{0, color.NRGBA{0x33, 0x33, 0x99, 255}},
+		{0.15, color.NRGBA{0x00, 0x99, 0xff, 255}},
+		{0.25, color.NRGBA{0x00, 0xcc, 0x66, 255}},
+		{0.5, color.NRGBA{0xff, 0xff, 0x99, 255}},
+		{0.75, color.NRGBA{0x80, 0x5c, 0x54, 255}},
+		{1, color.NRGBA{0xff, 0xff, 0xff, 255}},
+	}}
+)
+
+// LookupTable returns a discrete ramp of the given colors, spread evenly
+// from 0 to 1, such as a palette of 256 entries indexed by a stretched
+// value.
+func LookupTable(colors []color.NRGBA) ColorRamp {
+	r := ColorRamp{Stops: make([]ColorStop, len(colors)), Discrete: true}
+	for i, c := range colors {
+		r.Stops[i] = ColorStop{float64(i) / float64(len(colors)), c}
+	}
+	return r
+}
+
+// at returns the color of the ramp at position t.
+func (r ColorRamp) at(t float64) color.NRGBA {
+	s := r.Stops
+	// i is the number of stops at or below t.
+	i := sort.Search(len(s), func(i int) bool { return s[i].At > t })
+	switch {
+	case i == 0:
+		return s[0].Color
+	case i == len(s) || r.Discrete:
+		return s[i-1].Color
+	}
+	a, b := s[i-1], s[i]
+	f := (t - a.At) / (b.At - a.At)
+	mix := func(x, y uint8) uint8 {
+		return uint8(math.Round(float64(x) + f*(float64(y)-float64(x))))
+	}
+	return color.NRGBA{mix(a.Color.R, b.Color.R), mix(a.Color.G, b.Color.G), mix(a.Color.B, b.Color.B), mix(a.Color.A, b.Color.A)}
+}
+
+// A Stretch gives the values of a raster mapped to the ends of a
+// ColorRamp.
+type Stretch struct {
+	// Min and Max are the values mapped to the low and high ends of the
+	// ramp; Min may be above Max to reverse it. If they are equal, as in
+	// the zero Stretch, they are the lowest and highest samples of the
+	// image, save for those left out by Clip.
+	Min, Max float64
+	// Clip is the fraction of the samples, from 0 to 0.5, left out at each
+	// end when Min and Max are worked out, such as 0.02 for the common 2%
+	// stretch that keeps outliers from washing out the image.
+	Clip float64
+	// NoData, if not nil, is the value of samples holding no data.
+	NoData *float64
+}
+
+// Colorize renders img, a raster of floating point samples, as a color
+// image of the same bounds: each sample is stretched as s says and given
+// the color of ramp at the result. NaN samples and those holding the
+// NoData value of s are transparent.
+func Colorize(img *GrayFloat32, ramp ColorRamp, s Stretch) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(b)
+	lo, hi, ok := s.bounds(img)
+	if !ok {
+		return dst
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := dst.Pix[dst.PixOffset(b.Min.X, y):]
+		for i, v := range img.Pix[img.PixOffset(b.Min.X, y):][:b.Dx()] {
+			f := float64(math.Float32frombits(v))
+			if s.noData(f) {
+				continue
+			}
+			t := 0.5
+			if lo != hi {
+				t = (f - lo) / (hi - lo)
+			}
+			c := ramp.at(t)
+			row[4*i], row[4*i+1], row[4*i+2], row[4*i+3] = c.R, c.G, c.B, c.A
+		}
+	}
+	return dst
+}
+
+// noData reports whether v holds no data: it is NaN or the NoData value of
+// s.
+func (s Stretch) noData(v float64) bool {
+	return math.IsNaN(v) || s.NoData != nil && v == *s.NoData
+}
+
+// bounds returns the values mapped to the ends of a ramp by s for the
+// samples of imgs, taken together: Min and Max, or those worked out from
+// the samples if they are equal. ok is false if they are to be worked out
+// but all the samples hold no data.
+func (s Stretch) bounds(imgs ...*GrayFloat32) (lo, hi float64, ok bool) {
+	if s.Min != s.Max {
+		return s.Min, s.Max, true
+	}
+	var vals []float64
+	for _, img := range imgs {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for _, v := range img.Pix[img.PixOffset(b.Min.X, y):][:b.Dx()] {
+				if f := float64(math.Float32frombits(v)); !s.noData(f) {
+					vals = append(vals, f)
+				}
+			}
+		}
+	}
+	if len(vals) == 0 {
+		return 0, 0, false
+	}
+	slices.Sort(vals)
+	k := int(min(max(s.Clip, 0), 0.5) * float64(len(vals)-1))
+	return vals[k], vals[len(vals)-1-k], true
+}
+
+// Legend returns a strip of size pixels showing the colors that Colorize
+// gives the values from lo to hi stretched by Stretch{Min: lo, Max: hi},
+// for a raster colorized with ramp. The values increase from left to right
+// in a strip wider than high, and from bottom to top otherwise, so that a
+// reversed stretch shows the ramp reversed.
+func Legend(ramp ColorRamp, lo, hi float64, size image.Point) (*image.NRGBA, error) {
+	if size.X <= 0 || size.Y <= 0 {
+		return nil, fmt.Errorf("tiff: invalid legend size %v", size)
+	}
+	if d := hi - lo; d == 0 || math.IsNaN(d) || math.IsInf(d, 0) {
+		return nil, fmt.Errorf("tiff: invalid legend range %g to %g", lo, hi)
+	}
+	if len(ramp.Stops) == 0 {
+		return nil, errors.New("tiff: legend of a ramp without stops")
+	}
+	dst := image.NewNRGBA(image.Rectangle{Max: size})
+	n, horizontal := size.Y, size.X > size.Y
+	if horizontal {
+		n = size.X
+	}
+	low, high := min(lo, hi), max(lo, hi)
+	for i := 0; i < n; i++ {
+		// The value at the center of the i-th pixel from the low end.
+		v := low + (float64(i)+0.5)/float64(n)*(high-low)
+		c := ramp.at((v - lo) / (hi - lo))
+		if horizontal {
+			for y := 0; y < size.Y; y++ {
+				dst.SetNRGBA(i, y, c)
+			}
+		} else {
+			for x := 0; x < size.X; x++ {
+				dst.SetNRGBA(x, size.Y-1-i, c)
+			}
+		}
+	}
+	return dst, nil
+}
+
+// EncodeLegend writes the Legend of ramp from lo to hi to w as a PNG image.
+func EncodeLegend(w io.Writer, ramp ColorRamp, lo, hi float64, size image.Point) error {
+	m, err := Legend(ramp, lo, hi, size)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, m)
+}
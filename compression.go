@@ -0,0 +1,57 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// compressionNames holds the common names of the registered Compression
+// codes, used to describe the codes in error messages.
+var compressionNames = map[uint]string{
+	CompressionNone:        "none",
+	CompressionCCITTRLE:    "CCITT RLE",
+	CompressionCCITTGroup3: "CCITT Group 3",
+	CompressionCCITTGroup4: "CCITT Group 4",
+	CompressionLZW:         "LZW",
+	CompressionOldJPEG:     "old-style JPEG",
+	CompressionJPEG:        "JPEG",
+	CompressionDeflate:     "Deflate",
+	9:                      "JBIG B&W",
+	10:                     "JBIG color",
+	CompressionPackBits:    "PackBits",
+	CompressionOldDeflate:  "old-style Deflate",
+	34661:                  "JBIG",
+	34676:                  "SGI LogLuv",
+	CompressionJPEG2000:    "JPEG 2000",
+	CompressionLERC:        "LERC",
+	CompressionLZMA:        "LZMA",
+	CompressionZSTD:        "ZSTD",
+	CompressionWebP:        "WebP",
+	50002:                  "JPEG XL",
+}
+
+// decodableCompressions lists the Compression codes the decoder handles.
+var decodableCompressions = []uint{CompressionNone, CompressionLZW, CompressionJPEG, CompressionDeflate,
+	CompressionOldDeflate, CompressionLERC, CompressionLZMA, CompressionZSTD}
+
+// compressionString describes the Compression code c, for example
+// "JPEG (7)".
+func compressionString(c uint) string {
+	if name, ok := compressionNames[c]; ok {
+		return fmt.Sprintf("%s (%d)", name, c)
+	}
+	return fmt.Sprintf("unknown (%d)", c)
+}
+
+// compressionList describes the Compression codes in cs.
+func compressionList(cs []uint) string {
+	s := make([]string, len(cs))
+	for i, c := range cs {
+		s[i] = compressionString(c)
+	}
+	return strings.Join(s, ", ")
+}
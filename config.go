@@ -0,0 +1,74 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"io"
+)
+
+// A Config describes how the pixels of a TIFF image are stored, beyond the
+// color model and dimensions of its image.Config, so that the work and
+// memory of decoding a large raster can be planned for beforehand.
+type Config struct {
+	image.Config
+	BitsPerSample   int // The size of each sample in bits.
+	SamplesPerPixel int
+	SampleFormat    int // One of the SampleFormat values.
+	Photometric     int // The PhotometricInterpretation of the image.
+	Compression     int // One of the Compression values.
+	Predictor       int // One of the Predictor values.
+	// Tiled tells whether the pixels are stored in tiles rather than in
+	// strips.
+	Tiled bool
+	// BlockSize is the size of a tile, or of a strip: the width of the
+	// image and its rows per strip.
+	BlockSize image.Point
+	// Blocks is the number of tiles across and down the image, or 1 and
+	// the number of strips.
+	Blocks image.Point
+}
+
+// DecodeConfig returns the Config of the first image of the TIFF file in
+// r, reading its IFD only, not the tables of its strips or tiles nor its
+// pixels.
+func DecodeConfig(r io.Reader) (Config, error) {
+	d, err := newDecoder(newReaderAt(r), nil)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := d.setBlockSize(); err != nil {
+		return Config{}, err
+	}
+	return d.fullConfig(), nil
+}
+
+// FullConfig returns the Config of the image.
+func (r *Reader) FullConfig() Config {
+	return r.d.fullConfig()
+}
+
+// fullConfig returns the Config of the image once its block size is set.
+func (d *decoder) fullConfig() Config {
+	c := Config{
+		Config:          d.config,
+		BitsPerSample:   d.bitsPerSample,
+		SamplesPerPixel: d.samplesPerPixel,
+		SampleFormat:    int(d.sampleFormat),
+		Photometric:     int(d.firstVal(TagPhotometricInterpretation)),
+		Compression:     CompressionNone,
+		Predictor:       PredictorNone,
+		Tiled:           d.blockPadding,
+		BlockSize:       image.Pt(d.blockWidth, d.blockHeight),
+		Blocks:          image.Pt(d.blocksAcross, d.blocksDown),
+	}
+	if v := d.firstVal(TagCompression); v != 0 {
+		c.Compression = int(v)
+	}
+	if v := d.firstVal(TagPredictor); v != 0 {
+		c.Predictor = int(v)
+	}
+	return c
+}
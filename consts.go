@@ -0,0 +1,232 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+// A tiff image file contains one or more images. The metadata
+// of each image is contained in an Image File Directory (IFD),
+// which contains entries of 12 bytes each and is described
+// on page 14-16 of the specification. An IFD entry consists of
+//
+//   - a tag, which describes the signification of the entry,
+//   - the data type and length of the entry,
+//   - the data itself or a pointer to it if it is more than 4 bytes.
+//
+// The presence of a length means that each IFD is effectively an array.
+
+const (
+	leHeader = "II\x2A\x00" // Header for little-endian files.
+	beHeader = "MM\x00\x2A" // Header for big-endian files.
+
+	// Headers of BigTIFF files, followed by the size of their offsets.
+	leBigHeader = "II\x2B\x00\x08\x00\x00\x00"
+	beBigHeader = "MM\x00\x2B\x00\x08\x00\x00"
+
+	ifdLen    = 12 // Length of an IFD entry in bytes.
+	bigIFDLen = 20 // Length of an IFD entry of BigTIFF in bytes.
+)
+
+// Data types (p. 14-16 of the spec).
+const (
+	TypeByte      = 1
+	TypeASCII     = 2
+	TypeShort     = 3
+	TypeLong      = 4
+	TypeRational  = 5
+	TypeSByte     = 6
+	TypeUndefined = 7
+	TypeSShort    = 8
+	TypeSLong     = 9
+	TypeSRational = 10
+	TypeFloat     = 11
+	TypeDouble    = 12
+
+	// TypeIFD, of TIFF Technical Note 1, is for offsets of IFDs, which are
+	// otherwise LONGs.
+	TypeIFD = 13
+
+	// The 64-bit types of BigTIFF, which classic TIFF files cannot hold.
+	TypeLong8  = 16
+	TypeSLong8 = 17
+	TypeIFD8   = 18
+)
+
+// The length of one instance of each data type in bytes, or 0 for the
+// types not defined.
+var lengths = [...]uint32{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4, 0, 0, 8, 8, 8}
+
+// knownType reports whether datatype is one of the data types of lengths.
+func knownType(datatype int) bool {
+	return datatype > 0 && datatype < len(lengths) && lengths[datatype] != 0
+}
+
+// Tags (see p. 28-41 of the spec).
+const (
+	TagNewSubfileType            = 254
+	TagSubfileType               = 255
+	TagImageWidth                = 256
+	TagImageLength               = 257
+	TagBitsPerSample             = 258
+	TagCompression               = 259
+	TagPhotometricInterpretation = 262
+	TagFillOrder                 = 266
+
+	TagDocumentName     = 269
+	TagImageDescription = 270
+	TagMake             = 271
+	TagModel            = 272
+
+	TagStripOffsets    = 273
+	TagOrientation     = 274
+	TagSamplesPerPixel = 277
+	TagRowsPerStrip    = 278
+	TagStripByteCounts = 279
+	TagMinSampleValue  = 280
+	TagMaxSampleValue  = 281
+
+	TagXResolution         = 282
+	TagYResolution         = 283
+	TagPlanarConfiguration = 284
+	TagPageName            = 285
+	TagResolutionUnit      = 296
+	TagPageNumber          = 297
+
+	TagSoftware     = 305
+	TagDateTime     = 306
+	TagArtist       = 315
+	TagHostComputer = 316
+
+	TagPredictor = 317
+	TagColorMap  = 320
+
+	TagTileWidth      = 322
+	TagTileLength     = 323
+	TagTileOffsets    = 324
+	TagTileByteCounts = 325
+
+	TagSubIFDs         = 330
+	TagInkSet          = 332
+	TagExtraSamples    = 338
+	TagSampleFormat    = 339
+	TagSMinSampleValue = 340
+	TagSMaxSampleValue = 341
+	TagJPEGTables      = 347
+
+	TagYCbCrCoefficients   = 529
+	TagYCbCrSubSampling    = 530
+	TagYCbCrPositioning    = 531
+	TagReferenceBlackWhite = 532
+
+	TagCopyright = 33432
+
+	// SGI fields of volumes, whose slices are stored one after the other
+	// in a single image.
+	TagImageDepth = 32997
+	TagTileDepth  = 32998
+
+	// Pointers to private IFDs.
+	TagExifIFD             = 34665
+	TagGPSIFD              = 34853
+	TagInteroperabilityIFD = 40965
+
+	// GeoTIFF and GDAL fields.
+	TagModelPixelScale     = 33550
+	TagModelTiepoint       = 33922
+	TagModelTransformation = 34264
+	TagGeoKeyDirectory     = 34735
+	TagGeoDoubleParams     = 34736
+	TagGeoAsciiParams      = 34737
+	TagGDALMetadata        = 42112
+	TagGDALNoData          = 42113
+	TagLercParameters      = 50674
+
+	// TagZSTDDictionary is a private field of the package, in the range
+	// of reusable tags, holding the dictionary shared by the ZSTD
+	// compressed tiles of an image.
+	TagZSTDDictionary = 65000
+	// TagBlockChecksums is a private field of the package holding the
+	// xxHash64 of the stored data of each strip or tile of an image, as 8
+	// little-endian bytes per block in the order of the table of offsets.
+	TagBlockChecksums = 65001
+)
+
+// Compression types (defined in various places in the spec and elsewhere).
+const (
+	CompressionNone        = 1
+	CompressionCCITTRLE    = 2
+	CompressionCCITTGroup3 = 3
+	CompressionCCITTGroup4 = 4
+	CompressionLZW         = 5
+	CompressionOldJPEG     = 6
+	CompressionJPEG        = 7
+	CompressionDeflate     = 8 // zlib compression.
+	CompressionPackBits    = 32773
+	CompressionOldDeflate  = 32946
+	CompressionJPEG2000    = 34712
+	CompressionLERC        = 34887
+	CompressionLZMA        = 34925
+	CompressionZSTD        = 50000
+	CompressionWebP        = 50001
+)
+
+// Photometric interpretation values (see p. 37 of the spec).
+const (
+	PhotometricWhiteIsZero = 0
+	PhotometricBlackIsZero = 1
+	PhotometricRGB         = 2
+	PhotometricPaletted    = 3
+	PhotometricTransMask   = 4 // transparency mask
+	PhotometricCMYK        = 5
+	PhotometricYCbCr       = 6
+	PhotometricCIELab      = 8
+)
+
+// Values for the ExtraSamples tag (page 31 of the spec).
+const (
+	ExtraSamplesUnspecified       = 0
+	ExtraSamplesAssociatedAlpha   = 1 // Premultiplied alpha.
+	ExtraSamplesUnassociatedAlpha = 2 // Straight alpha.
+)
+
+// Values for the FillOrder tag (page 32 of the spec).
+const (
+	FillOrderMSB2LSB = 1 // The most significant bit of a byte comes first.
+	FillOrderLSB2MSB = 2 // The bits of every byte are reversed.
+)
+
+// Values for the Predictor tag (page 64-65 of the spec).
+const (
+	PredictorNone          = 1
+	PredictorHorizontal    = 2
+	PredictorFloatingPoint = 3 // Adobe Photoshop TIFF Technical Note 3.
+)
+
+// Values for the SampleFormat tag (page 80 of the spec).
+const (
+	SampleFormatUint   = 1
+	SampleFormatInt    = 2
+	SampleFormatIEEEFP = 3
+	SampleFormatVoid   = 4
+)
+
+// Values for the Orientation tag (page 36 of the spec), naming the sides of
+// the visual image the first row and the first column of the stored image
+// stand for.
+const (
+	OrientationTopLeft     = 1 // The default, stored as shown.
+	OrientationTopRight    = 2 // Mirrored horizontally.
+	OrientationBottomRight = 3 // Rotated by 180°.
+	OrientationBottomLeft  = 4 // Mirrored vertically.
+	OrientationLeftTop     = 5 // Transposed.
+	OrientationRightTop    = 6 // To be rotated by 90° clockwise.
+	OrientationRightBottom = 7 // Transposed across the other diagonal.
+	OrientationLeftBottom  = 8 // To be rotated by 90° counterclockwise.
+)
+
+// Values for the ResolutionUnit tag (page 38 of the spec).
+const (
+	ResolutionUnitNone       = 1
+	ResolutionUnitInch       = 2
+	ResolutionUnitCentimeter = 3
+)
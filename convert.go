@@ -0,0 +1,122 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+
+	"golang.org/x/image/tiff"
+)
+
+// EncodeAny writes the image m to w like Encode, but accepts an image of
+// any type, using opt as for Encode.
+func EncodeAny(w io.Writer, m image.Image, opt *tiff.Options) error {
+	e := &Encoder{Options: opt}
+	return e.EncodeAny(w, m)
+}
+
+// EncodeAny writes the image m to w like Encode, but accepts an image of
+// any type. An image of a type Encode supports is written as it is; any
+// other is first converted, through the color models, to the closest of
+// them:
+//
+//   - an image with the color model of the gray types of the standard
+//     library or of Gray32 to a *Gray32, whose samples keep the 16-bit
+//     scale of color.Color;
+//   - an image with the Gray32FloatModel to a *GrayFloat32;
+//   - an image with the color.RGBA64Model or color.NRGBA64Model to an
+//     *image.RGBA64 or *image.NRGBA64, so that no precision is lost;
+//   - an image with the color.NRGBAModel to an *image.NRGBA, and any other,
+//     such as a paletted, CMYK or YCbCr one, to an *image.RGBA.
+func (e *Encoder) EncodeAny(w io.Writer, m image.Image) error {
+	if m != nil {
+		var err error
+		if m, err = toEncodable(m); err != nil {
+			return err
+		}
+	}
+	return e.Encode(w, m)
+}
+
+// toEncodable returns m if the encoder can write it, or a copy of m
+// converted to the closest image type it can. Images too large to be
+// written are reported before any copy is made.
+func toEncodable(m image.Image) (image.Image, error) {
+	switch m.(type) {
+	case *Gray32, *GrayFloat32, *image.RGBA, *image.NRGBA, *image.RGBA64, *image.NRGBA64:
+		return m, nil
+	}
+
+	b := m.Bounds()
+	if err := checkSize(b.Dx(), b.Dy()); err != nil {
+		return nil, err
+	}
+	// Every image type written has pixels of at least 4 bytes.
+	if _, err := classicImageLen(b.Dx(), b.Dy(), 4); err != nil {
+		return nil, err
+	}
+	switch m.ColorModel() {
+	case Gray32Model, color.GrayModel, color.Gray16Model:
+		dst := NewGray32(b)
+		switch m := m.(type) {
+		case *image.Gray:
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				pix := dst.Pix[dst.PixOffset(b.Min.X, y):]
+				for x, v := range m.Pix[m.PixOffset(b.Min.X, y):][:b.Dx()] {
+					pix[x] = uint32(v) * 0x101
+				}
+			}
+		case *image.Gray16:
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				pix := dst.Pix[dst.PixOffset(b.Min.X, y):]
+				row := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < b.Dx(); x++ {
+					pix[x] = uint32(row[2*x])<<8 | uint32(row[2*x+1])
+				}
+			}
+		default:
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					dst.SetGray32(x, y, Gray32Model.Convert(m.At(x, y)).(Gray32Color))
+				}
+			}
+		}
+		return dst, nil
+	case Gray32FloatModel:
+		dst := NewGrayFloat32(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			pix := dst.Pix[dst.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				switch c := m.At(b.Min.X+x, y).(type) {
+				case GrayFloat32Color:
+					pix[x] = c.Y
+				default:
+					// Other colors are taken as a luminance in [0, 1].
+					v := Gray32Model.Convert(c).(Gray32Color).Y
+					pix[x] = math.Float32bits(float32(v) / 0xffff)
+				}
+			}
+		}
+		return dst, nil
+	}
+
+	var dst draw.Image
+	switch m.ColorModel() {
+	case color.RGBA64Model:
+		dst = image.NewRGBA64(b)
+	case color.NRGBA64Model:
+		dst = image.NewNRGBA64(b)
+	case color.NRGBAModel:
+		dst = image.NewNRGBA(b)
+	default:
+		dst = image.NewRGBA(b)
+	}
+	draw.Draw(dst, b, m, b.Min, draw.Src)
+	return dst, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// diskCacheChunk is the size of the pieces of a file a DiskCache fetches
+// and stores, aligned on multiples of it.
+const diskCacheChunk = 256 << 10
+
+// A DiskCache is an io.ReaderAt keeping the bytes it reads from another,
+// such as a file in object storage read over HTTP, in a directory, so that
+// reading them again, even from another process or after a restart, does
+// not fetch them anew. The file is read in aligned chunks of 256KB, each
+// stored in a file of its own named after the key of the DiskCache and its
+// position, so that any range read again is served from the directory.
+//
+// Unless the io.ReaderAt is a VersionedReaderAt, the key must change
+// whenever the contents of the file do, for example by joining its URL
+// and its ETag, or a stale copy is read. Nothing is ever
+// removed from the directory but by Clear; the files may be deleted at
+// any time, to bound its size, and are then fetched again. A DiskCache is
+// safe for concurrent use if the io.ReaderAt it reads from is, and several
+// may share a directory.
+//
+// If the io.ReaderAt is a VersionedReaderAt, each chunk is stored with the
+// version of the file it was read from, and all the chunks read must be of
+// the same version, as for a PinnedReaderAt: a chunk stored for another
+// version is fetched anew, and a chunk fetched of another version fails the
+// read with a ChangedError. The version is that of the first chunk read,
+// or that of the PinnedReaderAt read from if it knows it already, so that
+// pinning the version announced by the server, as from a HEAD request,
+// makes the cache check every stored chunk against it.
+type DiskCache struct {
+	// Metrics, if it is a CacheMetrics, is told whether each chunk read was
+	// found in the directory. It must be set before the first read.
+	Metrics Metrics
+
+	r      io.ReaderAt
+	dir    string
+	prefix string // Of the names of the files, from the key.
+	pin    versionPin
+}
+
+// NewDiskCache returns a DiskCache reading r through the directory dir,
+// which is created if need be, for the file identified by key.
+func NewDiskCache(r io.ReaderAt, dir, key string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(key))
+	c := &DiskCache{r: r, dir: dir, prefix: hex.EncodeToString(sum[:16])}
+	if p, ok := r.(*PinnedReaderAt); ok {
+		c.pin.version = p.Version()
+	}
+	return c, nil
+}
+
+// ReadAt reads len(p) bytes at off, from the directory if they were read
+// before and from the underlying io.ReaderAt otherwise.
+func (c *DiskCache) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("tiff: negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk, err := c.chunk(pos / diskCacheChunk)
+		if err != nil {
+			return n, err
+		}
+		start := int(pos % diskCacheChunk)
+		if start >= len(chunk) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], chunk[start:])
+		if len(chunk) < diskCacheChunk && n < len(p) {
+			// A short chunk is the last of the file.
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// chunk returns chunk i of the file, from the directory if it holds it,
+// and fetched and stored there otherwise. The last chunk of the file is
+// short.
+//
+// A chunk is stored after a line holding the version of the file it was
+// read from, empty if it is unknown.
+func (c *DiskCache) chunk(i int64) ([]byte, error) {
+	name := filepath.Join(c.dir, fmt.Sprintf("%s-%d", c.prefix, i))
+	if b, err := os.ReadFile(name); err == nil {
+		if v, data, ok := bytes.Cut(b, []byte("\n")); ok && c.pin.match(string(v)) {
+			cacheLookup(c.Metrics, true)
+			return data, nil
+		}
+	}
+	cacheLookup(c.Metrics, false)
+	b := make([]byte, diskCacheChunk)
+	var (
+		n   int
+		v   string
+		err error
+	)
+	if vr, ok := c.r.(VersionedReaderAt); ok {
+		n, v, err = vr.ReadAtVersion(b, i*diskCacheChunk)
+	} else {
+		n, err = c.r.ReadAt(b, i*diskCacheChunk)
+	}
+	// An io.ReaderAt may return io.EOF with the last bytes of the file,
+	// even a full chunk of them: the chunk is then stored like any other,
+	// and no bytes at all make an empty chunk past the end of the file.
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !c.pin.match(v) {
+		return nil, ChangedError{c.pin.get(), v}
+	}
+	b = b[:n]
+	// The chunk is written under another name and renamed, so that a
+	// chunk cut short by a crash or read while written is never seen.
+	// Failing to store it only costs fetching it again.
+	if f, err := os.CreateTemp(c.dir, c.prefix+"-*.tmp"); err == nil {
+		_, werr := f.Write(append([]byte(v+"\n"), b...))
+		if cerr := f.Close(); werr == nil && cerr == nil {
+			werr = os.Rename(f.Name(), name)
+		}
+		if werr != nil {
+			os.Remove(f.Name())
+		}
+	}
+	return b, nil
+}
+
+// Version returns the version of the file the chunks read are of, or "" if
+// none is known yet.
+func (c *DiskCache) Version() string { return c.pin.get() }
+
+// Clear removes the chunks of the file from the directory.
+func (c *DiskCache) Clear() error {
+	names, err := filepath.Glob(filepath.Join(c.dir, c.prefix+"-*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
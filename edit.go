@@ -0,0 +1,262 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+// An EditSession edits the pixels of an image of a TIFF file without
+// modifying the file. The strips or tiles written to are held in memory in
+// place of those of the file, which is only read, until Commit writes the
+// edited file anew. Only the blocks touched are decoded, so that small
+// edits of large tiled images, such as cloud optimized GeoTIFFs, are cheap.
+//
+// An EditSession is not safe for concurrent use.
+type EditSession struct {
+	r io.ReaderAt
+	d *decoder
+	// The samples of the edited blocks, by index, as stored but neither
+	// compressed nor predicted.
+	edited map[int][]byte
+}
+
+// NewEditSession starts editing the image of the TIFF file in r chosen by
+// opt, which may be nil. The file must be little-endian, and the image
+// uncompressed or Deflate compressed, since Commit stores the edited
+// blocks like the others.
+func NewEditSession(r io.ReaderAt, opt *ReaderOptions) (*EditSession, error) {
+	d, err := newDecoder(r, opt)
+	if err != nil {
+		return nil, err
+	}
+	if d.byteOrder != binary.ByteOrder(binary.LittleEndian) {
+		return nil, UnsupportedError{Feature: "editing a big-endian file"}
+	}
+	if err := d.parseLayout(); err != nil {
+		return nil, err
+	}
+	if c := d.firstVal(TagCompression); c != 0 && c != CompressionNone && c != CompressionDeflate {
+		return nil, UnsupportedError{"editing an image with compression", TagCompression, c}
+	}
+	return &EditSession{r: r, d: d, edited: make(map[int][]byte)}, nil
+}
+
+// Bounds returns the bounds of the image.
+func (s *EditSession) Bounds() image.Rectangle {
+	return image.Rect(0, 0, s.d.config.Width, s.d.config.Height)
+}
+
+// ReadRegion decodes the part of the edited image inside rect, as
+// Reader.ReadRegion does.
+func (s *EditSession) ReadRegion(rect image.Rectangle) (image.Image, error) {
+	d := s.d
+	rect = rect.Intersect(s.Bounds())
+	img, err := d.newImage(rect)
+	if err != nil {
+		return nil, err
+	}
+	if rect.Empty() {
+		return img, nil
+	}
+	if err := d.readRegion(img); err != nil {
+		return nil, err
+	}
+	for k, buf := range s.edited {
+		b := d.blockBounds(k%d.blocksAcross, k/d.blocksAcross)
+		if !b.Overlaps(rect) {
+			continue
+		}
+		// unpack may modify the data it is given.
+		if err := d.unpack(append([]byte(nil), buf...), img, b); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// WriteRegion overwrites the pixels inside rect of the image with those of
+// src at the same coordinates. rect must lie within both the image and
+// src, and the image must be of a kind the package function WriteRegion
+// can write into, whose description also tells how src is converted.
+func (s *EditSession) WriteRegion(rect image.Rectangle, src image.Image) error {
+	d := s.d
+	if rect.Empty() {
+		return nil
+	}
+	if !rect.In(s.Bounds()) || !rect.In(src.Bounds()) {
+		return fmt.Errorf("tiff: region %v outside of the image or the source", rect)
+	}
+	put, err := d.samplePutter(src)
+	if err != nil {
+		return err
+	}
+	size := d.bitsPerSample / 8
+	blockRow := d.rowBytes(d.blockWidth)
+	for j := rect.Min.Y / d.blockHeight; j*d.blockHeight < rect.Max.Y; j++ {
+		for i := rect.Min.X / d.blockWidth; i*d.blockWidth < rect.Max.X; i++ {
+			buf, err := s.block(i, j)
+			if err != nil {
+				return err
+			}
+			b := d.blockBounds(i, j)
+			c := b.Intersect(rect)
+			for y := c.Min.Y; y < c.Max.Y; y++ {
+				// Appending to an empty slice of the row overwrites it.
+				row := buf[(y-b.Min.Y)*blockRow+(c.Min.X-b.Min.X)*size:][:0]
+				for x := c.Min.X; x < c.Max.X; x++ {
+					row = put(row, x, y)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// block returns the samples of block (i, j) for editing, reading them
+// from the file the first time.
+func (s *EditSession) block(i, j int) ([]byte, error) {
+	d := s.d
+	k := j*d.blocksAcross + i
+	if buf, ok := s.edited[k]; ok {
+		return buf, nil
+	}
+	want := d.blockSize(i, j)
+	var buf []byte
+	if d.uncompressed() {
+		var err error
+		n := min(int64(d.blockCounts[k]), want)
+		if buf, err = safeReadAt(d.r, uint64(n), int64(d.blockOffsets[k])); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := d.inflate(&d.state, i, j, nil); err != nil {
+			return nil, err
+		}
+		buf = append([]byte(nil), d.state.buf...)
+	}
+	if int64(len(buf)) < want {
+		return nil, errNoPixels
+	}
+	buf = buf[:want]
+	if d.predicted() {
+		if err := d.unpredict(buf, d.blockBounds(i, j)); err != nil {
+			return nil, err
+		}
+	}
+	s.edited[k] = buf
+	return buf, nil
+}
+
+// Commit writes the edited file to w: all the images of the file, with the
+// edited blocks compressed as the image is and the others copied as they
+// are. Overviews are copied unchanged, and can be brought up to date with
+// RegenerateOverviews once the file is written. Images pointing to
+// SubIFDs are not supported. The session can go on after Commit.
+func (s *EditSession) Commit(w io.Writer) error {
+	d := s.d
+	chain, err := d.ifdChain()
+	if err != nil {
+		return err
+	}
+
+	// As in EncodeAll, each IFD precedes the data it describes, here with
+	// the IFDs it points to in between.
+	var header [8]byte
+	copy(header[:], leHeader)
+	enc.PutUint32(header[4:], 8)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	off := int64(8)
+	for i := range chain {
+		t, err := readIFDTree(s.r, binary.LittleEndian, chain[i], 0)
+		if err != nil {
+			return err
+		}
+		var offsets, counts, sums *ifdEntry
+		for k := range t.entries {
+			switch e := &t.entries[k]; e.tag {
+			case TagSubIFDs:
+				return UnsupportedError{Feature: "committing SubIFDs"}
+			case TagStripOffsets, TagTileOffsets:
+				offsets = e
+			case TagStripByteCounts, TagTileByteCounts:
+				counts = e
+			case TagBlockChecksums:
+				sums = e
+			}
+		}
+		if offsets == nil || counts == nil || len(offsets.data) != len(counts.data) {
+			return FormatError(fmt.Sprintf("image %d: bad strip or tile offsets", i))
+		}
+		src := offsets.data
+		sizes := append([]uint32(nil), counts.data...)
+		newOffsets := make([]uint32, len(sizes))
+		offsets.datatype, offsets.data = TypeLong, newOffsets
+		counts.datatype, counts.data = TypeLong, sizes
+		var edited *bytes.Buffer // The edited blocks, stored.
+		at := make(map[int]int)  // The start of each in edited.
+		if i == d.image && len(s.edited) > 0 {
+			edited = new(bytes.Buffer)
+			c := d.newBlockCompressor(uint32(max(d.firstVal(TagCompression), CompressionNone)),
+				uint32(d.firstVal(TagPredictor)), d.rowBytes(d.blockWidth))
+			for k := range sizes {
+				buf, ok := s.edited[k]
+				if !ok {
+					continue
+				}
+				at[k] = edited.Len()
+				// The edits must outlive the prediction.
+				if sizes[k], err = c.compress(edited, append([]byte(nil), buf...)); err != nil {
+					return err
+				}
+				if sums != nil {
+					if err := putBlockChecksum(sums, k, edited.Bytes()[at[k]:]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		dataOff := off + int64(t.size())
+		pos := uint64(dataOff)
+		for k, n := range sizes {
+			newOffsets[k] = uint32(pos)
+			pos += uint64(n)
+		}
+		if pos > math.MaxUint32 {
+			return UnsupportedError{Feature: "file too large for a classic TIFF file"}
+		}
+		dataLen := int(pos - uint64(dataOff))
+		next := int64(0)
+		if i < len(chain)-1 {
+			next = int64(pos) + int64(dataLen%2)
+		}
+		if err := t.write(w, off, next); err != nil {
+			return err
+		}
+		for k, n := range sizes {
+			if start, ok := at[k]; ok {
+				_, err = w.Write(edited.Bytes()[start:][:n])
+			} else {
+				_, err = io.CopyN(w, io.NewSectionReader(s.r, int64(src[k]), int64(n)), int64(n))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := writePad(w, dataLen); err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import "fmt"
+
+// A FormatError reports that the input is not a valid TIFF image.
+type FormatError string
+
+func (e FormatError) Error() string {
+	return "tiff: invalid format: " + string(e)
+}
+
+// An UnsupportedError reports that the input uses a valid but
+// unimplemented feature. Tag and Value identify the offending field when
+// the feature is selected by one, such as Compression or BitsPerSample;
+// otherwise Tag is zero.
+type UnsupportedError struct {
+	Feature string
+	Tag     int
+	Value   uint
+}
+
+func (e UnsupportedError) Error() string {
+	switch e.Tag {
+	case 0:
+		return "tiff: unsupported feature: " + e.Feature
+	case TagCompression:
+		return fmt.Sprintf("tiff: unsupported feature: %s %s (supported: %s)",
+			e.Feature, compressionString(e.Value), compressionList(decodableCompressions))
+	}
+	return fmt.Sprintf("tiff: unsupported feature: %s %d", e.Feature, e.Value)
+}
+
+// An InternalError reports that an internal error was encountered.
+type InternalError string
+
+func (e InternalError) Error() string {
+	return "tiff: internal error: " + string(e)
+}
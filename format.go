@@ -0,0 +1,670 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+)
+
+// A pixelFormat identifies how the samples of an image are stored and the
+// type of image they are decoded into.
+type pixelFormat int
+
+const (
+	formatGray32     pixelFormat = iota // *Gray32 or *GrayFloat32.
+	formatGray                          // *image.Gray, from 1, 2, 4 or 8 bits.
+	formatGray16                        // *image.Gray16.
+	formatPaletted                      // *image.Paletted, from 1, 2, 4 or 8 bits.
+	formatNRGBA                         // *image.NRGBA, from 8-bit RGB or RGBA.
+	formatNRGBA64                       // *image.NRGBA64, from 16-bit RGB or RGBA.
+	formatRGBA                          // *image.RGBA, from 8-bit RGBA with associated alpha.
+	formatRGBA64                        // *image.RGBA64, from 16-bit RGBA with associated alpha.
+	formatExpanded                      // *image.RGBA, from an expanded palette.
+	formatCMYK                          // *image.CMYK, from 8-bit CMYK.
+	formatYCbCr                         // *image.YCbCr, from 8-bit YCbCr.
+	formatQuantized                     // *GrayFloat32, from 16- or 32-bit signed samples.
+	formatPaletted16                    // *Gray32 with a Palette, from 16-bit indices.
+)
+
+// pixelBytes returns the size of a pixel of the images of format f.
+func (f pixelFormat) pixelBytes() int {
+	switch f {
+	case formatGray, formatPaletted:
+		return 1
+	case formatGray16:
+		return 2
+	case formatNRGBA64, formatRGBA64:
+		return 8
+	case formatYCbCr:
+		return 3
+	}
+	return 4
+}
+
+// setFormat works out the pixel format of the image from its IFD and sets
+// the color model of d.config accordingly.
+func (d *decoder) setFormat() error {
+	d.samplesPerPixel = 1
+	if spp := d.firstVal(TagSamplesPerPixel); spp > 1 {
+		d.samplesPerPixel = int(spp)
+		if pc := d.firstVal(TagPlanarConfiguration); pc > 1 {
+			return UnsupportedError{"PlanarConfiguration", TagPlanarConfiguration, pc}
+		}
+	}
+	// BitsPerSample defaults to 1 (p. 29 of the spec). It holds a value
+	// per sample, which must all be the same. A single value is taken for
+	// all samples, as other readers do, and so is the last of too few
+	// unless the decoder is strict.
+	d.bitsPerSample = 1
+	if bps := d.features[TagBitsPerSample]; len(bps) > 0 {
+		spp := d.samplesPerPixel
+		if len(bps) != 1 && len(bps) < spp && d.strict {
+			return FormatError(fmt.Sprintf("BitsPerSample has %d values for %d samples", len(bps), spp))
+		}
+		bps = bps[:min(len(bps), spp)]
+		d.bitsPerSample = int(bps[0])
+		for _, v := range bps[1:] {
+			if int(v) != d.bitsPerSample {
+				return UnsupportedError{Feature: fmt.Sprintf("samples of different sizes, BitsPerSample %v", bps)}
+			}
+		}
+	}
+	bps := d.bitsPerSample
+	spp := d.samplesPerPixel
+	switch pi := d.firstVal(TagPhotometricInterpretation); {
+	case pi == PhotometricRGB:
+		// Samples past the color ones are extra samples.
+	case pi == PhotometricCMYK, pi == PhotometricYCbCr:
+		if spp > 4 {
+			return UnsupportedError{"SamplesPerPixel", TagSamplesPerPixel, uint(spp)}
+		}
+	case spp > 1 && pi <= PhotometricBlackIsZero && (bps == 8 || bps == 16 || bps == 32):
+		// Images of several bands of gray samples, such as multispectral
+		// ones, are decoded a band at a time.
+	case spp > 1:
+		return UnsupportedError{"SamplesPerPixel", TagSamplesPerPixel, uint(spp)}
+	}
+
+	// SampleFormat defaults to unsigned integer data (p. 80 of the spec).
+	d.sampleFormat = SampleFormatUint
+	if v := d.firstVal(TagSampleFormat); d.forceFloat && bps == 32 {
+		d.sampleFormat = SampleFormatIEEEFP
+	} else if v != 0 {
+		d.sampleFormat = v
+	}
+	switch {
+	case d.sampleFormat == SampleFormatUint:
+	case d.sampleFormat == SampleFormatIEEEFP && bps == 32:
+	case d.sampleFormat == SampleFormatInt && (bps == 16 || bps == 32):
+		if pi := d.firstVal(TagPhotometricInterpretation); pi > PhotometricBlackIsZero {
+			return UnsupportedError{"signed samples with PhotometricInterpretation", TagPhotometricInterpretation, pi}
+		}
+	default:
+		return UnsupportedError{"SampleFormat", TagSampleFormat, d.sampleFormat}
+	}
+
+	switch pi := d.firstVal(TagPhotometricInterpretation); pi {
+	case PhotometricWhiteIsZero, PhotometricBlackIsZero, PhotometricTransMask:
+		// Masks are decoded as gray images.
+		d.invert = pi == PhotometricWhiteIsZero
+		if d.sampleFormat == SampleFormatInt {
+			if spp > 1 {
+				return UnsupportedError{"signed samples in several bands", TagSamplesPerPixel, uint(spp)}
+			}
+			if err := d.setQuantized(); err != nil {
+				return err
+			}
+			break
+		}
+		switch bps {
+		case 1, 2, 4, 8:
+			d.format = formatGray
+			d.config.ColorModel = color.GrayModel
+		case 16:
+			d.format = formatGray16
+			d.config.ColorModel = color.Gray16Model
+		case 32:
+			// 32-bit samples, which have no maximum to be inverted
+			// against when floating point, are decoded as they are;
+			// Reader.Photometric tells how they are meant to be shown.
+			d.invert = false
+			d.format = formatGray32
+			d.config.ColorModel = Gray32Model
+			if d.sampleFormat == SampleFormatIEEEFP {
+				d.config.ColorModel = Gray32FloatModel
+			}
+		default:
+			return UnsupportedError{"BitsPerSample", TagBitsPerSample, uint(bps)}
+		}
+	case PhotometricRGB:
+		if spp < 3 {
+			return UnsupportedError{"RGB with SamplesPerPixel", TagSamplesPerPixel, uint(spp)}
+		}
+		// A fourth sample is alpha, premultiplied into the colors if it is
+		// associated and straight otherwise; an unspecified extra sample is
+		// taken to be straight alpha. Further samples, such as masks, are
+		// left out.
+		associated := false
+		if spp >= 4 {
+			switch es := d.firstVal(TagExtraSamples); es {
+			case ExtraSamplesUnspecified, ExtraSamplesUnassociatedAlpha:
+			case ExtraSamplesAssociatedAlpha:
+				associated = true
+			default:
+				return UnsupportedError{"ExtraSamples", TagExtraSamples, es}
+			}
+		}
+		switch {
+		case bps == 8 && associated:
+			d.format = formatRGBA
+			d.config.ColorModel = color.RGBAModel
+		case bps == 8:
+			d.format = formatNRGBA
+			d.config.ColorModel = color.NRGBAModel
+		case bps == 16 && associated:
+			d.format = formatRGBA64
+			d.config.ColorModel = color.RGBA64Model
+		case bps == 16:
+			d.format = formatNRGBA64
+			d.config.ColorModel = color.NRGBA64Model
+		default:
+			return UnsupportedError{"BitsPerSample with RGB", TagBitsPerSample, uint(bps)}
+		}
+	case PhotometricCMYK:
+		if is := d.firstVal(TagInkSet); is > 1 {
+			return UnsupportedError{"InkSet", TagInkSet, is}
+		}
+		if spp != 4 {
+			return UnsupportedError{"CMYK with SamplesPerPixel", TagSamplesPerPixel, uint(spp)}
+		}
+		if bps != 8 {
+			return UnsupportedError{"BitsPerSample with CMYK", TagBitsPerSample, uint(bps)}
+		}
+		d.format = formatCMYK
+		d.config.ColorModel = color.CMYKModel
+	case PhotometricYCbCr:
+		if spp != 3 {
+			return UnsupportedError{"YCbCr with SamplesPerPixel", TagSamplesPerPixel, uint(spp)}
+		}
+		if bps != 8 {
+			return UnsupportedError{"BitsPerSample with YCbCr", TagBitsPerSample, uint(bps)}
+		}
+		if err := d.setSubsampling(); err != nil {
+			return err
+		}
+		d.format = formatYCbCr
+		d.config.ColorModel = color.YCbCrModel
+	case PhotometricPaletted:
+		switch bps {
+		case 1, 2, 4, 8, 16:
+		default:
+			return UnsupportedError{"BitsPerSample with a palette", TagBitsPerSample, uint(bps)}
+		}
+		if err := d.parsePalette(); err != nil {
+			return err
+		}
+		d.format = formatPaletted
+		d.config.ColorModel = d.palette
+		if bps == 16 {
+			// An image.Paletted holds no more than 256 colors.
+			d.format = formatPaletted16
+			d.config.ColorModel = Gray32Model
+		}
+		if d.expandPalette {
+			d.format = formatExpanded
+			d.config.ColorModel = color.RGBAModel
+		}
+	default:
+		return UnsupportedError{"PhotometricInterpretation", TagPhotometricInterpretation, pi}
+	}
+
+	switch p := d.firstVal(TagPredictor); p {
+	case 0, PredictorNone:
+	case PredictorHorizontal:
+		if bps < 8 {
+			return UnsupportedError{"horizontal predictor with samples of less than 8 bits, BitsPerSample", TagBitsPerSample, uint(bps)}
+		}
+		if d.format == formatYCbCr {
+			return UnsupportedError{Feature: "horizontal predictor with YCbCr"}
+		}
+	case PredictorFloatingPoint:
+		if d.sampleFormat != SampleFormatIEEEFP {
+			return UnsupportedError{"floating point predictor with SampleFormat", TagSampleFormat, d.sampleFormat}
+		}
+	default:
+		return UnsupportedError{"Predictor", TagPredictor, p}
+	}
+
+	// The bit order within bytes is defined for the stored data, so it is
+	// undone on uncompressed data only; it matters to samples of less than
+	// a byte. Readers may ignore it otherwise (p. 32), but a writer
+	// declaring reversed bytes may well have reversed the samples too, so
+	// such files are refused rather than decoded scrambled.
+	switch fo := d.firstVal(TagFillOrder); fo {
+	case 0, FillOrderMSB2LSB:
+	case FillOrderLSB2MSB:
+		if bps >= 8 {
+			return UnsupportedError{fmt.Sprintf("reversed bit order with %d-bit samples, FillOrder", bps), TagFillOrder, fo}
+		}
+		if !d.uncompressed() {
+			return UnsupportedError{"reversed bit order with compression, FillOrder", TagFillOrder, fo}
+		}
+		d.reverseBits = true
+	default:
+		return FormatError(fmt.Sprintf("invalid FillOrder %d", fo))
+	}
+
+	if bands := d.grayBands(); d.band < 0 || d.band >= bands {
+		return fmt.Errorf("tiff: band %d requested from an image of %d bands", d.band, bands)
+	}
+	if int64(d.config.Height)*int64(d.rowBytes(d.config.Width)) > math.MaxInt32 {
+		return UnsupportedError{Feature: "image too large"}
+	}
+	if _, ok := mulInt(d.config.Width*d.config.Height, d.format.pixelBytes()); !ok {
+		return UnsupportedError{Feature: "image too large"}
+	}
+	return nil
+}
+
+// parsePalette reads the ColorMap of a paletted image into d.palette. It
+// holds all the red values, then the green, then the blue (p. 23).
+func (d *decoder) parsePalette() error {
+	n := 1 << uint(d.bitsPerSample)
+	cm, err := d.parseIFDOffsets(TagColorMap, 3*n)
+	if err != nil {
+		return err
+	}
+	if len(cm) != 3*n {
+		return FormatError("bad ColorMap length")
+	}
+	d.palette = make(color.Palette, n)
+	for i := range d.palette {
+		d.palette[i] = color.RGBA64{
+			R: uint16(cm[i]),
+			G: uint16(cm[i+n]),
+			B: uint16(cm[i+2*n]),
+			A: 0xffff,
+		}
+	}
+	return nil
+}
+
+// setSubsampling reads the chroma subsampling of a YCbCr image, which
+// defaults to 2×2 (p. 91), and checks that the conversion to RGB is the
+// one assumed by image.YCbCr: the coefficients of ITU-R BT.601 on samples
+// spanning their full range.
+func (d *decoder) setSubsampling() error {
+	d.subsampleX, d.subsampleY = 2, 2
+	if ss := d.features[TagYCbCrSubSampling]; len(ss) >= 2 {
+		d.subsampleX, d.subsampleY = int(ss[0]), int(ss[1])
+	}
+	ratios := map[[2]int]image.YCbCrSubsampleRatio{
+		{1, 1}: image.YCbCrSubsampleRatio444,
+		{2, 1}: image.YCbCrSubsampleRatio422,
+		{2, 2}: image.YCbCrSubsampleRatio420,
+		{1, 2}: image.YCbCrSubsampleRatio440,
+		{4, 1}: image.YCbCrSubsampleRatio411,
+		{4, 2}: image.YCbCrSubsampleRatio410,
+	}
+	r, ok := ratios[[2]int{d.subsampleX, d.subsampleY}]
+	if !ok {
+		return UnsupportedError{Feature: fmt.Sprintf("YCbCr subsampling %dx%d", d.subsampleX, d.subsampleY)}
+	}
+	d.subsampleRatio = r
+	// Strips must hold whole rows of data units.
+	if rps := d.firstVal(TagRowsPerStrip); d.firstVal(TagTileWidth) == 0 && rps != 0 &&
+		rps < uint(d.config.Height) && rps%uint(d.subsampleY) != 0 {
+		return FormatError("RowsPerStrip is not a multiple of the YCbCr subsampling")
+	}
+
+	for _, f := range []struct {
+		tag  int
+		want []float64
+	}{
+		{TagYCbCrCoefficients, []float64{0.299, 0.587, 0.114}},
+		{TagReferenceBlackWhite, []float64{0, 255, 128, 255, 128, 255}},
+	} {
+		dt, data, ok, err := d.entryData(f.tag)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if dt != TypeRational || len(data) != 8*len(f.want) {
+			return FormatError(fmt.Sprintf("bad field %d", f.tag))
+		}
+		for i, want := range f.want {
+			num := binary.LittleEndian.Uint32(data[8*i:])
+			den := binary.LittleEndian.Uint32(data[8*i+4:])
+			if den == 0 || math.Abs(float64(num)/float64(den)-want) > 0.001 {
+				return UnsupportedError{Feature: fmt.Sprintf("YCbCr field %d other than the default", f.tag)}
+			}
+		}
+	}
+	return nil
+}
+
+// grayBands returns the number of bands of an image of gray samples, of
+// which only that chosen by the Band option is decoded, or 1 for images of
+// other kinds, which are decoded whole.
+func (d *decoder) grayBands() int {
+	switch d.format {
+	case formatGray32, formatGray, formatGray16:
+		return d.samplesPerPixel
+	}
+	return 1
+}
+
+// pickBand moves the samples of the band decoded to the start of each row
+// of the rows of b held in buf, so that they can be unpacked as those of an
+// image of a single band.
+func (d *decoder) pickBand(buf []byte, b image.Rectangle) {
+	size := d.bitsPerSample / 8
+	step := size * d.samplesPerPixel
+	rowBytes := d.rowBytes(b.Dx())
+	for y := 0; (y+1)*rowBytes <= len(buf) && y < b.Dy(); y++ {
+		row := buf[y*rowBytes : (y+1)*rowBytes]
+		for x := 0; x < b.Dx(); x++ {
+			copy(row[x*size:(x+1)*size], row[x*step+d.band*size:])
+		}
+	}
+}
+
+// rowBytes returns the number of bytes taken by a row of w pixels. Rows
+// start on a byte boundary whatever the size of the samples.
+func (d *decoder) rowBytes(w int) int {
+	return int((int64(w)*int64(d.samplesPerPixel*d.bitsPerSample) + 7) / 8)
+}
+
+// blockBytes returns the size of a block once decompressed.
+func (d *decoder) blockBytes() int64 {
+	if d.format == formatYCbCr {
+		return d.unitBytes(d.blockWidth, d.blockHeight)
+	}
+	return int64(d.blockHeight) * int64(d.rowBytes(d.blockWidth))
+}
+
+// unitBytes returns the size of the YCbCr data of w×h pixels. They are
+// stored in data units of subsampleX×subsampleY luma samples followed by a
+// Cb and a Cr sample, covering the pixels rounded up to whole units (p. 93).
+func (d *decoder) unitBytes(w, h int) int64 {
+	sx, sy := d.subsampleX, d.subsampleY
+	return int64((w+sx-1)/sx) * int64((h+sy-1)/sy) * int64(sx*sy+2)
+}
+
+// predicted reports whether the samples of the image are stored with a
+// predictor, to be undone by unpredict.
+func (d *decoder) predicted() bool {
+	return d.firstVal(TagPredictor) > PredictorNone
+}
+
+// unpredict undoes the predictor in buf, which holds the rows of b. With
+// the horizontal predictor each sample is stored as the difference from the
+// same sample of the preceding pixel (p. 64-65); with the floating point
+// one, the bytes of the samples of a row are stored a byte plane after the
+// other, from the most significant, and each byte as the difference from
+// the same byte of the preceding pixel (Adobe Photoshop TIFF Technical
+// Note 3).
+func (d *decoder) unpredict(buf []byte, b image.Rectangle) error {
+	rowBytes := d.rowBytes(b.Dx())
+	if len(buf) < b.Dy()*rowBytes {
+		return errNoPixels
+	}
+	size := d.bitsPerSample / 8
+	step := size * d.samplesPerPixel
+	if d.firstVal(TagPredictor) == PredictorFloatingPoint {
+		tmp := make([]byte, rowBytes)
+		for y := 0; y < b.Dy(); y++ {
+			d.unpredictFloats(buf[y*rowBytes:(y+1)*rowBytes], tmp, size, d.samplesPerPixel)
+		}
+		return nil
+	}
+	for y := 0; y < b.Dy(); y++ {
+		row := buf[y*rowBytes : (y+1)*rowBytes]
+		switch size {
+		case 1:
+			for i := step; i < len(row); i++ {
+				row[i] += row[i-step]
+			}
+		case 2:
+			for i := step; i+2 <= len(row); i += 2 {
+				d.byteOrder.PutUint16(row[i:], d.byteOrder.Uint16(row[i:])+d.byteOrder.Uint16(row[i-step:]))
+			}
+		case 4:
+			for i := step; i+4 <= len(row); i += 4 {
+				d.byteOrder.PutUint32(row[i:], d.byteOrder.Uint32(row[i:])+d.byteOrder.Uint32(row[i-step:]))
+			}
+		}
+	}
+	return nil
+}
+
+// unpredictFloats undoes the floating point predictor in row, made of
+// samples of size bytes and spp samples per pixel, storing them in the byte
+// order of the file. tmp must be as long as row.
+func (d *decoder) unpredictFloats(row, tmp []byte, size, spp int) {
+	for i := spp; i < len(row); i++ {
+		row[i] += row[i-spp]
+	}
+	// The planes run from the most significant byte.
+	big := d.byteOrder != binary.ByteOrder(binary.LittleEndian)
+	n := len(row) / size
+	for i := 0; i < n; i++ {
+		for k := 0; k < size; k++ {
+			j := i*size + size - 1 - k
+			if big {
+				j = i*size + k
+			}
+			tmp[j] = row[k*n+i]
+		}
+	}
+	copy(row, tmp)
+}
+
+// decodeSamples unpacks the rows of b held in buf into dst, a standard
+// library image of one of the formats other than formatGray32. Only the
+// part of b inside the bounds of dst is stored.
+func (d *decoder) decodeSamples(buf []byte, dst image.Image, b image.Rectangle) error {
+	if d.reverseBits {
+		for i, v := range buf {
+			buf[i] = bits.Reverse8(v)
+		}
+	}
+	r := b.Intersect(dst.Bounds())
+	rowBytes := d.rowBytes(b.Dx())
+	if len(buf) < (r.Max.Y-b.Min.Y)*rowBytes {
+		return errNoPixels
+	}
+
+	switch dst := dst.(type) {
+	case *image.Gray16:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := buf[(y-b.Min.Y)*rowBytes:]
+			pix := dst.Pix[dst.PixOffset(r.Min.X, y):]
+			for x := r.Min.X; x < r.Max.X; x++ {
+				v := d.byteOrder.Uint16(row[2*(x-b.Min.X):])
+				if d.invert {
+					v = 0xffff - v
+				}
+				pix[0], pix[1] = byte(v>>8), byte(v)
+				pix = pix[2:]
+			}
+		}
+	case *image.NRGBA:
+		d.decodeRGB(buf, dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y):], dst.Stride, r, b)
+	case *image.NRGBA64:
+		d.decodeRGB(buf, dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y):], dst.Stride, r, b)
+	case *image.RGBA64:
+		d.decodeRGB(buf, dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y):], dst.Stride, r, b)
+	case *GrayFloat32:
+		d.decodeQuantized(buf, dst, r, b)
+	case *image.CMYK:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := buf[(y-b.Min.Y)*rowBytes+(r.Min.X-b.Min.X)*4:]
+			i := dst.PixOffset(r.Min.X, y)
+			copy(dst.Pix[i:i+4*r.Dx()], row)
+		}
+	case *image.Gray:
+		d.decodeIndices(buf, dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y):], dst.Stride, r, b, true)
+	case *image.Paletted:
+		d.decodeIndices(buf, dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y):], dst.Stride, r, b, false)
+	case *Gray32:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := buf[(y-b.Min.Y)*rowBytes+(r.Min.X-b.Min.X)*2:]
+			pix := dst.Pix[dst.PixOffset(r.Min.X, y):][:r.Dx()]
+			for x := range pix {
+				pix[x] = uint32(d.byteOrder.Uint16(row[2*x:]))
+			}
+		}
+	case *image.RGBA:
+		if d.format != formatExpanded {
+			d.decodeRGB(buf, dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y):], dst.Stride, r, b)
+			break
+		}
+		if d.bitsPerSample == 16 {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				row := buf[(y-b.Min.Y)*rowBytes+(r.Min.X-b.Min.X)*2:]
+				pix := dst.Pix[dst.PixOffset(r.Min.X, y):][:4*r.Dx()]
+				for i := 0; i < r.Dx(); i++ {
+					c := d.palette[d.byteOrder.Uint16(row[2*i:])].(color.RGBA64)
+					pix[4*i+0] = uint8(c.R >> 8)
+					pix[4*i+1] = uint8(c.G >> 8)
+					pix[4*i+2] = uint8(c.B >> 8)
+					pix[4*i+3] = 0xff
+				}
+			}
+			break
+		}
+		// The indices of a row are unpacked in place at the end of the
+		// row, then replaced by the colors they select.
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			pix := dst.Pix[dst.PixOffset(r.Min.X, y) : dst.PixOffset(r.Min.X, y)+4*r.Dx()]
+			idx := pix[3*r.Dx():]
+			d.decodeIndices(buf, idx, r.Dx(), image.Rect(r.Min.X, y, r.Max.X, y+1), b, false)
+			for i, v := range idx {
+				c := d.palette[v].(color.RGBA64)
+				pix[4*i+0] = uint8(c.R >> 8)
+				pix[4*i+1] = uint8(c.G >> 8)
+				pix[4*i+2] = uint8(c.B >> 8)
+				pix[4*i+3] = 0xff
+			}
+		}
+	default:
+		return InternalError(fmt.Sprintf("cannot decode into a %T", dst))
+	}
+	return nil
+}
+
+// decodeRGB copies RGB or RGBA samples of 8 or 16 bits from buf, which
+// holds the rows of b, into the pixels of pix covering r with the given
+// stride, which have four samples of the same size. Missing alpha is opaque;
+// alpha, associated or not, is stored as it is, to match the destination
+// type chosen for it. Samples past the alpha are left out.
+func (d *decoder) decodeRGB(buf, pix []byte, stride int, r, b image.Rectangle) {
+	spp := d.samplesPerPixel
+	rowBytes := d.rowBytes(b.Dx())
+	if d.bitsPerSample == 8 {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := buf[(y-b.Min.Y)*rowBytes+(r.Min.X-b.Min.X)*spp:]
+			p := pix[(y-r.Min.Y)*stride:]
+			for x := 0; x < r.Dx(); x++ {
+				copy(p[4*x:4*x+3], row[spp*x:])
+				if spp >= 4 {
+					p[4*x+3] = row[spp*x+3]
+				} else {
+					p[4*x+3] = 0xff
+				}
+			}
+		}
+		return
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := buf[(y-b.Min.Y)*rowBytes+(r.Min.X-b.Min.X)*2*spp:]
+		p := pix[(y-r.Min.Y)*stride:]
+		for x := 0; x < r.Dx(); x++ {
+			for c := 0; c < 4; c++ {
+				v := uint16(0xffff)
+				if c < spp {
+					v = d.byteOrder.Uint16(row[2*(spp*x+c):])
+				}
+				p[8*x+2*c], p[8*x+2*c+1] = byte(v>>8), byte(v)
+			}
+		}
+	}
+}
+
+// decodeIndices unpacks samples of up to 8 bits from buf, which holds the
+// rows of b, into the bytes of pix covering r with the given stride. Gray
+// levels are scaled to 8 bits and inverted if WhiteIsZero; palette indices
+// are stored as they are.
+func (d *decoder) decodeIndices(buf, pix []byte, stride int, r, b image.Rectangle, gray bool) {
+	bps := uint(d.bitsPerSample)
+	max := uint32(1)<<bps - 1
+	rowBytes := d.rowBytes(b.Dx())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := buf[(y-b.Min.Y)*rowBytes:]
+		dst := pix[(y-r.Min.Y)*stride : (y-r.Min.Y)*stride+r.Dx()]
+		if bps == 8 {
+			copy(dst, row[r.Min.X-b.Min.X:])
+			if gray && d.invert {
+				for i, v := range dst {
+					dst[i] = 0xff - v
+				}
+			}
+			continue
+		}
+		for i := range dst {
+			bit := uint(r.Min.X-b.Min.X+i) * bps
+			v := uint32(row[bit/8]>>(8-bps-bit%8)) & max
+			if gray {
+				if d.invert {
+					v = max - v
+				}
+				v = v * 0xff / max
+			}
+			dst[i] = byte(v)
+		}
+	}
+}
+
+// decodeYCbCr unpacks the YCbCr data units of b held in buf into dst. Only
+// the part of b inside the bounds of dst is stored.
+func (d *decoder) decodeYCbCr(buf []byte, m image.Image, b image.Rectangle) error {
+	dst, ok := m.(*image.YCbCr)
+	if !ok {
+		return InternalError(fmt.Sprintf("cannot decode YCbCr into a %T", m))
+	}
+	if int64(len(buf)) < d.unitBytes(b.Dx(), b.Dy()) {
+		return errNoPixels
+	}
+	dr := dst.Rect
+	sx, sy := d.subsampleX, d.subsampleY
+	off := 0
+	for y0 := b.Min.Y; y0 < b.Max.Y; y0 += sy {
+		for x0 := b.Min.X; x0 < b.Max.X; x0 += sx {
+			unit := image.Rect(x0, y0, x0+sx, y0+sy).Intersect(dr)
+			if !unit.Empty() {
+				for j := 0; j < sy; j++ {
+					for i := 0; i < sx; i++ {
+						if p := image.Pt(x0+i, y0+j); p.In(unit) {
+							dst.Y[dst.YOffset(p.X, p.Y)] = buf[off+j*sx+i]
+						}
+					}
+				}
+				c := dst.COffset(unit.Min.X, unit.Min.Y)
+				dst.Cb[c] = buf[off+sx*sy]
+				dst.Cr[c] = buf[off+sx*sy+1]
+			}
+			off += sx*sy + 2
+		}
+	}
+	return nil
+}
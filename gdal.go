@@ -0,0 +1,284 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A GDALItem is an item of the GDAL_METADATA field, in which GDAL keeps the
+// metadata it has no TIFF field for.
+type GDALItem struct {
+	Name  string
+	Value string
+	// Band is the band the item applies to, counting from 1, or 0 if it
+	// applies to the whole image. It is stored as the zero-based sample
+	// attribute.
+	Band int
+	// Role is the meaning GDAL gives the item, such as "scale", "offset"
+	// or "description", or empty for a plain metadata item.
+	Role string
+}
+
+type gdalMetadataXML struct {
+	XMLName xml.Name      `xml:"GDALMetadata"`
+	Items   []gdalItemXML `xml:"Item"`
+}
+
+type gdalItemXML struct {
+	XMLName xml.Name `xml:"Item"`
+	Name    string   `xml:"name,attr"`
+	Sample  string   `xml:"sample,attr,omitempty"`
+	Role    string   `xml:"role,attr,omitempty"`
+	Value   string   `xml:",chardata"`
+}
+
+// parseGDALMetadata parses the XML document held in a GDAL_METADATA
+// field.
+func parseGDALMetadata(s string) ([]GDALItem, error) {
+	var doc gdalMetadataXML
+	if err := xml.Unmarshal([]byte(s), &doc); err != nil {
+		return nil, FormatError("invalid GDAL_METADATA: " + err.Error())
+	}
+	items := make([]GDALItem, len(doc.Items))
+	for i, it := range doc.Items {
+		items[i] = GDALItem{Name: it.Name, Value: it.Value, Role: it.Role}
+		if it.Sample != "" {
+			n, err := strconv.Atoi(it.Sample)
+			if err != nil || n < 0 {
+				return nil, FormatError("invalid GDAL_METADATA sample " + strconv.Quote(it.Sample))
+			}
+			items[i].Band = n + 1
+		}
+	}
+	return items, nil
+}
+
+// gdalMetadataEntry returns a GDAL_METADATA entry holding items, laid out
+// one item per line as GDAL writes them.
+func gdalMetadataEntry(items []GDALItem) ifdEntry {
+	var b strings.Builder
+	b.WriteString("<GDALMetadata>\n")
+	for _, it := range items {
+		x := gdalItemXML{Name: it.Name, Role: it.Role, Value: it.Value}
+		if it.Band > 0 {
+			x.Sample = strconv.Itoa(it.Band - 1)
+		}
+		// Marshalling a struct of strings cannot fail.
+		p, _ := xml.Marshal(x)
+		b.WriteString("  ")
+		b.Write(p)
+		b.WriteString("\n")
+	}
+	b.WriteString("</GDALMetadata>")
+	return asciiEntry(TagGDALMetadata, b.String())
+}
+
+// gdalItems returns the items of the GDAL_METADATA field of the image, if
+// any.
+func (d *decoder) gdalItems() ([]GDALItem, error) {
+	s, err := d.asciiField(TagGDALMetadata)
+	if err != nil || s == "" {
+		return nil, err
+	}
+	return parseGDALMetadata(s)
+}
+
+// noData returns the value of the GDAL_NODATA field of the image, or nil if
+// there is none.
+func (d *decoder) noData() (*float64, error) {
+	s, err := d.asciiField(TagGDALNoData)
+	if err != nil || s == "" {
+		return nil, err
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return nil, FormatError("invalid GDAL_NODATA value " + strconv.Quote(s))
+	}
+	return &v, nil
+}
+
+// A BandInfo describes a band of an image as GDAL does, with items of the
+// GDAL_METADATA field of the band. Empty fields are not stored.
+type BandInfo struct {
+	Description string
+	Unit        string // Such as "m" or "metre", as GDAL's unit type.
+	// Scale and Offset, if not nil, give the values that the samples of
+	// the band stand for, each being sample*Scale + Offset.
+	Scale, Offset *float64
+}
+
+// The roles of the GDAL_METADATA items described by a BandInfo.
+var bandRoles = map[string]bool{"description": true, "unittype": true, "scale": true, "offset": true}
+
+// Band returns the description of band band of the image of md, counting
+// from 1, from the items of md.GDAL. The scale and offset of the first band
+// of an image of a single band, which are decoded as md.Quantization, are
+// taken from there.
+func (md *Metadata) Band(band int) (BandInfo, error) {
+	var info BandInfo
+	if q := md.Quantization; q != nil && band == 1 {
+		scale, offset := q.Scale, q.Offset
+		info.Scale, info.Offset = &scale, &offset
+	}
+	for _, it := range md.GDAL {
+		if it.Band != band {
+			continue
+		}
+		switch it.Role {
+		case "description":
+			info.Description = it.Value
+		case "unittype":
+			info.Unit = it.Value
+		case "scale", "offset":
+			v, err := strconv.ParseFloat(strings.TrimSpace(it.Value), 64)
+			if err != nil {
+				return BandInfo{}, FormatError(fmt.Sprintf("invalid GDAL %s %q of band %d", it.Role, it.Value, band))
+			}
+			if it.Role == "scale" {
+				info.Scale = &v
+			} else {
+				info.Offset = &v
+			}
+		}
+	}
+	return info, nil
+}
+
+// SetBand replaces the description of band band of the image of md,
+// counting from 1, in md.GDAL, leaving the other items as they are.
+func (md *Metadata) SetBand(band int, info BandInfo) {
+	items := md.GDAL[:0:0]
+	for _, it := range md.GDAL {
+		if it.Band != band || !bandRoles[it.Role] {
+			items = append(items, it)
+		}
+	}
+	add := func(name, role, value string) {
+		items = append(items, GDALItem{Name: name, Value: value, Band: band, Role: role})
+	}
+	if info.Description != "" {
+		add("DESCRIPTION", "description", info.Description)
+	}
+	if info.Unit != "" {
+		add("UNITTYPE", "unittype", info.Unit)
+	}
+	if info.Offset != nil {
+		add("OFFSET", "offset", strconv.FormatFloat(*info.Offset, 'g', -1, 64))
+	}
+	if info.Scale != nil {
+		add("SCALE", "scale", strconv.FormatFloat(*info.Scale, 'g', -1, 64))
+	}
+	md.GDAL = items
+}
+
+// A Class is an entry of the legend of a classified raster, such as a land
+// cover map, whose samples are the values of classes rather than
+// measurements.
+type Class struct {
+	Value uint32
+	Name  string
+	// Color, if not nil, is the color the class is shown in.
+	Color *color.NRGBA
+}
+
+// Classes returns the class table of the image of md, by increasing value,
+// from the items of md.GDAL with the "class" and "classcolor" roles.
+func (md *Metadata) Classes() ([]Class, error) {
+	byValue := make(map[uint32]*Class)
+	var classes []*Class
+	for _, it := range md.GDAL {
+		if it.Role != "class" && it.Role != "classcolor" {
+			continue
+		}
+		s := strings.TrimSuffix(strings.TrimPrefix(it.Name, "CLASS_"), "_COLOR")
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, FormatError(fmt.Sprintf("invalid GDAL class %q", it.Name))
+		}
+		c := byValue[uint32(v)]
+		if c == nil {
+			c = &Class{Value: uint32(v)}
+			byValue[c.Value] = c
+			classes = append(classes, c)
+		}
+		if it.Role == "class" {
+			c.Name = it.Value
+			continue
+		}
+		// The alpha value may be left out for an opaque color.
+		rgba := [4]uint8{3: 0xff}
+		f := strings.Split(it.Value, ",")
+		if len(f) != 3 && len(f) != 4 {
+			return nil, FormatError(fmt.Sprintf("invalid GDAL color %q of class %d", it.Value, v))
+		}
+		for i, s := range f {
+			n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+			if err != nil {
+				return nil, FormatError(fmt.Sprintf("invalid GDAL color %q of class %d", it.Value, v))
+			}
+			rgba[i] = uint8(n)
+		}
+		c.Color = &color.NRGBA{rgba[0], rgba[1], rgba[2], rgba[3]}
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i].Value < classes[j].Value })
+	out := make([]Class, len(classes))
+	for i, c := range classes {
+		out[i] = *c
+	}
+	return out, nil
+}
+
+// SetClasses replaces the class table of the image of md in md.GDAL,
+// leaving the other items as they are. Each class is stored as an item
+// named CLASS_<value> holding its name, and its color, if any, as one
+// named CLASS_<value>_COLOR holding the red, green, blue and alpha values
+// separated by commas.
+func (md *Metadata) SetClasses(classes []Class) {
+	items := md.GDAL[:0:0]
+	for _, it := range md.GDAL {
+		if it.Role != "class" && it.Role != "classcolor" {
+			items = append(items, it)
+		}
+	}
+	for _, c := range classes {
+		name := "CLASS_" + strconv.FormatUint(uint64(c.Value), 10)
+		items = append(items, GDALItem{Name: name, Value: c.Name, Role: "class"})
+		if k := c.Color; k != nil {
+			items = append(items, GDALItem{Name: name + "_COLOR", Value: fmt.Sprintf("%d,%d,%d,%d", k.R, k.G, k.B, k.A), Role: "classcolor"})
+		}
+	}
+	md.GDAL = items
+}
+
+// ClassPalette returns a palette giving each class of classes its color,
+// to be set as the Palette of the *Gray32 of a classified raster. It is
+// long enough for the highest value of the classes, and values without a
+// class or a color are transparent. The values must be less than 65536 for
+// the image to be encoded, and the colors are then written opaque, as the
+// ColorMap field holds no alpha.
+func ClassPalette(classes []Class) color.Palette {
+	var n uint32
+	for _, c := range classes {
+		if c.Color != nil {
+			n = max(n, c.Value+1)
+		}
+	}
+	p := make(color.Palette, n)
+	for i := range p {
+		p[i] = color.NRGBA{}
+	}
+	for _, c := range classes {
+		if c.Color != nil {
+			p[c.Value] = *c.Color
+		}
+	}
+	return p
+}
@@ -0,0 +1,251 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// GeoKeyRasterType is the GeoKey telling whether the georeferencing of a
+// GeoTIFF file is that of the corners of its pixels, RasterPixelIsArea, or
+// of their centers, RasterPixelIsPoint.
+const (
+	GeoKeyRasterType   = 1025
+	RasterPixelIsArea  = 1
+	RasterPixelIsPoint = 2
+)
+
+// A GeoTransform is the affine transformation from the pixel grid of an
+// image to world coordinates, with the coefficients of GDAL: the point at
+// column col and row row of the grid, whose pixel (0, 0) covers the unit
+// square from the origin, is at
+//
+//	x = gt[0] + col*gt[1] + row*gt[2]
+//	y = gt[3] + col*gt[4] + row*gt[5]
+//
+// Columns and rows are those of the coordinates of package image, so that
+// the bounds of an image read from a region of a file place it in the
+// grid of the file.
+type GeoTransform [6]float64
+
+// Apply returns the world coordinates of the point at col, row.
+func (gt GeoTransform) Apply(col, row float64) (x, y float64) {
+	return gt[0] + col*gt[1] + row*gt[2], gt[3] + col*gt[4] + row*gt[5]
+}
+
+// Pixel returns the point of the grid at the world coordinates x, y, the
+// inverse of Apply. ok is false if the transformation cannot be inverted.
+func (gt GeoTransform) Pixel(x, y float64) (col, row float64, ok bool) {
+	det := gt[1]*gt[5] - gt[2]*gt[4]
+	if det == 0 || math.IsNaN(det) || math.IsInf(det, 0) {
+		return 0, 0, false
+	}
+	dx, dy := x-gt[0], y-gt[3]
+	return (dx*gt[5] - dy*gt[2]) / det, (dy*gt[1] - dx*gt[4]) / det, true
+}
+
+// GeoTransform returns the transformation given by the ModelTransformation
+// field, or else by the pixel scale and first tiepoint. Georeferencing of
+// the centers of the pixels, as GeoKeyRasterType says, is shifted by half
+// a pixel to that of their corners, as GDAL does. ok is false if g holds
+// neither.
+func (g *GeoInfo) GeoTransform() (gt GeoTransform, ok bool) {
+	switch t, s, tp := g.Transformation, g.PixelScale, g.Tiepoints; {
+	case len(t) == 16:
+		gt = GeoTransform{t[3], t[0], t[1], t[7], t[4], t[5]}
+	case len(s) >= 2 && len(tp) >= 6:
+		gt = GeoTransform{tp[3] - tp[0]*s[0], s[0], 0, tp[4] + tp[1]*s[1], 0, -s[1]}
+	default:
+		return gt, false
+	}
+	if v, ok := g.shortKey(GeoKeyRasterType); ok && v == RasterPixelIsPoint {
+		gt[0], gt[3] = gt.Apply(-0.5, -0.5)
+	}
+	return gt, true
+}
+
+// Shift returns a copy of g georeferencing the grid whose pixel (0, 0) is
+// the pixel (dx, dy) of the grid of g, with its tiepoints and
+// transformation moved there. An image made of the region of another,
+// copied to the point at by Writer.CopyTiles, is georeferenced as the
+// other by its Geo shifted by region.Min.X-at.X, region.Min.Y-at.Y.
+func (g *GeoInfo) Shift(dx, dy int) *GeoInfo {
+	s := *g
+	s.PixelScale = append([]float64(nil), g.PixelScale...)
+	s.Tiepoints = shiftTiepoints(g.Tiepoints, dx, dy)
+	s.Transformation = shiftTransformation(g.Transformation, dx, dy)
+	s.KeyDirectory = append([]uint16(nil), g.KeyDirectory...)
+	s.DoubleParams = append([]float64(nil), g.DoubleParams...)
+	return &s
+}
+
+// shiftTiepoints returns a copy of the ModelTiepoint values tp moved to
+// the grid whose pixel (0, 0) is the pixel (dx, dy) of theirs.
+func shiftTiepoints(tp []float64, dx, dy int) []float64 {
+	v := append([]float64(nil), tp...)
+	for p := 0; p+6 <= len(v); p += 6 {
+		v[p] -= float64(dx)
+		v[p+1] -= float64(dy)
+	}
+	return v
+}
+
+// shiftTransformation returns a copy of the ModelTransformation values t
+// moved to the grid whose pixel (0, 0) is the pixel (dx, dy) of theirs.
+func shiftTransformation(t []float64, dx, dy int) []float64 {
+	v := append([]float64(nil), t...)
+	if len(v) == 16 {
+		x0, y0 := float64(dx), float64(dy)
+		v[3] += v[0]*x0 + v[1]*y0
+		v[7] += v[4]*x0 + v[5]*y0
+		v[11] += v[8]*x0 + v[9]*y0
+	}
+	return v
+}
+
+// shortKey returns the value of a GeoKey stored in the key directory
+// itself.
+func (g *GeoInfo) shortKey(id uint16) (uint16, bool) {
+	kd := g.KeyDirectory
+	if len(kd) < 4 {
+		return 0, false
+	}
+	for k := kd[4:]; len(k) >= 4; k = k[4:] {
+		if k[0] == id && k[1] == 0 {
+			return k[3], true
+		}
+	}
+	return 0, false
+}
+
+// An Interp is a way of interpolating the value of a raster between the
+// centers of its pixels.
+type Interp int
+
+const (
+	// InterpNearest takes the pixel holding the point.
+	InterpNearest Interp = iota
+	// InterpBilinear blends the 4 pixels whose centers surround the point
+	// by their distance to it, leaving out those holding no data.
+	InterpBilinear
+)
+
+// SampleAtWorld returns the value of the raster at the world coordinates
+// x, y, the image being placed in the world by gt, interpolated by method.
+// NaN samples hold no data. ok is false if the point is outside the image
+// or has no data.
+func (p *GrayFloat32) SampleAtWorld(x, y float64, gt GeoTransform, method Interp) (float32, bool) {
+	col, row, ok := gt.Pixel(x, y)
+	if !ok {
+		return 0, false
+	}
+	return p.sampleAt(col, row, method)
+}
+
+// sampleAt returns the value of the raster at the point col, row of its
+// grid, as for SampleAtWorld.
+func (p *GrayFloat32) sampleAt(col, row float64, method Interp) (float32, bool) {
+	r := p.Rect
+	if !(col >= float64(r.Min.X) && col < float64(r.Max.X) && row >= float64(r.Min.Y) && row < float64(r.Max.Y)) {
+		return 0, false
+	}
+	if method == InterpNearest {
+		v := math.Float32frombits(p.Pix[p.PixOffset(int(math.Floor(col)), int(math.Floor(row)))])
+		return v, !math.IsNaN(float64(v))
+	}
+	fx, fy := col-0.5, row-0.5
+	x0, y0 := math.Floor(fx), math.Floor(fy)
+	wx := [2]float64{1 - (fx - x0), fx - x0}
+	wy := [2]float64{1 - (fy - y0), fy - y0}
+	var sum, weight float64
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 2; i++ {
+			q := image.Pt(int(x0)+i, int(y0)+j)
+			w := wx[i] * wy[j]
+			if w == 0 || !q.In(r) {
+				continue
+			}
+			v := float64(math.Float32frombits(p.Pix[p.PixOffset(q.X, q.Y)]))
+			if !math.IsNaN(v) {
+				sum += w * v
+				weight += w
+			}
+		}
+	}
+	if weight == 0 {
+		return 0, false
+	}
+	return float32(sum / weight), true
+}
+
+// AlignTo resamples src, placed in the world by srcGT, onto the grid of
+// dstSize pixels placed by dstGT in the same coordinate reference system,
+// so that rasters of different grids can be stacked without a full
+// reprojection. The pixels of the result, whose bounds start at (0, 0),
+// are computed by method: ResampleNearest takes the pixel of src holding
+// the center of each, and ResampleAverage the mean of the pixels of src
+// whose centers it covers, or the pixel holding its center if it covers
+// none, as when enlarging. NaN samples of src hold no data, and pixels
+// with no data or outside src are NaN.
+func AlignTo(src *GrayFloat32, srcGT, dstGT GeoTransform, dstSize image.Point, method Resampling) (*GrayFloat32, error) {
+	if dstSize.X < 0 || dstSize.Y < 0 {
+		return nil, fmt.Errorf("tiff: invalid size %v", dstSize)
+	}
+	if method != ResampleNearest && method != ResampleAverage {
+		return nil, fmt.Errorf("tiff: unknown resampling %d", method)
+	}
+	// toSrc maps a point of the grid of the result to that of src.
+	toSrc := func(col, row float64) (float64, float64) {
+		x, y := dstGT.Apply(col, row)
+		c, r, _ := srcGT.Pixel(x, y)
+		return c, r
+	}
+	if _, _, ok := srcGT.Pixel(0, 0); !ok {
+		return nil, fmt.Errorf("tiff: source transformation %v cannot be inverted", srcGT)
+	}
+	nan := math.Float32bits(float32(math.NaN()))
+	dst := NewGrayFloat32(image.Rectangle{Max: dstSize})
+	sr := src.Rect
+	for j := 0; j < dstSize.Y; j++ {
+		for i := 0; i < dstSize.X; i++ {
+			k := dst.PixOffset(i, j)
+			dst.Pix[k] = nan
+			if method == ResampleAverage {
+				// The bounding box of the pixel in the grid of src.
+				c0, r0 := toSrc(float64(i), float64(j))
+				c1, r1 := c0, r0
+				for _, p := range [3][2]float64{{1, 0}, {0, 1}, {1, 1}} {
+					c, r := toSrc(float64(i)+p[0], float64(j)+p[1])
+					c0, c1, r0, r1 = min(c0, c), max(c1, c), min(r0, r), max(r1, r)
+				}
+				x0, x1 := max(sr.Min.X, int(math.Ceil(c0-0.5))), min(sr.Max.X, int(math.Ceil(c1-0.5)))
+				y0, y1 := max(sr.Min.Y, int(math.Ceil(r0-0.5))), min(sr.Max.Y, int(math.Ceil(r1-0.5)))
+				if x0 < x1 && y0 < y1 {
+					var sum float64
+					n := 0
+					for y := y0; y < y1; y++ {
+						for _, v := range src.Pix[src.PixOffset(x0, y):][:x1-x0] {
+							if f := float64(math.Float32frombits(v)); !math.IsNaN(f) {
+								sum += f
+								n++
+							}
+						}
+					}
+					if n > 0 {
+						dst.Pix[k] = math.Float32bits(float32(sum / float64(n)))
+					}
+					continue
+				}
+			}
+			c, r := toSrc(float64(i)+0.5, float64(j)+0.5)
+			if v, ok := src.sampleAt(c, r, InterpNearest); ok {
+				dst.Pix[k] = math.Float32bits(v)
+			}
+		}
+	}
+	return dst, nil
+}
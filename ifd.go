@@ -0,0 +1,381 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// An IFD builds an Image File Directory from typed entries, for writing
+// directories the encoder does not produce itself, such as EXIF, GPS or
+// vendor IFDs. The output is little-endian, like the rest of the package.
+//
+// Adding an entry for a tag already present replaces it. The entries are
+// written in ascending order of tag whatever the order they were added in.
+type IFD struct {
+	entries []ifdEntry
+}
+
+// add sets the entry for tag, replacing any previous one.
+func (d *IFD) add(e ifdEntry) {
+	for i := range d.entries {
+		if d.entries[i].tag == e.tag {
+			d.entries[i] = e
+			return
+		}
+	}
+	d.entries = append(d.entries, e)
+}
+
+// AddByte sets tag to the BYTE values v.
+func (d *IFD) AddByte(tag uint16, v ...byte) {
+	d.add(ifdEntry{int(tag), TypeByte, tagData(TypeByte, v)})
+}
+
+// AddUndefined sets tag to the UNDEFINED bytes v.
+func (d *IFD) AddUndefined(tag uint16, v []byte) {
+	d.add(ifdEntry{int(tag), TypeUndefined, tagData(TypeUndefined, v)})
+}
+
+// AddASCII sets tag to the string s, which is NUL-terminated in the file.
+func (d *IFD) AddASCII(tag uint16, s string) {
+	d.add(asciiEntry(int(tag), s))
+}
+
+// AddShort sets tag to the SHORT values v.
+func (d *IFD) AddShort(tag uint16, v ...uint16) {
+	data := make([]uint32, len(v))
+	for i, x := range v {
+		data[i] = uint32(x)
+	}
+	d.add(ifdEntry{int(tag), TypeShort, data})
+}
+
+// AddLong sets tag to the LONG values v.
+func (d *IFD) AddLong(tag uint16, v ...uint32) {
+	d.add(ifdEntry{int(tag), TypeLong, append([]uint32(nil), v...)})
+}
+
+// AddSByte sets tag to the SBYTE values v.
+func (d *IFD) AddSByte(tag uint16, v ...int8) {
+	data := make([]uint32, len(v))
+	for i, x := range v {
+		data[i] = uint32(uint8(x))
+	}
+	d.add(ifdEntry{int(tag), TypeSByte, data})
+}
+
+// AddSShort sets tag to the SSHORT values v.
+func (d *IFD) AddSShort(tag uint16, v ...int16) {
+	data := make([]uint32, len(v))
+	for i, x := range v {
+		data[i] = uint32(uint16(x))
+	}
+	d.add(ifdEntry{int(tag), TypeSShort, data})
+}
+
+// AddSLong sets tag to the SLONG values v.
+func (d *IFD) AddSLong(tag uint16, v ...int32) {
+	data := make([]uint32, len(v))
+	for i, x := range v {
+		data[i] = uint32(x)
+	}
+	d.add(ifdEntry{int(tag), TypeSLong, data})
+}
+
+// AddRational sets tag to the RATIONAL values v, each given as a numerator
+// and denominator, as Rational returns them.
+func (d *IFD) AddRational(tag uint16, v ...[2]uint32) {
+	d.add(rationalEntry(int(tag), v...))
+}
+
+// AddSRational sets tag to the SRATIONAL values v, each given as a
+// numerator and denominator, as SRational returns them.
+func (d *IFD) AddSRational(tag uint16, v ...[2]int32) {
+	data := make([]uint32, 0, 2*len(v))
+	for _, r := range v {
+		data = append(data, uint32(r[0]), uint32(r[1]))
+	}
+	d.add(ifdEntry{int(tag), TypeSRational, data})
+}
+
+// Rational returns the numerator and denominator of the RATIONAL closest
+// to v among the continued fractions of v, and whether v, which must not
+// be negative, fits a RATIONAL at all.
+func Rational(v float64) ([2]uint32, bool) {
+	num, den, ok := fraction(v, math.MaxUint32)
+	return [2]uint32{uint32(num), uint32(den)}, ok
+}
+
+// SRational is like Rational for an SRATIONAL, which may be negative.
+func SRational(v float64) ([2]int32, bool) {
+	num, den, ok := fraction(math.Abs(v), math.MaxInt32)
+	if v < 0 {
+		num = -num
+	}
+	return [2]int32{int32(num), int32(den)}, ok
+}
+
+// fraction approximates v, not negative, by the last of its continued
+// fractions whose numerator and denominator are at most limit.
+func fraction(v float64, limit int64) (num, den int64, ok bool) {
+	if !(v >= 0 && v <= float64(limit)) {
+		return 0, 0, false
+	}
+	h0, h1, k0, k1 := int64(0), int64(1), int64(1), int64(0)
+	for x := v; ; {
+		a := math.Floor(x)
+		h := a*float64(h1) + float64(h0)
+		k := a*float64(k1) + float64(k0)
+		if h > float64(limit) || k > float64(limit) {
+			break
+		}
+		h0, h1 = h1, int64(h)
+		k0, k1 = k1, int64(k)
+		if x == a || float64(h1)/float64(k1) == v {
+			break
+		}
+		x = 1 / (x - a)
+	}
+	return h1, k1, true
+}
+
+// AddFloat sets tag to the FLOAT values v.
+func (d *IFD) AddFloat(tag uint16, v ...float32) {
+	data := make([]uint32, len(v))
+	for i, x := range v {
+		data[i] = math.Float32bits(x)
+	}
+	d.add(ifdEntry{int(tag), TypeFloat, data})
+}
+
+// AddDouble sets tag to the DOUBLE values v.
+func (d *IFD) AddDouble(tag uint16, v ...float64) {
+	d.add(doubleEntry(int(tag), v))
+}
+
+// Add sets the entry for t.ID from its raw data.
+func (d *IFD) Add(t Tag) error {
+	dt := int(t.DataType)
+	if !knownType(dt) {
+		return UnsupportedError{"IFD entry datatype", int(t.ID), uint(dt)}
+	}
+	if len(t.Data)%int(lengths[dt]) != 0 {
+		return fmt.Errorf("tiff: tag %d has %d bytes, not a multiple of its type size", t.ID, len(t.Data))
+	}
+	d.add(ifdEntry{int(t.ID), dt, tagData(dt, t.Data)})
+	return nil
+}
+
+// Remove deletes the entry for tag, if any.
+func (d *IFD) Remove(tag uint16) {
+	for i := range d.entries {
+		if d.entries[i].tag == int(tag) {
+			d.entries = append(d.entries[:i], d.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Len returns the number of entries.
+func (d *IFD) Len() int { return len(d.entries) }
+
+// Size returns the number of bytes Write produces: the entry count, the
+// entries, the offset of the next IFD and the data of entries longer than
+// four bytes.
+func (d *IFD) Size() int { return ifdSize(d.entries) }
+
+// Write writes the IFD to w, which must be positioned at offset in the
+// file so that the pointers to entry data are right. next is the offset of
+// the following IFD, or zero if there is none. TIFF requires offset to be
+// even.
+func (d *IFD) Write(w io.Writer, offset int64, next int64) error {
+	if len(d.entries) > math.MaxUint16 {
+		return errors.New("tiff: too many IFD entries")
+	}
+	if offset < 0 || offset%2 != 0 || next < 0 || next%2 != 0 {
+		return errors.New("tiff: IFD offsets must be even and non-negative")
+	}
+	if uint64(offset)+uint64(d.Size()) > math.MaxUint32 || next > math.MaxUint32 {
+		return UnsupportedError{Feature: "IFD beyond 4GB in a classic TIFF file"}
+	}
+	return writeIFD(w, int(offset), d.entries, int(next))
+}
+
+// NewIntTag returns the Tag of the given integer data type holding v: one
+// of BYTE, SBYTE, SHORT, SSHORT, LONG, SLONG, IFD, or the LONG8, SLONG8 and
+// IFD8 of BigTIFF, which the encoder does not write. It fails if a value
+// is out of the range of the type.
+func NewIntTag(id, datatype uint16, v ...int64) (Tag, error) {
+	dt := int(datatype)
+	lo, hi := int64(0), int64(0)
+	switch dt {
+	case TypeByte:
+		hi = math.MaxUint8
+	case TypeSByte:
+		lo, hi = math.MinInt8, math.MaxInt8
+	case TypeShort:
+		hi = math.MaxUint16
+	case TypeSShort:
+		lo, hi = math.MinInt16, math.MaxInt16
+	case TypeLong, TypeIFD:
+		hi = math.MaxUint32
+	case TypeSLong:
+		lo, hi = math.MinInt32, math.MaxInt32
+	case TypeLong8, TypeIFD8:
+		hi = math.MaxInt64
+	case TypeSLong8:
+		lo, hi = math.MinInt64, math.MaxInt64
+	default:
+		return Tag{}, UnsupportedError{"integer data type", int(id), uint(dt)}
+	}
+	n := int(lengths[dt])
+	t := Tag{ID: id, DataType: datatype, Data: make([]byte, n*len(v))}
+	for i, x := range v {
+		if x < lo || x > hi {
+			return Tag{}, fmt.Errorf("tiff: value %d of tag %d out of the range of its type", x, id)
+		}
+		p := t.Data[i*n:]
+		switch n {
+		case 1:
+			p[0] = byte(x)
+		case 2:
+			binary.LittleEndian.PutUint16(p, uint16(x))
+		case 4:
+			binary.LittleEndian.PutUint32(p, uint32(x))
+		default:
+			binary.LittleEndian.PutUint64(p, uint64(x))
+		}
+	}
+	return t, nil
+}
+
+// NewFloatTag returns the Tag of the given data type holding v: FLOAT,
+// DOUBLE, or RATIONAL and SRATIONAL, whose values are the fractions
+// Rational and SRational return. It fails if a value does not fit a
+// RATIONAL or SRATIONAL.
+func NewFloatTag(id, datatype uint16, v ...float64) (Tag, error) {
+	dt := int(datatype)
+	if dt != TypeFloat && dt != TypeDouble && dt != TypeRational && dt != TypeSRational {
+		return Tag{}, UnsupportedError{"floating point data type", int(id), uint(dt)}
+	}
+	n := int(lengths[dt])
+	t := Tag{ID: id, DataType: datatype, Data: make([]byte, n*len(v))}
+	le := binary.LittleEndian
+	for i, x := range v {
+		p := t.Data[i*n:]
+		ok := true
+		switch dt {
+		case TypeFloat:
+			le.PutUint32(p, math.Float32bits(float32(x)))
+		case TypeDouble:
+			le.PutUint64(p, math.Float64bits(x))
+		case TypeRational:
+			var r [2]uint32
+			r, ok = Rational(x)
+			le.PutUint32(p, r[0])
+			le.PutUint32(p[4:], r[1])
+		case TypeSRational:
+			var r [2]int32
+			r, ok = SRational(x)
+			le.PutUint32(p, uint32(r[0]))
+			le.PutUint32(p[4:], uint32(r[1]))
+		}
+		if !ok {
+			return Tag{}, fmt.Errorf("tiff: value %g of tag %d out of the range of its type", x, id)
+		}
+	}
+	return t, nil
+}
+
+// Ints returns the values of t, of an integer data type.
+func (t Tag) Ints() ([]int64, error) {
+	dt := int(t.DataType)
+	switch dt {
+	case TypeByte, TypeSByte, TypeShort, TypeSShort, TypeLong, TypeSLong, TypeIFD, TypeLong8, TypeSLong8, TypeIFD8:
+	default:
+		return nil, fmt.Errorf("tiff: tag %d of type %d is not of integers", t.ID, dt)
+	}
+	n := int(lengths[dt])
+	le := binary.LittleEndian
+	v := make([]int64, len(t.Data)/n)
+	for i := range v {
+		p := t.Data[i*n:]
+		switch dt {
+		case TypeByte:
+			v[i] = int64(p[0])
+		case TypeSByte:
+			v[i] = int64(int8(p[0]))
+		case TypeShort:
+			v[i] = int64(le.Uint16(p))
+		case TypeSShort:
+			v[i] = int64(int16(le.Uint16(p)))
+		case TypeLong, TypeIFD:
+			v[i] = int64(le.Uint32(p))
+		case TypeSLong:
+			v[i] = int64(int32(le.Uint32(p)))
+		case TypeSLong8:
+			v[i] = int64(le.Uint64(p))
+		default:
+			u := le.Uint64(p)
+			if u > math.MaxInt64 {
+				return nil, fmt.Errorf("tiff: value %d of tag %d out of range", u, t.ID)
+			}
+			v[i] = int64(u)
+		}
+	}
+	return v, nil
+}
+
+// Floats returns the values of t, of any integer, rational or floating
+// point data type.
+func (t Tag) Floats() ([]float64, error) {
+	dt := int(t.DataType)
+	if !knownType(dt) || dt == TypeASCII || dt == TypeUndefined {
+		return nil, fmt.Errorf("tiff: tag %d of type %d is not numeric", t.ID, dt)
+	}
+	return tagFloats(dt, t.Data), nil
+}
+
+// tagFloats returns the numeric values in data, little-endian and of the
+// given data type.
+func tagFloats(dt int, data []byte) []float64 {
+	le := binary.LittleEndian
+	v := make([]float64, len(data)/int(lengths[dt]))
+	for i := range v {
+		p := data[i*int(lengths[dt]):]
+		switch dt {
+		case TypeByte:
+			v[i] = float64(p[0])
+		case TypeSByte:
+			v[i] = float64(int8(p[0]))
+		case TypeShort:
+			v[i] = float64(le.Uint16(p))
+		case TypeSShort:
+			v[i] = float64(int16(le.Uint16(p)))
+		case TypeLong, TypeIFD:
+			v[i] = float64(le.Uint32(p))
+		case TypeSLong:
+			v[i] = float64(int32(le.Uint32(p)))
+		case TypeRational:
+			v[i] = float64(le.Uint32(p)) / float64(le.Uint32(p[4:]))
+		case TypeSRational:
+			v[i] = float64(int32(le.Uint32(p))) / float64(int32(le.Uint32(p[4:])))
+		case TypeFloat:
+			v[i] = float64(math.Float32frombits(le.Uint32(p)))
+		case TypeDouble:
+			v[i] = math.Float64frombits(le.Uint64(p))
+		case TypeSLong8:
+			v[i] = float64(int64(le.Uint64(p)))
+		case TypeLong8, TypeIFD8:
+			v[i] = float64(le.Uint64(p))
+		}
+	}
+	return v
+}
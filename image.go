@@ -5,19 +5,37 @@
 package tiff
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"math"
+	"math/bits"
 )
 
 // Gray32 is an in-memory image whose At method returns color.Gray32 values.
 type Gray32 struct {
-	// Pix holds the image's pixels, as gray values in big-endian format. The pixel at
-	// (x, y) starts at Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)].
+	// Pix holds the image's pixels, as gray values. The pixel at (x, y) is
+	// Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)]. The values are native
+	// integers, whatever the byte order of the file they are read from or
+	// written to: the decoder and encoder convert them.
 	Pix []uint32
-	// Stride is the Pix stride (in bytes) between vertically adjacent pixels.
+	// Stride is the Pix stride (in samples, not bytes) between vertically
+	// adjacent pixels. It is at least the width of the image.
 	Stride int
 	// Rect is the image's bounds.
 	Rect image.Rectangle
+	// Range, if not nil, makes At return color.Gray16 values going from
+	// black at Range.Min to white at Range.Max, so that viewers knowing
+	// only color.Color show the samples with sensible contrast. Gray32At
+	// returns the samples whatever Range is.
+	Range *SampleRange
+	// Palette, if not nil, makes the samples indices into it, as in a
+	// classified raster: At returns the colors they select, or black for
+	// samples beyond it, and the encoder writes the image as a paletted
+	// one. It takes precedence over Range.
+	Palette color.Palette
 }
 
 func (p *Gray32) ColorModel() color.Model { return Gray32Model }
@@ -25,6 +43,16 @@ func (p *Gray32) ColorModel() color.Model { return Gray32Model }
 func (p *Gray32) Bounds() image.Rectangle { return p.Rect }
 
 func (p *Gray32) At(x, y int) color.Color {
+	if p.Palette != nil && (image.Point{x, y}.In(p.Rect)) {
+		if v := p.Pix[p.PixOffset(x, y)]; uint64(v) < uint64(len(p.Palette)) {
+			return p.Palette[v]
+		}
+		return color.Black
+	}
+	if p.Range != nil && (image.Point{x, y}.In(p.Rect)) {
+		i := p.PixOffset(x, y)
+		return p.Range.gray16(float64(p.Pix[i]))
+	}
 	return p.Gray32At(x, y)
 }
 
@@ -50,6 +78,44 @@ func (p *Gray32) SetGray32(x, y int, c Gray32Color) {
 	p.Pix[i] = c.Y
 }
 
+// ValueAt returns the sample at (x, y), or 0 if it is outside the image.
+func (p *Gray32) ValueAt(x, y int) uint32 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return p.Pix[p.PixOffset(x, y)]
+}
+
+// SetValue sets the sample at (x, y) to v.
+func (p *Gray32) SetValue(x, y int, v uint32) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = v
+}
+
+// Row returns a copy of the samples of row y, from Rect.Min.X to
+// Rect.Max.X. It returns nil if y is outside the image.
+func (p *Gray32) Row(y int) []uint32 {
+	if y < p.Rect.Min.Y || y >= p.Rect.Max.Y {
+		return nil
+	}
+	i := p.PixOffset(p.Rect.Min.X, y)
+	row := make([]uint32, p.Rect.Dx())
+	copy(row, p.Pix[i:i+len(row)])
+	return row
+}
+
+// SetRow sets the samples of row y, starting at Rect.Min.X, from row.
+// Values beyond the width of the image are ignored.
+func (p *Gray32) SetRow(y int, row []uint32) {
+	if y < p.Rect.Min.Y || y >= p.Rect.Max.Y {
+		return
+	}
+	i := p.PixOffset(p.Rect.Min.X, y)
+	copy(p.Pix[i:i+p.Rect.Dx()], row)
+}
+
 // SubImage returns an image representing the portion of the image p visible
 // through r. The returned value shares pixels with the original image.
 func (p *Gray32) SubImage(r image.Rectangle) image.Image {
@@ -62,9 +128,11 @@ func (p *Gray32) SubImage(r image.Rectangle) image.Image {
 	}
 	i := p.PixOffset(r.Min.X, r.Min.Y)
 	return &Gray32{
-		Pix:    p.Pix[i:],
-		Stride: p.Stride,
-		Rect:   r,
+		Pix:     p.Pix[i:],
+		Stride:  p.Stride,
+		Rect:    r,
+		Range:   p.Range,
+		Palette: p.Palette,
 	}
 }
 
@@ -77,18 +145,49 @@ func (p *Gray32) Opaque() bool {
 func NewGray32(r image.Rectangle) *Gray32 {
 	w, h := r.Dx(), r.Dy()
 	pix := make([]uint32, w*h)
-	return &Gray32{pix, w, r}
+	return &Gray32{Pix: pix, Stride: w, Rect: r}
+}
+
+// NewGray32WithStride returns a new Gray32 image with the given bounds
+// whose rows are stride samples apart, as for buffers whose rows are
+// padded. It returns an error if stride is less than the width of r.
+func NewGray32WithStride(r image.Rectangle, stride int) (*Gray32, error) {
+	pix, err := makeStrided(r, stride)
+	if err != nil {
+		return nil, err
+	}
+	return &Gray32{Pix: pix, Stride: stride, Rect: r}, nil
+}
+
+// Gray32FromBytes returns a new Gray32 image with the given bounds holding
+// the 32-bit samples of b, in the given byte order, whose rows start
+// byteStride bytes apart, as in buffers handed over by C code. The samples
+// are copied, so b may be reused; the image has a stride of its width.
+func Gray32FromBytes(b []byte, byteStride int, r image.Rectangle, order binary.ByteOrder) (*Gray32, error) {
+	m := NewGray32(r)
+	if err := unpackStrided(m.Pix, b, byteStride, r, order); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
 // GrayFloat32 is an in-memory image whose At method returns color.Gray32 values.
 type GrayFloat32 struct {
-	// Pix holds the image's pixels, as gray values in big-endian format. The pixel at
-	// (x, y) starts at Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)].
+	// Pix holds the image's pixels, as the bits of float32 gray values, as
+	// math.Float32bits returns them. The pixel at (x, y) is
+	// Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)]. As for Gray32, the bits
+	// are native, whatever the byte order of the file.
 	Pix []uint32
-	// Stride is the Pix stride (in bytes) between vertically adjacent pixels.
+	// Stride is the Pix stride (in samples, not bytes) between vertically
+	// adjacent pixels. It is at least the width of the image.
 	Stride int
 	// Rect is the image's bounds.
 	Rect image.Rectangle
+	// Range, if not nil, makes At return color.Gray16 values going from
+	// black at Range.Min to white at Range.Max, so that viewers knowing
+	// only color.Color show the samples with sensible contrast. Gray32At
+	// returns the samples whatever Range is.
+	Range *SampleRange
 }
 
 func (p *GrayFloat32) ColorModel() color.Model { return Gray32FloatModel }
@@ -96,6 +195,10 @@ func (p *GrayFloat32) ColorModel() color.Model { return Gray32FloatModel }
 func (p *GrayFloat32) Bounds() image.Rectangle { return p.Rect }
 
 func (p *GrayFloat32) At(x, y int) color.Color {
+	if p.Range != nil && (image.Point{x, y}.In(p.Rect)) {
+		i := p.PixOffset(x, y)
+		return p.Range.gray16(float64(math.Float32frombits(p.Pix[i])))
+	}
 	return p.Gray32At(x, y)
 }
 
@@ -121,6 +224,61 @@ func (p *GrayFloat32) SetGray32(x, y int, c GrayFloat32Color) {
 	p.Pix[i] = c.Y
 }
 
+// ValueAt returns the sample at (x, y), or NaN if it is outside the image.
+func (p *GrayFloat32) ValueAt(x, y int) float32 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return float32(math.NaN())
+	}
+	return math.Float32frombits(p.Pix[p.PixOffset(x, y)])
+}
+
+// BitsAt returns the bits of the sample at (x, y), as held in Pix, or 0 if
+// it is outside the image. Unlike ValueAt, it tells NaNs apart.
+func (p *GrayFloat32) BitsAt(x, y int) uint32 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return p.Pix[p.PixOffset(x, y)]
+}
+
+// SetValue sets the sample at (x, y) to v.
+func (p *GrayFloat32) SetValue(x, y int, v float32) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = math.Float32bits(v)
+}
+
+// Row returns a copy of the samples of row y, from Rect.Min.X to
+// Rect.Max.X. It returns nil if y is outside the image.
+func (p *GrayFloat32) Row(y int) []float32 {
+	if y < p.Rect.Min.Y || y >= p.Rect.Max.Y {
+		return nil
+	}
+	i := p.PixOffset(p.Rect.Min.X, y)
+	row := make([]float32, p.Rect.Dx())
+	for x, v := range p.Pix[i : i+len(row)] {
+		row[x] = math.Float32frombits(v)
+	}
+	return row
+}
+
+// SetRow sets the samples of row y, starting at Rect.Min.X, from row.
+// Values beyond the width of the image are ignored.
+func (p *GrayFloat32) SetRow(y int, row []float32) {
+	if y < p.Rect.Min.Y || y >= p.Rect.Max.Y {
+		return
+	}
+	i := p.PixOffset(p.Rect.Min.X, y)
+	if len(row) > p.Rect.Dx() {
+		row = row[:p.Rect.Dx()]
+	}
+	pix := p.Pix[i : i+len(row)]
+	for x, v := range row {
+		pix[x] = math.Float32bits(v)
+	}
+}
+
 // SubImage returns an image representing the portion of the image p visible
 // through r. The returned value shares pixels with the original image.
 func (p *GrayFloat32) SubImage(r image.Rectangle) image.Image {
@@ -136,6 +294,7 @@ func (p *GrayFloat32) SubImage(r image.Rectangle) image.Image {
 		Pix:    p.Pix[i:],
 		Stride: p.Stride,
 		Rect:   r,
+		Range:  p.Range,
 	}
 }
 
@@ -148,5 +307,76 @@ func (p *GrayFloat32) Opaque() bool {
 func NewGrayFloat32(r image.Rectangle) *GrayFloat32 {
 	w, h := r.Dx(), r.Dy()
 	pix := make([]uint32, w*h)
-	return &GrayFloat32{pix, w, r}
+	return &GrayFloat32{Pix: pix, Stride: w, Rect: r}
+}
+
+// NewGrayFloat32WithStride is like NewGray32WithStride for a GrayFloat32
+// image.
+func NewGrayFloat32WithStride(r image.Rectangle, stride int) (*GrayFloat32, error) {
+	pix, err := makeStrided(r, stride)
+	if err != nil {
+		return nil, err
+	}
+	return &GrayFloat32{Pix: pix, Stride: stride, Rect: r}, nil
+}
+
+// GrayFloat32FromBytes is like Gray32FromBytes for the float32 samples of
+// a GrayFloat32 image.
+func GrayFloat32FromBytes(b []byte, byteStride int, r image.Rectangle, order binary.ByteOrder) (*GrayFloat32, error) {
+	m := NewGrayFloat32(r)
+	if err := unpackStrided(m.Pix, b, byteStride, r, order); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// makeStrided returns the samples of an image of bounds r whose rows are
+// stride samples apart.
+func makeStrided(r image.Rectangle, stride int) ([]uint32, error) {
+	w, h := r.Dx(), r.Dy()
+	if w <= 0 || h <= 0 {
+		return nil, nil
+	}
+	if stride < w {
+		return nil, fmt.Errorf("tiff: image stride %d is less than its width %d", stride, w)
+	}
+	n, ok := mulInt(h-1, stride)
+	if !ok || n > math.MaxInt-w {
+		return nil, errors.New("tiff: image too large for its stride")
+	}
+	return make([]uint32, n+w), nil
+}
+
+// unpackStrided copies into dst, the samples of an image of bounds r with
+// a stride of its width, the 32-bit samples of b whose rows start
+// byteStride bytes apart.
+func unpackStrided(dst []uint32, b []byte, byteStride int, r image.Rectangle, order binary.ByteOrder) error {
+	w, h := r.Dx(), r.Dy()
+	if w <= 0 || h <= 0 {
+		return nil
+	}
+	if byteStride < 4*w {
+		return fmt.Errorf("tiff: byte stride %d is less than the %d bytes of a row", byteStride, 4*w)
+	}
+	if n, ok := mulInt(h-1, byteStride); !ok || n > len(b)-4*w {
+		return errors.New("tiff: too few bytes for the image bounds")
+	}
+	for y := 0; y < h; y++ {
+		row := b[y*byteStride:]
+		for x := range dst[y*w : (y+1)*w] {
+			dst[y*w+x] = order.Uint32(row[4*x:])
+		}
+	}
+	return nil
+}
+
+// SwapSampleBytes reverses the order of the bytes of each element of pix,
+// the Pix of a Gray32 or GrayFloat32. It converts the pixels of code that
+// filled Pix with big-endian values on a little-endian machine, or the
+// reverse, taking the documentation of older versions at its word, into
+// the native values the package expects.
+func SwapSampleBytes(pix []uint32) {
+	for i, v := range pix {
+		pix[i] = bits.ReverseBytes32(v)
+	}
 }
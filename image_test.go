@@ -0,0 +1,413 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestRows(t *testing.T) {
+	g := NewGray32(image.Rect(2, 3, 6, 5))
+	g.SetRow(4, []uint32{1, 2, 3, 4, 5})
+	if got := g.Row(4); len(got) != 4 || got[0] != 1 || got[3] != 4 {
+		t.Errorf("Gray32.Row(4) = %v, want [1 2 3 4]", got)
+	}
+	if g.Gray32At(2, 4).Y != 1 || g.Gray32At(5, 4).Y != 4 {
+		t.Error("Gray32.SetRow stored samples at the wrong position")
+	}
+	if g.Row(5) != nil {
+		t.Error("Gray32.Row returned a row outside the image")
+	}
+
+	f := NewGrayFloat32(image.Rect(-1, 0, 2, 2))
+	f.SetRow(1, []float32{0.5, -2})
+	if got := f.Row(1); len(got) != 3 || got[0] != 0.5 || got[1] != -2 || got[2] != 0 {
+		t.Errorf("GrayFloat32.Row(1) = %v, want [0.5 -2 0]", got)
+	}
+	if v := math.Float32frombits(f.Pix[f.PixOffset(0, 1)]); v != -2 {
+		t.Errorf("sample at (0, 1) = %v, want -2", v)
+	}
+}
+
+func TestValueAt(t *testing.T) {
+	g := NewGray32(image.Rect(1, 1, 3, 3))
+	g.SetValue(2, 1, 0x01020304)
+	g.SetValue(3, 1, 7) // Outside.
+	if v := g.ValueAt(2, 1); v != 0x01020304 || g.Pix[1] != v {
+		t.Errorf("Gray32.ValueAt(2, 1) = %#x, want 0x01020304", v)
+	}
+	if v := g.ValueAt(0, 0); v != 0 {
+		t.Errorf("Gray32.ValueAt outside the image = %d", v)
+	}
+	// Samples filled byte-swapped still come out as stored once swapped back.
+	SwapSampleBytes(g.Pix)
+	if g.Pix[1] != 0x04030201 {
+		t.Errorf("swapped sample = %#x, want 0x04030201", g.Pix[1])
+	}
+	SwapSampleBytes(g.Pix)
+
+	f := NewGrayFloat32(image.Rect(0, 0, 2, 1))
+	f.SetValue(0, 0, -1.5)
+	f.Pix[1] = 0x7fc00001 // A NaN with a payload.
+	if v := f.ValueAt(0, 0); v != -1.5 {
+		t.Errorf("GrayFloat32.ValueAt(0, 0) = %g, want -1.5", v)
+	}
+	if v := f.ValueAt(1, 0); v == v {
+		t.Errorf("GrayFloat32.ValueAt(1, 0) = %g, want NaN", v)
+	}
+	if b := f.BitsAt(1, 0); b != 0x7fc00001 {
+		t.Errorf("GrayFloat32.BitsAt(1, 0) = %#x, want 0x7fc00001", b)
+	}
+	if v := f.ValueAt(2, 0); v == v {
+		t.Errorf("GrayFloat32.ValueAt outside the image = %g, want NaN", v)
+	}
+
+	// The values decoded are those encoded, whatever the order of the file.
+	var buf bytes.Buffer
+	if err := Encode(&buf, g, nil); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SampleEndianness() != binary.LittleEndian {
+		t.Errorf("SampleEndianness = %v, want little-endian", r.SampleEndianness())
+	}
+	m, err := r.ReadRegion(r.Bounds())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := m.(*Gray32).ValueAt(1, 0); v != 0x01020304 {
+		t.Errorf("decoded sample = %#x, want 0x01020304", v)
+	}
+}
+
+func TestStride(t *testing.T) {
+	r := image.Rect(0, 0, 3, 2)
+	g, err := NewGray32WithStride(r, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Stride != 5 || len(g.Pix) != 8 {
+		t.Errorf("stride %d, %d samples, want 5 and 8", g.Stride, len(g.Pix))
+	}
+	g.SetRow(1, []uint32{1, 2, 3})
+	if g.Pix[5] != 1 || g.ValueAt(2, 1) != 3 || g.Row(1)[1] != 2 {
+		t.Error("samples of a padded image at the wrong position")
+	}
+	if _, err := NewGrayFloat32WithStride(r, 2); err == nil {
+		t.Error("accepted a stride less than the width")
+	}
+
+	// Rows of 3 samples padded to 16 bytes.
+	b := make([]byte, 32)
+	for i := range 3 {
+		binary.BigEndian.PutUint32(b[4*i:], uint32(i+1))
+		binary.BigEndian.PutUint32(b[16+4*i:], math.Float32bits(float32(i)+0.5))
+	}
+	f, err := GrayFloat32FromBytes(b, 16, r, binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Stride != 3 || f.ValueAt(1, 1) != 1.5 {
+		t.Errorf("GrayFloat32FromBytes: stride %d, sample (1, 1) = %g", f.Stride, f.ValueAt(1, 1))
+	}
+	if g, err := Gray32FromBytes(b[:28], 16, r, binary.BigEndian); err != nil || g.ValueAt(2, 0) != 3 {
+		t.Errorf("Gray32FromBytes of a short last row: %v", err)
+	}
+	if _, err := Gray32FromBytes(b[:27], 16, r, binary.BigEndian); err == nil {
+		t.Error("accepted too few bytes")
+	}
+	if _, err := Gray32FromBytes(b, 8, r, binary.BigEndian); err == nil {
+		t.Error("accepted a byte stride less than a row")
+	}
+}
+
+func TestColorize(t *testing.T) {
+	f := NewGrayFloat32(image.Rect(0, 0, 5, 1))
+	nan := float32(math.NaN())
+	f.SetRow(0, []float32{0, 5, 10, nan, -9999})
+	nodata := -9999.0
+	m := Colorize(f, GrayscaleRamp, Stretch{NoData: &nodata})
+	for x, want := range []color.NRGBA{{0, 0, 0, 255}, {128, 128, 128, 255}, {255, 255, 255, 255}, {}, {}} {
+		if got := m.NRGBAAt(x, 0); got != want {
+			t.Errorf("grayscale (%d, 0) = %v, want %v", x, got, want)
+		}
+	}
+	// A reversed stretch, clamped beyond its ends.
+	m = Colorize(f, ViridisRamp, Stretch{Min: 5, Max: 0})
+	if got := m.NRGBAAt(0, 0); got != ViridisRamp.Stops[8].Color {
+		t.Errorf("viridis (0, 0) = %v, want %v", got, ViridisRamp.Stops[8].Color)
+	}
+	if got := m.NRGBAAt(2, 0); got != ViridisRamp.Stops[0].Color {
+		t.Errorf("viridis (2, 0) = %v, want %v", got, ViridisRamp.Stops[0].Color)
+	}
+
+	lut := LookupTable([]color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}})
+	m = Colorize(f, lut, Stretch{Min: 0, Max: 10})
+	for x, want := range []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}} {
+		if got := m.NRGBAAt(x, 0); got != want {
+			t.Errorf("lookup table (%d, 0) = %v, want %v", x, got, want)
+		}
+	}
+
+	// Clipping leaves the outlier out of the stretch.
+	g := NewGrayFloat32(image.Rect(0, 0, 101, 1))
+	for x := 0; x < 100; x++ {
+		g.Pix[x] = math.Float32bits(float32(x))
+	}
+	g.Pix[100] = math.Float32bits(1e6)
+	m = Colorize(g, GrayscaleRamp, Stretch{Clip: 0.02})
+	if got := m.NRGBAAt(98, 0).R; got != 255 {
+		t.Errorf("clipped stretch: (98, 0) has red %d, want 255", got)
+	}
+}
+
+func TestLegend(t *testing.T) {
+	ramp := ColorRamp{Stops: []ColorStop{{0, color.NRGBA{0, 0, 0, 255}}, {1, color.NRGBA{200, 100, 0, 255}}}}
+	m, err := Legend(ramp, 0, 100, image.Pt(4, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The centers of the columns are at 12.5, 37.5, 62.5 and 87.5.
+	for x, want := range []color.NRGBA{{25, 13, 0, 255}, {75, 38, 0, 255}, {125, 63, 0, 255}, {175, 88, 0, 255}} {
+		if got := m.NRGBAAt(x, 1); got != want {
+			t.Errorf("horizontal legend (%d, 1) = %v, want %v", x, got, want)
+		}
+	}
+	// Vertical, with the high values at the top, of a reversed stretch.
+	m, err = Legend(ramp, 100, 0, image.Pt(1, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.NRGBAAt(0, 0); got != (color.NRGBA{25, 13, 0, 255}) {
+		t.Errorf("reversed vertical legend (0, 0) = %v", got)
+	}
+	if got := m.NRGBAAt(0, 3); got != (color.NRGBA{175, 88, 0, 255}) {
+		t.Errorf("reversed vertical legend (0, 3) = %v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeLegend(&buf, ViridisRamp, -10, 10, image.Pt(64, 8)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Bounds() != image.Rect(0, 0, 64, 8) {
+		t.Errorf("PNG legend of bounds %v", p.Bounds())
+	}
+	if _, err := Legend(ramp, 5, 5, image.Pt(4, 1)); err == nil {
+		t.Error("Legend accepted an empty range")
+	}
+	if _, err := Legend(ramp, 0, 1, image.Pt(0, 1)); err == nil {
+		t.Error("Legend accepted an empty size")
+	}
+}
+
+func TestSampleAtWorld(t *testing.T) {
+	f := NewGrayFloat32(image.Rect(0, 0, 3, 2))
+	f.SetRow(0, []float32{0, 10, 20})
+	f.SetRow(1, []float32{30, 40, float32(math.NaN())})
+	// 10 m pixels with the top left corner at (1000, 5000).
+	g := &GeoInfo{PixelScale: []float64{10, 10, 0}, Tiepoints: []float64{0, 0, 0, 1000, 5000, 0}}
+	gt, ok := g.GeoTransform()
+	if !ok || gt != (GeoTransform{1000, 10, 0, 5000, 0, -10}) {
+		t.Fatalf("GeoTransform() = %v, %t", gt, ok)
+	}
+	for _, tc := range []struct {
+		x, y   float64
+		method Interp
+		want   float32
+		ok     bool
+	}{
+		{1012, 4999, InterpNearest, 10, true},
+		{1015, 4995, InterpBilinear, 10, true},
+		{1010, 4995, InterpBilinear, 5, true},
+		{1010, 4990, InterpBilinear, 20, true},
+		{1025, 4985, InterpNearest, 0, false},
+		// The NaN neighbor is left out.
+		{1020, 4990, InterpBilinear, 70.0 / 3, true},
+		{999, 4995, InterpBilinear, 0, false},
+		{1015, 5001, InterpNearest, 0, false},
+	} {
+		v, ok := f.SampleAtWorld(tc.x, tc.y, gt, tc.method)
+		if ok != tc.ok || ok && math.Abs(float64(v-tc.want)) > 1e-4 {
+			t.Errorf("SampleAtWorld(%g, %g, %d) = %g, %t, want %g, %t", tc.x, tc.y, tc.method, v, ok, tc.want, tc.ok)
+		}
+	}
+
+	g.KeyDirectory = []uint16{1, 1, 0, 1, GeoKeyRasterType, 0, 1, RasterPixelIsPoint}
+	if gt, _ := g.GeoTransform(); gt[0] != 995 || gt[3] != 5005 {
+		t.Errorf("GeoTransform() of PixelIsPoint = %v, want the origin at (995, 5005)", gt)
+	}
+}
+
+func TestAlignTo(t *testing.T) {
+	src := NewGrayFloat32(image.Rect(0, 0, 4, 4))
+	for i := range src.Pix {
+		src.Pix[i] = math.Float32bits(float32(i))
+	}
+	src.Pix[5] = math.Float32bits(float32(math.NaN()))
+	srcGT := GeoTransform{1000, 10, 0, 5000, 0, -10}
+	for _, tc := range []struct {
+		gt     GeoTransform
+		size   image.Point
+		method Resampling
+		want   []float32
+	}{
+		// Halved, leaving out the NaN sample.
+		{GeoTransform{1000, 20, 0, 5000, 0, -20}, image.Pt(2, 2), ResampleAverage, []float32{5.0 / 3, 4.5, 10.5, 12.5}},
+		{GeoTransform{1000, 20, 0, 5000, 0, -20}, image.Pt(2, 2), ResampleNearest, []float32{float32(math.NaN()), 7, 13, 15}},
+		// Shifted by a pixel, with a column outside src.
+		{GeoTransform{1010, 10, 0, 5000, 0, -10}, image.Pt(4, 1), ResampleNearest, []float32{1, 2, 3, float32(math.NaN())}},
+		// Enlarged.
+		{GeoTransform{1000, 5, 0, 5000, 0, -5}, image.Pt(3, 1), ResampleAverage, []float32{0, 0, 1}},
+	} {
+		dst, err := AlignTo(src, srcGT, tc.gt, tc.size, tc.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range tc.want {
+			got := math.Float32frombits(dst.Pix[i])
+			if got != want && !(math.IsNaN(float64(got)) && math.IsNaN(float64(want))) {
+				t.Errorf("%v, %d: pixel %d = %g, want %g", tc.gt, tc.method, i, got, want)
+			}
+		}
+	}
+	if _, err := AlignTo(src, GeoTransform{}, srcGT, image.Pt(1, 1), ResampleNearest); err == nil {
+		t.Error("AlignTo accepted a degenerate source transformation")
+	}
+}
+
+func TestRasterAlgebra(t *testing.T) {
+	nan := float32(math.NaN())
+	newRow := func(v ...float32) *GrayFloat32 {
+		m := NewGrayFloat32(image.Rect(1, 2, 1+len(v), 3))
+		m.SetRow(2, v)
+		return m
+	}
+	a := newRow(1, 2, nan, 4)
+	b := newRow(10, -20, 30, 0)
+	cond := newRow(1, 0, 1, nan)
+	check := func(name string, m *GrayFloat32, err error, want ...float32) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := m.Row(2)
+		for i := range want {
+			if got[i] != want[i] && !(math.IsNaN(float64(got[i])) && math.IsNaN(float64(want[i]))) {
+				t.Errorf("%s = %v, want %v", name, got, want)
+				return
+			}
+		}
+	}
+	m, err := Add(a, b)
+	check("Add", m, err, 11, -18, nan, 4)
+	m, err = Subtract(b, a)
+	check("Subtract", m, err, 9, -22, nan, -4)
+	m, err = Multiply(a, b)
+	check("Multiply", m, err, 10, -40, nan, 0)
+	check("ScaleOffset", ScaleOffset(a, 2, -1), nil, 1, 3, nan, 7)
+	m, err = Where(cond, a, b)
+	check("Where", m, err, 1, -20, nan, nan)
+	NoDataToNaN(b, 0)
+	check("NoDataToNaN", b, nil, 10, -20, 30, nan)
+
+	if _, err := Add(a, newRow(1, 2, 3)); err == nil {
+		t.Error("Add accepted images of different bounds")
+	}
+}
+
+func TestZonalStats(t *testing.T) {
+	nan := float32(math.NaN())
+	r := image.Rect(1, 1, 5, 3)
+	values := NewGrayFloat32(r)
+	values.SetRow(1, []float32{1, 2, 3, nan})
+	values.SetRow(2, []float32{10, 4, nan, 7})
+	zones := NewGray32(image.Rect(0, 0, 5, 3))
+	zones.SetRow(1, []uint32{9, 1, 1, 2, 3})
+	zones.SetRow(2, []uint32{9, 2, 1, 4, 3})
+
+	got := ZonalStats(values, zones)
+	want := map[uint32]Stats{
+		1: {Count: 3, Min: 1, Max: 4, Mean: 7.0 / 3, StdDev: math.Sqrt(14.0 / 9)},
+		2: {Count: 2, Min: 3, Max: 10, Mean: 6.5, StdDev: 3.5},
+		3: {Count: 1, Min: 7, Max: 7, Mean: 7},
+	}
+	if len(got) != len(want)+1 {
+		t.Errorf("ZonalStats has %d zones, want %d", len(got), len(want)+1)
+	}
+	for id, w := range want {
+		g := got[id]
+		if g.Count != w.Count || g.Min != w.Min || g.Max != w.Max || math.Abs(g.Mean-w.Mean) > 1e-12 || math.Abs(g.StdDev-w.StdDev) > 1e-12 {
+			t.Errorf("zone %d: %+v, want %+v", id, g, w)
+		}
+	}
+	if g := got[4]; g.Count != 0 || !math.IsNaN(g.Mean) || !math.IsNaN(g.Min) {
+		t.Errorf("zone without data: %+v", g)
+	}
+	if _, ok := got[9]; ok {
+		t.Error("zone 9, outside of the values, was counted")
+	}
+}
+
+func TestRasterizePolygon(t *testing.T) {
+	gt := GeoTransform{100, 10, 0, 200, 0, -10}
+	outer := []Point{{120, 180}, {180, 180}, {180, 120}, {120, 120}}
+	hole := []Point{{140, 160}, {160, 160}, {160, 140}, {140, 140}, {140, 160}}
+	m := RasterizePolygon([][]Point{outer, hole}, gt, image.Pt(10, 10))
+	if m.Rect != image.Rect(0, 0, 10, 10) {
+		t.Fatalf("bounds %v", m.Rect)
+	}
+	n := 0
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			inside := x >= 2 && x < 8 && y >= 2 && y < 8 && !(x >= 4 && x < 6 && y >= 4 && y < 6)
+			if v := m.Gray32At(x, y).Y; v != 0 != inside {
+				t.Errorf("pixel (%d, %d) = %d", x, y, v)
+			}
+			n += int(m.Gray32At(x, y).Y)
+		}
+	}
+	if n != 32 {
+		t.Errorf("%d pixels inside, want 32", n)
+	}
+
+	values := NewGrayFloat32(m.Rect)
+	for i := range values.Pix {
+		values.Pix[i] = math.Float32bits(float32(i % 10))
+	}
+	if s := ZonalStats(values, m)[1]; s.Count != 32 || s.Min != 2 || s.Max != 7 || s.Mean != 4.5 {
+		t.Errorf("stats inside the polygon = %+v", s)
+	}
+
+	// A triangle cut by the edge of the mask.
+	tri := RasterizePolygon([][]Point{{{95, 205}, {150, 205}, {95, 150}}}, gt, image.Pt(4, 4))
+	for y, want := range []string{"1111", "111.", "11..", "1..."} {
+		for x := range want {
+			if got := tri.Gray32At(x, y).Y == 1; got != (want[x] == '1') {
+				t.Errorf("triangle pixel (%d, %d) = %v, want %c", x, y, got, want[x])
+			}
+		}
+	}
+
+	if m := RasterizePolygon([][]Point{outer}, GeoTransform{}, image.Pt(4, 4)); slices.Contains(m.Pix, 1) {
+		t.Error("RasterizePolygon filled a mask placed by a singular transform")
+	}
+	if m := RasterizePolygon([][]Point{outer}, gt, image.Pt(-4, -4)); len(m.Pix) != 0 {
+		t.Errorf("mask of negative size has %d pixels", len(m.Pix))
+	}
+}
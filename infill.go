@@ -0,0 +1,105 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// A NoDataFill tells the encoder how to rewrite the samples of floating
+// point images that hold no data.
+type NoDataFill int
+
+const (
+	// FillNone stores the samples as they are.
+	FillNone NoDataFill = iota
+	// FillNaNWithNoData stores NaN samples as the NoData value of the
+	// Metadata, which must be set, for software that cannot handle NaN.
+	FillNaNWithNoData
+	// FillNoDataWithNaN stores the samples equal to the NoData value of the
+	// Metadata as NaN, and declares NaN as the NoData value.
+	FillNoDataWithNaN
+)
+
+// fillNoData returns m with its samples marking no data rewritten as
+// e.NoDataFill says, and md with the NoData value they are then marked
+// by. Images other than those of floating point samples, and quantized
+// ones, whose NaN samples are stored as NoData anyway, are returned as
+// they are. m and md are left unchanged.
+func (e *Encoder) fillNoData(m image.Image, md *Metadata) (image.Image, *Metadata, error) {
+	if e.NoDataFill == FillNone {
+		return m, md, nil
+	}
+	if e.NoDataFill != FillNaNWithNoData && e.NoDataFill != FillNoDataWithNaN {
+		return nil, nil, errors.New("tiff: invalid NoDataFill")
+	}
+	switch m.(type) {
+	case *GrayFloat32, *bandStack:
+	default:
+		return m, md, nil
+	}
+	if md != nil && md.Quantization != nil {
+		return m, md, nil
+	}
+	var noData *float64
+	if md != nil {
+		noData = md.NoData
+	}
+	if noData == nil && e.NoDataFill == FillNaNWithNoData {
+		return nil, nil, errors.New("tiff: NaN to be filled without a NoData value")
+	}
+	if noData == nil || math.IsNaN(*noData) {
+		return m, md, nil
+	}
+
+	// fill returns the sample of bits v as it is stored.
+	nd := float32(*noData)
+	fill := func(v uint32) uint32 { return v }
+	switch e.NoDataFill {
+	case FillNaNWithNoData:
+		bits := math.Float32bits(nd)
+		fill = func(v uint32) uint32 {
+			if f := math.Float32frombits(v); f != f {
+				return bits
+			}
+			return v
+		}
+	case FillNoDataWithNaN:
+		nan := math.Float32bits(float32(math.NaN()))
+		fill = func(v uint32) uint32 {
+			if math.Float32frombits(v) == nd {
+				return nan
+			}
+			return v
+		}
+		filled := *md
+		filled.NoData = new(float64)
+		*filled.NoData = math.NaN()
+		md = &filled
+	}
+	switch m := m.(type) {
+	case *GrayFloat32:
+		r := m.Rect
+		dst := &GrayFloat32{Pix: make([]uint32, r.Dx()*r.Dy()), Stride: r.Dx(), Rect: r, Range: m.Range}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := dst.Pix[(y-r.Min.Y)*dst.Stride:][:r.Dx()]
+			copy(row, m.Pix[m.PixOffset(r.Min.X, y):])
+			for i, v := range row {
+				row[i] = fill(v)
+			}
+		}
+		return dst, md, nil
+	case *bandStack:
+		dst := *m
+		dst.pix = append([]byte(nil), m.pix...)
+		for i := 0; i+4 <= len(dst.pix); i += 4 {
+			enc.PutUint32(dst.pix[i:], fill(enc.Uint32(dst.pix[i:])))
+		}
+		return &dst, md, nil
+	}
+	return m, md, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The checks made with the Strict option. Files corrupted by truncated
+// copies or buggy writers often still decode, into images with garbage or
+// missing rows; these checks reject them instead, naming the block at
+// fault.
+
+// A byteRange is a span of the file holding a block or a part of the IFD.
+type byteRange struct {
+	off, end int64
+	what     string
+	block    bool
+}
+
+func (r byteRange) String() string {
+	return fmt.Sprintf("%s (bytes %d-%d)", r.what, r.off, r.end-1)
+}
+
+// blockName names block (i, j) in diagnostics by its index in the table of
+// offsets.
+func (d *decoder) blockName(i, j int) string {
+	if d.blockPadding {
+		return fmt.Sprintf("tile %d", j*d.blocksAcross+i)
+	}
+	return fmt.Sprintf("strip %d", j)
+}
+
+// blockSize returns the size of block (i, j) once decompressed. It is less
+// than blockBytes for the last strip when it is cut short by the image.
+func (d *decoder) blockSize(i, j int) int64 {
+	b := d.blockBounds(i, j)
+	if d.format == formatYCbCr {
+		return d.unitBytes(b.Dx(), b.Dy())
+	}
+	return int64(b.Dy()) * int64(d.rowBytes(b.Dx()))
+}
+
+// sizeError reports that block (i, j) decompressed to n bytes rather than
+// the want it should. n is want+1 if there was more data than that.
+func (d *decoder) sizeError(i, j int, n, want int64) error {
+	if n > want {
+		return FormatError(fmt.Sprintf("%s decompresses to more than %d bytes", d.blockName(i, j), want))
+	}
+	return FormatError(fmt.Sprintf("%s decompresses to %d bytes, expected %d", d.blockName(i, j), n, want))
+}
+
+// checkBlocks reports a FormatError if the data of a block overlaps that of
+// another block, the IFD of the image or the data of its entries, or if an
+// uncompressed block does not hold exactly its pixels. Empty blocks are
+// ignored, and so are blocks sharing the very same data, as some writers
+// store identical blocks once.
+func (d *decoder) checkBlocks() error {
+	ranges, err := d.ifdRanges()
+	if err != nil {
+		return err
+	}
+	// Transformed blocks hold more than their pixels.
+	uncompressed := d.uncompressed() && d.transform == nil
+	for j := 0; j < d.blocksDown; j++ {
+		for i := 0; i < d.blocksAcross; i++ {
+			k := j*d.blocksAcross + i
+			off, n := int64(d.blockOffsets[k]), int64(d.blockCounts[k])
+			if n == 0 {
+				continue
+			}
+			if want := d.blockSize(i, j); uncompressed && n != want {
+				return FormatError(fmt.Sprintf("%s holds %d bytes, expected %d", d.blockName(i, j), n, want))
+			}
+			ranges = append(ranges, byteRange{off, off + n, d.blockName(i, j), true})
+		}
+	}
+
+	sort.SliceStable(ranges, func(a, b int) bool { return ranges[a].off < ranges[b].off })
+	last := 0 // The range reaching furthest so far.
+	for k := 1; k < len(ranges); k++ {
+		r, p := ranges[k], ranges[last]
+		if r.off < p.end && (r.block || p.block) && !(r.block && p.block && r.off == p.off && r.end == p.end) {
+			return FormatError(fmt.Sprintf("%v overlaps %v", r, p))
+		}
+		if r.end > p.end {
+			last = k
+		}
+	}
+	return nil
+}
+
+// ifdRanges returns the spans of the file holding the IFD of the image and
+// the data of its entries not held in the IFD itself.
+func (d *decoder) ifdRanges() ([]byteRange, error) {
+	var p [2]byte
+	if _, err := d.r.ReadAt(p[:], d.imageIFD); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n := int64(d.byteOrder.Uint16(p[:]))
+	entries, err := safeReadAt(d.r, uint64(n*ifdLen), d.imageIFD+2)
+	if err != nil {
+		return nil, err
+	}
+	ranges := []byteRange{{d.imageIFD, d.imageIFD + 2 + n*ifdLen + 4, "the IFD", false}}
+	for e := entries; len(e) >= ifdLen; e = e[ifdLen:] {
+		tag, datatype := d.byteOrder.Uint16(e[0:2]), d.byteOrder.Uint16(e[2:4])
+		if !knownType(int(datatype)) {
+			continue
+		}
+		size := int64(lengths[datatype]) * int64(d.byteOrder.Uint32(e[4:8]))
+		if size > 4 {
+			off := int64(d.byteOrder.Uint32(e[8:12]))
+			ranges = append(ranges, byteRange{off, off + size, fmt.Sprintf("the data of field %d", tag), false})
+		}
+	}
+	return ranges, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+)
+
+// With JPEG compression (TIFF Technical Note #2), each strip or tile is a
+// JPEG stream of its own, decoded and encoded with image/jpeg. The tables
+// shared by the blocks may be held in the JPEGTables field instead, in
+// which case the streams are abbreviated. Color images are normally stored
+// as YCbCr, converted and subsampled by the JPEG codec.
+
+var (
+	jpegSOI = []byte{0xff, 0xd8}
+	jpegEOI = []byte{0xff, 0xd9}
+)
+
+// checkJPEG reports an error unless the JPEG compressed image can be
+// decoded, and reads the tables shared by its blocks.
+func (d *decoder) checkJPEG() error {
+	switch {
+	case d.bitsPerSample != 8:
+		return UnsupportedError{"JPEG with BitsPerSample", TagBitsPerSample, uint(d.bitsPerSample)}
+	case d.format == formatGray, d.format == formatYCbCr:
+	case d.format == formatNRGBA && d.samplesPerPixel == 3:
+	default:
+		return UnsupportedError{"JPEG with PhotometricInterpretation", TagPhotometricInterpretation, d.firstVal(TagPhotometricInterpretation)}
+	}
+	_, tables, ok, err := d.entryData(TagJPEGTables)
+	if err != nil || !ok {
+		return err
+	}
+	// The tables form an abbreviated stream, from SOI to EOI, which the
+	// data of each block continues once its own SOI is dropped.
+	if len(tables) < 4 || !bytes.HasPrefix(tables, jpegSOI) || !bytes.HasSuffix(tables, jpegEOI) {
+		return FormatError("bad JPEGTables")
+	}
+	d.jpegTables = tables[:len(tables)-2]
+	return nil
+}
+
+// jpegBlock decodes the n bytes of JPEG data in r into the samples of a
+// block, laid out as if they were uncompressed.
+func (d *decoder) jpegBlock(r io.Reader, n int64) (io.ReadCloser, error) {
+	data, err := readBuf(r, nil, n)
+	if err != nil {
+		return nil, err
+	}
+	if d.jpegTables != nil {
+		if !bytes.HasPrefix(data, jpegSOI) {
+			return nil, FormatError("JPEG data without SOI")
+		}
+		data = append(append([]byte(nil), d.jpegTables...), data[2:]...)
+	}
+	m, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := m.Bounds()
+	if b.Dx() != d.blockWidth || b.Dy() > d.blockHeight {
+		return nil, FormatError(fmt.Sprintf("JPEG data of %dx%d pixels in a %dx%d block", b.Dx(), b.Dy(), d.blockWidth, d.blockHeight))
+	}
+
+	var out []byte
+	switch d.format {
+	case formatYCbCr:
+		out = jpegUnits(m, d.subsampleX, d.subsampleY)
+	case formatGray:
+		out = make([]byte, 0, b.Dx()*b.Dy())
+		g, _ := m.(*image.Gray)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			if g != nil {
+				out = append(out, g.Pix[g.PixOffset(b.Min.X, y):][:b.Dx()]...)
+				continue
+			}
+			for x := b.Min.X; x < b.Max.X; x++ {
+				out = append(out, color.GrayModel.Convert(m.At(x, y)).(color.Gray).Y)
+			}
+		}
+	default:
+		out = make([]byte, 0, 3*b.Dx()*b.Dy())
+		ycc, _ := m.(*image.YCbCr)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if ycc != nil {
+					c := ycc.YCbCrAt(x, y)
+					r, g, b := color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+					out = append(out, r, g, b)
+					continue
+				}
+				c := color.RGBAModel.Convert(m.At(x, y)).(color.RGBA)
+				out = append(out, c.R, c.G, c.B)
+			}
+		}
+	}
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
+
+// jpegUnits returns the pixels of m as YCbCr data units of sx×sy luma
+// samples followed by a Cb and a Cr sample, as decodeYCbCr reads them.
+// Units reaching past m repeat its last row and column.
+func jpegUnits(m image.Image, sx, sy int) []byte {
+	b := m.Bounds()
+	ycc, _ := m.(*image.YCbCr)
+	at := func(x, y int) color.YCbCr {
+		x, y = min(x, b.Max.X-1), min(y, b.Max.Y-1)
+		if ycc != nil {
+			return ycc.YCbCrAt(x, y)
+		}
+		return color.YCbCrModel.Convert(m.At(x, y)).(color.YCbCr)
+	}
+	across, down := (b.Dx()+sx-1)/sx, (b.Dy()+sy-1)/sy
+	out := make([]byte, 0, across*down*(sx*sy+2))
+	for y0 := b.Min.Y; y0 < b.Max.Y; y0 += sy {
+		for x0 := b.Min.X; x0 < b.Max.X; x0 += sx {
+			for j := 0; j < sy; j++ {
+				for i := 0; i < sx; i++ {
+					out = append(out, at(x0+i, y0+j).Y)
+				}
+			}
+			c := at(x0, y0)
+			out = append(out, c.Cb, c.Cr)
+		}
+	}
+	return out
+}
+
+// jpegSource returns the image whose pixels are written when m is JPEG
+// compressed: m itself if it is an *image.Gray or an *image.RGBA, or else
+// an *image.RGBA copy of it. Images with transparency, which JPEG cannot
+// hold, and gray images of more than 8 bits are refused.
+func jpegSource(m image.Image) (image.Image, error) {
+	switch m.(type) {
+	case *image.Gray:
+		return m, nil
+	case *Gray32, *GrayFloat32:
+		return nil, UnsupportedError{Feature: fmt.Sprintf("JPEG compression of a %T", m)}
+	}
+	if o, ok := m.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		return nil, UnsupportedError{Feature: "JPEG compression of an image with transparency"}
+	}
+	if _, ok := m.(*image.RGBA); ok {
+		return m, nil
+	}
+	b := m.Bounds()
+	if _, err := classicImageLen(b.Dx(), b.Dy(), 4); err != nil {
+		return nil, err
+	}
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, m, b.Min, draw.Src)
+	return dst, nil
+}
+
+// setJPEGLayout sets the layout of p, which holds the pixels of an
+// *image.Gray or *image.RGBA, for JPEG compression. Color is stored as
+// YCbCr, subsampled 2×2 as image/jpeg does.
+func (p *page) setJPEGLayout() {
+	l := &p.layout
+	l.extraSamples = nil
+	if p.pixBytes == 1 {
+		l.bitsPerSample = []uint32{8}
+		return
+	}
+	l.bitsPerSample = []uint32{8, 8, 8}
+	l.samplesPerPixel = 3
+	l.photometric = PhotometricYCbCr
+	l.extra = append(l.extra,
+		ifdEntry{TagYCbCrSubSampling, TypeShort, []uint32{2, 2}},
+		// The default of the spec does not suit the full-range samples of
+		// JPEG.
+		ifdEntry{TagReferenceBlackWhite, TypeRational, []uint32{0, 1, 255, 1, 128, 1, 255, 1, 128, 1, 255, 1}},
+	)
+}
+
+// encodeJPEG compresses a block of p, held as packed rows of w×h pixels.
+func (p *page) encodeJPEG(block []byte, w, h int) ([]byte, error) {
+	r := image.Rect(0, 0, w, h)
+	var m image.Image = &image.RGBA{Pix: block, Stride: 4 * w, Rect: r}
+	if p.pixBytes == 1 {
+		m = &image.Gray{Pix: block, Stride: w, Rect: r}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, p.jpeg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,803 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// LERC (Limited Error Raster Compression) stores each strip or tile as a
+// Lerc2 blob: a header, a mask of the valid pixels, and their values,
+// quantized to within a maximum error in micro blocks of a few pixels and
+// bit-packed. This file decodes blobs of versions 2 to 4, as written by the
+// LERC library that GDAL and libtiff use, and encodes version 3 blobs. Only
+// the Huffman coding of 8-bit data, which that library tries for lossless
+// byte images, is not supported.
+
+// LERCOptions are the parameters of LERC compression.
+type LERCOptions struct {
+	// MaxError is the largest difference allowed between a sample and the
+	// value it decodes to. Zero compresses floating point samples without
+	// loss; integer samples are never given an error of less than 0.5,
+	// which keeps them exact.
+	MaxError float64
+	// Deflate further compresses the LERC data with Deflate, as GDAL does
+	// for LERC_DEFLATE.
+	Deflate bool
+}
+
+// The version of the LERC API recorded in the LercParameters field, as
+// required by libtiff, and the version of the blobs written.
+const (
+	lercAPIVersion  = 4
+	lercBlobVersion = 3
+	lercMicroBlock  = 8
+)
+
+// Values for the second element of the LercParameters field.
+const (
+	lercCompressionNone    = 0
+	lercCompressionDeflate = 1
+)
+
+// Lerc2 data types.
+const (
+	lercChar = iota
+	lercByte
+	lercShort
+	lercUShort
+	lercInt
+	lercUInt
+	lercFloat
+	lercDouble
+)
+
+var lercTypeSize = [...]int{1, 1, 2, 2, 4, 4, 4, 8}
+
+var errLERC = FormatError("invalid LERC data")
+
+// A lercHeader is the header of a Lerc2 blob.
+type lercHeader struct {
+	version, rows, cols, depth int
+	numValid, microBlock       int
+	blobSize, dataType         int
+	checksum                   uint32
+	maxZError, zMin, zMax      float64
+}
+
+// A lercImage is the content of a decoded blob: depth values per pixel,
+// and a bit per pixel, most significant first, set for the valid ones.
+// mask is nil if all pixels are valid.
+type lercImage struct {
+	lercHeader
+	vals []float64
+	mask []byte
+}
+
+func (m *lercImage) valid(k int) bool {
+	return m.mask == nil || m.mask[k>>3]&(0x80>>(k&7)) != 0
+}
+
+// A lercCursor reads the fields of a blob. Reading past its end yields
+// zero values and sets short.
+type lercCursor struct {
+	p     []byte
+	short bool
+}
+
+func (c *lercCursor) next(n int) []byte {
+	if n < 0 || len(c.p) < n {
+		c.p, c.short = nil, true
+		return nil
+	}
+	b := c.p[:n]
+	c.p = c.p[n:]
+	return b
+}
+
+func (c *lercCursor) u8() byte {
+	if b := c.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (c *lercCursor) u32() uint32 {
+	if b := c.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (c *lercCursor) i32() int { return int(int32(c.u32())) }
+
+func (c *lercCursor) f64() float64 {
+	if b := c.next(8); b != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+// value reads a value of data type dt.
+func (c *lercCursor) value(dt int) float64 {
+	if dt < 0 || dt >= len(lercTypeSize) {
+		c.p, c.short = nil, true
+		return 0
+	}
+	b := c.next(lercTypeSize[dt])
+	if b == nil {
+		return 0
+	}
+	return lercValue(b, dt)
+}
+
+// lercValue returns the little-endian value of data type dt at the start
+// of b.
+func lercValue(b []byte, dt int) float64 {
+	le := binary.LittleEndian
+	switch dt {
+	case lercChar:
+		return float64(int8(b[0]))
+	case lercByte:
+		return float64(b[0])
+	case lercShort:
+		return float64(int16(le.Uint16(b)))
+	case lercUShort:
+		return float64(le.Uint16(b))
+	case lercInt:
+		return float64(int32(le.Uint32(b)))
+	case lercUInt:
+		return float64(le.Uint32(b))
+	case lercFloat:
+		return float64(math.Float32frombits(le.Uint32(b)))
+	}
+	return math.Float64frombits(le.Uint64(b))
+}
+
+// appendLERCValue appends v as a little-endian value of data type dt.
+func appendLERCValue(p []byte, v float64, dt int) []byte {
+	le := binary.LittleEndian
+	switch dt {
+	case lercChar:
+		return append(p, byte(int8(v)))
+	case lercByte:
+		return append(p, byte(v))
+	case lercShort:
+		return le.AppendUint16(p, uint16(int16(v)))
+	case lercUShort:
+		return le.AppendUint16(p, uint16(v))
+	case lercInt:
+		return le.AppendUint32(p, uint32(int32(v)))
+	case lercUInt:
+		return le.AppendUint32(p, uint32(v))
+	case lercFloat:
+		return le.AppendUint32(p, math.Float32bits(float32(v)))
+	}
+	return le.AppendUint64(p, math.Float64bits(v))
+}
+
+// lercTypeUsed returns the data type in which the offset of a micro block
+// of data type dt is stored, given the code in the top bits of its flags.
+func lercTypeUsed(dt, code int) int {
+	switch dt {
+	case lercShort, lercInt:
+		return dt - code
+	case lercUShort, lercUInt:
+		return dt - 2*code
+	case lercFloat:
+		switch code {
+		case 0:
+			return dt
+		case 1:
+			return lercShort
+		}
+		return lercByte
+	case lercDouble:
+		if code == 0 {
+			return dt
+		}
+		return dt - 2*code + 1
+	}
+	return dt
+}
+
+// lercChecksum returns the Fletcher-32 checksum of p, as stored in blobs
+// from version 3.
+func lercChecksum(p []byte) uint32 {
+	sum1, sum2 := uint32(0xffff), uint32(0xffff)
+	for words := len(p) / 2; words > 0; {
+		n := words
+		if n > 359 {
+			n = 359
+		}
+		words -= n
+		for ; n > 0; n-- {
+			sum1 += uint32(p[0])<<8 | uint32(p[1])
+			sum2 += sum1
+			p = p[2:]
+		}
+		sum1 = sum1&0xffff + sum1>>16
+		sum2 = sum2&0xffff + sum2>>16
+	}
+	if len(p) > 0 {
+		sum1 += uint32(p[0]) << 8
+		sum2 += sum1
+	}
+	sum1 = sum1&0xffff + sum1>>16
+	sum2 = sum2&0xffff + sum2>>16
+	return sum2<<16 | sum1
+}
+
+// decodeLERC decodes the Lerc2 blob at the start of blob, which must not
+// hold more than maxValues values.
+func decodeLERC(blob []byte, maxValues int) (*lercImage, error) {
+	c := &lercCursor{p: blob}
+	if string(c.next(6)) != "Lerc2 " {
+		return nil, errLERC
+	}
+	var h lercHeader
+	h.version = c.i32()
+	if h.version < 2 || h.version > 4 {
+		return nil, UnsupportedError{Feature: fmt.Sprintf("LERC version %d", h.version)}
+	}
+	if h.version >= 3 {
+		h.checksum = c.u32()
+	}
+	h.rows, h.cols, h.depth = c.i32(), c.i32(), 1
+	if h.version >= 4 {
+		h.depth = c.i32()
+	}
+	h.numValid, h.microBlock, h.blobSize, h.dataType = c.i32(), c.i32(), c.i32(), c.i32()
+	h.maxZError, h.zMin, h.zMax = c.f64(), c.f64(), c.f64()
+	headerLen := len(blob) - len(c.p)
+	if c.short || h.rows <= 0 || h.cols <= 0 || h.depth <= 0 || h.microBlock <= 0 ||
+		h.dataType < 0 || h.dataType >= len(lercTypeSize) || h.blobSize < headerLen || h.blobSize > len(blob) {
+		return nil, errLERC
+	}
+	n, ok := mulInt(h.rows, h.cols)
+	nv, ok2 := mulInt(n, h.depth)
+	if !ok || !ok2 || nv > maxValues || h.numValid < 0 || h.numValid > n {
+		return nil, errLERC
+	}
+	if h.version >= 3 && lercChecksum(blob[14:h.blobSize]) != h.checksum {
+		return nil, FormatError("LERC checksum mismatch")
+	}
+	c.p = blob[headerLen:h.blobSize]
+
+	m := &lercImage{lercHeader: h, vals: make([]float64, nv)}
+	nmask := c.i32()
+	switch {
+	case h.numValid == 0 || h.numValid == n:
+		if nmask != 0 {
+			return nil, errLERC
+		}
+		if h.numValid == 0 {
+			m.mask = make([]byte, (n+7)/8)
+			return m, nil
+		}
+	case nmask <= 0:
+		return nil, errLERC
+	default:
+		m.mask = make([]byte, (n+7)/8)
+		if err := lercUnRLE(c.next(nmask), m.mask); err != nil || c.short {
+			return nil, errLERC
+		}
+	}
+
+	zMin := make([]float64, h.depth)
+	zMax := make([]float64, h.depth)
+	for i := range zMin {
+		zMin[i], zMax[i] = h.zMin, h.zMax
+	}
+	constant := h.zMin == h.zMax
+	if !constant && h.version >= 4 {
+		// The range of each of the values of a pixel follows.
+		constant = true
+		for i := range zMin {
+			zMin[i] = c.value(h.dataType)
+		}
+		for i := range zMax {
+			zMax[i] = c.value(h.dataType)
+			constant = constant && zMax[i] == zMin[i]
+		}
+	}
+	if constant {
+		for k := 0; k < n; k++ {
+			if m.valid(k) {
+				copy(m.vals[k*h.depth:(k+1)*h.depth], zMin)
+			}
+		}
+		return m, nil
+	}
+
+	if oneSweep := c.u8(); oneSweep != 0 {
+		for k := 0; k < n; k++ {
+			if m.valid(k) {
+				for d := 0; d < h.depth; d++ {
+					m.vals[k*h.depth+d] = c.value(h.dataType)
+				}
+			}
+		}
+	} else {
+		if (h.dataType == lercChar || h.dataType == lercByte) && h.maxZError == 0.5 {
+			if mode := c.u8(); mode != 0 {
+				return nil, UnsupportedError{Feature: "LERC Huffman coding"}
+			}
+		}
+		mb := h.microBlock
+		for i0 := 0; i0 < h.rows; i0 += mb {
+			for j0 := 0; j0 < h.cols; j0 += mb {
+				i1, j1 := min(i0+mb, h.rows), min(j0+mb, h.cols)
+				for d := 0; d < h.depth; d++ {
+					if err := m.readBlock(c, i0, i1, j0, j1, d, zMax[d]); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	if c.short {
+		return nil, errLERC
+	}
+	return m, nil
+}
+
+// readBlock reads value d of the valid pixels of the micro block spanning
+// rows [i0, i1) and columns [j0, j1).
+func (m *lercImage) readBlock(c *lercCursor, i0, i1, j0, j1, d int, zMax float64) error {
+	flags := c.u8()
+	// Bits 2 to 5 hold part of the first column, as an integrity check.
+	if int(flags>>2)&15 != (j0>>3)&15 {
+		return errLERC
+	}
+	each := func(f func(k int)) {
+		for i := i0; i < i1; i++ {
+			for j := j0; j < j1; j++ {
+				if k := i*m.cols + j; m.valid(k) {
+					f(k*m.depth + d)
+				}
+			}
+		}
+	}
+	switch flags & 3 {
+	case 2:
+		// All zero.
+	case 0:
+		each(func(k int) { m.vals[k] = c.value(m.dataType) })
+	case 3:
+		offset := c.value(lercTypeUsed(m.dataType, int(flags>>6)))
+		each(func(k int) { m.vals[k] = offset })
+	case 1:
+		offset := c.value(lercTypeUsed(m.dataType, int(flags>>6)))
+		q := c.unstuff((i1-i0)*(j1-j0), m.version)
+		scale := 2 * m.maxZError
+		n := 0
+		bad := false
+		each(func(k int) {
+			if n >= len(q) {
+				bad = true
+				return
+			}
+			m.vals[k] = math.Min(offset+float64(q[n])*scale, zMax)
+			n++
+		})
+		if bad {
+			return errLERC
+		}
+	}
+	if c.short {
+		return errLERC
+	}
+	return nil
+}
+
+// unstuff reads an array of at most maxLen bit-packed unsigned integers,
+// which may be given as indices into a table of the distinct values.
+func (c *lercCursor) unstuff(maxLen, version int) []uint32 {
+	b := c.u8()
+	var n int
+	switch b >> 6 {
+	case 0:
+		n = int(c.u32())
+	case 1:
+		if p := c.next(2); p != nil {
+			n = int(binary.LittleEndian.Uint16(p))
+		}
+	case 2:
+		n = int(c.u8())
+	default:
+		c.short = true
+	}
+	nbits := int(b & 31)
+	if c.short || n > maxLen {
+		c.short = true
+		return nil
+	}
+	if b&0x20 == 0 {
+		return c.bits(n, nbits, version)
+	}
+
+	nlut := int(c.u8()) - 1
+	if nbits == 0 || nlut < 0 {
+		c.short = true
+		return nil
+	}
+	lut := append([]uint32{0}, c.bits(nlut, nbits, version)...)
+	idx := c.bits(n, bits.Len(uint(nlut)), version)
+	for i, v := range idx {
+		if int(v) >= len(lut) {
+			c.short = true
+			return nil
+		}
+		idx[i] = lut[v]
+	}
+	return idx
+}
+
+// bits reads n unsigned integers of nbits bits. From version 3 they are
+// packed from the least significant bit of each byte; before, they were
+// packed from the most significant bit of little-endian 32-bit words, the
+// bytes of a final partial word being those of its top.
+func (c *lercCursor) bits(n, nbits, version int) []uint32 {
+	out := make([]uint32, n)
+	if nbits == 0 || n == 0 {
+		return out
+	}
+	if nbits >= 32 {
+		c.short = true
+		return nil
+	}
+	p := c.next((n*nbits + 7) / 8)
+	if p == nil {
+		return nil
+	}
+	mask := uint64(1)<<nbits - 1
+	var acc uint64
+	nacc := 0
+	if version >= 3 {
+		for i := range out {
+			for nacc < nbits {
+				acc |= uint64(p[0]) << nacc
+				p = p[1:]
+				nacc += 8
+			}
+			out[i] = uint32(acc & mask)
+			acc >>= nbits
+			nacc -= nbits
+		}
+		return out
+	}
+	for i := range out {
+		for nacc < nbits {
+			k := min(4, len(p))
+			var w uint32
+			for j := 0; j < k; j++ {
+				w |= uint32(p[j]) << (8 * j)
+			}
+			w <<= 8 * (4 - k)
+			p = p[k:]
+			acc = acc<<32 | uint64(w)
+			nacc += 32
+		}
+		out[i] = uint32(acc>>(nacc-nbits)) & uint32(mask)
+		nacc -= nbits
+		acc &= uint64(1)<<nacc - 1
+	}
+	return out
+}
+
+// lercUnRLE expands the run-length encoded mask in p into dst. Each run
+// starts with a count: a positive count of literal bytes, or the negated
+// count of repetitions of the byte that follows; -32768 ends the data.
+func lercUnRLE(p, dst []byte) error {
+	k := 0
+	for {
+		if len(p) < 2 {
+			return errLERC
+		}
+		cnt := int(int16(binary.LittleEndian.Uint16(p)))
+		p = p[2:]
+		switch {
+		case cnt == -32768:
+			return nil
+		case cnt > 0:
+			if len(p) < cnt || k+cnt > len(dst) {
+				return errLERC
+			}
+			copy(dst[k:], p[:cnt])
+			p = p[cnt:]
+			k += cnt
+		default:
+			if len(p) < 1 || k-cnt > len(dst) {
+				return errLERC
+			}
+			for i := 0; i < -cnt; i++ {
+				dst[k+i] = p[0]
+			}
+			p = p[1:]
+			k -= cnt
+		}
+	}
+}
+
+// lercRLE run-length encodes p for lercUnRLE.
+func lercRLE(p []byte) []byte {
+	le := binary.LittleEndian
+	// At least minRun equal bytes are worth a repeat.
+	const minRun = 5
+	runAt := func(i int) int {
+		n := 1
+		for i+n < len(p) && n < 32767 && p[i+n] == p[i] {
+			n++
+		}
+		return n
+	}
+	var out []byte
+	for len(p) > 0 {
+		if n := runAt(0); n >= minRun {
+			out = le.AppendUint16(out, uint16(-n))
+			out = append(out, p[0])
+			p = p[n:]
+			continue
+		}
+		n := 0
+		for n < len(p) && n < 32767 && runAt(n) < minRun {
+			n++
+		}
+		out = le.AppendUint16(out, uint16(n))
+		out = append(out, p[:n]...)
+		p = p[n:]
+	}
+	return le.AppendUint16(out, 0x8000)
+}
+
+// encodeLERC compresses the cols×rows samples of data type dt, held
+// little-endian in p, into a Lerc2 blob that decodes to within maxErr of
+// them. NaN values are marked invalid.
+func encodeLERC(p []byte, cols, rows, dt int, maxErr float64) []byte {
+	le := binary.LittleEndian
+	n := cols * rows
+	size := lercTypeSize[dt]
+	vals := make([]float64, n)
+	mask := make([]byte, (n+7)/8)
+	numValid := 0
+	zMin, zMax := math.Inf(1), math.Inf(-1)
+	for k := range vals {
+		v := lercValue(p[k*size:], dt)
+		vals[k] = v
+		if math.IsNaN(v) {
+			continue
+		}
+		mask[k>>3] |= 0x80 >> (k & 7)
+		numValid++
+		zMin, zMax = math.Min(zMin, v), math.Max(zMax, v)
+	}
+	if numValid == 0 {
+		zMin, zMax = 0, 0
+	}
+	if dt < lercFloat {
+		// Integers are quantized to whole steps.
+		maxErr = math.Max(0.5, math.Floor(maxErr))
+	}
+
+	out := []byte("Lerc2 ")
+	out = le.AppendUint32(out, lercBlobVersion)
+	out = le.AppendUint32(out, 0) // Checksum, set below.
+	for _, v := range []int{rows, cols, numValid, lercMicroBlock, 0, dt} {
+		out = le.AppendUint32(out, uint32(v))
+	}
+	blobSizeAt := len(out) - 8
+	for _, v := range []float64{maxErr, zMin, zMax} {
+		out = le.AppendUint64(out, math.Float64bits(v))
+	}
+	if numValid == 0 || numValid == n {
+		out = le.AppendUint32(out, 0)
+	} else {
+		rle := lercRLE(mask)
+		out = le.AppendUint32(out, uint32(len(rle)))
+		out = append(out, rle...)
+	}
+
+	if numValid > 0 && zMin != zMax {
+		out = append(out, 0) // Micro blocks rather than all values in one sweep.
+		if dt <= lercByte && maxErr == 0.5 {
+			out = append(out, 0) // Micro blocks rather than Huffman coding.
+		}
+		var block []float64
+		var q []uint32
+		for i0 := 0; i0 < rows; i0 += lercMicroBlock {
+			for j0 := 0; j0 < cols; j0 += lercMicroBlock {
+				block = block[:0]
+				for i := i0; i < min(i0+lercMicroBlock, rows); i++ {
+					for j := j0; j < min(j0+lercMicroBlock, cols); j++ {
+						if k := i*cols + j; !math.IsNaN(vals[k]) {
+							block = append(block, vals[k])
+						}
+					}
+				}
+				out, q = appendLERCBlock(out, block, q, byte((j0>>3)&15)<<2, dt, maxErr)
+			}
+		}
+	}
+	le.PutUint32(out[blobSizeAt:], uint32(len(out)))
+	le.PutUint32(out[10:], lercChecksum(out[14:]))
+	return out
+}
+
+// appendLERCBlock appends the micro block holding the valid values in
+// block, using whichever of the storage modes is smallest. q is scratch
+// space, returned for reuse.
+func appendLERCBlock(out []byte, block []float64, q []uint32, flags byte, dt int, maxErr float64) ([]byte, []uint32) {
+	if len(block) == 0 {
+		return append(out, flags|2), q
+	}
+	lo, hi := block[0], block[0]
+	for _, v := range block[1:] {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	switch {
+	case lo == 0 && hi == 0:
+		return append(out, flags|2), q
+	case lo == hi:
+		return appendLERCValue(append(out, flags|3), lo, dt), q
+	}
+
+	size := lercTypeSize[dt]
+	if scale := 2 * maxErr; maxErr > 0 && (hi-lo)/scale < 1<<30 {
+		q = q[:0]
+		var maxQ uint32
+		for _, v := range block {
+			x := uint32(math.Round((v - lo) / scale))
+			q = append(q, x)
+			maxQ = max(maxQ, x)
+		}
+		nbits := bits.Len32(maxQ)
+		if 3+size+(len(q)*nbits+7)/8 < 1+size*len(block) {
+			out = appendLERCValue(append(out, flags|1), lo, dt)
+			return appendStuffed(out, q, nbits), q
+		}
+	}
+	out = append(out, flags)
+	for _, v := range block {
+		out = appendLERCValue(out, v, dt)
+	}
+	return out, q
+}
+
+// appendStuffed appends the values of q, which has fewer than 256
+// elements, packed in nbits bits each as read by lercCursor.unstuff.
+func appendStuffed(out []byte, q []uint32, nbits int) []byte {
+	out = append(out, 2<<6|byte(nbits), byte(len(q)))
+	var acc uint64
+	nacc := 0
+	for _, v := range q {
+		acc |= uint64(v) << nacc
+		nacc += nbits
+		for nacc >= 8 {
+			out = append(out, byte(acc))
+			acc >>= 8
+			nacc -= 8
+		}
+	}
+	if nacc > 0 {
+		out = append(out, byte(acc))
+	}
+	return out
+}
+
+// lercType returns the Lerc2 data type of the samples of l, which can only
+// be LERC compressed if it has a single sample per pixel.
+func (l *imageLayout) lercType() (int, error) {
+	if l.samplesPerPixel != 1 {
+		return 0, UnsupportedError{Feature: "LERC compression of images with several samples"}
+	}
+	switch bps := l.bitsPerSample[0]; {
+	case l.sampleFormat == SampleFormatIEEEFP:
+		return lercFloat, nil
+	case l.sampleFormat == SampleFormatInt && bps == 16:
+		return lercShort, nil
+	case l.sampleFormat == SampleFormatInt:
+		return lercInt, nil
+	}
+	return lercUInt, nil
+}
+
+// encodeLERC compresses a block of p, held as packed rows of cols×rows
+// pixels, as configured for the page.
+func (p *page) encodeLERC(block []byte, cols, rows int) ([]byte, error) {
+	blob := encodeLERC(block, cols, rows, p.lercType, p.lerc.MaxError)
+	if !p.lerc.Deflate {
+		return blob, nil
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(blob); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkLERC reports an error unless the LERC compressed image can be
+// decoded, and records how the blobs are stored.
+func (d *decoder) checkLERC() error {
+	switch d.bitsPerSample {
+	case 8, 16, 32:
+	default:
+		return UnsupportedError{"LERC with BitsPerSample", TagBitsPerSample, uint(d.bitsPerSample)}
+	}
+	if p, ok := d.ifd[TagLercParameters]; ok {
+		v, err := d.ifdUint(p[:], 2)
+		if err != nil {
+			return err
+		}
+		if len(v) > 1 {
+			switch v[1] {
+			case lercCompressionNone, lercCompressionDeflate:
+				d.lercCompression = int(v[1])
+			default:
+				return UnsupportedError{"LERC additional compression", TagLercParameters, v[1]}
+			}
+		}
+	}
+	return nil
+}
+
+// lercBlock decodes the compressed block in r into its samples, in the
+// byte order of the file. Invalid pixels are NaN if the samples are
+// floating point and zero otherwise.
+func (d *decoder) lercBlock(r io.Reader, n int64) (io.ReadCloser, error) {
+	blob, err := readBuf(r, nil, n)
+	if err != nil {
+		return nil, err
+	}
+	if d.lercCompression == lercCompressionDeflate {
+		zr, err := zlib.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			return nil, err
+		}
+		// The blob is no larger than its values with a generous allowance
+		// for the header and mask.
+		if blob, err = readBuf(zr, nil, 2*d.blockBytes()+1<<16); err != nil {
+			return nil, err
+		}
+	}
+	spp := d.samplesPerPixel
+	m, err := decodeLERC(blob, d.blockWidth*d.blockHeight*spp)
+	if err != nil {
+		return nil, err
+	}
+	if m.cols != d.blockWidth || m.rows > d.blockHeight || m.depth != spp {
+		return nil, FormatError(fmt.Sprintf("LERC block of %dx%dx%d values in a %dx%d block", m.cols, m.rows, m.depth, d.blockWidth, d.blockHeight))
+	}
+
+	size := d.bitsPerSample / 8
+	out := make([]byte, len(m.vals)*size)
+	for i, v := range m.vals {
+		p := out[i*size:]
+		switch {
+		case d.sampleFormat == SampleFormatIEEEFP:
+			if !m.valid(i / spp) {
+				v = math.NaN()
+			}
+			d.byteOrder.PutUint32(p, math.Float32bits(float32(v)))
+		case size == 1:
+			p[0] = byte(int64(v))
+		case size == 2:
+			d.byteOrder.PutUint16(p, uint16(int64(v)))
+		default:
+			d.byteOrder.PutUint32(p, uint32(int64(v)))
+		}
+	}
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
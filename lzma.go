@@ -0,0 +1,568 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+// With LZMA compression, as written by libtiff, each strip or tile is an
+// XZ stream: blocks of LZMA2 data, possibly behind a delta filter, with a
+// check of their content, followed by an index. This file implements the
+// decoding of such streams into memory, the whole output being the LZMA
+// dictionary.
+
+var errLZMA = FormatError("invalid LZMA data")
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// decodeXZ decompresses the XZ stream at the start of src, which must not
+// hold more than lim bytes.
+func decodeXZ(src []byte, lim int64) ([]byte, error) {
+	if len(src) < 12 || string(src[:6]) != "\xfd7zXZ\x00" {
+		return nil, errLZMA
+	}
+	if crc32.ChecksumIEEE(src[6:8]) != binary.LittleEndian.Uint32(src[8:]) || src[6] != 0 || src[7] > 15 {
+		return nil, errLZMA
+	}
+	var check hash.Hash
+	checkLen := 0
+	switch src[7] {
+	case 0:
+	case 1:
+		check, checkLen = crc32.NewIEEE(), 4
+	case 4:
+		check, checkLen = crc64.New(crc64Table), 8
+	case 10:
+		check, checkLen = sha256.New(), 32
+	default:
+		return nil, UnsupportedError{Feature: fmt.Sprintf("XZ check type %d", src[7])}
+	}
+	p := src[12:]
+
+	var out []byte
+	for {
+		// A zero byte starts the index, which follows the last block.
+		if len(p) == 0 {
+			return nil, errLZMA
+		}
+		if p[0] == 0 {
+			return out, nil
+		}
+		hlen := (int(p[0]) + 1) * 4
+		if len(p) < hlen || crc32.ChecksumIEEE(p[:hlen-4]) != binary.LittleEndian.Uint32(p[hlen-4:]) {
+			return nil, errLZMA
+		}
+		delta, err := parseXZBlockHeader(p[1 : hlen-4])
+		if err != nil {
+			return nil, err
+		}
+		p = p[hlen:]
+
+		start := len(out)
+		z := &lzma2Decoder{src: p, lim: lim}
+		if out, err = z.decode(out); err != nil {
+			return nil, err
+		}
+		n := len(p) - len(z.src)
+		// The compressed data is padded to a multiple of 4 bytes.
+		for ; n%4 != 0; n++ {
+			if n >= len(p) || p[n] != 0 {
+				return nil, errLZMA
+			}
+		}
+		p = p[n:]
+		block := out[start:]
+		if delta > 0 {
+			for i := delta; i < len(block); i++ {
+				block[i] += block[i-delta]
+			}
+		}
+		if check != nil {
+			if len(p) < checkLen {
+				return nil, errLZMA
+			}
+			check.Reset()
+			check.Write(block)
+			sum := check.Sum(nil)
+			if checkLen == 4 || checkLen == 8 {
+				// CRCs are stored little-endian.
+				for i, j := 0, checkLen-1; i < j; i, j = i+1, j-1 {
+					sum[i], sum[j] = sum[j], sum[i]
+				}
+			}
+			if !bytes.Equal(sum, p[:checkLen]) {
+				return nil, FormatError("LZMA check mismatch")
+			}
+			p = p[checkLen:]
+		}
+	}
+}
+
+// parseXZBlockHeader parses the flags and filters of a block header, less
+// its size and CRC, and returns the distance of its delta filter, or 0 if
+// there is none. Only LZMA2, optionally preceded by delta, is supported.
+func parseXZBlockHeader(h []byte) (delta int, err error) {
+	if len(h) == 0 || h[0]&0x3c != 0 {
+		return 0, errLZMA
+	}
+	flags := h[0]
+	h = h[1:]
+	// The sizes, if given, are checked by the decoding itself.
+	for _, bit := range []byte{0x40, 0x80} {
+		if flags&bit != 0 {
+			if _, h, err = xzVLI(h); err != nil {
+				return 0, err
+			}
+		}
+	}
+	nfilters := int(flags&3) + 1
+	for i := 0; i < nfilters; i++ {
+		var id, size uint64
+		if id, h, err = xzVLI(h); err != nil {
+			return 0, err
+		}
+		if size, h, err = xzVLI(h); err != nil {
+			return 0, err
+		}
+		if size > uint64(len(h)) {
+			return 0, errLZMA
+		}
+		props := h[:size]
+		h = h[size:]
+		last := i == nfilters-1
+		switch {
+		case id == 0x21 && last && size == 1:
+			// The dictionary size needs no checking: the whole output is
+			// kept.
+		case id == 0x03 && !last && delta == 0 && size == 1:
+			delta = int(props[0]) + 1
+		default:
+			return 0, UnsupportedError{Feature: fmt.Sprintf("XZ filter %#x", id)}
+		}
+	}
+	for _, b := range h {
+		if b != 0 {
+			return 0, errLZMA
+		}
+	}
+	return delta, nil
+}
+
+// xzVLI decodes the variable-length integer at the start of p.
+func xzVLI(p []byte) (uint64, []byte, error) {
+	var v uint64
+	for i := 0; i < 9 && i < len(p); i++ {
+		v |= uint64(p[i]&0x7f) << (7 * i)
+		if p[i]&0x80 == 0 {
+			return v, p[i+1:], nil
+		}
+	}
+	return 0, nil, errLZMA
+}
+
+// An lzma2Decoder decodes LZMA2 chunks from src, appending to an output
+// that serves as the dictionary.
+type lzma2Decoder struct {
+	src []byte
+	lim int64
+
+	dictStart    int // Of the data since the last dictionary reset.
+	lc, lp, pb   uint
+	props, state bool // Whether properties were set and state initialized.
+	lzma         lzmaState
+	rc           rangeDecoder
+}
+
+func (z *lzma2Decoder) decode(out []byte) ([]byte, error) {
+	first := true
+	for {
+		if len(z.src) == 0 {
+			return nil, errLZMA
+		}
+		c := z.src[0]
+		z.src = z.src[1:]
+		if c == 0 {
+			return out, nil
+		}
+		if first && c != 1 && c < 0xe0 {
+			// The first chunk of a block must reset the dictionary.
+			return nil, errLZMA
+		}
+		first = false
+
+		if c < 0x80 {
+			// An uncompressed chunk, resetting the dictionary if c is 1.
+			if c > 2 || len(z.src) < 2 {
+				return nil, errLZMA
+			}
+			n := int(binary.BigEndian.Uint16(z.src)) + 1
+			z.src = z.src[2:]
+			if len(z.src) < n || int64(len(out)+n) > z.lim {
+				return nil, errLZMA
+			}
+			if c == 1 {
+				z.dictStart = len(out)
+			}
+			out = append(out, z.src[:n]...)
+			z.src = z.src[n:]
+			continue
+		}
+
+		if len(z.src) < 4 {
+			return nil, errLZMA
+		}
+		usize := int(c&0x1f)<<16 + int(binary.BigEndian.Uint16(z.src)) + 1
+		csize := int(binary.BigEndian.Uint16(z.src[2:])) + 1
+		z.src = z.src[4:]
+		switch reset := c >> 5 & 3; {
+		case reset == 3:
+			z.dictStart = len(out)
+			fallthrough
+		case reset == 2:
+			if len(z.src) == 0 {
+				return nil, errLZMA
+			}
+			p := uint(z.src[0])
+			z.src = z.src[1:]
+			if p >= 9*5*5 {
+				return nil, errLZMA
+			}
+			z.lc, z.lp, z.pb = p%9, p/9%5, p/45
+			if z.lc+z.lp > 4 {
+				return nil, errLZMA
+			}
+			z.props = true
+			fallthrough
+		case reset == 1:
+			if !z.props {
+				return nil, errLZMA
+			}
+			z.lzma.init(z.lc + z.lp)
+			z.state = true
+		case !z.state:
+			return nil, errLZMA
+		}
+		if len(z.src) < csize || int64(len(out)+usize) > z.lim {
+			return nil, errLZMA
+		}
+		var err error
+		if out, err = z.chunk(out, z.src[:csize], usize); err != nil {
+			return nil, err
+		}
+		z.src = z.src[csize:]
+	}
+}
+
+// Probabilities are 11-bit, moved by 1/32 of their distance to the bit
+// decoded.
+const (
+	lzmaProbBits = 11
+	lzmaProbInit = 1 << lzmaProbBits / 2
+	lzmaMoveBits = 5
+)
+
+// A rangeDecoder decodes bits from the range-coded data in src.
+type rangeDecoder struct {
+	src       []byte
+	rng, code uint32
+	overrun   bool
+}
+
+func (rc *rangeDecoder) init(src []byte) bool {
+	if len(src) < 5 || src[0] != 0 {
+		return false
+	}
+	rc.src, rc.rng, rc.code, rc.overrun = src[5:], 0xffffffff, binary.BigEndian.Uint32(src[1:]), false
+	return true
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		var b byte
+		if len(rc.src) > 0 {
+			b, rc.src = rc.src[0], rc.src[1:]
+		} else {
+			rc.overrun = true
+		}
+		rc.rng <<= 8
+		rc.code = rc.code<<8 | uint32(b)
+	}
+}
+
+func (rc *rangeDecoder) bit(p *uint16) uint32 {
+	rc.normalize()
+	bound := (rc.rng >> lzmaProbBits) * uint32(*p)
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (1<<lzmaProbBits - *p) >> lzmaMoveBits
+		return 0
+	}
+	rc.rng -= bound
+	rc.code -= bound
+	*p -= *p >> lzmaMoveBits
+	return 1
+}
+
+// tree decodes a value of n bits, most significant first, from the bit
+// tree in probs.
+func (rc *rangeDecoder) tree(probs []uint16, n uint) uint32 {
+	m := uint32(1)
+	for i := uint(0); i < n; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<n
+}
+
+// reverseTree decodes a value of n bits, least significant first.
+func (rc *rangeDecoder) reverseTree(probs []uint16, n uint) uint32 {
+	m, v := uint32(1), uint32(0)
+	for i := uint(0); i < n; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 | b
+		v |= b << i
+	}
+	return v
+}
+
+// direct decodes n bits of equal probability.
+func (rc *rangeDecoder) direct(n uint) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		rc.normalize()
+		rc.rng >>= 1
+		v <<= 1
+		if rc.code >= rc.rng {
+			rc.code -= rc.rng
+			v |= 1
+		}
+	}
+	return v
+}
+
+// An lzmaLen holds the probabilities of match lengths.
+type lzmaLen struct {
+	choice, choice2 uint16
+	low, mid        [16][8]uint16
+	high            [256]uint16
+}
+
+func (l *lzmaLen) init() {
+	l.choice, l.choice2 = lzmaProbInit, lzmaProbInit
+	for i := range l.low {
+		fillProbs(l.low[i][:])
+		fillProbs(l.mid[i][:])
+	}
+	fillProbs(l.high[:])
+}
+
+// decode returns a match length, from 2 to 273.
+func (l *lzmaLen) decode(rc *rangeDecoder, posState uint32) int {
+	if rc.bit(&l.choice) == 0 {
+		return 2 + int(rc.tree(l.low[posState][:], 3))
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return 10 + int(rc.tree(l.mid[posState][:], 3))
+	}
+	return 18 + int(rc.tree(l.high[:], 8))
+}
+
+// An lzmaState holds the adaptive state of an LZMA decoder. Distances are
+// held less one.
+type lzmaState struct {
+	state                   int
+	rep                     [4]uint32
+	isMatch, isRep0Long     [12 << 4]uint16
+	isRep, isRepG0, isRepG1 [12]uint16
+	isRepG2                 [12]uint16
+	posSlot                 [4][64]uint16
+	specPos                 [115]uint16 // The first is unused.
+	align                   [16]uint16
+	matchLen, repLen        lzmaLen
+	literal                 []uint16
+}
+
+func fillProbs(p []uint16) {
+	for i := range p {
+		p[i] = lzmaProbInit
+	}
+}
+
+// init resets s for literal coders of lclp context bits.
+func (s *lzmaState) init(lclp uint) {
+	s.state, s.rep = 0, [4]uint32{}
+	for _, p := range [][]uint16{s.isMatch[:], s.isRep0Long[:], s.isRep[:], s.isRepG0[:],
+		s.isRepG1[:], s.isRepG2[:], s.specPos[:], s.align[:]} {
+		fillProbs(p)
+	}
+	for i := range s.posSlot {
+		fillProbs(s.posSlot[i][:])
+	}
+	s.matchLen.init()
+	s.repLen.init()
+	if n := 0x300 << lclp; cap(s.literal) >= n {
+		s.literal = s.literal[:n]
+	} else {
+		s.literal = make([]uint16, n)
+	}
+	fillProbs(s.literal)
+}
+
+// chunk decodes the compressed chunk src into usize bytes appended to out.
+func (z *lzma2Decoder) chunk(out, src []byte, usize int) ([]byte, error) {
+	rc := &z.rc
+	if !rc.init(src) {
+		return nil, errLZMA
+	}
+	s := &z.lzma
+	pbMask := uint32(1)<<z.pb - 1
+	lpMask := uint32(1)<<z.lp - 1
+	end := len(out) + usize
+	for len(out) < end {
+		pos := uint32(len(out) - z.dictStart)
+		posState := pos & pbMask
+		if rc.bit(&s.isMatch[s.state<<4|int(posState)]) == 0 {
+			var prev uint32
+			if pos > 0 {
+				prev = uint32(out[len(out)-1])
+			}
+			lit := ((pos&lpMask)<<z.lc + prev>>(8-z.lc)) * 0x300
+			probs := s.literal[lit : lit+0x300]
+			sym := uint32(1)
+			if s.state < 7 {
+				for sym < 0x100 {
+					sym = sym<<1 | rc.bit(&probs[sym])
+				}
+			} else {
+				// After a match, the byte at the last distance guides the
+				// decoding until it differs.
+				if s.rep[0] >= pos {
+					return nil, errLZMA
+				}
+				match := uint32(out[len(out)-int(s.rep[0])-1]) << 1
+				offset := uint32(0x100)
+				for sym < 0x100 {
+					mbit := match & offset
+					match <<= 1
+					b := rc.bit(&probs[offset+mbit+sym])
+					sym = sym<<1 | b
+					if b != 0 {
+						offset &= mbit
+					} else {
+						offset &^= mbit
+					}
+				}
+			}
+			out = append(out, byte(sym))
+			switch {
+			case s.state < 4:
+				s.state = 0
+			case s.state < 10:
+				s.state -= 3
+			default:
+				s.state -= 6
+			}
+			continue
+		}
+
+		var n int
+		if rc.bit(&s.isRep[s.state]) == 0 {
+			// A match at a new distance.
+			s.rep[3], s.rep[2], s.rep[1] = s.rep[2], s.rep[1], s.rep[0]
+			n = s.matchLen.decode(rc, posState)
+			s.state = lzmaNextState(s.state, 7, 10)
+			s.rep[0] = s.distance(rc, n)
+			if s.rep[0] == 0xffffffff {
+				// The end marker is not allowed in LZMA2.
+				return nil, errLZMA
+			}
+		} else {
+			if rc.bit(&s.isRepG0[s.state]) == 0 {
+				if rc.bit(&s.isRep0Long[s.state<<4|int(posState)]) == 0 {
+					// A single byte at the last distance.
+					s.state = lzmaNextState(s.state, 9, 11)
+					if s.rep[0] >= pos {
+						return nil, errLZMA
+					}
+					out = append(out, out[len(out)-int(s.rep[0])-1])
+					continue
+				}
+			} else {
+				var d uint32
+				if rc.bit(&s.isRepG1[s.state]) == 0 {
+					d = s.rep[1]
+				} else {
+					if rc.bit(&s.isRepG2[s.state]) == 0 {
+						d = s.rep[2]
+					} else {
+						d = s.rep[3]
+						s.rep[3] = s.rep[2]
+					}
+					s.rep[2] = s.rep[1]
+				}
+				s.rep[1] = s.rep[0]
+				s.rep[0] = d
+			}
+			s.state = lzmaNextState(s.state, 8, 11)
+			n = s.repLen.decode(rc, posState)
+		}
+		if s.rep[0] >= pos || len(out)+n > end {
+			return nil, errLZMA
+		}
+		from := len(out) - int(s.rep[0]) - 1
+		for i := 0; i < n; i++ {
+			out = append(out, out[from+i])
+		}
+	}
+	if rc.overrun {
+		return nil, errLZMA
+	}
+	return out, nil
+}
+
+// lzmaNextState returns the state following a match or repetition,
+// depending on whether the previous symbol was a literal.
+func lzmaNextState(state, afterLiteral, afterMatch int) int {
+	if state < 7 {
+		return afterLiteral
+	}
+	return afterMatch
+}
+
+// distance decodes the distance, less one, of a match of length n.
+func (s *lzmaState) distance(rc *rangeDecoder, n int) uint32 {
+	lenState := min(n-2, 3)
+	slot := rc.tree(s.posSlot[lenState][:], 6)
+	if slot < 4 {
+		return slot
+	}
+	bits := uint(slot>>1 - 1)
+	d := (2 | slot&1) << bits
+	if slot < 14 {
+		return d + rc.reverseTree(s.specPos[d-slot:], bits)
+	}
+	d += rc.direct(bits-4) << 4
+	return d + rc.reverseTree(s.align[:], 4)
+}
+
+// lzmaBlock decompresses the n bytes of XZ data in r.
+func (d *decoder) lzmaBlock(r io.Reader, n int64) (io.ReadCloser, error) {
+	src, err := readBuf(r, nil, n)
+	if err != nil {
+		return nil, err
+	}
+	out, err := decodeXZ(src, d.blockBytes())
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// An lzwWriter compresses data with LZW as TIFF uses it: codes of 9 to 12
+// bits, most significant bit first, after 256 literal codes, a ClearCode
+// and an EndOfInformation code, the width growing one code earlier than in
+// standard LZW, as golang.org/x/image/tiff/lzw and libtiff expect. It is
+// adapted from the Writer of compress/lzw.
+type lzwWriter struct {
+	w   io.Writer
+	out []byte // Compressed bytes not yet written to w.
+	err error
+	// bits holds the nBits bits not yet written to out, in its high bits.
+	bits  uint32
+	nBits uint
+	// width is the number of bits of every code. hi is the code implied by
+	// the next code written, and overflow the code at which hi widens the
+	// codes.
+	width        uint
+	hi, overflow uint32
+	// saved is the code of the bytes accumulated so far, or lzwInvalidCode
+	// before the first byte.
+	saved uint32
+	// table maps the key of a code and a byte, code<<8 | byte, to the code
+	// of both, stored together as key<<12 | code, by open addressing.
+	table [lzwTableSize]uint32
+}
+
+const (
+	lzwClear       = 256
+	lzwEOI         = 257
+	lzwMaxWidth    = 12
+	lzwMaxCode     = 1<<lzwMaxWidth - 1
+	lzwInvalidCode = 1<<32 - 1
+	lzwTableSize   = 4 << lzwMaxWidth
+	lzwTableMask   = lzwTableSize - 1
+	lzwFlushBytes  = 4096
+)
+
+// errLZWOutOfCodes tells that the codes ran out and the table was cleared.
+var errLZWOutOfCodes = errors.New("tiff: LZW out of codes")
+
+// newLZWWriter returns an lzwWriter compressing into w.
+func newLZWWriter(w io.Writer) *lzwWriter {
+	z := new(lzwWriter)
+	z.Reset(w)
+	return z
+}
+
+// Reset discards the state of z and makes it compress a new stream into w.
+func (z *lzwWriter) Reset(w io.Writer) {
+	z.w, z.out, z.err = w, z.out[:0], nil
+	z.bits, z.nBits = 0, 0
+	z.width, z.hi, z.overflow = 9, lzwEOI, 1<<9
+	z.saved = lzwInvalidCode
+	clear(z.table[:])
+}
+
+// writeCode appends the code c, of z.width bits, to the output.
+func (z *lzwWriter) writeCode(c uint32) error {
+	z.bits |= c << (32 - z.width - z.nBits)
+	z.nBits += z.width
+	for z.nBits >= 8 {
+		z.out = append(z.out, byte(z.bits>>24))
+		z.bits <<= 8
+		z.nBits -= 8
+	}
+	if len(z.out) >= lzwFlushBytes {
+		return z.flush()
+	}
+	return nil
+}
+
+func (z *lzwWriter) flush() error {
+	_, err := z.w.Write(z.out)
+	z.out = z.out[:0]
+	return err
+}
+
+// incHi moves on to the next implied code, widening the codes one code
+// before they stop fitting, as TIFF does. Once the codes run out, it
+// writes a ClearCode, resets the table and returns errLZWOutOfCodes.
+func (z *lzwWriter) incHi() error {
+	z.hi++
+	if z.hi+1 == z.overflow && z.width < lzwMaxWidth {
+		z.width++
+		z.overflow <<= 1
+	}
+	if z.hi+1 == z.overflow {
+		if err := z.writeCode(lzwClear); err != nil {
+			return err
+		}
+		z.width, z.hi, z.overflow = 9, lzwEOI, 1<<9
+		clear(z.table[:])
+		return errLZWOutOfCodes
+	}
+	return nil
+}
+
+// Write compresses p.
+func (z *lzwWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n := len(p)
+	code := z.saved
+	if code == lzwInvalidCode {
+		// The stream starts with a ClearCode.
+		if z.err = z.writeCode(lzwClear); z.err != nil {
+			return 0, z.err
+		}
+		code, p = uint32(p[0]), p[1:]
+	}
+loop:
+	for _, b := range p {
+		literal := uint32(b)
+		key := code<<8 | literal
+		// A hit in the table extends the code without writing it yet.
+		hash := (key>>12 ^ key) & lzwTableMask
+		for h, t := hash, z.table[hash]; t != 0; {
+			if key == t>>12 {
+				code = t & lzwMaxCode
+				continue loop
+			}
+			h = (h + 1) & lzwTableMask
+			t = z.table[h]
+		}
+		// Otherwise, the code is written and the byte starts the next.
+		if z.err = z.writeCode(code); z.err != nil {
+			return 0, z.err
+		}
+		code = literal
+		if err := z.incHi(); err != nil {
+			if err == errLZWOutOfCodes {
+				continue
+			}
+			z.err = err
+			return 0, err
+		}
+		for {
+			if z.table[hash] == 0 {
+				z.table[hash] = key<<12 | z.hi
+				break
+			}
+			hash = (hash + 1) & lzwTableMask
+		}
+	}
+	z.saved = code
+	return n, nil
+}
+
+// Close writes the pending code, the EndOfInformation code and the last
+// bits to the underlying writer. It does not close that writer.
+func (z *lzwWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	// Later calls to Write or Close fail.
+	z.err = errors.New("tiff: write to a closed LZW writer")
+	if z.saved != lzwInvalidCode {
+		if err := z.writeCode(z.saved); err != nil {
+			return err
+		}
+		if err := z.incHi(); err != nil && err != errLZWOutOfCodes {
+			return err
+		}
+	} else if err := z.writeCode(lzwClear); err != nil {
+		return err
+	}
+	if err := z.writeCode(lzwEOI); err != nil {
+		return err
+	}
+	if z.nBits > 0 {
+		z.out = append(z.out, byte(z.bits>>24))
+	}
+	return z.flush()
+}
+
+// A streamCompressor compresses a stream of bytes into a writer, and can
+// be reset to compress the next strip or tile.
+type streamCompressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// newStreamCompressor returns a streamCompressor into w for compression,
+// CompressionDeflate or CompressionLZW. level is the zlib level of
+// Deflate, which must be valid, 0 standing for the default.
+func newStreamCompressor(compression uint32, w io.Writer, level int) streamCompressor {
+	if compression == CompressionLZW {
+		return newLZWWriter(w)
+	}
+	if level == 0 {
+		level = zlib.DefaultCompression
+	}
+	zw, _ := zlib.NewWriterLevel(w, level) // Fails only for invalid levels.
+	return zw
+}
@@ -0,0 +1,553 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/tiff"
+)
+
+// Metadata holds the information of an image besides its pixels. It is
+// returned by DecodeWithMetadata and accepted by EncodeWithMetadata, so that
+// decoding a file and encoding the result preserves its fields.
+type Metadata struct {
+	// Descriptive ASCII fields; empty strings are not stored.
+	DocumentName     string // The document the image was scanned from.
+	PageName         string // The name of the page, such as a band or time.
+	ImageDescription string
+	Make             string
+	Model            string
+	Software         string
+	DateTime         string // As "YYYY:MM:DD HH:MM:SS".
+	Artist           string
+	HostComputer     string
+	Copyright        string
+
+	// PageNumber is the position of the page in a multi-page file, or nil
+	// if none is stored.
+	PageNumber *PageNumber
+
+	// Resolution is the pixel density, or nil if none is stored.
+	Resolution *Resolution
+
+	// Orientation is one of the Orientation values, telling how the stored
+	// image is to be shown, or 0 if no Orientation field is stored. See
+	// Encoder.BakeOrientation.
+	Orientation uint16
+
+	// Geo holds the GeoTIFF georeferencing, or nil if there is none.
+	Geo *GeoInfo
+
+	// NoData, if not nil, is the value of pixels that hold no data,
+	// stored in the GDAL_NODATA field.
+	NoData *float64
+
+	// Quantization, if not nil, gives the values that the samples stand
+	// for; see Quantization.
+	Quantization *Quantization
+
+	// GDAL holds the other items of the GDAL_METADATA field.
+	GDAL []GDALItem
+
+	// Tags holds the remaining fields, in ascending order of ID when
+	// decoded. Fields describing the layout of the pixel data are not
+	// included, nor are pointers to other IFDs, which would dangle once the
+	// image is written elsewhere.
+	Tags []Tag
+}
+
+// PageNumber is the PageNumber field of a page of a multi-page file.
+type PageNumber struct {
+	Page  uint16 // Zero for the first page.
+	Total uint16 // The number of pages, or zero if unknown.
+}
+
+// Resolution is the number of pixels per unit in each direction.
+type Resolution struct {
+	X, Y [2]uint32 // Numerator and denominator.
+	Unit uint16    // 1 for no absolute unit, 2 for inches, 3 for centimeters.
+}
+
+// GeoInfo holds the fields of a GeoTIFF file that tie the raster to the
+// world. Absent fields are nil or empty.
+type GeoInfo struct {
+	PixelScale     []float64 // ModelPixelScaleTag: the x, y and z scale.
+	Tiepoints      []float64 // ModelTiepointTag: i, j, k, x, y, z per point.
+	Transformation []float64 // ModelTransformationTag: 4×4, row-major.
+	KeyDirectory   []uint16  // GeoKeyDirectoryTag.
+	DoubleParams   []float64 // GeoDoubleParamsTag.
+	AsciiParams    string    // GeoAsciiParamsTag.
+}
+
+// A Tag is an IFD entry carried without interpretation.
+type Tag struct {
+	ID       uint16
+	DataType uint16 // The TIFF data type, from 1 (BYTE) to 12 (DOUBLE).
+	Data     []byte // The values, in little-endian byte order.
+}
+
+// layoutTags are the fields written by the encoder from the image itself,
+// or describing storage the decoder resolves, which Metadata does not carry.
+var layoutTags = map[int]bool{
+	TagNewSubfileType:            true,
+	TagSubfileType:               true,
+	TagImageWidth:                true,
+	TagImageLength:               true,
+	TagBitsPerSample:             true,
+	TagCompression:               true,
+	TagPhotometricInterpretation: true,
+	TagFillOrder:                 true,
+	TagStripOffsets:              true,
+	TagSamplesPerPixel:           true,
+	TagRowsPerStrip:              true,
+	TagStripByteCounts:           true,
+	TagXResolution:               true,
+	TagYResolution:               true,
+	TagPlanarConfiguration:       true,
+	TagResolutionUnit:            true,
+	TagPredictor:                 true,
+	TagColorMap:                  true,
+	TagTileWidth:                 true,
+	TagTileLength:                true,
+	TagTileOffsets:               true,
+	TagTileByteCounts:            true,
+	TagSubIFDs:                   true,
+	TagExtraSamples:              true,
+	TagSampleFormat:              true,
+	TagJPEGTables:                true,
+	TagInkSet:                    true,
+	TagYCbCrCoefficients:         true,
+	TagYCbCrSubSampling:          true,
+	TagYCbCrPositioning:          true,
+	TagReferenceBlackWhite:       true,
+	TagImageDepth:                true,
+	TagTileDepth:                 true,
+	TagExifIFD:                   true,
+	TagGPSIFD:                    true,
+	TagInteroperabilityIFD:       true,
+	TagLercParameters:            true,
+	TagZSTDDictionary:            true,
+	TagBlockChecksums:            true,
+}
+
+// The ASCII fields held in named fields of Metadata.
+var metadataStrings = []struct {
+	tag   int
+	field func(md *Metadata) *string
+}{
+	{TagDocumentName, func(md *Metadata) *string { return &md.DocumentName }},
+	{TagPageName, func(md *Metadata) *string { return &md.PageName }},
+	{TagImageDescription, func(md *Metadata) *string { return &md.ImageDescription }},
+	{TagMake, func(md *Metadata) *string { return &md.Make }},
+	{TagModel, func(md *Metadata) *string { return &md.Model }},
+	{TagSoftware, func(md *Metadata) *string { return &md.Software }},
+	{TagDateTime, func(md *Metadata) *string { return &md.DateTime }},
+	{TagArtist, func(md *Metadata) *string { return &md.Artist }},
+	{TagHostComputer, func(md *Metadata) *string { return &md.HostComputer }},
+	{TagCopyright, func(md *Metadata) *string { return &md.Copyright }},
+}
+
+// namedTags are the fields held in named fields of Metadata.
+var namedTags = map[int]bool{
+	TagDocumentName: true, TagPageName: true, TagPageNumber: true, TagOrientation: true,
+	TagImageDescription: true, TagMake: true, TagModel: true, TagSoftware: true,
+	TagDateTime: true, TagArtist: true, TagHostComputer: true, TagCopyright: true,
+	TagModelPixelScale: true, TagModelTiepoint: true, TagModelTransformation: true,
+	TagGeoKeyDirectory: true, TagGeoDoubleParams: true, TagGeoAsciiParams: true,
+	TagGDALMetadata: true, TagGDALNoData: true,
+}
+
+// entryData reads the data of the IFD entry for tag, converted to
+// little-endian byte order. ok is false if the entry is absent.
+func (d *decoder) entryData(tag int) (datatype int, data []byte, ok bool, err error) {
+	p, ok := d.ifd[tag]
+	if !ok {
+		return 0, nil, false, nil
+	}
+	datatype = int(d.byteOrder.Uint16(p[2:4]))
+	if !knownType(datatype) {
+		return 0, nil, false, UnsupportedError{"IFD entry datatype", tag, uint(datatype)}
+	}
+	size := uint64(lengths[datatype]) * uint64(d.byteOrder.Uint32(p[4:8]))
+	if size > uint64(d.maxTagDataSize) {
+		return 0, nil, false, FormatError("IFD entry data too large")
+	}
+	if size <= 4 {
+		data = append([]byte(nil), p[8:8+size]...)
+	} else if data, err = safeReadAt(d.r, size, int64(d.byteOrder.Uint32(p[8:12]))); err != nil {
+		return 0, nil, false, err
+	}
+	if d.byteOrder != binary.ByteOrder(binary.LittleEndian) {
+		swapEntryData(datatype, data)
+	}
+	return datatype, data, true, nil
+}
+
+// swapEntryData reverses the byte order of the values in data, of the given
+// data type.
+func swapEntryData(datatype int, data []byte) {
+	n := int(lengths[datatype])
+	if datatype == TypeRational || datatype == TypeSRational {
+		n = 4
+	}
+	for i := 0; i+n <= len(data); i += n {
+		for a, b := i, i+n-1; a < b; a, b = a+1, b-1 {
+			data[a], data[b] = data[b], data[a]
+		}
+	}
+}
+
+// asciiField returns the string held in the ASCII entry for tag.
+func (d *decoder) asciiField(tag int) (string, error) {
+	dt, data, ok, err := d.entryData(tag)
+	if !ok || err != nil {
+		return "", err
+	}
+	if dt != TypeASCII {
+		return "", FormatError(fmt.Sprintf("field %d is not ASCII", tag))
+	}
+	return strings.TrimRight(string(data), "\x00"), nil
+}
+
+// doubleField returns the values of the DOUBLE or FLOAT entry for tag.
+func (d *decoder) doubleField(tag int) ([]float64, error) {
+	dt, data, ok, err := d.entryData(tag)
+	if !ok || err != nil {
+		return nil, err
+	}
+	var v []float64
+	switch dt {
+	case TypeDouble:
+		v = make([]float64, len(data)/8)
+		for i := range v {
+			v[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+		}
+	case TypeFloat:
+		v = make([]float64, len(data)/4)
+		for i := range v {
+			v[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+		}
+	default:
+		return nil, FormatError(fmt.Sprintf("field %d is not floating point", tag))
+	}
+	return v, nil
+}
+
+// metadata collects the Metadata of the image from its IFD.
+func (d *decoder) metadata() (*Metadata, error) {
+	md := new(Metadata)
+	var err error
+	for _, s := range metadataStrings {
+		if *s.field(md), err = d.asciiField(s.tag); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := d.ifd[TagXResolution]; ok {
+		res := &Resolution{Unit: 2} // Inches if ResolutionUnit is missing.
+		for _, f := range []struct {
+			tag int
+			v   *[2]uint32
+		}{{TagXResolution, &res.X}, {TagYResolution, &res.Y}} {
+			dt, data, ok, err := d.entryData(f.tag)
+			if err != nil {
+				return nil, err
+			}
+			if ok && dt == TypeRational && len(data) >= 8 {
+				f.v[0] = binary.LittleEndian.Uint32(data[0:])
+				f.v[1] = binary.LittleEndian.Uint32(data[4:])
+			}
+		}
+		if p, ok := d.ifd[TagResolutionUnit]; ok {
+			u, err := d.ifdUint(p[:], 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(u) > 0 {
+				res.Unit = uint16(u[0])
+			}
+		}
+		md.Resolution = res
+	}
+	if p, ok := d.ifd[TagOrientation]; ok {
+		o, err := d.ifdUint(p[:], 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(o) > 0 {
+			md.Orientation = uint16(o[0])
+		}
+	}
+
+	if p, ok := d.ifd[TagPageNumber]; ok {
+		n, err := d.ifdUint(p[:], 2)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 2 {
+			md.PageNumber = &PageNumber{uint16(n[0]), uint16(n[1])}
+		}
+	}
+
+	geo := new(GeoInfo)
+	for _, f := range []struct {
+		tag int
+		v   *[]float64
+	}{
+		{TagModelPixelScale, &geo.PixelScale},
+		{TagModelTiepoint, &geo.Tiepoints},
+		{TagModelTransformation, &geo.Transformation},
+		{TagGeoDoubleParams, &geo.DoubleParams},
+	} {
+		if *f.v, err = d.doubleField(f.tag); err != nil {
+			return nil, err
+		}
+	}
+	if p, ok := d.ifd[TagGeoKeyDirectory]; ok {
+		keys, err := d.ifdUint(p[:], d.maxTagDataSize/2)
+		if err != nil {
+			return nil, err
+		}
+		geo.KeyDirectory = make([]uint16, len(keys))
+		for i, k := range keys {
+			geo.KeyDirectory[i] = uint16(k)
+		}
+	}
+	if geo.AsciiParams, err = d.asciiField(TagGeoAsciiParams); err != nil {
+		return nil, err
+	}
+	if geo.PixelScale != nil || geo.Tiepoints != nil || geo.Transformation != nil ||
+		geo.KeyDirectory != nil || geo.DoubleParams != nil || geo.AsciiParams != "" {
+		md.Geo = geo
+	}
+
+	if md.NoData, err = d.noData(); err != nil {
+		return nil, err
+	}
+	items, err := d.gdalItems()
+	if err != nil {
+		return nil, err
+	}
+	// The scale and offset only describe the samples of single-band
+	// images; those of other images are kept with the other items.
+	md.GDAL = items
+	if d.samplesPerPixel == 1 {
+		if md.Quantization, md.GDAL, err = quantization(items, d.bitsPerSample); err != nil {
+			return nil, err
+		}
+	}
+
+	tags := make([]int, 0, len(d.ifd))
+	for tag := range d.ifd {
+		if !layoutTags[tag] && !namedTags[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Ints(tags)
+	for _, tag := range tags {
+		dt, data, _, err := d.entryData(tag)
+		if _, ok := err.(UnsupportedError); ok {
+			continue // Readers skip fields of unknown types (p. 16).
+		}
+		if err != nil {
+			return nil, err
+		}
+		md.Tags = append(md.Tags, Tag{ID: uint16(tag), DataType: uint16(dt), Data: data})
+	}
+	return md, nil
+}
+
+// asciiEntry returns an ASCII IFD entry holding s, of any length,
+// NUL-terminated unless s already is.
+func asciiEntry(tag int, s string) ifdEntry {
+	data := make([]uint32, len(s), len(s)+1)
+	for i := 0; i < len(s); i++ {
+		data[i] = uint32(s[i])
+	}
+	if !strings.HasSuffix(s, "\x00") {
+		data = append(data, 0)
+	}
+	return ifdEntry{tag, TypeASCII, data}
+}
+
+// rationalEntry returns a RATIONAL IFD entry holding the numerators and
+// denominators v.
+func rationalEntry(tag int, v ...[2]uint32) ifdEntry {
+	data := make([]uint32, 0, 2*len(v))
+	for _, r := range v {
+		data = append(data, r[0], r[1])
+	}
+	return ifdEntry{tag, TypeRational, data}
+}
+
+// long8Entry returns a LONG8 IFD entry holding v, for BigTIFF files.
+func long8Entry(tag int, v []uint64) ifdEntry {
+	data := make([]uint32, 2*len(v))
+	for i, x := range v {
+		data[2*i], data[2*i+1] = uint32(x), uint32(x>>32)
+	}
+	return ifdEntry{tag, TypeLong8, data}
+}
+
+// noDataEntry returns a GDAL_NODATA entry holding v.
+func noDataEntry(v float64) ifdEntry {
+	return asciiEntry(TagGDALNoData, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// doubleEntry returns a DOUBLE IFD entry holding v.
+func doubleEntry(tag int, v []float64) ifdEntry {
+	data := make([]uint32, 2*len(v))
+	for i, f := range v {
+		b := math.Float64bits(f)
+		data[2*i], data[2*i+1] = uint32(b), uint32(b>>32)
+	}
+	return ifdEntry{tag, TypeDouble, data}
+}
+
+// appendEntries appends the IFD entries storing md, except the resolution,
+// to ifd. It fails if a custom tag is malformed or would clash with a field
+// written otherwise.
+func (md *Metadata) appendEntries(ifd []ifdEntry) ([]ifdEntry, error) {
+	for _, s := range metadataStrings {
+		if v := *s.field(md); v != "" {
+			ifd = append(ifd, asciiEntry(s.tag, v))
+		}
+	}
+	if n := md.PageNumber; n != nil {
+		ifd = append(ifd, ifdEntry{TagPageNumber, TypeShort, []uint32{uint32(n.Page), uint32(n.Total)}})
+	}
+	if o := md.Orientation; o != 0 {
+		if o > OrientationLeftBottom {
+			return nil, fmt.Errorf("tiff: invalid orientation %d", o)
+		}
+		ifd = append(ifd, ifdEntry{TagOrientation, TypeShort, []uint32{uint32(o)}})
+	}
+	if g := md.Geo; g != nil {
+		for _, f := range []struct {
+			tag int
+			v   []float64
+		}{
+			{TagModelPixelScale, g.PixelScale},
+			{TagModelTiepoint, g.Tiepoints},
+			{TagModelTransformation, g.Transformation},
+			{TagGeoDoubleParams, g.DoubleParams},
+		} {
+			if len(f.v) > 0 {
+				ifd = append(ifd, doubleEntry(f.tag, f.v))
+			}
+		}
+		if len(g.KeyDirectory) > 0 {
+			keys := make([]uint32, len(g.KeyDirectory))
+			for i, k := range g.KeyDirectory {
+				keys[i] = uint32(k)
+			}
+			ifd = append(ifd, ifdEntry{TagGeoKeyDirectory, TypeShort, keys})
+		}
+		if g.AsciiParams != "" {
+			ifd = append(ifd, asciiEntry(TagGeoAsciiParams, g.AsciiParams))
+		}
+	}
+	if md.NoData != nil {
+		ifd = append(ifd, noDataEntry(*md.NoData))
+	}
+	if items := md.GDAL; len(items) > 0 || md.Quantization != nil {
+		if md.Quantization != nil {
+			items = append(quantizationItems(md.Quantization), items...)
+		}
+		ifd = append(ifd, gdalMetadataEntry(items))
+	}
+
+	seen := make(map[uint16]bool, len(md.Tags))
+	for _, t := range md.Tags {
+		id, dt := int(t.ID), int(t.DataType)
+		switch {
+		case layoutTags[id] || namedTags[id]:
+			return nil, fmt.Errorf("tiff: tag %d cannot be set as a custom tag", id)
+		case seen[t.ID]:
+			return nil, fmt.Errorf("tiff: duplicate custom tag %d", id)
+		case !knownType(dt):
+			return nil, UnsupportedError{"IFD entry datatype", id, uint(dt)}
+		case len(t.Data)%int(lengths[dt]) != 0:
+			return nil, fmt.Errorf("tiff: custom tag %d has %d bytes, not a multiple of its type size", id, len(t.Data))
+		}
+		seen[t.ID] = true
+		ifd = append(ifd, ifdEntry{id, dt, tagData(dt, t.Data)})
+	}
+	return ifd, nil
+}
+
+// tagData splits the little-endian values in p, of the given data type,
+// into the elements of ifdEntry.data.
+func tagData(datatype int, p []byte) []uint32 {
+	var data []uint32
+	switch lengths[datatype] {
+	case 1:
+		data = make([]uint32, len(p))
+		for i, b := range p {
+			data[i] = uint32(b)
+		}
+	case 2:
+		data = make([]uint32, len(p)/2)
+		for i := range data {
+			data[i] = uint32(binary.LittleEndian.Uint16(p[2*i:]))
+		}
+	default:
+		// Eight-byte types are stored as pairs of 32-bit halves.
+		data = make([]uint32, len(p)/4)
+		for i := range data {
+			data[i] = binary.LittleEndian.Uint32(p[4*i:])
+		}
+	}
+	if datatype == TypeASCII && (len(data) == 0 || data[len(data)-1] != 0) {
+		// TIFF strings end with a NUL, which the data may leave out.
+		data = append(data, 0)
+	}
+	return data
+}
+
+// DecodeWithMetadata is like Decode, but also returns the metadata of the
+// image.
+func DecodeWithMetadata(r io.Reader) (image.Image, *Metadata, error) {
+	d, err := newDecoder(newReaderAt(r), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	md, err := d.metadata()
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err := d.decodeImage()
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, md, nil
+}
+
+// Metadata returns the metadata of the image.
+func (r *Reader) Metadata() (*Metadata, error) {
+	return r.d.metadata()
+}
+
+// EncodeWithMetadata is like Encode, but also stores md, which may be nil.
+func EncodeWithMetadata(w io.Writer, m image.Image, md *Metadata, opt *tiff.Options) error {
+	e := &Encoder{Options: opt}
+	return e.EncodeWithMetadata(w, m, md)
+}
+
+// EncodeWithMetadata is like Encode, but also stores md, which may be nil.
+// If md is not nil, the resolution fields are written only if
+// md.Resolution is set, so that decoding and re-encoding a file keeps them
+// as they were.
+func (e *Encoder) EncodeWithMetadata(w io.Writer, m image.Image, md *Metadata) error {
+	return e.encodeVerified(w, m, md, nil)
+}
@@ -0,0 +1,675 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	nodata := -9999.0
+	want := &Metadata{
+		DocumentName:     "survey",
+		PageName:         "band 1",
+		PageNumber:       &PageNumber{Page: 0, Total: 3},
+		ImageDescription: "elevation",
+		Software:         "go-tiff32",
+		DateTime:         "2019:06:01 12:00:00",
+		Copyright:        "public domain",
+		Resolution:       &Resolution{X: [2]uint32{300, 1}, Y: [2]uint32{600, 2}, Unit: 3},
+		Geo: &GeoInfo{
+			PixelScale:   []float64{0.5, 0.5, 0},
+			Tiepoints:    []float64{0, 0, 0, 120.25, 23.5, 0},
+			KeyDirectory: []uint16{1, 1, 0, 1, 1024, 0, 1, 2},
+			DoubleParams: []float64{math.Pi},
+			AsciiParams:  "WGS 84|",
+		},
+		NoData: &nodata,
+		// Recorded as it is for an image that is not quantized.
+		Quantization: &Quantization{Scale: 0.5, Offset: 1, Bits: 32},
+		GDAL: []GDALItem{
+			{Name: "AREA_OR_POINT", Value: "Area"},
+			{Name: "DESCRIPTION", Value: "height <m>", Band: 1, Role: "description"},
+		},
+		Tags: []Tag{
+			{ID: 280, DataType: TypeShort, Data: []byte{1, 0}},
+			{ID: 50000, DataType: TypeSRational, Data: []byte{0xff, 0xff, 0xff, 0xff, 3, 0, 0, 0}},
+			{ID: 50001, DataType: TypeDouble, Data: []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		},
+	}
+	g := newTestGray32(7, 5)
+	var buf bytes.Buffer
+	if err := EncodeWithMetadata(&buf, g, want, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, got, err := DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*Gray32).Pix, g.Pix)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+
+	// Without a resolution, none is written.
+	want.Resolution = nil
+	buf.Reset()
+	if err := EncodeWithMetadata(&buf, g, want, nil); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Metadata(); err != nil || got.Resolution != nil {
+		t.Errorf("Resolution = %v, %v, want nil", got.Resolution, err)
+	}
+}
+
+func TestMetadataCustomTagErrors(t *testing.T) {
+	g := newTestGray32(2, 2)
+	for _, tag := range []Tag{
+		{ID: TagImageWidth, DataType: TypeShort, Data: []byte{1, 0}},
+		{ID: TagSoftware, DataType: TypeASCII, Data: []byte("x\x00")},
+		{ID: 50000, DataType: 14, Data: []byte{1, 0, 0, 0}},
+		{ID: 50000, DataType: TypeLong8, Data: []byte{1, 0, 0, 0, 0, 0, 0, 0}},
+		{ID: 50000, DataType: TypeLong, Data: []byte{1, 0}},
+	} {
+		if err := EncodeWithMetadata(io.Discard, g, &Metadata{Tags: []Tag{tag}}, nil); err == nil {
+			t.Errorf("tag %+v: no error", tag)
+		}
+	}
+}
+
+func TestIFDBuilder(t *testing.T) {
+	// Assemble a complete file by hand: header, one strip of pixels and
+	// an IFD describing them.
+	g := newTestGray32(6, 3)
+	pix := make([]byte, 4*len(g.Pix))
+	packUint32s(pix, g.Pix)
+
+	var d IFD
+	d.AddShort(TagImageLength, 99) // Replaced below.
+	d.AddLong(TagImageWidth, 6)
+	d.AddLong(TagImageLength, 3)
+	d.AddShort(TagBitsPerSample, 32)
+	d.AddShort(TagPhotometricInterpretation, PhotometricBlackIsZero)
+	d.AddLong(TagStripOffsets, 8)
+	d.AddLong(TagStripByteCounts, uint32(len(pix)))
+	d.AddASCII(TagSoftware, "builder")
+	d.AddRational(50000, [2]uint32{1, 3}, [2]uint32{2, 3})
+	d.AddDouble(50001, 0.25)
+	if err := d.Add(Tag{ID: 50002, DataType: TypeSShort, Data: []byte{0xfe, 0xff}}); err != nil {
+		t.Fatal(err)
+	}
+	d.AddByte(50003, 1)
+	d.Remove(50003)
+	if d.Len() != 10 {
+		t.Fatalf("Len = %d, want 10", d.Len())
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(leHeader)
+	ifdOffset := int64(8 + len(pix))
+	binary.Write(&buf, binary.LittleEndian, uint32(ifdOffset))
+	buf.Write(pix)
+	if err := d.Write(&buf, ifdOffset, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := buf.Len() - int(ifdOffset); n != d.Size() {
+		t.Errorf("wrote %d bytes, Size = %d", n, d.Size())
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := r.ReadRegion(r.Bounds())
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*Gray32).Pix, g.Pix)
+	md, err := r.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Tag{
+		{ID: 50000, DataType: TypeRational, Data: []byte{1, 0, 0, 0, 3, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0}},
+		{ID: 50001, DataType: TypeDouble, Data: []byte{0, 0, 0, 0, 0, 0, 0xd0, 0x3f}},
+		{ID: 50002, DataType: TypeSShort, Data: []byte{0xfe, 0xff}},
+	}
+	if md.Software != "builder" || !reflect.DeepEqual(md.Tags, want) {
+		t.Errorf("metadata = %q, %+v, want %q, %+v", md.Software, md.Tags, "builder", want)
+	}
+
+	if err := d.Write(io.Discard, 7, 0); err == nil {
+		t.Error("Write accepted an odd offset")
+	}
+}
+
+func TestRationalAndASCIIEntries(t *testing.T) {
+	for _, tc := range []struct {
+		v    float64
+		want [2]uint32
+		ok   bool
+	}{
+		{0.75, [2]uint32{3, 4}, true},
+		{1.0 / 3, [2]uint32{1, 3}, true},
+		{72, [2]uint32{72, 1}, true},
+		{1e-12, [2]uint32{0, 1}, true},
+		{-1, [2]uint32{}, false},
+		{5e9, [2]uint32{}, false},
+		{math.NaN(), [2]uint32{}, false},
+	} {
+		if r, ok := Rational(tc.v); r != tc.want || ok != tc.ok {
+			t.Errorf("Rational(%g) = %v, %v, want %v, %v", tc.v, r, ok, tc.want, tc.ok)
+		}
+	}
+	if r, _ := Rational(math.Pi); math.Abs(float64(r[0])/float64(r[1])-math.Pi) > 1e-15 {
+		t.Errorf("Rational(π) = %v", r)
+	}
+	if r, ok := SRational(-2.5); r != [2]int32{-5, 2} || !ok {
+		t.Errorf("SRational(-2.5) = %v, %v", r, ok)
+	}
+
+	long := string(bytes.Repeat([]byte("0123456789"), 100))
+	md := &Metadata{
+		Software: long,
+		Artist:   "abc", // Held in the entry itself with its NUL.
+		Tags: []Tag{
+			{ID: 50000, DataType: TypeASCII, Data: []byte("no nul")},
+			{ID: 50001, DataType: TypeSRational, Data: []byte{0xfb, 0xff, 0xff, 0xff, 2, 0, 0, 0}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithMetadata(&buf, newTestGray32(2, 2), md, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, got, err := DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Software != long || got.Artist != "abc" {
+		t.Errorf("strings of %d and %d bytes, %q", len(got.Software), len(got.Artist), got.Artist)
+	}
+	want := []Tag{
+		{ID: 50000, DataType: TypeASCII, Data: []byte("no nul\x00")},
+		md.Tags[1],
+	}
+	if !reflect.DeepEqual(got.Tags, want) {
+		t.Errorf("custom tags = %+v, want %+v", got.Tags, want)
+	}
+
+	if err := writeIFD(io.Discard, 8, []ifdEntry{{50000, TypeRational, []uint32{1, 2, 3}}}, 0); err == nil {
+		t.Error("wrote a RATIONAL without its denominator")
+	}
+	if err := writeIFD(io.Discard, 8, []ifdEntry{{50000, TypeASCII, []uint32{'a'}}}, 0); err == nil {
+		t.Error("wrote an ASCII entry without its NUL")
+	}
+}
+
+func TestTagDataTypes(t *testing.T) {
+	var tags []Tag
+	ints := map[uint16][]int64{
+		TypeByte:   {0, 255},
+		TypeSByte:  {-128, 127},
+		TypeShort:  {0, 65535},
+		TypeSShort: {-32768, 32767},
+		TypeLong:   {0, math.MaxUint32},
+		TypeSLong:  {math.MinInt32, math.MaxInt32},
+		TypeIFD:    {8},
+	}
+	floats := map[uint16][]float64{
+		TypeFloat:     {-1.5, 3.25},
+		TypeDouble:    {-1e300, math.Pi},
+		TypeRational:  {0.125, 72},
+		TypeSRational: {-0.125, 72},
+	}
+	for dt := uint16(1); dt <= TypeIFD; dt++ {
+		var tag Tag
+		var err error
+		switch {
+		case ints[dt] != nil:
+			tag, err = NewIntTag(50000+dt, dt, ints[dt]...)
+		case floats[dt] != nil:
+			tag, err = NewFloatTag(50000+dt, dt, floats[dt]...)
+		default:
+			continue
+		}
+		if err != nil {
+			t.Fatalf("type %d: %v", dt, err)
+		}
+		tags = append(tags, tag)
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithMetadata(&buf, newTestGray32(2, 2), &Metadata{Tags: tags}, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, md, err := DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(md.Tags, tags) {
+		t.Fatalf("tags = %+v, want %+v", md.Tags, tags)
+	}
+	for _, tag := range md.Tags {
+		if want := ints[tag.DataType]; want != nil {
+			if got, err := tag.Ints(); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("type %d: Ints = %v, %v, want %v", tag.DataType, got, err, want)
+			}
+			continue
+		}
+		if got, err := tag.Floats(); err != nil || !reflect.DeepEqual(got, floats[tag.DataType]) {
+			t.Errorf("type %d: Floats = %v, %v, want %v", tag.DataType, got, err, floats[tag.DataType])
+		}
+		if _, err := tag.Ints(); err == nil {
+			t.Errorf("type %d: Ints of a floating point tag", tag.DataType)
+		}
+	}
+
+	if tag, err := NewIntTag(50000, TypeSLong8, math.MinInt64); err != nil {
+		t.Error(err)
+	} else if v, err := tag.Ints(); err != nil || v[0] != math.MinInt64 {
+		t.Errorf("SLONG8 = %v, %v", v, err)
+	}
+	if _, err := NewIntTag(50000, TypeSByte, 128); err == nil {
+		t.Error("SBYTE accepted 128")
+	}
+	if _, err := NewIntTag(50000, TypeFloat, 1); err == nil {
+		t.Error("NewIntTag accepted FLOAT")
+	}
+	if _, err := NewFloatTag(50000, TypeRational, -1); err == nil {
+		t.Error("RATIONAL accepted -1")
+	}
+	if _, err := (Tag{ID: 50000, DataType: TypeASCII, Data: []byte("1\x00")}).Floats(); err == nil {
+		t.Error("Floats of an ASCII tag")
+	}
+}
+
+func TestQuantization(t *testing.T) {
+	f := NewGrayFloat32(image.Rect(0, 0, 9, 6))
+	for i := range f.Pix {
+		f.Pix[i] = math.Float32bits(float32(i)*1.37 - 20)
+	}
+	f.Pix[4] = math.Float32bits(float32(math.NaN()))
+	f.Pix[5] = math.Float32bits(1e9) // Clamped.
+	for _, tc := range []struct {
+		q      Quantization
+		noData *float64
+	}{
+		{Quantization{Scale: 0.01, Offset: -5, Bits: 16}, nil},
+		{Quantization{Scale: 1e-4, Offset: 0, Bits: 32}, nil},
+		{Quantization{Scale: 0.1, Offset: 3, Bits: 16}, func() *float64 { v := 7.0; return &v }()},
+	} {
+		md := &Metadata{Quantization: &tc.q, NoData: tc.noData}
+		var buf bytes.Buffer
+		e := &Encoder{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, VerifyRows: 3}
+		if err := e.EncodeWithMetadata(&buf, f, md); err != nil {
+			t.Fatalf("%+v: %v", tc.q, err)
+		}
+		m, got, err := DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.q, err)
+		}
+		if !reflect.DeepEqual(got.Quantization, &tc.q) {
+			t.Errorf("Quantization = %+v, want %+v", got.Quantization, tc.q)
+		}
+		lo := -1 << (tc.q.Bits - 1)
+		wantNoData := float64(lo)
+		if tc.noData != nil {
+			wantNoData = *tc.noData
+		}
+		if got.NoData == nil || *got.NoData != wantNoData {
+			t.Errorf("%+v: NoData = %v, want %v", tc.q, got.NoData, wantNoData)
+		}
+		g := m.(*GrayFloat32)
+		for i, bits := range g.Pix {
+			v, want := math.Float32frombits(bits), math.Float32frombits(f.Pix[i])
+			switch {
+			case i == 4:
+				if !math.IsNaN(float64(v)) {
+					t.Errorf("%+v: NaN decoded as %v", tc.q, v)
+				}
+			case i == 5:
+				if max := float64(int64(1)<<(tc.q.Bits-1)-1)*tc.q.Scale + tc.q.Offset; math.Abs(float64(v)-max) > 1e-3*math.Abs(max) {
+					t.Errorf("%+v: clamped value = %v, want %v", tc.q, v, max)
+				}
+			case math.Abs(float64(v-want)) > tc.q.Scale/2+1e-5:
+				t.Fatalf("%+v: sample %d = %v, want %v", tc.q, i, v, want)
+			}
+		}
+	}
+
+	for _, q := range []Quantization{{Scale: 1, Bits: 8}, {Scale: 0, Bits: 16}} {
+		if err := EncodeWithMetadata(io.Discard, f, &Metadata{Quantization: &q}, nil); err == nil {
+			t.Errorf("%+v: no error", q)
+		}
+	}
+	bad := 0.5
+	if err := EncodeWithMetadata(io.Discard, f, &Metadata{Quantization: &Quantization{Scale: 1, Bits: 16}, NoData: &bad}, nil); err == nil {
+		t.Error("accepted a fractional NoData value")
+	}
+}
+
+func TestBandInfo(t *testing.T) {
+	r := image.Rect(0, 0, 4, 4)
+	imgs := []*GrayFloat32{NewGrayFloat32(r), NewGrayFloat32(r)}
+	scale, offset := 0.01, -5.0
+	md := &Metadata{GDAL: []GDALItem{{Name: "AREA", Value: "north"}}}
+	md.SetBand(1, BandInfo{Description: "red", Unit: "W/m2"})
+	md.SetBand(2, BandInfo{Description: "placeholder"})
+	md.SetBand(2, BandInfo{Description: "near infrared", Scale: &scale, Offset: &offset})
+	var buf bytes.Buffer
+	if err := (&Encoder{}).StackBandsWithMetadata(&buf, imgs, md); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := rd.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.GDAL) != 6 || got.GDAL[0].Name != "AREA" {
+		t.Errorf("GDAL items = %v", got.GDAL)
+	}
+	if b, err := got.Band(1); err != nil || b != (BandInfo{Description: "red", Unit: "W/m2"}) {
+		t.Errorf("Band(1) = %+v, %v", b, err)
+	}
+	b, err := got.Band(2)
+	if err != nil || b.Description != "near infrared" || b.Unit != "" || b.Scale == nil || *b.Scale != scale || b.Offset == nil || *b.Offset != offset {
+		t.Errorf("Band(2) = %+v, %v", b, err)
+	}
+
+	// The scale and offset of a single band are decoded as its
+	// quantization, and still reported for the band.
+	one := &Metadata{}
+	one.SetBand(1, BandInfo{Description: "height", Scale: &scale})
+	buf.Reset()
+	if err := EncodeAll(&buf, []Page{{Image: imgs[0], Metadata: one, Type: SubfilePage}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, got, err = DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := got.Band(1); err != nil || b.Description != "height" || b.Scale == nil || *b.Scale != scale || b.Offset == nil || *b.Offset != 0 {
+		t.Errorf("Band(1) of a single band = %+v, %v", b, err)
+	}
+
+	bad := &Metadata{GDAL: []GDALItem{{Name: "SCALE", Value: "x", Band: 1, Role: "scale"}}}
+	if _, err := bad.Band(1); err == nil {
+		t.Error("Band accepted an invalid scale")
+	}
+}
+
+func TestSampleRange(t *testing.T) {
+	le := binary.LittleEndian
+	r := image.Rect(0, 0, 4, 1)
+	g := NewGray32(r)
+	g.SetRow(0, []uint32{0, 1000, 2000, 3000})
+	f := NewGrayFloat32(r)
+	f.SetRow(0, []float32{-2, 0, 1, float32(math.NaN())})
+	lo, hi := make([]byte, 8), make([]byte, 8)
+	le.PutUint64(lo, math.Float64bits(-1))
+	le.PutUint64(hi, math.Float64bits(1))
+	for _, tc := range []struct {
+		name string
+		m    image.Image
+		tags []Tag
+		want *SampleRange
+		gray []uint16
+	}{
+		{"none", g, nil, nil, nil},
+		{"Min and Max", g, []Tag{
+			{ID: TagMinSampleValue, DataType: TypeShort, Data: le.AppendUint16(nil, 1000)},
+			{ID: TagMaxSampleValue, DataType: TypeShort, Data: le.AppendUint16(nil, 3000)},
+		}, &SampleRange{1000, 3000}, []uint16{0, 0, 0x8000, 0xffff}},
+		{"Max only", g, []Tag{
+			{ID: TagMaxSampleValue, DataType: TypeLong, Data: le.AppendUint32(nil, 2000)},
+		}, &SampleRange{0, 2000}, []uint16{0, 0x8000, 0xffff, 0xffff}},
+		{"SMin and SMax", f, []Tag{
+			{ID: TagSMinSampleValue, DataType: TypeDouble, Data: lo},
+			{ID: TagSMaxSampleValue, DataType: TypeDouble, Data: hi},
+			{ID: TagMaxSampleValue, DataType: TypeShort, Data: le.AppendUint16(nil, 9)},
+		}, &SampleRange{-1, 1}, []uint16{0, 0x8000, 0xffff, 0}},
+		{"float without SMin", f, []Tag{
+			{ID: TagSMaxSampleValue, DataType: TypeDouble, Data: hi},
+		}, nil, nil},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithMetadata(&buf, tc.m, &Metadata{Tags: tc.tags}, nil); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		rd, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{DisplayRange: true})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got, err := rd.SampleRange()
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: SampleRange = %v, %v, want %v", tc.name, got, err, tc.want)
+			continue
+		}
+		m, err := rd.ReadRegion(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for x, want := range tc.gray {
+			if c := m.At(x, 0); c != (color.Gray16{Y: want}) {
+				t.Errorf("%s: At(%d, 0) = %v, want gray %#x", tc.name, x, c, want)
+			}
+		}
+		if c, want := m.(interface{ Gray32At(x, y int) Gray32Color }).Gray32At(1, 0), tc.m.(interface{ Gray32At(x, y int) Gray32Color }).Gray32At(1, 0); c != want {
+			t.Errorf("%s: Gray32At(1, 0) = %v, want %v", tc.name, c, want)
+		}
+	}
+
+	// Without DisplayRange, At returns the samples.
+	var buf bytes.Buffer
+	md := &Metadata{Tags: []Tag{{ID: TagMaxSampleValue, DataType: TypeShort, Data: le.AppendUint16(nil, 9)}}}
+	if err := EncodeWithMetadata(&buf, g, md, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := m.At(3, 0); c != (Gray32Color{3000}) {
+		t.Errorf("At(3, 0) without DisplayRange = %v", c)
+	}
+	if sub := (&Gray32{Pix: g.Pix, Stride: 4, Rect: r, Range: &SampleRange{0, 3000}}).SubImage(image.Rect(3, 0, 4, 1)); sub.At(3, 0) != (color.Gray16{Y: 0xffff}) {
+		t.Errorf("SubImage At(3, 0) = %v", sub.At(3, 0))
+	}
+}
+
+func TestClasses(t *testing.T) {
+	water, forest := &color.NRGBA{0, 0, 255, 255}, &color.NRGBA{34, 139, 34, 128}
+	classes := []Class{
+		{Value: 1, Name: "water", Color: water},
+		{Value: 2, Name: "urban"},
+		{Value: 11, Name: "forest, mixed", Color: forest},
+	}
+	md := &Metadata{GDAL: []GDALItem{{Name: "AREA", Value: "north"}}}
+	md.SetClasses([]Class{{Value: 5, Name: "replaced"}})
+	md.SetClasses(classes)
+	m := NewGray32(image.Rect(0, 0, 4, 4))
+	m.Pix[3], m.Pix[7] = 1, 11
+	m.Palette = ClassPalette(classes)
+	var buf bytes.Buffer
+	if err := EncodeWithMetadata(&buf, m, md, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, gotMD, err := DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := gotMD.Classes()
+	if err != nil || !reflect.DeepEqual(decoded, classes) {
+		t.Errorf("Classes = %+v, %v, want %+v", decoded, err, classes)
+	}
+	if len(gotMD.GDAL) != 6 || gotMD.GDAL[0].Name != "AREA" {
+		t.Errorf("GDAL items = %v", gotMD.GDAL)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want color.Color
+	}{{3, 0, *water}, {3, 1, color.NRGBA{34, 139, 34, 255}}, {0, 0, color.Black}} {
+		r, g, b, a := got.At(tc.x, tc.y).RGBA()
+		wr, wg, wb, wa := tc.want.RGBA()
+		if [4]uint32{r, g, b, a} != [4]uint32{wr, wg, wb, wa} {
+			t.Errorf("At(%d, %d) = %v, want %v", tc.x, tc.y, got.At(tc.x, tc.y), tc.want)
+		}
+	}
+
+	for _, it := range []GDALItem{
+		{Name: "CLASS_x", Value: "bad", Role: "class"},
+		{Name: "CLASS_1_COLOR", Value: "1,2", Role: "classcolor"},
+		{Name: "CLASS_1_COLOR", Value: "1,2,300", Role: "classcolor"},
+	} {
+		if _, err := (&Metadata{GDAL: []GDALItem{it}}).Classes(); err == nil {
+			t.Errorf("Classes accepted %+v", it)
+		}
+	}
+	if c, err := (&Metadata{GDAL: []GDALItem{{Name: "CLASS_4_COLOR", Value: "1, 2, 3", Role: "classcolor"}}}).Classes(); err != nil || len(c) != 1 || *c[0].Color != (color.NRGBA{1, 2, 3, 255}) {
+		t.Errorf("Classes of an opaque color = %+v, %v", c, err)
+	}
+}
+
+func TestBakeOrientation(t *testing.T) {
+	g := newTestGray32(3, 2)
+	// shown maps the visual position of a pixel to its stored one, for
+	// each orientation.
+	shown := map[uint16]func(x, y int) (int, int){
+		OrientationTopLeft:     func(x, y int) (int, int) { return x, y },
+		OrientationTopRight:    func(x, y int) (int, int) { return 2 - x, y },
+		OrientationBottomRight: func(x, y int) (int, int) { return 2 - x, 1 - y },
+		OrientationBottomLeft:  func(x, y int) (int, int) { return x, 1 - y },
+		OrientationLeftTop:     func(x, y int) (int, int) { return y, x },
+		OrientationRightTop:    func(x, y int) (int, int) { return y, 1 - x },
+		OrientationRightBottom: func(x, y int) (int, int) { return 2 - y, 1 - x },
+		OrientationLeftBottom:  func(x, y int) (int, int) { return 2 - y, x },
+	}
+	for o, f := range shown {
+		md := &Metadata{Orientation: o, Software: "test"}
+		var buf bytes.Buffer
+		if err := EncodeWithMetadata(&buf, g, md, nil); err != nil {
+			t.Fatal(err)
+		}
+		m, got, err := DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Orientation != o {
+			t.Errorf("orientation %d: decoded Orientation %d", o, got.Orientation)
+		}
+		comparePix(t, m.(*Gray32).Pix, g.Pix)
+
+		buf.Reset()
+		e := &Encoder{BakeOrientation: true, VerifyRows: 2}
+		if err := e.EncodeWithMetadata(&buf, g, md); err != nil {
+			t.Fatal(err)
+		}
+		if md.Orientation != o {
+			t.Fatalf("orientation %d: Metadata modified", o)
+		}
+		m, got, err = DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Orientation != 0 || got.Software != "test" {
+			t.Errorf("orientation %d: baked file has Orientation %d, Software %q", o, got.Orientation, got.Software)
+		}
+		b := m.(*Gray32)
+		want := image.Rect(0, 0, 3, 2)
+		if o >= OrientationLeftTop {
+			want = image.Rect(0, 0, 2, 3)
+		}
+		if b.Rect != want {
+			t.Fatalf("orientation %d: baked bounds %v, want %v", o, b.Rect, want)
+		}
+		for y := 0; y < want.Dy(); y++ {
+			for x := 0; x < want.Dx(); x++ {
+				sx, sy := f(x, y)
+				if v, w := b.Pix[b.PixOffset(x, y)], g.Pix[g.PixOffset(sx, sy)]; v != w {
+					t.Errorf("orientation %d: pixel (%d, %d) = %#x, want %#x", o, x, y, v, w)
+				}
+			}
+		}
+	}
+	if err := EncodeWithMetadata(io.Discard, g, &Metadata{Orientation: 9}, nil); err == nil {
+		t.Error("invalid orientation: no error")
+	}
+}
+
+func TestNoDataFill(t *testing.T) {
+	nan := float32(math.NaN())
+	src := NewGrayFloat32(image.Rect(0, 0, 3, 1))
+	src.SetRow(0, []float32{1, nan, -9999})
+	noData := -9999.0
+	for _, tc := range []struct {
+		fill   NoDataFill
+		want   []float32
+		noData float64
+	}{
+		{FillNone, []float32{1, nan, -9999}, -9999},
+		{FillNaNWithNoData, []float32{1, -9999, -9999}, -9999},
+		{FillNoDataWithNaN, []float32{1, nan, nan}, math.NaN()},
+	} {
+		md := &Metadata{NoData: &noData}
+		var buf bytes.Buffer
+		e := &Encoder{NoDataFill: tc.fill, VerifyRows: 1}
+		if err := e.EncodeWithMetadata(&buf, src, md); err != nil {
+			t.Fatalf("fill %d: %v", tc.fill, err)
+		}
+		if *md.NoData != noData || !math.IsNaN(float64(math.Float32frombits(src.Pix[1]))) {
+			t.Fatalf("fill %d: source modified", tc.fill)
+		}
+		m, got, err := DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := m.(*GrayFloat32)
+		for i, w := range tc.want {
+			if v := math.Float32frombits(g.Pix[i]); v != w && !(v != v && w != w) {
+				t.Errorf("fill %d: sample %d = %g, want %g", tc.fill, i, v, w)
+			}
+		}
+		if v := *got.NoData; v != tc.noData && !(math.IsNaN(v) && math.IsNaN(tc.noData)) {
+			t.Errorf("fill %d: NoData %g, want %g", tc.fill, v, tc.noData)
+		}
+
+		// The bands of a stack are filled alike.
+		buf.Reset()
+		if err := e.StackBandsWithMetadata(&buf, []*GrayFloat32{src, src}, md); err != nil {
+			t.Fatalf("fill %d: %v", tc.fill, err)
+		}
+		b, err := ExtractBand(bytes.NewReader(buf.Bytes()), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range tc.want {
+			if v := math.Float32frombits(b.(*GrayFloat32).Pix[i]); v != w && !(v != v && w != w) {
+				t.Errorf("fill %d: band 1, sample %d = %g, want %g", tc.fill, i, v, w)
+			}
+		}
+	}
+	e := &Encoder{NoDataFill: FillNaNWithNoData}
+	if err := e.Encode(io.Discard, src); err == nil {
+		t.Error("filled NaN without a NoData value")
+	}
+	if err := e.Encode(io.Discard, newTestGray32(2, 2)); err != nil {
+		t.Errorf("32-bit integers: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics receives measurements from Readers, Encoders and Pipeline, for
+// example to export them to a monitoring system. The methods may be called
+// from several goroutines at once and should return quickly.
+type Metrics interface {
+	// BytesRead is called with the number of bytes read from a file.
+	BytesRead(n int64)
+	// BytesWritten is called with the number of bytes written to a file.
+	BytesWritten(n int64)
+	// BlockDecoded is called once for every strip or tile decoded.
+	BlockDecoded()
+	// Decompressed is called with the time spent decompressing a strip or
+	// tile.
+	Decompressed(d time.Duration)
+}
+
+// A meteredReaderAt reports the bytes read from r to m.
+type meteredReaderAt struct {
+	r io.ReaderAt
+	m Metrics
+}
+
+func (mr meteredReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := mr.r.ReadAt(p, off)
+	mr.m.BytesRead(int64(n))
+	return n, err
+}
+
+// A meteredWriter reports the bytes written to w to m.
+type meteredWriter struct {
+	w io.Writer
+	m Metrics
+}
+
+func (mw meteredWriter) Write(p []byte) (int, error) {
+	n, err := mw.w.Write(p)
+	mw.m.BytesWritten(int64(n))
+	return n, err
+}
+
+// CacheMetrics is implemented by a Metrics also counting the lookups of
+// caches: the files of a Pool and the chunks of a DiskCache.
+type CacheMetrics interface {
+	Metrics
+	// CacheLookup is called for every lookup of a cache, with whether what
+	// was looked for was found there.
+	CacheLookup(hit bool)
+}
+
+// cacheLookup reports a lookup to m if it is a CacheMetrics. m may be nil.
+func cacheLookup(m Metrics, hit bool) {
+	if cm, ok := m.(CacheMetrics); ok {
+		cm.CacheLookup(hit)
+	}
+}
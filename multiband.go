@@ -0,0 +1,178 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+// ExtractBand reads band band, counting from 0, of the image of r holding
+// several bands of gray samples, such as one written by StackBands or a
+// multispectral file of GDAL. The band is returned as the image of a
+// single band would be.
+func ExtractBand(r io.ReaderAt, band int) (image.Image, error) {
+	rd, err := NewReaderWithOptions(r, &ReaderOptions{Band: band})
+	if err != nil {
+		return nil, err
+	}
+	return rd.ReadRegion(rd.Bounds())
+}
+
+// StackBands writes imgs to w as the bands of a single image, in order,
+// using opt as for Encode. The images must have the same bounds.
+func StackBands(w io.Writer, imgs []*GrayFloat32, opt *tiff.Options) error {
+	e := &Encoder{Options: opt}
+	return e.StackBands(w, imgs)
+}
+
+// StackBands writes imgs to w as the bands of a single image of 32-bit
+// floating point samples, interleaved pixel by pixel. The bands past the
+// first are declared as extra samples of unspecified meaning, as GDAL
+// does, unless e.ExtraSamples declares them otherwise. The images must
+// have the same bounds, and neither LERC nor JPEG compression can be used.
+func (e *Encoder) StackBands(w io.Writer, imgs []*GrayFloat32) error {
+	return e.StackBandsWithMetadata(w, imgs, nil)
+}
+
+// StackBandsWithMetadata is like StackBands, but also stores md, which may
+// be nil, as EncodeWithMetadata does. The names and units of the bands can
+// be set with md.SetBand.
+func (e *Encoder) StackBandsWithMetadata(w io.Writer, imgs []*GrayFloat32, md *Metadata) error {
+	if len(imgs) == 0 {
+		return errors.New("tiff: StackBands given no images")
+	}
+	if e.LERC != nil || e.JPEG != nil {
+		return UnsupportedError{Feature: "LERC or JPEG compression of several bands"}
+	}
+	r := imgs[0].Rect
+	for i, m := range imgs {
+		if m.Rect != r {
+			return fmt.Errorf("tiff: band %d has bounds %v, not %v", i, m.Rect, r)
+		}
+		if err := checkPix(len(m.Pix), m.Stride, r.Dx(), r.Dy()); err != nil {
+			return err
+		}
+	}
+	if _, err := classicImageLen(r.Dx(), r.Dy(), 4*len(imgs)); err != nil {
+		return err
+	}
+	s := &bandStack{
+		pix:    make([]byte, 4*len(imgs)*r.Dx()*r.Dy()),
+		stride: 4 * len(imgs) * r.Dx(),
+		rect:   r,
+		bands:  len(imgs),
+	}
+	for y := 0; y < r.Dy(); y++ {
+		row := s.pix[y*s.stride:]
+		for b, m := range imgs {
+			for x, v := range m.Pix[y*m.Stride : y*m.Stride+r.Dx()] {
+				enc.PutUint32(row[4*(x*s.bands+b):], v)
+			}
+		}
+	}
+	return e.EncodeWithMetadata(w, s, md)
+}
+
+// A bandStack holds the interleaved samples of the bands of StackBands,
+// little-endian as they are written. It shows its first band as an image.
+type bandStack struct {
+	pix    []byte
+	stride int
+	rect   image.Rectangle
+	bands  int
+}
+
+func (s *bandStack) ColorModel() color.Model { return Gray32FloatModel }
+
+func (s *bandStack) Bounds() image.Rectangle { return s.rect }
+
+func (s *bandStack) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(s.rect)) {
+		return Gray32Color{}
+	}
+	i := (y-s.rect.Min.Y)*s.stride + (x-s.rect.Min.X)*4*s.bands
+	return Gray32Color{enc.Uint32(s.pix[i:])}
+}
+
+// ReadBands decodes the part of the image inside rect for each of bands,
+// indices of the bands of an image of several bands of gray samples, as
+// ReadRegion would with the Band option set to each in turn. Every block
+// is read and decompressed once, however many bands are asked for, and
+// only the samples of those bands are unpacked, so that a few bands of a
+// stack of many can be read without the memory or time the others take.
+// The images returned are in the order of bands.
+func (r *Reader) ReadBands(rect image.Rectangle, bands ...int) ([]image.Image, error) {
+	d := r.d
+	if len(bands) == 0 {
+		return nil, errors.New("tiff: ReadBands given no bands")
+	}
+	rect = rect.Intersect(r.Bounds())
+	set := &bandSet{rect: rect}
+	for _, b := range bands {
+		if n := d.grayBands(); b < 0 || b >= n {
+			return nil, fmt.Errorf("tiff: band %d requested from an image of %d bands", b, n)
+		}
+		bd := *d
+		bd.state = blockState{}
+		bd.band = b
+		if d.useRange && d.format == formatGray32 {
+			var err error
+			if bd.displayRange, err = bd.sampleRange(); err != nil {
+				return nil, err
+			}
+		}
+		m, err := bd.newImage(rect)
+		if err != nil {
+			return nil, err
+		}
+		set.decoders = append(set.decoders, &bd)
+		set.images = append(set.images, m)
+	}
+	if !rect.Empty() {
+		if err := d.readRegion(set); err != nil {
+			return nil, err
+		}
+	}
+	return set.images, nil
+}
+
+// A bandSet is the destination of ReadBands: an image for each band read,
+// with the decoder picking the band. It stands in for the images in
+// readRegion, which only needs its bounds.
+type bandSet struct {
+	rect     image.Rectangle
+	decoders []*decoder
+	images   []image.Image
+}
+
+func (s *bandSet) ColorModel() color.Model { return s.images[0].ColorModel() }
+
+func (s *bandSet) Bounds() image.Rectangle { return s.rect }
+
+func (s *bandSet) At(x, y int) color.Color { return s.images[0].At(x, y) }
+
+// unpack unpacks the rows of b held in buf, whose predictor has been
+// undone, into every image of s. Picking a band overwrites the samples of
+// the others, so all but the last band are picked from a copy.
+func (s *bandSet) unpack(buf []byte, b image.Rectangle) error {
+	var tmp []byte
+	for k, m := range s.images {
+		p := buf
+		if k < len(s.images)-1 {
+			tmp = append(tmp[:0], buf...)
+			p = tmp
+		}
+		if err := s.decoders[k].unpack(p, m, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
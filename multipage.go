@@ -0,0 +1,263 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+
+	"golang.org/x/image/tiff"
+)
+
+// A SubfileType classifies an image of a file holding several, as stored
+// in the NewSubfileType field. The flags may be combined; the zero value
+// is a full-resolution image.
+type SubfileType uint32
+
+const (
+	// SubfileReducedResolution marks a reduced-resolution version of
+	// another image in the file, such as an overview.
+	SubfileReducedResolution SubfileType = 1
+	// SubfilePage marks a single page of a multi-page image.
+	SubfilePage SubfileType = 2
+	// SubfileMask marks a transparency mask for another image in the file.
+	SubfileMask SubfileType = 4
+)
+
+// A Page is one of the images written by EncodeAll, with the options
+// particular to it.
+type Page struct {
+	Image image.Image
+	Type  SubfileType
+	// Metadata, if not nil, is stored with the image, as for
+	// EncodeWithMetadata.
+	Metadata *Metadata
+	// Options, if not nil, determines the encoding of the image in place
+	// of the options given to EncodeAll.
+	Options *tiff.Options
+	// TileWidth and TileHeight, if not zero, make the image be stored in
+	// tiles of that size in place of the tiles of the encoder, if any, or
+	// of a single strip. Both must be multiples of 16.
+	TileWidth, TileHeight int
+	// JPEG, if not nil, compresses the image with JPEG, in place of the
+	// compression of the options and of the LERC compression of the
+	// encoder. An *image.Gray is stored as 8-bit gray; any other image but
+	// a *Gray32 or *GrayFloat32, which JPEG cannot hold, is converted to
+	// 8-bit color stored as YCbCr. Images with transparency are refused.
+	JPEG *jpeg.Options
+	// Photometric, if not nil, is the PhotometricInterpretation stored in
+	// place of the one the encoder picks, such as PhotometricTransMask for
+	// a mask or PhotometricWhiteIsZero for a product whose low values are
+	// drawn light. The samples are written as they are. Images of a single
+	// sample may be given PhotometricWhiteIsZero, PhotometricBlackIsZero or
+	// PhotometricTransMask, color images only PhotometricRGB, and JPEG
+	// compressed images none.
+	Photometric *int
+
+	// tuned tells that Options were chosen by Encoder.AutoTune for a page
+	// sharing them, so that they are not tuned again, and floatPredictor
+	// that the predictor they enable is the floating point one.
+	tuned, floatPredictor bool
+}
+
+// EncodeAll writes the pages to w as separate images of one file, in order,
+// using opt as for Encode.
+func EncodeAll(w io.Writer, pages []Page, opt *tiff.Options) error {
+	e := &Encoder{Options: opt}
+	return e.EncodeAll(w, pages)
+}
+
+// EncodeAll writes the pages to w as separate images of one file, in order.
+// Every image carries a NewSubfileType field giving the Type of its page,
+// so that other software can tell pages, overviews and masks apart.
+//
+// Pages whose Type includes SubfilePage are numbered in order in their
+// PageNumber field, unless their Metadata gives a PageNumber already.
+func (e *Encoder) EncodeAll(w io.Writer, pages []Page) error {
+	if len(pages) == 0 {
+		return errors.New("tiff: EncodeAll given no pages")
+	}
+	if len(pages) > math.MaxUint16 {
+		return errors.New("tiff: EncodeAll given too many pages")
+	}
+	total := 0
+	for _, pg := range pages {
+		if pg.Type&SubfilePage != 0 {
+			total++
+		}
+	}
+	e.once.Do(e.init)
+	if e.Metrics != nil {
+		w = meteredWriter{w, e.Metrics}
+	}
+
+	// Each IFD immediately precedes the pixel data it describes, so that
+	// the offset of the next IFD is known when an IFD is written without
+	// holding more than one page in memory.
+	var ghost []byte
+	if e.GhostArea {
+		// A single IFD precedes all the data.
+		ghost = ghostArea(len(pages) == 1)
+	}
+	var header [8]byte
+	copy(header[:], leHeader)
+	enc.PutUint32(header[4:], uint32(8+len(ghost)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(ghost); err != nil {
+		return err
+	}
+	off := int64(8 + len(ghost))
+	ep := e.getEntries()
+	defer e.putEntries(ep)
+	n := 0
+	for i, pg := range pages {
+		p, err := e.preparePage(pg)
+		if err != nil {
+			return err
+		}
+		if pg.Type&SubfilePage != 0 {
+			if pg.Metadata == nil || pg.Metadata.PageNumber == nil {
+				p.layout.extra = append(p.layout.extra,
+					ifdEntry{TagPageNumber, TypeShort, []uint32{uint32(n), uint32(total)}})
+			}
+			n++
+		}
+		p.layout.subfile, p.layout.subfileType = true, pg.Type
+		// The block offsets are filled in once the size of the IFD is
+		// known; the IFD entry shares the slice.
+		ifd := p.layout.appendEntries((*ep)[:0])
+		*ep = ifd
+
+		// IFDs must start on a word boundary (p. 15), so the IFD and the
+		// pixel data are padded to an even length.
+		dataOff := off + int64(ifdSize(ifd)+ifdSize(ifd)%2)
+		end := p.setOffset(dataOff, e.blockAlign(), e.GhostArea)
+		next := int64(0)
+		if i < len(pages)-1 {
+			next = end + end%2
+		}
+		if end > math.MaxUint32 {
+			return UnsupportedError{Feature: "file too large for a classic TIFF file"}
+		}
+
+		if err := writeIFD(w, int(off), ifd, int(next)); err != nil {
+			return err
+		}
+		if err := writePad(w, ifdSize(ifd)); err != nil {
+			return err
+		}
+		if err := e.writePix(w, w, p, dataOff); err != nil {
+			return err
+		}
+		if err := writePad(w, int(end)); err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// writePad writes the byte needed to bring a block of n bytes to an even
+// length.
+func writePad(w io.Writer, n int) error {
+	if n%2 == 0 {
+		return nil
+	}
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// Photometric returns the PhotometricInterpretation of the image, which
+// tells how its samples are to be shown.
+func (r *Reader) Photometric() int {
+	return int(r.d.firstVal(TagPhotometricInterpretation))
+}
+
+// ExtraSamples returns the ExtraSamples field of the image, telling what
+// each sample of a pixel past those of its color space stands for, such as
+// ExtraSamplesAssociatedAlpha, or nil if it has none.
+func (r *Reader) ExtraSamples() []uint16 {
+	v := r.d.features[TagExtraSamples]
+	if len(v) == 0 {
+		return nil
+	}
+	es := make([]uint16, len(v))
+	for i, x := range v {
+		es[i] = uint16(x)
+	}
+	return es
+}
+
+// SampleEndianness returns the byte order of the samples in the file. The
+// images decoded hold native values whatever it is, so it only matters to
+// code handling the stored bytes itself.
+func (r *Reader) SampleEndianness() binary.ByteOrder {
+	return r.d.byteOrder
+}
+
+// SubfileType returns the classification of the image, from its
+// NewSubfileType field.
+func (r *Reader) SubfileType() SubfileType {
+	return SubfileType(r.d.firstVal(TagNewSubfileType))
+}
+
+// A LazyPage is an image of a multi-page file, as returned by DecodeAll,
+// whose IFD is parsed but whose pixels are only decoded on demand.
+type LazyPage struct {
+	Index  int          // The index of the image in the file.
+	Config image.Config // The color model and dimensions of the image.
+	Type   SubfileType  // From the NewSubfileType field of the image.
+	r      *Reader
+}
+
+// DecodeAll returns the images of the TIFF file in r, in order, read
+// applying opt, which may be nil, save for its Image. Only their IFDs are
+// parsed; the pixels of each are decoded when its Decode method is called,
+// so that files holding hundreds of large pages need not fit in memory.
+// The pages include reduced-resolution images and masks, which their Type
+// tells apart.
+func DecodeAll(r io.ReaderAt, opt *ReaderOptions) ([]*LazyPage, error) {
+	first, err := NewReaderWithOptions(r, opt)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := first.d.ifdChain()
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]*LazyPage, len(chain))
+	for i, off := range chain {
+		pr, err := openReaderAt(r, opt, off)
+		if err != nil {
+			return nil, err
+		}
+		pages[i] = &LazyPage{Index: i, Config: pr.Config(), Type: pr.SubfileType(), r: pr}
+	}
+	return pages, nil
+}
+
+// Decode decodes the whole image. Nothing of it is kept once returned, so
+// that decoding the pages one after the other holds a single one in
+// memory. Decode may be called concurrently, even for the same page.
+func (p *LazyPage) Decode() (image.Image, error) {
+	r := p.r.Clone()
+	return r.ReadRegion(r.Bounds())
+}
+
+// Metadata returns the metadata of the image, as Reader.Metadata does.
+func (p *LazyPage) Metadata() (*Metadata, error) {
+	return p.r.Clone().Metadata()
+}
+
+// Reader returns a new Reader of the image, for reading parts of it.
+func (p *LazyPage) Reader() *Reader {
+	return p.r.Clone()
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+)
+
+// bakeOrientation returns m with its pixels reordered as md.Orientation
+// says they are to be shown, and a copy of md without the Orientation, if
+// e.BakeOrientation is set; m and md are returned as they are otherwise.
+func (e *Encoder) bakeOrientation(m image.Image, md *Metadata) (image.Image, *Metadata, error) {
+	if !e.BakeOrientation || md == nil || md.Orientation == 0 {
+		return m, md, nil
+	}
+	o := md.Orientation
+	if o > OrientationLeftBottom {
+		return nil, nil, fmt.Errorf("tiff: invalid orientation %d", o)
+	}
+	oriented, err := orient(m, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	baked := *md
+	baked.Orientation = 0
+	return oriented, &baked, nil
+}
+
+// orient returns a copy of m, with bounds at the origin, whose pixels are
+// those of m in the order they are shown in for the Orientation o.
+func orient(m image.Image, o uint16) (image.Image, error) {
+	r := m.Bounds()
+	switch m := m.(type) {
+	case *Gray32:
+		pix, stride, size := orientPix(m.Pix, m.Stride, 1, r, o)
+		return &Gray32{Pix: pix, Stride: stride, Rect: image.Rectangle{Max: size}, Range: m.Range, Palette: m.Palette}, nil
+	case *GrayFloat32:
+		pix, stride, size := orientPix(m.Pix, m.Stride, 1, r, o)
+		return &GrayFloat32{Pix: pix, Stride: stride, Rect: image.Rectangle{Max: size}, Range: m.Range}, nil
+	case *image.Gray:
+		pix, stride, size := orientPix(m.Pix, m.Stride, 1, r, o)
+		return &image.Gray{Pix: pix, Stride: stride, Rect: image.Rectangle{Max: size}}, nil
+	case *image.RGBA:
+		pix, stride, size := orientPix(m.Pix, m.Stride, 4, r, o)
+		return &image.RGBA{Pix: pix, Stride: stride, Rect: image.Rectangle{Max: size}}, nil
+	case *image.NRGBA:
+		pix, stride, size := orientPix(m.Pix, m.Stride, 4, r, o)
+		return &image.NRGBA{Pix: pix, Stride: stride, Rect: image.Rectangle{Max: size}}, nil
+	case *image.RGBA64:
+		pix, stride, size := orientPix(m.Pix, m.Stride, 8, r, o)
+		return &image.RGBA64{Pix: pix, Stride: stride, Rect: image.Rectangle{Max: size}}, nil
+	case *image.NRGBA64:
+		pix, stride, size := orientPix(m.Pix, m.Stride, 8, r, o)
+		return &image.NRGBA64{Pix: pix, Stride: stride, Rect: image.Rectangle{Max: size}}, nil
+	case *bandStack:
+		pix, stride, size := orientPix(m.pix, m.stride, 4*m.bands, r, o)
+		return &bandStack{pix: pix, stride: stride, rect: image.Rectangle{Max: size}, bands: m.bands}, nil
+	}
+	return nil, UnsupportedError{Feature: fmt.Sprintf("reorienting a %T", m)}
+}
+
+// orientPix copies the pixels of n elements each of the image of bounds r
+// held in pix, with stride elements between rows, into the order they are
+// shown in for the Orientation o. It returns the new pixels, their stride
+// and the size of the image shown, transposed for orientations from
+// OrientationLeftTop on.
+func orientPix[T any](pix []T, stride, n int, r image.Rectangle, o uint16) ([]T, int, image.Point) {
+	w, h := r.Dx(), r.Dy()
+	size := image.Point{w, h}
+	transpose := o >= OrientationLeftTop
+	if transpose {
+		size = image.Point{h, w}
+	}
+	// Whether the columns and rows of the stored image run backwards
+	// across the visual one.
+	var flipX, flipY bool
+	switch o {
+	case OrientationTopRight, OrientationLeftBottom:
+		flipX = true
+	case OrientationBottomLeft, OrientationRightTop:
+		flipY = true
+	case OrientationBottomRight, OrientationRightBottom:
+		flipX, flipY = true, true
+	}
+	dstStride := size.X * n
+	dst := make([]T, dstStride*size.Y)
+	for y := 0; y < h; y++ {
+		row := pix[y*stride:]
+		for x := 0; x < w; x++ {
+			sx, sy := x, y
+			if flipX {
+				sx = w - 1 - x
+			}
+			if flipY {
+				sy = h - 1 - y
+			}
+			if transpose {
+				sx, sy = sy, sx
+			}
+			copy(dst[sy*dstStride+sx*n:][:n], row[x*n:][:n])
+		}
+	}
+	return dst, dstStride, size
+}
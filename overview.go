@@ -0,0 +1,521 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"golang.org/x/image/tiff"
+)
+
+// A Resampling is a way of computing the pixels of an image from those of
+// another on a different grid, such as an overview from the
+// full-resolution image.
+type Resampling int
+
+const (
+	// ResampleAverage takes the mean of the pixels covered by each pixel of
+	// the overview, leaving out NoData samples and NaN.
+	ResampleAverage Resampling = iota
+	// ResampleNearest takes the pixel nearest to the center of each pixel
+	// of the overview. Paletted images are always resampled so.
+	ResampleNearest
+)
+
+// A ReadWriterAt is a file open for reading and writing at any offset, such
+// as an *os.File.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// RegenerateOverviews recomputes the overviews of the images of the file in
+// f from their pixels, as is needed once the full-resolution pixels have
+// been edited, and rewrites them in place. The overviews of an image are
+// the images following it marked SubfileReducedResolution, as written by
+// GDAL or by EncodeAll.
+//
+// The overviews keep their size and the way they are stored, which must be
+// uncompressed or Deflate compressed. Their new data is appended to the
+// file, the offsets and byte counts of their strips or tiles are patched
+// to point to it, and their checksums of TagBlockChecksums, if any, to
+// match it; nothing else is changed, so the space taken by their old data
+// is lost. Only little-endian files with samples of 8, 16 or 32 bits are
+// supported.
+func RegenerateOverviews(f ReadWriterAt, resampling Resampling) error {
+	d, err := newDecoder(f, nil)
+	if err != nil {
+		return err
+	}
+	if d.byteOrder != binary.ByteOrder(binary.LittleEndian) {
+		return UnsupportedError{Feature: "rewriting a big-endian file"}
+	}
+	chain, err := d.ifdChain()
+	if err != nil {
+		return err
+	}
+	end, err := readerSize(f)
+	if err != nil {
+		return err
+	}
+	end += end % 2
+
+	var base *decoder // The full-resolution image.
+	var src []byte    // Its samples, once read.
+	for i := range chain {
+		if i > 0 {
+			if d, err = newDecoder(f, &ReaderOptions{Image: i}); err != nil {
+				return err
+			}
+		}
+		if SubfileType(d.firstVal(TagNewSubfileType))&SubfileReducedResolution == 0 {
+			base, src = d, nil
+			continue
+		}
+		if base == nil {
+			continue
+		}
+		if src == nil {
+			if src, err = base.overviewSource(); err != nil {
+				return err
+			}
+		}
+		if err := d.parseLayout(); err != nil {
+			return err
+		}
+		if d.samplesPerPixel != base.samplesPerPixel || d.bitsPerSample != base.bitsPerSample ||
+			d.sampleFormat != base.sampleFormat || d.format != base.format {
+			return FormatError(fmt.Sprintf("overview %d does not match the samples of its image", i))
+		}
+		compression := d.firstVal(TagCompression)
+		if compression != 0 && compression != CompressionNone && compression != CompressionDeflate {
+			return UnsupportedError{"rewriting overviews with compression", TagCompression, compression}
+		}
+		method := resampling
+		if d.format == formatPaletted || d.format == formatPaletted16 {
+			method = ResampleNearest
+		}
+		raw, err := base.resample(src, d.config.Width, d.config.Height, method)
+		if err != nil {
+			return err
+		}
+		tw, th := d.blockWidth, d.blockHeight
+		data, counts, err := d.encodeBlocks(raw, d.config.Width, d.config.Height, uint32(max(compression, CompressionNone)),
+			uint32(d.firstVal(TagPredictor)), d.blockPadding, tw, th)
+		if err != nil {
+			return err
+		}
+		if len(counts) != d.blocksAcross*d.blocksDown {
+			return InternalError("overview blocks miscounted")
+		}
+		if uint64(end)+uint64(data.Len()) > math.MaxUint32 {
+			return UnsupportedError{Feature: "file too large for a classic TIFF file"}
+		}
+		offsets := make([]uint32, len(counts))
+		pos := uint32(end)
+		for k, n := range counts {
+			offsets[k] = pos
+			pos += n
+		}
+		if _, err := f.WriteAt(data.Bytes(), end); err != nil {
+			return err
+		}
+		end = int64(pos) + int64(pos%2)
+
+		offsetsTag, countsTag := TagStripOffsets, TagStripByteCounts
+		if d.blockPadding {
+			offsetsTag, countsTag = TagTileOffsets, TagTileByteCounts
+		}
+		if err := patchEntry(f, chain[i], offsetsTag, offsets); err != nil {
+			return err
+		}
+		if err := patchEntry(f, chain[i], countsTag, counts); err != nil {
+			return err
+		}
+		if _, ok := d.ifd[TagBlockChecksums]; ok {
+			sums := blockChecksumsEntry(data.Bytes(), counts)
+			if err := patchEntry(f, chain[i], sums.tag, sums.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// overviewSource checks that the overviews of the image can be computed
+// and returns its samples.
+func (d *decoder) overviewSource() ([]byte, error) {
+	if err := d.parseLayout(); err != nil {
+		return nil, err
+	}
+	switch {
+	case d.bitsPerSample != 8 && d.bitsPerSample != 16 && d.bitsPerSample != 32:
+		return nil, UnsupportedError{"rewriting overviews with BitsPerSample", TagBitsPerSample, uint(d.bitsPerSample)}
+	case d.format == formatYCbCr && (d.subsampleX != 1 || d.subsampleY != 1):
+		return nil, UnsupportedError{Feature: "rewriting overviews of subsampled YCbCr"}
+	}
+	return d.littleEndianSamples()
+}
+
+// resample computes the samples of a w×h overview from src, the samples of
+// the image.
+func (d *decoder) resample(src []byte, w, h int, method Resampling) ([]byte, error) {
+	sw, sh := d.config.Width, d.config.Height
+	spp, size := d.samplesPerPixel, d.bitsPerSample/8
+	pixBytes := spp * size
+	srcRow := sw * pixBytes
+	out := make([]byte, w*h*pixBytes)
+	if method == ResampleNearest {
+		for y := 0; y < h; y++ {
+			sy := (2*y + 1) * sh / (2 * h)
+			for x := 0; x < w; x++ {
+				sx := (2*x + 1) * sw / (2 * w)
+				copy(out[(y*w+x)*pixBytes:][:pixBytes], src[sy*srcRow+sx*pixBytes:])
+			}
+		}
+		return out, nil
+	}
+
+	noData, err := d.noData()
+	if err != nil {
+		return nil, err
+	}
+	sample := func(p []byte) float64 {
+		switch {
+		case d.sampleFormat == SampleFormatIEEEFP:
+			return float64(math.Float32frombits(enc.Uint32(p)))
+		case d.sampleFormat == SampleFormatInt && size == 2:
+			return float64(int16(enc.Uint16(p)))
+		case d.sampleFormat == SampleFormatInt:
+			return float64(int32(enc.Uint32(p)))
+		case size == 1:
+			return float64(p[0])
+		case size == 2:
+			return float64(enc.Uint16(p))
+		}
+		return float64(enc.Uint32(p))
+	}
+	put := func(p []byte, v float64) {
+		if d.sampleFormat == SampleFormatIEEEFP {
+			enc.PutUint32(p, math.Float32bits(float32(v)))
+			return
+		}
+		// The mean of integers is within their range.
+		v = math.Round(v)
+		switch size {
+		case 1:
+			p[0] = byte(v)
+		case 2:
+			enc.PutUint16(p, uint16(int64(v)))
+		default:
+			enc.PutUint32(p, uint32(int64(v)))
+		}
+	}
+	empty := math.NaN()
+	if noData != nil {
+		empty = *noData
+	}
+	sums := make([]float64, spp)
+	counts := make([]int, spp)
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := max((y+1)*sh/h, y0+1)
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := max((x+1)*sw/w, x0+1)
+			clear(sums)
+			clear(counts)
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					p := src[sy*srcRow+sx*pixBytes:]
+					for c := 0; c < spp; c++ {
+						v := sample(p[c*size:])
+						if math.IsNaN(v) || noData != nil && v == *noData {
+							continue
+						}
+						sums[c] += v
+						counts[c]++
+					}
+				}
+			}
+			p := out[(y*w+x)*pixBytes:]
+			for c := 0; c < spp; c++ {
+				v := empty
+				if counts[c] > 0 {
+					v = sums[c] / float64(counts[c])
+				}
+				put(p[c*size:], v)
+			}
+		}
+	}
+	return out, nil
+}
+
+// patchEntry overwrites the values of the field with the given tag in the
+// little-endian IFD at off with v, which must have as many values. The
+// field is of the SHORT, LONG or UNDEFINED type.
+func patchEntry(f ReadWriterAt, off int64, tag int, v []uint32) error {
+	entries, _, err := readRawIFD(f, binary.LittleEndian, off)
+	if err != nil {
+		return err
+	}
+	for k, e := range entries {
+		if e.tag != tag {
+			continue
+		}
+		if len(e.data) != len(v) {
+			return FormatError(fmt.Sprintf("field %d holds %d values, not %d", tag, len(e.data), len(v)))
+		}
+		if e.datatype == TypeShort {
+			for _, x := range v {
+				if x > math.MaxUint16 {
+					return UnsupportedError{Feature: fmt.Sprintf("value %d in the SHORT field %d", x, tag)}
+				}
+			}
+		} else if e.datatype != TypeLong && e.datatype != TypeUndefined {
+			return UnsupportedError{"IFD entry datatype", tag, uint(e.datatype)}
+		}
+		e.data = v
+		p := make([]byte, max(e.dataLen(), 4))
+		e.putData(p)
+		pos := off + 2 + int64(ifdLen*k) + 8
+		if e.dataLen() > 4 {
+			var b [4]byte
+			if _, err := f.ReadAt(b[:], pos); err != nil {
+				return err
+			}
+			pos = int64(enc.Uint32(b[:]))
+		}
+		_, err := f.WriteAt(p, pos)
+		return err
+	}
+	return FormatError(fmt.Sprintf("missing field %d", tag))
+}
+
+// OverviewFileName returns the name of the external overview file of the
+// TIFF file of the given name, as GDAL names it.
+func OverviewFileName(name string) string {
+	return name + ".ovr"
+}
+
+// OverviewOptions are the parameters of EncodeOverviews.
+type OverviewOptions struct {
+	// Levels are the factors by which the image is reduced in each
+	// overview, all at least 2. If empty, the image is halved until it
+	// fits in 256×256 pixels.
+	Levels []int
+	// Resampling is the way the pixels of the overviews are computed.
+	Resampling Resampling
+	// Options gives the compression and predictor of the overviews, as
+	// for Encode. If nil, the pixels are stored uncompressed.
+	Options *tiff.Options
+	// TileWidth and TileHeight, if not zero, make the overviews be stored
+	// in tiles of that size instead of in a single strip. Both must be
+	// multiples of 16.
+	TileWidth, TileHeight int
+}
+
+// overviewTags are the fields describing the samples of an image that
+// EncodeOverviews copies to its overviews.
+var overviewTags = map[int]bool{
+	TagBitsPerSample:             true,
+	TagPhotometricInterpretation: true,
+	TagSamplesPerPixel:           true,
+	TagPlanarConfiguration:       true,
+	TagColorMap:                  true,
+	TagExtraSamples:              true,
+	TagSampleFormat:              true,
+	TagYCbCrCoefficients:         true,
+	TagYCbCrSubSampling:          true,
+	TagYCbCrPositioning:          true,
+	TagGDALNoData:                true,
+}
+
+// EncodeOverviews writes to w an external overview file for the first
+// image of the TIFF file in src, for when that file must be left as it is.
+// The overview file is a TIFF file of reduced-resolution versions of the
+// image, largest first, as GDAL reads them from the file named by
+// OverviewFileName next to the image. Each is the size of the image
+// divided by its level, rounded up. opt may be nil.
+//
+// As for RegenerateOverviews, the samples of the image must be of 8, 16
+// or 32 bits; those of big-endian files are made little-endian.
+func EncodeOverviews(w io.Writer, src io.ReaderAt, opt *OverviewOptions) error {
+	var o OverviewOptions
+	if opt != nil {
+		o = *opt
+	}
+	compression, predictor, err := encodingOptions(o.Options)
+	if err != nil {
+		return err
+	}
+	if o.TileWidth != 0 || o.TileHeight != 0 {
+		if err := checkTileSize(o.TileWidth, o.TileHeight); err != nil {
+			return err
+		}
+	}
+	d, err := newDecoder(src, nil)
+	if err != nil {
+		return err
+	}
+	samples, err := d.overviewSource()
+	if err != nil {
+		return err
+	}
+	dx, dy := d.config.Width, d.config.Height
+	levels := o.Levels
+	if len(levels) == 0 {
+		for f := 2; ; f *= 2 {
+			levels = append(levels, f)
+			if (dx+f-1)/f <= 256 && (dy+f-1)/f <= 256 {
+				break
+			}
+		}
+	}
+	for _, f := range levels {
+		if f < 2 {
+			return fmt.Errorf("tiff: invalid overview level %d", f)
+		}
+	}
+	method := o.Resampling
+	if d.format == formatPaletted || d.format == formatPaletted16 {
+		method = ResampleNearest
+	}
+	fields, _, err := readRawIFD(src, d.byteOrder, d.imageIFD)
+	if err != nil {
+		return err
+	}
+	var kept []ifdEntry
+	for _, e := range fields {
+		if overviewTags[e.tag] {
+			kept = append(kept, e)
+		}
+	}
+
+	// As in EncodeAll, each IFD precedes the pixel data it describes.
+	var header [8]byte
+	copy(header[:], leHeader)
+	enc.PutUint32(header[4:], 8)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	off := int64(8)
+	for k, f := range levels {
+		ow, oh := (dx+f-1)/f, (dy+f-1)/f
+		raw, err := d.resample(samples, ow, oh, method)
+		if err != nil {
+			return err
+		}
+		tw, th := o.TileWidth, o.TileHeight
+		if tw <= 0 {
+			tw, th = ow, oh
+		}
+		data, counts, err := d.encodeBlocks(raw, ow, oh, compression, predictorValue(predictor), o.TileWidth > 0, tw, th)
+		if err != nil {
+			return err
+		}
+		offsets := make([]uint32, len(counts))
+		ifd := append([]ifdEntry{
+			{TagNewSubfileType, TypeLong, []uint32{uint32(SubfileReducedResolution)}},
+			{TagImageWidth, shortOrLong(ow), []uint32{uint32(ow)}},
+			{TagImageLength, shortOrLong(oh), []uint32{uint32(oh)}},
+		}, kept...)
+		ifd = appendStorage(ifd, compression, predictor, oh, o.TileWidth, o.TileHeight, offsets, counts)
+
+		size := ifdSize(ifd)
+		dataOff, dataLen := off+int64(size+size%2), data.Len()
+		next := int64(0)
+		if k < len(levels)-1 {
+			next = dataOff + int64(dataLen+dataLen%2)
+		}
+		if uint64(dataOff)+uint64(dataLen) > math.MaxUint32 {
+			return UnsupportedError{Feature: "file too large for a classic TIFF file"}
+		}
+		pos := uint32(dataOff)
+		for j, n := range counts {
+			offsets[j] = pos
+			pos += n
+		}
+		if err := writeIFD(w, int(off), ifd, int(next)); err != nil {
+			return err
+		}
+		if err := writePad(w, size); err != nil {
+			return err
+		}
+		if _, err := data.WriteTo(w); err != nil {
+			return err
+		}
+		if err := writePad(w, dataLen); err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// Overviews returns readers of the overviews of the first image of the
+// TIFF file in src, largest first: the images marked
+// SubfileReducedResolution following it in src and, if ovr is not nil,
+// the images of its external overview file in ovr.
+func Overviews(src, ovr io.ReaderAt) ([]*Reader, error) {
+	return findOverviews(src, ovr, nil)
+}
+
+// findOverviews is Overviews with the readers applying opt, which may be
+// nil, save for its Image.
+func findOverviews(src, ovr io.ReaderAt, opt *ReaderOptions) ([]*Reader, error) {
+	d, err := newDecoder(src, imageOptions(opt, 0))
+	if err != nil {
+		return nil, err
+	}
+	chain, err := d.ifdChain()
+	if err != nil {
+		return nil, err
+	}
+	var overviews []*Reader
+	for i := 1; i < len(chain); i++ {
+		r, err := NewReaderWithOptions(src, imageOptions(opt, i))
+		if err != nil {
+			return nil, err
+		}
+		if r.SubfileType()&SubfileReducedResolution == 0 {
+			break
+		}
+		overviews = append(overviews, r)
+	}
+	if ovr != nil {
+		if d, err = newDecoder(ovr, imageOptions(opt, 0)); err != nil {
+			return nil, err
+		}
+		if chain, err = d.ifdChain(); err != nil {
+			return nil, err
+		}
+		for i := range chain {
+			r, err := NewReaderWithOptions(ovr, imageOptions(opt, i))
+			if err != nil {
+				return nil, err
+			}
+			overviews = append(overviews, r)
+		}
+	}
+	sort.SliceStable(overviews, func(a, b int) bool {
+		return overviews[a].d.config.Width > overviews[b].d.config.Width
+	})
+	return overviews, nil
+}
+
+// imageOptions returns a copy of opt, which may be nil, choosing image i.
+func imageOptions(opt *ReaderOptions, i int) *ReaderOptions {
+	var o ReaderOptions
+	if opt != nil {
+		o = *opt
+	}
+	o.Image = i
+	return &o
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// maxPaletteLen is the number of colors of the ColorMap of 16-bit indices.
+const maxPaletteLen = 1 << 16
+
+// setPalette lays out m, a *Gray32 with a Palette, as an image of 16-bit
+// indices whose ColorMap holds the palette, padded with black to the
+// 65536 colors that 16 bits address.
+func (p *page) setPalette(m *Gray32) error {
+	l := &p.layout
+	dx, dy := l.width, l.height
+	if len(m.Palette) > maxPaletteLen {
+		return fmt.Errorf("tiff: palette of %d colors, more than %d", len(m.Palette), maxPaletteLen)
+	}
+	if err := checkPix(len(m.Pix), m.Stride, dx, dy); err != nil {
+		return err
+	}
+	pix8 := make([]byte, 2*dx*dy)
+	for y := 0; y < dy; y++ {
+		for x, v := range m.Pix[y*m.Stride : y*m.Stride+dx] {
+			if uint64(v) >= uint64(len(m.Palette)) {
+				return fmt.Errorf("tiff: sample %d at (%d, %d) beyond the palette of %d colors", v, m.Rect.Min.X+x, m.Rect.Min.Y+y, len(m.Palette))
+			}
+			// Kept big-endian, as in an image.Gray16.
+			i := 2 * (y*dx + x)
+			pix8[i], pix8[i+1] = byte(v>>8), byte(v)
+		}
+	}
+	p.pix8, p.stride, p.pixBytes, p.sample16 = pix8, 2*dx, 2, true
+
+	// The ColorMap holds all the red values, then the green, then the
+	// blue (p. 23). It has no alpha, so the colors are written opaque.
+	l.colorMap = make([]uint32, 3*maxPaletteLen)
+	for i, c := range m.Palette {
+		var n color.NRGBA64
+		if k, ok := c.(color.NRGBA); ok {
+			// Taken as it is, rather than through premultiplied values.
+			n = color.NRGBA64{uint16(k.R) * 0x101, uint16(k.G) * 0x101, uint16(k.B) * 0x101, 0xffff}
+		} else {
+			n = color.NRGBA64Model.Convert(c).(color.NRGBA64)
+		}
+		l.colorMap[i], l.colorMap[i+maxPaletteLen], l.colorMap[i+2*maxPaletteLen] = uint32(n.R), uint32(n.G), uint32(n.B)
+	}
+	l.bitsPerSample = []uint32{16}
+	l.photometric = PhotometricPaletted
+	return nil
+}
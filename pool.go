@@ -0,0 +1,54 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Row, strip and compression buffers are taken from a set of pools, one per
+// power-of-two size class, so that encoding many images of similar size does
+// not allocate fresh buffers on every call.
+const (
+	minBufferClass = 10 // 1KB, the smallest pooled capacity.
+	maxBufferClass = 30 // 1GB; larger buffers are allocated and dropped.
+)
+
+var bufferPools [maxBufferClass + 1]sync.Pool
+
+// bufferClass returns the size class of a buffer holding n bytes, that is
+// the smallest c such that 1<<c >= n.
+func bufferClass(n int) int {
+	if n <= 1<<minBufferClass {
+		return minBufferClass
+	}
+	return bits.Len(uint(n - 1))
+}
+
+// getBuffer returns a buffer of length n. The contents are undefined.
+// The buffer should be handed back with putBuffer once it is no longer used.
+func getBuffer(n int) *[]byte {
+	c := bufferClass(n)
+	if c > maxBufferClass {
+		b := make([]byte, n)
+		return &b
+	}
+	if p, ok := bufferPools[c].Get().(*[]byte); ok {
+		*p = (*p)[:n]
+		return p
+	}
+	b := make([]byte, n, 1<<c)
+	return &b
+}
+
+// putBuffer returns a buffer obtained from getBuffer to its pool.
+func putBuffer(p *[]byte) {
+	c := bufferClass(cap(*p))
+	if c > maxBufferClass || cap(*p) != 1<<c {
+		return
+	}
+	bufferPools[c].Put(p)
+}
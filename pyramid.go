@@ -0,0 +1,96 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"io"
+	"sort"
+)
+
+// maxSubIFDs limits the number of SubIFDs of an image.
+const maxSubIFDs = 64
+
+// A Pyramid is an image along with its overviews, wherever they are
+// stored: as images marked SubfileReducedResolution following it in the
+// file, as SubIFDs of the image or in an external overview file. Its
+// levels are ordered by decreasing width, the image itself first, so that
+// rendering code can pick one without caring where it is stored.
+type Pyramid struct {
+	levels []*Reader
+}
+
+// NewPyramid returns the pyramid of the first image of the TIFF file in r.
+// ovr, if not nil, holds the external overview file of r, as written by
+// EncodeOverviews. The readers of all levels apply opt, which may be nil,
+// save for its Image.
+func NewPyramid(r, ovr io.ReaderAt, opt *ReaderOptions) (*Pyramid, error) {
+	base, err := NewReaderWithOptions(r, imageOptions(opt, 0))
+	if err != nil {
+		return nil, err
+	}
+	subs, err := base.d.subIFDs()
+	if err != nil {
+		return nil, err
+	}
+	var overviews []*Reader
+	for _, off := range subs {
+		sub, err := openReaderAt(r, imageOptions(opt, 0), off)
+		if err != nil {
+			return nil, err
+		}
+		// SubIFDs also hold masks and, in DNG files, the full image.
+		if sub.SubfileType()&SubfileReducedResolution != 0 {
+			overviews = append(overviews, sub)
+		}
+	}
+	more, err := findOverviews(r, ovr, opt)
+	if err != nil {
+		return nil, err
+	}
+	overviews = append(overviews, more...)
+	sort.SliceStable(overviews, func(a, b int) bool {
+		return overviews[a].d.config.Width > overviews[b].d.config.Width
+	})
+	return &Pyramid{append([]*Reader{base}, overviews...)}, nil
+}
+
+// LevelCount returns the number of levels of the pyramid, at least 1.
+func (p *Pyramid) LevelCount() int { return len(p.levels) }
+
+// Level returns the reader of level i, which is 0 for the image and
+// increases as the resolution decreases.
+func (p *Pyramid) Level(i int) *Reader { return p.levels[i] }
+
+// BestLevelFor returns the level to read to draw the image at the given
+// scale, the ratio of the size drawn to that of the image: the smallest
+// level at least that large, so that no level has to be enlarged. It is 0
+// for scales of 1 or more.
+func (p *Pyramid) BestLevelFor(scale float64) int {
+	want := scale * float64(p.levels[0].d.config.Width)
+	best := 0
+	for i, l := range p.levels {
+		if float64(l.d.config.Width) >= want {
+			best = i
+		}
+	}
+	return best
+}
+
+// subIFDs returns the offsets of the SubIFDs of the image.
+func (d *decoder) subIFDs() ([]int64, error) {
+	p, ok := d.ifd[TagSubIFDs]
+	if !ok {
+		return nil, nil
+	}
+	u, err := d.ifdUint(p[:], maxSubIFDs)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, len(u))
+	for i, v := range u {
+		offsets[i] = int64(v)
+	}
+	return offsets, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+)
+
+// Quantization describes floating point values stored as signed integers
+// to save space, each value being sample*Scale + Offset. It is recorded as
+// the scale and offset of the first band in the GDAL_METADATA field, as GDAL
+// does.
+//
+// A *GrayFloat32 encoded with metadata holding a Quantization is stored with
+// Bits-bit signed samples, rounded to the nearest step of Scale and clamped
+// to the range of the samples. NaN values are stored as the NoData value of
+// the metadata, or if there is none, as the most negative sample value,
+// which is then recorded as the NoData value. Other images are written as
+// usual, with the Quantization recorded as it is.
+//
+// Images with signed integer samples, for which the package has no image
+// type, are decoded into a *GrayFloat32 holding the values they stand for,
+// with NaN in place of the NoData value.
+type Quantization struct {
+	Scale, Offset float64
+	// Bits is the size of the stored samples: 16 or 32. On decoding, it is
+	// that of the samples of the file.
+	Bits int
+}
+
+// check reports an error if q cannot be used to encode an image.
+func (q *Quantization) check() error {
+	if q.Bits != 16 && q.Bits != 32 {
+		return fmt.Errorf("tiff: cannot quantize to %d-bit samples", q.Bits)
+	}
+	if q.Scale == 0 || math.IsInf(q.Scale, 0) || math.IsNaN(q.Scale) || math.IsInf(q.Offset, 0) || math.IsNaN(q.Offset) {
+		return fmt.Errorf("tiff: invalid quantization scale %g and offset %g", q.Scale, q.Offset)
+	}
+	return nil
+}
+
+// quantization extracts the scale and offset of the first band from items,
+// returning the remaining items. q is nil if neither is given.
+func quantization(items []GDALItem, bits int) (q *Quantization, rest []GDALItem, err error) {
+	for _, it := range items {
+		if it.Band != 1 || (it.Role != "scale" && it.Role != "offset") {
+			rest = append(rest, it)
+			continue
+		}
+		v, err := strconv.ParseFloat(it.Value, 64)
+		if err != nil {
+			return nil, nil, FormatError(fmt.Sprintf("invalid GDAL %s %q", it.Role, it.Value))
+		}
+		if q == nil {
+			q = &Quantization{Scale: 1, Bits: bits}
+		}
+		if it.Role == "scale" {
+			q.Scale = v
+		} else {
+			q.Offset = v
+		}
+	}
+	return q, rest, nil
+}
+
+// quantizationItems returns the GDAL_METADATA items recording q.
+func quantizationItems(q *Quantization) []GDALItem {
+	return []GDALItem{
+		{Name: "OFFSET", Value: strconv.FormatFloat(q.Offset, 'g', -1, 64), Band: 1, Role: "offset"},
+		{Name: "SCALE", Value: strconv.FormatFloat(q.Scale, 'g', -1, 64), Band: 1, Role: "scale"},
+	}
+}
+
+// quantize stores the values of m, quantized as described by q, which
+// must be valid, in p, and sets the layout of p for them. noData is the
+// sample standing for NaN, or nil to use the most negative sample; written
+// reports whether the NaN sample was used and so has to be recorded.
+func (p *page) quantize(m *GrayFloat32, q *Quantization, noData *float64) (nan int64, written bool, err error) {
+	lo, hi := int64(math.MinInt16), int64(math.MaxInt16)
+	if q.Bits == 32 {
+		lo, hi = math.MinInt32, math.MaxInt32
+	}
+	nan = lo
+	if noData != nil {
+		if v := *noData; v != math.Trunc(v) || v < float64(lo) || v > float64(hi) {
+			return 0, false, fmt.Errorf("tiff: NoData value %g is not a %d-bit integer", v, q.Bits)
+		}
+		nan = int64(*noData)
+	} else {
+		// The most negative sample is kept for NaN.
+		lo++
+	}
+
+	b := m.Rect
+	dx, dy := b.Dx(), b.Dy()
+	if err := checkPix(len(m.Pix), m.Stride, dx, dy); err != nil {
+		return 0, false, err
+	}
+	var pix []uint32
+	var pix8 []byte
+	if q.Bits == 32 {
+		pix = make([]uint32, dx*dy)
+	} else {
+		pix8 = make([]byte, 2*dx*dy)
+	}
+	for y := 0; y < dy; y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+dx]
+		for x, bits := range row {
+			f := float64(math.Float32frombits(bits))
+			v := nan
+			if math.IsNaN(f) {
+				written = true
+			} else {
+				s := math.Round((f - q.Offset) / q.Scale)
+				switch {
+				case s < float64(lo):
+					v = lo
+				case s > float64(hi):
+					v = hi
+				default:
+					v = int64(s)
+				}
+			}
+			i := y*dx + x
+			if pix != nil {
+				pix[i] = uint32(int32(v))
+			} else {
+				// Kept big-endian, as in an image.Gray16.
+				pix8[2*i], pix8[2*i+1] = byte(uint16(v)>>8), byte(v)
+			}
+		}
+	}
+
+	p.pix, p.pix8, p.stride = pix, pix8, dx
+	if pix8 != nil {
+		p.stride, p.pixBytes, p.sample16 = 2*dx, 2, true
+	}
+	p.layout.bitsPerSample = []uint32{uint32(q.Bits)}
+	p.layout.sampleFormat = SampleFormatInt
+	return nan, written, nil
+}
+
+// setQuantized prepares the decoding of signed integer samples into
+// floating point values.
+func (d *decoder) setQuantized() error {
+	if d.invert {
+		return UnsupportedError{Feature: "WhiteIsZero with signed samples"}
+	}
+	items, err := d.gdalItems()
+	if err != nil {
+		return err
+	}
+	q, _, err := quantization(items, d.bitsPerSample)
+	if err != nil {
+		return err
+	}
+	if q == nil {
+		q = &Quantization{Scale: 1, Bits: d.bitsPerSample}
+	}
+	d.quantization = *q
+	if d.noDataSample, err = d.noData(); err != nil {
+		return err
+	}
+	d.format = formatQuantized
+	d.config.ColorModel = Gray32FloatModel
+	return nil
+}
+
+// decodeQuantized converts the signed samples in buf, which holds the rows
+// of b, into the values they stand for in the pixels of dst covering r.
+func (d *decoder) decodeQuantized(buf []byte, dst *GrayFloat32, r, b image.Rectangle) {
+	rowBytes := d.rowBytes(b.Dx())
+	size := d.bitsPerSample / 8
+	q := d.quantization
+	nan := math.Float32bits(float32(math.NaN()))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := buf[(y-b.Min.Y)*rowBytes+(r.Min.X-b.Min.X)*size:]
+		pix := dst.Pix[dst.PixOffset(r.Min.X, y):]
+		for x := 0; x < r.Dx(); x++ {
+			var v float64
+			if size == 2 {
+				v = float64(int16(d.byteOrder.Uint16(row[2*x:])))
+			} else {
+				v = float64(int32(d.byteOrder.Uint32(row[4*x:])))
+			}
+			if d.noDataSample != nil && v == *d.noDataSample {
+				pix[x] = nan
+				continue
+			}
+			pix[x] = math.Float32bits(float32(v*q.Scale + q.Offset))
+		}
+	}
+}
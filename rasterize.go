@@ -0,0 +1,70 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"math"
+	"slices"
+)
+
+// A Point is a point in world coordinates.
+type Point struct {
+	X, Y float64
+}
+
+// RasterizePolygon returns a mask of size pixels placed in the world by gt,
+// holding 1 in the pixels whose centers are inside the polygon of rings and
+// 0 elsewhere, for use as the zones of ZonalStats or the condition of
+// Where. A point is inside if a ray from it crosses the rings an odd number
+// of times, so that rings inside others are holes; rings need not be
+// closed. The mask is empty if gt cannot be inverted.
+func RasterizePolygon(rings [][]Point, gt GeoTransform, size image.Point) *Gray32 {
+	if size.X <= 0 || size.Y <= 0 {
+		return NewGray32(image.Rectangle{})
+	}
+	m := NewGray32(image.Rectangle{Max: size})
+	type edge struct{ x0, y0, x1, y1 float64 }
+	var edges []edge
+	for _, ring := range rings {
+		for i, p := range ring {
+			q := ring[(i+1)%len(ring)]
+			x0, y0, ok0 := gt.Pixel(p.X, p.Y)
+			x1, y1, ok1 := gt.Pixel(q.X, q.Y)
+			if !ok0 || !ok1 {
+				return m
+			}
+			if y0 != y1 && !math.IsNaN(x0+y0+x1+y1) {
+				edges = append(edges, edge{x0, y0, x1, y1})
+			}
+		}
+	}
+
+	// column returns the first column whose center is at or right of x.
+	column := func(x float64) int {
+		return int(math.Min(math.Max(math.Ceil(x-0.5), 0), float64(size.X)))
+	}
+	var xs []float64
+	for y := 0; y < size.Y; y++ {
+		cy := float64(y) + 0.5
+		xs = xs[:0]
+		for _, e := range edges {
+			// An edge crosses the row if its ends are on either side of
+			// the line through the centers, a point on the line counting
+			// as above it.
+			if (e.y0 <= cy) != (e.y1 <= cy) {
+				xs = append(xs, e.x0+(cy-e.y0)*(e.x1-e.x0)/(e.y1-e.y0))
+			}
+		}
+		slices.Sort(xs)
+		row := m.Pix[m.PixOffset(0, y):][:size.X]
+		for i := 0; i+1 < len(xs); i += 2 {
+			for x := column(xs[i]); x < column(xs[i+1]); x++ {
+				row[x] = 1
+			}
+		}
+	}
+	return m
+}
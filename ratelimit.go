@@ -0,0 +1,51 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"context"
+	"io"
+)
+
+// A RateLimiter paces the reads of a Reader, through
+// ReaderOptions.RequestLimit and ReaderOptions.BandwidthLimit, so that
+// crawling many remote files, such as Cloud Optimized GeoTIFFs read over
+// HTTP range requests, neither saturates a shared link nor trips the
+// throttling of the provider. A *rate.Limiter of golang.org/x/time/rate
+// implements it, and may be shared by many Readers to cap them together.
+type RateLimiter interface {
+	// WaitN blocks until n events are allowed.
+	WaitN(ctx context.Context, n int) error
+	// Burst returns the largest n WaitN allows at once.
+	Burst() int
+}
+
+// A limitedReaderAt waits for requests, one event per call to ReadAt, and
+// for bandwidth, one event per byte asked for, before reading from r.
+// Either limiter may be nil.
+type limitedReaderAt struct {
+	r                   io.ReaderAt
+	requests, bandwidth RateLimiter
+}
+
+func (lr limitedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	ctx := context.Background()
+	if lr.requests != nil {
+		if err := lr.requests.WaitN(ctx, 1); err != nil {
+			return 0, err
+		}
+	}
+	if lr.bandwidth != nil {
+		// WaitN fails for more events than the burst, so large reads
+		// wait for their bytes a burst at a time.
+		burst := max(lr.bandwidth.Burst(), 1)
+		for n := len(p); n > 0; n -= burst {
+			if err := lr.bandwidth.WaitN(ctx, min(n, burst)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return lr.r.ReadAt(p, off)
+}
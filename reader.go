@@ -0,0 +1,1338 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"iter"
+	"math"
+	"math/bits"
+	"runtime"
+	"slices"
+	"time"
+
+	"golang.org/x/image/tiff/lzw"
+)
+
+var errNoPixels = FormatError("not enough pixel data")
+
+const maxChunkSize = 10 << 20 // 10M
+
+// safeReadAt reads n bytes at off from r. A length taken from untrusted
+// input is not allocated up front if it is large (>maxChunkSize), so that a
+// bogus header cannot force a giant allocation before the read fails.
+func safeReadAt(r io.ReaderAt, n uint64, off int64) ([]byte, error) {
+	if int64(n) < 0 || n != uint64(int(n)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, ok := addOffset(off, int64(n)); !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if n < maxChunkSize {
+		buf := make([]byte, n)
+		_, err := r.ReadAt(buf, off)
+		if err != nil {
+			// io.SectionReader can return EOF for n == 0,
+			// but for our purposes that is a success.
+			if err != io.EOF || n > 0 {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	var buf []byte
+	buf1 := make([]byte, maxChunkSize)
+	for n > 0 {
+		next := n
+		if next > maxChunkSize {
+			next = maxChunkSize
+		}
+		_, err := r.ReadAt(buf1[:next], off)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, buf1[:next]...)
+		n -= next
+		off += int64(next)
+	}
+	return buf, nil
+}
+
+type decoder struct {
+	r            io.ReaderAt
+	byteOrder    binary.ByteOrder
+	config       image.Config
+	sampleFormat uint
+	features     map[int][]uint
+	ifd          map[int][ifdLen]byte
+
+	// Sample layout, set up by setFormat.
+	format                         pixelFormat
+	bitsPerSample, samplesPerPixel int
+	invert                         bool // WhiteIsZero.
+	reverseBits                    bool // FillOrder 2.
+	palette                        color.Palette
+	expandPalette                  bool
+	subsampleX, subsampleY         int // Of YCbCr chroma.
+	subsampleRatio                 image.YCbCrSubsampleRatio
+	quantization                   Quantization // Of signed samples.
+	noDataSample                   *float64
+	lercCompression                int    // Of LERC blobs, from LercParameters.
+	jpegTables                     []byte // Shared by JPEG blocks, less EOI.
+	zstdDictionary                 []byte // Shared by ZSTD blocks.
+
+	// Strip or tile layout, set up by parseLayout.
+	blockPadding              bool
+	blockWidth, blockHeight   int
+	blocksAcross, blocksDown  int
+	blockOffsets, blockCounts []uint
+
+	// Tuning set by setOptions.
+	workers, bufferSize, readAhead int
+	metrics                        Metrics
+	arena                          *Arena
+	pool                           *WorkerPool
+	maxIFDEntries, maxTagDataSize  int
+	maxIFDs, maxImageBytes         int
+	chopSize                       int
+
+	ifdOffset  int64 // Offset of the first IFD.
+	imageIFD   int64 // Offset of the IFD decoded.
+	image      int   // Index of the IFD decoded.
+	band       int   // Of images of several bands of gray samples.
+	forceFloat bool
+	strict     bool
+
+	useRange     bool
+	displayRange *SampleRange // The SampleRange, if useRange.
+
+	verifyChecksums bool
+	blockChecksums  []byte // From TagBlockChecksums, if verified.
+	transform       BlockTransform
+
+	state blockState // Used when decoding sequentially.
+}
+
+// firstVal returns the first uint of the features entry with the given tag,
+// or 0 if the tag does not exist.
+func (d *decoder) firstVal(tag int) uint {
+	f := d.features[tag]
+	if len(f) == 0 {
+		return 0
+	}
+	return f[0]
+}
+
+// ifdUint decodes the IFD entry in p, which must be of the Byte, Short,
+// Long or IFD type, or of the 64-bit Long8 or IFD8 types, and returns the
+// decoded uint values.
+//
+// maxCount limits the number of values.
+// If the entry contains more than maxCount values, only the first maxCount are parsed.
+func (d *decoder) ifdUint(p []byte, maxCount int) (u []uint, err error) {
+	var raw []byte
+	if len(p) < ifdLen {
+		return nil, FormatError("bad IFD entry")
+	}
+
+	datatype := d.byteOrder.Uint16(p[2:4])
+	if !knownType(int(datatype)) {
+		return nil, UnsupportedError{"IFD entry datatype", int(d.byteOrder.Uint16(p[0:2])), uint(datatype)}
+	}
+
+	count := d.byteOrder.Uint32(p[4:8])
+	if count > math.MaxInt32/lengths[datatype] {
+		return nil, FormatError("IFD data too large")
+	}
+	truncatedCount := int(count)
+	if truncatedCount > maxCount {
+		truncatedCount = maxCount
+	}
+	if datalen := lengths[datatype] * count; datalen > 4 {
+		truncatedLen := uint64(lengths[datatype]) * uint64(truncatedCount)
+		if truncatedLen > uint64(d.maxTagDataSize) {
+			return nil, FormatError("IFD entry data too large")
+		}
+		// The IFD contains a pointer to the real value.
+		raw, err = safeReadAt(d.r, truncatedLen, int64(d.byteOrder.Uint32(p[8:12])))
+	} else {
+		raw = p[8 : 8+datalen]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u = make([]uint, truncatedCount)
+	switch datatype {
+	case TypeByte:
+		for i := range u {
+			u[i] = uint(raw[i])
+		}
+	case TypeShort:
+		for i := range u {
+			u[i] = uint(d.byteOrder.Uint16(raw[2*i : 2*(i+1)]))
+		}
+	case TypeLong, TypeIFD:
+		for i := range u {
+			u[i] = uint(d.byteOrder.Uint32(raw[4*i : 4*(i+1)]))
+		}
+	case TypeLong8, TypeIFD8:
+		for i := range u {
+			v := d.byteOrder.Uint64(raw[8*i : 8*(i+1)])
+			if v > uint64(^uint(0)) {
+				return nil, FormatError("IFD entry value out of range")
+			}
+			u[i] = uint(v)
+		}
+	default:
+		return nil, UnsupportedError{"data type", int(d.byteOrder.Uint16(p[0:2])), uint(datatype)}
+	}
+	return u, nil
+}
+
+// parseIFDOffsets parses an IFD entry stored in d.ifd using ifdUint.
+// The strip and tile tables scale with the image size, so they are only
+// read once the expected number of blocks is known.
+func (d *decoder) parseIFDOffsets(tag int, maxCount int) (u []uint, err error) {
+	p, ok := d.ifd[tag]
+	if !ok {
+		return nil, nil
+	}
+	return d.ifdUint(p[:], maxCount)
+}
+
+// parseIFD decides whether the IFD entry in p is "interesting" and
+// stows away the data in the decoder. It returns the tag number of the
+// entry and an error, if any.
+func (d *decoder) parseIFD(p []byte) (int, error) {
+	// smallEntryMaxCount is the limit to use for parsed IFD entries that
+	// don't scale with the image size.
+	const smallEntryMaxCount = 16
+
+	tag := d.byteOrder.Uint16(p[0:2])
+	switch tag {
+	case TagNewSubfileType,
+		TagFillOrder,
+		TagPlanarConfiguration,
+		TagInkSet,
+		TagYCbCrSubSampling,
+		TagSamplesPerPixel,
+		TagPhotometricInterpretation,
+		TagCompression,
+		TagPredictor,
+		TagRowsPerStrip,
+		TagTileWidth,
+		TagTileLength,
+		TagImageLength,
+		TagImageWidth,
+		TagSampleFormat:
+		val, err := d.ifdUint(p, smallEntryMaxCount)
+		if err != nil {
+			return 0, err
+		}
+		d.features[int(tag)] = val
+	case TagExtraSamples, TagBitsPerSample:
+		// There is a value per sample, or per sample past those of the
+		// color space, of which multispectral images may have many.
+		val, err := d.ifdUint(p, math.MaxUint16)
+		if err != nil {
+			return 0, err
+		}
+		d.features[int(tag)] = val
+	default:
+		// The strip and tile tables may contain many values, and the
+		// other fields are only needed for the metadata.
+		// Stash the IFD entry for later parsing.
+		var v [ifdLen]byte
+		copy(v[:], p)
+		d.ifd[int(tag)] = v
+	}
+	return int(tag), nil
+}
+
+// newDecoder parses the header and first IFD of the file in r, applying
+// opt, which may be nil.
+func newDecoder(r io.ReaderAt, opt *ReaderOptions) (*decoder, error) {
+	return newDecoderAt(r, opt, 0)
+}
+
+// newDecoderAt is like newDecoder, but parses the IFD at off in place of
+// the one chosen by opt if off is not zero, such as a SubIFD.
+func newDecoderAt(r io.ReaderAt, opt *ReaderOptions, off int64) (*decoder, error) {
+	d := &decoder{
+		r:        r,
+		features: make(map[int][]uint),
+		ifd:      make(map[int][ifdLen]byte),
+	}
+	d.setOptions(opt)
+
+	p := make([]byte, 8)
+	if _, err := d.r.ReadAt(p, 0); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	switch string(p[0:4]) {
+	case leHeader:
+		d.byteOrder = binary.LittleEndian
+	case beHeader:
+		d.byteOrder = binary.BigEndian
+	case leBigHeader[:4], beBigHeader[:4]:
+		return nil, UnsupportedError{Feature: "reading BigTIFF files"}
+	default:
+		return nil, FormatError("malformed header")
+	}
+
+	ifdOffset := int64(d.byteOrder.Uint32(p[4:8]))
+	d.ifdOffset = ifdOffset
+	if off > 0 {
+		ifdOffset = off
+	} else if d.image > 0 {
+		chain, err := d.ifdChain()
+		if err != nil {
+			return nil, err
+		}
+		if d.image >= len(chain) {
+			return nil, fmt.Errorf("tiff: image %d requested from a file of %d images", d.image, len(chain))
+		}
+		ifdOffset = chain[d.image]
+	}
+	d.imageIFD = ifdOffset
+
+	// The first two bytes contain the number of entries (12 bytes each).
+	if _, err := d.r.ReadAt(p[0:2], ifdOffset); err != nil {
+		return nil, err
+	}
+	numItems := int(d.byteOrder.Uint16(p[0:2]))
+	if numItems > d.maxIFDEntries {
+		return nil, FormatError("too many IFD entries")
+	}
+
+	// All IFD entries are read in one chunk.
+	var err error
+	p, err = safeReadAt(d.r, uint64(ifdLen*numItems), ifdOffset+2)
+	if err != nil {
+		return nil, err
+	}
+
+	prevTag := -1
+	for i := 0; i < len(p); i += ifdLen {
+		tag, err := d.parseIFD(p[i : i+ifdLen])
+		if err != nil {
+			return nil, err
+		}
+		if tag <= prevTag {
+			return nil, FormatError("tags are not sorted in ascending order")
+		}
+		prevTag = tag
+	}
+
+	d.config.Width = int(d.firstVal(TagImageWidth))
+	d.config.Height = int(d.firstVal(TagImageLength))
+	if d.config.Width == 0 || d.config.Height == 0 {
+		return nil, FormatError("zero-size image")
+	}
+	if n, ok := mulInt(d.config.Width, d.config.Height); !ok || n > math.MaxInt32 {
+		return nil, UnsupportedError{Feature: "image too large"}
+	}
+	if _, ok := sampleBytes(d.config.Width, d.config.Height); !ok {
+		return nil, UnsupportedError{Feature: "image too large"}
+	}
+
+	if c := d.firstVal(TagCompression); c != 0 && !slices.Contains(decodableCompressions, c) {
+		return nil, UnsupportedError{"compression", TagCompression, c}
+	}
+	if err := d.setFormat(); err != nil {
+		return nil, err
+	}
+	switch d.firstVal(TagCompression) {
+	case CompressionJPEG:
+		err = d.checkJPEG()
+	case CompressionLERC:
+		err = d.checkLERC()
+	case CompressionZSTD:
+		err = d.checkZSTD()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ifdChain returns the offsets of the IFDs of the file in order, starting
+// with the first. The chain is rejected if it loops or is longer than
+// d.maxIFDs.
+func (d *decoder) ifdChain() ([]int64, error) {
+	var offsets []int64
+	seen := make(map[int64]bool)
+	var p [4]byte
+	for off := d.ifdOffset; off != 0; {
+		if seen[off] {
+			return nil, FormatError("IFD chain loops")
+		}
+		if len(offsets) == d.maxIFDs {
+			return nil, FormatError("too many IFDs")
+		}
+		seen[off] = true
+		offsets = append(offsets, off)
+
+		if _, err := d.r.ReadAt(p[:2], off); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		n := int64(d.byteOrder.Uint16(p[:2]))
+		if n > int64(d.maxIFDEntries) {
+			return nil, FormatError("too many IFD entries")
+		}
+		if _, err := d.r.ReadAt(p[:4], off+2+n*ifdLen); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		off = int64(d.byteOrder.Uint32(p[:4]))
+	}
+	return offsets, nil
+}
+
+// fastPathDisabled forces the generic per-pixel paths of the encoder and
+// decoder; it is used by the benchmarks to compare both paths on the same
+// input.
+var fastPathDisabled = false
+
+// parseLayout works out the strip or tile layout of the image and reads the
+// tables of block offsets and byte counts.
+func (d *decoder) parseLayout() (err error) {
+	if err := d.setBlockSize(); err != nil {
+		return err
+	}
+	offsetsTag, countsTag := TagStripOffsets, TagStripByteCounts
+	if d.blockPadding {
+		offsetsTag, countsTag = TagTileOffsets, TagTileByteCounts
+	}
+	d.blockOffsets, err = d.parseIFDOffsets(offsetsTag, d.blocksAcross*d.blocksDown)
+	if err != nil {
+		return err
+	}
+	d.blockCounts, err = d.parseIFDOffsets(countsTag, d.blocksAcross*d.blocksDown)
+	if err != nil {
+		return err
+	}
+
+	// Check if we have the right number of strips/tiles, offsets and counts.
+	if n := d.blocksAcross * d.blocksDown; len(d.blockOffsets) < n || len(d.blockCounts) < n {
+		return FormatError("inconsistent header")
+	}
+	if err := d.checkBlockChecksums(); err != nil {
+		return err
+	}
+	if d.useRange && d.format == formatGray32 {
+		if d.displayRange, err = d.sampleRange(); err != nil {
+			return err
+		}
+	}
+	if d.strict {
+		if err := d.checkBlocks(); err != nil {
+			return err
+		}
+		return d.checkLeaders()
+	}
+	return nil
+}
+
+// setBlockSize works out the size of the strips or tiles of the image and
+// their number, without reading their tables.
+func (d *decoder) setBlockSize() error {
+	d.blockWidth = d.config.Width
+	d.blockHeight = d.config.Height
+	d.blocksAcross = 1
+	d.blocksDown = 1
+
+	if d.firstVal(TagTileWidth) != 0 {
+		d.blockPadding = true
+
+		d.blockWidth = int(d.firstVal(TagTileWidth))
+		d.blockHeight = int(d.firstVal(TagTileLength))
+
+		// The specification says that tile widths and lengths must be a
+		// multiple of 16. Invalid sizes are permitted, but anything too
+		// small is rejected to limit the work a malicious input can cause.
+		if d.blockWidth < 8 || d.blockHeight < 8 {
+			return FormatError("tile size is too small")
+		}
+		if n, ok := mulInt(d.blockWidth, d.blockHeight); !ok || n > math.MaxInt32 {
+			return UnsupportedError{Feature: "tile size is too large"}
+		}
+		if _, ok := sampleBytes(d.blockWidth, d.blockHeight); !ok {
+			return UnsupportedError{Feature: "tile size is too large"}
+		}
+		d.blocksAcross = (d.config.Width + d.blockWidth - 1) / d.blockWidth
+		d.blocksDown = (d.config.Height + d.blockHeight - 1) / d.blockHeight
+		return nil
+	}
+	if v := d.firstVal(TagRowsPerStrip); v > 0 && v < uint(d.blockHeight) {
+		d.blockHeight = int(v)
+	}
+	d.blocksDown = (d.config.Height + d.blockHeight - 1) / d.blockHeight
+	return nil
+}
+
+// blockBounds returns the pixels covered by block (i, j). Tiles keep their
+// full size at the right and bottom edges, strips are cut to the image.
+func (d *decoder) blockBounds(i, j int) image.Rectangle {
+	b := image.Rect(i*d.blockWidth, j*d.blockHeight, (i+1)*d.blockWidth, (j+1)*d.blockHeight)
+	if !d.blockPadding {
+		b = b.Intersect(image.Rect(0, 0, d.config.Width, d.config.Height))
+	}
+	return b
+}
+
+// newImage returns an image of the decoder's pixel format covering r, or a
+// FormatError if it would take more than the MaxImageBytes of the options.
+func (d *decoder) newImage(r image.Rectangle) (image.Image, error) {
+	if n := uint64(r.Dx()) * uint64(r.Dy()) * uint64(d.pixelBytes()); n > uint64(d.maxImageBytes) {
+		return nil, FormatError(fmt.Sprintf("image of %d bytes exceeds MaxImageBytes", n))
+	}
+	return d.allocImage(r), nil
+}
+
+// pixelBytes returns the number of bytes taken by a pixel of the images
+// newImage allocates, at most.
+func (d *decoder) pixelBytes() int {
+	switch d.format {
+	case formatGray, formatPaletted:
+		return 1
+	case formatGray16:
+		return 2
+	case formatYCbCr:
+		return 3
+	case formatNRGBA64, formatRGBA64:
+		return 8
+	}
+	return 4
+}
+
+// allocImage returns an image for the pixels of r, of the type decoded.
+func (d *decoder) allocImage(r image.Rectangle) image.Image {
+	switch d.format {
+	case formatGray:
+		return image.NewGray(r)
+	case formatGray16:
+		return image.NewGray16(r)
+	case formatPaletted:
+		return image.NewPaletted(r, d.palette)
+	case formatPaletted16:
+		m := NewGray32(r)
+		m.Palette = d.palette
+		return m
+	case formatNRGBA:
+		return image.NewNRGBA(r)
+	case formatNRGBA64:
+		return image.NewNRGBA64(r)
+	case formatRGBA, formatExpanded:
+		return image.NewRGBA(r)
+	case formatRGBA64:
+		return image.NewRGBA64(r)
+	case formatCMYK:
+		return image.NewCMYK(r)
+	case formatYCbCr:
+		return image.NewYCbCr(r, d.subsampleRatio)
+	}
+	if d.arena != nil {
+		return d.bandImage(d.arena.alloc(r.Dx()*r.Dy()), r)
+	}
+	return d.bandImage(make([]uint32, r.Dx()*r.Dy()), r)
+}
+
+// gray32Pix returns the samples and stride of m, a *Gray32 or *GrayFloat32.
+func gray32Pix(m image.Image) ([]uint32, int) {
+	switch m := m.(type) {
+	case *Gray32:
+		return m.Pix, m.Stride
+	case *GrayFloat32:
+		return m.Pix, m.Stride
+	}
+	return nil, 0
+}
+
+// uncompressed reports whether the blocks are stored without compression.
+func (d *decoder) uncompressed() bool {
+	// According to the spec, Compression does not have a default value,
+	// but some tools interpret a missing Compression value as none, so we do
+	// the same.
+	c := d.firstVal(TagCompression)
+	return c == CompressionNone || c == 0
+}
+
+// readDirect reports whether the block rows b can be read straight into
+// the Pix of dst. This requires uncompressed 32-bit data without
+// prediction, blocks and destination rows that both span the whole image
+// width, and a platform on which Pix can be viewed as bytes.
+func (d *decoder) readDirect(b image.Rectangle, dst image.Image) bool {
+	if fastPathDisabled || !haveUint32Bytes || !d.uncompressed() || d.format != formatGray32 || d.samplesPerPixel > 1 {
+		return false
+	}
+	w := d.config.Width
+	dr := dst.Bounds()
+	_, stride := gray32Pix(dst)
+	return !d.predicted() &&
+		b.Min.X == 0 && b.Dx() == w && dr.Min.X == 0 && dr.Dx() == w && stride == w
+}
+
+// decodeDirect reads the n bytes at offset straight into the rows
+// [ymin, ymax) of dst with a single ReadAt, then swaps the byte order in
+// place if the file and the host disagree.
+func (d *decoder) decodeDirect(dst image.Image, offset, n int64, ymin, ymax int) error {
+	w := d.config.Width
+	pix, _ := gray32Pix(dst)
+	dr := dst.Bounds()
+	rows := pix[(ymin-dr.Min.Y)*w : (ymax-dr.Min.Y)*w]
+	if !haveUint32Bytes {
+		return InternalError("no byte view of the pixel buffer")
+	}
+	b := uint32Bytes(rows)
+	if n < int64(len(b)) {
+		return errNoPixels
+	}
+	if _, err := d.r.ReadAt(b, offset); err != nil {
+		if err == io.EOF {
+			return errNoPixels
+		}
+		return err
+	}
+	if (d.byteOrder == binary.LittleEndian) != nativeLittleEndian {
+		for i, v := range rows {
+			rows[i] = bits.ReverseBytes32(v)
+		}
+	}
+	return nil
+}
+
+// A blockState holds the buffers used to decode blocks. Each goroutine
+// decoding blocks of the same image has its own.
+type blockState struct {
+	buf []byte        // Decompressed or raw pixel data of the current block.
+	br  *bufio.Reader // Buffers reads of compressed data.
+}
+
+// source returns a reader for the compressed data of a block: raw if it
+// was fetched ahead, otherwise the n bytes at offset read through s.br.
+func (d *decoder) source(s *blockState, raw []byte, offset, n int64) io.Reader {
+	if raw != nil {
+		return bytes.NewReader(raw)
+	}
+	sr := io.NewSectionReader(d.r, offset, n)
+	if s.br == nil {
+		s.br = bufio.NewReaderSize(sr, d.bufferSize)
+	} else {
+		s.br.Reset(sr)
+	}
+	return s.br
+}
+
+// decompressor returns a reader of the decompressed data of block (i, j).
+// raw holds the compressed data if it has already been fetched.
+func (d *decoder) decompressor(s *blockState, i, j int, raw []byte) (io.ReadCloser, error) {
+	offset := int64(d.blockOffsets[j*d.blocksAcross+i])
+	n := int64(d.blockCounts[j*d.blocksAcross+i])
+	switch d.firstVal(TagCompression) {
+	case CompressionLZW:
+		return lzw.NewReader(d.source(s, raw, offset, n), lzw.MSB, 8), nil
+	case CompressionDeflate, CompressionOldDeflate:
+		// Old-style Deflate is the same zlib data under the code used
+		// before Deflate was registered.
+		return zlib.NewReader(d.source(s, raw, offset, n))
+	case CompressionJPEG:
+		return d.jpegBlock(d.source(s, raw, offset, n), n)
+	case CompressionLERC:
+		return d.lercBlock(d.source(s, raw, offset, n), n)
+	case CompressionLZMA:
+		return d.lzmaBlock(d.source(s, raw, offset, n), n)
+	case CompressionZSTD:
+		return d.zstdBlock(d.source(s, raw, offset, n), n)
+	}
+	return nil, UnsupportedError{"compression", TagCompression, d.firstVal(TagCompression)}
+}
+
+// inflate decompresses block (i, j) into s.buf. raw holds the compressed
+// data if it has already been fetched.
+func (d *decoder) inflate(s *blockState, i, j int, raw []byte) error {
+	r, err := d.decompressor(s, i, j, raw)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if !d.strict {
+		s.buf, err = readBuf(r, s.buf, d.blockBytes())
+		return err
+	}
+	// Reading a byte more than the block holds reveals any excess data.
+	want := d.blockSize(i, j)
+	if s.buf, err = readBuf(r, s.buf, want+1); err != nil {
+		return err
+	}
+	if n := int64(len(s.buf)); n != want {
+		return d.sizeError(i, j, n, want)
+	}
+	return nil
+}
+
+// chopped reports whether blocks are unpacked a chunk of rows at a time,
+// because they are larger than the ChopSize option allows. Subsampled
+// YCbCr data is not made of rows, so it is always unpacked whole.
+func (d *decoder) chopped() bool {
+	return d.chopSize > 0 && d.blockBytes() > int64(d.chopSize) && d.format != formatYCbCr
+}
+
+// decodeChopped decodes the part of block (i, j) inside dst like
+// decodeBlock, but reads or decompresses the rows of the block a chunk of
+// at most d.chopSize bytes at a time, so that the block never has to be
+// held in memory whole. Compressed rows after dst are not decompressed.
+func (d *decoder) decodeChopped(s *blockState, i, j int, raw []byte, dst image.Image) error {
+	b := d.blockBounds(i, j)
+	dr := dst.Bounds()
+	rowBytes := d.rowBytes(b.Dx())
+	chunkRows := d.chopSize / rowBytes
+	if chunkRows < 1 {
+		chunkRows = 1
+	}
+	ymax := b.Max.Y
+	if dr.Max.Y < ymax {
+		ymax = dr.Max.Y
+	}
+	offset := int64(d.blockOffsets[j*d.blocksAcross+i])
+	n := int64(d.blockCounts[j*d.blocksAcross+i])
+
+	var zr io.ReadCloser
+	y := b.Min.Y
+	if d.uncompressed() {
+		// Uncompressed rows before dr can be skipped.
+		if dr.Min.Y > y {
+			y = dr.Min.Y
+		}
+	} else {
+		var err error
+		if zr, err = d.decompressor(s, i, j, raw); err != nil {
+			return err
+		}
+		defer zr.Close()
+	}
+	var elapsed time.Duration
+	var read int64 // Decompressed bytes.
+	for ; y < ymax; y += chunkRows {
+		rows := chunkRows
+		if y+rows > ymax {
+			rows = ymax - y
+		}
+		size := rows * rowBytes
+		if cap(s.buf) < size {
+			s.buf = make([]byte, size)
+		}
+		buf := s.buf[:size]
+		if zr != nil {
+			start := time.Now()
+			k, err := io.ReadFull(zr, buf)
+			elapsed += time.Since(start)
+			read += int64(k)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if d.strict {
+					return d.sizeError(i, j, read, d.blockSize(i, j))
+				}
+				return errNoPixels
+			} else if err != nil {
+				return err
+			}
+		} else {
+			skip := int64(y-b.Min.Y) * int64(rowBytes)
+			if skip+int64(size) > n {
+				return errNoPixels
+			}
+			if k, err := d.r.ReadAt(buf, offset+skip); k < size {
+				if err == nil || err == io.EOF {
+					return errNoPixels
+				}
+				return err
+			}
+		}
+		if y+rows > dr.Min.Y {
+			if err := d.decode(buf, dst, image.Rect(b.Min.X, y, b.Max.X, y+rows)); err != nil {
+				return err
+			}
+		}
+	}
+	if zr != nil && d.metrics != nil {
+		d.metrics.Decompressed(elapsed)
+	}
+	if zr != nil && d.strict && ymax == b.Max.Y {
+		if k, _ := io.ReadFull(zr, s.buf[:1]); k > 0 {
+			return d.sizeError(i, j, read+1, d.blockSize(i, j))
+		}
+	}
+	return nil
+}
+
+// decodeBlock decodes the part of block (i, j) inside the bounds of dst
+// into dst. raw holds the compressed data of the block if it has already
+// been fetched.
+func (d *decoder) decodeBlock(s *blockState, i, j int, raw []byte, dst image.Image) error {
+	if d.metrics != nil {
+		defer d.metrics.BlockDecoded()
+	}
+	if d.blockChecksums != nil {
+		var err error
+		if raw, err = d.verifyBlock(i, j, raw); err != nil {
+			return err
+		}
+	}
+	b := d.blockBounds(i, j)
+	if d.transform != nil {
+		var err error
+		if raw, err = d.openBlock(i, j, raw); err != nil {
+			return err
+		}
+		if d.uncompressed() {
+			if want := d.blockSize(i, j); d.strict && int64(len(raw)) != want {
+				return d.sizeError(i, j, int64(len(raw)), want)
+			}
+			return d.decode(raw, dst, b)
+		}
+	}
+	if d.chopped() && !d.readDirect(b, dst) {
+		return d.decodeChopped(s, i, j, raw, dst)
+	}
+	if !d.uncompressed() {
+		start := time.Now()
+		if err := d.inflate(s, i, j, raw); err != nil {
+			return err
+		}
+		if d.metrics != nil {
+			d.metrics.Decompressed(time.Since(start))
+		}
+		return d.decode(s.buf, dst, b)
+	}
+
+	// Uncompressed rows can be read individually, except for subsampled
+	// YCbCr, whose data units span several rows.
+	isect := b.Intersect(dst.Bounds())
+	offset := int64(d.blockOffsets[j*d.blocksAcross+i])
+	n := int64(d.blockCounts[j*d.blocksAcross+i])
+	if d.format == formatYCbCr {
+		if n > d.blockBytes() {
+			n = d.blockBytes()
+		}
+		var err error
+		if s.buf, err = safeReadAt(d.r, uint64(n), offset); err != nil {
+			return err
+		}
+		return d.decode(s.buf, dst, b)
+	}
+	rowBytes := int64(d.rowBytes(b.Dx()))
+	skip := int64(isect.Min.Y-b.Min.Y) * rowBytes
+	size := int64(isect.Dy()) * rowBytes
+	if skip+size > n {
+		return errNoPixels
+	}
+	if d.readDirect(b, dst) {
+		return d.decodeDirect(dst, offset+skip, size, isect.Min.Y, isect.Max.Y)
+	}
+	var err error
+	if s.buf, err = safeReadAt(d.r, uint64(size), offset+skip); err != nil {
+		return err
+	}
+	rows := image.Rect(b.Min.X, isect.Min.Y, b.Max.X, isect.Max.Y)
+	return d.decode(s.buf, dst, rows)
+}
+
+// A blockJob is a block to be decoded, along with its compressed data if
+// it has been fetched ahead.
+type blockJob struct {
+	i, j int
+	raw  []byte
+	err  error
+}
+
+// readRegion decodes the pixels inside the bounds dr of dst, which must lie
+// within the image and be of the decoder's pixel format, into dst. Only the
+// blocks intersecting dr are read, and of uncompressed blocks only the rows
+// intersecting dr. Blocks are decoded by up to d.workers goroutines.
+func (d *decoder) readRegion(dst image.Image) error {
+	dr := dst.Bounds()
+	var jobs []blockJob
+	i0, i1 := dr.Min.X/d.blockWidth, (dr.Max.X+d.blockWidth-1)/d.blockWidth
+	j0, j1 := dr.Min.Y/d.blockHeight, (dr.Max.Y+d.blockHeight-1)/d.blockHeight
+	for j := j0; j < j1; j++ {
+		for i := i0; i < i1; i++ {
+			if !d.blockBounds(i, j).Intersect(dr).Empty() {
+				jobs = append(jobs, blockJob{i: i, j: j})
+			}
+		}
+	}
+
+	workers := d.pool.limit(d.workers)
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	if workers <= 1 {
+		for _, job := range jobs {
+			d.pool.acquire()
+			err := d.decodeBlock(&d.state, job.i, job.j, nil, dst)
+			d.pool.release()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// A feeder hands out the jobs in order, fetching the compressed data of
+	// up to d.readAhead blocks ahead of the workers.
+	queue := make(chan blockJob, d.readAhead)
+	done := make(chan struct{})
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			if d.readAhead > 0 && !d.uncompressed() && !d.chopped() {
+				n := uint64(d.blockCounts[job.j*d.blocksAcross+job.i])
+				off := int64(d.blockOffsets[job.j*d.blocksAcross+job.i])
+				job.raw, job.err = safeReadAt(d.r, n, off)
+			}
+			select {
+			case queue <- job:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	errc := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			var s blockState
+			for job := range queue {
+				err := job.err
+				if err == nil {
+					d.pool.acquire()
+					err = d.decodeBlock(&s, job.i, job.j, job.raw, dst)
+					d.pool.release()
+				}
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+			errc <- nil
+		}()
+	}
+	var err error
+	for w := 0; w < workers; w++ {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+			close(done)
+		}
+	}
+	return err
+}
+
+// decode unpacks the raw data in buf, which holds the rows of b, into
+// dst. Only the part of b inside the bounds of dst is stored.
+func (d *decoder) decode(buf []byte, dst image.Image, b image.Rectangle) error {
+	if d.predicted() {
+		if err := d.unpredict(buf, b); err != nil {
+			return err
+		}
+	}
+	return d.unpack(buf, dst, b)
+}
+
+// unpack is like decode for data to which the predictor, if any, has
+// already been undone.
+func (d *decoder) unpack(buf []byte, dst image.Image, b image.Rectangle) error {
+	if s, ok := dst.(*bandSet); ok {
+		return s.unpack(buf, b)
+	}
+	if s, ok := dst.(*rawSamples); ok {
+		return s.unpack(buf, b)
+	}
+	if d.grayBands() > 1 {
+		d.pickBand(buf, b)
+	}
+	switch d.format {
+	case formatGray32:
+	case formatYCbCr:
+		return d.decodeYCbCr(buf, dst, b)
+	default:
+		return d.decodeSamples(buf, dst, b)
+	}
+
+	pix, stride := gray32Pix(dst)
+	dr := dst.Bounds()
+	rowBytes := d.rowBytes(b.Dx())
+	r := b.Intersect(dr)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		off := (y-b.Min.Y)*rowBytes + (r.Min.X-b.Min.X)*4
+		if off+r.Dx()*4 > len(buf) {
+			return errNoPixels
+		}
+		i := (y-dr.Min.Y)*stride + (r.Min.X - dr.Min.X)
+		row := pix[i : i+r.Dx()]
+		for i := range row {
+			row[i] = d.byteOrder.Uint32(buf[off : off+4])
+			off += 4
+		}
+	}
+	return nil
+}
+
+// Decode reads a TIFF image from r and returns it as an image.Image.
+// 32-bit unsigned integer samples are returned as a *Gray32, floating point
+// samples as a *GrayFloat32, and 16- or 32-bit signed samples as a
+// *GrayFloat32 of the values they stand for, as described for Quantization.
+// Gray images of 1 to 8 bits are returned as an *image.Gray, 16-bit ones as
+// an *image.Gray16, and paletted images as an *image.Paletted, or as a
+// *Gray32 of indices with its Palette set if they have 16-bit indices. RGB
+// and RGBA images are returned as an *image.NRGBA if they have 8-bit
+// samples and as an *image.NRGBA64 if they have 16-bit ones, or as an
+// *image.RGBA or *image.RGBA64 if their alpha is declared associated
+// (premultiplied) by the ExtraSamples field. 8-bit CMYK images are returned as an *image.CMYK and
+// 8-bit YCbCr images as an *image.YCbCr with the subsampling of the file.
+//
+// Images larger than the default MaxImageBytes of ReaderOptions are
+// rejected; a Reader with a larger limit decodes them.
+func Decode(r io.Reader) (image.Image, error) {
+	d, err := newDecoder(newReaderAt(r), nil)
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeImage()
+}
+
+// decodeImage decodes the whole image, once its layout is parsed and the
+// file is known to be long enough to hold the data of its strips or tiles.
+func (d *decoder) decodeImage() (image.Image, error) {
+	if err := d.parseLayout(); err != nil {
+		return nil, err
+	}
+	if err := d.checkDataEnd(); err != nil {
+		return nil, err
+	}
+	img, err := d.newImage(image.Rect(0, 0, d.config.Width, d.config.Height))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.readRegion(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// checkDataEnd reports a FormatError if the data of a strip or tile, as
+// given by the offsets and byte counts, extends past the end of the file,
+// so that a short file that declares a huge image is rejected before the
+// image is allocated. Only the last byte of the data is read.
+func (d *decoder) checkDataEnd() error {
+	var end uint64
+	n := d.blocksAcross * d.blocksDown
+	for i, count := range d.blockCounts[:n] {
+		if count > 0 {
+			end = max(end, uint64(d.blockOffsets[i])+uint64(count))
+		}
+	}
+	if end == 0 {
+		return nil
+	}
+	var b [1]byte
+	if k, err := d.r.ReadAt(b[:], int64(end-1)); k == 0 {
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return FormatError("strip or tile data past the end of the file")
+	}
+	return nil
+}
+
+func readBuf(r io.Reader, buf []byte, lim int64) ([]byte, error) {
+	b := bytes.NewBuffer(buf[:0])
+	_, err := b.ReadFrom(io.LimitReader(r, lim))
+	return b.Bytes(), err
+}
+
+// A Reader gives random access to the pixels of a TIFF image without
+// decoding all of it. A Reader is not safe for concurrent use; Clone gives
+// a Reader for each goroutine.
+type Reader struct {
+	d *decoder
+}
+
+// ReaderOptions tune how a Reader fetches and decodes strips and tiles.
+// The zero value selects the defaults.
+type ReaderOptions struct {
+	// Workers is the number of goroutines decoding strips or tiles
+	// concurrently. If zero, GOMAXPROCS is used; 1 decodes sequentially.
+	Workers int
+	// BufferSize is the size of the buffer each worker reads compressed
+	// data through. Larger buffers, such as 1MB, suit network-backed
+	// storage where every read is expensive. If zero, 64KB is used.
+	BufferSize int
+	// ReadAhead is the number of compressed blocks fetched into memory
+	// ahead of the workers. If zero, Workers is used; a negative value
+	// disables read-ahead, leaving every worker to read its own blocks.
+	ReadAhead int
+	// Metrics, if not nil, receives the bytes read and the blocks decoded.
+	Metrics Metrics
+	// Arena, if not nil, supplies the pixel buffers of the *Gray32 and
+	// *GrayFloat32 images returned by ReadRegion.
+	Arena *Arena
+	// Pool, if not nil, bounds the blocks being decoded at once, and the
+	// workers with them, shared with the other users of the pool.
+	Pool *WorkerPool
+	// RequestLimit, if not nil, is waited on for one event before each
+	// read from the file, and BandwidthLimit for one event per byte read.
+	RequestLimit, BandwidthLimit RateLimiter
+
+	// The following limits guard against hostile files. A file exceeding
+	// one is rejected with a FormatError. If zero, the defaults are used.
+
+	// MaxIFDEntries limits the number of entries in an IFD. The default is
+	// 4096.
+	MaxIFDEntries int
+	// MaxTagDataSize limits the size in bytes of the data of a single IFD
+	// entry, such as the table of strip offsets. The default is 64MB.
+	MaxTagDataSize int
+	// MaxIFDs limits the length of the chain of IFDs followed through a
+	// file. The default is 4096.
+	MaxIFDs int
+	// MaxImageBytes limits the size in bytes of an image allocated to
+	// decode pixels into, such as the region given to ReadRegion or the
+	// whole image decoded by Decode. The default is 1GB; larger images can
+	// be read a region at a time.
+	MaxImageBytes int
+
+	// Image is the index of the image to decode in a file holding several,
+	// such as the pages or overviews written by EncodeAll.
+	Image int
+	// Band is the index of the band decoded from an image of several bands
+	// of gray samples, such as the multispectral images written by
+	// StackBands or GDAL, which are decoded a band at a time. It must be
+	// zero for images of other kinds, whose samples are decoded together.
+	Band int
+	// ForceFloat makes the samples be read as IEEE floating point whatever
+	// the SampleFormat field says. Without it, a file lacking the field
+	// holds unsigned integers, as the spec requires, but some old writers
+	// of floating point data omit or misstate it.
+	ForceFloat bool
+	// ChopSize, if positive, bounds the memory used to unpack a strip or
+	// tile. Larger blocks, such as the single strip of some huge files,
+	// are read or decompressed a chunk of rows of about ChopSize bytes at
+	// a time rather than whole, and are not fetched ahead. If zero, every
+	// block is unpacked whole.
+	ChopSize int
+	// DisplayRange makes the *Gray32 and *GrayFloat32 images decoded have
+	// their Range set to the SampleRange of the file, if it has one, so
+	// that their At method maps the samples to grays.
+	DisplayRange bool
+	// ExpandPalette makes paletted images be decoded into an *image.RGBA
+	// holding the colors of their pixels rather than an *image.Paletted.
+	ExpandPalette bool
+	// Strict makes the strips or tiles be checked for corruption, such as
+	// the damage done by a bad copy, which otherwise goes unnoticed or
+	// shows as missing rows. The data of a block must not overlap that of
+	// another or the IFD, and must decompress to exactly the pixels of the
+	// block, or else a FormatError naming the block is returned. Blocks
+	// must also have the leaders and trailers the GDAL structural metadata
+	// of the file describes, if any. Overlaps and leaders are checked by
+	// NewReaderWithOptions, sizes as blocks are decoded.
+	Strict bool
+	// VerifyChecksums makes the stored data of every strip or tile read be
+	// checked against the checksum of the TagBlockChecksums field, if the
+	// image has one, as written with Encoder.BlockChecksums. A block that
+	// does not match is reported with a FormatError naming it. Only the
+	// blocks read are checked, each read whole once.
+	VerifyChecksums bool
+	// Transform, if not nil, undoes the transformation of the stored data
+	// of the strips and tiles of files written with Encoder.Transform,
+	// such as their encryption.
+	Transform BlockTransform
+}
+
+const (
+	defaultBufferSize     = 64 << 10
+	defaultMaxIFDEntries  = 4096
+	defaultMaxTagDataSize = 64 << 20
+	defaultMaxIFDs        = 4096
+	defaultMaxImageBytes  = 1 << 30
+)
+
+// setOptions applies opt, which may be nil, to d.
+func (d *decoder) setOptions(opt *ReaderOptions) {
+	var o ReaderOptions
+	if opt != nil {
+		o = *opt
+	}
+	if o.Workers <= 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = defaultBufferSize
+	}
+	if o.ReadAhead == 0 {
+		o.ReadAhead = o.Workers
+	} else if o.ReadAhead < 0 {
+		o.ReadAhead = 0
+	}
+	d.workers, d.bufferSize, d.readAhead = o.Workers, o.BufferSize, o.ReadAhead
+	d.metrics, d.arena, d.pool = o.Metrics, o.Arena, o.Pool
+
+	if o.MaxIFDEntries <= 0 {
+		o.MaxIFDEntries = defaultMaxIFDEntries
+	}
+	if o.MaxTagDataSize <= 0 {
+		o.MaxTagDataSize = defaultMaxTagDataSize
+	}
+	if o.MaxIFDs <= 0 {
+		o.MaxIFDs = defaultMaxIFDs
+	}
+	if o.MaxImageBytes <= 0 {
+		o.MaxImageBytes = defaultMaxImageBytes
+	}
+	d.maxIFDEntries, d.maxTagDataSize, d.maxIFDs = o.MaxIFDEntries, o.MaxTagDataSize, o.MaxIFDs
+	d.maxImageBytes = o.MaxImageBytes
+	d.image, d.band, d.forceFloat = o.Image, o.Band, o.ForceFloat
+	d.chopSize, d.expandPalette = o.ChopSize, o.ExpandPalette
+	d.strict, d.verifyChecksums = o.Strict, o.VerifyChecksums
+	d.transform, d.useRange = o.Transform, o.DisplayRange
+}
+
+// NewReader parses the header and first IFD of the TIFF file in r.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	return NewReaderWithOptions(r, nil)
+}
+
+// NewReaderWithOptions is like NewReader but tunes decoding with opt,
+// which may be nil.
+func NewReaderWithOptions(r io.ReaderAt, opt *ReaderOptions) (*Reader, error) {
+	return openReaderAt(r, opt, 0)
+}
+
+// openReaderAt is like NewReaderWithOptions, but reads the image of the IFD
+// at off if it is not zero, as for newDecoderAt.
+func openReaderAt(r io.ReaderAt, opt *ReaderOptions, off int64) (*Reader, error) {
+	if opt != nil && (opt.RequestLimit != nil || opt.BandwidthLimit != nil) {
+		r = limitedReaderAt{r, opt.RequestLimit, opt.BandwidthLimit}
+	}
+	if opt != nil && opt.Metrics != nil {
+		r = meteredReaderAt{r, opt.Metrics}
+	}
+	d, err := newDecoderAt(r, opt, off)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.parseLayout(); err != nil {
+		return nil, err
+	}
+	return &Reader{d}, nil
+}
+
+// NumImages returns the number of images in the file, following the chain
+// of IFDs within the limits set by the ReaderOptions. The Reader decodes
+// the image selected by ReaderOptions.Image, by default the first.
+func (r *Reader) NumImages() (int, error) {
+	offsets, err := r.d.ifdChain()
+	return len(offsets), err
+}
+
+// Clone returns a Reader of the same image that can be used concurrently
+// with r. It shares the parsed IFD and the options of r, which are not
+// changed once read, but keeps its own buffers. Both read through the
+// io.ReaderAt given to r.
+func (r *Reader) Clone() *Reader {
+	d := *r.d
+	d.state = blockState{}
+	return &Reader{&d}
+}
+
+// Config returns the color model and dimensions of the image.
+func (r *Reader) Config() image.Config { return r.d.config }
+
+// Bounds returns the bounds of the image.
+func (r *Reader) Bounds() image.Rectangle {
+	return image.Rect(0, 0, r.d.config.Width, r.d.config.Height)
+}
+
+// ReadRegion decodes the part of the image inside rect. The returned image
+// is of the type Decode would return, with bounds of rect clipped to the
+// image.
+func (r *Reader) ReadRegion(rect image.Rectangle) (image.Image, error) {
+	rect = rect.Intersect(r.Bounds())
+	img, err := r.d.newImage(rect)
+	if err != nil {
+		return nil, err
+	}
+	if rect.Empty() {
+		return img, nil
+	}
+	if err := r.d.readRegion(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Blocks returns the regions to read in turn to process the whole image,
+// row by row, covering the image without overlapping. Each is made of
+// whole strips or tiles of the file, cut to the image, so that reading
+// every region with ReadRegion decodes each block exactly once. Regions
+// are about blockSize pixels across and down, rounded up to whole blocks
+// of the file; a zero size gives regions of a single block.
+func (r *Reader) Blocks(blockSize image.Point) iter.Seq[image.Rectangle] {
+	d := r.d
+	step := func(want, block int) int {
+		return max(1, (want+block-1)/block) * block
+	}
+	dx, dy := step(blockSize.X, d.blockWidth), step(blockSize.Y, d.blockHeight)
+	bounds := r.Bounds()
+	return func(yield func(image.Rectangle) bool) {
+		for y := 0; y < bounds.Max.Y; y += dy {
+			for x := 0; x < bounds.Max.X; x += dx {
+				if !yield(image.Rect(x, y, x+dx, y+dy).Intersect(bounds)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// A RegionResult is the outcome of ReadRegionAsync: the image ReadRegion
+// returns, or the error it fails with.
+type RegionResult struct {
+	Image image.Image
+	Err   error
+}
+
+// ReadRegionAsync starts decoding the part of the image inside rect, as
+// ReadRegion does, and returns at once. The result is sent on the channel
+// returned, which is then closed, so that drawing a region can overlap with
+// decoding the next. The region is read through a Clone of r, which stays
+// free for other reads in the meantime; the Workers of r decode its blocks.
+func (r *Reader) ReadRegionAsync(rect image.Rectangle) <-chan RegionResult {
+	c := r.Clone()
+	ch := make(chan RegionResult, 1)
+	go func() {
+		m, err := c.ReadRegion(rect)
+		ch <- RegionResult{m, err}
+		close(ch)
+	}()
+	return ch
+}
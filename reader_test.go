@@ -0,0 +1,3319 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/image/tiff"
+)
+
+func newTestGray32(w, h int) *Gray32 {
+	m := NewGray32(image.Rect(0, 0, w, h))
+	for i := range m.Pix {
+		m.Pix[i] = uint32(i) * 2654435761
+	}
+	return m
+}
+
+func newTestGrayFloat32(w, h int) *GrayFloat32 {
+	m := NewGrayFloat32(image.Rect(0, 0, w, h))
+	for i := range m.Pix {
+		m.Pix[i] = math.Float32bits(float32(i) / 3)
+	}
+	return m
+}
+
+func encodeToBytes(t testing.TB, m image.Image) []byte {
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func comparePix(t *testing.T, got, want []uint32) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("len(Pix) = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Pix[%d] = %#x, want %#x", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	for _, generic := range []bool{false, true} {
+		fastPathDisabled = generic
+		g := newTestGray32(37, 11)
+		m, err := Decode(bytes.NewReader(encodeToBytes(t, g)))
+		if err != nil {
+			t.Fatalf("generic=%v: Gray32: %v", generic, err)
+		}
+		comparePix(t, m.(*Gray32).Pix, g.Pix)
+
+		f := newTestGrayFloat32(37, 11)
+		m, err = Decode(bytes.NewReader(encodeToBytes(t, f)))
+		if err != nil {
+			t.Fatalf("generic=%v: GrayFloat32: %v", generic, err)
+		}
+		comparePix(t, m.(*GrayFloat32).Pix, f.Pix)
+	}
+	fastPathDisabled = false
+}
+
+func TestDecodeFromReader(t *testing.T) {
+	// A plain io.Reader goes through the buffering ReaderAt adapter.
+	g := newTestGray32(16, 16)
+	m, err := Decode(struct{ *bytes.Reader }{bytes.NewReader(encodeToBytes(t, g))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*Gray32).Pix, g.Pix)
+}
+
+func benchmarkDecode(b *testing.B, generic bool) {
+	data := encodeToBytes(b, newTestGrayFloat32(1024, 1024))
+	fastPathDisabled = generic
+	defer func() { fastPathDisabled = false }()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeUncompressedDirect(b *testing.B)  { benchmarkDecode(b, false) }
+func BenchmarkDecodeUncompressedGeneric(b *testing.B) { benchmarkDecode(b, true) }
+
+// encodeStrips writes m as a little-endian TIFF with the given number of
+// rows per strip, passing the data of every strip through compress.
+func encodeStrips(t testing.TB, m *Gray32, rowsPerStrip int, compression uint32, compress func([]byte) []byte) []byte {
+	dx, dy := m.Rect.Dx(), m.Rect.Dy()
+	var data bytes.Buffer
+	var offsets, counts []uint32
+	for y := 0; y < dy; y += rowsPerStrip {
+		rows := rowsPerStrip
+		if y+rows > dy {
+			rows = dy - y
+		}
+		raw := make([]byte, 4*dx*rows)
+		packGray32Rows(raw, m.Pix[y*m.Stride:], dx, m.Stride, 0, rows, false)
+		offsets = append(offsets, uint32(8+data.Len()))
+		c := compress(raw)
+		counts = append(counts, uint32(len(c)))
+		data.Write(c)
+	}
+	l := imageLayout{
+		width:           dx,
+		height:          dy,
+		bitsPerSample:   []uint32{32},
+		samplesPerPixel: 1,
+		photometric:     PhotometricBlackIsZero,
+		compression:     compression,
+		predictor:       PredictorNone,
+		sampleFormat:    SampleFormatUint,
+		rowsPerStrip:    rowsPerStrip,
+		blockOffsets:    offsets,
+		blockByteCounts: counts,
+	}
+	var buf bytes.Buffer
+	buf.WriteString(leHeader)
+	binary.Write(&buf, binary.LittleEndian, uint32(8+data.Len()))
+	data.WriteTo(&buf)
+	if err := writeIFD(&buf, buf.Len(), l.appendEntries(nil), 0); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func deflate(p []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(p)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestReaderOptions(t *testing.T) {
+	g := newTestGray32(50, 47)
+	data := encodeStrips(t, g, 5, CompressionDeflate, deflate)
+	for _, opt := range []*ReaderOptions{
+		nil,
+		{Workers: 1},
+		{Workers: 3, ReadAhead: -1},
+		{Workers: 4, ReadAhead: 2, BufferSize: 16},
+	} {
+		r, err := NewReaderWithOptions(bytes.NewReader(data), opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("%+v: %v", opt, err)
+		}
+		comparePix(t, m.(*Gray32).Pix, g.Pix)
+	}
+}
+
+func TestChopSize(t *testing.T) {
+	g := newTestGray32(37, 50)
+	f := newTestGrayFloat32(37, 50)
+	var predicted bytes.Buffer
+	if err := Encode(&predicted, f, &tiff.Options{Compression: tiff.Deflate, Predictor: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		pix  []uint32
+	}{
+		{"uncompressed", encodeStrips(t, g, 50, CompressionNone, func(p []byte) []byte { return p }), g.Pix},
+		{"deflate", encodeStrips(t, g, 50, CompressionDeflate, deflate), g.Pix},
+		{"predictor", predicted.Bytes(), f.Pix},
+	} {
+		for _, workers := range []int{1, 3} {
+			r, err := NewReaderWithOptions(bytes.NewReader(tc.data), &ReaderOptions{ChopSize: 3*37*4 + 5, Workers: workers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rect := range []image.Rectangle{r.Bounds(), image.Rect(3, 7, 20, 41), image.Rect(0, 49, 37, 50)} {
+				m, err := r.ReadRegion(rect)
+				if err != nil {
+					t.Fatalf("%s: %v: %v", tc.name, rect, err)
+				}
+				var got []uint32
+				switch m := m.(type) {
+				case *Gray32:
+					got = m.Pix
+				case *GrayFloat32:
+					got = m.Pix
+				}
+				for y := rect.Min.Y; y < rect.Max.Y; y++ {
+					for x := rect.Min.X; x < rect.Max.X; x++ {
+						if v, want := got[(y-rect.Min.Y)*rect.Dx()+x-rect.Min.X], tc.pix[y*37+x]; v != want {
+							t.Fatalf("%s: %v: pixel (%d, %d) = %#x, want %#x", tc.name, rect, x, y, v, want)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Truncated data is reported rather than decoded short.
+	data := encodeStrips(t, g, 50, CompressionDeflate, func(p []byte) []byte { return deflate(p)[:100] })
+	r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{ChopSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadRegion(r.Bounds()); err == nil {
+		t.Error("truncated strip decoded without error")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	g := newTestGray32(50, 47)
+	gray := image.NewGray(image.Rect(0, 0, 50, 47))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	encode := func(e *Encoder, pages ...Page) []byte {
+		var buf bytes.Buffer
+		if err := e.EncodeAll(&buf, pages); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	deflated := &tiff.Options{Compression: tiff.Deflate}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"uncompressed strips", encodeStrips(t, g, 5, CompressionNone, func(p []byte) []byte { return p })},
+		{"deflate strips", encodeStrips(t, g, 5, CompressionDeflate, deflate)},
+		{"deflate tiles", encode(&Encoder{Options: deflated}, Page{Image: g, TileWidth: 16, TileHeight: 32})},
+		{"LERC tiles", encode(&Encoder{LERC: &LERCOptions{}}, Page{Image: g, TileWidth: 16, TileHeight: 16})},
+		{"JPEG", encode(&Encoder{}, Page{Image: gray, JPEG: &jpeg.Options{Quality: 90}})},
+	} {
+		for _, opt := range []*ReaderOptions{{Strict: true}, {Strict: true, ChopSize: 300}} {
+			r, err := NewReaderWithOptions(bytes.NewReader(tc.data), opt)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if _, err := r.ReadRegion(r.Bounds()); err != nil {
+				t.Errorf("%s, %+v: %v", tc.name, opt, err)
+			}
+		}
+	}
+
+	// file returns an image of 16×4 pixels in strips of two rows, or if
+	// tiled of 32×16 pixels in tiles of 16×16, with 256 bytes of data.
+	file := func(tiled bool, compression uint32, offsets, counts []uint32) []byte {
+		l := imageLayout{
+			width:           16,
+			height:          4,
+			bitsPerSample:   []uint32{32},
+			samplesPerPixel: 1,
+			photometric:     PhotometricBlackIsZero,
+			compression:     compression,
+			predictor:       PredictorNone,
+			sampleFormat:    SampleFormatUint,
+			rowsPerStrip:    2,
+			blockOffsets:    offsets,
+			blockByteCounts: counts,
+		}
+		if tiled {
+			l.width, l.height, l.tileWidth, l.tileHeight = 32, 16, 16, 16
+		}
+		var buf bytes.Buffer
+		buf.WriteString(leHeader)
+		binary.Write(&buf, binary.LittleEndian, uint32(8+256))
+		buf.Write(make([]byte, 256))
+		if err := writeIFD(&buf, buf.Len(), l.appendEntries(nil), 0); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	for _, tc := range []struct {
+		name, err string
+		data      []byte
+	}{
+		{"overlap", "strip 1 (bytes 108-235) overlaps strip 0 (bytes 8-135)",
+			file(false, CompressionNone, []uint32{8, 108}, []uint32{128, 128})},
+		{"tiles", "tile 1 (bytes 20-35) overlaps tile 0 (bytes 8-23)",
+			file(true, CompressionDeflate, []uint32{8, 20}, []uint32{16, 16})},
+		{"IFD", "the IFD (bytes 264-",
+			file(false, CompressionNone, []uint32{8, 200}, []uint32{128, 128})},
+		{"count", "strip 1 holds 100 bytes, expected 128",
+			file(false, CompressionNone, []uint32{8, 136}, []uint32{128, 100})},
+	} {
+		if _, err := NewReader(bytes.NewReader(tc.data)); err != nil {
+			t.Errorf("%s: without Strict: %v", tc.name, err)
+		}
+		_, err := NewReaderWithOptions(bytes.NewReader(tc.data), &ReaderOptions{Strict: true})
+		if _, ok := err.(FormatError); !ok || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got %v, want a FormatError containing %q", tc.name, err, tc.err)
+		}
+	}
+
+	// Blocks sharing the same data are allowed.
+	shared := file(false, CompressionNone, []uint32{8, 8}, []uint32{128, 128})
+	if _, err := NewReaderWithOptions(bytes.NewReader(shared), &ReaderOptions{Strict: true}); err != nil {
+		t.Errorf("shared strips: %v", err)
+	}
+
+	// The size of compressed strips is checked as they are decoded.
+	small := newTestGray32(16, 4)
+	for _, tc := range []struct {
+		name, err string
+		compress  func([]byte) []byte
+	}{
+		{"short", "strip 0 decompresses to 124 bytes, expected 128", func(p []byte) []byte { return deflate(p[:len(p)-4]) }},
+		{"long", "strip 0 decompresses to more than 128 bytes", func(p []byte) []byte { return deflate(append(p, 1, 2)) }},
+	} {
+		data := encodeStrips(t, small, 2, CompressionDeflate, tc.compress)
+		for _, chop := range []int{0, 100} {
+			r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Strict: true, Workers: 1, ChopSize: chop})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = r.ReadRegion(r.Bounds())
+			if err == nil || err.Error() != "tiff: invalid format: "+tc.err {
+				t.Errorf("%s, ChopSize %d: got %v, want %q", tc.name, chop, err, tc.err)
+			}
+		}
+	}
+}
+
+// defectiveFile returns a file holding the pixels of m uncompressed from
+// offset 8, in strips of the given number of rows, described by the IFD
+// entries of l as changed by edit. The entries are written in reverse
+// order if reverse is set.
+func defectiveFile(t *testing.T, m *Gray32, rowsPerStrip int, edit func([]ifdEntry) []ifdEntry, reverse bool) []byte {
+	dx, dy := m.Rect.Dx(), m.Rect.Dy()
+	data := make([]byte, 4*dx*dy)
+	packGray32Rows(data, m.Pix, dx, m.Stride, 0, dy, false)
+	l := imageLayout{
+		width:           dx,
+		height:          dy,
+		bitsPerSample:   []uint32{32},
+		samplesPerPixel: 1,
+		photometric:     PhotometricBlackIsZero,
+		compression:     CompressionNone,
+		predictor:       PredictorNone,
+		sampleFormat:    SampleFormatUint,
+		rowsPerStrip:    rowsPerStrip,
+	}
+	for y := 0; y < dy; y += rowsPerStrip {
+		l.blockOffsets = append(l.blockOffsets, uint32(8+4*dx*y))
+		l.blockByteCounts = append(l.blockByteCounts, uint32(4*dx*min(rowsPerStrip, dy-y)))
+	}
+	entries := edit(l.appendEntries(nil))
+	var buf bytes.Buffer
+	buf.WriteString(leHeader)
+	binary.Write(&buf, binary.LittleEndian, uint32(8+len(data)))
+	buf.Write(data)
+	if err := writeIFD(&buf, buf.Len(), entries, 0); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if reverse {
+		p := b[8+len(data)+2:][:ifdLen*len(entries)]
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			var e [ifdLen]byte
+			copy(e[:], p[ifdLen*i:])
+			copy(p[ifdLen*i:], p[ifdLen*j:][:ifdLen])
+			copy(p[ifdLen*j:], e[:])
+		}
+	}
+	return b
+}
+
+func TestRepair(t *testing.T) {
+	// withEntry replaces or removes the entry for a tag.
+	withEntry := func(tag int, e *ifdEntry) func([]ifdEntry) []ifdEntry {
+		return func(ifd []ifdEntry) []ifdEntry {
+			for i := range ifd {
+				if ifd[i].tag == tag {
+					if e == nil {
+						return append(ifd[:i], ifd[i+1:]...)
+					}
+					ifd[i] = *e
+				}
+			}
+			return ifd
+		}
+	}
+	keep := func(ifd []ifdEntry) []ifdEntry { return ifd }
+	small, large := newTestGray32(40, 30), newTestGray32(200, 100)
+	for _, tc := range []struct {
+		name   string
+		m      *Gray32
+		data   []byte
+		tags   []int
+		blocks int
+	}{
+		{"order", small, defectiveFile(t, small, 5, keep, true), []int{0}, 6},
+		{"duplicate", small, defectiveFile(t, small, 5, func(ifd []ifdEntry) []ifdEntry {
+			return append(ifd, asciiEntry(TagImageDescription, "one"), asciiEntry(TagImageDescription, "two"))
+		}, false), []int{TagImageDescription}, 6},
+		{"SampleFormat", small, defectiveFile(t, small, 5, withEntry(TagSampleFormat, nil), false), []int{TagSampleFormat}, 6},
+		{"RowsPerStrip", small, defectiveFile(t, small, 5, withEntry(TagRowsPerStrip, &ifdEntry{TagRowsPerStrip, TypeShort, []uint32{7}}), false), []int{TagRowsPerStrip}, 6},
+		{"no RowsPerStrip", small, defectiveFile(t, small, 4, withEntry(TagRowsPerStrip, nil), true), []int{0, TagRowsPerStrip}, 8},
+		{"oversized strip", large, defectiveFile(t, large, 100, keep, false), []int{TagStripOffsets}, 2},
+	} {
+		var out bytes.Buffer
+		rep, err := Repair(bytes.NewReader(tc.data), &out)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var tags []int
+		for _, f := range rep.Fixes {
+			tags = append(tags, f.Tag)
+		}
+		if !reflect.DeepEqual(tags, tc.tags) {
+			t.Errorf("%s: fixed %v, want tags %v", tc.name, rep.Fixes, tc.tags)
+		}
+		// The pixel data is copied as it is.
+		n := 4 * len(tc.m.Pix)
+		if !bytes.Equal(out.Bytes()[8:8+n], tc.data[8:8+n]) {
+			t.Errorf("%s: pixel data changed", tc.name)
+		}
+		r, err := NewReaderWithOptions(bytes.NewReader(out.Bytes()), &ReaderOptions{Strict: true})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := r.d.blocksAcross * r.d.blocksDown; got != tc.blocks {
+			t.Errorf("%s: %d strips, want %d", tc.name, got, tc.blocks)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		comparePix(t, m.(*Gray32).Pix, tc.m.Pix)
+
+		// A repaired file needs no more repair.
+		var again bytes.Buffer
+		if rep, err := Repair(bytes.NewReader(out.Bytes()), &again); err != nil || len(rep.Fixes) != 0 {
+			t.Errorf("%s: repairing again: %v, %v", tc.name, rep.Fixes, err)
+		} else if !bytes.Equal(again.Bytes(), out.Bytes()) {
+			t.Errorf("%s: sound file changed", tc.name)
+		}
+	}
+
+	// Strips from which no RowsPerStrip can be worked out.
+	bad := defectiveFile(t, small, 5, func(ifd []ifdEntry) []ifdEntry {
+		offsets := []uint32{8, 16, 24, 32, 40, 48, 56}
+		ifd = withEntry(TagStripOffsets, &ifdEntry{TagStripOffsets, TypeLong, offsets})(ifd)
+		ifd = withEntry(TagStripByteCounts, &ifdEntry{TagStripByteCounts, TypeLong, repeatValue(8, 7)})(ifd)
+		return withEntry(TagCompression, &ifdEntry{TagCompression, TypeShort, []uint32{CompressionDeflate}})(ifd)
+	}, false)
+	if _, err := Repair(bytes.NewReader(bad), io.Discard); err == nil || err.Error() != "tiff: invalid format: image 0: no RowsPerStrip fits 7 strips" {
+		t.Errorf("7 strips of 30 rows: got %v", err)
+	}
+	if _, err := Repair(strings.NewReader(beHeader+"\x00\x00\x00\x08"), io.Discard); !errors.As(err, new(UnsupportedError)) {
+		t.Errorf("big-endian file: got %v, want an UnsupportedError", err)
+	}
+}
+
+// transcodeFields returns the fields of the first IFD of the file in data
+// that Transcode copies, and the IFDs they point to.
+func transcodeFields(t *testing.T, data []byte) ([]ifdEntry, map[int]*ifdTree) {
+	t.Helper()
+	tree, err := readIFDTree(bytes.NewReader(data), binary.LittleEndian, int64(binary.LittleEndian.Uint32(data[4:8])), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []ifdEntry
+	for _, e := range tree.entries {
+		if !storageTags[e.tag] && !pointerTags[e.tag] {
+			fields = append(fields, e)
+		}
+	}
+	return fields, tree.subs
+}
+
+func TestTranscode(t *testing.T) {
+	g := newTestGray32(40, 30)
+	exif := &IFD{}
+	exif.AddASCII(36867, "2019:01:02 03:04:05") // DateTimeOriginal
+	exif.AddRational(33434, [2]uint32{1, 250})  // ExposureTime
+	var exifOff int
+	src := defectiveFile(t, g, 5, func(ifd []ifdEntry) []ifdEntry {
+		ifd = append(ifd, asciiEntry(65000, "private"), ifdEntry{TagExifIFD, TypeLong, []uint32{0}})
+		exifOff = 8 + 4*len(g.Pix) + ifdSize(ifd)
+		exifOff += exifOff % 2
+		ifd[len(ifd)-1].data[0] = uint32(exifOff)
+		return ifd
+	}, false)
+	var buf bytes.Buffer
+	buf.Write(src)
+	buf.Write(make([]byte, exifOff-len(src)))
+	if err := exif.Write(&buf, int64(exifOff), 0); err != nil {
+		t.Fatal(err)
+	}
+	src = buf.Bytes()
+	fields, subs := transcodeFields(t, src)
+
+	data := src
+	for _, opt := range []*TranscodeOptions{
+		{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 16, TileHeight: 32},
+		{Options: &tiff.Options{Compression: tiff.Deflate}},
+		nil,
+	} {
+		var out bytes.Buffer
+		if err := Transcode(&out, bytes.NewReader(data), opt); err != nil {
+			t.Fatalf("%+v: %v", opt, err)
+		}
+		data = out.Bytes()
+		r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Strict: true})
+		if err != nil {
+			t.Fatalf("%+v: %v", opt, err)
+		}
+		want := uint(CompressionNone)
+		if opt != nil {
+			want = CompressionDeflate
+		}
+		if c := r.d.firstVal(TagCompression); c != want {
+			t.Errorf("%+v: Compression %d, want %d", opt, c, want)
+		}
+		if tiled := opt != nil && opt.TileWidth > 0; r.d.blockPadding != tiled {
+			t.Errorf("%+v: tiled = %v", opt, r.d.blockPadding)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("%+v: %v", opt, err)
+		}
+		comparePix(t, m.(*Gray32).Pix, g.Pix)
+		gotFields, gotSubs := transcodeFields(t, data)
+		if !reflect.DeepEqual(gotFields, fields) {
+			t.Errorf("%+v: fields\n%v\nwant\n%v", opt, gotFields, fields)
+		}
+		if len(gotSubs) != 1 || !reflect.DeepEqual(gotSubs[TagExifIFD].entries, subs[TagExifIFD].entries) {
+			t.Errorf("%+v: EXIF IFD %v, want %v", opt, gotSubs[TagExifIFD], subs[TagExifIFD])
+		}
+	}
+
+	// Every image of a file is transcoded, whatever its samples.
+	rgb := image.NewNRGBA(image.Rect(0, 0, 33, 21))
+	gray16 := image.NewGray16(image.Rect(0, 0, 17, 40))
+	palette := color.Palette{color.Black, color.White, color.RGBA{0x10, 0x80, 0xf0, 0xff}}
+	paletted := image.NewPaletted(image.Rect(0, 0, 20, 20), palette)
+	for i := range rgb.Pix {
+		rgb.Pix[i] = uint8(i * 13)
+	}
+	for i := range gray16.Pix {
+		gray16.Pix[i] = uint8(i * 91)
+	}
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % 3)
+	}
+	buf.Reset()
+	pages := []Page{{Image: g}, {Image: rgb, TileWidth: 16, TileHeight: 16}}
+	if err := EncodeAll(&buf, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	var gray16File, palettedFile bytes.Buffer
+	if err := tiff.Encode(&gray16File, gray16, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tiff.Encode(&palettedFile, paletted, nil); err != nil {
+		t.Fatal(err)
+	}
+	bilevel := encodeLayout(t, imageLayout{
+		width: 10, height: 2, bitsPerSample: []uint32{1}, samplesPerPixel: 1, photometric: PhotometricBlackIsZero,
+		compression: CompressionNone, predictor: PredictorNone, sampleFormat: SampleFormatUint,
+	}, []byte{0xa5, 0xc0, 0x0f, 0x40})
+	// A big-endian image of 3×2 16-bit samples.
+	be := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x07" +
+		"\x01\x00\x00\x03\x00\x00\x00\x01\x00\x03\x00\x00" + // ImageWidth
+		"\x01\x01\x00\x03\x00\x00\x00\x01\x00\x02\x00\x00" + // ImageLength
+		"\x01\x02\x00\x03\x00\x00\x00\x01\x00\x10\x00\x00" + // BitsPerSample
+		"\x01\x06\x00\x03\x00\x00\x00\x01\x00\x01\x00\x00" + // PhotometricInterpretation
+		"\x01\x11\x00\x04\x00\x00\x00\x01\x00\x00\x00\x5a" + // StripOffsets
+		"\x01\x16\x00\x03\x00\x00\x00\x01\x00\x02\x00\x00" + // RowsPerStrip
+		"\x01\x17\x00\x04\x00\x00\x00\x01\x00\x00\x00\x0c" + // StripByteCounts
+		"\x00\x00\x00\x00" +
+		"\x12\x34\x00\x01\xff\x00\x80\x80\x00\x10\xab\xcd")
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"pages", buf.Bytes()},
+		{"gray16", gray16File.Bytes()},
+		{"paletted", palettedFile.Bytes()},
+		{"bilevel", bilevel},
+		{"big-endian", be},
+	} {
+		for _, opt := range []*TranscodeOptions{
+			{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: tc.name != "bilevel"}, TileWidth: 16, TileHeight: 16},
+			{Options: &tiff.Options{Compression: tiff.Deflate}},
+		} {
+			var out bytes.Buffer
+			if err := Transcode(&out, bytes.NewReader(tc.data), opt); err != nil {
+				t.Fatalf("%s, %+v: %v", tc.name, opt, err)
+			}
+			src, err := NewReader(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			images, err := src.NumImages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < images; i++ {
+				want, err := decodeImage(bytes.NewReader(tc.data), i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := decodeImage(bytes.NewReader(out.Bytes()), i)
+				if err != nil {
+					t.Fatalf("%s, %+v: image %d: %v", tc.name, opt, i, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s, %+v: image %d differs", tc.name, opt, i)
+				}
+			}
+		}
+	}
+
+	// JPEG compressed color is subsampled.
+	opaque := image.NewRGBA(rgb.Rect)
+	for i := range opaque.Pix {
+		opaque.Pix[i] = 0xff
+	}
+	buf.Reset()
+	if err := (&Encoder{JPEG: &jpeg.Options{Quality: 90}}).Encode(&buf, opaque); err != nil {
+		t.Fatal(err)
+	}
+	if err := Transcode(io.Discard, bytes.NewReader(buf.Bytes()), nil); !errors.As(err, new(UnsupportedError)) {
+		t.Errorf("JPEG YCbCr: got %v, want an UnsupportedError", err)
+	}
+}
+
+// decodeImage decodes image i of the file in r.
+func decodeImage(r io.ReaderAt, i int) (image.Image, error) {
+	rd, err := NewReaderWithOptions(r, &ReaderOptions{Image: i})
+	if err != nil {
+		return nil, err
+	}
+	return rd.ReadRegion(rd.Bounds())
+}
+
+// memFile is a file held in memory, growing as it is written.
+type memFile []byte
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(*f)) {
+		return 0, io.EOF
+	}
+	n := copy(p, (*f)[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(*f)) {
+		*f = append(*f, make([]byte, end-int64(len(*f)))...)
+	}
+	return copy((*f)[off:], p), nil
+}
+
+func (f *memFile) Size() int64 { return int64(len(*f)) }
+
+func TestRegenerateOverviews(t *testing.T) {
+	full := NewGray32(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			full.SetGray32(x, y, Gray32Color{uint32(x + 100*y)})
+		}
+	}
+	pages := []Page{
+		{Image: full},
+		{Image: NewGray32(image.Rect(0, 0, 32, 24)), Type: SubfileReducedResolution,
+			Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 16, TileHeight: 16},
+		{Image: NewGray32(image.Rect(0, 0, 16, 12)), Type: SubfileReducedResolution, Options: &tiff.Options{}},
+	}
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	f := memFile(buf.Bytes())
+	tests := []struct {
+		resampling Resampling
+		want       [2]func(x, y int) uint32
+	}{
+		// The mean of a 2×2 block is 2x+200y+50.5 and of a 4×4 block
+		// 4x+400y+151.5, both rounded up.
+		{ResampleAverage, [2]func(x, y int) uint32{
+			func(x, y int) uint32 { return uint32(2*x + 200*y + 51) },
+			func(x, y int) uint32 { return uint32(4*x + 400*y + 152) },
+		}},
+		{ResampleNearest, [2]func(x, y int) uint32{
+			func(x, y int) uint32 { return uint32(2*x + 1 + 100*(2*y+1)) },
+			func(x, y int) uint32 { return uint32(4*x + 2 + 100*(4*y+2)) },
+		}},
+	}
+	for _, tt := range tests {
+		if err := RegenerateOverviews(&f, tt.resampling); err != nil {
+			t.Fatalf("resampling %d: %v", tt.resampling, err)
+		}
+		m, err := decodeImage(bytes.NewReader(f), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m.(*Gray32).Pix, full.Pix) {
+			t.Errorf("resampling %d: the full-resolution image changed", tt.resampling)
+		}
+		for i, want := range tt.want {
+			r, err := NewReaderWithOptions(bytes.NewReader(f), &ReaderOptions{Image: i + 1, Strict: true})
+			if err != nil {
+				t.Fatalf("resampling %d, overview %d: %v", tt.resampling, i, err)
+			}
+			m, err := r.ReadRegion(r.Bounds())
+			if err != nil {
+				t.Fatalf("resampling %d, overview %d: %v", tt.resampling, i, err)
+			}
+			g := m.(*Gray32)
+			for y := g.Rect.Min.Y; y < g.Rect.Max.Y; y++ {
+				for x := g.Rect.Min.X; x < g.Rect.Max.X; x++ {
+					if got := g.Gray32At(x, y).Y; got != want(x, y) {
+						t.Fatalf("resampling %d, overview %d: pixel (%d, %d) = %d, want %d",
+							tt.resampling, i, x, y, got, want(x, y))
+					}
+				}
+			}
+		}
+	}
+
+	// NaN and NoData are left out of means.
+	nan, noData := float32(math.NaN()), float32(-1)
+	frac := NewGrayFloat32(image.Rect(0, 0, 4, 2))
+	frac.SetRow(0, []float32{1, noData, nan, nan})
+	frac.SetRow(1, []float32{3, noData, nan, noData})
+	nd := float64(noData)
+	buf.Reset()
+	pages = []Page{
+		{Image: frac, Metadata: &Metadata{NoData: &nd}},
+		{Image: NewGrayFloat32(image.Rect(0, 0, 2, 1)), Type: SubfileReducedResolution},
+	}
+	if err := EncodeAll(&buf, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	f = memFile(buf.Bytes())
+	if err := RegenerateOverviews(&f, ResampleAverage); err != nil {
+		t.Fatal(err)
+	}
+	m, err := decodeImage(bytes.NewReader(f), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.(*GrayFloat32).Row(0); got[0] != 2 || got[1] != noData {
+		t.Errorf("NoData overview = %v, want [2 %v]", got, noData)
+	}
+
+	// LERC overviews cannot be rewritten.
+	buf.Reset()
+	pages = []Page{{Image: full}, {Image: NewGray32(image.Rect(0, 0, 32, 24)), Type: SubfileReducedResolution}}
+	if err := (&Encoder{LERC: &LERCOptions{}}).EncodeAll(&buf, pages); err != nil {
+		t.Fatal(err)
+	}
+	f = memFile(buf.Bytes())
+	if err := RegenerateOverviews(&f, ResampleAverage); !errors.As(err, new(UnsupportedError)) {
+		t.Errorf("LERC: got %v, want an UnsupportedError", err)
+	}
+}
+
+// seekFile is a memFile read and written through an offset.
+type seekFile struct {
+	f   *memFile
+	off int64
+}
+
+func (s *seekFile) Read(p []byte) (int, error) {
+	n, err := s.f.ReadAt(p, s.off)
+	s.off += int64(n)
+	if n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *seekFile) Write(p []byte) (int, error) {
+	n, err := s.f.WriteAt(p, s.off)
+	s.off += int64(n)
+	return n, err
+}
+
+func (s *seekFile) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		off += s.off
+	case io.SeekEnd:
+		off += s.f.Size()
+	}
+	s.off = off
+	return off, nil
+}
+
+func TestWriteRegion(t *testing.T) {
+	m := newTestGray32(50, 40)
+	patch := NewGray32(image.Rect(0, 0, 50, 40))
+	for i := range patch.Pix {
+		patch.Pix[i] = uint32(i)
+	}
+	rect := image.Rect(10, 5, 45, 30)
+	want := NewGray32(m.Rect)
+	copy(want.Pix, m.Pix)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			want.SetGray32(x, y, patch.Gray32At(x, y))
+		}
+	}
+	for _, tw := range []int{0, 16} {
+		var buf bytes.Buffer
+		if err := EncodeAll(&buf, []Page{{Image: m, TileWidth: tw, TileHeight: tw}}, nil); err != nil {
+			t.Fatal(err)
+		}
+		size := buf.Len()
+		f := memFile(buf.Bytes())
+		if err := WriteRegion(&seekFile{f: &f}, rect, patch); err != nil {
+			t.Fatalf("tile width %d: %v", tw, err)
+		}
+		if len(f) != size {
+			t.Errorf("tile width %d: file grew from %d to %d bytes", tw, size, len(f))
+		}
+		got, err := decodeImage(bytes.NewReader(f), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.(*Gray32).Pix, want.Pix) {
+			t.Errorf("tile width %d: pixels differ from the patched image", tw)
+		}
+	}
+
+	// Other images are converted to the samples of 8-bit gray files.
+	var buf bytes.Buffer
+	gray := image.NewGray(image.Rect(0, 0, 8, 4))
+	if err := tiff.Encode(&buf, gray, nil); err != nil {
+		t.Fatal(err)
+	}
+	f := memFile(buf.Bytes())
+	white := image.NewUniform(color.White)
+	if err := WriteRegion(&seekFile{f: &f}, image.Rect(2, 1, 4, 3), white); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeImage(bytes.NewReader(f), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			in := image.Pt(x, y).In(image.Rect(2, 1, 4, 3))
+			if v := got.(*image.Gray).GrayAt(x, y).Y; (v == 0xff) != in {
+				t.Errorf("gray pixel (%d, %d) = %d", x, y, v)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		opt  *tiff.Options
+		rect image.Rectangle
+		src  image.Image
+	}{
+		{"compressed", &tiff.Options{Compression: tiff.Deflate}, rect, patch},
+		{"outside", nil, image.Rect(40, 30, 60, 40), patch},
+		{"float source", nil, rect, newTestGrayFloat32(50, 40)},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, tc.opt); err != nil {
+			t.Fatal(err)
+		}
+		f := memFile(buf.Bytes())
+		if err := WriteRegion(&seekFile{f: &f}, tc.rect, tc.src); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+		if !bytes.Equal(f, buf.Bytes()) {
+			t.Errorf("%s: file modified", tc.name)
+		}
+	}
+}
+
+func TestEditSession(t *testing.T) {
+	m := newTestGray32(100, 70)
+	overview := newTestGray32(50, 35)
+	var buf bytes.Buffer
+	pages := []Page{
+		{Image: m, TileWidth: 32, TileHeight: 32},
+		{Image: overview, Type: SubfileReducedResolution},
+	}
+	if err := EncodeAll(&buf, pages, &tiff.Options{Compression: tiff.Deflate, Predictor: true}); err != nil {
+		t.Fatal(err)
+	}
+	orig := append([]byte(nil), buf.Bytes()...)
+	s, err := NewEditSession(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := NewGray32(image.Rect(0, 0, 100, 70))
+	for i := range patch.Pix {
+		patch.Pix[i] = uint32(i)
+	}
+	want := NewGray32(m.Rect)
+	copy(want.Pix, m.Pix)
+	for _, r := range []image.Rectangle{image.Rect(20, 10, 70, 40), image.Rect(90, 60, 100, 70)} {
+		if err := s.WriteRegion(r, patch); err != nil {
+			t.Fatal(err)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				want.SetGray32(x, y, patch.Gray32At(x, y))
+			}
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), orig) {
+		t.Error("the source changed")
+	}
+	got, err := s.ReadRegion(image.Rect(10, 5, 95, 65))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := got.(*Gray32)
+	for y := g.Rect.Min.Y; y < g.Rect.Max.Y; y++ {
+		for x := g.Rect.Min.X; x < g.Rect.Max.X; x++ {
+			if g.Gray32At(x, y) != want.Gray32At(x, y) {
+				t.Fatalf("ReadRegion: pixel (%d, %d) = %v, want %v", x, y, g.Gray32At(x, y), want.Gray32At(x, y))
+			}
+		}
+	}
+
+	var out, again bytes.Buffer
+	if err := s.Commit(&out); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), again.Bytes()) {
+		t.Error("a second Commit wrote another file")
+	}
+	for i, want := range []*Gray32{want, overview} {
+		r, err := NewReaderWithOptions(bytes.NewReader(out.Bytes()), &ReaderOptions{Image: i, Strict: true})
+		if err != nil {
+			t.Fatalf("image %d: %v", i, err)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("image %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(m.(*Gray32).Pix, want.Pix) {
+			t.Errorf("image %d: pixels differ from the edited image", i)
+		}
+	}
+
+	// Strips of 8-bit gray.
+	buf.Reset()
+	gray := image.NewGray(image.Rect(0, 0, 30, 20))
+	if err := tiff.Encode(&buf, gray, &tiff.Options{Compression: tiff.Deflate, Predictor: true}); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewEditSession(bytes.NewReader(buf.Bytes()), nil); err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(5, 5, 25, 15)
+	if err := s.WriteRegion(rect, image.NewUniform(color.White)); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := s.Commit(&out); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := decodeImage(bytes.NewReader(out.Bytes()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 30; x++ {
+			if v := m2.(*image.Gray).GrayAt(x, y).Y; (v == 0xff) != image.Pt(x, y).In(rect) {
+				t.Fatalf("gray pixel (%d, %d) = %d", x, y, v)
+			}
+		}
+	}
+
+	buf.Reset()
+	if err := (&Encoder{LERC: &LERCOptions{}}).Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEditSession(bytes.NewReader(buf.Bytes()), nil); !errors.As(err, new(UnsupportedError)) {
+		t.Errorf("LERC: got %v, want an UnsupportedError", err)
+	}
+}
+
+// The blocks rewritten by EditSession.Commit, WriteRegion and
+// RegenerateOverviews keep matching their checksums.
+func TestRewrittenChecksums(t *testing.T) {
+	m := newTestGray32(50, 40)
+	patch := NewGray32(m.Rect)
+	for i := range patch.Pix {
+		patch.Pix[i] = uint32(i)
+	}
+	rect := image.Rect(10, 5, 45, 30)
+	verify := func(name string, data []byte, images int) {
+		t.Helper()
+		for i := range images {
+			r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Image: i, VerifyChecksums: true})
+			if err != nil {
+				t.Fatalf("%s, image %d: %v", name, i, err)
+			}
+			if _, err := r.ReadRegion(r.Bounds()); err != nil {
+				t.Errorf("%s, image %d: %v", name, i, err)
+			}
+		}
+	}
+	pages := []Page{
+		{Image: m, TileWidth: 16, TileHeight: 16},
+		{Image: NewGray32(image.Rect(0, 0, 25, 20)), Type: SubfileReducedResolution},
+	}
+	for _, tc := range []struct {
+		name string
+		opt  *tiff.Options
+	}{
+		{"uncompressed", &tiff.Options{}},
+		{"deflate", &tiff.Options{Compression: tiff.Deflate, Predictor: true}},
+	} {
+		var buf bytes.Buffer
+		if err := (&Encoder{Options: tc.opt, BlockChecksums: true}).EncodeAll(&buf, pages); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewEditSession(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteRegion(rect, patch); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := s.Commit(&out); err != nil {
+			t.Fatal(err)
+		}
+		verify(tc.name+", Commit", out.Bytes(), 2)
+
+		f := memFile(out.Bytes())
+		if err := RegenerateOverviews(&f, ResampleAverage); err != nil {
+			t.Fatal(err)
+		}
+		verify(tc.name+", RegenerateOverviews", f, 2)
+
+		if tc.opt.Compression == tiff.Uncompressed {
+			f := memFile(buf.Bytes())
+			if err := WriteRegion(&seekFile{f: &f}, rect, patch); err != nil {
+				t.Fatal(err)
+			}
+			verify(tc.name+", WriteRegion", f, 1)
+		}
+	}
+}
+
+func TestEncodeOverviews(t *testing.T) {
+	full := NewGray32(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			full.SetGray32(x, y, Gray32Color{uint32(x + 100*y)})
+		}
+	}
+	var src, ovr bytes.Buffer
+	pages := []Page{{Image: full}, {Image: NewGray32(image.Rect(0, 0, 8, 6)), Type: SubfileReducedResolution}}
+	if err := EncodeAll(&src, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	orig := append([]byte(nil), src.Bytes()...)
+	opt := &OverviewOptions{
+		Levels:    []int{2, 4},
+		Options:   &tiff.Options{Compression: tiff.Deflate, Predictor: true},
+		TileWidth: 16, TileHeight: 16,
+	}
+	if err := EncodeOverviews(&ovr, bytes.NewReader(src.Bytes()), opt); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src.Bytes(), orig) {
+		t.Error("the source changed")
+	}
+	overviews, err := Overviews(bytes.NewReader(src.Bytes()), bytes.NewReader(ovr.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var widths []int
+	for _, r := range overviews {
+		widths = append(widths, r.Bounds().Dx())
+	}
+	if want := []int{32, 16, 8}; !reflect.DeepEqual(widths, want) {
+		t.Fatalf("overview widths %v, want %v", widths, want)
+	}
+	// The means are rounded up, as for TestRegenerateOverviews.
+	for i, want := range []func(x, y int) uint32{
+		func(x, y int) uint32 { return uint32(2*x + 200*y + 51) },
+		func(x, y int) uint32 { return uint32(4*x + 400*y + 152) },
+	} {
+		r := overviews[i]
+		if r.SubfileType() != SubfileReducedResolution {
+			t.Errorf("overview %d: SubfileType %d", i, r.SubfileType())
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("overview %d: %v", i, err)
+		}
+		g := m.(*Gray32)
+		for y := g.Rect.Min.Y; y < g.Rect.Max.Y; y++ {
+			for x := g.Rect.Min.X; x < g.Rect.Max.X; x++ {
+				if got := g.Gray32At(x, y).Y; got != want(x, y) {
+					t.Fatalf("overview %d: pixel (%d, %d) = %d, want %d", i, x, y, got, want(x, y))
+				}
+			}
+		}
+	}
+
+	// By default, the image is halved down to 256×256 pixels, and the
+	// description of its samples is kept.
+	nd := -9999.0
+	ovr.Reset()
+	src.Reset()
+	if err := EncodeWithMetadata(&src, newTestGrayFloat32(600, 300), &Metadata{NoData: &nd}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeOverviews(&ovr, bytes.NewReader(src.Bytes()), nil); err != nil {
+		t.Fatal(err)
+	}
+	if overviews, err = Overviews(bytes.NewReader(src.Bytes()), bytes.NewReader(ovr.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if len(overviews) != 2 || overviews[1].Bounds().Size() != image.Pt(150, 75) {
+		t.Fatalf("got %d overviews, want 2 down to 150×75", len(overviews))
+	}
+	md, err := overviews[1].Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm := overviews[1].Config().ColorModel; cm != Gray32FloatModel || md.NoData == nil || *md.NoData != nd {
+		t.Errorf("overview color model %v, NoData %v; want float samples and NoData %g", cm, md.NoData, nd)
+	}
+}
+
+// withSubIFD returns the file data with its first image given a SubIFD
+// holding the image of the file sub, marked as an overview.
+func withSubIFD(t *testing.T, data, sub []byte) []byte {
+	out := append([]byte(nil), data...)
+	if len(out)%2 != 0 {
+		out = append(out, 0)
+	}
+	shift := uint32(len(out))
+	out = append(out, sub...)
+	ifd, _, err := readRawIFD(bytes.NewReader(sub), binary.LittleEndian, int64(enc.Uint32(sub[4:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ifd {
+		if ifd[i].tag == TagStripOffsets {
+			for k := range ifd[i].data {
+				ifd[i].data[k] += shift
+			}
+		}
+	}
+	ifd = append(ifd, ifdEntry{TagNewSubfileType, TypeLong, []uint32{uint32(SubfileReducedResolution)}})
+	base, next, err := readRawIFD(bytes.NewReader(data), binary.LittleEndian, int64(enc.Uint32(data[4:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	subOff := len(out) + len(out)%2
+	if err := writePad(&buf, len(out)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeIFD(&buf, subOff, ifd, 0); err != nil {
+		t.Fatal(err)
+	}
+	baseOff := subOff + ifdSize(ifd)
+	base = append(base, ifdEntry{TagSubIFDs, TypeLong, []uint32{uint32(subOff)}})
+	if err := writeIFD(&buf, baseOff, base, int(next)); err != nil {
+		t.Fatal(err)
+	}
+	out = append(out, buf.Bytes()...)
+	enc.PutUint32(out[4:], uint32(baseOff))
+	return out
+}
+
+func TestPyramid(t *testing.T) {
+	var buf, ovr bytes.Buffer
+	pages := []Page{
+		{Image: newTestGray32(64, 48)},
+		{Image: newTestGray32(16, 12), Type: SubfileReducedResolution},
+	}
+	if err := EncodeAll(&buf, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestGray32(32, 24)
+	data := withSubIFD(t, buf.Bytes(), encodeToBytes(t, sub))
+	if err := EncodeOverviews(&ovr, bytes.NewReader(data), &OverviewOptions{Levels: []int{8}}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPyramid(bytes.NewReader(data), bytes.NewReader(ovr.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var widths []int
+	for i := 0; i < p.LevelCount(); i++ {
+		widths = append(widths, p.Level(i).Bounds().Dx())
+	}
+	if want := []int{64, 32, 16, 8}; !reflect.DeepEqual(widths, want) {
+		t.Fatalf("level widths %v, want %v", widths, want)
+	}
+	m, err := p.Level(1).ReadRegion(p.Level(1).Bounds())
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*Gray32).Pix, sub.Pix)
+
+	for _, tc := range []struct {
+		scale float64
+		level int
+	}{
+		{2, 0}, {1, 0}, {0.6, 0}, {0.5, 1}, {0.3, 1}, {0.25, 2}, {0.1, 3}, {0.01, 3},
+	} {
+		if got := p.BestLevelFor(tc.scale); got != tc.level {
+			t.Errorf("BestLevelFor(%g) = %d, want %d", tc.scale, got, tc.level)
+		}
+	}
+
+	// Without overviews, there is a single level.
+	if p, err = NewPyramid(bytes.NewReader(encodeToBytes(t, sub)), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if p.LevelCount() != 1 || p.BestLevelFor(0.1) != 0 {
+		t.Errorf("%d levels, best level for 0.1 %d; want 1 and 0", p.LevelCount(), p.BestLevelFor(0.1))
+	}
+}
+
+func TestReadRegionScaled(t *testing.T) {
+	f := NewGrayFloat32(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			f.Pix[f.PixOffset(x, y)] = math.Float32bits(float32(x + 10*y))
+		}
+	}
+	f.Pix[f.PixOffset(4, 2)] = math.Float32bits(float32(math.NaN()))
+	rd, err := NewReader(bytes.NewReader(encodeToBytes(t, f)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		rect   image.Rectangle
+		size   image.Point
+		method Resampling
+		want   []float32
+	}{
+		{image.Rect(2, 2, 6, 6), image.Pt(2, 2), ResampleAverage, []float32{27.5, 94.0 / 3, 47.5, 49.5}}, // Less the NaN.
+		{image.Rect(2, 2, 6, 6), image.Pt(2, 2), ResampleNearest, []float32{33, 35, 53, 55}},
+		{image.Rect(1, 1, 3, 2), image.Pt(4, 1), ResampleAverage, []float32{11, 11, 12, 12}},
+		{image.Rect(1, 1, 3, 2), image.Pt(4, 1), ResampleNearest, []float32{11, 11, 12, 12}},
+		{image.Rect(0, 0, 3, 1), image.Pt(2, 1), ResampleNearest, []float32{0, 2}},
+	} {
+		m, err := rd.ReadRegionScaled(tc.rect, tc.size, tc.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := m.(*GrayFloat32)
+		if g.Rect != (image.Rectangle{Max: tc.size}) {
+			t.Fatalf("%v to %v: bounds %v", tc.rect, tc.size, g.Rect)
+		}
+		var got []float32
+		for _, v := range g.Pix {
+			got = append(got, math.Float32frombits(v))
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%v to %v, method %d: got %v, want %v", tc.rect, tc.size, tc.method, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		rect image.Rectangle
+		size image.Point
+	}{
+		{image.Rect(4, 4, 9, 6), image.Pt(2, 2)},
+		{image.Rect(4, 4, 4, 6), image.Pt(2, 2)},
+		{image.Rect(0, 0, 4, 4), image.Pt(0, 2)},
+	} {
+		if _, err := rd.ReadRegionScaled(tc.rect, tc.size, ResampleAverage); err == nil {
+			t.Errorf("%v to %v: no error", tc.rect, tc.size)
+		}
+	}
+
+	// Colors are averaged sample by sample.
+	c := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	copy(c.Pix, []byte{10, 20, 30, 255, 20, 40, 61, 255})
+	if rd, err = NewReader(bytes.NewReader(encodeToBytes(t, c))); err != nil {
+		t.Fatal(err)
+	}
+	m, err := rd.ReadRegionScaled(rd.Bounds(), image.Pt(1, 1), ResampleAverage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.(*image.NRGBA).Pix, []byte{15, 30, 46, 255}; !bytes.Equal(got, want) {
+		t.Errorf("averaged colors %v, want %v", got, want)
+	}
+
+	// A pyramid reads the overview matching the size asked for.
+	var buf bytes.Buffer
+	full, overview := newTestGray32(64, 48), newTestGray32(16, 12)
+	if err := EncodeAll(&buf, []Page{{Image: full}, {Image: overview, Type: SubfileReducedResolution}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var metrics countingMetrics
+	p, err := NewPyramid(bytes.NewReader(buf.Bytes()), nil, &ReaderOptions{Metrics: &metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = p.ReadRegionScaled(image.Rect(16, 8, 48, 40), image.Pt(8, 8), ResampleNearest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := m.(*Gray32)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if got, want := g.Pix[g.PixOffset(x, y)], overview.Pix[overview.PixOffset(4+x, 2+y)]; got != want {
+				t.Fatalf("pyramid: pixel (%d, %d) = %#x, want %#x", x, y, got, want)
+			}
+		}
+	}
+	if n := metrics.blocks.Load(); n != 1 {
+		t.Errorf("pyramid: %d blocks decoded, want the one of the overview", n)
+	}
+}
+
+type countingMetrics struct {
+	read, written, blocks, decompressed atomic.Int64
+	hits, misses                        atomic.Int64
+}
+
+func (m *countingMetrics) BytesRead(n int64)            { m.read.Add(n) }
+func (m *countingMetrics) BytesWritten(n int64)         { m.written.Add(n) }
+func (m *countingMetrics) BlockDecoded()                { m.blocks.Add(1) }
+func (m *countingMetrics) Decompressed(d time.Duration) { m.decompressed.Add(1) }
+
+func (m *countingMetrics) CacheLookup(hit bool) {
+	if hit {
+		m.hits.Add(1)
+	} else {
+		m.misses.Add(1)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	g := newTestGray32(20, 23)
+	data := encodeStrips(t, g, 5, CompressionDeflate, deflate)
+	var m countingMetrics
+	r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Workers: 2, Metrics: &m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadRegion(r.Bounds()); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.blocks.Load(); n != 5 {
+		t.Errorf("BlockDecoded called %d times, want 5", n)
+	}
+	if n := m.decompressed.Load(); n != 5 {
+		t.Errorf("Decompressed called %d times, want 5", n)
+	}
+	var strips int64
+	for _, c := range r.d.blockCounts {
+		strips += int64(c)
+	}
+	if n := m.read.Load(); n < strips {
+		t.Errorf("BytesRead total %d, want at least %d", n, strips)
+	}
+
+	var buf bytes.Buffer
+	if err := (&Encoder{Metrics: &m}).Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.written.Load(); n != int64(buf.Len()) {
+		t.Errorf("BytesWritten total %d, want %d", n, buf.Len())
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 16, TileHeight: 32}
+	if err := e.Encode(&buf, newTestGrayFloat32(40, 70)); err != nil {
+		t.Fatal(err)
+	}
+	// DecodeConfig reads through an io.Reader that is not an io.ReaderAt.
+	c, err := DecodeConfig(io.MultiReader(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Config:          image.Config{ColorModel: c.ColorModel, Width: 40, Height: 70},
+		BitsPerSample:   32,
+		SamplesPerPixel: 1,
+		SampleFormat:    SampleFormatIEEEFP,
+		Photometric:     PhotometricBlackIsZero,
+		Compression:     CompressionDeflate,
+		Predictor:       c.Predictor,
+		Tiled:           true,
+		BlockSize:       image.Pt(16, 32),
+		Blocks:          image.Pt(3, 3),
+	}
+	if c != want || c.Predictor == PredictorNone {
+		t.Errorf("DecodeConfig = %+v, want %+v", c, want)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc := r.FullConfig(); rc != c {
+		t.Errorf("FullConfig = %+v, want %+v", rc, c)
+	}
+
+	data := encodeStrips(t, newTestGray32(20, 23), 5, CompressionDeflate, deflate)
+	if c, err = DecodeConfig(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tiled || c.BlockSize != image.Pt(20, 5) || c.Blocks != image.Pt(1, 5) || c.Compression != CompressionDeflate || c.Predictor != PredictorNone || c.SampleFormat != SampleFormatUint {
+		t.Errorf("DecodeConfig of strips = %+v", c)
+	}
+}
+
+// A countingLimiter records the events waited for, failing once they
+// exceed limit if it is positive.
+type countingLimiter struct {
+	burst, limit  int
+	calls, events atomic.Int64
+}
+
+func (l *countingLimiter) Burst() int { return l.burst }
+
+func (l *countingLimiter) WaitN(ctx context.Context, n int) error {
+	if n > l.burst {
+		return fmt.Errorf("wait for %d events exceeds the burst of %d", n, l.burst)
+	}
+	l.calls.Add(1)
+	if l.events.Add(int64(n)) > int64(l.limit) && l.limit > 0 {
+		return errors.New("rate limit exceeded")
+	}
+	return nil
+}
+
+func TestRateLimit(t *testing.T) {
+	g := newTestGray32(20, 23)
+	data := encodeStrips(t, g, 5, CompressionDeflate, deflate)
+	requests, bandwidth := &countingLimiter{burst: 1}, &countingLimiter{burst: 100}
+	var m countingMetrics
+	r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{
+		Workers: 2, Metrics: &m, RequestLimit: requests, BandwidthLimit: bandwidth,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.ReadRegion(r.Bounds())
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, got.(*Gray32).Pix, g.Pix)
+	if requests.calls.Load() == 0 || requests.events.Load() != requests.calls.Load() {
+		t.Errorf("%d requests waited for in %d calls", requests.events.Load(), requests.calls.Load())
+	}
+	if n := bandwidth.events.Load(); n < m.read.Load() {
+		t.Errorf("waited for %d bytes, read %d", n, m.read.Load())
+	}
+
+	// A failing limiter fails the read.
+	limited := &countingLimiter{burst: 1 << 20, limit: 100}
+	if _, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{BandwidthLimit: limited}); err == nil {
+		t.Error("read beyond the limit succeeded")
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	g := newTestGray32(20, 23)
+	data := encodeStrips(t, g, 5, CompressionDeflate, deflate)
+	pool := NewWorkerPool(1)
+	if pool.Size() != 1 {
+		t.Fatalf("Size = %d, want 1", pool.Size())
+	}
+
+	// With the only slot taken, reading waits for it.
+	pool.acquire()
+	r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Workers: 4, Pool: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := r.ReadRegionAsync(r.Bounds())
+	select {
+	case <-res:
+		t.Fatal("region read without a free slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	pool.release()
+	got := <-res
+	if got.Err != nil {
+		t.Fatal(got.Err)
+	}
+	comparePix(t, got.Image.(*Gray32).Pix, g.Pix)
+
+	// Readers, encoders and Recompress share the pool concurrently.
+	e := &Encoder{Pool: pool}
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, 12)
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, err := r.Clone().ReadRegion(r.Bounds())
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- e.Encode(io.Discard, g)
+		}()
+		go func() {
+			defer wg.Done()
+			f, err := os.CreateTemp(dir, "*.tif")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			errs <- Recompress(f, bytes.NewReader(data), &RecompressOptions{Pool: pool})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestArena(t *testing.T) {
+	g := newTestGray32(30, 30)
+	data := encodeToBytes(t, g)
+	a := NewArena(30 * 10 * 4 * 2)
+	r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Arena: a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pass := 0; pass < 2; pass++ {
+		for y := 0; y < 30; y += 10 {
+			rect := image.Rect(0, y, 30, y+10)
+			m, err := r.ReadRegion(rect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			comparePix(t, m.(*Gray32).Pix, g.Pix[y*30:(y+10)*30])
+		}
+		if len(a.slabs) != 2 {
+			t.Errorf("pass %d: %d slabs, want 2", pass, len(a.slabs))
+		}
+		a.Reset()
+	}
+	// Regions larger than a slab are allocated on their own.
+	if _, err := r.ReadRegion(r.Bounds()); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.slabs) != 2 {
+		t.Errorf("%d slabs after large region, want 2", len(a.slabs))
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	g := newTestGray32(8, 8)
+	data := encodeStrips(t, g, 8, CompressionLZW+1, func(p []byte) []byte { return p })
+	_, err := Decode(bytes.NewReader(data))
+	var ue UnsupportedError
+	var fe FormatError
+	if !errors.As(err, &ue) || ue.Tag != TagCompression || ue.Value != CompressionLZW+1 {
+		t.Errorf("unknown compression: got %v, want an UnsupportedError for tag %d", err, TagCompression)
+	}
+	if want := "old-style JPEG (6) (supported: none (1), LZW (5), JPEG (7), Deflate (8), old-style Deflate (32946), LERC (34887), LZMA (34925), ZSTD (50000))"; err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("old-style JPEG: got %v, want an error ending in %q", err, want)
+	}
+	data = encodeStrips(t, g, 8, CompressionJPEG, func(p []byte) []byte { return p })
+	if _, err = Decode(bytes.NewReader(data)); !errors.As(err, &ue) || ue.Tag != TagBitsPerSample {
+		t.Errorf("JPEG with 32-bit samples: got %v, want an UnsupportedError for tag %d", err, TagBitsPerSample)
+	}
+
+	for _, fo := range []uint32{FillOrderLSB2MSB, 3} {
+		l := imageLayout{
+			width: 1, height: 1, bitsPerSample: []uint32{32}, samplesPerPixel: 1,
+			photometric: PhotometricBlackIsZero, compression: CompressionNone,
+			predictor: PredictorNone, sampleFormat: SampleFormatUint,
+			rowsPerStrip: 1, blockOffsets: []uint32{8}, blockByteCounts: []uint32{4},
+			extra: []ifdEntry{{TagFillOrder, TypeShort, []uint32{fo}}},
+		}
+		var buf bytes.Buffer
+		buf.WriteString(leHeader + "\x0c\x00\x00\x00\x00\x00\x00\x00")
+		if err := writeIFD(&buf, buf.Len(), l.appendEntries(nil), 0); err != nil {
+			t.Fatal(err)
+		}
+		_, err = Decode(bytes.NewReader(buf.Bytes()))
+		if fo == FillOrderLSB2MSB && !errors.As(err, &ue) || fo != FillOrderLSB2MSB && !errors.As(err, &fe) {
+			t.Errorf("FillOrder %d: got %v", fo, err)
+		}
+	}
+
+	_, err = Decode(bytes.NewReader([]byte("XX\x2A\x00\x08\x00\x00\x00")))
+	if !errors.As(err, &fe) {
+		t.Errorf("bad header: got %v, want a FormatError", err)
+	}
+
+	data = encodeToBytes(t, g)
+	_, err = Decode(bytes.NewReader(data[:len(data)/2]))
+	if err == nil {
+		t.Error("truncated file decoded without error")
+	}
+}
+
+func TestIFDLimits(t *testing.T) {
+	g := newTestGray32(8, 64)
+	data := encodeStrips(t, g, 1, CompressionNone, func(p []byte) []byte { return p })
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.NumImages(); n != 1 || err != nil {
+		t.Errorf("NumImages = %d, %v, want 1, nil", n, err)
+	}
+
+	var fe FormatError
+	for _, opt := range []*ReaderOptions{
+		{MaxIFDEntries: 3},
+		{MaxTagDataSize: 64},
+	} {
+		if _, err := NewReaderWithOptions(bytes.NewReader(data), opt); !errors.As(err, &fe) {
+			t.Errorf("%+v: got %v, want a FormatError", opt, err)
+		}
+	}
+
+	// Point the next-IFD offset back at the IFD itself.
+	loop := append([]byte(nil), data...)
+	off := binary.LittleEndian.Uint32(loop[4:])
+	n := binary.LittleEndian.Uint16(loop[off:])
+	binary.LittleEndian.PutUint32(loop[off+2+uint32(n)*ifdLen:], off)
+	r, err = NewReader(bytes.NewReader(loop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.NumImages(); !errors.As(err, &fe) {
+		t.Errorf("looping IFD chain: got %v, want a FormatError", err)
+	}
+}
+
+// declaredImage returns a file declaring a single strip of count bytes of
+// a w×h image of floating point samples, holding only 10 bytes of data.
+func declaredImage(t *testing.T, w, h int, compression, count uint32) []byte {
+	l := imageLayout{
+		width: w, height: h,
+		bitsPerSample: []uint32{32}, samplesPerPixel: 1,
+		photometric: PhotometricBlackIsZero, compression: compression, predictor: PredictorNone,
+		sampleFormat: SampleFormatIEEEFP, rowsPerStrip: h, noResolution: true,
+		blockOffsets: []uint32{8}, blockByteCounts: []uint32{count},
+	}
+	var buf bytes.Buffer
+	buf.WriteString(leHeader + "\x12\x00\x00\x00")
+	buf.Write(make([]byte, 10))
+	if err := writeIFD(&buf, 18, l.appendEntries(nil), 0); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageLimits(t *testing.T) {
+	var fe FormatError
+	data := declaredImage(t, 5000, 5000, CompressionNone, 5000*5000*4)
+	if _, err := Decode(bytes.NewReader(data)); !errors.As(err, &fe) || !strings.Contains(err.Error(), "past the end") {
+		t.Errorf("strip past the end of the file: got %v, want a FormatError", err)
+	}
+	data = declaredImage(t, 20000, 20000, CompressionDeflate, 10)
+	if _, err := Decode(bytes.NewReader(data)); !errors.As(err, &fe) || !strings.Contains(err.Error(), "MaxImageBytes") {
+		t.Errorf("%d-byte file of a 20000x20000 image: got %v, want a FormatError", len(data), err)
+	}
+
+	g := newTestGray32(64, 64)
+	r, err := NewReaderWithOptions(bytes.NewReader(encodeToBytes(t, g)), &ReaderOptions{MaxImageBytes: 32 * 32 * 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadRegion(r.Bounds()); !errors.As(err, &fe) {
+		t.Errorf("ReadRegion over MaxImageBytes: got %v, want a FormatError", err)
+	}
+	m, err := r.ReadRegion(image.Rect(16, 16, 48, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.(*Gray32).Gray32At(20, 30); got != g.Gray32At(20, 30) {
+		t.Errorf("pixel (20, 30) = %v, want %v", got, g.Gray32At(20, 30))
+	}
+}
+
+func TestForceFloat(t *testing.T) {
+	f := newTestGrayFloat32(9, 4)
+	var buf bytes.Buffer
+	if err := Encode(&buf, f, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Drop SampleFormat by renaming its entry to a private tag.
+	data := buf.Bytes()
+	ifd := binary.LittleEndian.Uint32(data[4:])
+	n := int(binary.LittleEndian.Uint16(data[ifd:]))
+	for i := 0; i < n; i++ {
+		p := data[int(ifd)+2+ifdLen*i:]
+		if binary.LittleEndian.Uint16(p) == TagSampleFormat {
+			binary.LittleEndian.PutUint16(p, 65000)
+		}
+	}
+
+	m, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := m.(*Gray32); !ok {
+		t.Errorf("without SampleFormat: got a %T, want a *Gray32", m)
+	} else {
+		comparePix(t, g.Pix, f.Pix)
+	}
+
+	r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{ForceFloat: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = r.ReadRegion(r.Bounds())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := m.(*GrayFloat32); !ok {
+		t.Errorf("with ForceFloat: got a %T, want a *GrayFloat32", m)
+	} else {
+		comparePix(t, g.Pix, f.Pix)
+	}
+}
+
+// encodeLayout returns a file holding the image described by l, whose
+// pixel data, in a single strip, is data.
+func encodeLayout(t testing.TB, l imageLayout, data []byte) []byte {
+	l.rowsPerStrip = l.height
+	l.blockOffsets = []uint32{8}
+	l.blockByteCounts = []uint32{uint32(len(data))}
+	var buf bytes.Buffer
+	buf.WriteString(leHeader)
+	binary.Write(&buf, binary.LittleEndian, uint32(8+len(data)+len(data)%2))
+	buf.Write(data)
+	if len(data)%2 != 0 {
+		buf.WriteByte(0)
+	}
+	if err := writeIFD(&buf, buf.Len(), l.appendEntries(nil), 0); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeStdlibTypes(t *testing.T) {
+	rect := image.Rect(0, 0, 19, 11)
+	gray := image.NewGray(rect)
+	gray16 := image.NewGray16(rect)
+	palette := color.Palette{color.Black, color.White, color.RGBA{0x10, 0x80, 0xf0, 0xff}}
+	paletted := image.NewPaletted(rect, palette)
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 37)
+		paletted.Pix[i] = uint8(i % len(palette))
+	}
+	for i := range gray16.Pix {
+		gray16.Pix[i] = uint8(i * 91)
+	}
+	for _, opt := range []*tiff.Options{
+		nil,
+		{Compression: tiff.Deflate, Predictor: true},
+	} {
+		for _, src := range []image.Image{gray, gray16, paletted} {
+			var buf bytes.Buffer
+			if err := tiff.Encode(&buf, src, opt); err != nil {
+				t.Fatal(err)
+			}
+			m, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%T, %+v: %v", src, opt, err)
+			}
+			if reflect.TypeOf(m) != reflect.TypeOf(src) {
+				t.Fatalf("%T, %+v: got a %T", src, opt, m)
+			}
+			compareColors(t, m, src)
+
+			// Regions of the image decode to the same pixels.
+			r, err := NewReader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sub := image.Rect(3, 2, 15, 9)
+			m, err = r.ReadRegion(sub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareColors(t, m, src.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(sub))
+		}
+	}
+}
+
+func TestDecodeFloatPredictor(t *testing.T) {
+	// Rows of (x-3.25)*1.5 plus 0.1 times the band, as stored by libtiff
+	// with the floating point predictor, before compression.
+	for _, tc := range []struct {
+		spp  int
+		data string
+	}{
+		{1, "c000ffff8101005cbc98d0d0985c7c00000000000000000000000000"},
+		{2, "c0c00000ffffffff8181010100005c58bcb99892d0a9d01098925c597c4500cd009a00990000009a00cd009a00cd0099009a0000009900cd"},
+	} {
+		data, err := hex.DecodeString(tc.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := imageLayout{
+			width: 7, height: 1, bitsPerSample: make([]uint32, tc.spp), samplesPerPixel: uint32(tc.spp),
+			photometric: PhotometricBlackIsZero, compression: CompressionNone, predictor: PredictorFloatingPoint,
+			sampleFormat: SampleFormatIEEEFP,
+		}
+		for i := range l.bitsPerSample {
+			l.bitsPerSample[i] = 32
+		}
+		file := encodeLayout(t, l, data)
+		for band := 0; band < tc.spp; band++ {
+			r, err := NewReaderWithOptions(bytes.NewReader(file), &ReaderOptions{Band: band})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := r.ReadRegion(r.Bounds())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for x := 0; x < 7; x++ {
+				want := float32((float64(x)-3.25)*1.5 + 0.1*float64(band))
+				if v := m.(*GrayFloat32).ValueAt(x, 0); v != want {
+					t.Errorf("%d bands, band %d: pixel %d = %g, want %g", tc.spp, band, x, v, want)
+				}
+			}
+		}
+	}
+
+	// An unknown predictor, or the floating point one with integer
+	// samples, is refused rather than decoded into garbage.
+	for _, tc := range []struct {
+		predictor, sampleFormat uint32
+	}{
+		{PredictorFloatingPoint, SampleFormatUint},
+		{7, SampleFormatIEEEFP},
+	} {
+		l := imageLayout{
+			width: 7, height: 1, bitsPerSample: []uint32{32}, samplesPerPixel: 1,
+			photometric: PhotometricBlackIsZero, compression: CompressionNone, predictor: tc.predictor,
+			sampleFormat: tc.sampleFormat,
+		}
+		var ue UnsupportedError
+		if _, err := Decode(bytes.NewReader(encodeLayout(t, l, make([]byte, 28)))); !errors.As(err, &ue) {
+			t.Errorf("predictor %d, sample format %d: got %v, want an UnsupportedError", tc.predictor, tc.sampleFormat, err)
+		}
+	}
+}
+
+func TestDecodeBilevel(t *testing.T) {
+	// A 10x2 image: rows of 10 bits, each padded to 2 bytes.
+	data := []byte{0xa5, 0xc0, 0x0f, 0x40}
+	want := [][]uint8{
+		{1, 0, 1, 0, 0, 1, 0, 1, 1, 1},
+		{0, 0, 0, 0, 1, 1, 1, 1, 0, 1},
+	}
+	l := imageLayout{
+		width: 10, height: 2, bitsPerSample: []uint32{1}, samplesPerPixel: 1,
+		compression: CompressionNone, predictor: PredictorNone, sampleFormat: SampleFormatUint,
+	}
+	for _, tc := range []struct {
+		photometric, fillOrder uint32
+		black                  uint8
+	}{
+		{PhotometricBlackIsZero, FillOrderMSB2LSB, 0},
+		{PhotometricWhiteIsZero, FillOrderMSB2LSB, 1},
+		{PhotometricBlackIsZero, FillOrderLSB2MSB, 0},
+	} {
+		l.photometric = tc.photometric
+		l.extra = []ifdEntry{{TagFillOrder, TypeShort, []uint32{tc.fillOrder}}}
+		raw := append([]byte(nil), data...)
+		if tc.fillOrder == FillOrderLSB2MSB {
+			for i, b := range raw {
+				raw[i] = bits.Reverse8(b)
+			}
+		}
+		m, err := Decode(bytes.NewReader(encodeLayout(t, l, raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, ok := m.(*image.Gray)
+		if !ok {
+			t.Fatalf("got a %T, want an *image.Gray", m)
+		}
+		for y, row := range want {
+			for x, v := range row {
+				w := uint8(0xff)
+				if v == tc.black {
+					w = 0
+				}
+				if got := g.GrayAt(x, y).Y; got != w {
+					t.Errorf("%+v: pixel (%d, %d) = %d, want %d", tc, x, y, got, w)
+				}
+			}
+		}
+	}
+
+	// Reversed bit order cannot be undone on compressed data.
+	l.compression = CompressionDeflate
+	if _, err := Decode(bytes.NewReader(encodeLayout(t, l, deflate(data)))); err == nil {
+		t.Error("FillOrder 2 accepted with compression")
+	}
+}
+
+func TestDecodePaletted4(t *testing.T) {
+	// A 3x2 image with 4-bit indices into a 16 color map.
+	cm := make([]uint32, 3*16)
+	for i := 0; i < 16; i++ {
+		cm[i], cm[16+i], cm[32+i] = uint32(i*0x1111), 0x8080, uint32(0xffff-i*0x1111)
+	}
+	l := imageLayout{
+		width: 3, height: 2, bitsPerSample: []uint32{4}, samplesPerPixel: 1,
+		photometric: PhotometricPaletted, compression: CompressionNone,
+		predictor: PredictorNone, sampleFormat: SampleFormatUint, colorMap: cm,
+	}
+	m, err := Decode(bytes.NewReader(encodeLayout(t, l, []byte{0x12, 0x30, 0xfe, 0xd0})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := m.(*image.Paletted)
+	if !ok {
+		t.Fatalf("got a %T, want an *image.Paletted", m)
+	}
+	if want := []uint8{1, 2, 3, 15, 14, 13}; !bytes.Equal(p.Pix, want) {
+		t.Errorf("Pix = %v, want %v", p.Pix, want)
+	}
+	if r, g, b, _ := p.Palette[15].RGBA(); r != 0xffff || g != 0x8080 || b != 0 {
+		t.Errorf("palette[15] = %v", p.Palette[15])
+	}
+
+	data := encodeLayout(t, l, []byte{0x12, 0x30, 0xfe, 0xd0})
+	r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{ExpandPalette: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Config().ColorModel != color.RGBAModel {
+		t.Errorf("ExpandPalette: color model %v, want RGBAModel", r.Config().ColorModel)
+	}
+	for _, rect := range []image.Rectangle{r.Bounds(), image.Rect(1, 1, 3, 2)} {
+		m, err := r.ReadRegion(rect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(*image.RGBA); !ok {
+			t.Fatalf("ExpandPalette: got a %T, want an *image.RGBA", m)
+		}
+		compareColors(t, m, p.SubImage(rect))
+	}
+
+	l.colorMap = cm[:47]
+	if _, err := Decode(bytes.NewReader(encodeLayout(t, l, []byte{0x12, 0x30, 0xfe, 0xd0}))); err == nil {
+		t.Error("short ColorMap accepted")
+	}
+}
+
+// compareColors reports the pixels of got that differ from those of want,
+// which must have the same size.
+func compareColors(t *testing.T, got, want image.Image) {
+	t.Helper()
+	gb, wb := got.Bounds(), want.Bounds()
+	if gb.Size() != wb.Size() {
+		t.Fatalf("bounds %v, want the size of %v", gb, wb)
+	}
+	for y := 0; y < gb.Dy(); y++ {
+		for x := 0; x < gb.Dx(); x++ {
+			r0, g0, b0, a0 := got.At(gb.Min.X+x, gb.Min.Y+y).RGBA()
+			r1, g1, b1, a1 := want.At(wb.Min.X+x, wb.Min.Y+y).RGBA()
+			if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y,
+					got.At(gb.Min.X+x, gb.Min.Y+y), want.At(wb.Min.X+x, wb.Min.Y+y))
+			}
+		}
+	}
+}
+
+func TestDecodeRGB(t *testing.T) {
+	rect := image.Rect(0, 0, 13, 7)
+	nrgba := image.NewNRGBA(rect)
+	nrgba64 := image.NewNRGBA64(rect)
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = uint8(i * 29)
+	}
+	for i := range nrgba64.Pix {
+		nrgba64.Pix[i] = uint8(i * 53)
+	}
+	// Premultiplied colors are no larger than their alpha.
+	rgba := image.NewRGBA(rect)
+	rgba64 := image.NewRGBA64(rect)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i*29) % 200
+		if i%4 == 3 {
+			rgba.Pix[i] = 200
+		}
+	}
+	for i := range rgba64.Pix {
+		rgba64.Pix[i] = uint8(i*53) % 150
+		if i%8 >= 6 {
+			rgba64.Pix[i] = 150
+		}
+	}
+	for _, opt := range []*tiff.Options{nil, {Compression: tiff.Deflate, Predictor: true}} {
+		for _, tc := range []struct {
+			src  image.Image
+			want reflect.Type
+		}{
+			{nrgba, reflect.TypeOf(nrgba)},
+			{nrgba64, reflect.TypeOf(nrgba64)},
+			{rgba, reflect.TypeOf(rgba)},
+			{rgba64, reflect.TypeOf(rgba64)},
+		} {
+			var buf bytes.Buffer
+			if err := tiff.Encode(&buf, tc.src, opt); err != nil {
+				t.Fatal(err)
+			}
+			m, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%T, %+v: %v", tc.src, opt, err)
+			}
+			if reflect.TypeOf(m) != tc.want {
+				t.Fatalf("%T, %+v: got a %T, want a %v", tc.src, opt, m, tc.want)
+			}
+			compareColors(t, m, tc.src)
+		}
+	}
+
+	// Three samples are opaque.
+	l := imageLayout{
+		width: 2, height: 1, bitsPerSample: []uint32{8, 8, 8}, samplesPerPixel: 3,
+		photometric: PhotometricRGB, compression: CompressionNone,
+		predictor: PredictorNone, sampleFormat: SampleFormatUint,
+	}
+	m, err := Decode(bytes.NewReader(encodeLayout(t, l, []byte{1, 2, 3, 4, 5, 6})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := m.(*image.NRGBA); !ok || !bytes.Equal(p.Pix, []byte{1, 2, 3, 0xff, 4, 5, 6, 0xff}) {
+		t.Errorf("RGB: got %#v", m)
+	}
+
+	// Planar data is not supported yet.
+	l.extra = []ifdEntry{{TagPlanarConfiguration, TypeShort, []uint32{2}}}
+	var ue UnsupportedError
+	if _, err := Decode(bytes.NewReader(encodeLayout(t, l, []byte{1, 2, 3, 4, 5, 6}))); !errors.As(err, &ue) {
+		t.Errorf("planar RGB: got %v, want an UnsupportedError", err)
+	}
+}
+
+func TestDecodeCMYK(t *testing.T) {
+	l := imageLayout{
+		width: 2, height: 2, bitsPerSample: []uint32{8, 8, 8, 8}, samplesPerPixel: 4,
+		photometric: PhotometricCMYK, compression: CompressionNone,
+		predictor: PredictorNone, sampleFormat: SampleFormatUint,
+	}
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	m, err := Decode(bytes.NewReader(encodeLayout(t, l, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := m.(*image.CMYK); !ok || !bytes.Equal(c.Pix, data) {
+		t.Errorf("got %#v", m)
+	}
+
+	l.extra = []ifdEntry{{TagInkSet, TypeShort, []uint32{2}}}
+	if _, err := Decode(bytes.NewReader(encodeLayout(t, l, data))); err == nil {
+		t.Error("non-CMYK InkSet accepted")
+	}
+}
+
+func TestDecodeYCbCr(t *testing.T) {
+	// A 3x3 image in 2x2 data units, in strips of two rows: the units
+	// cover 4x4 pixels.
+	src := image.NewYCbCr(image.Rect(0, 0, 3, 3), image.YCbCrSubsampleRatio420)
+	for i := range src.Y {
+		src.Y[i] = uint8(10 + i)
+	}
+	for i := range src.Cb {
+		src.Cb[i], src.Cr[i] = uint8(100+i), uint8(200+i)
+	}
+	var strips [][]byte
+	for y0 := 0; y0 < 3; y0 += 2 {
+		var strip []byte
+		for x0 := 0; x0 < 3; x0 += 2 {
+			for j := 0; j < 2; j++ {
+				for i := 0; i < 2; i++ {
+					var v byte
+					if x, y := x0+i, y0+j; x < 3 && y < 3 {
+						v = src.Y[src.YOffset(x, y)]
+					}
+					strip = append(strip, v)
+				}
+			}
+			c := src.COffset(x0, y0)
+			strip = append(strip, src.Cb[c], src.Cr[c])
+		}
+		strips = append(strips, strip)
+	}
+
+	for _, compression := range []uint32{CompressionNone, CompressionDeflate} {
+		var data bytes.Buffer
+		var offsets, counts []uint32
+		for _, s := range strips {
+			if compression == CompressionDeflate {
+				s = deflate(s)
+			}
+			offsets = append(offsets, uint32(8+data.Len()))
+			counts = append(counts, uint32(len(s)))
+			data.Write(s)
+		}
+		if data.Len()%2 != 0 {
+			data.WriteByte(0)
+		}
+		l := imageLayout{
+			width: 3, height: 3, bitsPerSample: []uint32{8, 8, 8}, samplesPerPixel: 3,
+			photometric: PhotometricYCbCr, compression: compression,
+			predictor: PredictorNone, sampleFormat: SampleFormatUint,
+			rowsPerStrip: 2, blockOffsets: offsets, blockByteCounts: counts,
+			extra: []ifdEntry{{TagYCbCrSubSampling, TypeShort, []uint32{2, 2}}},
+		}
+		var buf bytes.Buffer
+		buf.WriteString(leHeader)
+		binary.Write(&buf, binary.LittleEndian, uint32(8+data.Len()))
+		data.WriteTo(&buf)
+		if err := writeIFD(&buf, buf.Len(), l.appendEntries(nil), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{ChopSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rect := range []image.Rectangle{r.Bounds(), image.Rect(1, 1, 3, 3)} {
+			m, err := r.ReadRegion(rect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			y, ok := m.(*image.YCbCr)
+			if !ok || y.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+				t.Fatalf("got a %T, want a 4:2:0 *image.YCbCr", m)
+			}
+			compareColors(t, m, src.SubImage(rect))
+		}
+	}
+}
+
+// splitJPEG splits the JPEG stream p into an abbreviated stream of its
+// quantization and Huffman tables, as held in JPEGTables, and the rest.
+func splitJPEG(t *testing.T, p []byte) (tables, data []byte) {
+	tables = []byte{0xff, 0xd8}
+	data = []byte{0xff, 0xd8}
+	for i := 2; i < len(p); {
+		if p[i] != 0xff || i+4 > len(p) {
+			t.Fatalf("bad JPEG marker at %d", i)
+		}
+		if p[i+1] == 0xda { // SOS: the entropy-coded data follows.
+			data = append(data, p[i:]...)
+			break
+		}
+		n := 2 + int(binary.BigEndian.Uint16(p[i+2:]))
+		if p[i+1] == 0xdb || p[i+1] == 0xc4 {
+			tables = append(tables, p[i:i+n]...)
+		} else {
+			data = append(data, p[i:i+n]...)
+		}
+		i += n
+	}
+	return append(tables, 0xff, 0xd9), data
+}
+
+func TestDecodeJPEG(t *testing.T) {
+	rect := image.Rect(0, 0, 27, 14)
+	gray := image.NewGray(rect)
+	rgba := image.NewRGBA(rect)
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 13)
+		if i%4 == 3 {
+			rgba.Pix[i] = 0xff
+		}
+	}
+	for _, tc := range []struct {
+		src         image.Image
+		photometric uint32
+		spp         uint32
+	}{
+		{gray, PhotometricBlackIsZero, 1},
+		{rgba, PhotometricYCbCr, 3},
+		{rgba, PhotometricRGB, 3},
+	} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, tc.src, nil); err != nil {
+			t.Fatal(err)
+		}
+		// The image decoded is that of image/jpeg, converted to RGB for
+		// the RGB photometric.
+		dec, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := dec
+		if tc.photometric == PhotometricRGB {
+			ycc := dec.(*image.YCbCr)
+			rgb := image.NewNRGBA(rect)
+			for y := 0; y < rect.Dy(); y++ {
+				for x := 0; x < rect.Dx(); x++ {
+					c := ycc.YCbCrAt(x, y)
+					r, g, b := color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+					rgb.SetNRGBA(x, y, color.NRGBA{r, g, b, 0xff})
+				}
+			}
+			want = rgb
+		}
+		bps := make([]uint32, tc.spp)
+		for i := range bps {
+			bps[i] = 8
+		}
+		l := imageLayout{
+			width: rect.Dx(), height: rect.Dy(), bitsPerSample: bps, samplesPerPixel: tc.spp,
+			photometric: tc.photometric, compression: CompressionJPEG,
+			predictor: PredictorNone, sampleFormat: SampleFormatUint,
+		}
+		// Whole streams, and abbreviated ones with the tables apart.
+		tables, data := splitJPEG(t, buf.Bytes())
+		for _, jt := range [][]byte{nil, tables} {
+			block := buf.Bytes()
+			l.extra = nil
+			if jt != nil {
+				block = data
+				raw := make([]uint32, len(jt))
+				for i, b := range jt {
+					raw[i] = uint32(b)
+				}
+				l.extra = []ifdEntry{{TagJPEGTables, TypeUndefined, raw}}
+			}
+			m, err := Decode(bytes.NewReader(encodeLayout(t, l, block)))
+			if err != nil {
+				t.Fatalf("photometric %d, tables %t: %v", tc.photometric, jt != nil, err)
+			}
+			if reflect.TypeOf(m) != reflect.TypeOf(want) {
+				t.Fatalf("photometric %d: decoded a %T", tc.photometric, m)
+			}
+			compareColors(t, m, want)
+		}
+	}
+
+	// The JPEG data must match the block.
+	l := imageLayout{
+		width: 30, height: 14, bitsPerSample: []uint32{8}, samplesPerPixel: 1,
+		photometric: PhotometricBlackIsZero, compression: CompressionJPEG,
+		predictor: PredictorNone, sampleFormat: SampleFormatUint,
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gray, nil); err != nil {
+		t.Fatal(err)
+	}
+	var fe FormatError
+	if _, err := Decode(bytes.NewReader(encodeLayout(t, l, buf.Bytes()))); !errors.As(err, &fe) {
+		t.Errorf("JPEG narrower than its strip: got %v, want a FormatError", err)
+	}
+}
+
+func TestDecodeLZMAAndOldDeflate(t *testing.T) {
+	g := NewGray32(image.Rect(0, 0, 8, 4))
+	for i := range g.Pix {
+		g.Pix[i] = uint32(i/3) * 1000
+	}
+	// The pixels of g compressed by xz, with a delta filter of 4 bytes and
+	// a CRC-64 check.
+	xz, _ := hex.DecodeString("fd377a585a000004e6d6b4460201030103210116978f71fce0007f000d5d0000" +
+		"6c5b4ec62277c053d36bc000000000000805bb2f3c15e9b00001298001000000" +
+		"d457aceab1c467fb020000000004595a")
+	for _, tc := range []struct {
+		compression uint32
+		compress    func([]byte) []byte
+	}{
+		{CompressionLZMA, func([]byte) []byte { return xz }},
+		{CompressionOldDeflate, deflate},
+	} {
+		m, err := Decode(bytes.NewReader(encodeStrips(t, g, 4, tc.compression, tc.compress)))
+		if err != nil {
+			t.Fatalf("compression %d: %v", tc.compression, err)
+		}
+		comparePix(t, m.(*Gray32).Pix, g.Pix)
+	}
+
+	// Corrupt data fails its check.
+	bad := append([]byte(nil), xz...)
+	bad[len(bad)-30] ^= 1
+	var fe FormatError
+	if _, err := Decode(bytes.NewReader(encodeStrips(t, g, 4, CompressionLZMA, func([]byte) []byte { return bad }))); !errors.As(err, &fe) {
+		t.Errorf("corrupt LZMA data: got %v, want a FormatError", err)
+	}
+}
+
+func TestStackBands(t *testing.T) {
+	r := image.Rect(0, 0, 40, 37)
+	bands := make([]*GrayFloat32, 3)
+	for b := range bands {
+		bands[b] = NewGrayFloat32(r)
+		for i := range bands[b].Pix {
+			bands[b].Pix[i] = math.Float32bits(float32(b*1000+i%97) / 8)
+		}
+	}
+	deflated := &tiff.Options{Compression: tiff.Deflate, Predictor: true}
+	for _, tc := range []struct {
+		name string
+		e    *Encoder
+	}{
+		{"uncompressed", &Encoder{}},
+		{"deflate", &Encoder{Options: deflated}},
+		{"deflate tiles", &Encoder{Options: deflated, TileWidth: 16, TileHeight: 16}},
+		{"ZSTD tiles", &Encoder{ZSTD: &ZSTDOptions{}, TileWidth: 32, TileHeight: 16}},
+	} {
+		var buf bytes.Buffer
+		if err := tc.e.StackBands(&buf, bands); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for b, want := range bands {
+			m, err := ExtractBand(bytes.NewReader(buf.Bytes()), b)
+			if err != nil {
+				t.Fatalf("%s, band %d: %v", tc.name, b, err)
+			}
+			f, ok := m.(*GrayFloat32)
+			if !ok {
+				t.Fatalf("%s, band %d: got a %T", tc.name, b, m)
+			}
+			comparePix(t, f.Pix, want.Pix)
+		}
+		// A region of a band.
+		rd, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{Band: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := image.Rect(5, 7, 30, 20)
+		m, err := rd.ReadRegion(sub)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for y := sub.Min.Y; y < sub.Max.Y; y++ {
+			for x := sub.Min.X; x < sub.Max.X; x++ {
+				if got, want := m.(*GrayFloat32).Pix[m.(*GrayFloat32).PixOffset(x, y)], bands[2].Pix[bands[2].PixOffset(x, y)]; got != want {
+					t.Fatalf("%s: region pixel (%d, %d) = %#x, want %#x", tc.name, x, y, got, want)
+				}
+			}
+		}
+		if _, err := ExtractBand(bytes.NewReader(buf.Bytes()), 3); err == nil {
+			t.Errorf("%s: ExtractBand accepted band 3 of 3", tc.name)
+		}
+	}
+
+	if err := StackBands(io.Discard, nil, nil); err == nil {
+		t.Error("StackBands accepted no images")
+	}
+	if err := StackBands(io.Discard, []*GrayFloat32{bands[0], NewGrayFloat32(image.Rect(0, 0, 40, 36))}, nil); err == nil {
+		t.Error("StackBands accepted images of different bounds")
+	}
+	if err := (&Encoder{LERC: &LERCOptions{}}).StackBands(io.Discard, bands); err == nil {
+		t.Error("StackBands accepted LERC compression")
+	}
+}
+
+func TestReadBands(t *testing.T) {
+	r := image.Rect(0, 0, 40, 37)
+	bands := make([]*GrayFloat32, 4)
+	for b := range bands {
+		bands[b] = NewGrayFloat32(r)
+		for i := range bands[b].Pix {
+			bands[b].Pix[i] = math.Float32bits(float32(b*1000+i%89) / 4)
+		}
+	}
+	for _, e := range []*Encoder{
+		{},
+		{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 16, TileHeight: 16},
+	} {
+		var buf bytes.Buffer
+		if err := e.StackBands(&buf, bands); err != nil {
+			t.Fatal(err)
+		}
+		for _, opt := range []*ReaderOptions{{}, {Workers: 3}, {ChopSize: 200}} {
+			var metrics countingMetrics
+			o := *opt
+			o.Metrics = &metrics
+			rd, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rect := image.Rect(3, 5, 38, 30)
+			want := []int{3, 1, 3}
+			ms, err := rd.ReadBands(rect, want...)
+			if err != nil {
+				t.Fatalf("%+v: %v", opt, err)
+			}
+			if len(ms) != len(want) {
+				t.Fatalf("%+v: %d images, want %d", opt, len(ms), len(want))
+			}
+			for k, b := range want {
+				f := ms[k].(*GrayFloat32)
+				if f.Rect != rect {
+					t.Fatalf("%+v: band %d bounds %v, want %v", opt, b, f.Rect, rect)
+				}
+				src := bands[b].SubImage(rect).(*GrayFloat32)
+				for y := rect.Min.Y; y < rect.Max.Y; y++ {
+					for x := rect.Min.X; x < rect.Max.X; x++ {
+						if got, w := f.Pix[f.PixOffset(x, y)], src.Pix[src.PixOffset(x, y)]; got != w {
+							t.Fatalf("%+v: band %d, pixel (%d, %d) = %#x, want %#x", opt, b, x, y, got, w)
+						}
+					}
+				}
+			}
+			blocks := metrics.blocks.Load()
+			if _, err := rd.ReadRegion(rect); err != nil {
+				t.Fatal(err)
+			}
+			if n := metrics.blocks.Load() - blocks; n != blocks {
+				t.Errorf("%+v: %d blocks decoded for 3 bands, %d for one", opt, blocks, n)
+			}
+		}
+	}
+
+	rd, err := NewReader(bytes.NewReader(encodeToBytes(t, newTestGray32(4, 4))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.ReadBands(rd.Bounds(), 0, 1); err == nil {
+		t.Error("read band 1 of an image of one band")
+	}
+	if _, err := rd.ReadBands(rd.Bounds()); err == nil {
+		t.Error("read no bands")
+	}
+}
+
+func TestExtraSamples(t *testing.T) {
+	r := image.Rect(0, 0, 5, 3)
+	bands := []*GrayFloat32{NewGrayFloat32(r), NewGrayFloat32(r), NewGrayFloat32(r)}
+	declared := []uint16{ExtraSamplesUnassociatedAlpha, ExtraSamplesUnspecified}
+	var buf bytes.Buffer
+	if err := (&Encoder{ExtraSamples: declared}).StackBands(&buf, bands); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rd.ExtraSamples(); !slices.Equal(got, declared) {
+		t.Errorf("ExtraSamples = %v, want %v", got, declared)
+	}
+	for _, es := range [][]uint16{{ExtraSamplesUnspecified}, {ExtraSamplesUnspecified, 3}} {
+		if err := (&Encoder{ExtraSamples: es}).StackBands(io.Discard, bands); err == nil {
+			t.Errorf("ExtraSamples %v: no error", es)
+		}
+	}
+
+	// RGBA with a mask, taken as RGBA.
+	data := make([]byte, 5*r.Dx()*r.Dy())
+	want := image.NewNRGBA(r)
+	for i := 0; i < r.Dx()*r.Dy(); i++ {
+		for c := range 5 {
+			data[5*i+c] = uint8(i*31 + c*7)
+		}
+		copy(want.Pix[4*i:], data[5*i:5*i+4])
+	}
+	file := encodeLayout(t, imageLayout{
+		width:           r.Dx(),
+		height:          r.Dy(),
+		bitsPerSample:   []uint32{8, 8, 8, 8, 8},
+		samplesPerPixel: 5,
+		photometric:     PhotometricRGB,
+		compression:     CompressionNone,
+		predictor:       PredictorNone,
+		sampleFormat:    SampleFormatUint,
+		extraSamples:    []uint32{ExtraSamplesUnassociatedAlpha, ExtraSamplesUnspecified},
+	}, data)
+	rd, err = NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rd.ExtraSamples(), []uint16{ExtraSamplesUnassociatedAlpha, ExtraSamplesUnspecified}; !slices.Equal(got, want) {
+		t.Errorf("RGBA and mask: ExtraSamples = %v, want %v", got, want)
+	}
+	m, err := rd.ReadRegion(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := m.(*image.NRGBA); !ok || !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("RGBA and mask: got %v, want %v", m, want)
+	}
+}
+
+func TestBitsPerSample(t *testing.T) {
+	r := image.Rect(0, 0, 4, 3)
+	data := make([]byte, 3*r.Dx()*r.Dy())
+	for i := range data {
+		data[i] = uint8(i * 29)
+	}
+	rgb := func(bps ...uint32) []byte {
+		return encodeLayout(t, imageLayout{
+			width:           r.Dx(),
+			height:          r.Dy(),
+			bitsPerSample:   bps,
+			samplesPerPixel: 3,
+			photometric:     PhotometricRGB,
+			compression:     CompressionNone,
+			predictor:       PredictorNone,
+			sampleFormat:    SampleFormatUint,
+		}, data)
+	}
+	for _, tc := range []struct {
+		bps         []uint32
+		lax, strict string // The errors, if any.
+	}{
+		{[]uint32{8, 8, 8}, "", ""},
+		{[]uint32{8}, "", ""},
+		{[]uint32{8, 8, 8, 16}, "", ""},
+		{[]uint32{8, 8}, "", "tiff: invalid format: BitsPerSample has 2 values for 3 samples"},
+		{[]uint32{8, 8, 16}, "tiff: unsupported feature: samples of different sizes, BitsPerSample [8 8 16]", "tiff: unsupported feature: samples of different sizes, BitsPerSample [8 8 16]"},
+	} {
+		file := rgb(tc.bps...)
+		for _, strict := range []bool{false, true} {
+			want := tc.lax
+			if strict {
+				want = tc.strict
+			}
+			rd, err := NewReaderWithOptions(bytes.NewReader(file), &ReaderOptions{Strict: strict})
+			if err == nil {
+				var m image.Image
+				if m, err = rd.ReadRegion(r); err == nil {
+					for i, c := range m.(*image.NRGBA).Pix {
+						if i%4 != 3 && c != data[i/4*3+i%4] {
+							t.Fatalf("BitsPerSample %v: sample %d = %d, want %d", tc.bps, i, c, data[i/4*3+i%4])
+						}
+					}
+				}
+			}
+			if got := fmt.Sprint(err); want == "" && err != nil || want != "" && got != want {
+				t.Errorf("BitsPerSample %v, strict %v: got %v, want %q", tc.bps, strict, err, want)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	rep, err := Repair(bytes.NewReader(rgb(8, 8)), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(rep.Fixes, func(f Fix) bool { return f.Tag == TagBitsPerSample }) {
+		t.Errorf("Repair fixed %v, not BitsPerSample", rep.Fixes)
+	}
+	if _, err := NewReaderWithOptions(bytes.NewReader(out.Bytes()), &ReaderOptions{Strict: true}); err != nil {
+		t.Errorf("repaired file: %v", err)
+	}
+}
+
+func TestReaderClone(t *testing.T) {
+	g := newTestGray32(37, 50)
+	var buf bytes.Buffer
+	e := &Encoder{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 16, TileHeight: 16}
+	if err := e.Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		c := r.Clone()
+		rect := image.Rect(i, 2*i, 37-i, 50-i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 10; k++ {
+				m, err := c.ReadRegion(rect)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for y := rect.Min.Y; y < rect.Max.Y; y++ {
+					for x := rect.Min.X; x < rect.Max.X; x++ {
+						if v, want := m.(*Gray32).Gray32At(x, y).Y, g.Pix[y*37+x]; v != want {
+							errs <- fmt.Errorf("%v: pixel (%d, %d) = %#x, want %#x", rect, x, y, v, want)
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if c := r.Clone(); c.Bounds() != r.Bounds() {
+		t.Errorf("clone has bounds %v, want %v", c.Bounds(), r.Bounds())
+	}
+}
+
+// closingReader is an io.ReaderAt counting the times it is closed.
+type closingReader struct {
+	*bytes.Reader
+	closed *int
+}
+
+func (c closingReader) Close() error {
+	*c.closed++
+	return nil
+}
+
+func TestPool(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, newTestGray32(8, 8), nil); err != nil {
+		t.Fatal(err)
+	}
+	opened := map[string]int{}
+	closed := map[string]*int{}
+	var metrics countingMetrics
+	p := &Pool{
+		Open: func(name string) (io.ReaderAt, error) {
+			if name == "missing" {
+				return nil, errors.New("no such file")
+			}
+			opened[name]++
+			if closed[name] == nil {
+				closed[name] = new(int)
+			}
+			return closingReader{bytes.NewReader(buf.Bytes()), closed[name]}, nil
+		},
+		Options:    &ReaderOptions{Metrics: &metrics},
+		TTL:        time.Minute,
+		MaxEntries: 2,
+	}
+	now := time.Unix(0, 0)
+	p.now = func() time.Time { return now }
+	get := func(name string) func() {
+		t.Helper()
+		r, release, err := p.Get(name)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", name, err)
+		}
+		if r.Bounds() != image.Rect(0, 0, 8, 8) {
+			t.Fatalf("Get(%q) gave a Reader of bounds %v", name, r.Bounds())
+		}
+		return release
+	}
+
+	get("a")()
+	get("a")()
+	if opened["a"] != 1 {
+		t.Errorf("a opened %d times, want 1", opened["a"])
+	}
+	if h, m := metrics.hits.Load(), metrics.misses.Load(); h != 1 || m != 1 {
+		t.Errorf("%d hits and %d misses of the pool, want 1 and 1", h, m)
+	}
+	// b and c push a out, the least recently used.
+	ra := get("a")
+	get("b")()
+	get("c")()
+	if *closed["a"] != 0 {
+		t.Error("a closed while in use")
+	}
+	ra()
+	ra()
+	if *closed["a"] != 1 {
+		t.Errorf("a closed %d times once released, want 1", *closed["a"])
+	}
+	get("b")()
+	if opened["b"] != 1 {
+		t.Errorf("b opened %d times, want 1", opened["b"])
+	}
+
+	// Files expire after the TTL.
+	now = now.Add(time.Minute)
+	get("b")()
+	if opened["b"] != 2 || *closed["b"] != 1 {
+		t.Errorf("expired b opened %d and closed %d times, want 2 and 1", opened["b"], *closed["b"])
+	}
+
+	if _, _, err := p.Get("missing"); err == nil {
+		t.Error("Get of a missing file succeeded")
+	}
+	p.Close()
+	if *closed["b"] != 2 || *closed["c"] != 1 {
+		t.Errorf("Close left files open: b closed %d times, c %d", *closed["b"], *closed["c"])
+	}
+}
+
+func TestReadRegionAsync(t *testing.T) {
+	g := newTestGray32(37, 50)
+	var buf bytes.Buffer
+	if err := (&Encoder{TileWidth: 16, TileHeight: 16}).Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rects := []image.Rectangle{image.Rect(0, 0, 16, 16), image.Rect(10, 20, 37, 50), image.Rect(30, 0, 100, 10)}
+	var pending []<-chan RegionResult
+	for _, rect := range rects {
+		pending = append(pending, r.ReadRegionAsync(rect))
+	}
+	for k, ch := range pending {
+		res := <-ch
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		m := res.Image.(*Gray32)
+		want := rects[k].Intersect(r.Bounds())
+		if m.Bounds() != want {
+			t.Fatalf("region %v has bounds %v, want %v", rects[k], m.Bounds(), want)
+		}
+		for y := want.Min.Y; y < want.Max.Y; y++ {
+			for x := want.Min.X; x < want.Max.X; x++ {
+				if v := m.Gray32At(x, y).Y; v != g.Pix[y*37+x] {
+					t.Fatalf("region %v: pixel (%d, %d) = %#x, want %#x", rects[k], x, y, v, g.Pix[y*37+x])
+				}
+			}
+		}
+		if _, ok := <-ch; ok {
+			t.Error("ReadRegionAsync sent a second result")
+		}
+	}
+}
+
+// sparseFile returns a copy of data, a little-endian file, in which the
+// blocks ks of the first image hold no data, as in sparse files.
+func sparseFile(t *testing.T, data []byte, ks ...int) []byte {
+	t.Helper()
+	tr, err := readIFDTree(bytes.NewReader(data), binary.LittleEndian, int64(binary.LittleEndian.Uint32(data[4:])), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range tr.entries {
+		switch e.tag {
+		case TagStripOffsets, TagStripByteCounts, TagTileOffsets, TagTileByteCounts:
+			for _, k := range ks {
+				e.data[k] = 0
+			}
+		}
+	}
+	out := append([]byte(nil), data...)
+	if len(out)%2 != 0 {
+		out = append(out, 0)
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)))
+	var ifd bytes.Buffer
+	if err := tr.write(&ifd, int64(len(out)), 0); err != nil {
+		t.Fatal(err)
+	}
+	return append(out, ifd.Bytes()...)
+}
+
+func TestCopyTiles(t *testing.T) {
+	g := newTestGray32(40, 37)
+	md := &Metadata{Geo: &GeoInfo{PixelScale: []float64{10, 10, 0}, Tiepoints: []float64{0, 0, 0, 1000, 5000, 0}}}
+	deflated := &tiff.Options{Compression: tiff.Deflate, Predictor: true}
+	for _, tc := range []struct {
+		name   string
+		e      *Encoder
+		region image.Rectangle
+	}{
+		{"tiles", &Encoder{Options: deflated, TileWidth: 16, TileHeight: 16}, image.Rect(16, 16, 40, 37)},
+		{"inner tile", &Encoder{Options: deflated, TileWidth: 16, TileHeight: 16}, image.Rect(16, 0, 32, 16)},
+		{"ZSTD tiles", &Encoder{ZSTD: &ZSTDOptions{DictionarySize: 1 << 10}, TileWidth: 16, TileHeight: 16}, image.Rect(0, 16, 32, 37)},
+		{"strips", &Encoder{}, image.Rect(0, 0, 40, 37)},
+	} {
+		var buf bytes.Buffer
+		if err := tc.e.EncodeWithMetadata(&buf, g, md); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := CopyTiles(&out, r, tc.region); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		m, got, err := DecodeWithMetadata(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if m.Bounds() != (image.Rectangle{Max: tc.region.Size()}) {
+			t.Fatalf("%s: bounds %v, want the size of %v", tc.name, m.Bounds(), tc.region)
+		}
+		for y := tc.region.Min.Y; y < tc.region.Max.Y; y++ {
+			for x := tc.region.Min.X; x < tc.region.Max.X; x++ {
+				if v := m.(*Gray32).Gray32At(x-tc.region.Min.X, y-tc.region.Min.Y).Y; v != g.Pix[y*40+x] {
+					t.Fatalf("%s: pixel (%d, %d) = %#x, want %#x", tc.name, x, y, v, g.Pix[y*40+x])
+				}
+			}
+		}
+		gt, _ := got.Geo.GeoTransform()
+		if x, y := gt.Apply(0, 0); x != 1000+10*float64(tc.region.Min.X) || y != 5000-10*float64(tc.region.Min.Y) {
+			t.Errorf("%s: origin at (%g, %g)", tc.name, x, y)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := (&Encoder{TileWidth: 16, TileHeight: 16}).Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, region := range []image.Rectangle{image.Rect(8, 0, 32, 16), image.Rect(0, 0, 20, 16), image.Rect(0, 0, 48, 16), {}} {
+		if err := CopyTiles(io.Discard, r, region); err == nil {
+			t.Errorf("CopyTiles accepted the region %v", region)
+		}
+	}
+
+	// Tiles holding no data stay so.
+	if err := (&Encoder{Options: deflated, TileWidth: 16, TileHeight: 16}).Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewReader(bytes.NewReader(sparseFile(t, buf.Bytes(), 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := CopyTiles(&out, r, image.Rect(16, 16, 40, 37)); err != nil {
+		t.Fatalf("sparse tiles: %v", err)
+	}
+	r, err = NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.d.blockOffsets[0] != 0 || r.d.blockCounts[0] != 0 {
+		t.Errorf("sparse tile stored as %d bytes at %d", r.d.blockCounts[0], r.d.blockOffsets[0])
+	}
+	m, err := r.ReadRegion(image.Rect(16, 0, 24, 21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 21; y++ {
+		for x := 16; x < 24; x++ {
+			if v := m.(*Gray32).Gray32At(x, y).Y; v != g.Pix[(y+16)*40+x+16] {
+				t.Fatalf("sparse tiles: pixel (%d, %d) = %#x, want %#x", x, y, v, g.Pix[(y+16)*40+x+16])
+			}
+		}
+	}
+}
+
+func TestWriterCopyTiles(t *testing.T) {
+	g := newTestGray32(40, 37)
+	deflated := &tiff.Options{Compression: tiff.Deflate, Predictor: true}
+	lzw := &tiff.Options{Compression: tiff.LZW}
+	for _, tc := range []struct {
+		name   string
+		e      *Encoder
+		region image.Rectangle
+	}{
+		{"tiles", &Encoder{Options: deflated, TileWidth: 16, TileHeight: 16}, image.Rect(16, 16, 40, 37)},
+		{"inner tile", &Encoder{Options: deflated, TileWidth: 16, TileHeight: 16}, image.Rect(16, 0, 32, 16)},
+		{"LZW tiles", &Encoder{Options: lzw, TileWidth: 16, TileHeight: 16}, image.Rect(0, 16, 32, 37)},
+		{"strips", &Encoder{}, image.Rect(0, 0, 40, 37)},
+	} {
+		var buf bytes.Buffer
+		if err := tc.e.Encode(&buf, g); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := new(memFile)
+		opt := &WriterOptions{Options: tc.e.Options, TileWidth: tc.e.TileWidth, TileHeight: tc.e.TileHeight}
+		w, err := NewWriterWithOptions(&seekFile{f: f}, image.Config{Width: tc.region.Dx(), Height: tc.region.Dy()}, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.CopyTiles(r, tc.region, image.Point{}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		m, err := Decode(bytes.NewReader(*f))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if m.Bounds() != (image.Rectangle{Max: tc.region.Size()}) {
+			t.Fatalf("%s: bounds %v, want the size of %v", tc.name, m.Bounds(), tc.region)
+		}
+		for y := tc.region.Min.Y; y < tc.region.Max.Y; y++ {
+			for x := tc.region.Min.X; x < tc.region.Max.X; x++ {
+				if v := m.(*Gray32).Gray32At(x-tc.region.Min.X, y-tc.region.Min.Y).Y; v != g.Pix[y*40+x] {
+					t.Fatalf("%s: pixel (%d, %d) = %#x, want %#x", tc.name, x, y, v, g.Pix[y*40+x])
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := (&Encoder{TileWidth: 16, TileHeight: 16}).Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriterWithOptions(&seekFile{f: new(memFile)}, image.Config{Width: 64, Height: 64}, &WriterOptions{TileWidth: 16, TileHeight: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, region := range []image.Rectangle{image.Rect(8, 0, 32, 16), image.Rect(0, 0, 20, 16), image.Rect(0, 0, 48, 16), {}} {
+		if err := w.CopyTiles(r, region, image.Point{}); err == nil {
+			t.Errorf("CopyTiles accepted the region %v", region)
+		}
+	}
+	for _, at := range []image.Point{{8, 0}, {48, 48}, {0, 0}} {
+		// The tiles at the edge of the source are cut short inside the
+		// output at (0, 0).
+		if err := w.CopyTiles(r, r.Bounds(), at); err == nil {
+			t.Errorf("CopyTiles accepted copying the image to %v", at)
+		}
+	}
+	var ue UnsupportedError
+	if err := w.CopyTiles(r, image.Rect(0, 0, 32, 32), image.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	w, err = NewWriterWithOptions(&seekFile{f: new(memFile)}, image.Config{Width: 64, Height: 64}, &WriterOptions{Options: deflated, TileWidth: 16, TileHeight: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CopyTiles(r, image.Rect(0, 0, 32, 32), image.Point{}); !errors.As(err, &ue) {
+		t.Errorf("uncompressed tiles copied into deflated ones: got %v, want an UnsupportedError", err)
+	}
+
+	// Blocks holding no data are stored as zeros.
+	defer func(n int) { writerStripBytes = n }(writerStripBytes)
+	writerStripBytes = 8 * 40 * 4
+	noPredictor := &tiff.Options{Compression: tiff.Deflate}
+	var tiles bytes.Buffer
+	if err := (&Encoder{Options: deflated, TileWidth: 16, TileHeight: 16}).Encode(&tiles, g); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opt  *WriterOptions
+	}{
+		{"sparse tiles", tiles.Bytes(), &WriterOptions{Options: deflated, TileWidth: 16, TileHeight: 16}},
+		{"sparse strips", encodeStrips(t, g, 8, CompressionNone, func(p []byte) []byte { return p }), &WriterOptions{}},
+		{"sparse deflate strips", encodeStrips(t, g, 8, CompressionDeflate, deflate), &WriterOptions{Options: noPredictor}},
+	} {
+		r, err := NewReader(bytes.NewReader(sparseFile(t, tc.data, 1, 4)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := new(memFile)
+		w, err := NewWriterWithOptions(&seekFile{f: f}, image.Config{Width: 40, Height: 37}, tc.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.CopyTiles(r, r.Bounds(), image.Point{}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		m, err := Decode(bytes.NewReader(*f))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		bw, bh := 40, 8
+		if tc.opt.TileWidth > 0 {
+			bw, bh = 16, 16
+		}
+		for y := 0; y < 37; y++ {
+			for x := 0; x < 40; x++ {
+				want := g.Pix[y*40+x]
+				if k := y/bh*((40+bw-1)/bw) + x/bw; k == 1 || k == 4 {
+					want = 0
+				}
+				if v := m.(*Gray32).Gray32At(x, y).Y; v != want {
+					t.Fatalf("%s: pixel (%d, %d) = %#x, want %#x", tc.name, x, y, v, want)
+				}
+			}
+		}
+	}
+}
+
+func TestCopyTilesMosaic(t *testing.T) {
+	opt := &tiff.Options{Compression: tiff.Deflate, Predictor: true}
+	e := &Encoder{Options: opt, TileWidth: 16, TileHeight: 16}
+	left, right := newTestGrayFloat32(32, 40), newTestGrayFloat32(24, 40)
+	for i := range right.Pix {
+		right.Pix[i] ^= 0x5555
+	}
+	// The right image lies east of the left one, on the same grid.
+	geos := []*GeoInfo{
+		{PixelScale: []float64{10, 10, 0}, Tiepoints: []float64{0, 0, 0, 1000, 5000, 0}},
+		{PixelScale: []float64{10, 10, 0}, Tiepoints: []float64{0, 0, 0, 1320, 5000, 0}},
+	}
+	var srcs []*Reader
+	for k, m := range []*GrayFloat32{left, right} {
+		var buf bytes.Buffer
+		if err := e.EncodeWithMetadata(&buf, m, &Metadata{Geo: geos[k]}); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, r)
+	}
+
+	f := new(memFile)
+	cfg := image.Config{ColorModel: Gray32FloatModel, Width: 56, Height: 48}
+	// The right image, copied from its origin to (32, 0), georeferences
+	// the mosaic once shifted back by 32 columns.
+	md := &Metadata{Software: "mosaic", Geo: geos[1].Shift(-32, 0)}
+	w, err := NewWriterWithOptions(&seekFile{f: f}, cfg, &WriterOptions{Options: opt, TileWidth: 16, TileHeight: 16, BlockChecksums: true, Metadata: md})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The right image ends the mosaic, whose bottom row of tiles is left
+	// empty.
+	if err := w.CopyTiles(srcs[1], srcs[1].Bounds(), image.Pt(32, 0)); err == nil {
+		t.Error("CopyTiles accepted tiles cut short inside the mosaic")
+	}
+	if err := w.CopyTiles(srcs[0], image.Rect(0, 0, 32, 32), image.Pt(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CopyTiles(srcs[1], image.Rect(0, 0, 24, 32), image.Pt(32, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CopyTiles(srcs[0], image.Rect(16, 16, 32, 32), image.Pt(16, 16)); err == nil {
+		t.Error("CopyTiles accepted a tile written twice")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReaderWithOptions(bytes.NewReader(*f), &ReaderOptions{Strict: true, VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := r.ReadRegion(r.Bounds())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.(*GrayFloat32)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 56; x++ {
+			var want uint32
+			switch {
+			case y >= 32:
+			case x < 32:
+				want = left.Pix[left.PixOffset(x, y)]
+			default:
+				want = right.Pix[right.PixOffset(x-32, y)]
+			}
+			if v := got.Pix[got.PixOffset(x, y)]; v != want {
+				t.Fatalf("pixel (%d, %d) = %#x, want %#x", x, y, v, want)
+			}
+		}
+	}
+	md, err = r.Metadata()
+	if err != nil || md.Software != "mosaic" {
+		t.Fatalf("metadata %+v, %v", md, err)
+	}
+	gt, _ := md.Geo.GeoTransform()
+	if x, y := gt.Apply(0, 0); x != 1000 || y != 5000 {
+		t.Errorf("mosaic origin at (%g, %g), want (1000, 5000)", x, y)
+	}
+	if geos[1].Tiepoints[0] != 0 {
+		t.Errorf("Shift changed the tiepoints shifted to %v", geos[1].Tiepoints)
+	}
+
+	// A transformation is shifted to the same grid.
+	g := &GeoInfo{Transformation: []float64{10, 0, 0, 1320, 0, -10, 0, 5000, 0, 0, 0, 0, 0, 0, 0, 1}}
+	gt, _ = g.Shift(-32, 0).GeoTransform()
+	if x, y := gt.Apply(32, 0); x != 1320 || y != 5000 {
+		t.Errorf("shifted transformation puts (32, 0) at (%g, %g), want (1320, 5000)", x, y)
+	}
+	if g.Transformation[3] != 1320 {
+		t.Errorf("Shift changed the transformation shifted to %v", g.Transformation)
+	}
+}
+
+func TestBlockChecksums(t *testing.T) {
+	g := newTestGray32(40, 37)
+	for _, tc := range []struct {
+		name string
+		e    *Encoder
+	}{
+		{"strip", &Encoder{BlockChecksums: true}},
+		{"deflate tiles", &Encoder{BlockChecksums: true, Options: &tiff.Options{Compression: tiff.Deflate}, TileWidth: 16, TileHeight: 16}},
+	} {
+		var buf bytes.Buffer
+		if err := tc.e.Encode(&buf, g); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		verified := &ReaderOptions{VerifyChecksums: true, Workers: 1}
+		r, err := NewReaderWithOptions(bytes.NewReader(data), verified)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if r.d.blockChecksums == nil {
+			t.Fatalf("%s: no checksums found", tc.name)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		comparePix(t, m.(*Gray32).Pix, g.Pix)
+
+		// Corrupt the last block.
+		k := len(r.d.blockOffsets) - 1
+		bad := append([]byte(nil), data...)
+		bad[r.d.blockOffsets[k]+r.d.blockCounts[k]/2] ^= 0x10
+		r, err = NewReaderWithOptions(bytes.NewReader(bad), verified)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fe FormatError
+		if _, err := r.ReadRegion(r.Bounds()); !errors.As(err, &fe) || !strings.Contains(err.Error(), "checksum") {
+			t.Errorf("%s: corrupt block: got %v, want a checksum FormatError", tc.name, err)
+		}
+		if k > 0 {
+			if _, err := r.ReadRegion(image.Rect(0, 0, 16, 16)); err != nil {
+				t.Errorf("%s: block before the corrupt one: %v", tc.name, err)
+			}
+		}
+		// Uncompressed data is otherwise decoded corrupt as it is.
+		if _, err := Decode(bytes.NewReader(bad)); err != nil && tc.e.Options == nil {
+			t.Errorf("%s: unverified decoding failed: %v", tc.name, err)
+		}
+	}
+
+	// Cropping keeps the checksums of the tiles kept.
+	var buf bytes.Buffer
+	if err := (&Encoder{BlockChecksums: true, TileWidth: 16, TileHeight: 16}).Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := CopyTiles(&out, r, image.Rect(16, 16, 40, 37)); err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewReaderWithOptions(bytes.NewReader(out.Bytes()), &ReaderOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadRegion(r.Bounds()); err != nil {
+		t.Errorf("cropped image: %v", err)
+	}
+}
+
+func TestBlockTransform(t *testing.T) {
+	g := newTestGray32(40, 37)
+	key := bytes.Repeat([]byte{7}, 32)
+	aes, err := NewAESGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewAESGCM(bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		e    *Encoder
+	}{
+		{"strip", &Encoder{Transform: aes, VerifyRows: 10, BlockChecksums: true}},
+		{"deflate tiles", &Encoder{Transform: aes, VerifyRows: 10, Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 16, TileHeight: 16}},
+		{"ZSTD tiles", &Encoder{Transform: aes, ZSTD: &ZSTDOptions{}, TileWidth: 16, TileHeight: 16}},
+	} {
+		var buf bytes.Buffer
+		if err := tc.e.Encode(&buf, g); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		data := buf.Bytes()
+		row := make([]byte, 4*40)
+		for x, v := range g.Pix[40:80] {
+			binary.LittleEndian.PutUint32(row[4*x:], v)
+		}
+		if tc.e.Options == nil && tc.e.ZSTD == nil && bytes.Contains(data, row) {
+			t.Errorf("%s: samples stored in the clear", tc.name)
+		}
+		r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Transform: aes, Strict: true, VerifyChecksums: true})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		rect := image.Rect(10, 5, 35, 30)
+		m, err := r.ReadRegion(rect)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				if v := m.(*Gray32).Gray32At(x, y).Y; v != g.Pix[y*40+x] {
+					t.Fatalf("%s: pixel (%d, %d) = %#x, want %#x", tc.name, x, y, v, g.Pix[y*40+x])
+				}
+			}
+		}
+
+		r, err = NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Transform: other})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fe FormatError
+		if _, err := r.ReadRegion(r.Bounds()); !errors.As(err, &fe) {
+			t.Errorf("%s: wrong key: got %v, want a FormatError", tc.name, err)
+		}
+	}
+	if _, err := NewAESGCM([]byte("short")); err == nil {
+		t.Error("NewAESGCM accepted a 5-byte key")
+	}
+}
+
+func TestReaderBlocks(t *testing.T) {
+	src := NewGray32(image.Rect(0, 0, 50, 40))
+	for i := range src.Pix {
+		src.Pix[i] = uint32(i)
+	}
+	for _, tc := range []struct {
+		name   string
+		e      *Encoder
+		size   image.Point
+		want   []image.Rectangle
+		blocks int64
+	}{
+		{"tiles", &Encoder{TileWidth: 16, TileHeight: 16}, image.Pt(20, 20), []image.Rectangle{
+			image.Rect(0, 0, 32, 32), image.Rect(32, 0, 50, 32),
+			image.Rect(0, 32, 32, 40), image.Rect(32, 32, 50, 40),
+		}, 12},
+		{"single tiles", &Encoder{TileWidth: 32, TileHeight: 32}, image.Point{}, []image.Rectangle{
+			image.Rect(0, 0, 32, 32), image.Rect(32, 0, 50, 32),
+			image.Rect(0, 32, 32, 40), image.Rect(32, 32, 50, 40),
+		}, 4},
+		{"strip", &Encoder{}, image.Pt(1, 20), []image.Rectangle{image.Rect(0, 0, 50, 40)}, 1},
+	} {
+		var buf bytes.Buffer
+		if err := tc.e.Encode(&buf, src); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var m countingMetrics
+		rd, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{Metrics: &m})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var got []image.Rectangle
+		for r := range rd.Blocks(tc.size) {
+			got = append(got, r)
+			img, err := rd.ReadRegion(r)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if c := img.(*Gray32).Gray32At(r.Min.X, r.Min.Y); c != src.Gray32At(r.Min.X, r.Min.Y) {
+				t.Errorf("%s: region %v starts with %v", tc.name, r, c)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: Blocks = %v, want %v", tc.name, got, tc.want)
+		}
+		if n := m.blocks.Load(); n != tc.blocks {
+			t.Errorf("%s: %d blocks decoded, want %d", tc.name, n, tc.blocks)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// A Pool keeps the Readers of files opened once, by name, so that a tile
+// server does not read and parse the IFD of a file on every request. Files
+// are closed once they have been kept longer than TTL or are the least
+// recently used beyond MaxEntries, and no Reader got from them is in use.
+// A Pool may be used from several goroutines at once.
+type Pool struct {
+	// Open opens the file of a name, such as a path or URL. If the
+	// io.ReaderAt returned is also an io.Closer, it is closed when the file
+	// leaves the pool.
+	Open func(name string) (io.ReaderAt, error)
+	// Options, if not nil, are those of the Readers. If their Metrics is a
+	// CacheMetrics, it is also told whether each Get found its file in the
+	// pool.
+	Options *ReaderOptions
+	// TTL, if not zero, is the time a file is kept after being opened.
+	TTL time.Duration
+	// MaxEntries, if not zero, is the number of files kept.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+	lru     list.List // Of *poolEntry, the most recently used first.
+	now     func() time.Time
+}
+
+// A poolEntry is a file of a Pool. Its fields other than r and err are
+// guarded by the mutex of the pool; r and err are set before ready is
+// closed.
+type poolEntry struct {
+	name    string
+	ready   chan struct{}
+	r       *Reader
+	err     error
+	closer  io.Closer
+	loaded  bool
+	opened  time.Time
+	refs    int // Readers in use, and the Get opening the file.
+	evicted bool
+	elem    *list.Element
+}
+
+// Get returns a Reader of the file of name, opening it unless the pool
+// holds it already. The Reader is a Clone of the one kept, for the use of
+// the caller alone, and release must be called once it is no longer used.
+// Several calls asking for a file being opened wait for it to be opened
+// once.
+func (p *Pool) Get(name string) (r *Reader, release func(), err error) {
+	if p.Open == nil {
+		return nil, nil, errors.New("tiff: Pool without an Open function")
+	}
+	p.mu.Lock()
+	if p.entries == nil {
+		p.entries = make(map[string]*poolEntry)
+	}
+	e := p.entries[name]
+	if e != nil && e.loaded && p.TTL > 0 && p.clock().Sub(e.opened) >= p.TTL {
+		p.evict(e)
+		e = nil
+	}
+	if p.Options != nil {
+		cacheLookup(p.Options.Metrics, e != nil)
+	}
+	if e != nil {
+		e.refs++
+		p.lru.MoveToFront(e.elem)
+		p.mu.Unlock()
+		<-e.ready
+		if e.err != nil {
+			p.release(e)
+			return nil, nil, e.err
+		}
+	} else {
+		e = &poolEntry{name: name, ready: make(chan struct{}), refs: 1}
+		e.elem = p.lru.PushFront(e)
+		p.entries[name] = e
+		p.mu.Unlock()
+
+		ra, err := p.Open(name)
+		var rd *Reader
+		if err == nil {
+			if rd, err = NewReaderWithOptions(ra, p.Options); err != nil {
+				if c, ok := ra.(io.Closer); ok {
+					c.Close()
+				}
+			}
+		}
+		p.mu.Lock()
+		e.r, e.err, e.loaded, e.opened = rd, err, true, p.clock()
+		if c, ok := ra.(io.Closer); ok && err == nil {
+			e.closer = c
+		}
+		close(e.ready)
+		if err != nil {
+			e.refs--
+			p.evict(e)
+			p.mu.Unlock()
+			return nil, nil, err
+		}
+		p.trim()
+		p.mu.Unlock()
+	}
+	var once sync.Once
+	return e.r.Clone(), func() { once.Do(func() { p.release(e) }) }, nil
+}
+
+// Close takes every file out of the pool, closing those whose Readers are
+// not in use; the others are closed once released. The pool may still be
+// used afterwards.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.lru.Len() > 0 {
+		p.evict(p.lru.Back().Value.(*poolEntry))
+	}
+}
+
+// clock returns the current time.
+func (p *Pool) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// trim evicts the least recently used files beyond MaxEntries.
+func (p *Pool) trim() {
+	for p.MaxEntries > 0 && p.lru.Len() > p.MaxEntries {
+		p.evict(p.lru.Back().Value.(*poolEntry))
+	}
+}
+
+// evict takes e out of the pool, closing its file if it is not in use.
+func (p *Pool) evict(e *poolEntry) {
+	if e.evicted {
+		return
+	}
+	e.evicted = true
+	delete(p.entries, e.name)
+	p.lru.Remove(e.elem)
+	if e.refs == 0 && e.closer != nil {
+		e.closer.Close()
+	}
+}
+
+// release hands back a Reader got from e, closing the file of e if it has
+// left the pool and is no longer in use.
+func (p *Pool) release(e *poolEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.refs--
+	if e.evicted && e.refs == 0 && e.closer != nil {
+		e.closer.Close()
+	}
+}
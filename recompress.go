@@ -0,0 +1,388 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/image/tiff"
+)
+
+// RecompressOptions are the parameters of Recompress.
+type RecompressOptions struct {
+	// Options gives the compression and predictor of the output, as for
+	// Encode. If nil, the pixels are stored uncompressed.
+	Options *tiff.Options
+	// Workers is the number of goroutines decompressing and compressing
+	// strips concurrently. If zero, GOMAXPROCS is used.
+	Workers int
+	// Pool, if not nil, bounds the strips being recompressed at once,
+	// shared with the other users of the pool.
+	Pool *WorkerPool
+	// Progress, if not nil, is called after each strip is written.
+	Progress func(RecompressProgress)
+}
+
+// RecompressProgress tells how far Recompress has got.
+type RecompressProgress struct {
+	Image   int   // The index of the image being written.
+	Rows    int   // The rows of the image written so far.
+	Height  int   // The height of the image.
+	Read    int64 // The bytes read from the input so far.
+	Written int64 // The bytes written to the output so far.
+}
+
+// Recompress copies the images of the TIFF file in src to dst as Transcode
+// does, storing their pixels anew with the compression and predictor of
+// opt, which may be nil, but in strips, streamed from those of src rather
+// than held whole in memory. Each strip of the output is made of whole
+// rows of strips or tiles of src, of about 256KB, and is read,
+// decompressed and compressed anew concurrently with the others, up to
+// twice the number of workers at a time, so that memory is bounded by a
+// few strips however large the images. Strips of src larger than that,
+// such as those of images stored as a single strip, are read and
+// decompressed as they go, 256KB of rows at a time, and cut into several
+// strips of the output.
+//
+// The IFDs are written after the pixels, so dst must be able to seek back
+// to the header. The limitations of Transcode apply.
+func Recompress(dst io.WriteSeeker, src io.ReaderAt, opt *RecompressOptions) error {
+	var o RecompressOptions
+	if opt != nil {
+		o = *opt
+	}
+	compression, predictor, err := encodingOptions(o.Options)
+	if err != nil {
+		return err
+	}
+	if o.Workers <= 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+	o.Workers = o.Pool.limit(o.Workers)
+	var read atomic.Int64
+	src = countingReaderAt{src, &read}
+	d, err := newDecoder(src, &ReaderOptions{Pool: o.Pool})
+	if err != nil {
+		return err
+	}
+	chain, err := d.ifdChain()
+	if err != nil {
+		return err
+	}
+
+	var header [8]byte
+	copy(header[:], leHeader)
+	if _, err := dst.Write(header[:]); err != nil {
+		return err
+	}
+	off := int64(8)
+	trees := make([]*ifdTree, len(chain))
+	for i := range chain {
+		if i > 0 {
+			if d, err = newDecoder(src, &ReaderOptions{Image: i, Pool: o.Pool}); err != nil {
+				return err
+			}
+		}
+		t, err := readIFDTree(src, d.byteOrder, chain[i], 0)
+		if err != nil {
+			return err
+		}
+		if _, ok := d.ifd[TagSubIFDs]; ok {
+			return UnsupportedError{Feature: "transcoding of SubIFDs"}
+		}
+		if err := d.checkTranscode(predictor); err != nil {
+			return err
+		}
+		rows := d.blockHeight * max(1, writerStripBytes/(d.blockHeight*d.rowBytes(d.config.Width)))
+		if d.streamedStrips() {
+			rows = max(1, writerStripBytes/d.rowBytes(d.config.Width))
+		}
+		var offsets []uint32
+		counts, err := d.recompressStrips(dst, rows, compression, predictor, o.Workers, func(y int, n uint32) error {
+			if uint64(off)+uint64(n) > math.MaxUint32 {
+				return UnsupportedError{Feature: "file too large for a classic TIFF file"}
+			}
+			offsets = append(offsets, uint32(off))
+			off += int64(n)
+			if o.Progress != nil {
+				o.Progress(RecompressProgress{i, y, d.config.Height, read.Load(), off})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if off%2 != 0 {
+			if err := writePad(dst, 1); err != nil {
+				return err
+			}
+			off++
+		}
+		ifd := t.entries[:0]
+		for _, e := range t.entries {
+			if !storageTags[e.tag] {
+				ifd = append(ifd, e)
+			}
+		}
+		t.entries = appendStorage(ifd, compression, predictor, min(rows, d.config.Height), 0, 0, offsets, counts)
+		trees[i] = t
+	}
+
+	first := off
+	for i, t := range trees {
+		next := int64(0)
+		if i < len(trees)-1 {
+			next = off + int64(t.size())
+		}
+		if uint64(off)+uint64(t.size()) > math.MaxUint32 {
+			return UnsupportedError{Feature: "file too large for a classic TIFF file"}
+		}
+		if err := t.write(dst, off, next); err != nil {
+			return err
+		}
+		off = next
+	}
+	enc.PutUint32(header[4:], uint32(first))
+	if _, err := dst.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dst.Write(header[4:]); err != nil {
+		return err
+	}
+	_, err = dst.Seek(0, io.SeekEnd)
+	return err
+}
+
+// checkTranscode reports whether the pixels of the image can be stored anew
+// with or without predictor, once its layout is parsed.
+func (d *decoder) checkTranscode(predictor bool) error {
+	if err := d.parseLayout(); err != nil {
+		return err
+	}
+	if d.depth() > 1 {
+		return UnsupportedError{Feature: "transcoding of volumes"}
+	}
+	if d.format == formatYCbCr && (d.subsampleX != 1 || d.subsampleY != 1) {
+		return UnsupportedError{Feature: "transcoding of subsampled YCbCr"}
+	}
+	if predictor && d.bitsPerSample != 8 && d.bitsPerSample != 16 && d.bitsPerSample != 32 {
+		return UnsupportedError{"predictor with BitsPerSample", TagBitsPerSample, uint(d.bitsPerSample)}
+	}
+	if pixelBits := d.samplesPerPixel * d.bitsPerSample; pixelBits%8 != 0 && d.blocksAcross > 1 {
+		// Rows would have to be joined in the middle of a byte.
+		return UnsupportedError{Feature: fmt.Sprintf("transcoding of tiled %d-bit pixels", pixelBits)}
+	}
+	return nil
+}
+
+// streamedStrips reports whether Recompress reads the strips of the image
+// as a stream of rows, because they are larger than the strips it writes.
+func (d *decoder) streamedStrips() bool {
+	return !d.blockPadding && d.blockBytes() > int64(writerStripBytes) && d.format != formatYCbCr
+}
+
+// A stripJob is a strip of Recompress: rows [y0, y1) of the image, made of
+// the rows of blocks from j0 to j1, or if raw is set, read already into raw,
+// or failed to be read with err.
+type stripJob struct {
+	y0, y1 int
+	j0, j1 int
+	raw    []byte
+	err    error
+	done   chan stripResult
+}
+
+type stripResult struct {
+	data  *bytes.Buffer
+	count uint32
+	err   error
+}
+
+// recompressStrips writes the samples of the image to w as strips of rows
+// rows, a multiple of the height of its blocks unless the strips of the
+// image are streamed, with the given compression and predictor, and returns
+// the size of each. Strips are read and compressed by workers goroutines
+// but written in order, wrote being called after each is written with the
+// rows written so far and its size. Streamed strips are read in order, as
+// the jobs are handed out.
+func (d *decoder) recompressStrips(w io.Writer, rows int, compression uint32, predictor bool, workers int, wrote func(y int, n uint32) error) ([]uint32, error) {
+	perStrip := rows / d.blockHeight
+	rowBytes := d.rowBytes(d.config.Width)
+	jobs := make(chan stripJob)
+	queue := make(chan stripJob, workers) // The strips in flight, in order.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(stop)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(queue)
+		defer close(jobs)
+		var sr *stripReader
+		if perStrip == 0 {
+			sr = &stripReader{d: d}
+			defer sr.close()
+		}
+		for y := 0; y < d.config.Height; y += rows {
+			j := y / d.blockHeight
+			job := stripJob{
+				y0: y, y1: min(y+rows, d.config.Height),
+				j0: j, j1: min(j+perStrip, d.blocksDown),
+				done: make(chan stripResult, 1),
+			}
+			if sr != nil {
+				job.raw = make([]byte, (job.y1-job.y0)*rowBytes)
+				job.err = sr.read(job.raw)
+			}
+			select {
+			case queue <- job:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-stop:
+				return
+			}
+			if job.err != nil {
+				return
+			}
+		}
+	}()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var s blockState
+			c := d.newBlockCompressor(compression, predictorValue(predictor), rowBytes)
+			var raw []byte
+			for job := range jobs {
+				if n := (job.y1 - job.y0) * rowBytes; job.raw != nil {
+					raw = job.raw
+				} else if cap(raw) < n {
+					raw = make([]byte, n)
+				} else {
+					raw = raw[:n]
+				}
+				res := stripResult{err: job.err}
+				d.pool.acquire()
+				for j := job.j0; j < job.j1 && res.err == nil; j++ {
+					res.err = d.readBlockRow(&s, j, raw[(j*d.blockHeight-job.y0)*rowBytes:])
+				}
+				if res.err == nil {
+					d.makeLittleEndian(raw)
+					res.data = new(bytes.Buffer)
+					res.count, res.err = c.compress(res.data, raw)
+				}
+				d.pool.release()
+				job.done <- res
+			}
+		}()
+	}
+
+	var counts []uint32
+	for job := range queue {
+		res := <-job.done
+		if res.err != nil {
+			return nil, res.err
+		}
+		if _, err := res.data.WriteTo(w); err != nil {
+			return nil, err
+		}
+		if err := wrote(job.y1, res.count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, res.count)
+	}
+	return counts, nil
+}
+
+// A stripReader reads the rows of an image stored in strips, from the
+// first, as stored but with the predictor undone, decompressing each strip
+// as it goes so that none is held whole in memory.
+type stripReader struct {
+	d  *decoder
+	s  blockState
+	j  int           // The strip holding the next row.
+	y  int           // The next row.
+	zr io.ReadCloser // Of strip j, if compressed and opened.
+}
+
+// read reads the next rows into buf, which holds a whole number of them.
+func (r *stripReader) read(buf []byte) error {
+	d := r.d
+	rowBytes := d.rowBytes(d.config.Width)
+	for len(buf) > 0 {
+		b := d.blockBounds(0, r.j)
+		end := min(b.Max.Y, d.config.Height)
+		rows := min(len(buf)/rowBytes, end-r.y)
+		part := buf[:rows*rowBytes]
+		if d.uncompressed() {
+			skip := int64(r.y-b.Min.Y) * int64(rowBytes)
+			if skip+int64(len(part)) > int64(d.blockCounts[r.j]) {
+				return errNoPixels
+			}
+			if n, err := d.r.ReadAt(part, int64(d.blockOffsets[r.j])+skip); n < len(part) {
+				if err == nil || err == io.EOF {
+					return errNoPixels
+				}
+				return err
+			}
+		} else {
+			if r.zr == nil {
+				var err error
+				if r.zr, err = d.decompressor(&r.s, 0, r.j, nil); err != nil {
+					return err
+				}
+			}
+			if _, err := io.ReadFull(r.zr, part); err == io.EOF || err == io.ErrUnexpectedEOF {
+				return errNoPixels
+			} else if err != nil {
+				return err
+			}
+		}
+		if d.predicted() {
+			if err := d.unpredict(part, image.Rect(b.Min.X, r.y, b.Max.X, r.y+rows)); err != nil {
+				return err
+			}
+		}
+		r.y += rows
+		buf = buf[len(part):]
+		if r.y == end {
+			r.close()
+			r.j++
+		}
+	}
+	return nil
+}
+
+// close closes the decompressor of the strip being read, if any.
+func (r *stripReader) close() {
+	if r.zr != nil {
+		r.zr.Close()
+		r.zr = nil
+	}
+}
+
+// A countingReaderAt adds the number of bytes read from r to n.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n *atomic.Int64
+}
+
+func (c countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	k, err := c.r.ReadAt(p, off)
+	c.n.Add(int64(k))
+	return k, err
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// WriteRegion overwrites the pixels inside rect of the first image of the
+// file in f with those of src at the same coordinates, patching the bytes
+// of the file in place rather than rewriting it, so that small edits of
+// huge rasters are cheap. rect must lie within both the image and src.
+//
+// Only uncompressed images without a predictor, with samples of 8 or 16
+// bits of gray or of 32 bits, can be patched. The samples of src are
+// converted to 8- or 16-bit gray as needed, but a 32-bit image must be
+// written from a *Gray32 or *GrayFloat32 of the same color model. The
+// checksums of TagBlockChecksums, if any, are patched along with the
+// blocks. The offset of f is left anywhere.
+func WriteRegion(f io.ReadWriteSeeker, rect image.Rectangle, src image.Image) error {
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		r = seekReaderAt{f}
+	}
+	d, err := newDecoder(r, nil)
+	if err != nil {
+		return err
+	}
+	if err := d.parseLayout(); err != nil {
+		return err
+	}
+	if rect.Empty() {
+		return nil
+	}
+	if !rect.In(image.Rect(0, 0, d.config.Width, d.config.Height)) || !rect.In(src.Bounds()) {
+		return fmt.Errorf("tiff: region %v outside of the image or the source", rect)
+	}
+	if !d.uncompressed() {
+		return UnsupportedError{"writing into an image with compression", TagCompression, d.firstVal(TagCompression)}
+	}
+	if p := d.firstVal(TagPredictor); p > PredictorNone {
+		return UnsupportedError{"writing into an image with predictor", TagPredictor, p}
+	}
+	put, err := d.samplePutter(src)
+	if err != nil {
+		return err
+	}
+
+	size := d.bitsPerSample / 8
+	blockRow := int64(d.rowBytes(d.blockWidth))
+	var pending []byte // Bytes to write at off, gathered from adjacent rows.
+	var off int64
+	var blocks []int // The blocks written into.
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := f.Write(pending)
+		pending = pending[:0]
+		return err
+	}
+	for j := rect.Min.Y / d.blockHeight; j*d.blockHeight < rect.Max.Y; j++ {
+		for i := rect.Min.X / d.blockWidth; i*d.blockWidth < rect.Max.X; i++ {
+			b := d.blockBounds(i, j)
+			k := j*d.blocksAcross + i
+			if want := d.blockSize(i, j); int64(d.blockCounts[k]) < want {
+				return FormatError(fmt.Sprintf("%s holds %d bytes, expected %d", d.blockName(i, j), d.blockCounts[k], want))
+			}
+			blocks = append(blocks, k)
+			c := b.Intersect(rect)
+			for y := c.Min.Y; y < c.Max.Y; y++ {
+				pos := int64(d.blockOffsets[k]) + int64(y-b.Min.Y)*blockRow + int64((c.Min.X-b.Min.X)*size)
+				if pos != off+int64(len(pending)) || len(pending) >= 1<<20 {
+					if err := flush(); err != nil {
+						return err
+					}
+					off = pos
+				}
+				for x := c.Min.X; x < c.Max.X; x++ {
+					pending = put(pending, x, y)
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return d.patchBlockChecksums(f, blocks)
+}
+
+// samplePutter returns a function appending the sample of pixel (x, y) of
+// src to a buffer as the image stores it.
+func (d *decoder) samplePutter(src image.Image) (func(p []byte, x, y int) []byte, error) {
+	order := d.byteOrder
+	switch {
+	case d.grayBands() > 1:
+	case d.format == formatGray32:
+		pix, stride := gray32Pix(src)
+		if pix == nil || src.ColorModel() != d.config.ColorModel {
+			return nil, fmt.Errorf("tiff: cannot write a %T into a 32-bit image of another model", src)
+		}
+		b := src.Bounds()
+		return func(p []byte, x, y int) []byte {
+			p = append(p, 0, 0, 0, 0)
+			order.PutUint32(p[len(p)-4:], pix[(y-b.Min.Y)*stride+x-b.Min.X])
+			return p
+		}, nil
+	case d.format == formatGray && d.bitsPerSample == 8:
+		return func(p []byte, x, y int) []byte {
+			v := color.GrayModel.Convert(src.At(x, y)).(color.Gray).Y
+			if d.invert {
+				v = 0xff - v
+			}
+			return append(p, v)
+		}, nil
+	case d.format == formatGray16:
+		return func(p []byte, x, y int) []byte {
+			v := color.Gray16Model.Convert(src.At(x, y)).(color.Gray16).Y
+			if d.invert {
+				v = 0xffff - v
+			}
+			p = append(p, 0, 0)
+			order.PutUint16(p[len(p)-2:], v)
+			return p
+		}, nil
+	}
+	return nil, UnsupportedError{Feature: fmt.Sprintf("writing into an image with %d samples of %d bits", d.samplesPerPixel, d.bitsPerSample)}
+}
+
+// seekReaderAt reads at any offset by seeking before each read.
+type seekReaderAt struct {
+	rs io.ReadSeeker
+}
+
+func (s seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,359 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+)
+
+// repairStripSize is the size of the strips an oversized single strip is
+// split into by Repair.
+const repairStripSize = 64 << 10
+
+// A Report lists the defects fixed by Repair.
+type Report struct {
+	Fixes []Fix
+}
+
+// A Fix is a defect fixed by Repair.
+type Fix struct {
+	Image int    // Index of the image in the file.
+	Tag   int    // The field fixed, or zero for the IFD as a whole.
+	What  string // The defect and how it was fixed.
+}
+
+func (f Fix) String() string {
+	return fmt.Sprintf("image %d: %s", f.Image, f.What)
+}
+
+// Repair copies the little-endian TIFF file in r to w, rewriting the IFDs
+// of its images to fix common structural defects that make strict readers
+// refuse the file or misread it:
+//
+//   - Fields out of ascending order are sorted, and duplicate fields are
+//     dropped but for the first.
+//   - A missing SampleFormat on samples of more than 8 bits is set to the
+//     unsigned integers the spec implies, and one with fewer values than
+//     there are samples is extended, and so is a BitsPerSample with too
+//     few values.
+//   - A RowsPerStrip that does not match the number of strips is worked out
+//     from the strips.
+//   - A single uncompressed strip larger than 64KB is split into strips of
+//     about 64KB.
+//
+// The data of the file is copied as it is, so the pixels and anything the
+// IFDs point to are left untouched; the new IFDs follow it. If there is
+// nothing to fix, the file is copied unchanged. Defects that cannot be
+// fixed without guessing are reported as a FormatError.
+func Repair(r io.ReaderAt, w io.Writer) (Report, error) {
+	var rep Report
+	var p [8]byte
+	if _, err := r.ReadAt(p[:], 0); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return rep, err
+	}
+	switch string(p[0:4]) {
+	case leHeader:
+	case beHeader:
+		return rep, UnsupportedError{Feature: "repair of a big-endian file"}
+	default:
+		return rep, FormatError("malformed header")
+	}
+
+	var ifds [][]ifdEntry
+	seen := make(map[int64]bool)
+	for off := int64(enc.Uint32(p[4:8])); off != 0; {
+		if seen[off] {
+			return rep, FormatError("IFD chain loops")
+		}
+		if len(ifds) == defaultMaxIFDs {
+			return rep, FormatError("too many IFDs")
+		}
+		seen[off] = true
+		ifd, next, err := readRawIFD(r, enc, off)
+		if err != nil {
+			return rep, err
+		}
+		if ifd, err = repairIFD(ifd, len(ifds), &rep); err != nil {
+			return rep, err
+		}
+		ifds = append(ifds, ifd)
+		off = next
+	}
+	if len(ifds) == 0 {
+		return rep, FormatError("no IFD")
+	}
+
+	size, err := readerSize(r)
+	if err != nil {
+		return rep, err
+	}
+	if len(rep.Fixes) == 0 {
+		_, err := io.Copy(w, io.NewSectionReader(r, 0, size))
+		return rep, err
+	}
+	// The IFDs are laid out after the data, at even offsets.
+	offsets := make([]int64, len(ifds)+1)
+	offsets[0] = size + size%2
+	for i, ifd := range ifds {
+		end := offsets[i] + int64(ifdSize(ifd))
+		offsets[i+1] = end + end%2
+	}
+	if offsets[len(ifds)] > math.MaxUint32 {
+		return rep, UnsupportedError{Feature: "repaired file beyond 4GB"}
+	}
+	offsets[len(ifds)] = 0
+
+	var h [8]byte
+	copy(h[:], leHeader)
+	enc.PutUint32(h[4:], uint32(offsets[0]))
+	if _, err := w.Write(h[:]); err != nil {
+		return rep, err
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(r, 8, size-8)); err != nil {
+		return rep, err
+	}
+	pos := size
+	for i, ifd := range ifds {
+		if pos < offsets[i] {
+			if _, err := w.Write([]byte{0}); err != nil {
+				return rep, err
+			}
+		}
+		if err := writeIFD(w, int(offsets[i]), ifd, int(offsets[i+1])); err != nil {
+			return rep, err
+		}
+		pos = offsets[i] + int64(ifdSize(ifd))
+	}
+	return rep, nil
+}
+
+// readerSize returns the size of the file in r, reading it through if r
+// cannot tell.
+func readerSize(r io.ReaderAt) (int64, error) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), nil
+	case interface{ Stat() (fs.FileInfo, error) }:
+		fi, err := r.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	return io.Copy(io.Discard, io.NewSectionReader(r, 0, math.MaxInt64))
+}
+
+// readRawIFD reads the entries of the IFD at off, in a file of the given
+// byte order, as they are and in the order of the file, and returns them
+// with the offset of the next IFD.
+func readRawIFD(r io.ReaderAt, order binary.ByteOrder, off int64) (ifd []ifdEntry, next int64, err error) {
+	var p [2]byte
+	if _, err := r.ReadAt(p[:], off); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	n := int(order.Uint16(p[:]))
+	if n > defaultMaxIFDEntries {
+		return nil, 0, FormatError("too many IFD entries")
+	}
+	b, err := safeReadAt(r, uint64(ifdLen*n+4), off+2)
+	if err != nil {
+		return nil, 0, err
+	}
+	ifd = make([]ifdEntry, 0, n)
+	for e := b; len(e) > 4; e = e[ifdLen:] {
+		tag, dt := int(order.Uint16(e[0:2])), int(order.Uint16(e[2:4]))
+		if !knownType(dt) {
+			return nil, 0, UnsupportedError{"IFD entry datatype", tag, uint(dt)}
+		}
+		size := uint64(lengths[dt]) * uint64(order.Uint32(e[4:8]))
+		if size > defaultMaxTagDataSize {
+			return nil, 0, FormatError("IFD entry data too large")
+		}
+		var data []byte
+		if size <= 4 {
+			data = append([]byte(nil), e[8:8+size]...)
+		} else if data, err = safeReadAt(r, size, int64(order.Uint32(e[8:12]))); err != nil {
+			return nil, 0, err
+		}
+		if order != binary.ByteOrder(binary.LittleEndian) {
+			swapEntryData(dt, data)
+		}
+		ifd = append(ifd, ifdEntry{tag, dt, tagData(dt, data)})
+	}
+	return ifd, int64(order.Uint32(b[ifdLen*n:])), nil
+}
+
+// repairIFD fixes the defects of ifd, the IFD of the given image, as
+// described for Repair, recording them in rep. The entries are sorted when
+// written.
+func repairIFD(ifd []ifdEntry, image int, rep *Report) ([]ifdEntry, error) {
+	fix := func(tag int, format string, a ...any) {
+		rep.Fixes = append(rep.Fixes, Fix{image, tag, fmt.Sprintf(format, a...)})
+	}
+	fields := make(map[int]int) // Index of each tag in out.
+	out := ifd[:0]
+	sorted := true
+	for _, e := range ifd {
+		if _, dup := fields[e.tag]; dup {
+			fix(e.tag, "duplicate field %d dropped", e.tag)
+			continue
+		}
+		if len(out) > 0 && e.tag < out[len(out)-1].tag {
+			sorted = false
+		}
+		fields[e.tag] = len(out)
+		out = append(out, e)
+	}
+	if !sorted {
+		fix(0, "fields sorted in ascending order")
+	}
+	values := func(tag int) []uint32 {
+		if i, ok := fields[tag]; ok && !pairedType(out[i].datatype) {
+			return out[i].data
+		}
+		return nil
+	}
+	val := func(tag int, def uint32) uint32 {
+		if v := values(tag); len(v) > 0 {
+			return v[0]
+		}
+		return def
+	}
+	set := func(e ifdEntry) {
+		if i, ok := fields[e.tag]; ok {
+			out[i] = e
+			return
+		}
+		fields[e.tag] = len(out)
+		out = append(out, e)
+	}
+
+	width, height := int64(val(TagImageWidth, 0)), int64(val(TagImageLength, 0))
+	if width == 0 || height == 0 {
+		// Not an image, or not one Repair can make sense of.
+		return out, nil
+	}
+	spp := int(val(TagSamplesPerPixel, 1))
+	bits := values(TagBitsPerSample)
+	if len(bits) == 0 {
+		bits = []uint32{1}
+	} else if n := len(bits); n < spp {
+		bits = append(append([]uint32(nil), bits...), repeatValue(bits[n-1], spp-n)...)
+		set(ifdEntry{TagBitsPerSample, TypeShort, bits})
+		fix(TagBitsPerSample, "BitsPerSample of %d values for %d samples extended", n, spp)
+	}
+	maxBits := uint32(0)
+	for _, b := range bits {
+		maxBits = max(maxBits, b)
+	}
+
+	// Readers only disagree over unmarked samples of more than 8 bits,
+	// which the spec makes unsigned integers but some take for floating
+	// point.
+	switch formats := values(TagSampleFormat); {
+	case formats == nil && maxBits > 8:
+		set(ifdEntry{TagSampleFormat, TypeShort, repeatValue(SampleFormatUint, spp)})
+		fix(TagSampleFormat, "missing SampleFormat set to unsigned integers")
+	case len(formats) > 0 && len(formats) < spp:
+		data := append(append([]uint32(nil), formats...), repeatValue(formats[len(formats)-1], spp-len(formats))...)
+		set(ifdEntry{TagSampleFormat, TypeShort, data})
+		fix(TagSampleFormat, "SampleFormat of %d values for %d samples extended", len(formats), spp)
+	}
+
+	if _, tiled := fields[TagTileWidth]; tiled {
+		return out, nil
+	}
+	offsets, counts := values(TagStripOffsets), values(TagStripByteCounts)
+	if len(offsets) == 0 {
+		return out, nil
+	}
+	if len(offsets) != len(counts) {
+		return nil, FormatError(fmt.Sprintf("image %d has %d strip offsets and %d byte counts", image, len(offsets), len(counts)))
+	}
+	planes, pixelBits := 1, int64(0)
+	if val(TagPlanarConfiguration, 1) == 2 {
+		planes, pixelBits = spp, int64(bits[0])
+	} else {
+		for i := 0; i < spp; i++ {
+			pixelBits += int64(bits[min(i, len(bits)-1)])
+		}
+	}
+	if len(offsets)%planes != 0 {
+		return nil, FormatError(fmt.Sprintf("image %d has %d strips for %d planes", image, len(offsets), planes))
+	}
+	n := int64(len(offsets) / planes)
+	rowBytes := (width*pixelBits + 7) / 8
+	uncompressed := val(TagCompression, CompressionNone) == CompressionNone
+
+	declared := int64(val(TagRowsPerStrip, 0))
+	rows := declared
+	if rows == 0 || rows > height {
+		rows = height
+	}
+	if (height+rows-1)/rows != n {
+		if rows = stripRows(height, n, rowBytes, int64(counts[0]), uncompressed); rows == 0 {
+			return nil, FormatError(fmt.Sprintf("image %d: no RowsPerStrip fits %d strips", image, n))
+		}
+		set(ifdEntry{TagRowsPerStrip, shortOrLong(int(rows)), []uint32{uint32(rows)}})
+		if declared > 0 {
+			fix(TagRowsPerStrip, "RowsPerStrip %d does not match %d strips, set to %d", declared, n, rows)
+		} else {
+			fix(TagRowsPerStrip, "missing RowsPerStrip for %d strips set to %d", n, rows)
+		}
+	}
+
+	// Subsampled YCbCr is stored in data units of several rows, so it is
+	// left whole.
+	size := rowBytes * height
+	if n != 1 || planes != 1 || !uncompressed || val(TagPhotometricInterpretation, 0) == PhotometricYCbCr ||
+		size <= repairStripSize || int64(counts[0]) < size {
+		return out, nil
+	}
+	rows = max(1, repairStripSize/rowBytes)
+	var newOffsets, newCounts []uint32
+	for y := int64(0); y < height; y += rows {
+		newOffsets = append(newOffsets, offsets[0]+uint32(y*rowBytes))
+		newCounts = append(newCounts, uint32(min(rows, height-y)*rowBytes))
+	}
+	set(ifdEntry{TagStripOffsets, TypeLong, newOffsets})
+	set(ifdEntry{TagStripByteCounts, TypeLong, newCounts})
+	set(ifdEntry{TagRowsPerStrip, shortOrLong(int(rows)), []uint32{uint32(rows)}})
+	fix(TagStripOffsets, "single strip of %d bytes split into %d strips of %d rows", counts[0], len(newOffsets), rows)
+	return out, nil
+}
+
+// stripRows works out the RowsPerStrip of an image of the given height held
+// in n strips, from the size of the first if they are uncompressed. It
+// returns zero if no value fits.
+func stripRows(height, n, rowBytes, firstCount int64, uncompressed bool) int64 {
+	if uncompressed && rowBytes > 0 && firstCount%rowBytes == 0 {
+		if rows := firstCount / rowBytes; rows > 0 && (height+rows-1)/rows == n {
+			return rows
+		}
+	}
+	if rows := (height + n - 1) / n; (height+rows-1)/rows == n {
+		return rows
+	}
+	return 0
+}
+
+// repeatValue returns n copies of v.
+func repeatValue(v uint32, n int) []uint32 {
+	data := make([]uint32, n)
+	for i := range data {
+		data[i] = v
+	}
+	return data
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// A SampleRange gives the lowest and highest sample values of an image, as
+// stored in the MinSampleValue and MaxSampleValue fields or their SMin and
+// SMax counterparts for signed and floating point samples.
+type SampleRange struct {
+	Min, Max float64
+}
+
+// gray16 maps v to a gray from black at Min to white at Max. Values beyond
+// the range are clamped to its ends, and NaN is black.
+func (s *SampleRange) gray16(v float64) color.Gray16 {
+	if !(v > s.Min) || !(s.Max > s.Min) {
+		return color.Gray16{}
+	}
+	if v >= s.Max {
+		return color.Gray16{Y: 0xffff}
+	}
+	return color.Gray16{Y: uint16((v-s.Min)/(s.Max-s.Min)*0xffff + 0.5)}
+}
+
+// SampleRange returns the range of the samples of the image, or nil if the
+// file gives none. SMinSampleValue and SMaxSampleValue are used if present,
+// MinSampleValue and MaxSampleValue otherwise. A missing bound of integer
+// samples is that of their bit depth, but floating point samples need
+// both. For images of several bands, the bounds of the band decoded are
+// returned.
+func (r *Reader) SampleRange() (*SampleRange, error) {
+	return r.d.sampleRange()
+}
+
+// sampleRange reads the SampleRange of the image from its IFD.
+func (d *decoder) sampleRange() (*SampleRange, error) {
+	var bounds [2]*float64
+	for i, tags := range [2][2]int{{TagSMinSampleValue, TagMinSampleValue}, {TagSMaxSampleValue, TagMaxSampleValue}} {
+		for _, tag := range tags {
+			v, err := d.numericField(tag)
+			if err != nil {
+				return nil, err
+			}
+			if len(v) > 0 {
+				k := min(d.band, len(v)-1)
+				bounds[i] = &v[k]
+				break
+			}
+		}
+	}
+	if bounds[0] == nil && bounds[1] == nil {
+		return nil, nil
+	}
+	if bounds[0] == nil || bounds[1] == nil {
+		if d.config.ColorModel == Gray32FloatModel {
+			return nil, nil
+		}
+		lo, hi := 0.0, math.Exp2(float64(d.bitsPerSample))-1
+		if bounds[0] == nil {
+			bounds[0] = &lo
+		} else {
+			bounds[1] = &hi
+		}
+	}
+	return &SampleRange{Min: *bounds[0], Max: *bounds[1]}, nil
+}
+
+// numericField returns the values of the entry for tag, of any integer,
+// rational or floating point type.
+func (d *decoder) numericField(tag int) ([]float64, error) {
+	dt, data, ok, err := d.entryData(tag)
+	if !ok || err != nil {
+		return nil, err
+	}
+	if dt == TypeASCII || dt == TypeUndefined {
+		return nil, FormatError(fmt.Sprintf("field %d is not numeric", tag))
+	}
+	return tagFloats(dt, data), nil
+}
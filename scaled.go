@@ -0,0 +1,275 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// ReadRegionScaled decodes the part of the image inside rect resampled to
+// an image of outSize pixels, larger or smaller than rect, with bounds at
+// the origin. Each pixel of the result covers a rectangle of the image,
+// not necessarily aligned on its pixels: ResampleNearest takes the pixel
+// under its center, and ResampleAverage the mean of the pixels whose
+// centers it covers, leaving out NoData samples and NaN, or the nearest if
+// it covers none. Only the pixels of rect are read. The result is of the
+// type ReadRegion returns, but for YCbCr images, which are returned as an
+// *image.RGBA. Paletted images are always resampled with
+// ResampleNearest. rect must lie within the image.
+//
+// Pyramid.ReadRegionScaled reads from the overview closest to outSize
+// instead.
+func (r *Reader) ReadRegionScaled(rect image.Rectangle, outSize image.Point, method Resampling) (image.Image, error) {
+	if err := checkScaled(rect, outSize, r.Bounds()); err != nil {
+		return nil, err
+	}
+	win := [4]float64{float64(rect.Min.X), float64(rect.Min.Y), float64(rect.Max.X), float64(rect.Max.Y)}
+	return r.d.readScaled(win, outSize, method)
+}
+
+// ReadRegionScaled is like Reader.ReadRegionScaled, with rect in the pixels
+// of the image of level 0, but reads the smallest level at least as
+// detailed as outSize, as BestLevelFor does, so that reading a large
+// region into a small image decodes few pixels.
+func (p *Pyramid) ReadRegionScaled(rect image.Rectangle, outSize image.Point, method Resampling) (image.Image, error) {
+	base := p.levels[0].Bounds()
+	if err := checkScaled(rect, outSize, base); err != nil {
+		return nil, err
+	}
+	scale := max(float64(outSize.X)/float64(rect.Dx()), float64(outSize.Y)/float64(rect.Dy()))
+	l := p.levels[p.BestLevelFor(scale)]
+	fx := float64(l.d.config.Width) / float64(base.Dx())
+	fy := float64(l.d.config.Height) / float64(base.Dy())
+	win := [4]float64{
+		float64(rect.Min.X) * fx, float64(rect.Min.Y) * fy,
+		float64(rect.Max.X) * fx, float64(rect.Max.Y) * fy,
+	}
+	return l.d.readScaled(win, outSize, method)
+}
+
+// checkScaled reports whether rect, within bounds, can be read into an
+// image of outSize.
+func checkScaled(rect image.Rectangle, outSize image.Point, bounds image.Rectangle) error {
+	if rect.Empty() || !rect.In(bounds) {
+		return fmt.Errorf("tiff: region %v not within the image %v", rect, bounds)
+	}
+	if outSize.X <= 0 || outSize.Y <= 0 {
+		return fmt.Errorf("tiff: invalid size %v of a scaled region", outSize)
+	}
+	return nil
+}
+
+// A scaledSpan is the part of a column or row of the image covered by a
+// column or row of pixels of a scaled region: the pixels from lo to hi,
+// whose centers it covers, and the pixel mid under its center.
+type scaledSpan struct {
+	lo, hi, mid int
+}
+
+// scaledSpans returns the spans of the n pixels covering [a, b) in the
+// image, cut to the pixels from lo to hi.
+func scaledSpans(a, b float64, n, lo, hi int) []scaledSpan {
+	spans := make([]scaledSpan, n)
+	step := (b - a) / float64(n)
+	for i := range spans {
+		x0, x1 := a+float64(i)*step, a+float64(i+1)*step
+		s := scaledSpan{
+			lo:  max(int(math.Ceil(x0-0.5)), lo),
+			hi:  min(int(math.Ceil(x1-0.5)), hi),
+			mid: min(max(int(math.Floor((x0+x1)/2)), lo), hi-1),
+		}
+		if s.lo >= s.hi {
+			// The span covers the center of no pixel.
+			s.lo, s.hi = s.mid, s.mid+1
+		}
+		spans[i] = s
+	}
+	return spans
+}
+
+// readScaled reads the window win of the image, given as its left, top,
+// right and bottom edges in pixels, resampled to outSize.
+func (d *decoder) readScaled(win [4]float64, outSize image.Point, method Resampling) (image.Image, error) {
+	w, h := d.config.Width, d.config.Height
+	src := image.Rect(
+		int(math.Floor(win[0])), int(math.Floor(win[1])),
+		int(math.Ceil(win[2])), int(math.Ceil(win[3])),
+	).Intersect(image.Rect(0, 0, w, h))
+	m, err := d.newImage(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.readRegion(m); err != nil {
+		return nil, err
+	}
+	xs := scaledSpans(win[0], win[2], outSize.X, src.Min.X, src.Max.X)
+	ys := scaledSpans(win[1], win[3], outSize.Y, src.Min.Y, src.Max.Y)
+	noData, err := d.noData()
+	if err != nil {
+		return nil, err
+	}
+	out := image.Rectangle{Max: outSize}
+
+	switch m := m.(type) {
+	case *Gray32:
+		dst := &Gray32{Pix: make([]uint32, outSize.X*outSize.Y), Stride: outSize.X, Rect: out, Range: m.Range, Palette: m.Palette}
+		if m.Palette != nil {
+			method = ResampleNearest
+		}
+		scaleGray32(dst.Pix, m.Pix, m.Stride, src.Min, xs, ys, method, noData, false)
+		return dst, nil
+	case *GrayFloat32:
+		dst := &GrayFloat32{Pix: make([]uint32, outSize.X*outSize.Y), Stride: outSize.X, Rect: out, Range: m.Range}
+		scaleGray32(dst.Pix, m.Pix, m.Stride, src.Min, xs, ys, method, noData, true)
+		return dst, nil
+	case *image.Gray:
+		dst := image.NewGray(out)
+		scaleBytes(dst.Pix, m.Pix, m.Stride, 1, 1, src.Min, xs, ys, method, noData)
+		return dst, nil
+	case *image.Gray16:
+		dst := image.NewGray16(out)
+		scaleBytes(dst.Pix, m.Pix, m.Stride, 1, 2, src.Min, xs, ys, method, noData)
+		return dst, nil
+	case *image.Paletted:
+		dst := image.NewPaletted(out, m.Palette)
+		scaleBytes(dst.Pix, m.Pix, m.Stride, 1, 1, src.Min, xs, ys, ResampleNearest, nil)
+		return dst, nil
+	case *image.NRGBA:
+		dst := image.NewNRGBA(out)
+		scaleBytes(dst.Pix, m.Pix, m.Stride, 4, 1, src.Min, xs, ys, method, noData)
+		return dst, nil
+	case *image.RGBA:
+		dst := image.NewRGBA(out)
+		scaleBytes(dst.Pix, m.Pix, m.Stride, 4, 1, src.Min, xs, ys, method, noData)
+		return dst, nil
+	case *image.NRGBA64:
+		dst := image.NewNRGBA64(out)
+		scaleBytes(dst.Pix, m.Pix, m.Stride, 4, 2, src.Min, xs, ys, method, noData)
+		return dst, nil
+	case *image.RGBA64:
+		dst := image.NewRGBA64(out)
+		scaleBytes(dst.Pix, m.Pix, m.Stride, 4, 2, src.Min, xs, ys, method, noData)
+		return dst, nil
+	case *image.CMYK:
+		dst := image.NewCMYK(out)
+		scaleBytes(dst.Pix, m.Pix, m.Stride, 4, 1, src.Min, xs, ys, method, noData)
+		return dst, nil
+	case *image.YCbCr:
+		rgba := image.NewRGBA(src)
+		draw.Draw(rgba, src, m, src.Min, draw.Src)
+		dst := image.NewRGBA(out)
+		scaleBytes(dst.Pix, rgba.Pix, rgba.Stride, 4, 1, src.Min, xs, ys, method, noData)
+		return dst, nil
+	}
+	return nil, InternalError(fmt.Sprintf("cannot resample a %T", m))
+}
+
+// scaleGray32 resamples the 32-bit samples of pix, with the given stride
+// and origin, into dst, whose pixels cover the spans xs and ys. float
+// tells whether the samples are floating point.
+func scaleGray32(dst, pix []uint32, stride int, origin image.Point, xs, ys []scaledSpan, method Resampling, noData *float64, float bool) {
+	sample := func(v uint32) float64 {
+		if float {
+			return float64(math.Float32frombits(v))
+		}
+		return float64(v)
+	}
+	empty := uint32(0)
+	switch {
+	case noData != nil && float:
+		empty = math.Float32bits(float32(*noData))
+	case noData != nil:
+		empty = uint32(int64(*noData))
+	case float:
+		empty = math.Float32bits(float32(math.NaN()))
+	}
+	for oy, sy := range ys {
+		row := dst[oy*len(xs):]
+		for ox, sx := range xs {
+			if method == ResampleNearest {
+				row[ox] = pix[(sy.mid-origin.Y)*stride+sx.mid-origin.X]
+				continue
+			}
+			sum, n := 0.0, 0
+			for y := sy.lo; y < sy.hi; y++ {
+				for _, v := range pix[(y-origin.Y)*stride+sx.lo-origin.X:][:sx.hi-sx.lo] {
+					s := sample(v)
+					if math.IsNaN(s) || noData != nil && s == *noData {
+						continue
+					}
+					sum += s
+					n++
+				}
+			}
+			switch {
+			case n == 0:
+				row[ox] = empty
+			case float:
+				row[ox] = math.Float32bits(float32(sum / float64(n)))
+			default:
+				row[ox] = uint32(math.Round(sum / float64(n)))
+			}
+		}
+	}
+}
+
+// scaleBytes resamples the pixels of pix, of channels samples of size
+// bytes each, 16-bit samples being big-endian, with the given stride and
+// origin, into dst, whose pixels cover the spans xs and ys.
+func scaleBytes(dst, pix []byte, stride, channels, size int, origin image.Point, xs, ys []scaledSpan, method Resampling, noData *float64) {
+	pixBytes := channels * size
+	sample := func(p []byte) float64 {
+		if size == 2 {
+			return float64(uint16(p[0])<<8 | uint16(p[1]))
+		}
+		return float64(p[0])
+	}
+	sums := make([]float64, channels)
+	counts := make([]int, channels)
+	for oy, sy := range ys {
+		row := dst[oy*len(xs)*pixBytes:]
+		for ox, sx := range xs {
+			p := row[ox*pixBytes:][:pixBytes]
+			if method == ResampleNearest {
+				copy(p, pix[(sy.mid-origin.Y)*stride+(sx.mid-origin.X)*pixBytes:])
+				continue
+			}
+			clear(sums)
+			clear(counts)
+			for y := sy.lo; y < sy.hi; y++ {
+				q := pix[(y-origin.Y)*stride+(sx.lo-origin.X)*pixBytes:]
+				for x := sx.lo; x < sx.hi; x++ {
+					for c := 0; c < channels; c++ {
+						v := sample(q[c*size:])
+						if noData != nil && v == *noData {
+							continue
+						}
+						sums[c] += v
+						counts[c]++
+					}
+					q = q[pixBytes:]
+				}
+			}
+			for c := 0; c < channels; c++ {
+				v := 0.0
+				if noData != nil {
+					v = *noData
+				}
+				if counts[c] > 0 {
+					v = math.Round(sums[c] / float64(counts[c]))
+				}
+				if size == 2 {
+					u := uint16(v)
+					p[2*c], p[2*c+1] = byte(u>>8), byte(u)
+				} else {
+					p[c] = byte(v)
+				}
+			}
+		}
+	}
+}
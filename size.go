@@ -0,0 +1,55 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import "math"
+
+// Sizes derived from image bounds or file headers are computed with these
+// checked helpers, so that absurd or hostile dimensions produce an error
+// instead of a wrapped-around length.
+
+// mulInt returns a*b and reports whether the product of the non-negative
+// a and b fits in an int.
+func mulInt(a, b int) (int, bool) {
+	if a < 0 || b < 0 {
+		return 0, false
+	}
+	if a != 0 && b > math.MaxInt/a {
+		return 0, false
+	}
+	return a * b, true
+}
+
+// addOffset returns off+n and reports whether the sum fits in an int64.
+func addOffset(off, n int64) (int64, bool) {
+	if off < 0 || n < 0 || off > math.MaxInt64-n {
+		return 0, false
+	}
+	return off + n, true
+}
+
+// sampleBytes returns the size in bytes of w×h 32-bit samples and reports
+// whether it fits in an int.
+func sampleBytes(w, h int) (int, bool) {
+	n, ok := mulInt(w, h)
+	if !ok {
+		return 0, false
+	}
+	return mulInt(n, 4)
+}
+
+// classicImageLen returns the size in bytes of the pixel data of a w×h
+// image of pixels of pixBytes bytes, or an error if it does not fit in a
+// classic TIFF file after the 8-byte header.
+func classicImageLen(w, h, pixBytes int) (int, error) {
+	n, ok := mulInt(w, h)
+	if ok {
+		n, ok = mulInt(n, pixBytes)
+	}
+	if !ok || uint64(n)+8 > math.MaxUint32 {
+		return 0, UnsupportedError{Feature: "image too large for a classic TIFF file"}
+	}
+	return n, nil
+}
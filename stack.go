@@ -0,0 +1,106 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"time"
+)
+
+// A Stack is a time series of rasters stored as the pages of a multi-page
+// file, such as a grid of daily rainfall, along with the time of each. The
+// reduced-resolution images and masks of the file are left out. Like a
+// Reader, a Stack is not safe for concurrent use.
+type Stack struct {
+	pages []*Reader
+	times []time.Time
+}
+
+// The layouts of the times of pages, tried in order, the first being that
+// of the DateTime field.
+var stackTimeLayouts = []string{
+	"2006:01:02 15:04:05",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// OpenStack returns the Stack of the pages of the TIFF file in r, read
+// applying opt, which may be nil, save for its Image. The time of each
+// page is read from its PageName field, if it holds one, or else from its
+// DateTime field, as "YYYY:MM:DD HH:MM:SS", as RFC 3339 or as a date;
+// times without a zone are in UTC.
+func OpenStack(r io.ReaderAt, opt *ReaderOptions) (*Stack, error) {
+	pages, err := dataPages(r, opt)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stack{pages: pages, times: make([]time.Time, len(pages))}
+	for i, pr := range pages {
+		md, err := pr.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		s.times[i] = stackTime(md.PageName, md.DateTime)
+	}
+	return s, nil
+}
+
+// stackTime returns the first of the values given that holds a time, or
+// the zero time.
+func stackTime(values ...string) time.Time {
+	for _, v := range values {
+		for _, layout := range stackTimeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// FormatDateTime returns t in the format of the DateTime field, as read by
+// OpenStack.
+func FormatDateTime(t time.Time) string {
+	return t.Format(stackTimeLayouts[0])
+}
+
+// Len returns the number of slices of the stack.
+func (s *Stack) Len() int { return len(s.pages) }
+
+// Slice decodes slice t of the stack, from 0.
+func (s *Stack) Slice(t int) (image.Image, error) {
+	if t < 0 || t >= len(s.pages) {
+		return nil, fmt.Errorf("tiff: slice %d not within the %d of the stack", t, len(s.pages))
+	}
+	return s.pages[t].ReadRegion(s.pages[t].Bounds())
+}
+
+// Reader returns the Reader of slice t, for reading regions of it or its
+// metadata.
+func (s *Stack) Reader(t int) *Reader { return s.pages[t] }
+
+// Time returns the time of slice t, or the zero time if it has none.
+func (s *Stack) Time(t int) time.Time { return s.times[t] }
+
+// Nearest returns the slice whose time is the closest to tm, the first of
+// those as close, or -1 if no slice has a time.
+func (s *Stack) Nearest(tm time.Time) int {
+	best := -1
+	var bestDiff time.Duration
+	for i, t := range s.times {
+		if t.IsZero() {
+			continue
+		}
+		diff := t.Sub(tm).Abs()
+		if best < 0 || diff < bestDiff {
+			best, bestDiff = i, diff
+		}
+	}
+	return best
+}
@@ -0,0 +1,961 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"golang.org/x/image/tiff"
+)
+
+// writerStripBytes is the approximate size of the strips written by a
+// Writer.
+var writerStripBytes = 256 << 10
+
+// A Writer encodes an image a band of rows at a time, so that the whole
+// image never has to be held in memory. The pixel data is written as it
+// arrives, a strip or a row of tiles at a time if it is compressed or
+// tiled, and the IFD follows it once Close is called. The strips or tiles
+// of other files can also be copied into it by Writer.CopyTiles.
+type Writer struct {
+	w       io.Writer
+	float   bool
+	layout  imageLayout
+	y       int // Number of rows written so far.
+	err     error
+	entries []ifdEntry
+
+	big    bool           // Whether the file is a BigTIFF file.
+	seeker io.WriteSeeker // To write the header back to, if not nil.
+	off    int64          // Number of bytes written so far.
+
+	// The strips or tiles, across and down.
+	blockWidth, blockHeight  int
+	blocksAcross, blocksDown int
+
+	// The offsets and sizes of the blocks, a block not written yet having
+	// a zero offset, and their checksums if they are stored. If direct is
+	// set, the image is stored uncompressed in strips, which are written
+	// as the rows arrive and whose offsets are known up front.
+	offsets, counts []uint64
+	sums            []byte
+	direct          bool
+
+	// The compressor of the blocks, the rows of the strip or row of tiles
+	// being gathered, a tile being cut from them and the compressed data.
+	compressor *blockCompressor
+	rows       []byte
+	block      []byte
+	buf        bytes.Buffer
+}
+
+// WriterOptions are the parameters of NewWriterWithOptions.
+type WriterOptions struct {
+	// Options gives the compression and predictor of the output, as for
+	// Encode.
+	Options *tiff.Options
+	// TileWidth and TileHeight, if not zero, make the image be stored in
+	// tiles of that size instead of in strips, as for Encoder. Both must be
+	// multiples of 16.
+	TileWidth, TileHeight int
+	// BlockChecksums stores the checksum of every strip or tile, as for
+	// Encoder.
+	BlockChecksums bool
+	// Metadata, if not nil, is stored with the image as by
+	// EncodeWithMetadata.
+	Metadata *Metadata
+	// BigTIFF makes the output a BigTIFF file, whose 64-bit offsets let it
+	// exceed 4GB. It is also chosen when the uncompressed image would not
+	// fit in a classic TIFF file; a compressed image written to a classic
+	// file fails once its strips pass 4GB. The Reader of this package does
+	// not read BigTIFF files, but libtiff and GDAL do.
+	BigTIFF bool
+	// Metrics, if not nil, receives the number of bytes written.
+	Metrics Metrics
+}
+
+// NewWriter writes the header of an image with the width and height given
+// by cfg to w, and returns a Writer for its pixels. The samples are floating
+// point if cfg.ColorModel is Gray32FloatModel and unsigned integers
+// otherwise. opt is interpreted as for Encode. It is the same as
+// NewWriterWithOptions with only the Options set.
+func NewWriter(w io.Writer, cfg image.Config, opt *tiff.Options) (*Writer, error) {
+	return NewWriterWithOptions(w, cfg, &WriterOptions{Options: opt})
+}
+
+// NewWriterWithOptions is like NewWriter, with the options given by opt,
+// which may be nil.
+//
+// Unless the image is stored uncompressed in strips, without checksums,
+// the sizes of its blocks are only known once they are written, so w must
+// also be an io.Seeker, through which Close completes the header.
+func NewWriterWithOptions(w io.Writer, cfg image.Config, opt *WriterOptions) (*Writer, error) {
+	if err := checkSize(cfg.Width, cfg.Height); err != nil {
+		return nil, err
+	}
+	var o WriterOptions
+	if opt != nil {
+		o = *opt
+	}
+	compression, predictor, err := encodingOptions(o.Options)
+	if err != nil {
+		return nil, err
+	}
+	tiled := o.TileWidth != 0 || o.TileHeight != 0
+	if tiled {
+		if err := checkTileSize(o.TileWidth, o.TileHeight); err != nil {
+			return nil, err
+		}
+	}
+	sw := &Writer{
+		w:      w,
+		float:  cfg.ColorModel == Gray32FloatModel,
+		direct: compression == CompressionNone && !tiled && !o.BlockChecksums,
+	}
+	if !sw.direct {
+		s, ok := w.(io.WriteSeeker)
+		if !ok {
+			return nil, UnsupportedError{Feature: "compressed, tiled or checksummed image written to an io.Writer that cannot seek"}
+		}
+		sw.seeker = s
+	}
+	if o.Metrics != nil {
+		sw.w = meteredWriter{w, o.Metrics}
+	}
+
+	rowBytes := cfg.Width * 4
+	sw.blockWidth, sw.blockHeight = o.TileWidth, o.TileHeight
+	if !tiled {
+		rowsPerStrip := writerStripBytes / rowBytes
+		if rowsPerStrip < 1 {
+			rowsPerStrip = 1
+		}
+		if rowsPerStrip > cfg.Height {
+			rowsPerStrip = cfg.Height
+		}
+		sw.blockWidth, sw.blockHeight = cfg.Width, rowsPerStrip
+	}
+	sw.blocksAcross = (cfg.Width + sw.blockWidth - 1) / sw.blockWidth
+	sw.blocksDown = (cfg.Height + sw.blockHeight - 1) / sw.blockHeight
+	nblocks := sw.blocksAcross * sw.blocksDown
+	sampleFormat := uint32(SampleFormatUint)
+	if sw.float {
+		sampleFormat = SampleFormatIEEEFP
+	}
+	pr := predictorValue(predictor)
+	sw.layout = imageLayout{
+		width:           cfg.Width,
+		height:          cfg.Height,
+		bitsPerSample:   []uint32{32},
+		samplesPerPixel: 1,
+		photometric:     PhotometricBlackIsZero,
+		compression:     compression,
+		predictor:       pr,
+		sampleFormat:    sampleFormat,
+		rowsPerStrip:    sw.blockHeight,
+		blockOffsets:    make([]uint32, nblocks),
+		blockByteCounts: make([]uint32, nblocks),
+	}
+	if tiled {
+		sw.layout.tileWidth, sw.layout.tileHeight = o.TileWidth, o.TileHeight
+	}
+	if md := o.Metadata; md != nil {
+		if sw.layout.extra, err = md.appendEntries(nil); err != nil {
+			return nil, err
+		}
+		sw.layout.noResolution = md.Resolution == nil
+		sw.layout.resolution = md.Resolution
+	}
+	if o.BlockChecksums {
+		sw.sums = make([]byte, 8*nblocks)
+		sw.layout.extra = append(sw.layout.extra, ifdEntry{TagBlockChecksums, TypeUndefined, make([]uint32, len(sw.sums))})
+	}
+
+	// The size of the IFD does not depend on the values of the offsets
+	// and byte counts of the blocks, so the file is known to fit in a
+	// classic TIFF file unless compression makes it larger.
+	imageLen := uint64(cfg.Width) * uint64(cfg.Height) * 4
+	if tiled {
+		imageLen = uint64(nblocks) * uint64(o.TileWidth) * uint64(o.TileHeight) * 4
+	}
+	sw.big = o.BigTIFF || 8+imageLen+uint64(ifdSize(sw.layout.appendEntries(nil))) > math.MaxUint32
+	header := []byte(leHeader + "\x00\x00\x00\x00")
+	if sw.big {
+		header = []byte(leBigHeader + "\x00\x00\x00\x00\x00\x00\x00\x00")
+	}
+	sw.off = int64(len(header))
+	sw.offsets, sw.counts = make([]uint64, nblocks), make([]uint64, nblocks)
+	if sw.direct {
+		for i := range sw.offsets {
+			rows := min(sw.blockHeight, cfg.Height-i*sw.blockHeight)
+			sw.offsets[i] = uint64(sw.off) + uint64(i*sw.blockHeight)*uint64(rowBytes)
+			sw.counts[i] = uint64(rows) * uint64(rowBytes)
+		}
+		sw.putIFDOffset(header, uint64(sw.off)+imageLen)
+	} else {
+		sw.compressor = &blockCompressor{compression: compression, predictor: pr, rowBytes: sw.blockWidth * 4, size: 4, step: 4}
+		sw.rows = make([]byte, 0, sw.blockHeight*rowBytes)
+		if tiled {
+			sw.block = make([]byte, sw.blockWidth*sw.blockHeight*4)
+		}
+	}
+	if _, err := sw.w.Write(header); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// putIFDOffset sets the offset of the IFD in header.
+func (w *Writer) putIFDOffset(header []byte, off uint64) {
+	if w.big {
+		enc.PutUint64(header[8:], off)
+	} else {
+		enc.PutUint32(header[4:], uint32(off))
+	}
+}
+
+// Bounds returns the bounds of the image.
+func (w *Writer) Bounds() image.Rectangle {
+	return image.Rect(0, 0, w.layout.width, w.layout.height)
+}
+
+// WriteRows writes the rows of m, which must be a *Gray32 or a
+// *GrayFloat32 matching the Writer's sample format. m must span the full
+// width of the image and start at the first row not yet written.
+func (w *Writer) WriteRows(m image.Image) error {
+	if w.err != nil {
+		return w.err
+	}
+	var pix []uint32
+	var stride int
+	switch m := m.(type) {
+	case *Gray32:
+		if w.float {
+			return errors.New("tiff: WriteRows given a Gray32 for a float image")
+		}
+		pix, stride = m.Pix, m.Stride
+	case *GrayFloat32:
+		if !w.float {
+			return errors.New("tiff: WriteRows given a GrayFloat32 for an integer image")
+		}
+		pix, stride = m.Pix, m.Stride
+	default:
+		return errors.New("tiff: WriteRows given an unsupported image type")
+	}
+	b := m.Bounds()
+	if b.Min.X != 0 || b.Dx() != w.layout.width || b.Min.Y != w.y || b.Max.Y > w.layout.height {
+		return errors.New("tiff: WriteRows given rows out of order")
+	}
+	if err := checkPix(len(pix), stride, b.Dx(), b.Dy()); err != nil {
+		return err
+	}
+	if w.direct {
+		w.err = encodeGray32(w.w, nil, pix, b.Dx(), b.Dy(), stride, false)
+		w.off += int64(b.Dy()) * int64(b.Dx()) * 4
+	} else {
+		w.err = w.gatherRows(pix, stride, b.Dy())
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.y = b.Max.Y
+	return nil
+}
+
+// gatherRows adds the n rows of pix to the strip or row of tiles being
+// gathered, writing its blocks once it is complete.
+func (w *Writer) gatherRows(pix []uint32, stride, n int) error {
+	dx := w.layout.width
+	for y := 0; y < n; {
+		k := min(n-y, (cap(w.rows)-len(w.rows))/(dx*4))
+		start := len(w.rows)
+		w.rows = w.rows[:start+k*dx*4]
+		packGray32Rows(w.rows[start:], pix[y*stride:], dx, stride, 0, k, false)
+		y += k
+		if len(w.rows) == cap(w.rows) || w.y+y == w.layout.height {
+			if err := w.writeRowBlocks((w.y + y - 1) / w.blockHeight); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeRowBlocks compresses and writes the blocks of row j, from the rows
+// gathered.
+func (w *Writer) writeRowBlocks(j int) error {
+	if w.layout.tileWidth == 0 {
+		if err := w.compressBlock(j, w.rows); err != nil {
+			return err
+		}
+		w.rows = w.rows[:0]
+		return nil
+	}
+	rowBytes, tileRow := w.layout.width*4, w.blockWidth*4
+	for i := 0; i < w.blocksAcross; i++ {
+		// The parts of edge tiles beyond the image are zero.
+		clear(w.block)
+		x0 := i * tileRow
+		n := min(tileRow, rowBytes-x0)
+		for y := 0; y < len(w.rows)/rowBytes; y++ {
+			copy(w.block[y*tileRow:][:n], w.rows[y*rowBytes+x0:])
+		}
+		if err := w.compressBlock(j*w.blocksAcross+i, w.block); err != nil {
+			return err
+		}
+	}
+	w.rows = w.rows[:0]
+	return nil
+}
+
+// compressBlock compresses the samples of block k and writes them.
+func (w *Writer) compressBlock(k int, samples []byte) error {
+	w.buf.Reset()
+	if _, err := w.compressor.compress(&w.buf, samples); err != nil {
+		return err
+	}
+	return w.writeBlock(k, w.buf.Bytes())
+}
+
+// writeBlock writes data as the stored data of block k.
+func (w *Writer) writeBlock(k int, data []byte) error {
+	if w.direct {
+		if w.offsets[k] != uint64(w.off) || w.counts[k] != uint64(len(data)) {
+			return fmt.Errorf("tiff: strip %d of %d bytes written at %d, want %d bytes at %d", k, len(data), w.off, w.counts[k], w.offsets[k])
+		}
+	} else if w.offsets[k] != 0 {
+		return fmt.Errorf("tiff: block %d written twice", k)
+	}
+	if !w.big && uint64(w.off)+uint64(len(data)) > math.MaxUint32 {
+		return UnsupportedError{Feature: "image too large for a classic TIFF file"}
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.offsets[k], w.counts[k] = uint64(w.off), uint64(len(data))
+	if w.sums != nil {
+		binary.LittleEndian.PutUint64(w.sums[8*k:], xxhash64(data))
+	}
+	w.off += int64(len(data))
+	return nil
+}
+
+// Close writes the IFD of the image, and completes the header if it was
+// written without the offset of the IFD. The tiles of a tiled image never
+// written, by WriteRows or Writer.CopyTiles, are stored as zeros, but Close fails
+// if the rows of an image stored in strips were not all written, or if
+// WriteRows stopped short of the end of a row of tiles. Close does not
+// close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.layout.tileWidth == 0 && w.y != w.layout.height || len(w.rows) > 0 {
+		return errors.New("tiff: Writer closed before all rows were written")
+	}
+	w.err = w.writeIFD()
+	if w.err == nil {
+		w.err = errors.New("tiff: Writer is closed")
+		return nil
+	}
+	return w.err
+}
+
+// writeIFD writes the tiles missing, the IFD after the pixel data and, if
+// the header was written without its offset, the offset to the header.
+func (w *Writer) writeIFD() error {
+	if w.layout.tileWidth > 0 {
+		clear(w.block)
+		for k, off := range w.offsets {
+			if off == 0 {
+				if err := w.compressBlock(k, w.block); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := writePad(w.w, int(w.off%2)); err != nil {
+		return err
+	}
+	ifdOffset := w.off + w.off%2
+	if !w.big {
+		for i := range w.offsets {
+			w.layout.blockOffsets[i] = uint32(w.offsets[i])
+			w.layout.blockByteCounts[i] = uint32(w.counts[i])
+		}
+	}
+	if w.sums != nil {
+		e := &w.layout.extra[len(w.layout.extra)-1]
+		for i, b := range w.sums {
+			e.data[i] = uint32(b)
+		}
+	}
+	w.entries = w.layout.appendEntries(w.entries[:0])
+	var err error
+	if w.big {
+		for i, e := range w.entries {
+			switch e.tag {
+			case TagStripOffsets, TagTileOffsets:
+				w.entries[i] = long8Entry(e.tag, w.offsets)
+			case TagStripByteCounts, TagTileByteCounts:
+				w.entries[i] = long8Entry(e.tag, w.counts)
+			}
+		}
+		err = writeBigIFD(w.w, ifdOffset, w.entries, 0)
+	} else {
+		if uint64(ifdOffset)+uint64(ifdSize(w.entries)) > math.MaxUint32 {
+			return UnsupportedError{Feature: "image too large for a classic TIFF file"}
+		}
+		err = writeIFD(w.w, int(ifdOffset), w.entries, 0)
+	}
+	if err != nil || w.seeker == nil {
+		return err
+	}
+
+	// The header is completed through the io.Seeker, as by Recompress.
+	var header [16]byte
+	w.putIFDOffset(header[:], uint64(ifdOffset))
+	pos, field := int64(4), header[4:8]
+	if w.big {
+		pos, field = 8, header[8:16]
+	}
+	if _, err := w.seeker.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(field); err != nil {
+		return err
+	}
+	_, err = w.seeker.Seek(0, io.SeekEnd)
+	return err
+}
+
+// DefaultMemoryLimit is the memory ceiling used by Pipeline if none is set.
+const DefaultMemoryLimit = 256 << 20
+
+// PipelineOptions are the parameters of Pipeline.
+type PipelineOptions struct {
+	// MemoryLimit bounds the number of bytes of pixel data held in memory
+	// at once. If zero, DefaultMemoryLimit is used.
+	MemoryLimit int
+	// Options determines the encoding of the output, as for NewWriter. If
+	// the output is compressed, dst must also be an io.Seeker.
+	Options *tiff.Options
+	// Metadata, if not nil, is stored with the output in place of the
+	// metadata of src, which is kept otherwise.
+	Metadata *Metadata
+	// BigTIFF makes the output a BigTIFF file, as for WriterOptions.
+	BigTIFF bool
+	// Metrics, if not nil, receives measurements of both the decoding of
+	// the input and the encoding of the output.
+	Metrics Metrics
+}
+
+// Pipeline copies the image in src to dst a band of rows at a time. Each
+// band is decoded, passed to process, which may modify its pixels in place,
+// and encoded before the next one is read, so that memory use stays below
+// the limit set in opt whatever the size of the image. The band is a
+// *Gray32 or *GrayFloat32 spanning the full width of the image whose bounds
+// give its position. process may be nil to copy the pixels unchanged.
+//
+// Bands are aligned to the strips or tiles of src where the limit allows, so
+// that every compressed block is decoded once. The output is written by a
+// Writer, a BigTIFF file if it would not fit in a classic TIFF file
+// uncompressed.
+func Pipeline(dst io.Writer, src io.ReaderAt, process func(band image.Image) error, opt *PipelineOptions) error {
+	limit := DefaultMemoryLimit
+	var wopt WriterOptions
+	var ropt ReaderOptions
+	if opt != nil {
+		if opt.MemoryLimit > 0 {
+			limit = opt.MemoryLimit
+		}
+		wopt = WriterOptions{Options: opt.Options, Metadata: opt.Metadata, BigTIFF: opt.BigTIFF, Metrics: opt.Metrics}
+		ropt.Metrics = opt.Metrics
+	}
+
+	r, err := NewReaderWithOptions(src, &ropt)
+	if err != nil {
+		return err
+	}
+	d := r.d
+	if d.format != formatGray32 {
+		return UnsupportedError{Feature: "Pipeline from an image without 32-bit samples"}
+	}
+	if wopt.Metadata == nil {
+		if wopt.Metadata, err = r.Metadata(); err != nil {
+			return err
+		}
+	}
+	w, err := NewWriterWithOptions(dst, d.config, &wopt)
+	if err != nil {
+		return err
+	}
+	if !w.direct {
+		// The Writer holds a strip and its compressed copy.
+		limit -= 2 * cap(w.rows)
+	}
+
+	// Besides the band itself, every worker holds a compressed block while
+	// it is unpacked, and read-ahead holds more; if that does not fit, the
+	// blocks are decoded one at a time. Uncompressed rows are read in chunks
+	// that together are no larger than the band.
+	rowBytes := d.config.Width * 4
+	bandRows := limit / (2 * rowBytes)
+	if !d.uncompressed() {
+		blockBytes := int64(d.blockWidth) * int64(d.blockHeight) * 4
+		bandRows = int((int64(limit) - int64(d.workers+d.readAhead)*blockBytes) / int64(rowBytes))
+		if bandRows < 1 {
+			d.workers, d.readAhead = 1, 0
+			bandRows = int((int64(limit) - blockBytes) / int64(rowBytes))
+		}
+	}
+	if bandRows < 1 {
+		return errors.New("tiff: memory limit too small for the image")
+	}
+	if bandRows >= d.blockHeight {
+		bandRows -= bandRows % d.blockHeight
+	}
+	if bandRows > d.config.Height {
+		bandRows = d.config.Height
+	}
+
+	pix := make([]uint32, bandRows*d.config.Width)
+	for y0 := 0; y0 < d.config.Height; y0 += bandRows {
+		y1 := y0 + bandRows
+		if y1 > d.config.Height {
+			y1 = d.config.Height
+		}
+		rect := image.Rect(0, y0, d.config.Width, y1)
+		band := d.bandImage(pix[:rect.Dx()*rect.Dy()], rect)
+		if err := d.readRegion(band); err != nil {
+			return err
+		}
+		if process != nil {
+			if err := process(band); err != nil {
+				return err
+			}
+		}
+		if err := w.WriteRows(band); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// bandImage returns an image of the decoder's sample format using pix to
+// hold the pixels of r.
+func (d *decoder) bandImage(pix []uint32, r image.Rectangle) image.Image {
+	if d.config.ColorModel == Gray32FloatModel {
+		return &GrayFloat32{Pix: pix, Stride: r.Dx(), Rect: r, Range: d.displayRange}
+	}
+	return &Gray32{Pix: pix, Stride: r.Dx(), Rect: r, Range: d.displayRange}
+}
+
+// EncodeFromChannel writes an image with floating point samples to w, taking
+// its rows in order from rows as they arrive. cfg gives the dimensions of
+// the image; its ColorModel is ignored. Each row must hold cfg.Width
+// samples. Rows are gathered into strips, and every strip is encoded and
+// written as soon as it is complete, so that the producer can keep
+// computing while earlier results reach w. opt is interpreted as for
+// NewWriter: if it asks for compression, w must also be an io.Seeker.
+//
+// The sender must close rows after the last row; if an error occurs, the
+// remaining rows are drained so that the sender is not blocked.
+func EncodeFromChannel(w io.Writer, cfg image.Config, rows <-chan []float32, opt *tiff.Options) (err error) {
+	defer func() {
+		if err != nil {
+			for range rows {
+			}
+		}
+	}()
+
+	cfg.ColorModel = Gray32FloatModel
+	sw, err := NewWriter(w, cfg, opt)
+	if err != nil {
+		return err
+	}
+	rowsPerStrip := sw.layout.rowsPerStrip
+	strip := NewGrayFloat32(image.Rect(0, 0, cfg.Width, rowsPerStrip))
+	y := 0
+	for row := range rows {
+		if y == cfg.Height {
+			return errors.New("tiff: EncodeFromChannel received more rows than the image height")
+		}
+		if len(row) != cfg.Width {
+			return fmt.Errorf("tiff: EncodeFromChannel received a row of %d samples, want %d", len(row), cfg.Width)
+		}
+		// The strip buffer is reused by moving its bounds down the image.
+		y0 := y - y%rowsPerStrip
+		strip.Rect = image.Rect(0, y0, cfg.Width, y0+rowsPerStrip)
+		strip.SetRow(y, row)
+		y++
+		if y%rowsPerStrip == 0 || y == cfg.Height {
+			band := strip.SubImage(image.Rect(0, y0, cfg.Width, y))
+			if err := sw.WriteRows(band); err != nil {
+				return err
+			}
+		}
+	}
+	if y != cfg.Height {
+		return fmt.Errorf("tiff: EncodeFromChannel received %d rows, want %d", y, cfg.Height)
+	}
+	return sw.Close()
+}
+
+// EncodeRaw writes an image to w whose samples, in rows from the top, are
+// read from samples as raw 32-bit values in host byte order, such as the
+// binary grids of other tools, so that no image needs to be built. cfg
+// gives the dimensions of the image, and the samples are floating point
+// if cfg.ColorModel is Gray32FloatModel and unsigned integers otherwise.
+// The image is written uncompressed a strip at a time, as by a Writer.
+// Samples past the last one of the image are not read.
+func EncodeRaw(w io.Writer, cfg image.Config, samples io.Reader) error {
+	sw, err := NewWriter(w, cfg, nil)
+	if err != nil {
+		return err
+	}
+	rowsPerStrip := sw.layout.rowsPerStrip
+	pix := make([]uint32, rowsPerStrip*cfg.Width)
+	var buf []byte
+	if !haveUint32Bytes {
+		buf = make([]byte, 4*len(pix))
+	}
+	for y := 0; y < cfg.Height; y += rowsPerStrip {
+		rows := min(rowsPerStrip, cfg.Height-y)
+		n := rows * cfg.Width
+		// The samples are read straight into the pixels where they can be
+		// viewed as bytes.
+		p := uint32Bytes(pix[:n])
+		if p == nil {
+			p = buf[:4*n]
+		}
+		if _, err := io.ReadFull(samples, p); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("tiff: EncodeRaw samples end before row %d of %d", y+rows, cfg.Height)
+			}
+			return err
+		}
+		if buf != nil {
+			for i := range pix[:n] {
+				pix[i] = binary.NativeEndian.Uint32(buf[4*i:])
+			}
+		}
+		rect := image.Rect(0, y, cfg.Width, y+rows)
+		var band image.Image = &Gray32{Pix: pix[:n], Stride: cfg.Width, Rect: rect}
+		if sw.float {
+			band = &GrayFloat32{Pix: pix[:n], Stride: cfg.Width, Rect: rect}
+		}
+		if err := sw.WriteRows(band); err != nil {
+			return err
+		}
+	}
+	return sw.Close()
+}
+
+// rawChunkBytes is the approximate size of the pixels DecodeRaw decodes
+// at a time.
+var rawChunkBytes = 1 << 20
+
+// RawOptions are the parameters of DecodeRaw.
+type RawOptions struct {
+	// Reader chooses the image and tunes how it is read, as for
+	// NewReaderWithOptions.
+	Reader *ReaderOptions
+	// Region is the part of the image written, which must lie within
+	// it. If empty, the whole image is written.
+	Region image.Rectangle
+	// Band is the sample of each pixel written, from 0. If negative, all
+	// samples of each pixel are written one after the other.
+	Band int
+	// ByteOrder is the byte order of the samples written. If nil, that
+	// of the host is used.
+	ByteOrder binary.ByteOrder
+}
+
+// DecodeRaw writes the samples of an image of the TIFF file in r to w as
+// raw values, in rows from the top, with no header, for consumers of binary
+// grids such as GPU uploads; opt may be nil. The samples are those of the
+// image Decode would return: 32-bit samples are written as such, the
+// samples of 16-bit images as 16-bit values and the others as bytes. Every
+// sample of a pixel is written, such as the extra samples of an RGB image
+// past its alpha and all the bands of an image of several bands of gray
+// samples; the colors of an image with a palette expanded by
+// ReaderOptions.ExpandPalette are written as 4 bands of red, green, blue
+// and alpha. The image is decoded a band of rows at a time, so that it
+// never has to be held in memory whole. Subsampled YCbCr images are not
+// supported.
+func DecodeRaw(w io.Writer, r io.ReaderAt, opt *RawOptions) error {
+	var o RawOptions
+	if opt != nil {
+		o = *opt
+	}
+	rd, err := NewReaderWithOptions(r, o.Reader)
+	if err != nil {
+		return err
+	}
+	d := rd.d
+	bands := d.rawBands()
+	if bands == 0 {
+		return UnsupportedError{Feature: "raw samples of a YCbCr image"}
+	}
+	if o.Band >= bands {
+		return fmt.Errorf("tiff: band %d of an image of %d bands", o.Band, bands)
+	}
+	rect := rd.Bounds()
+	if !o.Region.Empty() {
+		if !o.Region.In(rect) {
+			return fmt.Errorf("tiff: region %v outside of the image", o.Region)
+		}
+		rect = o.Region
+	}
+	order := o.ByteOrder
+	if order == nil {
+		order = binary.NativeEndian
+	}
+	// 32-bit samples in host byte order are written straight from the
+	// pixels where they can be viewed as bytes.
+	gray32 := d.format == formatGray32 || d.format == formatQuantized
+	direct := gray32 && haveUint32Bytes && (order == binary.ByteOrder(binary.NativeEndian) ||
+		nativeLittleEndian && order == binary.ByteOrder(binary.LittleEndian))
+
+	// Images of several bands of gray samples are read through
+	// ReadBands, the bands asked for at once.
+	var grayBands []int
+	if d.grayBands() > 1 {
+		direct = false
+		if o.Band >= 0 {
+			grayBands = []int{o.Band}
+		} else {
+			for b := range bands {
+				grayBands = append(grayBands, b)
+			}
+		}
+	}
+	pixelBytes := d.format.pixelBytes() * max(1, len(grayBands))
+	if d.rawColor() {
+		pixelBytes = d.bitsPerSample / 8 * d.samplesPerPixel
+	}
+
+	// Bands of rows are aligned to the strips or tiles, so that every
+	// block is decoded once.
+	bandRows := max(1, rawChunkBytes/(rect.Dx()*pixelBytes))
+	if bandRows >= d.blockHeight {
+		bandRows -= bandRows % d.blockHeight
+	}
+	var pix []uint32
+	var buf []byte
+	for y := rect.Min.Y; y < rect.Max.Y; {
+		y1 := min(rect.Max.Y, (y/bandRows+1)*bandRows)
+		band := image.Rect(rect.Min.X, y, rect.Max.X, y1)
+		var p []byte
+		switch {
+		case d.rawColor():
+			s := newRawSamples(d, band, o.Band, order, buf)
+			if err := d.readRegion(s); err != nil {
+				return err
+			}
+			buf = s.pix
+			p = buf
+		case grayBands != nil:
+			imgs, err := rd.ReadBands(band, grayBands...)
+			if err != nil {
+				return err
+			}
+			buf = appendInterleaved(buf[:0], imgs, order)
+			p = buf
+		default:
+			var m image.Image
+			if gray32 {
+				if pix == nil {
+					pix = make([]uint32, bandRows*rect.Dx())
+				}
+				m = d.bandImage(pix[:band.Dx()*band.Dy()], band)
+			} else if m, err = d.newImage(band); err != nil {
+				return err
+			}
+			if err := d.readRegion(m); err != nil {
+				return err
+			}
+			if direct {
+				p = uint32Bytes(pix[:band.Dx()*band.Dy()])
+			} else {
+				buf = appendRawSamples(buf[:0], m, o.Band, bands, order)
+				p = buf
+			}
+		}
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		y = y1
+	}
+	return nil
+}
+
+// rawBands returns the number of bands DecodeRaw writes for the image, or
+// 0 if it cannot write it.
+func (d *decoder) rawBands() int {
+	switch d.format {
+	case formatNRGBA, formatNRGBA64, formatRGBA, formatRGBA64, formatCMYK:
+		return d.samplesPerPixel
+	case formatGray32, formatGray, formatGray16:
+		return d.grayBands()
+	case formatExpanded:
+		return 4
+	case formatYCbCr:
+		return 0
+	}
+	return 1
+}
+
+// rawColor reports whether DecodeRaw writes the samples of the image as
+// they are stored: those of RGB and CMYK images are the samples of the
+// images they are decoded into, and extra samples past the fourth are
+// not decoded at all.
+func (d *decoder) rawColor() bool {
+	switch d.format {
+	case formatNRGBA, formatNRGBA64, formatRGBA, formatRGBA64, formatCMYK:
+		return true
+	}
+	return false
+}
+
+// A rawSamples is the destination of DecodeRaw for the images of which it
+// writes the samples as stored: the samples of the pixels of rect, of one
+// band or of all, in the byte order of the output. It stands in for an
+// image in readRegion, like a bandSet.
+type rawSamples struct {
+	d      *decoder
+	rect   image.Rectangle
+	pix    []byte
+	lo, hi int // The bands written.
+	order  binary.ByteOrder
+}
+
+// newRawSamples returns a rawSamples of band of the pixels of rect, or of
+// all bands if band is negative, reusing buf.
+func newRawSamples(d *decoder, rect image.Rectangle, band int, order binary.ByteOrder, buf []byte) *rawSamples {
+	s := &rawSamples{d: d, rect: rect, lo: band, hi: band + 1, order: order}
+	if band < 0 {
+		s.lo, s.hi = 0, d.samplesPerPixel
+	}
+	n := rect.Dx() * rect.Dy() * (s.hi - s.lo) * d.bitsPerSample / 8
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	s.pix = buf[:n]
+	return s
+}
+
+func (s *rawSamples) ColorModel() color.Model { return s.d.config.ColorModel }
+
+func (s *rawSamples) Bounds() image.Rectangle { return s.rect }
+
+func (s *rawSamples) At(x, y int) color.Color { return color.Transparent }
+
+// unpack copies the samples of the rows of b held in buf, whose predictor
+// has been undone, into s.
+func (s *rawSamples) unpack(buf []byte, b image.Rectangle) error {
+	d := s.d
+	size := d.bitsPerSample / 8
+	step := size * d.samplesPerPixel
+	pixelBytes := size * (s.hi - s.lo)
+	rowBytes := d.rowBytes(b.Dx())
+	r := b.Intersect(s.rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		off := (y-b.Min.Y)*rowBytes + (r.Min.X-b.Min.X)*step
+		if off+r.Dx()*step > len(buf) {
+			return errNoPixels
+		}
+		src := buf[off:]
+		dst := s.pix[((y-s.rect.Min.Y)*s.rect.Dx()+r.Min.X-s.rect.Min.X)*pixelBytes:]
+		for x := 0; x < r.Dx(); x++ {
+			p := src[x*step:]
+			for c := s.lo; c < s.hi; c++ {
+				if size == 1 {
+					dst[0] = p[c]
+				} else {
+					s.order.PutUint16(dst, d.byteOrder.Uint16(p[2*c:]))
+				}
+				dst = dst[size:]
+			}
+		}
+	}
+	return nil
+}
+
+// appendInterleaved appends to dst the samples of imgs, images of a band
+// each decoded by ReadBands, pixel by pixel.
+func appendInterleaved(dst []byte, imgs []image.Image, order binary.ByteOrder) []byte {
+	if len(imgs) == 1 {
+		return appendRawSamples(dst, imgs[0], 0, 1, order)
+	}
+	planes := make([][]byte, len(imgs))
+	for k, m := range imgs {
+		planes[k] = appendRawSamples(nil, m, 0, 1, order)
+	}
+	b := imgs[0].Bounds()
+	size := len(planes[0]) / (b.Dx() * b.Dy())
+	for i := 0; i < len(planes[0]); i += size {
+		for _, p := range planes {
+			dst = append(dst, p[i:i+size]...)
+		}
+	}
+	return dst
+}
+
+// appendRawSamples appends to dst the samples of band of m, an image of
+// the given number of bands decoded by newImage or bandImage, in order,
+// or those of all bands if band is negative.
+func appendRawSamples(dst []byte, m image.Image, band, bands int, order binary.ByteOrder) []byte {
+	b := m.Bounds()
+	lo, hi := band, band+1
+	if band < 0 {
+		lo, hi = 0, bands
+	}
+	if pix, stride := gray32Pix(m); pix != nil {
+		for y := 0; y < b.Dy(); y++ {
+			for _, v := range pix[y*stride:][:b.Dx()] {
+				dst = append(dst, 0, 0, 0, 0)
+				order.PutUint32(dst[len(dst)-4:], v)
+			}
+		}
+		return dst
+	}
+	var pix []byte
+	var stride, channels, size int
+	switch m := m.(type) {
+	case *image.Gray:
+		pix, stride, channels, size = m.Pix, m.Stride, 1, 1
+	case *image.Paletted:
+		pix, stride, channels, size = m.Pix, m.Stride, 1, 1
+	case *image.Gray16:
+		pix, stride, channels, size = m.Pix, m.Stride, 1, 2
+	case *image.RGBA:
+		pix, stride, channels, size = m.Pix, m.Stride, 4, 1
+	}
+	for y := 0; y < b.Dy(); y++ {
+		row := pix[y*stride:]
+		for x := 0; x < b.Dx(); x++ {
+			p := row[x*channels*size:]
+			for c := lo; c < hi; c++ {
+				if size == 1 {
+					dst = append(dst, p[c])
+				} else {
+					// The 16-bit samples of package image are big-endian.
+					dst = append(dst, 0, 0)
+					order.PutUint16(dst[len(dst)-2:], binary.BigEndian.Uint16(p[2*c:]))
+				}
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,1363 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestWriterStrips(t *testing.T) {
+	defer func(n int) { writerStripBytes = n }(writerStripBytes)
+	writerStripBytes = 3 * 40 * 4
+
+	src := newTestGrayFloat32(40, 25)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, image.Config{ColorModel: Gray32FloatModel, Width: 40, Height: 25}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 25; y += 7 {
+		r := image.Rect(0, y, 40, y+7).Intersect(src.Rect)
+		if err := w.WriteRows(src.SubImage(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*GrayFloat32).Pix, src.Pix)
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(5, 4, 31, 17)
+	region, err := r.ReadRegion(rect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := region.(*GrayFloat32)
+	if g.Rect != rect {
+		t.Fatalf("region bounds = %v, want %v", g.Rect, rect)
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if got, want := g.Pix[g.PixOffset(x, y)], src.Pix[src.PixOffset(x, y)]; got != want {
+				t.Fatalf("pixel (%d, %d) = %#x, want %#x", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestWriterIncomplete(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, image.Config{Width: 4, Height: 4}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRows(NewGray32(image.Rect(0, 1, 4, 2))); err == nil {
+		t.Error("WriteRows accepted rows out of order")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close succeeded before all rows were written")
+	}
+}
+
+func TestWriterCompressed(t *testing.T) {
+	defer func(n int) { writerStripBytes = n }(writerStripBytes)
+	writerStripBytes = 3 * 40 * 4
+
+	src := newTestGrayFloat32(40, 25)
+	md := &Metadata{Software: "stream", Resolution: &Resolution{[2]uint32{300, 1}, [2]uint32{300, 1}, 2}}
+	for _, c := range []struct {
+		name string
+		opt  *tiff.Options
+	}{
+		{"deflate", &tiff.Options{Compression: tiff.Deflate}},
+		{"deflate predictor", &tiff.Options{Compression: tiff.Deflate, Predictor: true}},
+		{"lzw", &tiff.Options{Compression: tiff.LZW}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := new(memFile)
+			w, err := NewWriterWithOptions(&seekFile{f: f}, image.Config{ColorModel: Gray32FloatModel, Width: 40, Height: 25}, &WriterOptions{Options: c.opt, Metadata: md})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < 25; y += 7 {
+				r := image.Rect(0, y, 40, y+7).Intersect(src.Rect)
+				if err := w.WriteRows(src.SubImage(r)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewReaderWithOptions(bytes.NewReader(*f), &ReaderOptions{Strict: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(r.d.blockOffsets); n != 9 || r.d.uncompressed() {
+				t.Errorf("%d strips, uncompressed %v, want 9 compressed strips", n, r.d.uncompressed())
+			}
+			m, err := r.ReadRegion(r.Bounds())
+			if err != nil {
+				t.Fatal(err)
+			}
+			comparePix(t, m.(*GrayFloat32).Pix, src.Pix)
+			got, err := r.Metadata()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Software != md.Software || got.Resolution == nil || *got.Resolution != *md.Resolution {
+				t.Errorf("metadata = %+v, want %+v", got, md)
+			}
+		})
+	}
+
+	var ue UnsupportedError
+	if _, err := NewWriter(new(bytes.Buffer), image.Config{Width: 4, Height: 4}, &tiff.Options{Compression: tiff.Deflate}); !errors.As(err, &ue) {
+		t.Errorf("compression to a bytes.Buffer: got %v, want an UnsupportedError", err)
+	}
+}
+
+// readBigTIFF returns the integer values of the IFD entries of the
+// little-endian BigTIFF file data, by tag.
+func readBigTIFF(t *testing.T, data []byte) map[int][]uint64 {
+	t.Helper()
+	if string(data[:8]) != leBigHeader {
+		t.Fatalf("header % x", data[:8])
+	}
+	le := binary.LittleEndian
+	ifd := data[le.Uint64(data[8:]):]
+	n := int(le.Uint64(ifd))
+	if next := le.Uint64(ifd[8+bigIFDLen*n:]); next != 0 {
+		t.Errorf("next IFD at %d", next)
+	}
+	entries := make(map[int][]uint64)
+	for i := 0; i < n; i++ {
+		p := ifd[8+bigIFDLen*i:]
+		tag, datatype, count := int(le.Uint16(p)), int(le.Uint16(p[2:])), int(le.Uint64(p[4:]))
+		size := int(lengths[datatype])
+		v := p[12:20]
+		if count*size > 8 {
+			v = data[le.Uint64(p[12:]):]
+		}
+		for k := 0; k < count; k++ {
+			switch size {
+			case 1:
+				entries[tag] = append(entries[tag], uint64(v[k]))
+			case 2:
+				entries[tag] = append(entries[tag], uint64(le.Uint16(v[2*k:])))
+			case 4:
+				entries[tag] = append(entries[tag], uint64(le.Uint32(v[4*k:])))
+			default:
+				entries[tag] = append(entries[tag], le.Uint64(v[8*k:]))
+			}
+		}
+	}
+	return entries
+}
+
+func TestWriterBigTIFF(t *testing.T) {
+	defer func(n int) { writerStripBytes = n }(writerStripBytes)
+	writerStripBytes = 4 * 30 * 4
+
+	src := newTestGray32(30, 10)
+	for _, c := range []struct {
+		name string
+		opt  *tiff.Options
+	}{
+		{"uncompressed", nil},
+		{"deflate", &tiff.Options{Compression: tiff.Deflate}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := new(memFile)
+			opt := &WriterOptions{Options: c.opt, Metadata: &Metadata{Software: "stream"}, BigTIFF: true}
+			w, err := NewWriterWithOptions(&seekFile{f: f}, image.Config{Width: 30, Height: 10}, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.WriteRows(src); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			data := []byte(*f)
+			entries := readBigTIFF(t, data)
+			if got := entries[TagImageWidth]; len(got) != 1 || got[0] != 30 {
+				t.Errorf("ImageWidth = %v", got)
+			}
+			if got := entries[TagSoftware]; string(bytesOf(got)) != "stream\x00" {
+				t.Errorf("Software = %q", bytesOf(got))
+			}
+			offsets, counts := entries[TagStripOffsets], entries[TagStripByteCounts]
+			if len(offsets) != 3 || len(counts) != 3 {
+				t.Fatalf("strips at %v of %v bytes, want 3", offsets, counts)
+			}
+			var pix []byte
+			for i, off := range offsets {
+				strip := data[off : off+counts[i]]
+				if c.opt != nil {
+					zr, err := zlib.NewReader(bytes.NewReader(strip))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if strip, err = io.ReadAll(zr); err != nil {
+						t.Fatal(err)
+					}
+				}
+				pix = append(pix, strip...)
+			}
+			got := make([]uint32, len(pix)/4)
+			for i := range got {
+				got[i] = binary.LittleEndian.Uint32(pix[4*i:])
+			}
+			comparePix(t, got, src.Pix)
+
+			var ue UnsupportedError
+			if _, err := NewReader(bytes.NewReader(data)); !errors.As(err, &ue) {
+				t.Errorf("NewReader: got %v, want an UnsupportedError", err)
+			}
+		})
+	}
+}
+
+// bytesOf returns the values v as bytes.
+func bytesOf(v []uint64) []byte {
+	b := make([]byte, len(v))
+	for i, x := range v {
+		b[i] = byte(x)
+	}
+	return b
+}
+
+func TestPipeline(t *testing.T) {
+	src := newTestGray32(64, 50)
+	in := encodeToBytes(t, src)
+	var out bytes.Buffer
+	var bands int
+	err := Pipeline(&out, bytes.NewReader(in), func(band image.Image) error {
+		bands++
+		g := band.(*Gray32)
+		for i := range g.Pix {
+			g.Pix[i] = ^g.Pix[i]
+		}
+		return nil
+	}, &PipelineOptions{MemoryLimit: 2 * 64 * 4 * 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bands != 7 {
+		t.Errorf("processed %d bands, want 7", bands)
+	}
+	m, err := Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]uint32, len(src.Pix))
+	for i, v := range src.Pix {
+		want[i] = ^v
+	}
+	comparePix(t, m.(*Gray32).Pix, want)
+
+	// The output may be compressed, and keeps the metadata of the input.
+	nodata := 7.0
+	var buf bytes.Buffer
+	if err := EncodeWithMetadata(&buf, src, &Metadata{Software: "pipeline", NoData: &nodata}, nil); err != nil {
+		t.Fatal(err)
+	}
+	f := new(memFile)
+	opt := &PipelineOptions{MemoryLimit: 1 << 20, Options: &tiff.Options{Compression: tiff.LZW, Predictor: true}}
+	if err := Pipeline(&seekFile{f: f}, bytes.NewReader(buf.Bytes()), nil, opt); err != nil {
+		t.Fatal(err)
+	}
+	m, md, err := DecodeWithMetadata(bytes.NewReader(*f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*Gray32).Pix, src.Pix)
+	if md.Software != "pipeline" || md.NoData == nil || *md.NoData != nodata {
+		t.Errorf("metadata = %+v", md)
+	}
+}
+
+func TestEncodeFromChannel(t *testing.T) {
+	defer func(n int) { writerStripBytes = n }(writerStripBytes)
+	writerStripBytes = 4 * 10 * 4
+
+	src := newTestGrayFloat32(10, 13)
+	for _, opt := range []*tiff.Options{nil, {Compression: tiff.Deflate, Predictor: true}} {
+		rows := make(chan []float32)
+		go func() {
+			for y := 0; y < 13; y++ {
+				rows <- src.Row(y)
+			}
+			close(rows)
+		}()
+		f := new(memFile)
+		if err := EncodeFromChannel(&seekFile{f: f}, image.Config{Width: 10, Height: 13}, rows, opt); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(*f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := r.d.uncompressed(), opt == nil; got != want {
+			t.Errorf("options %+v: uncompressed %v, want %v", opt, got, want)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatal(err)
+		}
+		comparePix(t, m.(*GrayFloat32).Pix, src.Pix)
+	}
+}
+
+func TestEncodeFromChannelShortRow(t *testing.T) {
+	rows := make(chan []float32)
+	go func() {
+		rows <- make([]float32, 3)
+		rows <- make([]float32, 4)
+		close(rows)
+	}()
+	var buf bytes.Buffer
+	if err := EncodeFromChannel(&buf, image.Config{Width: 4, Height: 2}, rows, nil); err == nil {
+		t.Error("EncodeFromChannel accepted a short row")
+	}
+}
+
+func TestEncodeRaw(t *testing.T) {
+	defer func(n int) { writerStripBytes = n }(writerStripBytes)
+	writerStripBytes = 4 * 10 * 4
+
+	src := newTestGrayFloat32(10, 13)
+	var raw []byte
+	for _, v := range src.Pix {
+		raw = binary.NativeEndian.AppendUint32(raw, v)
+	}
+	for _, model := range []color.Model{Gray32Model, Gray32FloatModel} {
+		var buf bytes.Buffer
+		cfg := image.Config{ColorModel: model, Width: 10, Height: 13}
+		// Trailing samples are left unread.
+		if err := EncodeRaw(&buf, cfg, bytes.NewReader(append(raw, 1, 2, 3, 4))); err != nil {
+			t.Fatal(err)
+		}
+		m, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if model == Gray32Model {
+			comparePix(t, m.(*Gray32).Pix, src.Pix)
+		} else {
+			comparePix(t, m.(*GrayFloat32).Pix, src.Pix)
+		}
+	}
+	cfg := image.Config{Width: 10, Height: 13}
+	if err := EncodeRaw(io.Discard, cfg, bytes.NewReader(raw[:len(raw)-1])); err == nil {
+		t.Error("EncodeRaw accepted too few samples")
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	defer func(n int) { rawChunkBytes = n }(rawChunkBytes)
+	rawChunkBytes = 4 * 30 * 4
+
+	src := newTestGray32(45, 37)
+	var buf bytes.Buffer
+	e := &Encoder{Options: &tiff.Options{Compression: tiff.Deflate}}
+	if err := e.EncodeAll(&buf, []Page{{Image: src, TileWidth: 16, TileHeight: 16}}); err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(3, 5, 40, 36)
+	for _, order := range []binary.ByteOrder{nil, binary.LittleEndian, binary.BigEndian} {
+		var out bytes.Buffer
+		if err := DecodeRaw(&out, bytes.NewReader(buf.Bytes()), &RawOptions{Region: rect, ByteOrder: order}); err != nil {
+			t.Fatal(err)
+		}
+		if order == nil {
+			order = binary.NativeEndian
+		}
+		var want []byte
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				var v [4]byte
+				order.PutUint32(v[:], src.Gray32At(x, y).Y)
+				want = append(want, v[:]...)
+			}
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("%v: samples differ", order)
+		}
+	}
+
+	rgb := image.NewNRGBA64(image.Rect(0, 0, 5, 3))
+	for i := range rgb.Pix {
+		rgb.Pix[i] = byte(i)
+	}
+	buf.Reset()
+	if err := Encode(&buf, rgb, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, band := range []int{-1, 2} {
+		var out bytes.Buffer
+		opt := &RawOptions{Band: band, ByteOrder: binary.LittleEndian}
+		if err := DecodeRaw(&out, bytes.NewReader(buf.Bytes()), opt); err != nil {
+			t.Fatal(err)
+		}
+		var want []byte
+		for i := 0; i < len(rgb.Pix); i += 2 {
+			if band < 0 || i/2%4 == band {
+				want = append(want, rgb.Pix[i+1], rgb.Pix[i])
+			}
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("band %d: got %v, want %v", band, out.Bytes(), want)
+		}
+	}
+	for _, opt := range []*RawOptions{{Band: 4}, {Region: image.Rect(0, 0, 6, 3)}} {
+		if err := DecodeRaw(io.Discard, bytes.NewReader(buf.Bytes()), opt); err == nil {
+			t.Errorf("%+v accepted", *opt)
+		}
+	}
+
+	// The extra samples of RGB images past the alpha are written too.
+	data := make([]byte, 5*7*9)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	file := encodeLayout(t, imageLayout{
+		width:           7,
+		height:          9,
+		bitsPerSample:   []uint32{8, 8, 8, 8, 8},
+		samplesPerPixel: 5,
+		photometric:     PhotometricRGB,
+		compression:     CompressionNone,
+		predictor:       PredictorNone,
+		sampleFormat:    SampleFormatUint,
+		extraSamples:    []uint32{ExtraSamplesUnassociatedAlpha, ExtraSamplesUnspecified},
+	}, data)
+	for _, band := range []int{-1, 0, 4} {
+		var out bytes.Buffer
+		if err := DecodeRaw(&out, bytes.NewReader(file), &RawOptions{Band: band}); err != nil {
+			t.Fatalf("extra samples, band %d: %v", band, err)
+		}
+		var want []byte
+		for i, v := range data {
+			if band < 0 || i%5 == band {
+				want = append(want, v)
+			}
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("extra samples, band %d: got %v, want %v", band, out.Bytes(), want)
+		}
+	}
+	if err := DecodeRaw(io.Discard, bytes.NewReader(file), &RawOptions{Band: 5}); err == nil {
+		t.Error("band 5 of 5 samples accepted")
+	}
+
+	// So are all the bands of images of several bands of gray samples.
+	stack := []*GrayFloat32{newTestGrayFloat32(45, 37), newTestGrayFloat32(45, 37), newTestGrayFloat32(45, 37)}
+	for k, m := range stack {
+		for i := range m.Pix {
+			m.Pix[i] += uint32(k) << 24
+		}
+	}
+	buf.Reset()
+	if err := StackBands(&buf, stack, &tiff.Options{Compression: tiff.Deflate}); err != nil {
+		t.Fatal(err)
+	}
+	for _, band := range []int{-1, 2} {
+		var out bytes.Buffer
+		opt := &RawOptions{Region: rect, Band: band, ByteOrder: binary.BigEndian}
+		if err := DecodeRaw(&out, bytes.NewReader(buf.Bytes()), opt); err != nil {
+			t.Fatalf("stack, band %d: %v", band, err)
+		}
+		var want []byte
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				for k, m := range stack {
+					if band < 0 || k == band {
+						want = binary.BigEndian.AppendUint32(want, m.Pix[m.PixOffset(x, y)])
+					}
+				}
+			}
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("stack, band %d: %d bytes differ from the %d wanted", band, out.Len(), len(want))
+		}
+	}
+	if err := DecodeRaw(io.Discard, bytes.NewReader(buf.Bytes()), &RawOptions{Band: 3}); err == nil {
+		t.Error("band 3 of a stack of 3 accepted")
+	}
+}
+
+func TestEncodeAll(t *testing.T) {
+	full := newTestGrayFloat32(31, 17)
+	overview := newTestGrayFloat32(16, 9)
+	mask := newTestGray32(31, 17)
+	pages := []Page{
+		{Image: full},
+		{Image: overview, Type: SubfileReducedResolution},
+		{Image: mask, Type: SubfileMask},
+	}
+	for _, opt := range []*tiff.Options{nil, {Compression: tiff.Deflate}} {
+		var buf bytes.Buffer
+		if err := EncodeAll(&buf, pages, opt); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := r.NumImages(); n != len(pages) || err != nil {
+			t.Fatalf("NumImages = %d, %v, want %d", n, err, len(pages))
+		}
+		for i, pg := range pages {
+			r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Image: i})
+			if err != nil {
+				t.Fatalf("page %d: %v", i, err)
+			}
+			if r.d.ifdOffset%2 != 0 {
+				t.Errorf("page %d: IFD at odd offset", i)
+			}
+			if got := r.SubfileType(); got != pg.Type {
+				t.Errorf("page %d: SubfileType = %d, want %d", i, got, pg.Type)
+			}
+			m, err := r.ReadRegion(r.Bounds())
+			if err != nil {
+				t.Fatalf("page %d: %v", i, err)
+			}
+			switch want := pg.Image.(type) {
+			case *Gray32:
+				comparePix(t, m.(*Gray32).Pix, want.Pix)
+			case *GrayFloat32:
+				comparePix(t, m.(*GrayFloat32).Pix, want.Pix)
+			}
+		}
+		if _, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Image: 3}); err == nil {
+			t.Error("opened a page beyond the last")
+		}
+	}
+}
+
+func TestEncodeAllPageNumbers(t *testing.T) {
+	pages := []Page{
+		{Image: newTestGray32(4, 3), Type: SubfilePage, Metadata: &Metadata{PageName: "red"}},
+		{Image: newTestGray32(2, 2), Type: SubfilePage | SubfileReducedResolution},
+		{Image: newTestGray32(4, 3), Type: SubfilePage, Metadata: &Metadata{PageNumber: &PageNumber{7, 0}}},
+		{Image: newTestGray32(4, 3), Type: SubfileMask},
+	}
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []*PageNumber{{0, 3}, {1, 3}, {7, 0}, nil}
+	for i := range pages {
+		r, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{Image: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, err := r.Metadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := md.PageNumber; (got == nil) != (want[i] == nil) || got != nil && *got != *want[i] {
+			t.Errorf("page %d: PageNumber = %v, want %v", i, got, want[i])
+		}
+		if i == 0 && md.PageName != "red" {
+			t.Errorf("page 0: PageName = %q, want %q", md.PageName, "red")
+		}
+	}
+	if pages[0].Metadata.PageNumber != nil {
+		t.Error("EncodeAll modified the Metadata of a page")
+	}
+}
+
+func TestEncodeAllPageOptions(t *testing.T) {
+	full := newTestGrayFloat32(70, 40)
+	overview := newTestGrayFloat32(35, 20)
+	pages := []Page{
+		{Image: full, Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 32, TileHeight: 16},
+		{Image: overview, Type: SubfileReducedResolution, Options: &tiff.Options{}, TileWidth: 16, TileHeight: 16},
+		{Image: overview.SubImage(image.Rect(3, 2, 20, 9)), Type: SubfileReducedResolution},
+	}
+	var buf bytes.Buffer
+	e := &Encoder{Options: &tiff.Options{Compression: tiff.Deflate}}
+	if err := e.EncodeAll(&buf, pages); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		compression, predictor, tileWidth uint
+	}{
+		{CompressionDeflate, PredictorHorizontal, 32},
+		{CompressionNone, 0, 16},
+		{CompressionDeflate, 0, 0},
+	}
+	for i, pg := range pages {
+		r, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{Image: i})
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		w := want[i]
+		if c, p, tw := r.d.firstVal(TagCompression), r.d.firstVal(TagPredictor), r.d.firstVal(TagTileWidth); c != w.compression || p != w.predictor || tw != w.tileWidth {
+			t.Errorf("page %d: compression %d, predictor %d, tile width %d; want %d, %d, %d",
+				i, c, p, tw, w.compression, w.predictor, w.tileWidth)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		src := pg.Image.(*GrayFloat32)
+		got := m.(*GrayFloat32)
+		b := src.Bounds()
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				if g, s := got.Pix[y*got.Stride+x], src.Pix[src.PixOffset(b.Min.X+x, b.Min.Y+y)]; g != s {
+					t.Fatalf("page %d: pixel (%d, %d) = %#x, want %#x", i, x, y, g, s)
+				}
+			}
+		}
+	}
+
+	for _, size := range [][2]int{{16, 0}, {24, 16}, {-16, 16}} {
+		pages := []Page{{Image: overview, TileWidth: size[0], TileHeight: size[1]}}
+		if err := EncodeAll(&bytes.Buffer{}, pages, nil); err == nil {
+			t.Errorf("tile size %dx%d accepted", size[0], size[1])
+		}
+	}
+}
+
+func TestEncodeVolume(t *testing.T) {
+	slices := make([]image.Image, 3)
+	for z := range slices {
+		m := newTestGrayFloat32(40, 20)
+		for i := range m.Pix {
+			m.Pix[i] = math.Float32bits(float32(z*1000 + i%7))
+		}
+		slices[z] = m
+	}
+	nodata := -1.0
+	md := &Metadata{NoData: &nodata}
+	for _, e := range []*Encoder{
+		{},
+		{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 16, TileHeight: 16, BlockChecksums: true},
+		{AutoTune: true},
+	} {
+		for _, layout := range []VolumeLayout{VolumeDepth, VolumePages} {
+			var buf bytes.Buffer
+			if err := e.EncodeVolume(&buf, slices, md, layout); err != nil {
+				t.Fatalf("layout %d: %v", layout, err)
+			}
+			r, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{VerifyChecksums: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := r.NumImages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if layout == VolumeDepth && (r.Depth() != 3 || n != 1) || layout == VolumePages && (r.Depth() != 1 || n != 3) {
+				t.Errorf("layout %d: depth %d, %d images", layout, r.Depth(), n)
+			}
+			if got, err := r.Metadata(); err != nil || *got.NoData != -1 || len(got.Tags) != 0 {
+				t.Errorf("layout %d: metadata %+v, %v", layout, got, err)
+			}
+			got, err := DecodeVolume(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("layout %d: %v", layout, err)
+			}
+			if len(got) != len(slices) {
+				t.Fatalf("layout %d: %d slices", layout, len(got))
+			}
+			for z, m := range got {
+				comparePix(t, m.(*GrayFloat32).Pix, slices[z].(*GrayFloat32).Pix)
+			}
+			if layout == VolumeDepth {
+				if m, err := r.ReadSlice(2); err != nil {
+					t.Error(err)
+				} else {
+					comparePix(t, m.(*GrayFloat32).Pix, slices[2].(*GrayFloat32).Pix)
+				}
+				if _, err := r.ReadSlice(3); err == nil {
+					t.Error("read slice 3 of 3")
+				}
+				if err := Transcode(io.Discard, bytes.NewReader(buf.Bytes()), nil); err == nil {
+					t.Error("transcoded a volume")
+				}
+			}
+		}
+	}
+
+	mixed := []image.Image{slices[0], newTestGrayFloat32(40, 21)}
+	if err := (&Encoder{}).EncodeVolume(io.Discard, mixed, nil, VolumeDepth); err == nil {
+		t.Error("encoded slices of different sizes")
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	pages := []Page{
+		{Image: newTestGray32(30, 20), Type: SubfilePage},
+		{Image: newTestGrayFloat32(10, 5), Type: SubfilePage, Metadata: &Metadata{PageName: "second"}},
+		{Image: newTestGray32(15, 10), Type: SubfileReducedResolution},
+	}
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	var metrics countingMetrics
+	lazy, err := DecodeAll(bytes.NewReader(buf.Bytes()), &ReaderOptions{Metrics: &metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lazy) != len(pages) {
+		t.Fatalf("%d pages, want %d", len(lazy), len(pages))
+	}
+	if n := metrics.blocks.Load(); n != 0 {
+		t.Errorf("DecodeAll read %d blocks", n)
+	}
+	for i, p := range lazy {
+		size := pages[i].Image.Bounds().Size()
+		if p.Index != i || p.Type != pages[i].Type || p.Config.Width != size.X || p.Config.Height != size.Y {
+			t.Errorf("page %d: %+v", i, p)
+		}
+	}
+	m, err := lazy[1].Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*GrayFloat32).Pix, pages[1].Image.(*GrayFloat32).Pix)
+	if n := metrics.blocks.Load(); n != 1 {
+		t.Errorf("decoding a page read %d blocks, want 1", n)
+	}
+	if md, err := lazy[1].Metadata(); err != nil || md.PageName != "second" {
+		t.Errorf("metadata of page 1: %+v, %v", md, err)
+	}
+}
+
+func TestEncodeAnimation(t *testing.T) {
+	var pages []Page
+	for i := 0; i < 3; i++ {
+		m := NewGrayFloat32(image.Rect(0, 0, 8, 4))
+		for j := range m.Pix {
+			m.Pix[j] = math.Float32bits(float32(i * 10))
+		}
+		m.Pix[1] = math.Float32bits(float32(math.NaN()))
+		pages = append(pages, Page{Image: m, Type: SubfilePage})
+	}
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenStack(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	opt := &AnimationOptions{Delay: 200 * time.Millisecond, Size: image.Pt(4, 2)}
+	if err := s.EncodeAnimation(&out, GrayscaleRamp, Stretch{}, opt); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 || g.Delay[0] != 20 || g.Config.Width != 4 || g.Config.Height != 2 {
+		t.Fatalf("%d frames, delay %v, size %dx%d", len(g.Image), g.Delay, g.Config.Width, g.Config.Height)
+	}
+	// The stretch spans the three frames: the first is black, the last
+	// white.
+	for i, want := range []uint8{0, 0x80, 0xff} {
+		r, _, _, a := g.Image[i].At(3, 1).RGBA()
+		if uint8(r>>8) != want || a != 0xffff {
+			t.Errorf("frame %d: %v, want gray %#x", i, g.Image[i].At(3, 1), want)
+		}
+	}
+
+	nan := NewGrayFloat32(image.Rect(0, 0, 2, 2))
+	nan.Pix[0] = math.Float32bits(float32(math.NaN()))
+	out.Reset()
+	if err := EncodeAnimation(&out, []*GrayFloat32{nan}, ViridisRamp, Stretch{Min: -1, Max: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if g, err = gif.DecodeAll(&out); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := g.Image[0].At(0, 0).RGBA(); a != 0 {
+		t.Errorf("NaN sample not transparent")
+	}
+	if g.Delay[0] != 50 {
+		t.Errorf("default delay %d, want 50", g.Delay[0])
+	}
+	if err := EncodeAnimation(&out, []*GrayFloat32{nan, newTestGrayFloat32(3, 2)}, ViridisRamp, Stretch{}, nil); err == nil {
+		t.Error("frames of different sizes accepted")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	g := newTestGray32(300, 500) // Of more than two chunks.
+	var buf bytes.Buffer
+	e := &Encoder{TileWidth: 64, TileHeight: 64}
+	if err := e.Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "cache")
+	var fetched atomic.Int64
+	src := countingReaderAt{bytes.NewReader(buf.Bytes()), &fetched}
+	c, err := NewDiskCache(src, dir, "https://example.com/dem.tif\x00\"v1\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(ra io.ReaderAt) {
+		t.Helper()
+		r, err := NewReader(ra)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatal(err)
+		}
+		comparePix(t, m.(*Gray32).Pix, g.Pix)
+	}
+	read(c)
+	if n := fetched.Load(); n != int64(buf.Len()) {
+		t.Errorf("fetched %d bytes of %d", n, buf.Len())
+	}
+
+	// Another cache of the same key, as after a restart, fetches nothing.
+	c2, err := NewDiskCache(src, dir, "https://example.com/dem.tif\x00\"v1\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics countingMetrics
+	c2.Metrics = &metrics
+	fetched.Store(0)
+	read(c2)
+	if n := fetched.Load(); n != 0 {
+		t.Errorf("fetched %d bytes again", n)
+	}
+	if metrics.hits.Load() == 0 || metrics.misses.Load() != 0 {
+		t.Errorf("%d hits and %d misses, want only hits", metrics.hits.Load(), metrics.misses.Load())
+	}
+	p := make([]byte, 10)
+	if n, err := c2.ReadAt(p, int64(buf.Len()-4)); n != 4 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v", n, err)
+	}
+
+	// A new key, for a changed file, misses; Clear removes the chunks.
+	c3, err := NewDiskCache(src, dir, "https://example.com/dem.tif\x00\"v2\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(c3)
+	if n := fetched.Load(); n != int64(buf.Len()) {
+		t.Errorf("fetched %d bytes for a new key, want %d", n, buf.Len())
+	}
+	if err := c3.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if want := (buf.Len() + diskCacheChunk - 1) / diskCacheChunk; len(names) != want {
+		t.Errorf("%d files left, want the %d of the first key", len(names), want)
+	}
+}
+
+// An eofReaderAt returns io.EOF with the last bytes of its data, as
+// io.ReaderAt allows, even when they fill p.
+type eofReaderAt struct{ data []byte }
+
+func (r eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if off+int64(n) == int64(len(r.data)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestDiskCacheEOF(t *testing.T) {
+	// The file ends with a full chunk, returned with io.EOF.
+	data := make([]byte, 2*diskCacheChunk)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	c, err := NewDiskCache(eofReaderAt{data}, t.TempDir(), "eof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		off, len int
+		n        int
+		err      error
+	}{
+		{diskCacheChunk + 100, diskCacheChunk - 100, diskCacheChunk - 100, nil},
+		{0, len(data), len(data), nil},
+		{len(data) - 10, 20, 10, io.EOF},
+		{len(data), 1, 0, io.EOF},
+	} {
+		p := make([]byte, tc.len)
+		n, err := c.ReadAt(p, int64(tc.off))
+		if n != tc.n || err != tc.err {
+			t.Errorf("ReadAt(%d bytes at %d) = %d, %v, want %d, %v", tc.len, tc.off, n, err, tc.n, tc.err)
+			continue
+		}
+		if !bytes.Equal(p[:n], data[tc.off:tc.off+n]) {
+			t.Errorf("ReadAt(%d bytes at %d) read the wrong bytes", tc.len, tc.off)
+		}
+	}
+}
+
+// A versionedFile is a VersionedReaderAt of data, whose version can be
+// changed as by an upload.
+type versionedFile struct {
+	data    []byte
+	version atomic.Pointer[string]
+	reads   atomic.Int64
+}
+
+func (f *versionedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, _, err := f.ReadAtVersion(p, off)
+	return n, err
+}
+
+func (f *versionedFile) ReadAtVersion(p []byte, off int64) (int, string, error) {
+	f.reads.Add(1)
+	n, err := bytes.NewReader(f.data).ReadAt(p, off)
+	return n, *f.version.Load(), err
+}
+
+func (f *versionedFile) setVersion(v string) { f.version.Store(&v) }
+
+func TestChangedFile(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (&Encoder{TileWidth: 64, TileHeight: 64}).Encode(&buf, newTestGray32(300, 500)); err != nil {
+		t.Fatal(err)
+	}
+	src := &versionedFile{data: buf.Bytes()}
+	src.setVersion(`"v1"`)
+	readAll := func(ra io.ReaderAt) error {
+		r, err := NewReaderWithOptions(ra, &ReaderOptions{Workers: 1})
+		if err != nil {
+			return err
+		}
+		_, err = r.ReadRegion(r.Bounds())
+		return err
+	}
+
+	// A change between opening the file and reading its tiles is caught.
+	pinned := PinVersion(src, "")
+	r, err := NewReader(pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := pinned.Version(); v != `"v1"` {
+		t.Errorf("Version = %s, want \"v1\"", v)
+	}
+	src.setVersion(`"v2"`)
+	var ce ChangedError
+	if _, err := r.ReadRegion(r.Bounds()); !errors.As(err, &ce) || ce.Want != `"v1"` || ce.Got != `"v2"` {
+		t.Errorf("read of a changed file: %v", err)
+	}
+	if err := readAll(PinVersion(src, `"v2"`)); err != nil {
+		t.Error(err)
+	}
+
+	// The chunks of a DiskCache are all of a version.
+	dir := t.TempDir()
+	c, err := NewDiskCache(src, dir, "https://example.com/dem.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(c); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*-1"))
+	if len(names) != 1 {
+		t.Fatalf("chunk files %v", names)
+	}
+	os.Remove(names[0])
+	src.setVersion(`"v3"`)
+	c, err = NewDiskCache(src, dir, "https://example.com/dem.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(c); !errors.As(err, &ce) || ce.Want != `"v2"` || ce.Got != `"v3"` {
+		t.Errorf("read of chunks of versions v2 and v3: %v", err)
+	}
+
+	// Pinned to the current version, the cache fetches the stale chunks
+	// anew.
+	if c, err = NewDiskCache(PinVersion(src, `"v3"`), dir, "https://example.com/dem.tif"); err != nil {
+		t.Fatal(err)
+	}
+	src.reads.Store(0)
+	if err := readAll(c); err != nil {
+		t.Fatal(err)
+	}
+	if n := src.reads.Load(); n != int64(len(src.data)+diskCacheChunk-1)/diskCacheChunk {
+		t.Errorf("%d chunks fetched anew", n)
+	}
+	src.reads.Store(0)
+	if err := readAll(c); err != nil || src.reads.Load() != 0 {
+		t.Errorf("read again: %v, %d chunks fetched", err, src.reads.Load())
+	}
+}
+
+func TestHTTPReaderAt(t *testing.T) {
+	var buf bytes.Buffer
+	g := newTestGray32(300, 200)
+	if err := (&Encoder{TileWidth: 64, TileHeight: 64}).Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	var modified atomic.Int64
+	modified.Store(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC).Unix())
+	var etag atomic.Pointer[string]
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if v := *etag.Load(); v != "" {
+			w.Header().Set("ETag", v)
+		}
+		http.ServeContent(w, r, "dem.tif", time.Unix(modified.Load(), 0), bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	setETag := func(v string) { etag.Store(&v) }
+	setETag(`"v1"`)
+
+	h := NewHTTPReaderAt(srv.URL, srv.Client())
+	r, err := NewReader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := r.ReadRegion(r.Bounds())
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*Gray32).Pix, g.Pix)
+	if v := h.Version(); v != `"v1"` {
+		t.Errorf("Version = %s, want \"v1\"", v)
+	}
+	p := make([]byte, 10)
+	if n, err := h.ReadAt(p, int64(len(data)-4)); n != 4 || err != io.EOF || !bytes.Equal(p[:4], data[len(data)-4:]) {
+		t.Errorf("ReadAt at the end = %d, %v", n, err)
+	}
+	if n, err := h.ReadAt(p, int64(len(data))); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v", n, err)
+	}
+
+	// A changed ETag fails If-Match.
+	setETag(`"v2"`)
+	var ce ChangedError
+	if _, err := r.ReadRegion(r.Bounds()); !errors.As(err, &ce) || ce.Want != `"v1"` || ce.Got != `"v2"` {
+		t.Errorf("read of a changed file: %v", err)
+	}
+
+	// Without an ETag, a changed date fails If-Range.
+	setETag("")
+	h = NewHTTPReaderAt(srv.URL, srv.Client())
+	if _, err := h.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Unix(modified.Load(), 0).UTC().Format(http.TimeFormat)
+	if v := h.Version(); v != want {
+		t.Errorf("Version = %s, want %s", v, want)
+	}
+	modified.Add(3600)
+	if _, err := h.ReadAt(p, 0); !errors.As(err, &ce) || ce.Want != want || ce.Got != time.Unix(modified.Load(), 0).UTC().Format(http.TimeFormat) {
+		t.Errorf("read of a changed file: %v", err)
+	}
+
+	// The chunks of a DiskCache read over HTTP are checked against the
+	// version.
+	setETag(`"v3"`)
+	c, err := NewDiskCache(PinVersion(NewHTTPReaderAt(srv.URL, srv.Client()), ""), t.TempDir(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = NewReader(c); err != nil {
+		t.Fatal(err)
+	}
+	requests.Store(0)
+	if _, err := r.ReadRegion(r.Bounds()); err != nil || requests.Load() != 0 {
+		t.Errorf("read from the cache: %v, %d requests", err, requests.Load())
+	}
+	if v := c.Version(); v != `"v3"` {
+		t.Errorf("Version = %s, want \"v3\"", v)
+	}
+
+	// A range starting elsewhere than asked for, as sent by a server
+	// rounding ranges down to 16 bytes, is refused.
+	aligned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var first, last int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); err == nil {
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first&^15, last))
+		}
+		http.ServeContent(w, r, "dem.tif", time.Unix(modified.Load(), 0), bytes.NewReader(data))
+	}))
+	defer aligned.Close()
+	h = NewHTTPReaderAt(aligned.URL, aligned.Client())
+	if n, err := h.ReadAt(p, 16); err != nil || n != len(p) || !bytes.Equal(p, data[16:16+len(p)]) {
+		t.Errorf("ReadAt of an aligned range = %d, %v", n, err)
+	}
+	if n, err := h.ReadAt(p, 20); err == nil || errors.As(err, &ce) {
+		t.Errorf("ReadAt of a range sent from another offset = %d, %v", n, err)
+	}
+}
+
+func TestStack(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	var pages []Page
+	for i := 0; i < 4; i++ {
+		m := newTestGray32(8, 4)
+		m.Pix[0] = uint32(i)
+		md := &Metadata{DateTime: FormatDateTime(day.AddDate(0, 0, i))}
+		switch i {
+		case 1:
+			md.PageName = day.Add(36 * time.Hour).Format(time.RFC3339) // Takes precedence.
+		case 3:
+			md.DateTime = "yesterday"
+		}
+		pages = append(pages, Page{Image: m, Type: SubfilePage, Metadata: md})
+	}
+	pages = append(pages, Page{Image: newTestGray32(4, 2), Type: SubfileReducedResolution})
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, pages, nil); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenStack(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 4 {
+		t.Fatalf("Len = %d, want 4", s.Len())
+	}
+	want := []time.Time{day, day.Add(36 * time.Hour), day.AddDate(0, 0, 2), {}}
+	for i, w := range want {
+		if got := s.Time(i); !got.Equal(w) {
+			t.Errorf("Time(%d) = %v, want %v", i, got, w)
+		}
+		m, err := s.Slice(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := m.(*Gray32).Pix[0]; v != uint32(i) {
+			t.Errorf("slice %d holds page %d", i, v)
+		}
+	}
+	if i := s.Nearest(day.Add(40 * time.Hour)); i != 1 {
+		t.Errorf("Nearest = %d, want 1", i)
+	}
+	if _, err := s.Slice(4); err == nil {
+		t.Error("read slice 4 of 4")
+	}
+	if s, err := OpenStack(bytes.NewReader(encodeToBytes(t, newTestGray32(2, 2))), nil); err != nil || s.Nearest(day) != -1 {
+		t.Errorf("stack of a page without a time: %v", err)
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	defer func(n int) { writerStripBytes = n }(writerStripBytes)
+	writerStripBytes = 2 * 16 * 40 * 4
+
+	full := newTestGrayFloat32(40, 70)
+	mask := newTestGray32(40, 70)
+	var buf bytes.Buffer
+	e := &Encoder{Options: &tiff.Options{Compression: tiff.Deflate}, TileWidth: 16, TileHeight: 16}
+	if err := e.EncodeAll(&buf, []Page{{Image: full}, {Image: mask, Type: SubfileMask}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 3} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "out.tif"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var last [2]RecompressProgress
+		opt := &RecompressOptions{
+			Options:  &tiff.Options{Compression: tiff.Deflate, Predictor: true},
+			Workers:  workers,
+			Progress: func(p RecompressProgress) { last[p.Image] = p },
+		}
+		if err := Recompress(f, bytes.NewReader(buf.Bytes()), opt); err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		size, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, p := range last {
+			if p.Rows != 70 || p.Height != 70 {
+				t.Errorf("%d workers: image %d: last progress %+v", workers, i, p)
+			}
+		}
+		if last[1].Written > size || last[1].Read == 0 {
+			t.Errorf("%d workers: last progress %+v, file of %d bytes", workers, last[1], size)
+		}
+		for i, want := range []image.Image{full, mask} {
+			r, err := NewReaderWithOptions(f, &ReaderOptions{Image: i, Strict: true})
+			if err != nil {
+				t.Fatalf("%d workers: image %d: %v", workers, i, err)
+			}
+			if r.d.blockPadding || len(r.d.blockOffsets) != 3 {
+				t.Errorf("%d workers: image %d: tiled %v, %d strips, want 3 strips", workers, i, r.d.blockPadding, len(r.d.blockOffsets))
+			}
+			if got := r.SubfileType(); i == 1 && got != SubfileMask {
+				t.Errorf("%d workers: image %d: SubfileType = %d", workers, i, got)
+			}
+			m, err := r.ReadRegion(r.Bounds())
+			if err != nil {
+				t.Fatalf("%d workers: image %d: %v", workers, i, err)
+			}
+			switch want := want.(type) {
+			case *Gray32:
+				comparePix(t, m.(*Gray32).Pix, want.Pix)
+			case *GrayFloat32:
+				comparePix(t, m.(*GrayFloat32).Pix, want.Pix)
+			}
+		}
+	}
+}
+
+func TestRecompressLargeStrips(t *testing.T) {
+	defer func(n int) { writerStripBytes = n }(writerStripBytes)
+	writerStripBytes = 8 * 40 * 4
+
+	m := newTestGray32(40, 70)
+	f := newTestGrayFloat32(40, 70)
+	var single, predicted bytes.Buffer
+	if err := Encode(&single, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Encode(&predicted, f, &tiff.Options{Compression: tiff.Deflate, Predictor: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want []uint32
+	}{
+		{"single strip", single.Bytes(), m.Pix},
+		{"predicted single strip", predicted.Bytes(), f.Pix},
+		// Strips of 25 rows, cut into strips of 8 across their edges.
+		{"strips", encodeStrips(t, m, 25, CompressionDeflate, deflate), m.Pix},
+		{"uncompressed strips", encodeStrips(t, m, 25, CompressionNone, func(p []byte) []byte { return p }), m.Pix},
+	} {
+		out := new(memFile)
+		if err := Recompress(&seekFile{f: out}, bytes.NewReader(tc.data), &RecompressOptions{Workers: 3}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		r, err := NewReaderWithOptions(bytes.NewReader(*out), &ReaderOptions{Strict: true})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if n := len(r.d.blockOffsets); n != 9 || r.d.blockHeight != 8 {
+			t.Errorf("%s: %d strips of %d rows, want 9 of 8", tc.name, n, r.d.blockHeight)
+		}
+		got, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		switch got := got.(type) {
+		case *Gray32:
+			comparePix(t, got.Pix, tc.want)
+		case *GrayFloat32:
+			comparePix(t, got.Pix, tc.want)
+		}
+	}
+
+	// A truncated strip fails rather than being padded.
+	data := encodeStrips(t, m, 70, CompressionDeflate, func(p []byte) []byte { return deflate(p)[:100] })
+	if err := Recompress(&seekFile{f: new(memFile)}, bytes.NewReader(data), nil); err == nil {
+		t.Error("Recompress accepted a truncated strip")
+	}
+}
+
+// A heapProbe is an io.WriteSeeker discarding what is written to it, which
+// records the largest live heap seen at each write.
+type heapProbe struct {
+	pos, size int64
+	peak      uint64
+}
+
+func (p *heapProbe) Write(b []byte) (int, error) {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	p.peak = max(p.peak, ms.HeapAlloc)
+	p.pos += int64(len(b))
+	p.size = max(p.size, p.pos)
+	return len(b), nil
+}
+
+func (p *heapProbe) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		p.pos = offset
+	case io.SeekEnd:
+		p.pos = p.size + offset
+	default:
+		p.pos += offset
+	}
+	return p.pos, nil
+}
+
+func TestRecompressSingleStripMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("encodes a 32MB image")
+	}
+	m := NewGray32(image.Rect(0, 0, 2048, 4096))
+	for i := range m.Pix {
+		m.Pix[i] = uint32(i%2048 + i/2048)
+	}
+	var src bytes.Buffer
+	if err := Encode(&src, m, &tiff.Options{Compression: tiff.Deflate}); err != nil {
+		t.Fatal(err)
+	}
+	m = nil
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base := ms.HeapAlloc
+
+	var p heapProbe
+	if err := Recompress(&p, bytes.NewReader(src.Bytes()), &RecompressOptions{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// The image holds 32MB; a few strips of 256KB are in flight.
+	if p.peak > base+8<<20 {
+		t.Errorf("peak heap %dMB over the %dMB before", (p.peak-base)>>20, base>>20)
+	}
+	if p.size < 32<<20 {
+		t.Errorf("wrote %d bytes", p.size)
+	}
+}
@@ -0,0 +1,733 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+
+	"golang.org/x/image/tiff"
+)
+
+// TranscodeOptions are the parameters of Transcode.
+type TranscodeOptions struct {
+	// Options gives the compression and predictor of the output, as for
+	// Encode. If nil, the pixels are stored uncompressed.
+	Options *tiff.Options
+	// TileWidth and TileHeight, if not zero, make the images be stored in
+	// tiles of that size instead of in a single strip. Both must be
+	// multiples of 16.
+	TileWidth, TileHeight int
+}
+
+// storageTags are the fields Transcode replaces, which describe how the
+// pixels are stored rather than what they are.
+var storageTags = map[int]bool{
+	TagCompression:     true,
+	TagStripOffsets:    true,
+	TagRowsPerStrip:    true,
+	TagStripByteCounts: true,
+	TagPredictor:       true,
+	TagTileWidth:       true,
+	TagTileLength:      true,
+	TagTileOffsets:     true,
+	TagTileByteCounts:  true,
+	TagJPEGTables:      true,
+	TagLercParameters:  true,
+	TagZSTDDictionary:  true,
+	TagBlockChecksums:  true,
+}
+
+// pointerTags are the fields pointing to IFDs without pixels, which
+// Transcode copies along with the IFD holding them.
+var pointerTags = map[int]bool{
+	TagExifIFD:             true,
+	TagGPSIFD:              true,
+	TagInteroperabilityIFD: true,
+}
+
+// Transcode copies the images of the TIFF file in src to dst, changing only
+// how their pixels are stored: their compression, predictor and strips or
+// tiles, as given by opt, which may be nil. The other fields of their IFDs
+// are copied as they are, including private fields unknown to the package,
+// and so are the EXIF, GPS and interoperability IFDs they point to. The
+// samples are copied bit for bit whatever their type, save that those of
+// big-endian files are made little-endian, as the package writes.
+//
+// Images stored as planes or as subsampled YCbCr, which JPEG compressed
+// color images usually are, and images pointing to SubIFDs are not
+// supported.
+func Transcode(dst io.Writer, src io.ReaderAt, opt *TranscodeOptions) error {
+	var o TranscodeOptions
+	if opt != nil {
+		o = *opt
+	}
+	compression, predictor, err := encodingOptions(o.Options)
+	if err != nil {
+		return err
+	}
+	if o.TileWidth != 0 || o.TileHeight != 0 {
+		if err := checkTileSize(o.TileWidth, o.TileHeight); err != nil {
+			return err
+		}
+	}
+	d, err := newDecoder(src, nil)
+	if err != nil {
+		return err
+	}
+	chain, err := d.ifdChain()
+	if err != nil {
+		return err
+	}
+
+	// As in EncodeAll, each IFD precedes the pixel data it describes, here
+	// with the IFDs it points to in between.
+	var header [8]byte
+	copy(header[:], leHeader)
+	enc.PutUint32(header[4:], 8)
+	if _, err := dst.Write(header[:]); err != nil {
+		return err
+	}
+	off := int64(8)
+	for i := range chain {
+		if i > 0 {
+			if d, err = newDecoder(src, &ReaderOptions{Image: i}); err != nil {
+				return err
+			}
+		}
+		t, err := readIFDTree(src, d.byteOrder, chain[i], 0)
+		if err != nil {
+			return err
+		}
+		if _, ok := d.ifd[TagSubIFDs]; ok {
+			return UnsupportedError{Feature: "transcoding of SubIFDs"}
+		}
+		data, counts, err := d.transcodePixels(compression, predictor, o.TileWidth, o.TileHeight)
+		if err != nil {
+			return err
+		}
+
+		ifd := t.entries[:0]
+		for _, e := range t.entries {
+			if !storageTags[e.tag] {
+				ifd = append(ifd, e)
+			}
+		}
+		offsets := make([]uint32, len(counts))
+		t.entries = appendStorage(ifd, compression, predictor, d.config.Height, o.TileWidth, o.TileHeight, offsets, counts)
+
+		dataOff, dataLen := off+int64(t.size()), data.Len()
+		next := int64(0)
+		if i < len(chain)-1 {
+			next = dataOff + int64(dataLen+dataLen%2)
+		}
+		if uint64(dataOff)+uint64(dataLen) > math.MaxUint32 {
+			return UnsupportedError{Feature: "file too large for a classic TIFF file"}
+		}
+		pos := uint32(dataOff)
+		for k, n := range counts {
+			offsets[k] = pos
+			pos += n
+		}
+		if err := t.write(dst, off, next); err != nil {
+			return err
+		}
+		if _, err := data.WriteTo(dst); err != nil {
+			return err
+		}
+		if err := writePad(dst, dataLen); err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// appendStorage appends to ifd the fields telling how the pixels of an
+// image are stored: with the given compression and predictor, at offsets
+// with the given byte counts, as strips of rows rows, such as a single strip
+// of the height of the image, or, if tw is positive, as tw×th tiles.
+func appendStorage(ifd []ifdEntry, compression uint32, predictor bool, rows, tw, th int, offsets, counts []uint32) []ifdEntry {
+	ifd = append(ifd, ifdEntry{TagCompression, TypeShort, []uint32{compression}})
+	if predictor {
+		ifd = append(ifd, ifdEntry{TagPredictor, TypeShort, []uint32{PredictorHorizontal}})
+	}
+	if tw > 0 {
+		return append(ifd,
+			ifdEntry{TagTileWidth, shortOrLong(tw), []uint32{uint32(tw)}},
+			ifdEntry{TagTileLength, shortOrLong(th), []uint32{uint32(th)}},
+			ifdEntry{TagTileOffsets, TypeLong, offsets},
+			ifdEntry{TagTileByteCounts, TypeLong, counts})
+	}
+	return append(ifd,
+		ifdEntry{TagStripOffsets, TypeLong, offsets},
+		ifdEntry{TagRowsPerStrip, shortOrLong(rows), []uint32{uint32(rows)}},
+		ifdEntry{TagStripByteCounts, TypeLong, counts})
+}
+
+// An ifdTree is an IFD along with the IFDs its fields point to, such as
+// the EXIF IFD.
+type ifdTree struct {
+	entries []ifdEntry
+	subs    map[int]*ifdTree // By the tag of the field pointing to them.
+}
+
+// readIFDTree reads the IFD at off, in a file of the given byte order,
+// and the IFDs it points to. depth is the number of IFDs above it.
+func readIFDTree(r io.ReaderAt, order binary.ByteOrder, off int64, depth int) (*ifdTree, error) {
+	// The EXIF IFD points to the interoperability IFD, which points to
+	// nothing.
+	if depth > 2 {
+		return nil, FormatError("IFDs nested too deep")
+	}
+	entries, _, err := readRawIFD(r, order, off)
+	if err != nil {
+		return nil, err
+	}
+	t := &ifdTree{entries: entries}
+	for _, e := range entries {
+		if !pointerTags[e.tag] || len(e.data) != 1 || e.datatype != TypeLong {
+			continue
+		}
+		sub, err := readIFDTree(r, order, int64(e.data[0]), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if t.subs == nil {
+			t.subs = make(map[int]*ifdTree)
+		}
+		t.subs[e.tag] = sub
+	}
+	return t, nil
+}
+
+// size returns the number of bytes taken by t, each IFD padded to an even
+// length.
+func (t *ifdTree) size() int {
+	n := ifdSize(t.entries)
+	n += n % 2
+	for _, sub := range t.subs {
+		n += sub.size()
+	}
+	return n
+}
+
+// write writes t to w, at offset off in the file: the IFD, pointing to the
+// IFD at next, followed by the IFDs it points to.
+func (t *ifdTree) write(w io.Writer, off, next int64) error {
+	// The IFDs pointed to follow in the order of the fields pointing to
+	// them.
+	sort.Sort(byTag(t.entries))
+	pos := off + int64(ifdSize(t.entries)+ifdSize(t.entries)%2)
+	subOffsets := make([]int64, 0, len(t.subs))
+	for i := range t.entries {
+		e := &t.entries[i]
+		if sub, ok := t.subs[e.tag]; ok {
+			e.data = []uint32{uint32(pos)}
+			subOffsets = append(subOffsets, pos)
+			pos += int64(sub.size())
+		}
+	}
+	if err := writeIFD(w, int(off), t.entries, int(next)); err != nil {
+		return err
+	}
+	if err := writePad(w, ifdSize(t.entries)); err != nil {
+		return err
+	}
+	for _, e := range t.entries {
+		if sub, ok := t.subs[e.tag]; ok {
+			if err := sub.write(w, subOffsets[0], 0); err != nil {
+				return err
+			}
+			subOffsets = subOffsets[1:]
+		}
+	}
+	return nil
+}
+
+// transcodePixels reads the samples of the image and stores them anew as
+// a single strip or as tw×th tiles if tw is positive, with the given
+// compression and predictor. It returns the stored data and the size of
+// each block.
+func (d *decoder) transcodePixels(compression uint32, predictor bool, tw, th int) (*bytes.Buffer, []uint32, error) {
+	if err := d.checkTranscode(predictor); err != nil {
+		return nil, nil, err
+	}
+	raw, err := d.littleEndianSamples()
+	if err != nil {
+		return nil, nil, err
+	}
+	dx, dy := d.config.Width, d.config.Height
+	if tw <= 0 {
+		return d.encodeBlocks(raw, dx, dy, compression, predictorValue(predictor), false, dx, dy)
+	}
+	return d.encodeBlocks(raw, dx, dy, compression, predictorValue(predictor), true, tw, th)
+}
+
+// encodeBlocks stores raw, the little-endian samples of a dx×dy image with
+// the samples of d in rows of d.rowBytes(dx) bytes, as tw×th tiles if tiled
+// is set and otherwise as strips of th rows, the last cut short, with the
+// given compression and Predictor value. The parts of edge tiles beyond the
+// image are zero. It returns the stored data and the size of each block.
+func (d *decoder) encodeBlocks(raw []byte, dx, dy int, compression, predictor uint32, tiled bool, tw, th int) (*bytes.Buffer, []uint32, error) {
+	rowBytes := d.rowBytes(dx)
+	pixelBits := d.samplesPerPixel * d.bitsPerSample
+	blockRow := d.rowBytes(tw)
+	buf := make([]byte, blockRow*th)
+	data := new(bytes.Buffer)
+	c := d.newBlockCompressor(compression, predictor, blockRow)
+	var counts []uint32
+	for ty := 0; ty < dy; ty += th {
+		for tx := 0; tx < dx; tx += tw {
+			block := buf
+			if !tiled {
+				block = buf[:blockRow*min(th, dy-ty)]
+			}
+			clear(block)
+			x0 := tx * pixelBits / 8
+			n := min(blockRow, rowBytes-x0)
+			for y := ty; y < min(ty+th, dy); y++ {
+				copy(block[(y-ty)*blockRow:][:n], raw[y*rowBytes+x0:])
+			}
+			count, err := c.compress(data, block)
+			if err != nil {
+				return nil, nil, err
+			}
+			if uint64(data.Len())+8 > math.MaxUint32 {
+				return nil, nil, UnsupportedError{Feature: "image too large for a classic TIFF file"}
+			}
+			counts = append(counts, count)
+		}
+	}
+	return data, counts, nil
+}
+
+// A blockCompressor stores blocks of little-endian samples with the
+// compression and predictor of an image.
+type blockCompressor struct {
+	compression    uint32
+	predictor      uint32 // The Predictor value.
+	rowBytes, size int
+	step           int // Size of a pixel in bytes.
+	zw             streamCompressor
+	tmp            []byte // A row, for the floating point predictor.
+}
+
+// newBlockCompressor returns a blockCompressor for blocks of the image
+// made of rows of rowBytes bytes. compression must be CompressionNone,
+// CompressionDeflate or CompressionLZW.
+func (d *decoder) newBlockCompressor(compression, predictor uint32, rowBytes int) *blockCompressor {
+	size := d.bitsPerSample / 8
+	return &blockCompressor{compression: compression, predictor: predictor, rowBytes: rowBytes, size: size, step: size * d.samplesPerPixel}
+}
+
+// compress appends block to data, predicting it in place first if asked
+// to, and returns the number of bytes appended.
+func (c *blockCompressor) compress(data *bytes.Buffer, block []byte) (uint32, error) {
+	switch c.predictor {
+	case PredictorHorizontal:
+		predictRows(block, c.rowBytes, c.size, c.step)
+	case PredictorFloatingPoint:
+		if c.tmp == nil {
+			c.tmp = make([]byte, c.rowBytes)
+		}
+		predictFloatRows(block, c.tmp, c.rowBytes, c.size, c.step/c.size)
+	}
+	start := data.Len()
+	if c.compression != CompressionDeflate && c.compression != CompressionLZW {
+		data.Write(block)
+		return uint32(data.Len() - start), nil
+	}
+	if c.zw == nil {
+		c.zw = newStreamCompressor(c.compression, data, 0)
+	} else {
+		c.zw.Reset(data)
+	}
+	if _, err := c.zw.Write(block); err != nil {
+		return 0, err
+	}
+	if err := c.zw.Close(); err != nil {
+		return 0, err
+	}
+	return uint32(data.Len() - start), nil
+}
+
+// rawSamples returns the samples of the image as stored, in the byte order
+// of the file, once decompressed and gathered from its strips or tiles
+// into rows of d.rowBytes(width) bytes.
+func (d *decoder) rawSamples() ([]byte, error) {
+	rowBytes := d.rowBytes(d.config.Width)
+	n, ok := mulInt(rowBytes, d.config.Height)
+	if !ok {
+		return nil, UnsupportedError{Feature: "image too large"}
+	}
+	raw := make([]byte, n)
+	for j := 0; j < d.blocksDown; j++ {
+		if err := d.readBlockRow(&d.state, j, raw[j*d.blockHeight*rowBytes:]); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// readBlockRow reads the samples of the row j of strips or tiles, as
+// stored, into raw, which holds the rows of the image from the first row of
+// the blocks, of d.rowBytes(width) bytes each. s is the state of the
+// goroutine decoding the blocks.
+func (d *decoder) readBlockRow(s *blockState, j int, raw []byte) error {
+	dy := d.config.Height
+	rowBytes := d.rowBytes(d.config.Width)
+	blockRow := d.rowBytes(d.blockWidth)
+	pixelBits := d.samplesPerPixel * d.bitsPerSample
+	for i := 0; i < d.blocksAcross; i++ {
+		b := d.blockBounds(i, j)
+		rows := min(b.Max.Y, dy) - b.Min.Y
+		var buf []byte
+		if d.uncompressed() {
+			k := j*d.blocksAcross + i
+			var err error
+			n := min(int64(d.blockCounts[k]), d.blockBytes())
+			if buf, err = safeReadAt(d.r, uint64(n), int64(d.blockOffsets[k])); err != nil {
+				return err
+			}
+		} else {
+			if err := d.inflate(s, i, j, nil); err != nil {
+				return err
+			}
+			buf = s.buf
+		}
+		if len(buf) < rows*blockRow {
+			return errNoPixels
+		}
+		if d.predicted() {
+			r := image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+rows)
+			if err := d.unpredict(buf, r); err != nil {
+				return err
+			}
+		}
+		x0 := b.Min.X * pixelBits / 8
+		n := min(blockRow, rowBytes-x0)
+		for y := 0; y < rows; y++ {
+			copy(raw[y*rowBytes+x0:][:n], buf[y*blockRow:])
+		}
+	}
+	return nil
+}
+
+// littleEndianSamples is like rawSamples, but with samples of whole bytes
+// made little-endian, as the package writes them.
+func (d *decoder) littleEndianSamples() ([]byte, error) {
+	raw, err := d.rawSamples()
+	if err != nil {
+		return nil, err
+	}
+	d.makeLittleEndian(raw)
+	return raw, nil
+}
+
+// makeLittleEndian reverses the bytes of the samples in raw, samples of the
+// image as stored, if they are of whole bytes and the file is big-endian.
+func (d *decoder) makeLittleEndian(raw []byte) {
+	if size := d.bitsPerSample / 8; d.byteOrder != binary.ByteOrder(binary.LittleEndian) && d.bitsPerSample%8 == 0 && size > 1 {
+		for i := 0; i+size <= len(raw); i += size {
+			for a, b := i, i+size-1; a < b; a, b = a+1, b-1 {
+				raw[a], raw[b] = raw[b], raw[a]
+			}
+		}
+	}
+}
+
+// predictFloatRows applies the floating point predictor to the rows of
+// rowBytes bytes in buf, made of little-endian samples of the given size
+// and spp samples per pixel, as unpredictFloats undoes it. tmp must hold
+// rowBytes bytes.
+func predictFloatRows(buf, tmp []byte, rowBytes, size, spp int) {
+	n := rowBytes / size
+	for y := 0; y+rowBytes <= len(buf); y += rowBytes {
+		row := buf[y : y+rowBytes]
+		for i := 0; i < n; i++ {
+			for k := 0; k < size; k++ {
+				tmp[k*n+i] = row[i*size+size-1-k]
+			}
+		}
+		for i := rowBytes - 1; i >= spp; i-- {
+			tmp[i] -= tmp[i-spp]
+		}
+		copy(row, tmp)
+	}
+}
+
+// predictRows applies the horizontal predictor to the rows of rowBytes
+// bytes in buf, made of little-endian samples of the given size: each
+// sample is replaced by its difference from the same sample of the pixel
+// step bytes to its left.
+func predictRows(buf []byte, rowBytes, size, step int) {
+	for y := 0; y+rowBytes <= len(buf); y += rowBytes {
+		row := buf[y : y+rowBytes]
+		switch size {
+		case 1:
+			for i := len(row) - 1; i >= step; i-- {
+				row[i] -= row[i-step]
+			}
+		case 2:
+			for i := len(row) - 2; i >= step; i -= 2 {
+				enc.PutUint16(row[i:], enc.Uint16(row[i:])-enc.Uint16(row[i-step:]))
+			}
+		case 4:
+			for i := len(row) - 4; i >= step; i -= 4 {
+				enc.PutUint32(row[i:], enc.Uint32(row[i:])-enc.Uint32(row[i-step:]))
+			}
+		}
+	}
+}
+
+// CopyTiles writes to dst the part of the image of src inside region as a
+// file of its own, copying the compressed strips or tiles it is made of
+// verbatim, so that cropping an image, such as a COG, is lossless and
+// costs no more than reading the blocks kept. The compression, predictor
+// and layout of the blocks are those of src, and the other fields of its
+// IFD are copied as Transcode does, save that the georeferencing of
+// ModelTiepoint and ModelTransformation is moved to the corner of region,
+// as GeoInfo.Shift does, and the checksums of TagBlockChecksums are those
+// of the blocks kept. To put several images together into a mosaic, use
+// Writer.CopyTiles instead.
+//
+// The region must lie inside the image and be aligned with its blocks: it
+// starts at the corner of a block and ends at a corner or at the edge of
+// the image, so that strips are only cut between rows. Images of
+// big-endian files, whose blocks would have to be decoded to be made
+// little-endian, and images pointing to SubIFDs are not supported.
+func CopyTiles(dst io.Writer, src *Reader, region image.Rectangle) error {
+	d := src.d
+	if err := checkRegion(d, src.Bounds(), region); err != nil {
+		return err
+	}
+	if _, ok := d.ifd[TagSubIFDs]; ok {
+		return UnsupportedError{Feature: "copying the blocks of an image with SubIFDs"}
+	}
+	t, err := readIFDTree(d.r, d.byteOrder, d.imageIFD, 0)
+	if err != nil {
+		return err
+	}
+	tiepoints, err := d.doubleField(TagModelTiepoint)
+	if err != nil {
+		return err
+	}
+	transformation, err := d.doubleField(TagModelTransformation)
+	if err != nil {
+		return err
+	}
+
+	bw, bh := d.blockWidth, d.blockHeight
+	i0, j0 := region.Min.X/bw, region.Min.Y/bh
+	i1, j1 := (region.Max.X+bw-1)/bw, (region.Max.Y+bh-1)/bh
+	var blocks, counts []uint32
+	var dataLen uint64
+	for j := j0; j < j1; j++ {
+		for i := i0; i < i1; i++ {
+			k := j*d.blocksAcross + i
+			blocks = append(blocks, uint32(k))
+			counts = append(counts, uint32(d.blockCounts[k]))
+			dataLen += uint64(d.blockCounts[k])
+		}
+	}
+
+	dx, dy := region.Dx(), region.Dy()
+	offsetTag, countTag := TagStripOffsets, TagStripByteCounts
+	if d.blockPadding {
+		offsetTag, countTag = TagTileOffsets, TagTileByteCounts
+	}
+	offsets := make([]uint32, len(counts))
+	ifd := t.entries[:0]
+	for _, e := range t.entries {
+		switch e.tag {
+		case TagImageWidth, TagImageLength, offsetTag, countTag:
+		case TagModelTiepoint:
+			// The tiepoints are moved to the grid of region.
+			ifd = append(ifd, doubleEntry(e.tag, shiftTiepoints(tiepoints, region.Min.X, region.Min.Y)))
+		case TagBlockChecksums:
+			// The checksums of the blocks kept are kept with them.
+			_, all, _, err := d.entryData(e.tag)
+			if err != nil {
+				return err
+			}
+			if len(all) != 8*len(d.blockCounts) {
+				return FormatError("block checksums do not match the blocks")
+			}
+			sums := make([]byte, 0, 8*len(blocks))
+			for _, b := range blocks {
+				sums = append(sums, all[8*b:8*b+8]...)
+			}
+			ifd = append(ifd, ifdEntry{e.tag, TypeUndefined, tagData(TypeUndefined, sums)})
+		case TagModelTransformation:
+			ifd = append(ifd, doubleEntry(e.tag, shiftTransformation(transformation, region.Min.X, region.Min.Y)))
+		default:
+			ifd = append(ifd, e)
+		}
+	}
+	t.entries = append(ifd,
+		ifdEntry{TagImageWidth, shortOrLong(dx), []uint32{uint32(dx)}},
+		ifdEntry{TagImageLength, shortOrLong(dy), []uint32{uint32(dy)}},
+		ifdEntry{offsetTag, TypeLong, offsets},
+		ifdEntry{countTag, TypeLong, counts})
+
+	dataOff := uint64(8 + t.size())
+	if dataOff+dataLen > math.MaxUint32 {
+		return UnsupportedError{Feature: "file too large for a classic TIFF file"}
+	}
+	pos := uint32(dataOff)
+	for k, n := range counts {
+		// Blocks holding no data, as in sparse files, stay so.
+		if n > 0 {
+			offsets[k] = pos
+		}
+		pos += n
+	}
+	var header [8]byte
+	copy(header[:], leHeader)
+	enc.PutUint32(header[4:], 8)
+	if _, err := dst.Write(header[:]); err != nil {
+		return err
+	}
+	if err := t.write(dst, 8, 0); err != nil {
+		return err
+	}
+	for k, b := range blocks {
+		sr := io.NewSectionReader(d.r, int64(d.blockOffsets[b]), int64(counts[k]))
+		if n, err := io.Copy(dst, sr); err != nil {
+			return err
+		} else if n < int64(counts[k]) {
+			return errNoPixels
+		}
+	}
+	return nil
+}
+
+// CopyTiles copies the part of the image of src inside region into the
+// image of w, with its top-left corner at the point at, copying the
+// compressed strips or tiles it is made of verbatim, so that putting
+// several images together into a mosaic is lossless and costs no more
+// than reading the blocks kept. The blocks of src must be stored as those
+// of w: with the same compression, predictor, sample format and size of
+// strips or tiles, as 32-bit samples of a single band. The fields of the
+// output are those given to w; the georeferencing of src is that of the
+// output moved by GeoInfo.Shift(region.Min.X-at.X, region.Min.Y-at.Y).
+//
+// The region must lie inside the image and be aligned with its blocks, as
+// for the function CopyTiles. It must land inside the image of w, and at
+// on the corner of one of its blocks; blocks cut by the edge of src must
+// end up at the edge of w. Strips, which span the whole width of the
+// image, are appended to those written so far, so at must then be the
+// first row not yet written. Blocks of src holding no data, as in sparse
+// files, are left unwritten, so that Close stores them as zeros; strips,
+// which must all be written, are written as zeros at once.
+func (w *Writer) CopyTiles(src *Reader, region image.Rectangle, at image.Point) error {
+	d := src.d
+	if w.err != nil {
+		return w.err
+	}
+	if err := checkRegion(d, src.Bounds(), region); err != nil {
+		return err
+	}
+	if err := w.checkBlocks(d); err != nil {
+		return err
+	}
+	bw, bh := d.blockWidth, d.blockHeight
+	to := region.Sub(region.Min).Add(at)
+	if !to.In(w.Bounds()) || at.X%bw != 0 || at.Y%bh != 0 {
+		return fmt.Errorf("tiff: region %v copied to %v is not aligned with the blocks inside the image bounds %v", region, to, w.Bounds())
+	}
+	if region.Max.X%bw != 0 && to.Max.X != w.layout.width || region.Max.Y%bh != 0 && to.Max.Y != w.layout.height {
+		return fmt.Errorf("tiff: region %v copied to %v cuts its last blocks short of the edge of the image", region, to)
+	}
+	tiled := w.layout.tileWidth > 0
+	if !tiled && at.Y != w.y {
+		return fmt.Errorf("tiff: strips copied to row %d, want row %d", at.Y, w.y)
+	}
+
+	h := d.config.Height
+	i0, j0 := region.Min.X/bw, region.Min.Y/bh
+	i1, j1 := (region.Max.X+bw-1)/bw, (region.Max.Y+bh-1)/bh
+	var from, into []int
+	for j := j0; j < j1; j++ {
+		for i := i0; i < i1; i++ {
+			k := (at.Y/bh+j-j0)*w.blocksAcross + at.X/bw + i - i0
+			if tiled && w.offsets[k] != 0 {
+				return fmt.Errorf("tiff: tile %d of the output written twice", k)
+			}
+			// A strip must hold as many rows in both images.
+			if !tiled && min(bh, h-j*bh) != min(bh, w.layout.height-(at.Y/bh+j-j0)*bh) {
+				return fmt.Errorf("tiff: strip %d copied into a strip of another height", j)
+			}
+			from, into = append(from, j*d.blocksAcross+i), append(into, k)
+		}
+	}
+	for n, b := range from {
+		data, err := safeReadAt(d.r, uint64(d.blockCounts[b]), int64(d.blockOffsets[b]))
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(data) > 0:
+			w.err = w.writeBlock(into[n], data)
+		case !tiled:
+			zeros := make([]byte, min(bh, h-b/d.blocksAcross*bh)*w.blockWidth*4)
+			if w.direct {
+				w.err = w.writeBlock(into[n], zeros)
+			} else {
+				w.err = w.compressBlock(into[n], zeros)
+			}
+		}
+		if w.err != nil {
+			return w.err
+		}
+	}
+	if !tiled {
+		w.y = to.Max.Y
+	}
+	return nil
+}
+
+// checkRegion reports whether the blocks of the image of d inside region,
+// of an image of the given bounds, can be copied verbatim.
+func checkRegion(d *decoder, bounds, region image.Rectangle) error {
+	w, h := d.config.Width, d.config.Height
+	if region.Empty() || !region.In(bounds) {
+		return fmt.Errorf("tiff: region %v is not inside the image bounds %v", region, bounds)
+	}
+	bw, bh := d.blockWidth, d.blockHeight
+	if region.Min.X%bw != 0 || region.Min.Y%bh != 0 ||
+		region.Max.X%bw != 0 && region.Max.X != w || region.Max.Y%bh != 0 && region.Max.Y != h {
+		return fmt.Errorf("tiff: region %v is not aligned with the %dx%d blocks of the image", region, bw, bh)
+	}
+	if d.byteOrder != binary.ByteOrder(binary.LittleEndian) {
+		return UnsupportedError{Feature: "copying the blocks of a big-endian file"}
+	}
+	if d.depth() > 1 {
+		return UnsupportedError{Feature: "copying the blocks of a volume"}
+	}
+	return nil
+}
+
+// checkBlocks reports whether the blocks of the image of d can be copied
+// verbatim into w.
+func (w *Writer) checkBlocks(d *decoder) error {
+	sampleFormat := max(d.firstVal(TagSampleFormat), SampleFormatUint)
+	switch {
+	case d.bitsPerSample != 32 || d.samplesPerPixel != 1 || uint32(sampleFormat) != w.layout.sampleFormat:
+		return UnsupportedError{Feature: "copying blocks of other samples than those of the output"}
+	case uint32(max(d.firstVal(TagCompression), CompressionNone)) != w.layout.compression ||
+		uint32(max(d.firstVal(TagPredictor), PredictorNone)) != w.layout.predictor:
+		return UnsupportedError{Feature: "copying blocks of another compression or predictor than the output"}
+	case d.blockPadding != (w.layout.tileWidth > 0) || d.blockWidth != w.blockWidth || d.blockHeight != w.blockHeight:
+		return fmt.Errorf("tiff: blocks of %dx%d copied into blocks of %dx%d", d.blockWidth, d.blockHeight, w.blockWidth, w.blockHeight)
+	}
+	return nil
+}
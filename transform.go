@@ -0,0 +1,106 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// A BlockTransform transforms the stored data of strips and tiles, one
+// block at a time, so that a file can be encrypted at rest and yet be read
+// a region at a time. Seal is applied by an Encoder to the data of each
+// block once compressed, and Open by a Reader to the data read from the
+// file, before it is decompressed. Both may be called from several
+// goroutines at once.
+//
+// The other fields of the file are not transformed, and neither are the
+// blocks of files read by functions other than those of a Reader, such as
+// Transcode. CopyTiles and Writer.CopyTiles copy the blocks as they are
+// stored, transformed or not.
+type BlockTransform interface {
+	Seal(data []byte) ([]byte, error)
+	Open(data []byte) ([]byte, error)
+}
+
+// NewAESGCM returns a BlockTransform encrypting each block with AES in
+// Galois/counter mode, the key being 16, 24 or 32 bytes long for AES-128,
+// AES-192 or AES-256. Each block is stored with a random nonce before it
+// and an authentication tag after it, 28 bytes in all, so that a block
+// tampered with or opened with the wrong key is reported by Open.
+func NewAESGCM(key []byte) (BlockTransform, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("tiff: %v", err)
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCM{aead}, nil
+}
+
+type aesGCM struct {
+	aead cipher.AEAD
+}
+
+func (t aesGCM) Seal(data []byte) ([]byte, error) {
+	n := t.aead.NonceSize()
+	out := make([]byte, n, n+len(data)+t.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(out, out, data, nil), nil
+}
+
+func (t aesGCM) Open(data []byte) ([]byte, error) {
+	n := t.aead.NonceSize()
+	if len(data) < n+t.aead.Overhead() {
+		return nil, FormatError("encrypted block too short")
+	}
+	out, err := t.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, FormatError("block cannot be decrypted: " + err.Error())
+	}
+	return out, nil
+}
+
+// sealBlocks returns the blocks stored one after the other in data, of the
+// given sizes, each transformed by t, and updates counts to their new
+// sizes.
+func sealBlocks(t BlockTransform, data []byte, counts []uint32) (*bytes.Buffer, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	for k, n := range counts {
+		sealed, err := t.Seal(data[:n])
+		if err != nil {
+			return nil, err
+		}
+		out.Write(sealed)
+		counts[k] = uint32(len(sealed))
+		data = data[n:]
+	}
+	return out, nil
+}
+
+// openBlock returns the data of block (i, j) as it was before d.transform
+// was applied to it. raw holds the stored data if it has already been
+// fetched.
+func (d *decoder) openBlock(i, j int, raw []byte) ([]byte, error) {
+	if raw == nil {
+		k := j*d.blocksAcross + i
+		var err error
+		if raw, err = safeReadAt(d.r, uint64(d.blockCounts[k]), int64(d.blockOffsets[k])); err != nil {
+			return nil, err
+		}
+	}
+	data, err := d.transform.Open(raw)
+	if fe, ok := err.(FormatError); ok {
+		return nil, FormatError(d.blockName(i, j) + ": " + string(fe))
+	}
+	return data, err
+}
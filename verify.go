@@ -0,0 +1,156 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"image"
+	"io"
+	"math"
+
+	"golang.org/x/image/tiff"
+)
+
+// encodeVerified encodes m to w and, if e.VerifyRows is positive or
+// e.CheckXImage applies to m, reads the result back and checks it against
+// m.
+func (e *Encoder) encodeVerified(w io.Writer, m image.Image, md *Metadata, h hash.Hash) error {
+	if m != nil {
+		// The file is checked against the pixels as they are stored.
+		var err error
+		if m, md, err = e.rewriteSource(m, md); err != nil {
+			return err
+		}
+	}
+	lossy := e.JPEG != nil || e.LERC != nil && e.LERC.MaxError > 0
+	_, quantized := m.(*GrayFloat32)
+	quantized = quantized && md != nil && md.Quantization != nil
+	// Quantized and lossily compressed samples differ from the source by
+	// design.
+	verify := e.VerifyRows > 0 && !lossy && !quantized
+	var xcheck bool
+	switch m.(type) {
+	case *image.RGBA, *image.NRGBA, *image.RGBA64, *image.NRGBA64:
+		xcheck = e.CheckXImage && e.JPEG == nil && e.LERC == nil && e.ZSTD == nil && e.Transform == nil
+	}
+	if !verify && !xcheck {
+		return e.encode(w, m, md, h)
+	}
+
+	// Files are read back where they were written; anything else is
+	// copied while it is written.
+	var src io.ReaderAt
+	var copied *bytes.Buffer
+	if rs, ok := w.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		if base, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			src = io.NewSectionReader(rs, base, math.MaxInt64-base)
+		}
+	}
+	if src == nil {
+		copied = new(bytes.Buffer)
+		w = io.MultiWriter(w, copied)
+	}
+	if err := e.encode(w, m, md, h); err != nil {
+		return err
+	}
+	if copied != nil {
+		src = bytes.NewReader(copied.Bytes())
+	}
+	if verify {
+		if err := verifyImage(src, m, e.VerifyRows, e.Transform); err != nil {
+			return err
+		}
+	}
+	if xcheck {
+		return checkXImage(src, m)
+	}
+	return nil
+}
+
+// checkXImage decodes the TIFF file in r with golang.org/x/image/tiff and
+// compares its pixels with those of m. A difference is reported as an
+// InternalError.
+func checkXImage(r io.ReaderAt, m image.Image) error {
+	got, err := tiff.Decode(io.NewSectionReader(r, 0, math.MaxInt64))
+	if err != nil {
+		return InternalError("x/image/tiff cannot decode the output: " + err.Error())
+	}
+	b := m.Bounds()
+	if got.Bounds().Size() != b.Size() {
+		return InternalError(fmt.Sprintf("x/image/tiff decodes a %v image, want %v", got.Bounds().Size(), b.Size()))
+	}
+	if got.ColorModel() != m.ColorModel() {
+		return InternalError(fmt.Sprintf("x/image/tiff decodes a %T, want a %T", got, m))
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if c, want := got.At(x, y), m.At(b.Min.X+x, b.Min.Y+y); c != want {
+				return InternalError(fmt.Sprintf("x/image/tiff reads pixel (%d, %d) as %v, want %v", x, y, c, want))
+			}
+		}
+	}
+	return nil
+}
+
+// verifyImage decodes up to n rows, spread evenly over the image, of the
+// TIFF file in r, whose blocks t transforms if not nil, and compares them
+// with the pixels of m. A difference is reported as an InternalError, since
+// it means the encoder wrote m wrongly.
+func verifyImage(r io.ReaderAt, m image.Image, n int, t BlockTransform) error {
+	var pix []uint32
+	var stride int
+	switch m := m.(type) {
+	case *Gray32:
+		pix, stride = m.Pix, m.Stride
+	case *GrayFloat32:
+		pix, stride = m.Pix, m.Stride
+	default:
+		return nil
+	}
+
+	rd, err := NewReaderWithOptions(r, &ReaderOptions{Workers: 1, Transform: t})
+	if err != nil {
+		return err
+	}
+	dx, dy := m.Bounds().Dx(), m.Bounds().Dy()
+	if got := rd.Bounds().Size(); got != m.Bounds().Size() {
+		return InternalError(fmt.Sprintf("verify: wrote a %dx%d image, want %dx%d", got.X, got.Y, dx, dy))
+	}
+	if rd.Config().ColorModel != m.ColorModel() {
+		return InternalError("verify: wrote the wrong sample format")
+	}
+	if n > dy {
+		n = dy
+	}
+	for k := 0; k < n; k++ {
+		y := 0
+		if n > 1 {
+			y = k * (dy - 1) / (n - 1)
+		}
+		got, err := rd.ReadRegion(image.Rect(0, y, dx, y+1))
+		if err != nil {
+			return err
+		}
+		var row []uint32
+		switch got := got.(type) {
+		case *Gray32:
+			row = got.Pix
+		case *GrayFloat32:
+			row = got.Pix
+		}
+		want := pix[y*stride : y*stride+dx]
+		for x := range want {
+			if row[x] != want[x] {
+				return InternalError(fmt.Sprintf("verify: sample (%d, %d) reads back as %#x, want %#x", x, y, row[x], want[x]))
+			}
+		}
+	}
+	return nil
+}
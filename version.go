@@ -0,0 +1,221 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A VersionedReaderAt reads a file that may change while it is read, such
+// as an object of object storage read over HTTP range requests. An
+// implementation over HTTP, such as HTTPReaderAt, reports the ETag of each
+// response, or its Last-Modified date if it has none, and may send the
+// version it was given first in an If-Range or If-Match header.
+type VersionedReaderAt interface {
+	io.ReaderAt
+	// ReadAtVersion reads like ReadAt, and also returns the version of the
+	// file the bytes were read from, or "" if it is unknown.
+	ReadAtVersion(p []byte, off int64) (n int, version string, err error)
+}
+
+// A ChangedError reports that a file changed while it was read: bytes of
+// version Got were read after bytes of version Want, and putting them
+// together would mix the strips or tiles of both.
+type ChangedError struct {
+	Want, Got string
+}
+
+func (e ChangedError) Error() string {
+	return fmt.Sprintf("tiff: file changed while read, from version %q to %q", e.Want, e.Got)
+}
+
+// A versionPin holds the version of a file its reads must all be of.
+type versionPin struct {
+	mu      sync.Mutex
+	version string
+}
+
+// match reports whether bytes of version v may be used with those read
+// before, pinning v if no version was known. The unknown version "" matches
+// any.
+func (p *versionPin) match(v string) bool {
+	if v == "" {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.version == "" {
+		p.version = v
+	}
+	return v == p.version
+}
+
+func (p *versionPin) get() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
+
+// A PinnedReaderAt reads a VersionedReaderAt, failing every read of bytes
+// of another version than the first it read, or than the one it was given,
+// with a ChangedError. A Reader opened on it thus never decodes an image
+// from strips or tiles of different versions of the file. It is safe for
+// concurrent use if the VersionedReaderAt it reads is.
+type PinnedReaderAt struct {
+	r   VersionedReaderAt
+	pin versionPin
+}
+
+// PinVersion returns a PinnedReaderAt reading r, whose bytes must be of
+// version, or if it is "", of the version first read.
+func PinVersion(r VersionedReaderAt, version string) *PinnedReaderAt {
+	return &PinnedReaderAt{r: r, pin: versionPin{version: version}}
+}
+
+// ReadAt reads like the ReadAt of the underlying VersionedReaderAt.
+func (p *PinnedReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, _, err := p.ReadAtVersion(b, off)
+	return n, err
+}
+
+// ReadAtVersion reads like ReadAt and returns the version of the file.
+func (p *PinnedReaderAt) ReadAtVersion(b []byte, off int64) (int, string, error) {
+	n, v, err := p.r.ReadAtVersion(b, off)
+	if !p.pin.match(v) {
+		return 0, v, ChangedError{p.pin.get(), v}
+	}
+	return n, v, err
+}
+
+// Version returns the version the reads are pinned to, or "" if none is
+// known yet.
+func (p *PinnedReaderAt) Version() string { return p.pin.get() }
+
+// An HTTPReaderAt is a VersionedReaderAt reading a file over HTTP range
+// requests. The version of the file is the ETag of the first response, or
+// its Last-Modified date if it has none, and every later request is made
+// conditional on it: a strong ETag is sent in an If-Match header and a date
+// in an If-Range header, so that a server answering 412 Precondition Failed
+// or the whole file with 200 OK, or a response of another version, fails
+// the read with a ChangedError. It is safe for concurrent use if its
+// http.Client is.
+type HTTPReaderAt struct {
+	client *http.Client
+	url    string
+	pin    versionPin
+}
+
+// NewHTTPReaderAt returns an HTTPReaderAt reading the file at url with
+// client, or with http.DefaultClient if it is nil.
+func NewHTTPReaderAt(url string, client *http.Client) *HTTPReaderAt {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPReaderAt{client: client, url: url}
+}
+
+// ReadAt reads len(p) bytes at off with a range request.
+func (h *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, _, err := h.ReadAtVersion(p, off)
+	return n, err
+}
+
+// ReadAtVersion reads like ReadAt and returns the version of the file.
+func (h *HTTPReaderAt) ReadAtVersion(p []byte, off int64) (int, string, error) {
+	if off < 0 {
+		return 0, "", errors.New("tiff: negative offset")
+	}
+	if len(p) == 0 {
+		return 0, h.pin.get(), nil
+	}
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	want := h.pin.get()
+	switch {
+	case want == "":
+	case strings.HasPrefix(want, `"`):
+		req.Header.Set("If-Match", want)
+	case !strings.HasPrefix(want, "W/"):
+		req.Header.Set("If-Range", want)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	v := resp.Header.Get("ETag")
+	if v == "" {
+		v = resp.Header.Get("Last-Modified")
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// A server, or a cache in front of it, may send another range
+		// than the one asked for.
+		if cr := resp.Header.Get("Content-Range"); rangeStart(cr) != off {
+			return 0, v, fmt.Errorf("tiff: GET %s: range %q sent for bytes %d-", h.url, cr, off)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The range starts past the end of the file.
+		return 0, want, io.EOF
+	case http.StatusPreconditionFailed:
+		return 0, v, ChangedError{want, v}
+	case http.StatusOK:
+		// The whole file is sent in place of the range when the version
+		// given in If-Range is not the current one.
+		if want != "" && v != want {
+			return 0, v, ChangedError{want, v}
+		}
+		return 0, v, fmt.Errorf("tiff: %s does not support range requests", h.url)
+	default:
+		return 0, v, fmt.Errorf("tiff: GET %s: %s", h.url, resp.Status)
+	}
+	if !h.pin.match(v) {
+		return 0, v, ChangedError{h.pin.get(), v}
+	}
+	// The range is cut short at the end of the file.
+	b := p
+	if resp.ContentLength >= 0 && resp.ContentLength < int64(len(p)) {
+		b = p[:resp.ContentLength]
+	}
+	n, err := io.ReadFull(resp.Body, b)
+	switch {
+	case err == io.ErrUnexpectedEOF && resp.ContentLength < 0:
+		err = io.EOF
+	case err == nil && n < len(p):
+		err = io.EOF
+	}
+	return n, v, err
+}
+
+// rangeStart returns the first byte of the range of a Content-Range
+// header, such as "bytes 0-99/1000", or -1 if it holds none.
+func rangeStart(cr string) int64 {
+	s, ok := strings.CutPrefix(cr, "bytes ")
+	if !ok {
+		return -1
+	}
+	s, _, ok = strings.Cut(s, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// Version returns the version of the file the reads are of, or "" if none
+// is known yet.
+func (h *HTTPReaderAt) Version() string { return h.pin.get() }
@@ -0,0 +1,19 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+//go:build purego
+
+package tiff
+
+// haveUint32Bytes reports whether uint32Bytes returns a view of its argument.
+const haveUint32Bytes = false
+
+// nativeLittleEndian is unknown without package unsafe; it is only
+// consulted when uint32Bytes returns a view.
+var nativeLittleEndian = false
+
+// uint32Bytes returns nil: the purego build never aliases Pix as bytes.
+func uint32Bytes(p []uint32) []byte {
+	return nil
+}
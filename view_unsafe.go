@@ -0,0 +1,28 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+//go:build !purego
+
+package tiff
+
+import "unsafe"
+
+// haveUint32Bytes reports whether uint32Bytes returns a view of its argument.
+const haveUint32Bytes = true
+
+// nativeLittleEndian reports whether the host stores a uint32 with its
+// least significant byte first.
+var nativeLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// uint32Bytes returns the memory backing p as a byte slice in host byte
+// order, or nil if such a view is not available on this platform.
+func uint32Bytes(p []uint32) []byte {
+	if len(p) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&p[0])), 4*len(p))
+}
@@ -0,0 +1,238 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"golang.org/x/image/tiff"
+)
+
+// A VolumeLayout tells how EncodeVolume stores the slices of a volume.
+type VolumeLayout int
+
+const (
+	// VolumeDepth stores the slices in a single image whose ImageDepth
+	// field gives their number, the strips or tiles of each following
+	// those of the previous one in the tables of offsets, as SGI and
+	// volume tools read them. Readers unaware of ImageDepth see the first
+	// slice.
+	VolumeDepth VolumeLayout = iota
+	// VolumePages stores each slice as a page of its own, as EncodeAll
+	// does for pages of type SubfilePage, as ImageJ and most viewers read
+	// stacks.
+	VolumePages
+)
+
+// EncodeVolume writes the slices of a volume, such as the float32 samples
+// of a CT scan, to w as a single file laid out as layout says, with md,
+// which may be nil, stored as for EncodeWithMetadata. The slices must be
+// of the same type and size. With VolumeDepth they are compressed alike,
+// the compression chosen by AutoTune for the first applying to all, and
+// the palette, if any, is that of the first; ZSTD dictionaries are not
+// supported. The file read back by DecodeVolume holds the slices in order.
+func (e *Encoder) EncodeVolume(w io.Writer, slices []image.Image, md *Metadata, layout VolumeLayout) error {
+	if len(slices) == 0 {
+		return errors.New("tiff: EncodeVolume given no slices")
+	}
+	for _, s := range slices[1:] {
+		if fmt.Sprintf("%T", s) != fmt.Sprintf("%T", slices[0]) || s.Bounds().Size() != slices[0].Bounds().Size() {
+			return fmt.Errorf("tiff: volume slices of %T %v and %T %v", slices[0], slices[0].Bounds().Size(), s, s.Bounds().Size())
+		}
+	}
+	switch layout {
+	case VolumePages:
+		pages := make([]Page, len(slices))
+		for i, s := range slices {
+			pages[i] = Page{Image: s, Type: SubfilePage, Metadata: md}
+		}
+		return e.EncodeAll(w, pages)
+	case VolumeDepth:
+	default:
+		return fmt.Errorf("tiff: invalid volume layout %d", layout)
+	}
+	if e.ZSTD != nil && e.ZSTD.DictionarySize > 0 {
+		return UnsupportedError{Feature: "ZSTD dictionaries in volumes"}
+	}
+	e.once.Do(e.init)
+	if e.Metrics != nil {
+		w = meteredWriter{w, e.Metrics}
+	}
+
+	var p *page
+	var data bytes.Buffer
+	var counts []uint32
+	for i, s := range slices {
+		pg := Page{Image: s, Metadata: md}
+		if i > 0 && e.AutoTune && (p.layout.compression == CompressionDeflate || p.layout.compression == CompressionNone) {
+			c := tiff.Uncompressed
+			if p.layout.compression == CompressionDeflate {
+				c = tiff.Deflate
+			}
+			pg.Options, pg.tuned, pg.floatPredictor = &tiff.Options{Compression: c, Predictor: p.predictor}, true, p.floatPredictor
+		}
+		ps, err := e.preparePage(pg)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			p = ps
+		} else if ps.layout.compression != p.layout.compression || ps.layout.predictor != p.layout.predictor {
+			return InternalError("volume slices compressed differently")
+		}
+		if ps.buf == nil {
+			ps.buf = bytes.NewBuffer(make([]byte, 0, ps.imageLen))
+			if err := ps.writeRows(ps.buf, e.sem); err != nil {
+				return err
+			}
+		}
+		if uint64(data.Len())+uint64(ps.buf.Len())+8 > math.MaxUint32 {
+			return UnsupportedError{Feature: "volume too large for a classic TIFF file"}
+		}
+		data.Write(ps.buf.Bytes())
+		counts = append(counts, ps.layout.blockByteCounts...)
+	}
+
+	l := &p.layout
+	for k := range l.extra {
+		if l.extra[k].tag == TagBlockChecksums {
+			l.extra[k] = blockChecksumsEntry(data.Bytes(), counts)
+		}
+	}
+	l.extra = append(l.extra, ifdEntry{TagImageDepth, shortOrLong(len(slices)), []uint32{uint32(len(slices))}})
+	l.blockOffsets, l.blockByteCounts = make([]uint32, len(counts)), counts
+	p.buf, p.imageLen = &data, data.Len()
+	return e.writePage(w, p, nil)
+}
+
+// DecodeVolume reads the slices of the volume in the TIFF file in r: those
+// of its first image if its ImageDepth field gives more than one, or
+// otherwise all its images but the reduced-resolution ones and masks, each
+// a slice.
+func DecodeVolume(r io.ReaderAt) ([]image.Image, error) {
+	rd, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if depth := rd.Depth(); depth > 1 {
+		slices := make([]image.Image, depth)
+		for z := range slices {
+			if slices[z], err = rd.ReadSlice(z); err != nil {
+				return nil, err
+			}
+		}
+		return slices, nil
+	}
+	pages, err := dataPages(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	slices := make([]image.Image, len(pages))
+	for i, pr := range pages {
+		if slices[i], err = pr.ReadRegion(pr.Bounds()); err != nil {
+			return nil, err
+		}
+	}
+	return slices, nil
+}
+
+// dataPages returns readers, applying opt, of the images of the file in r
+// but the reduced-resolution ones and masks, in order.
+func dataPages(r io.ReaderAt, opt *ReaderOptions) ([]*Reader, error) {
+	first, err := NewReaderWithOptions(r, opt)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := first.d.ifdChain()
+	if err != nil {
+		return nil, err
+	}
+	var pages []*Reader
+	for _, off := range chain {
+		pr, err := openReaderAt(r, opt, off)
+		if err != nil {
+			return nil, err
+		}
+		if pr.SubfileType()&(SubfileReducedResolution|SubfileMask) == 0 {
+			pages = append(pages, pr)
+		}
+	}
+	return pages, nil
+}
+
+// Depth returns the number of slices of the image, from its ImageDepth
+// field: 1 but for volumes such as those EncodeVolume writes with
+// VolumeDepth.
+func (r *Reader) Depth() int {
+	return r.d.depth()
+}
+
+// ReadSlice decodes slice z of the image, from 0 to Depth, as ReadRegion
+// decodes the whole of the first. Volumes whose tiles span several slices,
+// of a TileDepth greater than 1, are not supported.
+func (r *Reader) ReadSlice(z int) (image.Image, error) {
+	depth := r.d.depth()
+	if z < 0 || z >= depth {
+		return nil, fmt.Errorf("tiff: slice %d not within the %d of the image", z, depth)
+	}
+	if v, err := r.d.parseIFDOffsets(TagTileDepth, 1); err != nil {
+		return nil, err
+	} else if len(v) > 0 && v[0] > 1 {
+		return nil, UnsupportedError{"TileDepth", TagTileDepth, v[0]}
+	}
+	s := r
+	if z > 0 {
+		var err error
+		if s, err = r.slice(z, depth); err != nil {
+			return nil, err
+		}
+	}
+	return s.ReadRegion(s.Bounds())
+}
+
+// slice returns a Reader of slice z of the depth slices of the image.
+func (r *Reader) slice(z, depth int) (*Reader, error) {
+	s := r.Clone()
+	d := s.d
+	n := d.blocksAcross * d.blocksDown
+	total, ok := mulInt(n, depth)
+	if !ok {
+		return nil, FormatError("too many slices")
+	}
+	offsetTag, countTag := TagStripOffsets, TagStripByteCounts
+	if d.blockPadding {
+		offsetTag, countTag = TagTileOffsets, TagTileByteCounts
+	}
+	offsets, err := d.parseIFDOffsets(offsetTag, total)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := d.parseIFDOffsets(countTag, total)
+	if err != nil {
+		return nil, err
+	}
+	if len(offsets) < total || len(counts) < total {
+		return nil, FormatError(fmt.Sprintf("tables of %d blocks for %d slices of %d", min(len(offsets), len(counts)), depth, n))
+	}
+	d.blockOffsets, d.blockCounts = offsets[z*n:(z+1)*n], counts[z*n:(z+1)*n]
+	if d.blockChecksums != nil {
+		d.blockChecksums = d.blockChecksums[8*z*n : 8*(z+1)*n]
+	}
+	return s, nil
+}
+
+// depth returns the number of slices given by the ImageDepth field, or 1.
+func (d *decoder) depth() int {
+	v, err := d.parseIFDOffsets(TagImageDepth, 1)
+	if err != nil || len(v) == 0 || v[0] == 0 || v[0] > math.MaxInt32 {
+		return 1
+	}
+	return int(v[0])
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import "runtime"
+
+// A WorkerPool caps the number of strips, tiles and bands being decoded or
+// encoded at once by all the Readers, Encoders and Recompress calls sharing
+// it, through ReaderOptions.Pool, Encoder.Pool and RecompressOptions.Pool,
+// so that a service handling many images at the same time keeps to a
+// fixed concurrency instead of each operation using GOMAXPROCS goroutines
+// of its own. Operations still start goroutines of their own, but those
+// wait for a free slot of the pool before doing any work. A WorkerPool is
+// safe for concurrent use.
+type WorkerPool struct {
+	sem chan struct{}
+}
+
+// NewWorkerPool returns a pool of n slots, or GOMAXPROCS if n is zero or
+// less.
+func NewWorkerPool(n int) *WorkerPool {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	return &WorkerPool{sem: make(chan struct{}, n)}
+}
+
+// Size returns the number of slots of the pool.
+func (p *WorkerPool) Size() int { return cap(p.sem) }
+
+// acquire waits for a free slot of the pool, if p is not nil; it is handed
+// back with release.
+func (p *WorkerPool) acquire() {
+	if p != nil {
+		p.sem <- struct{}{}
+	}
+}
+
+func (p *WorkerPool) release() {
+	if p != nil {
+		<-p.sem
+	}
+}
+
+// limit returns workers, cut to the size of the pool if p is not nil, as
+// more would only wait.
+func (p *WorkerPool) limit(workers int) int {
+	if p != nil {
+		return min(workers, p.Size())
+	}
+	return workers
+}
@@ -5,69 +5,24 @@
 package tiff
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"image"
+	"image/jpeg"
 	"io"
+	"math"
+	"runtime"
 	"sort"
+	"sync"
 
 	"golang.org/x/image/tiff"
 )
 
-// The length of one instance of each data type in bytes.
-var lengths = [...]uint32{0, 1, 1, 2, 4, 8}
-
-const (
-	dtByte     = 1
-	dtASCII    = 2
-	dtShort    = 3
-	dtLong     = 4
-	dtRational = 5
-)
-
-// Tags (see p. 28-41 of the spec).
-const (
-	tImageWidth                = 256
-	tImageLength               = 257
-	tBitsPerSample             = 258
-	tCompression               = 259
-	tPhotometricInterpretation = 262
-
-	tStripOffsets    = 273
-	tSamplesPerPixel = 277
-	tRowsPerStrip    = 278
-	tStripByteCounts = 279
-
-	tTileWidth      = 322
-	tTileLength     = 323
-	tTileOffsets    = 324
-	tTileByteCounts = 325
-
-	tXResolution    = 282
-	tYResolution    = 283
-	tResolutionUnit = 296
-
-	tPredictor    = 317
-	tColorMap     = 320
-	tExtraSamples = 338
-	tSampleFormat = 339
-)
-
-const (
-	cNone  = 1
-	ifdLen = 12 // Length of an IFD entry in bytes.
-
-	prNone       = 1
-	pRGB         = 2
-	prHorizontal = 2
-	pPaletted    = 3
-)
-const (
-	sampleFormat_UINT   = 1
-	sampleFormat_INT    = 2
-	sampleFormat_IEEEFP = 3
-	sampleFormat_VOID   = 4
-)
-
 type ifdEntry struct {
 	tag      int
 	datatype int
@@ -77,102 +32,1118 @@ type ifdEntry struct {
 // Encode writes the image m to w. opt determines the options used for
 // encoding, such as the compression type. If opt is nil, an uncompressed
 // image is written.
+//
+// m must be a *Gray32, a *GrayFloat32, or an *image.RGBA, *image.NRGBA,
+// *image.RGBA64 or *image.NRGBA64, which are written with 8- or 16-bit
+// samples. Color images are written with their alpha as it is held in
+// memory, declared as associated (premultiplied) for the RGBA types and as
+// unassociated for the NRGBA ones. JPEG compression, set with
+// Encoder.JPEG or Page.JPEG, takes other images as described for
+// Page.JPEG.
 func Encode(w io.Writer, m image.Image, opt *tiff.Options) error {
-	d := m.Bounds().Size()
+	e := &Encoder{Options: opt}
+	return e.Encode(w, m)
+}
+
+// An Encoder writes images using a configuration set up once. It keeps its
+// worker limit and IFD scratch space across calls, so it is cheaper than
+// Encode when writing many images. The zero value writes uncompressed
+// images. An Encoder is safe for concurrent use; its fields must not be
+// changed after the first call to Encode.
+type Encoder struct {
+	// Options determines the options used for encoding, as for Encode.
+	Options *tiff.Options
+	// DeflateLevel is the zlib level of Deflate compression, from
+	// zlib.BestSpeed (1) to zlib.BestCompression (9), or
+	// zlib.HuffmanOnly. Zero stands for zlib.DefaultCompression. Float
+	// rasters stored with the predictor often gain a few percent at the
+	// highest levels, for a slower encode.
+	DeflateLevel int
+	// Workers limits the number of goroutines serializing bands of large
+	// images, shared by all concurrent calls to Encode. If Workers is zero,
+	// GOMAXPROCS is used.
+	Workers int
+	// Pool, if not nil, bounds the bands being serialized instead of
+	// Workers, shared with the other users of the pool.
+	Pool *WorkerPool
+	// Metrics, if not nil, receives the number of bytes written.
+	Metrics Metrics
+	// VerifyRows, if positive, makes Encode read the file back once it is
+	// written and compare up to that many rows, spread evenly over the
+	// image, with the source. The file is read through w if it implements
+	// io.ReaderAt and io.Seeker, such as an *os.File opened for reading and
+	// writing; otherwise a copy of the output is kept in memory. A mismatch
+	// is reported as an InternalError.
+	VerifyRows int
+	// CheckXImage, like VerifyRows, makes Encode read the file back, here
+	// with golang.org/x/image/tiff, and compare every pixel with the
+	// source, so that the output is known to stay readable by that
+	// package. It applies to the 8- and 16-bit color images, *image.RGBA,
+	// *image.NRGBA, *image.RGBA64 and *image.NRGBA64, stored without
+	// compression or with Deflate or LZW, which both packages support;
+	// other images are written unchecked.
+	CheckXImage bool
+	// OmitResolution leaves out the XResolution, YResolution and
+	// ResolutionUnit fields, which are otherwise written with a placeholder
+	// of 72 dpi. Their absence is harmless to readers, whereas the bogus
+	// value can mislead GIS software that inspects it.
+	OmitResolution bool
+	// LERC, if not nil, compresses images with LERC in place of the
+	// compression of the options, without a predictor. Only images with a
+	// single sample per pixel can be compressed with LERC; NaN values of a
+	// *GrayFloat32 are stored as invalid pixels.
+	LERC *LERCOptions
+	// JPEG, if not nil, compresses images with JPEG in place of the
+	// compression of the options, as for Page.JPEG. It cannot be combined
+	// with LERC.
+	JPEG *jpeg.Options
+	// ZSTD, if not nil, compresses images with ZSTD in place of the
+	// compression of the options, keeping their predictor. It cannot be
+	// combined with LERC or JPEG.
+	ZSTD *ZSTDOptions
+	// TileWidth and TileHeight, if not zero, make images be stored in
+	// tiles of that size instead of in a single strip, as for Page, save
+	// for pages giving a tile size of their own. Both must be multiples
+	// of 16.
+	TileWidth, TileHeight int
+	// BlockAlign, if greater than 1, makes the data of every strip or tile
+	// start at a multiple of BlockAlign bytes in the file, padded with
+	// zeros before it, as readers using direct I/O need, which typically
+	// read 512 or 4096 bytes at a time. It must be a power of two.
+	BlockAlign int
+	// StrictLayout makes the encoder lay files out for strict or legacy
+	// readers: the IFD of an image written by Encode precedes its pixel
+	// data, as with EncodeAll, so that every offset in the file comes after
+	// the one pointing to it, and every strip or tile starts on a word
+	// boundary, as with a BlockAlign of 2. IFDs and the values of their
+	// entries are always on word boundaries, and strips and tiles always
+	// follow each other in the order of their offsets.
+	StrictLayout bool
+	// GhostArea makes the file carry the GDAL structural metadata after
+	// its header, as cloud optimized GeoTIFFs do, and every strip or tile
+	// be preceded by its size as a 4-byte leader and followed by a
+	// trailer repeating its last 4 bytes. Readers knowing of them can then
+	// fetch a block with a single range request, and tell whether the
+	// file was modified since; see Reader.StructuralMetadata.
+	GhostArea bool
+	// AutoTune makes the encoder choose the compression and predictor of
+	// each image in place of the options: a sample of rows spread over the
+	// image is stored with each candidate, no compression, Deflate, and
+	// Deflate with the horizontal predictor or, for floating point
+	// samples, with the floating point predictor, and the smallest result
+	// wins. It does not apply to images compressed with LERC, JPEG or
+	// ZSTD.
+	AutoTune bool
+	// BlockChecksums makes the encoder record the xxHash64 of the stored
+	// data of every strip or tile in the TagBlockChecksums field, so that
+	// the corruption of a file kept for a long time can be detected
+	// block by block; see ReaderOptions.VerifyChecksums. Uncompressed
+	// strips are then held in memory to be hashed before being written.
+	BlockChecksums bool
+	// Transform, if not nil, transforms the stored data of every strip or
+	// tile once compressed, such as to encrypt it; the file can then only
+	// be read with the same Transform in the ReaderOptions. Uncompressed
+	// strips are held in memory to be transformed before being written.
+	Transform BlockTransform
+	// BakeOrientation makes the encoder store the pixels of images whose
+	// Metadata gives an Orientation in the order they are to be shown, as
+	// if it were OrientationTopLeft, and leave out the field, for readers
+	// that ignore it. Images to be transposed are stored with their width
+	// and height swapped. Georeferencing and other fields are written as
+	// they are. Otherwise the Orientation is stored with the pixels as
+	// given.
+	BakeOrientation bool
+	// ExtraSamples, if not nil, declares what the bands of the images of
+	// StackBands past the first stand for, one ExtraSamples value each,
+	// such as alpha or ExtraSamplesUnspecified for a mask or another
+	// band, in place of ExtraSamplesUnspecified for all. Its length must
+	// be one less than the number of bands. Other images declare the
+	// alpha of their type.
+	ExtraSamples []uint16
+	// NoDataFill, if not FillNone, rewrites the samples of images of
+	// floating point samples holding no data, NaN or those equal to the
+	// NoData value of their Metadata, into the other, so that software
+	// that cannot handle NaN receives plain values, or software that only
+	// knows NaN finds it. The image passed is left unchanged.
+	NoDataFill NoDataFill
+
+	once    sync.Once
+	sem     chan struct{}
+	entries sync.Pool // of *[]ifdEntry
+}
+
+func (e *Encoder) init() {
+	if e.Pool != nil {
+		e.sem = e.Pool.sem
+		return
+	}
+	n := e.Workers
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	e.sem = make(chan struct{}, n)
+}
+
+// getEntries returns an empty IFD entry slice with room for the optional
+// entries; it is handed back with putEntries.
+func (e *Encoder) getEntries() *[]ifdEntry {
+	if p, ok := e.entries.Get().(*[]ifdEntry); ok {
+		return p
+	}
+	ifd := make([]ifdEntry, 0, 16)
+	return &ifd
+}
+
+func (e *Encoder) putEntries(p *[]ifdEntry) {
+	*p = (*p)[:0]
+	e.entries.Put(p)
+}
+
+// Encode writes the image m to w.
+func (e *Encoder) Encode(w io.Writer, m image.Image) error {
+	return e.encodeVerified(w, m, nil, nil)
+}
 
-	compression := uint32(cNone)
-	predictor := false
-	_, err := io.WriteString(w, "II\x2A\x00")
+// EncodeWithChecksum is like Encode, but also returns the CRC-32 (IEEE) of
+// the pixel data as stored in the file. The checksum is computed while the
+// data is written, without a second pass over the image.
+func (e *Encoder) EncodeWithChecksum(w io.Writer, m image.Image) (uint32, error) {
+	h := crc32.NewIEEE()
+	if err := e.encodeVerified(w, m, nil, h); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// A hashWriter feeds everything written to w into h as well.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
+
+// encode writes m and, if it is not nil, md to w. If h is not nil, the pixel
+// data is also written to h.
+func (e *Encoder) encode(w io.Writer, m image.Image, md *Metadata, h hash.Hash) error {
+	e.once.Do(e.init)
+	if e.Metrics != nil {
+		w = meteredWriter{w, e.Metrics}
+	}
+	p, err := e.preparePage(Page{Image: m, Metadata: md})
 	if err != nil {
 		return err
 	}
+	return e.writePage(w, p, h)
+}
 
-	// Compressed data is written into a buffer first, so that we
-	// know the compressed size.
-	//var buf bytes.Buffer
-	// dst holds the destination for the pixel data of the image --
-	// either w or a writer to buf.
-	var dst io.Writer
-	// imageLen is the length of the pixel data in bytes.
-	// The offset of the IFD is imageLen + 8 header bytes.
-	var imageLen int
+// writePage writes the prepared page p to w as a file of its own. If h is
+// not nil, the pixel data is also written to h.
+func (e *Encoder) writePage(w io.Writer, p *page, h hash.Hash) error {
+	var dst io.Writer = w
+	if h != nil {
+		dst = hashWriter{w, h}
+	}
+	if e.StrictLayout {
+		return e.encodeIFDFirst(w, dst, p)
+	}
 
-	switch compression {
-	case cNone:
-		dst = w
-		// Write IFD offset before outputting pixel data.
-		switch m.(type) {
-		case *Gray32:
-			imageLen = d.X * d.Y * 4
-		case *GrayFloat32:
-			imageLen = d.X * d.Y * 4
-		default:
-			imageLen = d.X * d.Y * 4
+	// The pixel data follows the header, and the IFD follows the data, on
+	// a word boundary.
+	var ghost []byte
+	if e.GhostArea {
+		ghost = ghostArea(false)
+	}
+	start := int64(8 + len(ghost))
+	dataEnd := p.setOffset(start, e.BlockAlign, e.GhostArea)
+	end := dataEnd + dataEnd%2
+	if end+8 > math.MaxUint32 {
+		return UnsupportedError{Feature: "image too large for a classic TIFF file"}
+	}
+	var header [8]byte
+	copy(header[:], leHeader)
+	enc.PutUint32(header[4:], uint32(end))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(ghost); err != nil {
+		return err
+	}
+	if err := e.writePix(dst, w, p, start); err != nil {
+		return err
+	}
+	if err := writePad(w, int(dataEnd)); err != nil {
+		return err
+	}
+
+	ep := e.getEntries()
+	defer e.putEntries(ep)
+	ifd := p.layout.appendEntries(*ep)
+	*ep = ifd
+	return writeIFD(w, int(end), ifd, 0)
+}
+
+// blockAlign returns the alignment of the strips and tiles written.
+func (e *Encoder) blockAlign() int {
+	if e.StrictLayout {
+		return max(e.BlockAlign, 2)
+	}
+	return e.BlockAlign
+}
+
+// encodeIFDFirst writes p to w as Encoder.StrictLayout asks: the IFD right
+// after the header, then the pixel data, written to dst, every strip or
+// tile starting on a word boundary.
+func (e *Encoder) encodeIFDFirst(w, dst io.Writer, p *page) error {
+	var ghost []byte
+	if e.GhostArea {
+		ghost = ghostArea(true)
+	}
+	off := int64(8 + len(ghost))
+	ep := e.getEntries()
+	defer e.putEntries(ep)
+	// The block offsets are filled in once the size of the IFD is known;
+	// the IFD entry shares the slice.
+	ifd := p.layout.appendEntries(*ep)
+	*ep = ifd
+	size := ifdSize(ifd)
+	dataOff := off + int64(size+size%2)
+	if end := p.setOffset(dataOff, e.blockAlign(), e.GhostArea); end > math.MaxUint32 {
+		return UnsupportedError{Feature: "image too large for a classic TIFF file"}
+	}
+	var header [8]byte
+	copy(header[:], leHeader)
+	enc.PutUint32(header[4:], uint32(off))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(ghost); err != nil {
+		return err
+	}
+	if err := writeIFD(w, int(off), ifd, 0); err != nil {
+		return err
+	}
+	if err := writePad(w, size); err != nil {
+		return err
+	}
+	return e.writePix(dst, w, p, dataOff)
+}
+
+// A page is an image prepared for writing: the layout of its IFD, less the
+// block offsets, and its pixel data. Compressed or tiled data is produced
+// up front in buf, so that its size is known; uncompressed strips are
+// serialized straight to the output by writePix.
+type page struct {
+	layout    imageLayout
+	imageLen  int           // Length of the pixel data in bytes.
+	buf       *bytes.Buffer // Compressed pixel data, or nil.
+	pix       []uint32      // Samples of a 32-bit image, or nil.
+	pix8      []byte        // Pixels of a color image, if pix is nil.
+	stride    int           // Of pix or pix8, in elements.
+	pixBytes  int           // Size of a pixel as stored.
+	sample16  bool          // Whether pix8 holds big-endian 16-bit samples.
+	sample32  bool          // Whether pix8 holds little-endian 32-bit samples.
+	predictor bool
+	lerc      *LERCOptions  // If the page is LERC compressed.
+	lercType  int           // Lerc2 data type of the samples.
+	jpeg      *jpeg.Options // If the page is JPEG compressed.
+	zstd      *zstdEncoder  // If the page is ZSTD compressed.
+	// deflateLevel is the zlib level of Deflate compression, 0 for the
+	// default.
+	deflateLevel int
+	// floatPredictor tells that the predictor is the floating point one
+	// rather than the horizontal one.
+	floatPredictor bool
+}
+
+// rewriteSource returns the image and metadata to store in place of m and
+// md, once their orientation is baked and their samples holding no data are
+// filled as the options of e ask. Doing so again changes nothing.
+func (e *Encoder) rewriteSource(m image.Image, md *Metadata) (image.Image, *Metadata, error) {
+	m, md, err := e.bakeOrientation(m, md)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.fillNoData(m, md)
+}
+
+// preparePage validates the image and metadata of pg, compresses its
+// pixels if the options ask for it and works out the layout of the image.
+// The options of pg, if set, take the place of those of e.
+func (e *Encoder) preparePage(pg Page) (*page, error) {
+	m, md := pg.Image, pg.Metadata
+	if m == nil {
+		return nil, errors.New("tiff: no image to encode")
+	}
+	m, md, err := e.rewriteSource(m, md)
+	if err != nil {
+		return nil, err
+	}
+	d := m.Bounds().Size()
+	if err := checkSize(d.X, d.Y); err != nil {
+		return nil, err
+	}
+	if a := e.BlockAlign; a < 0 || a&(a-1) != 0 {
+		return nil, fmt.Errorf("tiff: invalid block alignment %d: it must be a power of two", a)
+	}
+	jopt := pg.JPEG
+	if jopt == nil {
+		jopt = e.JPEG
+	}
+	if e.ZSTD != nil && (e.LERC != nil || jopt != nil) {
+		return nil, errors.New("tiff: ZSTD compression requested along with LERC or JPEG")
+	}
+	if jopt != nil {
+		if e.LERC != nil && pg.JPEG == nil {
+			return nil, errors.New("tiff: both JPEG and LERC compression requested")
 		}
-		err = binary.Write(w, binary.LittleEndian, uint32(imageLen+8))
-		if err != nil {
-			return err
+		var err error
+		if m, err = jpegSource(m); err != nil {
+			return nil, err
 		}
 	}
-
-	pr := uint32(prNone)
-	photometricInterpretation := uint32(pRGB)
-	samplesPerPixel := uint32(4)
-	bitsPerSample := []uint32{8, 8, 8, 8}
-	extraSamples := uint32(0)
-	colorMap := []uint32{}
-	SampleFormat := sampleFormat_UINT
-	if predictor {
-		pr = prHorizontal
+	p := &page{pixBytes: 4}
+	p.layout = imageLayout{
+		width:           d.X,
+		height:          d.Y,
+		bitsPerSample:   []uint32{32},
+		samplesPerPixel: 1,
+		photometric:     PhotometricBlackIsZero,
+		sampleFormat:    SampleFormatUint,
 	}
+	l := &p.layout
+	var quant *Quantization
+	var paletted *Gray32
 	switch m := m.(type) {
+	case *image.Gray:
+		if jopt == nil {
+			return nil, UnsupportedError{Feature: fmt.Sprintf("encoding a %T", m)}
+		}
+		p.pix8, p.stride, p.pixBytes = m.Pix, m.Stride, 1
 	case *Gray32:
-		photometricInterpretation = 1
-		samplesPerPixel = 1
-		bitsPerSample = []uint32{32}
-		err = encodeGray32(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		if m.Palette != nil {
+			paletted, p.pixBytes = m, 2
+			break
+		}
+		p.pix, p.stride = m.Pix, m.Stride
 	case *GrayFloat32:
-		photometricInterpretation = 1
-		samplesPerPixel = 1
-		bitsPerSample = []uint32{32}
-		SampleFormat = sampleFormat_IEEEFP
-		err = encodeGrayFloat32(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		if md != nil && md.Quantization != nil {
+			// The samples are laid out by quantize once the size of the
+			// image is known to be valid.
+			quant = md.Quantization
+			if err := quant.check(); err != nil {
+				return nil, err
+			}
+			p.pixBytes = quant.Bits / 8
+			break
+		}
+		p.pix, p.stride = m.Pix, m.Stride
+		l.sampleFormat = SampleFormatIEEEFP
+	case *image.RGBA:
+		// The alpha declared is that of the image type, so that the colors
+		// are written as they are.
+		p.pix8, p.stride = m.Pix, m.Stride
+		l.extraSamples = []uint32{ExtraSamplesAssociatedAlpha}
+	case *image.NRGBA:
+		p.pix8, p.stride = m.Pix, m.Stride
+		l.extraSamples = []uint32{ExtraSamplesUnassociatedAlpha}
+	case *image.RGBA64:
+		p.pix8, p.stride = m.Pix, m.Stride
+		l.extraSamples = []uint32{ExtraSamplesAssociatedAlpha}
+		p.pixBytes, p.sample16 = 8, true
+	case *image.NRGBA64:
+		p.pix8, p.stride = m.Pix, m.Stride
+		l.extraSamples = []uint32{ExtraSamplesUnassociatedAlpha}
+		p.pixBytes, p.sample16 = 8, true
+	case *bandStack:
+		p.pix8, p.stride = m.pix, m.stride
+		p.pixBytes, p.sample32 = 4*m.bands, true
+		l.bitsPerSample = make([]uint32, m.bands)
+		for i := range l.bitsPerSample {
+			l.bitsPerSample[i] = 32
+		}
+		l.samplesPerPixel = uint32(m.bands)
+		l.sampleFormat = SampleFormatIEEEFP
+		l.extraSamples = make([]uint32, m.bands-1)
+		if es := e.ExtraSamples; es != nil {
+			if len(es) != m.bands-1 {
+				return nil, fmt.Errorf("tiff: %d extra samples declared for %d bands", len(es), m.bands)
+			}
+			for i, v := range es {
+				if v > ExtraSamplesUnassociatedAlpha {
+					return nil, UnsupportedError{"ExtraSamples", TagExtraSamples, uint(v)}
+				}
+				l.extraSamples[i] = uint32(v)
+			}
+		}
 	default:
-		extraSamples = 1 // Associated alpha.
-		//	err = encode(dst, m, predictor)
+		return nil, UnsupportedError{Feature: fmt.Sprintf("encoding a %T", m)}
+	}
+	imageLen, err := classicImageLen(d.X, d.Y, p.pixBytes)
+	if err != nil {
+		return nil, err
+	}
+	p.imageLen = imageLen
+	switch {
+	case jopt != nil:
+		p.setJPEGLayout()
+		if err := checkPix(len(p.pix8), p.stride, d.X*p.pixBytes, d.Y); err != nil {
+			return nil, err
+		}
+	case quant != nil:
+		nan, written, err := p.quantize(m.(*GrayFloat32), quant, md.NoData)
+		if err != nil {
+			return nil, err
+		}
+		if written && md.NoData == nil {
+			l.extra = append(l.extra, noDataEntry(float64(nan)))
+		}
+	case paletted != nil:
+		if err := p.setPalette(paletted); err != nil {
+			return nil, err
+		}
+	case p.sample32:
+		if err := checkPix(len(p.pix8), p.stride, d.X*p.pixBytes, d.Y); err != nil {
+			return nil, err
+		}
+	case p.pix8 != nil:
+		bps := uint32(2 * p.pixBytes)
+		l.bitsPerSample = []uint32{bps, bps, bps, bps}
+		l.samplesPerPixel = 4
+		l.photometric = PhotometricRGB
+		if err := checkPix(len(p.pix8), p.stride, d.X*p.pixBytes, d.Y); err != nil {
+			return nil, err
+		}
+	default:
+		if err := checkPix(len(p.pix), p.stride, d.X, d.Y); err != nil {
+			return nil, err
+		}
+	}
+
+	if pg.Photometric != nil {
+		pi := *pg.Photometric
+		gray := pi == PhotometricWhiteIsZero || pi == PhotometricBlackIsZero || pi == PhotometricTransMask
+		if jopt != nil || !(l.samplesPerPixel == 1 && gray && l.colorMap == nil || l.photometric == PhotometricRGB && pi == PhotometricRGB) {
+			return nil, UnsupportedError{fmt.Sprintf("PhotometricInterpretation of a %T", m), TagPhotometricInterpretation, uint(pi)}
+		}
+		l.photometric = uint32(pi)
 	}
+
+	opt := pg.Options
+	if opt == nil {
+		opt = e.Options
+	}
+	compression, predictor, err := encodingOptions(opt)
 	if err != nil {
+		return nil, err
+	}
+	if l := e.DeflateLevel; l < zlib.HuffmanOnly || l > zlib.BestCompression {
+		return nil, fmt.Errorf("tiff: invalid Deflate level %d", l)
+	}
+	p.deflateLevel = e.DeflateLevel
+	switch {
+	case jopt != nil:
+		compression, predictor, p.jpeg = CompressionJPEG, false, jopt
+	case e.ZSTD != nil:
+		if err := e.ZSTD.check(); err != nil {
+			return nil, err
+		}
+		compression, predictor = CompressionZSTD, opt != nil && opt.Predictor
+	case e.AutoTune && e.LERC == nil && !pg.tuned:
+		var pr uint32
+		compression, pr = p.autoTune()
+		predictor, p.floatPredictor = pr != PredictorNone, pr == PredictorFloatingPoint
+	case pg.tuned:
+		p.floatPredictor = pg.floatPredictor && predictor
+	case e.LERC != nil:
+		if v := e.LERC.MaxError; v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("tiff: invalid LERC maximum error %g", v)
+		}
+		if p.lercType, err = l.lercType(); err != nil {
+			return nil, err
+		}
+		compression, predictor, p.lerc = CompressionLERC, false, e.LERC
+		inner := uint32(lercCompressionNone)
+		if e.LERC.Deflate {
+			inner = lercCompressionDeflate
+		}
+		l.extra = append(l.extra, ifdEntry{TagLercParameters, TypeLong, []uint32{lercAPIVersion, inner}})
+	}
+	p.predictor = predictor
+	tw, th := pg.TileWidth, pg.TileHeight
+	if tw == 0 && th == 0 {
+		tw, th = e.TileWidth, e.TileHeight
+	}
+	if tw != 0 || th != 0 {
+		if err := checkTileSize(tw, th); err != nil {
+			return nil, err
+		}
+	}
+	var extra []ifdEntry
+	if md != nil {
+		if extra, err = md.appendEntries(nil); err != nil {
+			return nil, err
+		}
+	}
+	if compression == CompressionZSTD {
+		var dict []byte
+		if n := e.ZSTD.DictionarySize; n > 0 && tw > 0 {
+			dict = p.zstdDictionary(n, tw, th)
+			l.extra = append(l.extra, ifdEntry{TagZSTDDictionary, TypeUndefined, tagData(TypeUndefined, dict)})
+		}
+		p.zstd = newZSTDEncoder(e.ZSTD, dict)
+	}
+
+	// Compressed data is written into a buffer first, so that we
+	// know the compressed size.
+	counts := []uint32{uint32(p.imageLen)}
+	if tw > 0 {
+		if counts, err = p.encodeTiles(compression, d.X, d.Y, tw, th); err != nil {
+			return nil, err
+		}
+	} else if compression == CompressionDeflate || compression == CompressionLZW {
+		p.buf = new(bytes.Buffer)
+		zw := newStreamCompressor(compression, p.buf, p.deflateLevel)
+		if err := p.writeRows(zw, e.sem); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		p.imageLen = p.buf.Len()
+		counts[0] = uint32(p.imageLen)
+	} else if compression == CompressionLERC || compression == CompressionJPEG || compression == CompressionZSTD {
+		block := make([]byte, p.imageLen)
+		p.packRows(block, 0, d.X, 0, d.Y)
+		encode := p.blockEncoder(compression)
+		blob, err := encode(block, d.X, d.Y)
+		if err != nil {
+			return nil, err
+		}
+		p.buf = bytes.NewBuffer(blob)
+		p.imageLen = p.buf.Len()
+		counts[0] = uint32(p.imageLen)
+	}
+	if uint64(p.imageLen)+8 > math.MaxUint32 {
+		return nil, UnsupportedError{Feature: "image too large for a classic TIFF file"}
+	}
+	if (e.BlockChecksums || e.Transform != nil) && p.buf == nil {
+		p.buf = bytes.NewBuffer(make([]byte, 0, p.imageLen))
+		if err := p.writeRows(p.buf, e.sem); err != nil {
+			return nil, err
+		}
+	}
+	if e.Transform != nil {
+		if p.buf, err = sealBlocks(e.Transform, p.buf.Bytes(), counts); err != nil {
+			return nil, err
+		}
+		p.imageLen = p.buf.Len()
+		if uint64(p.imageLen)+8 > math.MaxUint32 {
+			return nil, UnsupportedError{Feature: "image too large for a classic TIFF file"}
+		}
+	}
+	if e.BlockChecksums {
+		l.extra = append(l.extra, blockChecksumsEntry(p.buf.Bytes(), counts))
+	}
+
+	l.compression, l.predictor = compression, predictorValue(predictor)
+	if p.floatPredictor {
+		l.predictor = PredictorFloatingPoint
+	}
+	l.noResolution = e.OmitResolution
+	l.extra = append(extra, l.extra...)
+	l.rowsPerStrip = d.Y
+	l.tileWidth, l.tileHeight = tw, th
+	l.blockOffsets, l.blockByteCounts = make([]uint32, len(counts)), counts
+	if md != nil {
+		p.layout.noResolution = e.OmitResolution || md.Resolution == nil
+		p.layout.resolution = md.Resolution
+	}
+	return p, nil
+}
+
+// Parameters of the sample of rows compressed by autoTune.
+const (
+	tuneBands    = 8  // Bands of rows sampled.
+	tuneBandRows = 16 // Rows per band.
+)
+
+// autoTune returns the compression and Predictor value storing the pixels
+// of p in the fewest bytes, judging by a sample of its rows, as for
+// Encoder.AutoTune.
+func (p *page) autoTune() (compression, predictor uint32) {
+	dx, dy := p.layout.width, p.layout.height
+	rowBytes := dx * p.pixBytes
+	bands := min(tuneBands, (dy+tuneBandRows-1)/tuneBandRows)
+	bp := getBuffer(rowBytes * tuneBandRows)
+	defer putBuffer(bp)
+	buf := *bp
+	zw := newStreamCompressor(CompressionDeflate, io.Discard, p.deflateLevel)
+	deflated := func(pred uint32) int64 {
+		p.predictor, p.floatPredictor = pred != PredictorNone, pred == PredictorFloatingPoint
+		var n countingWriter
+		for b := 0; b < bands; b++ {
+			// The bands are spread evenly, the last ending the image.
+			y0 := b * (dy - tuneBandRows) / max(bands-1, 1)
+			y1 := min(y0+tuneBandRows, dy)
+			p.packRows(buf, 0, dx, y0, y1)
+			// Writing to a countingWriter cannot fail.
+			zw.Reset(&n)
+			zw.Write(buf[:(y1-y0)*rowBytes])
+			zw.Close()
+		}
+		return int64(n)
+	}
+	raw := int64(bands) * int64(min(tuneBandRows, dy)) * int64(rowBytes)
+	best, size := uint32(PredictorNone), deflated(PredictorNone)
+	candidates := []uint32{PredictorHorizontal}
+	if p.layout.sampleFormat == SampleFormatIEEEFP {
+		candidates = append(candidates, PredictorFloatingPoint)
+	}
+	for _, pr := range candidates {
+		if n := deflated(pr); n < size {
+			best, size = pr, n
+		}
+	}
+	p.predictor, p.floatPredictor = false, false
+	if size < raw {
+		return CompressionDeflate, best
+	}
+	return CompressionNone, PredictorNone
+}
+
+// A countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (n *countingWriter) Write(p []byte) (int, error) {
+	*n += countingWriter(len(p))
+	return len(p), nil
+}
+
+// encodeTiles serializes the dx×dy pixels of p into p.buf as tw×th tiles,
+// in row-major order, compressing each one separately if asked to. The
+// parts of edge tiles beyond the image are zero. It returns the size of
+// each tile.
+func (p *page) encodeTiles(compression uint32, dx, dy, tw, th int) ([]uint32, error) {
+	across, down := (dx+tw-1)/tw, (dy+th-1)/th
+	tileBytes := tw * th * p.pixBytes
+	if compression == CompressionNone && uint64(across)*uint64(down)*uint64(tileBytes)+8 > math.MaxUint32 {
+		return nil, UnsupportedError{Feature: "image too large for a classic TIFF file"}
+	}
+	bp := getBuffer(tileBytes)
+	defer putBuffer(bp)
+	tile := *bp
+	var tmp []byte
+	if p.floatPredictor {
+		tmp = make([]byte, tw*p.pixBytes)
+	}
+	p.buf = new(bytes.Buffer)
+	var zw streamCompressor
+	counts := make([]uint32, 0, across*down)
+	for ty := 0; ty < dy; ty += th {
+		for tx := 0; tx < dx; tx += tw {
+			w, h := tw, th
+			if tx+w > dx {
+				w = dx - tx
+			}
+			if ty+h > dy {
+				h = dy - ty
+			}
+			if w < tw || h < th {
+				for i := range tile {
+					tile[i] = 0
+				}
+			}
+			for y := 0; y < h; y++ {
+				p.packSamples(tile[y*tw*p.pixBytes:], tx, w, ty+y, ty+y+1, p.predictor && !p.floatPredictor)
+			}
+			if p.floatPredictor {
+				// The predictor spans the whole rows of the tile.
+				predictFloatRows(tile, tmp, tw*p.pixBytes, 4, p.pixBytes/4)
+			}
+
+			start := p.buf.Len()
+			switch compression {
+			case CompressionDeflate, CompressionLZW:
+				if zw == nil {
+					zw = newStreamCompressor(compression, p.buf, p.deflateLevel)
+				} else {
+					zw.Reset(p.buf)
+				}
+				if _, err := zw.Write(tile); err != nil {
+					return nil, err
+				}
+				if err := zw.Close(); err != nil {
+					return nil, err
+				}
+			case CompressionLERC, CompressionJPEG, CompressionZSTD:
+				blob, err := p.blockEncoder(compression)(tile, tw, th)
+				if err != nil {
+					return nil, err
+				}
+				p.buf.Write(blob)
+			default:
+				p.buf.Write(tile)
+			}
+			if uint64(p.buf.Len())+8 > math.MaxUint32 {
+				return nil, UnsupportedError{Feature: "image too large for a classic TIFF file"}
+			}
+			counts = append(counts, uint32(p.buf.Len()-start))
+		}
+	}
+	p.imageLen = p.buf.Len()
+	return counts, nil
+}
+
+// blockEncoder returns the function compressing a block of cols×rows
+// pixels of p, laid out as if uncompressed, with LERC, JPEG or ZSTD.
+func (p *page) blockEncoder(compression uint32) func(block []byte, cols, rows int) ([]byte, error) {
+	switch compression {
+	case CompressionJPEG:
+		return p.encodeJPEG
+	case CompressionZSTD:
+		return p.encodeZSTD
+	}
+	return p.encodeLERC
+}
+
+// setOffset places the pixel data of p at off in the file, filling in the
+// offsets of its strips or tiles, which follow each other, each moved up
+// to a multiple of align bytes if align is greater than 1 and surrounded
+// by a 4-byte leader and trailer if leaders is set. It returns the offset
+// of the end of the data.
+func (p *page) setOffset(off int64, align int, leaders bool) int64 {
+	extra := int64(0)
+	if leaders {
+		extra = 4
+	}
+	for i, n := range p.layout.blockByteCounts {
+		off += extra
+		if align > 1 {
+			off = (off + int64(align) - 1) &^ int64(align-1)
+		}
+		p.layout.blockOffsets[i] = uint32(off)
+		off += int64(n) + extra
+	}
+	return off
+}
+
+// checkTileSize reports an error unless tw×th is a valid tile size: the
+// spec requires both to be multiples of 16 (p. 67).
+func checkTileSize(tw, th int) error {
+	if tw <= 0 || th <= 0 || tw%16 != 0 || th%16 != 0 {
+		return fmt.Errorf("tiff: invalid tile size %dx%d: width and height must be positive multiples of 16", tw, th)
+	}
+	if uint64(tw)*uint64(th) > math.MaxInt32/4 {
+		return UnsupportedError{Feature: fmt.Sprintf("tile size %dx%d", tw, th)}
+	}
+	return nil
+}
+
+// writePix writes the pixel data of p to w, which is at offset off in the
+// file, as placed by setOffset. The zeros padding the blocks and their
+// leaders and trailers are written to pad, which is w but for the checksum
+// of EncodeWithChecksum.
+func (e *Encoder) writePix(w, pad io.Writer, p *page, off int64) error {
+	// before writes what precedes block i, once off is at its start.
+	before := func(i int) error {
+		start := int64(p.layout.blockOffsets[i])
+		if !e.GhostArea {
+			return writeZeros(pad, start-off)
+		}
+		if err := writeZeros(pad, start-4-off); err != nil {
+			return err
+		}
+		var leader [4]byte
+		enc.PutUint32(leader[:], p.layout.blockByteCounts[i])
+		_, err := pad.Write(leader[:])
 		return err
 	}
+	after := func(tail []byte) error {
+		if !e.GhostArea {
+			return nil
+		}
+		_, err := pad.Write(blockTrailer(tail))
+		return err
+	}
+	if p.buf == nil {
+		if err := before(0); err != nil {
+			return err
+		}
+		tw := &tailWriter{w: w}
+		if err := p.writeRows(tw, e.sem); err != nil {
+			return err
+		}
+		return after(tw.tail[:min(tw.n, 4)])
+	}
+	data := p.buf.Bytes()
+	for i, n := range p.layout.blockByteCounts {
+		if err := before(i); err != nil {
+			return err
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		if err := after(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		off = int64(p.layout.blockOffsets[i]) + int64(n)
+		if e.GhostArea {
+			off += 4
+		}
+	}
+	return nil
+}
 
-	ifd := []ifdEntry{
-		{tImageWidth, dtShort, []uint32{uint32(d.X)}},
-		{tImageLength, dtShort, []uint32{uint32(d.Y)}},
-		{tBitsPerSample, dtShort, bitsPerSample},
-		{tCompression, dtShort, []uint32{compression}},
-		{tPhotometricInterpretation, dtShort, []uint32{photometricInterpretation}},
-		{tStripOffsets, dtLong, []uint32{8}},
-		{tSamplesPerPixel, dtShort, []uint32{samplesPerPixel}},
-		{tRowsPerStrip, dtShort, []uint32{uint32(d.Y)}},
-		{tStripByteCounts, dtLong, []uint32{uint32(imageLen)}},
-		{tSampleFormat, dtShort, []uint32{uint32(SampleFormat)}},
-		// There is currently no support for storing the image
-		// resolution, so give a bogus value of 72x72 dpi.
-		{tXResolution, dtRational, []uint32{72, 1}},
-		{tYResolution, dtRational, []uint32{72, 1}},
-		{tResolutionUnit, dtShort, []uint32{2}},
+// A tailWriter writes to w, keeping the last 4 bytes written.
+type tailWriter struct {
+	w    io.Writer
+	tail [4]byte
+	n    int // Bytes written.
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n >= 4 {
+		copy(t.tail[:], p[n-4:n])
+	} else {
+		copy(t.tail[:], t.tail[n:])
+		copy(t.tail[4-n:], p[:n])
 	}
-	if pr != prNone {
-		ifd = append(ifd, ifdEntry{tPredictor, dtShort, []uint32{pr}})
+	t.n += n
+	return n, err
+}
+
+// writeZeros writes n zero bytes to w.
+func writeZeros(w io.Writer, n int64) error {
+	var zeros [512]byte
+	for n > 0 {
+		k := min(n, int64(len(zeros)))
+		if _, err := w.Write(zeros[:k]); err != nil {
+			return err
+		}
+		n -= k
 	}
-	if len(colorMap) != 0 {
-		ifd = append(ifd, ifdEntry{tColorMap, dtShort, colorMap})
+	return nil
+}
+
+// writeRows serializes the pixels of p to w, row after row.
+func (p *page) writeRows(w io.Writer, sem chan struct{}) error {
+	dx, dy := p.layout.width, p.layout.height
+	if p.pix != nil && !p.floatPredictor {
+		return encodeGray32(w, sem, p.pix, dx, dy, p.stride, p.predictor)
+	}
+	rowBytes := dx * p.pixBytes
+	if !p.predictor && !p.sample16 {
+		for y := 0; y < dy; y++ {
+			if _, err := w.Write(p.pix8[y*p.stride : y*p.stride+rowBytes]); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	if extraSamples > 0 {
-		ifd = append(ifd, ifdEntry{tExtraSamples, dtShort, []uint32{extraSamples}})
+	bp := getBuffer(rowBytes)
+	defer putBuffer(bp)
+	buf := *bp
+	for y := 0; y < dy; y++ {
+		p.packRows(buf, 0, dx, y, y+1)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return writeIFD(w, imageLen+8, ifd)
+// packRows serializes n pixels from column x0 of each of the rows [y0, y1)
+// of p into dst, applying the predictor if p uses one.
+func (p *page) packRows(dst []byte, x0, n, y0, y1 int) {
+	if !p.floatPredictor {
+		p.packSamples(dst, x0, n, y0, y1, p.predictor)
+		return
+	}
+	// The samples, all 32-bit floating point ones, are laid out as they
+	// are and then predicted.
+	rowBytes := n * p.pixBytes
+	bp := getBuffer(rowBytes)
+	defer putBuffer(bp)
+	p.packSamples(dst, x0, n, y0, y1, false)
+	predictFloatRows(dst[:(y1-y0)*rowBytes], *bp, rowBytes, 4, p.pixBytes/4)
+}
+
+// packSamples is like packRows, applying the horizontal predictor if
+// predictor is set.
+func (p *page) packSamples(dst []byte, x0, n, y0, y1 int, predictor bool) {
+	if p.pix != nil {
+		packGray32Rows(dst, p.pix[x0:], n, p.stride, y0, y1, predictor)
+		return
+	}
+	rowBytes := n * p.pixBytes
+	for y := y0; y < y1; y++ {
+		i := y*p.stride + x0*p.pixBytes
+		row := dst[(y-y0)*rowBytes : (y-y0+1)*rowBytes]
+		if p.sample16 {
+			// The standard library holds the samples big-endian, and we
+			// only write little-endian TIFF files.
+			src := p.pix8[i : i+rowBytes]
+			for j := 0; j < len(row); j += 2 {
+				row[j], row[j+1] = src[j+1], src[j]
+			}
+			if predictor {
+				for j := len(row) - 2; j >= p.pixBytes; j -= 2 {
+					enc.PutUint16(row[j:], enc.Uint16(row[j:])-enc.Uint16(row[j-p.pixBytes:]))
+				}
+			}
+			continue
+		}
+		copy(row, p.pix8[i:i+rowBytes])
+		if predictor && p.sample32 {
+			for j := len(row) - 4; j >= p.pixBytes; j -= 4 {
+				enc.PutUint32(row[j:], enc.Uint32(row[j:])-enc.Uint32(row[j-p.pixBytes:]))
+			}
+			continue
+		}
+		if predictor {
+			// Each sample is replaced by its difference from the same
+			// sample of the pixel to its left.
+			spp := p.pixBytes
+			for j := len(row) - 1; j >= spp; j-- {
+				row[j] -= row[j-spp]
+			}
+		}
+	}
+}
+
+// encodingOptions translates opt, as given to Encode, into the Compression
+// value and predictor to write. Compression types the encoder cannot
+// produce are reported instead of being silently ignored. As for
+// x/image/tiff, the predictor is only used with compression.
+func encodingOptions(opt *tiff.Options) (compression uint32, predictor bool, err error) {
+	if opt == nil {
+		return CompressionNone, false, nil
+	}
+	switch opt.Compression {
+	case tiff.Uncompressed:
+		compression = CompressionNone
+	case tiff.Deflate:
+		compression = CompressionDeflate
+	case tiff.LZW:
+		compression = CompressionLZW
+	default:
+		var c uint
+		switch opt.Compression {
+		case tiff.CCITTGroup3:
+			c = CompressionCCITTGroup3
+		case tiff.CCITTGroup4:
+			c = CompressionCCITTGroup4
+		}
+		return 0, false, UnsupportedError{Feature: "encoding with compression " + compressionString(c)}
+	}
+	return compression, opt.Predictor && compression != CompressionNone, nil
+}
+
+// predictorValue returns the Predictor value storing samples with the
+// horizontal predictor if predictor is set, and without one otherwise.
+func predictorValue(predictor bool) uint32 {
+	if predictor {
+		return PredictorHorizontal
+	}
+	return PredictorNone
+}
+
+// shortOrLong returns the narrowest of the Short and Long types able to
+// hold v, as allowed for the dimension fields.
+func shortOrLong(v int) int {
+	if v > math.MaxUint16 {
+		return TypeLong
+	}
+	return TypeShort
+}
+
+// An imageLayout holds the values describing how an image is stored, from
+// which its IFD entries are built.
+type imageLayout struct {
+	width, height   int
+	bitsPerSample   []uint32
+	samplesPerPixel uint32
+	photometric     uint32
+	compression     uint32
+	predictor       uint32
+	sampleFormat    uint32
+	extraSamples    []uint32 // A value per sample past the color ones.
+	colorMap        []uint32
+	noResolution    bool
+	resolution      *Resolution
+	extra           []ifdEntry // Further entries, such as metadata.
+	subfile         bool       // Whether to write subfileType.
+	subfileType     SubfileType
+	rowsPerStrip    int
+	// If tileWidth is positive, the image is stored in tiles of
+	// tileWidth×tileHeight rather than in strips of rowsPerStrip rows.
+	tileWidth, tileHeight int
+	blockOffsets          []uint32 // Of the strips or tiles.
+	blockByteCounts       []uint32
+}
+
+// appendEntries appends the IFD entries describing l to ifd.
+func (l *imageLayout) appendEntries(ifd []ifdEntry) []ifdEntry {
+	ifd = append(ifd, []ifdEntry{
+		{TagImageWidth, shortOrLong(l.width), []uint32{uint32(l.width)}},
+		{TagImageLength, shortOrLong(l.height), []uint32{uint32(l.height)}},
+		{TagBitsPerSample, TypeShort, l.bitsPerSample},
+		{TagCompression, TypeShort, []uint32{l.compression}},
+		{TagPhotometricInterpretation, TypeShort, []uint32{l.photometric}},
+		{TagSamplesPerPixel, TypeShort, []uint32{l.samplesPerPixel}},
+		{TagSampleFormat, TypeShort, []uint32{l.sampleFormat}},
+	}...)
+	if l.tileWidth > 0 {
+		ifd = append(ifd, []ifdEntry{
+			{TagTileWidth, shortOrLong(l.tileWidth), []uint32{uint32(l.tileWidth)}},
+			{TagTileLength, shortOrLong(l.tileHeight), []uint32{uint32(l.tileHeight)}},
+			{TagTileOffsets, TypeLong, l.blockOffsets},
+			{TagTileByteCounts, TypeLong, l.blockByteCounts},
+		}...)
+	} else {
+		ifd = append(ifd, []ifdEntry{
+			{TagStripOffsets, TypeLong, l.blockOffsets},
+			{TagRowsPerStrip, shortOrLong(l.rowsPerStrip), []uint32{uint32(l.rowsPerStrip)}},
+			{TagStripByteCounts, TypeLong, l.blockByteCounts},
+		}...)
+	}
+	switch r := l.resolution; {
+	case l.noResolution:
+	case r != nil:
+		ifd = append(ifd, []ifdEntry{
+			rationalEntry(TagXResolution, r.X),
+			rationalEntry(TagYResolution, r.Y),
+			{TagResolutionUnit, TypeShort, []uint32{uint32(r.Unit)}},
+		}...)
+	default:
+		// Without a resolution to store, give a bogus value of 72x72
+		// dpi.
+		ifd = append(ifd, []ifdEntry{
+			rationalEntry(TagXResolution, [2]uint32{72, 1}),
+			rationalEntry(TagYResolution, [2]uint32{72, 1}),
+			{TagResolutionUnit, TypeShort, []uint32{2}},
+		}...)
+	}
+	if l.subfile {
+		ifd = append(ifd, ifdEntry{TagNewSubfileType, TypeLong, []uint32{uint32(l.subfileType)}})
+	}
+	if l.predictor != PredictorNone {
+		ifd = append(ifd, ifdEntry{TagPredictor, TypeShort, []uint32{l.predictor}})
+	}
+	if len(l.colorMap) != 0 {
+		ifd = append(ifd, ifdEntry{TagColorMap, TypeShort, l.colorMap})
+	}
+	if len(l.extraSamples) > 0 {
+		ifd = append(ifd, ifdEntry{TagExtraSamples, TypeShort, l.extraSamples})
+	}
+	return append(ifd, l.extra...)
 }
 
 type byTag []ifdEntry
@@ -183,95 +1154,202 @@ func (d byTag) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
 
 var enc = binary.LittleEndian
 
+// pairedType reports whether each value of the data type is held in two
+// elements of ifdEntry.data: the numerator and denominator of a rational,
+// or the low and high halves of a double or a 64-bit integer.
+func pairedType(datatype int) bool {
+	return lengths[datatype] == 8
+}
+
 func (e ifdEntry) putData(p []byte) {
 	for _, d := range e.data {
 		switch e.datatype {
-		case dtByte, dtASCII:
+		case TypeByte, TypeASCII, TypeSByte, TypeUndefined:
 			p[0] = byte(d)
 			p = p[1:]
-		case dtShort:
+		case TypeShort, TypeSShort:
 			enc.PutUint16(p, uint16(d))
 			p = p[2:]
-		case dtLong, dtRational:
+		default:
 			enc.PutUint32(p, uint32(d))
 			p = p[4:]
 		}
 	}
 }
 
-func writeIFD(w io.Writer, ifdOffset int, d []ifdEntry) error {
-	var buf [ifdLen]byte
-	// Make space for "pointer area" containing IFD entry data
-	// longer than 4 bytes.
-	parea := make([]byte, 1024)
-	pstart := ifdOffset + ifdLen*len(d) + 6
-	var o int // Current offset in parea.
+// dataLen returns the length of the entry's data in bytes.
+func (e ifdEntry) dataLen() int {
+	count := len(e.data)
+	if pairedType(e.datatype) {
+		count /= 2
+	}
+	return count * int(lengths[e.datatype])
+}
 
-	// The IFD has to be written with the tags in ascending order.
-	sort.Sort(byTag(d))
+// ifdSize returns the number of bytes taken by an IFD holding d, including
+// its pointer area, in which the data of every entry starts on a word
+// boundary.
+func ifdSize(d []ifdEntry) int {
+	size := 2 + ifdLen*len(d) + 4
+	for _, ent := range d {
+		if n := ent.dataLen(); n > 4 {
+			size += n + n%2
+		}
+	}
+	return size
+}
 
-	// Write the number of entries in this IFD.
-	if err := binary.Write(w, enc, uint16(len(d))); err != nil {
-		return err
+// bigIFDSize returns the number of bytes taken by an IFD of BigTIFF holding
+// d, as ifdSize does for classic TIFF.
+func bigIFDSize(d []ifdEntry) int {
+	size := 8 + bigIFDLen*len(d) + 8
+	for _, ent := range d {
+		if n := ent.dataLen(); n > 8 {
+			size += n + n%2
+		}
 	}
+	return size
+}
+
+// checkEntries reports whether the entries of d can be written: their data
+// types are known, and of classic TIFF unless big is set, RATIONAL,
+// SRATIONAL and DOUBLE values come in whole pairs of halves and ASCII
+// strings are NUL-terminated.
+func checkEntries(d []ifdEntry, big bool) error {
 	for _, ent := range d {
-		enc.PutUint16(buf[0:2], uint16(ent.tag))
-		enc.PutUint16(buf[2:4], uint16(ent.datatype))
+		switch {
+		case !knownType(ent.datatype):
+			return UnsupportedError{"IFD entry datatype", ent.tag, uint(ent.datatype)}
+		case ent.datatype >= TypeLong8 && !big:
+			return UnsupportedError{"BigTIFF data type in a classic TIFF file", ent.tag, uint(ent.datatype)}
+		case pairedType(ent.datatype) && len(ent.data)%2 != 0:
+			return InternalError(fmt.Sprintf("tag %d of type %d holds a half value", ent.tag, ent.datatype))
+		case ent.datatype == TypeASCII && (len(ent.data) == 0 || ent.data[len(ent.data)-1] != 0):
+			return InternalError(fmt.Sprintf("ASCII tag %d is not NUL-terminated", ent.tag))
+		case uint64(len(ent.data)) > math.MaxUint32:
+			return UnsupportedError{Feature: fmt.Sprintf("tag %d of %d values", ent.tag, len(ent.data))}
+		}
+	}
+	return nil
+}
+
+// writeIFD writes an IFD holding d, which is to start at ifdOffset in the
+// file, followed by its pointer area. next is the offset of the following
+// IFD, or zero if this is the last one.
+func writeIFD(w io.Writer, ifdOffset int, d []ifdEntry, next int) error {
+	if err := checkEntries(d, false); err != nil {
+		return err
+	}
+	// The IFD has to be written with the tags in ascending order.
+	if !sort.IsSorted(byTag(d)) {
+		sort.Sort(byTag(d))
+	}
+
+	// The entries are followed by the offset of the next IFD and the
+	// "pointer area" containing IFD entry data longer than 4 bytes. Its
+	// size is known up front, so the IFD is laid out in a single buffer.
+	pstart := 2 + ifdLen*len(d) + 4
+	size := ifdSize(d)
+	bp := getBuffer(size)
+	defer putBuffer(bp)
+	buf := *bp
+
+	// Write the number of entries in this IFD.
+	enc.PutUint16(buf[0:2], uint16(len(d)))
+	o := pstart // Current offset in buf.
+	for i, ent := range d {
+		p := buf[2+ifdLen*i : 2+ifdLen*(i+1)]
+		enc.PutUint16(p[0:2], uint16(ent.tag))
+		enc.PutUint16(p[2:4], uint16(ent.datatype))
 		count := uint32(len(ent.data))
-		if ent.datatype == dtRational {
+		if pairedType(ent.datatype) {
 			count /= 2
 		}
-		enc.PutUint32(buf[4:8], count)
-		datalen := int(count * lengths[ent.datatype])
+		enc.PutUint32(p[4:8], count)
+		datalen := ent.dataLen()
 		if datalen <= 4 {
-			ent.putData(buf[8:12])
+			enc.PutUint32(p[8:12], 0)
+			ent.putData(p[8:12])
 		} else {
-			if (o + datalen) > len(parea) {
-				newlen := len(parea) + 1024
-				for (o + datalen) > newlen {
-					newlen += 1024
-				}
-				newarea := make([]byte, newlen)
-				copy(newarea, parea)
-				parea = newarea
-			}
-			ent.putData(parea[o : o+datalen])
-			enc.PutUint32(buf[8:12], uint32(pstart+o))
+			ent.putData(buf[o : o+datalen])
+			enc.PutUint32(p[8:12], uint32(ifdOffset+o))
 			o += datalen
-		}
-		if _, err := w.Write(buf[:]); err != nil {
-			return err
+			if datalen%2 != 0 {
+				// Offsets of entry data must be even (p. 15).
+				buf[o] = 0
+				o++
+			}
 		}
 	}
 	// The IFD ends with the offset of the next IFD in the file,
 	// or zero if it is the last one (page 14).
-	if err := binary.Write(w, enc, uint32(0)); err != nil {
+	enc.PutUint32(buf[pstart-4:pstart], uint32(next))
+	_, err := w.Write(buf)
+	return err
+}
+
+// writeBigIFD writes an IFD holding d as writeIFD does, but laid out for
+// BigTIFF: the number of entries, their counts and offsets take 8 bytes,
+// and data of up to 8 bytes is held in the entries.
+func writeBigIFD(w io.Writer, ifdOffset int64, d []ifdEntry, next int64) error {
+	if err := checkEntries(d, true); err != nil {
 		return err
 	}
-	_, err := w.Write(parea[:o])
+	if !sort.IsSorted(byTag(d)) {
+		sort.Sort(byTag(d))
+	}
+
+	pstart := 8 + bigIFDLen*len(d) + 8
+	bp := getBuffer(bigIFDSize(d))
+	defer putBuffer(bp)
+	buf := *bp
+
+	enc.PutUint64(buf[0:8], uint64(len(d)))
+	o := pstart
+	for i, ent := range d {
+		p := buf[8+bigIFDLen*i : 8+bigIFDLen*(i+1)]
+		enc.PutUint16(p[0:2], uint16(ent.tag))
+		enc.PutUint16(p[2:4], uint16(ent.datatype))
+		count := uint64(len(ent.data))
+		if pairedType(ent.datatype) {
+			count /= 2
+		}
+		enc.PutUint64(p[4:12], count)
+		datalen := ent.dataLen()
+		if datalen <= 8 {
+			enc.PutUint64(p[12:20], 0)
+			ent.putData(p[12:20])
+		} else {
+			ent.putData(buf[o : o+datalen])
+			enc.PutUint64(p[12:20], uint64(ifdOffset)+uint64(o))
+			o += datalen
+			if datalen%2 != 0 {
+				buf[o] = 0
+				o++
+			}
+		}
+	}
+	enc.PutUint64(buf[pstart-8:pstart], uint64(next))
+	_, err := w.Write(buf)
 	return err
 }
 
-func encodeGray32(w io.Writer, pix []uint32, dx, dy, stride int, predictor bool) error {
-	buf := make([]byte, dx*4)
+// encodeGray32 writes the samples in pix. Large images are serialized in
+// bands by up to cap(sem) goroutines.
+func encodeGray32(w io.Writer, sem chan struct{}, pix []uint32, dx, dy, stride int, predictor bool) error {
+	if !predictor && writeDirect() {
+		return writeUint32Pix(w, pix, dy, dx, stride)
+	}
+	if dx*dy*4 >= parallelMinBytes && cap(sem) > 1 {
+		return writeBands(w, sem, dx*4, dy, func(dst []byte, y0, y1 int) {
+			packGray32Rows(dst, pix, dx, stride, y0, y1, predictor)
+		})
+	}
+	bp := getBuffer(dx * 4)
+	defer putBuffer(bp)
+	buf := *bp
 	for y := 0; y < dy; y++ {
-		min := y*stride + 0
-		max := y*stride + dx
-		off := 0
-		var v0 uint32
-		for i := min; i < max; i++ {
-			// An image.Gray16's Pix is in big-endian order.
-			v1 := pix[i]
-			if predictor {
-				v0, v1 = v1, v1-v0
-			}
-			// We only write little-endian TIFF files.
-			buf[off+0] = byte(v1)
-			buf[off+1] = byte(v1 >> 8)
-			buf[off+2] = byte(v1 >> 16)
-			buf[off+3] = byte(v1 >> 24)
-			off += 4
-		}
+		packGray32Rows(buf, pix, dx, stride, y, y+1, predictor)
 		if _, err := w.Write(buf); err != nil {
 			return err
 		}
@@ -279,19 +1357,50 @@ func encodeGray32(w io.Writer, pix []uint32, dx, dy, stride int, predictor bool)
 	return nil
 }
 
-func encodeGrayFloat32(w io.Writer, pix []uint32, dx, dy, stride int, predictor bool) error {
-	buf := make([]byte, dx*4)
-	for y := 0; y < dy; y++ {
-		min := y*stride + 0
-		max := y*stride + dx
+// checkSize reports an error if a w×h image cannot be stored; TIFF has no
+// way to describe an image without pixels.
+func checkSize(w, h int) error {
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("tiff: cannot encode a %dx%d image: width and height must be positive", w, h)
+	}
+	if uint64(w) > math.MaxUint32 || uint64(h) > math.MaxUint32 {
+		return UnsupportedError{Feature: "image dimensions beyond 32 bits"}
+	}
+	return nil
+}
+
+// checkPix reports an error unless a Pix slice of length n, laid out with
+// the given stride, holds the dy rows of dx elements of an image. As for the
+// standard library images, Pix starts at the pixel at Rect.Min, so a
+// SubImage is written from its own bounds rather than from those of its
+// parent.
+func checkPix(n, stride, dx, dy int) error {
+	if dy == 0 || dx == 0 {
+		return nil
+	}
+	if stride < dx {
+		return fmt.Errorf("tiff: image stride %d is less than its width %d", stride, dx)
+	}
+	if m, ok := mulInt(dy-1, stride); !ok || m > n-dx {
+		return errors.New("tiff: image Pix is too short for its bounds")
+	}
+	return nil
+}
+
+// packGray32Rows serializes the rows [y0, y1) of pix into dst as
+// little-endian samples, applying the horizontal predictor if requested.
+func packGray32Rows(dst []byte, pix []uint32, dx, stride, y0, y1 int, predictor bool) {
+	for y := y0; y < y1; y++ {
+		row := pix[y*stride : y*stride+dx]
+		buf := dst[(y-y0)*dx*4:]
+		if !predictor {
+			packUint32s(buf, row)
+			continue
+		}
 		off := 0
 		var v0 uint32
-		for i := min; i < max; i++ {
-			// An image.Gray16's Pix is in big-endian order.
-			v1 := pix[i]
-			if predictor {
-				v0, v1 = v1, v1-v0
-			}
+		for _, v1 := range row {
+			v0, v1 = v1, v1-v0
 			// We only write little-endian TIFF files.
 			buf[off+0] = byte(v1)
 			buf[off+1] = byte(v1 >> 8)
@@ -299,9 +1408,50 @@ func encodeGrayFloat32(w io.Writer, pix []uint32, dx, dy, stride int, predictor
 			buf[off+3] = byte(v1 >> 24)
 			off += 4
 		}
-		if _, err := w.Write(buf); err != nil {
+	}
+}
+
+// writeDirect reports whether Pix rows can be written to the output as they
+// are laid out in memory.
+func writeDirect() bool {
+	return haveUint32Bytes && nativeLittleEndian && !fastPathDisabled
+}
+
+// writeUint32Pix writes nrows rows of length samples from pix to w straight
+// from memory. It must only be used if writeDirect reports true.
+func writeUint32Pix(w io.Writer, pix []uint32, nrows, length, stride int) error {
+	if length == stride {
+		_, err := w.Write(uint32Bytes(pix[:nrows*length]))
+		return err
+	}
+	for ; nrows > 0; nrows-- {
+		if _, err := w.Write(uint32Bytes(pix[:length])); err != nil {
 			return err
 		}
+		if nrows > 1 {
+			pix = pix[stride:]
+		}
 	}
 	return nil
 }
+
+// packUint32s stores src into dst as little-endian values, eight samples per
+// iteration. dst must hold at least 4*len(src) bytes.
+func packUint32s(dst []byte, src []uint32) {
+	dst = dst[:4*len(src)]
+	for len(src) >= 8 {
+		enc.PutUint32(dst[0:4], src[0])
+		enc.PutUint32(dst[4:8], src[1])
+		enc.PutUint32(dst[8:12], src[2])
+		enc.PutUint32(dst[12:16], src[3])
+		enc.PutUint32(dst[16:20], src[4])
+		enc.PutUint32(dst[20:24], src[5])
+		enc.PutUint32(dst[24:28], src[6])
+		enc.PutUint32(dst[28:32], src[7])
+		dst = dst[32:]
+		src = src[8:]
+	}
+	for i, v := range src {
+		enc.PutUint32(dst[4*i:4*i+4], v)
+	}
+}
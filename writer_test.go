@@ -4,11 +4,27 @@
 package tiff
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
 	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
 	"testing"
 	"unsafe"
+
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/tiff/lzw"
 )
 
 func TestFloat32Change(t *testing.T) {
@@ -20,3 +36,1371 @@ func TestFloat32Change(t *testing.T) {
 	u := math.Float32frombits(bits)
 	fmt.Println(u)
 }
+
+func TestEncodeGray32RowBufferReuse(t *testing.T) {
+	m := NewGray32(image.Rect(0, 0, 300, 20))
+	// Warm up the pool so that the steady state is measured.
+	if err := encodeGray32(io.Discard, nil, m.Pix, 300, 20, m.Stride, false); err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		encodeGray32(io.Discard, nil, m.Pix, 300, 20, m.Stride, false)
+	})
+	if allocs != 0 {
+		t.Errorf("encodeGray32 allocated %v times per run, want 0", allocs)
+	}
+}
+
+func TestEncodeGenericPath(t *testing.T) {
+	for _, m := range []image.Image{newTestGray32(37, 11), newTestGrayFloat32(37, 11)} {
+		want := encodeToBytes(t, m)
+		fastPathDisabled = true
+		got := encodeToBytes(t, m)
+		fastPathDisabled = false
+		if !bytes.Equal(got, want) {
+			t.Errorf("%T: generic and direct encodings differ", m)
+		}
+	}
+}
+
+// packUint32sSimple is the one-pixel-at-a-time loop that packUint32s
+// replaces; it is kept for comparison in the benchmarks below.
+func packUint32sSimple(dst []byte, src []uint32) {
+	off := 0
+	for _, v := range src {
+		dst[off+0] = byte(v)
+		dst[off+1] = byte(v >> 8)
+		dst[off+2] = byte(v >> 16)
+		dst[off+3] = byte(v >> 24)
+		off += 4
+	}
+}
+
+func TestPackUint32s(t *testing.T) {
+	src := newTestGray32(21, 1).Pix
+	got := make([]byte, 4*len(src))
+	want := make([]byte, 4*len(src))
+	packUint32s(got, src)
+	packUint32sSimple(want, src)
+	if !bytes.Equal(got, want) {
+		t.Errorf("packUint32s = %x, want %x", got, want)
+	}
+}
+
+func benchmarkPack(b *testing.B, pack func([]byte, []uint32)) {
+	src := newTestGray32(4096, 1).Pix
+	dst := make([]byte, 4*len(src))
+	b.SetBytes(int64(len(dst)))
+	for i := 0; i < b.N; i++ {
+		pack(dst, src)
+	}
+}
+
+func BenchmarkPackUint32sUnrolled(b *testing.B) { benchmarkPack(b, packUint32s) }
+func BenchmarkPackUint32sSimple(b *testing.B)   { benchmarkPack(b, packUint32sSimple) }
+
+func benchmarkEncode(b *testing.B, generic bool) {
+	m := newTestGrayFloat32(1024, 1024)
+	fastPathDisabled = generic
+	defer func() { fastPathDisabled = false }()
+	b.SetBytes(int64(4 * len(m.Pix)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := Encode(io.Discard, m, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeUncompressedDirect(b *testing.B)  { benchmarkEncode(b, false) }
+func BenchmarkEncodeUncompressedGeneric(b *testing.B) { benchmarkEncode(b, true) }
+
+func TestEncodeGray32Bands(t *testing.T) {
+	m := newTestGray32(37, 101)
+	defer func(b, p int) { bandBytes, parallelMinBytes = b, p }(bandBytes, parallelMinBytes)
+	for _, predictor := range []bool{false, true} {
+		fastPathDisabled = true
+		var want, got bytes.Buffer
+		parallelMinBytes = math.MaxInt32
+		if err := encodeGray32(&want, nil, m.Pix, 37, 101, m.Stride, predictor); err != nil {
+			t.Fatal(err)
+		}
+		bandBytes, parallelMinBytes = 37*4*3, 0
+		if err := writeBands(&got, make(chan struct{}, 4), 37*4, 101, func(dst []byte, y0, y1 int) {
+			packGray32Rows(dst, m.Pix, 37, m.Stride, y0, y1, predictor)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		fastPathDisabled = false
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("predictor=%v: banded output differs from row-by-row output", predictor)
+		}
+	}
+}
+
+func TestWriteIFDPointerArea(t *testing.T) {
+	const ifdOffset = 100
+	colorMap := make([]uint32, 768)
+	for i := range colorMap {
+		colorMap[i] = uint32(i)
+	}
+	ifd := []ifdEntry{
+		{TagXResolution, TypeRational, []uint32{300, 1}},
+		{TagImageWidth, TypeShort, []uint32{7}},
+		{TagColorMap, TypeShort, colorMap},
+	}
+	var buf bytes.Buffer
+	if err := writeIFD(&buf, ifdOffset, ifd, 0); err != nil {
+		t.Fatal(err)
+	}
+	p := buf.Bytes()
+	pstart := 2 + 3*ifdLen + 4
+	if want := pstart + 8 + 2*768; len(p) != want {
+		t.Fatalf("IFD length = %d, want %d", len(p), want)
+	}
+	if n := enc.Uint16(p[0:2]); n != 3 {
+		t.Fatalf("entry count = %d, want 3", n)
+	}
+	// Entries are sorted by tag: ImageWidth, XResolution, ColorMap.
+	if v := enc.Uint16(p[2+8 : 2+10]); v != 7 {
+		t.Errorf("ImageWidth = %d, want 7", v)
+	}
+	off := int(enc.Uint32(p[2+ifdLen+8:])) - ifdOffset
+	if off != pstart || enc.Uint32(p[off:]) != 300 || enc.Uint32(p[off+4:]) != 1 {
+		t.Errorf("XResolution stored at %d, want %d", off, pstart)
+	}
+	off = int(enc.Uint32(p[2+2*ifdLen+8:])) - ifdOffset
+	if off != pstart+8 || enc.Uint16(p[off+2*767:]) != 767 {
+		t.Errorf("ColorMap stored at %d, want %d", off, pstart+8)
+	}
+}
+
+func TestEncoderReuse(t *testing.T) {
+	defer func(p int) { parallelMinBytes = p }(parallelMinBytes)
+	parallelMinBytes = 0
+	fastPathDisabled = true
+	defer func() { fastPathDisabled = false }()
+
+	e := &Encoder{Workers: 2}
+	images := []image.Image{newTestGray32(64, 64), newTestGrayFloat32(64, 64)}
+	var wg sync.WaitGroup
+	errc := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(m image.Image) {
+			defer wg.Done()
+			var buf bytes.Buffer
+			if err := e.Encode(&buf, m); err != nil {
+				errc <- err
+				return
+			}
+			if _, err := Decode(bytes.NewReader(buf.Bytes())); err != nil {
+				errc <- err
+			}
+		}(images[i%2])
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Error(err)
+	}
+}
+
+func TestEncodeWithChecksum(t *testing.T) {
+	m := newTestGrayFloat32(33, 9)
+	var buf bytes.Buffer
+	sum, err := new(Encoder).EncodeWithChecksum(&buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pixels := buf.Bytes()[8 : 8+4*len(m.Pix)]
+	if want := crc32.ChecksumIEEE(pixels); sum != want {
+		t.Errorf("checksum = %#x, want %#x", sum, want)
+	}
+}
+
+func TestEncodeHugeBounds(t *testing.T) {
+	// The size check must fail before the missing pixels are touched.
+	m := &GrayFloat32{Rect: image.Rect(0, 0, 1<<20, 1<<20)}
+	var buf bytes.Buffer
+	var ue UnsupportedError
+	if err := Encode(&buf, m, nil); !errors.As(err, &ue) {
+		t.Errorf("got %v, want an UnsupportedError", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes for an image that cannot be encoded", buf.Len())
+	}
+}
+
+func TestEncodeWideImage(t *testing.T) {
+	// Widths beyond 65535 need a Long ImageWidth field.
+	g := newTestGray32(70000, 2)
+	m, err := Decode(bytes.NewReader(encodeToBytes(t, g)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := m.Bounds(); b != g.Rect {
+		t.Fatalf("bounds = %v, want %v", b, g.Rect)
+	}
+	comparePix(t, m.(*Gray32).Pix, g.Pix)
+}
+
+// corruptingFile flips the first byte of pixel data on its way to the file.
+type corruptingFile struct {
+	*os.File
+	n int
+}
+
+func (f *corruptingFile) Write(p []byte) (int, error) {
+	if f.n <= 8 && f.n+len(p) > 8 {
+		p = append([]byte(nil), p...)
+		p[8-f.n] ^= 0xff
+	}
+	f.n += len(p)
+	return f.File.Write(p)
+}
+
+func TestEncodeVerify(t *testing.T) {
+	g := newTestGrayFloat32(33, 17)
+	e := &Encoder{VerifyRows: 5}
+	var buf bytes.Buffer
+	if err := e.Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are read back in place, starting where the image begins.
+	f, err := os.CreateTemp(t.TempDir(), "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("prefix")
+	if err := e.Encode(f, g); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Encode(&corruptingFile{File: f}, g); err == nil {
+		t.Error("corrupted output passed verification")
+	} else if _, ok := err.(InternalError); !ok {
+		t.Errorf("got %v, want an InternalError", err)
+	}
+}
+
+func TestEncodeSubImage(t *testing.T) {
+	r := image.Rect(5, 3, 20, 11)
+	g := newTestGray32(30, 20).SubImage(r).(*Gray32)
+	f := newTestGrayFloat32(30, 20).SubImage(r).(*GrayFloat32)
+	for _, src := range []image.Image{g, f} {
+		m, err := Decode(bytes.NewReader(encodeToBytes(t, src)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Bounds() != image.Rect(0, 0, r.Dx(), r.Dy()) {
+			t.Fatalf("bounds = %v, want %v", m.Bounds(), r.Sub(r.Min))
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if got, want := m.At(x-r.Min.X, y-r.Min.Y), src.At(x, y); got != want {
+					t.Fatalf("%T: pixel (%d, %d) = %v, want %v", src, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	bad := &Gray32{Pix: make([]uint32, 10), Stride: 4, Rect: image.Rect(0, 0, 4, 4)}
+	if err := Encode(io.Discard, bad, nil); err == nil {
+		t.Error("encoded an image whose Pix is too short")
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	for _, m := range []image.Image{
+		NewGray32(image.Rect(0, 0, 0, 5)),
+		NewGrayFloat32(image.Rect(0, 0, 5, 0)),
+		&Gray32{Rect: image.Rectangle{image.Pt(5, 5), image.Pt(0, 0)}},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, nil); err == nil {
+			t.Errorf("%v: encoded an empty image", m.Bounds())
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%v: wrote %d bytes", m.Bounds(), buf.Len())
+		}
+	}
+	if _, err := NewWriter(io.Discard, image.Config{Width: -1, Height: 3}, nil); err == nil {
+		t.Error("NewWriter accepted a negative width")
+	}
+}
+
+func TestEncodeOmitResolution(t *testing.T) {
+	g := newTestGray32(9, 4)
+	var buf bytes.Buffer
+	if err := (&Encoder{OmitResolution: true}).Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	off := binary.LittleEndian.Uint32(data[4:])
+	n := binary.LittleEndian.Uint16(data[off:])
+	for i := 0; i < int(n); i++ {
+		tag := binary.LittleEndian.Uint16(data[int(off)+2+i*ifdLen:])
+		if tag == TagXResolution || tag == TagYResolution || tag == TagResolutionUnit {
+			t.Errorf("found resolution tag %d", tag)
+		}
+	}
+	m, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePix(t, m.(*Gray32).Pix, g.Pix)
+}
+
+func TestEncodeOptions(t *testing.T) {
+	g := newTestGray32(40, 30)
+	for _, opt := range []*tiff.Options{
+		{Compression: tiff.Uncompressed, Predictor: true},
+		{Compression: tiff.Deflate},
+		{Compression: tiff.Deflate, Predictor: true},
+		{Compression: tiff.LZW},
+		{Compression: tiff.LZW, Predictor: true},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, g, opt); err != nil {
+			t.Fatalf("%+v: %v", opt, err)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%+v: %v", opt, err)
+		}
+		wantCompression, wantPredictor := uint(CompressionNone), uint(0)
+		if opt.Compression != tiff.Uncompressed {
+			wantCompression = CompressionDeflate
+			if opt.Compression == tiff.LZW {
+				wantCompression = CompressionLZW
+			}
+			if opt.Predictor {
+				wantPredictor = PredictorHorizontal
+			}
+		}
+		if c := r.d.firstVal(TagCompression); c != wantCompression {
+			t.Errorf("%+v: Compression = %d, want %d", opt, c, wantCompression)
+		}
+		if p := r.d.firstVal(TagPredictor); p != wantPredictor {
+			t.Errorf("%+v: Predictor = %d, want %d", opt, p, wantPredictor)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("%+v: %v", opt, err)
+		}
+		comparePix(t, m.(*Gray32).Pix, g.Pix)
+	}
+
+	var ue UnsupportedError
+	if err := Encode(io.Discard, g, &tiff.Options{Compression: tiff.CCITTGroup4}); !errors.As(err, &ue) {
+		t.Errorf("CCITT Group 4: got %v, want an UnsupportedError", err)
+	}
+	if _, err := NewWriter(io.Discard, image.Config{Width: 4, Height: 4}, &tiff.Options{Compression: tiff.Deflate}); err == nil {
+		t.Error("NewWriter accepted Deflate compression")
+	}
+}
+
+func TestEncodeRGBA(t *testing.T) {
+	r := image.Rect(0, 0, 37, 21)
+	rgba := image.NewRGBA(r)
+	nrgba := image.NewNRGBA(r)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i*7) % 120
+		if i%4 == 3 {
+			rgba.Pix[i] = 120
+		}
+		nrgba.Pix[i] = uint8(i * 13)
+	}
+	rgba64 := image.NewRGBA64(r)
+	nrgba64 := image.NewNRGBA64(r)
+	for i := range rgba64.Pix {
+		rgba64.Pix[i] = uint8(i*11) % 90
+		if i%8 >= 6 {
+			rgba64.Pix[i] = 90
+		}
+		nrgba64.Pix[i] = uint8(i * 17)
+	}
+	sub := nrgba.SubImage(image.Rect(3, 2, 30, 20)).(*image.NRGBA)
+	sub64 := rgba64.SubImage(image.Rect(1, 5, 36, 19)).(*image.RGBA64)
+	for _, tc := range []struct {
+		src          image.Image
+		pix          []byte
+		stride       int
+		extraSamples uint
+	}{
+		{rgba, rgba.Pix, rgba.Stride, ExtraSamplesAssociatedAlpha},
+		{nrgba, nrgba.Pix, nrgba.Stride, ExtraSamplesUnassociatedAlpha},
+		{sub, sub.Pix, sub.Stride, ExtraSamplesUnassociatedAlpha},
+		{rgba64, rgba64.Pix, rgba64.Stride, ExtraSamplesAssociatedAlpha},
+		{nrgba64, nrgba64.Pix, nrgba64.Stride, ExtraSamplesUnassociatedAlpha},
+		{sub64, sub64.Pix, sub64.Stride, ExtraSamplesAssociatedAlpha},
+	} {
+		for _, pg := range []Page{
+			{Image: tc.src},
+			{Image: tc.src, Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}},
+			{Image: tc.src, TileWidth: 16, TileHeight: 16},
+		} {
+			var buf bytes.Buffer
+			if err := EncodeAll(&buf, []Page{pg}, nil); err != nil {
+				t.Fatalf("%T: %v", tc.src, err)
+			}
+			rd, err := NewReader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%T: %v", tc.src, err)
+			}
+			if es := rd.d.firstVal(TagExtraSamples); es != tc.extraSamples {
+				t.Errorf("%T: ExtraSamples = %d, want %d", tc.src, es, tc.extraSamples)
+			}
+			m, err := rd.ReadRegion(rd.Bounds())
+			if err != nil {
+				t.Fatalf("%T: %v", tc.src, err)
+			}
+			if m.ColorModel() != tc.src.ColorModel() {
+				t.Fatalf("%T: decoded a %T", tc.src, m)
+			}
+			b := tc.src.Bounds()
+			var got []byte
+			switch m := m.(type) {
+			case *image.RGBA:
+				got = m.Pix
+			case *image.NRGBA:
+				got = m.Pix
+			case *image.RGBA64:
+				got = m.Pix
+			case *image.NRGBA64:
+				got = m.Pix
+			}
+			n := len(got) / b.Dy()
+			for y := 0; y < b.Dy(); y++ {
+				want := tc.pix[y*tc.stride : y*tc.stride+n]
+				if row := got[y*n : (y+1)*n]; !bytes.Equal(row, want) {
+					t.Fatalf("%T, %+v: row %d = %v, want %v", tc.src, pg.Options, y, row, want)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeAny(t *testing.T) {
+	r := image.Rect(2, 1, 19, 12)
+	gray := image.NewGray(r)
+	gray16 := image.NewGray16(r)
+	cmyk := image.NewCMYK(r)
+	paletted := image.NewPaletted(r, color.Palette{
+		color.RGBA{0, 0, 0, 0xff}, color.RGBA{0x10, 0x80, 0xf0, 0xff}, color.RGBA{0x20, 0x10, 0x40, 0x80},
+	})
+	for i := range cmyk.Pix {
+		gray.Pix[i/4] = uint8(i * 3)
+		gray16.Pix[i/2] = uint8(i * 7)
+		cmyk.Pix[i] = uint8(i * 5)
+		paletted.Pix[i/4] = uint8(i % 3)
+	}
+	for _, tc := range []struct {
+		src  image.Image
+		want color.Model
+	}{
+		{gray, Gray32Model},
+		{gray16, Gray32Model},
+		{image.NewUniform(color.Gray{7}), nil},
+		{cmyk, color.RGBAModel},
+		{paletted, color.RGBAModel},
+		{image.NewYCbCr(r, image.YCbCrSubsampleRatio420), color.RGBAModel},
+	} {
+		var buf bytes.Buffer
+		err := EncodeAny(&buf, tc.src, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%T: encoded an image of infinite bounds", tc.src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%T: %v", tc.src, err)
+		}
+		m, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%T: %v", tc.src, err)
+		}
+		if m.ColorModel() != tc.want {
+			t.Fatalf("%T: decoded a %T", tc.src, m)
+		}
+		want := image.NewRGBA64(tc.src.Bounds())
+		for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+			for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+				want.Set(x, y, tc.want.Convert(tc.src.At(x, y)))
+			}
+		}
+		compareColors(t, m, want)
+	}
+
+	// Images Encode supports are written as they are.
+	g := newTestGray32(5, 4)
+	var direct, converted bytes.Buffer
+	if err := Encode(&direct, g, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeAny(&converted, g, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(direct.Bytes(), converted.Bytes()) {
+		t.Error("EncodeAny changed a Gray32")
+	}
+}
+
+func TestEncodeLERC(t *testing.T) {
+	r := image.Rect(0, 0, 45, 27)
+	elev := NewGrayFloat32(r)
+	for i := range elev.Pix {
+		x, y := float64(i%r.Dx()), float64(i/r.Dx())
+		elev.Pix[i] = math.Float32bits(float32(100 + 30*math.Sin(x/7) + 0.5*y))
+	}
+	// Holes, and whole micro blocks of NaN and of a single value.
+	for _, i := range []int{3, 100, 101, 102, 600} {
+		elev.Pix[i] = math.Float32bits(float32(math.NaN()))
+	}
+	for y := 8; y < 16; y++ {
+		for x := 16; x < 24; x++ {
+			elev.SetGray32(x, y, GrayFloat32Color{math.Float32bits(float32(math.NaN()))})
+			elev.SetGray32(x+8, y, GrayFloat32Color{math.Float32bits(7)})
+		}
+	}
+	counts := newTestGray32(45, 27)
+	for i := range counts.Pix {
+		counts.Pix[i] %= 1000
+	}
+
+	sample := func(m image.Image, x, y int) float64 {
+		if m, ok := m.(*Gray32); ok {
+			return float64(m.Pix[m.PixOffset(x, y)])
+		}
+		f := m.(*GrayFloat32)
+		return float64(math.Float32frombits(f.Pix[f.PixOffset(x, y)]))
+	}
+	for _, tc := range []struct {
+		src  image.Image
+		opt  LERCOptions
+		tile int
+	}{
+		{elev, LERCOptions{MaxError: 0.01}, 0},
+		{elev, LERCOptions{MaxError: 0.5, Deflate: true}, 16},
+		{elev, LERCOptions{}, 0},
+		{counts, LERCOptions{}, 16},
+		{counts, LERCOptions{MaxError: 4}, 0},
+		{newTestGray32(40, 20), LERCOptions{Deflate: true}, 0},
+	} {
+		e := &Encoder{LERC: &tc.opt}
+		var buf bytes.Buffer
+		if err := e.EncodeAll(&buf, []Page{{Image: tc.src, TileWidth: tc.tile, TileHeight: tc.tile}}); err != nil {
+			t.Fatalf("%T, %+v: %v", tc.src, tc.opt, err)
+		}
+		m, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%T, %+v: %v", tc.src, tc.opt, err)
+		}
+		maxErr := tc.opt.MaxError
+		if _, ok := tc.src.(*Gray32); ok {
+			maxErr = math.Floor(maxErr)
+		}
+		b := tc.src.Bounds()
+		if m.Bounds() != b {
+			t.Fatalf("%T, %+v: bounds %v, want %v", tc.src, tc.opt, m.Bounds(), b)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				got, want := sample(m, x, y), sample(tc.src, x, y)
+				if math.IsNaN(want) != math.IsNaN(got) || math.Abs(got-want) > maxErr*(1+1e-6) {
+					t.Fatalf("%T, %+v: (%d, %d) = %g, want %g", tc.src, tc.opt, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	e := &Encoder{LERC: &LERCOptions{}}
+	err := e.Encode(io.Discard, image.NewRGBA(r))
+	if _, ok := err.(UnsupportedError); !ok {
+		t.Errorf("LERC compression of an RGBA image: got %v, want an UnsupportedError", err)
+	}
+	e.LERC.MaxError = -1
+	if err := e.Encode(io.Discard, elev); err == nil {
+		t.Error("negative LERC MaxError accepted")
+	}
+}
+
+func TestDecodeLERCLibtiff(t *testing.T) {
+	// Files written by libtiff 4.5 and the LERC library 4: 40x30 float
+	// images, in strips of 10 rows losslessly, and in tiles of 16x16
+	// within 0.5 and deflated.
+	for _, tc := range []struct {
+		name   string
+		maxErr float64
+	}{
+		{"testdata/lerc.tif", 0},
+		{"testdata/lerc_deflate.tif", 0.5},
+	} {
+		f, err := os.Open(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		g, ok := m.(*GrayFloat32)
+		if !ok || g.Rect != image.Rect(0, 0, 40, 30) {
+			t.Fatalf("%s: decoded a %T of bounds %v", tc.name, m, m.Bounds())
+		}
+		for y := 0; y < 30; y++ {
+			for x := 0; x < 40; x++ {
+				want := 1000 + 0.25*float64(y*y) - float64(x*y)/8 + float64(x%7)*0.5
+				got := float64(math.Float32frombits(g.Pix[g.PixOffset(x, y)]))
+				if math.Abs(got-want) > tc.maxErr {
+					t.Fatalf("%s: (%d, %d) = %g, want %g", tc.name, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestLERCBitStuffing(t *testing.T) {
+	// Values of 5 bits packed from the least significant bit since version
+	// 3, and before from the top of little-endian words, the bytes of the
+	// final part of a word being those of its top.
+	want := []uint32{1, 2, 3}
+	for _, tc := range []struct {
+		version int
+		p       []byte
+	}{
+		{3, []byte{0x41, 0x0c}},
+		{2, []byte{0x86, 0x08}},
+	} {
+		c := &lercCursor{p: tc.p}
+		got := c.bits(len(want), 5, tc.version)
+		if c.short || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("version %d: got %v, want %v", tc.version, got, want)
+		}
+	}
+
+	mask := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 0, 0, 0, 0, 0, 0, 0, 9}
+	got := make([]byte, len(mask))
+	if err := lercUnRLE(lercRLE(mask), got); err != nil || !bytes.Equal(got, mask) {
+		t.Errorf("RLE round trip: got %v, %v, want %v", got, err, mask)
+	}
+}
+
+func TestEncodeJPEG(t *testing.T) {
+	r := image.Rect(0, 0, 70, 37)
+	gray := image.NewGray(r)
+	rgba := image.NewRGBA(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			gray.SetGray(x, y, color.Gray{uint8(3*x + y)})
+			rgba.SetRGBA(x, y, color.RGBA{uint8(3 * x), uint8(6 * y), 128, 0xff})
+		}
+	}
+	paletted := image.NewPaletted(r, color.Palette{color.RGBA{0x10, 0x80, 0xf0, 0xff}, color.White})
+	for _, tc := range []struct {
+		src  image.Image
+		want color.Model
+		tile int
+	}{
+		{gray, color.GrayModel, 0},
+		{gray, color.GrayModel, 32},
+		{rgba, color.YCbCrModel, 0},
+		{rgba.SubImage(image.Rect(5, 3, 60, 30)), color.YCbCrModel, 16},
+		{paletted, color.YCbCrModel, 0},
+	} {
+		var buf bytes.Buffer
+		pg := Page{Image: tc.src, JPEG: &jpeg.Options{Quality: 95}, TileWidth: tc.tile, TileHeight: tc.tile}
+		if err := EncodeAll(&buf, []Page{pg}, nil); err != nil {
+			t.Fatalf("%T: %v", tc.src, err)
+		}
+		m, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%T, tiles of %d: %v", tc.src, tc.tile, err)
+		}
+		b, sb := m.Bounds(), tc.src.Bounds()
+		if m.ColorModel() != tc.want || b.Size() != sb.Size() {
+			t.Fatalf("%T: decoded a %T of bounds %v", tc.src, m, b)
+		}
+		// JPEG is lossy: compare the average error.
+		var sum float64
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				r0, g0, b0, _ := m.At(x, y).RGBA()
+				r1, g1, b1, _ := tc.src.At(sb.Min.X+x, sb.Min.Y+y).RGBA()
+				for _, d := range []float64{float64(r0) - float64(r1), float64(g0) - float64(g1), float64(b0) - float64(b1)} {
+					sum += math.Abs(d) / 0x101
+				}
+			}
+		}
+		if avg := sum / float64(3*b.Dx()*b.Dy()); avg > 4 {
+			t.Errorf("%T, tiles of %d: average error %.1f", tc.src, tc.tile, avg)
+		}
+	}
+
+	// A JPEG overview of a LERC compressed image.
+	e := &Encoder{LERC: &LERCOptions{}}
+	var buf bytes.Buffer
+	err := e.EncodeAll(&buf, []Page{
+		{Image: newTestGrayFloat32(40, 20)},
+		{Image: image.NewGray(image.Rect(0, 0, 20, 10)), Type: SubfileReducedResolution, JPEG: &jpeg.Options{Quality: 50}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{Image: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := rd.d.firstVal(TagCompression); c != CompressionJPEG || rd.SubfileType() != SubfileReducedResolution {
+		t.Errorf("overview of compression %d and type %d", c, rd.SubfileType())
+	}
+	if _, err := rd.ReadRegion(rd.Bounds()); err != nil {
+		t.Error(err)
+	}
+
+	for _, m := range []image.Image{image.NewRGBA(r), newTestGray32(4, 4)} {
+		e := &Encoder{JPEG: &jpeg.Options{}}
+		if err := e.Encode(io.Discard, m); !errors.As(err, new(UnsupportedError)) {
+			t.Errorf("JPEG compression of a %T: got %v, want an UnsupportedError", m, err)
+		}
+	}
+	if err := Encode(io.Discard, gray, nil); err == nil {
+		t.Error("encoded an *image.Gray without JPEG compression")
+	}
+}
+
+func TestEncodeBlockAlign(t *testing.T) {
+	m := newTestGray32(100, 70)
+	for _, tc := range []struct {
+		name string
+		e    *Encoder
+	}{
+		{"tiles", &Encoder{Options: &tiff.Options{Compression: tiff.Deflate}, TileWidth: 32, TileHeight: 16, BlockAlign: 512}},
+		{"strip", &Encoder{BlockAlign: 4096}},
+	} {
+		var buf bytes.Buffer
+		if _, err := tc.e.EncodeWithChecksum(&buf, m); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var pages bytes.Buffer
+		if err := tc.e.EncodeAll(&pages, []Page{{Image: m}, {Image: m, TileWidth: 16, TileHeight: 16}}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for _, f := range []struct {
+			data  []byte
+			image int
+		}{{buf.Bytes(), 0}, {pages.Bytes(), 0}, {pages.Bytes(), 1}} {
+			r, err := NewReaderWithOptions(bytes.NewReader(f.data), &ReaderOptions{Image: f.image, Strict: true})
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			for k, off := range r.d.blockOffsets {
+				if off%uint(tc.e.BlockAlign) != 0 {
+					t.Errorf("%s, image %d: block %d at %d", tc.name, f.image, k, off)
+				}
+			}
+			tiled := r.d.blockPadding
+			if want := tc.e.TileWidth > 0 || f.image == 1; tiled != want {
+				t.Errorf("%s, image %d: tiled %v, want %v", tc.name, f.image, tiled, want)
+			}
+			got, err := r.ReadRegion(r.Bounds())
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			comparePix(t, got.(*Gray32).Pix, m.Pix)
+		}
+	}
+
+	// Checksums leave the padding out.
+	var buf bytes.Buffer
+	plain, err := (&Encoder{}).EncodeWithChecksum(&buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aligned, err := (&Encoder{BlockAlign: 1024}).EncodeWithChecksum(io.Discard, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != aligned {
+		t.Errorf("checksum %08x with alignment, want %08x", aligned, plain)
+	}
+	if err := (&Encoder{BlockAlign: 300}).Encode(io.Discard, m); err == nil {
+		t.Error("BlockAlign 300: no error")
+	}
+	if err := (&Encoder{TileWidth: 20, TileHeight: 16}).Encode(io.Discard, m); err == nil {
+		t.Error("tile width 20: no error")
+	}
+}
+
+func TestStrictLayout(t *testing.T) {
+	m := newTestGray32(100, 70)
+	md := &Metadata{Software: "abcd", Geo: &GeoInfo{PixelScale: []float64{1, 1, 0}}}
+	opt := &tiff.Options{Compression: tiff.Deflate}
+	for _, e := range []*Encoder{
+		{Options: opt},
+		{Options: opt, StrictLayout: true},
+		{Options: opt, StrictLayout: true, TileWidth: 32, TileHeight: 16},
+	} {
+		var buf bytes.Buffer
+		if err := e.EncodeWithMetadata(&buf, m, md); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		ifd := binary.LittleEndian.Uint32(b[4:])
+		if ifd%2 != 0 || e.StrictLayout && ifd != 8 {
+			t.Errorf("strict %v: IFD at %d", e.StrictLayout, ifd)
+		}
+		n := int(binary.LittleEndian.Uint16(b[ifd:]))
+		for i := 0; i < n; i++ {
+			p := b[int(ifd)+2+ifdLen*i:]
+			dt, count := binary.LittleEndian.Uint16(p[2:]), binary.LittleEndian.Uint32(p[4:])
+			if lengths[dt]*count > 4 && binary.LittleEndian.Uint32(p[8:])%2 != 0 {
+				t.Errorf("strict %v: data of tag %d at an odd offset", e.StrictLayout, binary.LittleEndian.Uint16(p))
+			}
+		}
+
+		r, err := NewReaderWithOptions(bytes.NewReader(b), &ReaderOptions{Strict: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev := uint(ifd)
+		for k, off := range r.d.blockOffsets {
+			if e.StrictLayout && (off%2 != 0 || off <= prev) {
+				t.Errorf("block %d at %d, after %d", k, off, prev)
+			}
+			prev = off
+		}
+		got, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatal(err)
+		}
+		comparePix(t, got.(*Gray32).Pix, m.Pix)
+		if got, err := r.Metadata(); err != nil || got.Software != "abcd" || got.Geo.PixelScale[0] != 1 {
+			t.Errorf("strict %v: metadata %+v, %v", e.StrictLayout, got, err)
+		}
+	}
+
+	plain, err := (&Encoder{Options: opt}).EncodeWithChecksum(io.Discard, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, err := (&Encoder{Options: opt, StrictLayout: true}).EncodeWithChecksum(io.Discard, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != strict {
+		t.Errorf("checksum %08x with StrictLayout, want %08x", strict, plain)
+	}
+}
+
+func TestEncodeGhostArea(t *testing.T) {
+	m := newTestGray32(100, 70)
+	files := make(map[string][]byte)
+	for name, e := range map[string]*Encoder{
+		"strip": {GhostArea: true},
+		"tiles": {GhostArea: true, Options: &tiff.Options{Compression: tiff.Deflate}, TileWidth: 32, TileHeight: 32, BlockAlign: 16},
+	} {
+		var buf bytes.Buffer
+		if err := e.Encode(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = buf.Bytes()
+		var one, two bytes.Buffer
+		if err := e.EncodeAll(&one, []Page{{Image: m}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.EncodeAll(&two, []Page{{Image: m}, {Image: m, Type: SubfileReducedResolution}}); err != nil {
+			t.Fatal(err)
+		}
+		files[name+", one page"], files[name+", two pages"] = one.Bytes(), two.Bytes()
+	}
+	for name, data := range files {
+		if !bytes.HasPrefix(data[8:], []byte("GDAL_STRUCTURAL_METADATA_SIZE=")) {
+			t.Errorf("%s: no ghost area after the header", name)
+		}
+		r, err := NewReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Strict: true})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		md, err := r.StructuralMetadata()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if md["BLOCK_LEADER"] != "SIZE_AS_UINT4" || md["BLOCK_TRAILER"] != "LAST_4_BYTES_REPEATED" {
+			t.Errorf("%s: structural metadata %v", name, md)
+		}
+		if _, ok := md["LAYOUT"]; ok != strings.HasSuffix(name, "one page") {
+			t.Errorf("%s: LAYOUT given: %v", name, ok)
+		}
+		for k, off := range r.d.blockOffsets {
+			if n := binary.LittleEndian.Uint32(data[off-4:]); uint(n) != r.d.blockCounts[k] {
+				t.Errorf("%s: block %d leader %d, want %d", name, k, n, r.d.blockCounts[k])
+			}
+		}
+		got, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		comparePix(t, got.(*Gray32).Pix, m.Pix)
+
+		// Editing a block in place leaves its trailer behind.
+		edited := append([]byte(nil), data...)
+		last := r.d.blockOffsets[0] + r.d.blockCounts[0] - 1
+		edited[last] ^= 0xff
+		if _, err := NewReaderWithOptions(bytes.NewReader(edited), &ReaderOptions{Strict: true}); err == nil {
+			t.Errorf("%s: edited block accepted", name)
+		}
+	}
+
+	r, err := NewReader(bytes.NewReader(encodeToBytes(t, m)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md, err := r.StructuralMetadata(); md != nil || err != nil {
+		t.Errorf("plain file: structural metadata %v, %v", md, err)
+	}
+}
+
+func TestEncodeAutoTune(t *testing.T) {
+	ramp := NewGray32(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			ramp.SetGray32(x, y, Gray32Color{uint32(1e6 + 1000*x + 7*y)})
+		}
+	}
+	flat := NewGray32(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			flat.SetGray32(x, y, Gray32Color{uint32(x % 3)})
+		}
+	}
+	noise := NewGray32(image.Rect(0, 0, 300, 200))
+	rnd := rand.New(rand.NewSource(1))
+	for i := range noise.Pix {
+		noise.Pix[i] = rnd.Uint32()
+	}
+	for _, tc := range []struct {
+		name        string
+		m           *Gray32
+		compression uint
+		predictor   uint
+	}{
+		{"ramp", ramp, CompressionDeflate, PredictorHorizontal},
+		{"flat", flat, CompressionDeflate, 0},
+		{"noise", noise, CompressionNone, 0},
+	} {
+		var buf bytes.Buffer
+		e := &Encoder{AutoTune: true, Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}}
+		if err := e.Encode(&buf, tc.m); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, p := r.d.firstVal(TagCompression), r.d.firstVal(TagPredictor); c != tc.compression || p != tc.predictor {
+			t.Errorf("%s: compression %d, predictor %d; want %d, %d", tc.name, c, p, tc.compression, tc.predictor)
+		}
+		got, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatal(err)
+		}
+		comparePix(t, got.(*Gray32).Pix, tc.m.Pix)
+	}
+
+	// Floating point samples, whose low bits are noise, do best with the
+	// floating point predictor.
+	dem := NewGrayFloat32(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			dem.Pix[dem.PixOffset(x, y)] = math.Float32bits(float32(500 + 0.25*float64(x) + 0.125*float64(y) + rnd.Float64()/2))
+		}
+	}
+	for _, tile := range []int{0, 64} {
+		var buf bytes.Buffer
+		e := &Encoder{AutoTune: true, TileWidth: tile, TileHeight: tile}
+		if err := e.Encode(&buf, dem); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, p := r.d.firstVal(TagCompression), r.d.firstVal(TagPredictor); c != CompressionDeflate || p != PredictorFloatingPoint {
+			t.Errorf("floating point, tiles of %d: compression %d, predictor %d; want %d, %d", tile, c, p, CompressionDeflate, PredictorFloatingPoint)
+		}
+		got, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatal(err)
+		}
+		comparePix(t, got.(*GrayFloat32).Pix, dem.Pix)
+	}
+}
+
+func TestEncodeZSTD(t *testing.T) {
+	// Land-cover classes, in patches with a few stray pixels.
+	classes := NewGray32(image.Rect(0, 0, 256, 192))
+	rnd := rand.New(rand.NewSource(1))
+	for y := 0; y < 192; y++ {
+		for x := 0; x < 256; x++ {
+			c := uint32((x/37 + y/23*3) % 7 * 10)
+			if rnd.Intn(40) == 0 {
+				c = uint32(rnd.Intn(7) * 10)
+			}
+			classes.SetGray32(x, y, Gray32Color{c})
+		}
+	}
+	encode := func(e *Encoder, tile int) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := e.EncodeAll(&buf, []Page{{Image: classes, TileWidth: tile, TileHeight: tile}}); err != nil {
+			t.Fatalf("%+v, tile %d: %v", *e.ZSTD, tile, err)
+		}
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := r.d.firstVal(TagCompression); c != CompressionZSTD {
+			t.Errorf("%+v, tile %d: compression %d, want ZSTD", *e.ZSTD, tile, c)
+		}
+		got, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("%+v, tile %d: %v", *e.ZSTD, tile, err)
+		}
+		comparePix(t, got.(*Gray32).Pix, classes.Pix)
+		return buf.Bytes()
+	}
+	for _, opt := range []ZSTDOptions{{}, {Level: 1}, {Level: 19, WindowLog: 10}, {Level: 22, WindowLog: 27}} {
+		for _, tile := range []int{0, 32} {
+			encode(&Encoder{ZSTD: &opt}, tile)
+			encode(&Encoder{ZSTD: &opt, Options: &tiff.Options{Predictor: true}}, tile)
+		}
+	}
+
+	// Small tiles of a texture compress better against a shared
+	// dictionary.
+	var motif [16 * 16]uint32
+	for i := range motif {
+		motif[i] = rnd.Uint32() % 1000
+	}
+	for y := 0; y < 192; y++ {
+		for x := 0; x < 256; x++ {
+			classes.SetGray32(x, y, Gray32Color{motif[y%16*16+x%16]})
+		}
+	}
+	plain := encode(&Encoder{ZSTD: &ZSTDOptions{}}, 16)
+	shared := encode(&Encoder{ZSTD: &ZSTDOptions{DictionarySize: 4096}}, 16)
+	if len(shared) >= len(plain) {
+		t.Errorf("with a dictionary: %d bytes, without: %d", len(shared), len(plain))
+	}
+	r, err := NewReader(bytes.NewReader(shared))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(r.d.zstdDictionary); n == 0 || n > 4096 {
+		t.Errorf("dictionary of %d bytes, want 1 to 4096", n)
+	}
+
+	for _, opt := range []ZSTDOptions{{Level: -1}, {Level: 23}, {WindowLog: 9}, {WindowLog: 28}, {DictionarySize: 2 << 20}} {
+		if err := (&Encoder{ZSTD: &opt}).Encode(io.Discard, classes); err == nil {
+			t.Errorf("%+v accepted", opt)
+		}
+	}
+	e := &Encoder{ZSTD: &ZSTDOptions{}, LERC: &LERCOptions{}}
+	if err := e.Encode(io.Discard, classes); err == nil {
+		t.Error("ZSTD along with LERC accepted")
+	}
+}
+
+// zstdInterop is the content of testdata/window10.zst, a frame written by
+// zstd 1.5.6 with "zstd -19 --zstd=wlog=10": a window of 1 KiB, and blocks
+// of as much.
+func zstdInterop() []byte {
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i%251 ^ i/1000)
+	}
+	return data
+}
+
+func TestZSTDWindow(t *testing.T) {
+	data := zstdInterop()
+	frame, err := os.ReadFile("testdata/window10.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decodeZstd(frame, nil, 1<<20); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decoding a frame of zstd: %v", err)
+	}
+
+	// Frames of small windows are cut in blocks no larger, which zstd
+	// checks, if installed.
+	zstd, _ := exec.LookPath("zstd")
+	for _, wlog := range []int{10, 12, 16, 17} {
+		frame := newZSTDEncoder(&ZSTDOptions{WindowLog: wlog}, nil).appendFrame(nil, data)
+		if got, err := decodeZstd(frame, nil, 1<<20); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("window log %d: %v", wlog, err)
+		}
+		if zstd == "" {
+			continue
+		}
+		cmd := exec.Command(zstd, "-d", "-c")
+		cmd.Stdin = bytes.NewReader(frame)
+		if got, err := cmd.Output(); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("window log %d: zstd -d: %v", wlog, err)
+		}
+	}
+
+	// A block larger than the window is invalid.
+	for _, tc := range []struct {
+		window byte
+		ok     bool
+	}{{0, false}, {1 << 3, true}} { // Windows of 1 and 2 KiB.
+		frame := binary.LittleEndian.AppendUint32(nil, zstdMagic)
+		// The last block, raw, of 2048 bytes.
+		frame = append(frame, 0, tc.window, 1, 2048>>5, 0)
+		frame = append(frame, data[:2048]...)
+		if _, err := decodeZstd(frame, nil, 1<<20); (err == nil) != tc.ok {
+			t.Errorf("block of 2 KiB in a window byte %#x: %v", tc.window, err)
+		}
+	}
+}
+
+func TestEncodeCheckXImage(t *testing.T) {
+	r := image.Rect(3, 2, 43, 39)
+	rgba, nrgba := image.NewRGBA(r), image.NewNRGBA(r)
+	rgba64, nrgba64 := image.NewRGBA64(r), image.NewNRGBA64(r)
+	rng := rand.New(rand.NewSource(1))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := uint16(rng.Intn(1 << 16))
+			rgba.SetRGBA(x, y, color.RGBA{uint8(v >> 9), uint8(v >> 10), uint8(v >> 11), uint8(v >> 8)})
+			nrgba.SetNRGBA(x, y, color.NRGBA{uint8(v), uint8(v >> 3), uint8(x), uint8(y)})
+			rgba64.SetRGBA64(x, y, color.RGBA64{v >> 1, v >> 2, v >> 3, v})
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{v, v ^ 0xff, uint16(x), uint16(y) << 8})
+		}
+	}
+	deflated := &tiff.Options{Compression: tiff.Deflate, Predictor: true}
+	lzwed := &tiff.Options{Compression: tiff.LZW, Predictor: true}
+	for _, m := range []image.Image{rgba, nrgba, rgba64, nrgba64} {
+		for _, e := range []*Encoder{
+			{CheckXImage: true},
+			{CheckXImage: true, Options: deflated},
+			{CheckXImage: true, Options: deflated, TileWidth: 16, TileHeight: 16},
+			{CheckXImage: true, Options: lzwed},
+			{CheckXImage: true, Options: lzwed, TileWidth: 16, TileHeight: 16},
+		} {
+			if err := e.Encode(io.Discard, m); err != nil {
+				t.Errorf("%T, %+v: %v", m, e.Options, err)
+			}
+		}
+	}
+
+	// A mismatch is caught.
+	var buf bytes.Buffer
+	if err := Encode(&buf, nrgba, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := image.NewNRGBA(r)
+	copy(other.Pix, nrgba.Pix)
+	other.Pix[100]++
+	var ie InternalError
+	if err := checkXImage(bytes.NewReader(buf.Bytes()), other); !errors.As(err, &ie) {
+		t.Errorf("checkXImage of a different image: got %v, want an InternalError", err)
+	}
+}
+
+func TestDeflateLevel(t *testing.T) {
+	g := newTestGrayFloat32(64, 48)
+	sizes := map[int]int{}
+	for _, level := range []int{zlib.HuffmanOnly, 0, zlib.BestSpeed, zlib.BestCompression} {
+		var buf bytes.Buffer
+		e := &Encoder{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, DeflateLevel: level, TileWidth: 16, TileHeight: 16}
+		if err := e.Encode(&buf, g); err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		m, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		comparePix(t, m.(*GrayFloat32).Pix, g.Pix)
+		sizes[level] = buf.Len()
+	}
+	if sizes[zlib.BestCompression] > sizes[zlib.BestSpeed] || sizes[zlib.BestSpeed] >= sizes[zlib.HuffmanOnly] {
+		t.Errorf("sizes by level %v", sizes)
+	}
+	e := &Encoder{Options: &tiff.Options{Compression: tiff.Deflate}, DeflateLevel: 10}
+	if err := e.Encode(io.Discard, g); err == nil {
+		t.Error("Deflate level 10 accepted")
+	}
+}
+
+func TestLZWWriter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rng.Read(random)
+	runs := make([]byte, 100000)
+	for i := range runs {
+		runs[i] = byte(i / 300 % 7)
+	}
+	ramp := make([]byte, 70000)
+	for i := range ramp {
+		ramp[i] = byte(i) ^ byte(i>>8)
+	}
+	z := newLZWWriter(nil)
+	for _, src := range [][]byte{nil, {42}, random[:1000], random, runs, ramp} {
+		var buf bytes.Buffer
+		z.Reset(&buf)
+		// Written in pieces, to carry the pending code across calls.
+		for p := src; len(p) > 0; {
+			n := min(len(p), 777)
+			if _, err := z.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(lzw.NewReader(bytes.NewReader(buf.Bytes()), lzw.MSB, 8))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", len(src), err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("%d bytes: round trip gave %d different bytes", len(src), len(got))
+		}
+		if len(src) == len(runs) && bytes.Equal(src, runs) && buf.Len() > len(src)/20 {
+			t.Errorf("runs compressed to %d bytes", buf.Len())
+		}
+	}
+	if _, err := z.Write([]byte{1}); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+}
+
+func TestEncodePhotometric(t *testing.T) {
+	mask := NewGrayFloat32(image.Rect(0, 0, 8, 4))
+	for i := range mask.Pix {
+		mask.Pix[i] = math.Float32bits(float32(i % 2))
+	}
+	pi := func(v int) *int { return &v }
+	var buf bytes.Buffer
+	err := EncodeAll(&buf, []Page{
+		{Image: mask, Type: SubfileMask, Photometric: pi(PhotometricTransMask)},
+		{Image: mask, Photometric: pi(PhotometricWhiteIsZero)},
+		{Image: image.NewNRGBA(image.Rect(0, 0, 2, 2)), Photometric: pi(PhotometricRGB)},
+		{Image: mask},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range []int{PhotometricTransMask, PhotometricWhiteIsZero, PhotometricRGB, PhotometricBlackIsZero} {
+		r, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{Image: k})
+		if err != nil {
+			t.Fatalf("image %d: %v", k, err)
+		}
+		if got := r.Photometric(); got != want {
+			t.Errorf("image %d: Photometric() = %d, want %d", k, got, want)
+		}
+		m, err := r.ReadRegion(r.Bounds())
+		if err != nil {
+			t.Fatalf("image %d: %v", k, err)
+		}
+		// The samples are as they were written.
+		if f, ok := m.(*GrayFloat32); ok {
+			comparePix(t, f.Pix, mask.Pix)
+		}
+	}
+
+	for _, pg := range []Page{
+		{Image: mask, Photometric: pi(PhotometricRGB)},
+		{Image: image.NewNRGBA(image.Rect(0, 0, 2, 2)), Photometric: pi(PhotometricWhiteIsZero)},
+		{Image: image.NewGray(image.Rect(0, 0, 2, 2)), JPEG: &jpeg.Options{}, Photometric: pi(PhotometricBlackIsZero)},
+	} {
+		if err := EncodeAll(io.Discard, []Page{pg}, nil); err == nil {
+			t.Errorf("%T given photometric %d: no error", pg.Image, *pg.Photometric)
+		}
+	}
+}
+
+func TestEncodePalette16(t *testing.T) {
+	r := image.Rect(0, 0, 40, 20)
+	m := NewGray32(r)
+	m.Palette = make(color.Palette, 3000)
+	for i := range m.Palette {
+		m.Palette[i] = color.RGBA64{uint16(i * 20), uint16(0xffff - i*20), uint16(i), 0xffff}
+	}
+	for i := range m.Pix {
+		m.Pix[i] = uint32(i*7) % 3000
+	}
+	for _, e := range []*Encoder{
+		{},
+		{Options: &tiff.Options{Compression: tiff.Deflate, Predictor: true}, TileWidth: 16, TileHeight: 16},
+	} {
+		var buf bytes.Buffer
+		if err := e.Encode(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		rd, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pi := rd.Photometric(); pi != PhotometricPaletted {
+			t.Errorf("Photometric = %d", pi)
+		}
+		got, err := rd.ReadRegion(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, ok := got.(*Gray32)
+		if !ok || len(g.Palette) != 1<<16 {
+			t.Fatalf("decoded a %T", got)
+		}
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				if c, want := g.Gray32At(x, y), m.Gray32At(x, y); c != want {
+					t.Fatalf("Gray32At(%d, %d) = %v, want %v", x, y, c, want)
+				}
+				if c, want := g.At(x, y), m.At(x, y); c != want {
+					t.Fatalf("At(%d, %d) = %v, want %v", x, y, c, want)
+				}
+			}
+		}
+		if c := g.Palette[3000]; c != (color.RGBA64{A: 0xffff}) {
+			t.Errorf("padding color = %v", c)
+		}
+
+		rd, err = NewReaderWithOptions(bytes.NewReader(buf.Bytes()), &ReaderOptions{ExpandPalette: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rgba, err := rd.ReadRegion(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, want := rgba.At(5, 3), color.RGBAModel.Convert(m.At(5, 3)); c != want {
+			t.Errorf("expanded At(5, 3) = %v, want %v", c, want)
+		}
+	}
+
+	bad := NewGray32(r)
+	bad.Palette = color.Palette{color.Black}
+	bad.Pix[3] = 1
+	if err := Encode(io.Discard, bad, nil); err == nil {
+		t.Error("Encode accepted a sample beyond the palette")
+	}
+	bad.Pix[3] = 0
+	pi := PhotometricBlackIsZero
+	if err := EncodeAll(io.Discard, []Page{{Image: bad, Photometric: &pi}}, nil); err == nil {
+		t.Error("EncodeAll accepted a gray PhotometricInterpretation for a paletted image")
+	}
+	bad.Palette = make(color.Palette, 1<<16+1)
+	if err := Encode(io.Discard, bad, nil); err == nil {
+		t.Error("Encode accepted a palette of more than 65536 colors")
+	}
+}
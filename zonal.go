@@ -0,0 +1,67 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import "math"
+
+// Stats are the statistics of the samples of a zone of an image.
+type Stats struct {
+	Count    int // Samples with data; the others are left out.
+	Min, Max float64
+	Mean     float64
+	StdDev   float64 // Of the population of samples.
+}
+
+// ZonalStats computes the statistics of the samples of values in each zone
+// of zones, a raster of zone ids such as a classification, in a single
+// pass over the pixels. Only the pixels in the bounds of both images are
+// counted, and NaN samples hold no data: a zone whose samples all lack
+// data has a Count of zero and NaN statistics.
+func ZonalStats(values *GrayFloat32, zones *Gray32) map[uint32]Stats {
+	type acc struct {
+		n             int
+		min, max      float64
+		mean, squares float64 // Running mean and sum of squared deviations.
+	}
+	accs := make(map[uint32]*acc)
+	r := values.Rect.Intersect(zones.Rect)
+	var last *acc
+	lastID := uint32(0)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		vs := values.Pix[values.PixOffset(r.Min.X, y):][:r.Dx()]
+		for i, id := range zones.Pix[zones.PixOffset(r.Min.X, y):][:r.Dx()] {
+			// Zones come in runs along rows, so the zone of the previous
+			// pixel is tried before the map.
+			a := last
+			if a == nil || id != lastID {
+				if a = accs[id]; a == nil {
+					a = &acc{min: math.Inf(1), max: math.Inf(-1)}
+					accs[id] = a
+				}
+				last, lastID = a, id
+			}
+			v := float64(math.Float32frombits(vs[i]))
+			if math.IsNaN(v) {
+				continue
+			}
+			// Welford's method keeps the variance accurate in one pass.
+			a.n++
+			d := v - a.mean
+			a.mean += d / float64(a.n)
+			a.squares += d * (v - a.mean)
+			a.min, a.max = min(a.min, v), max(a.max, v)
+		}
+	}
+	stats := make(map[uint32]Stats, len(accs))
+	for id, a := range accs {
+		if a.n == 0 {
+			nan := math.NaN()
+			stats[id] = Stats{Min: nan, Max: nan, Mean: nan, StdDev: nan}
+			continue
+		}
+		stats[id] = Stats{Count: a.n, Min: a.min, Max: a.max, Mean: a.mean, StdDev: math.Sqrt(a.squares / float64(a.n))}
+	}
+	return stats
+}
@@ -0,0 +1,1825 @@
+// Copyright 2019 Hong-Ping Lo. All rights reserved.
+// Use of this source code is governed by a BDS-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// With ZSTD compression, as written by libtiff, each strip or tile is a
+// Zstandard frame (RFC 8878): blocks of literals, Huffman coded, and of
+// sequences copying earlier data, FSE coded. This file implements the
+// decoding of frames into memory, and an encoder finding the sequences
+// over hash chains and fitting the codes to each block.
+
+var errZSTD = FormatError("invalid ZSTD data")
+
+const (
+	zstdMagic          = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50 // Of skippable frames, in the high 28 bits.
+	zstdMaxBlock       = 128 << 10  // Largest block, unless the window is smaller.
+	zstdMaxDictionary  = 1 << 20
+)
+
+// ZSTDOptions are the options of ZSTD compression.
+type ZSTDOptions struct {
+	// Level trades speed for size, from 1, the fastest, to 22, the
+	// smallest, as for the zstd tool. Zero stands for 9, the default of
+	// GDAL.
+	Level int
+	// WindowLog is the base 2 logarithm of how far back in a strip or
+	// tile repeated data is looked for, from 10 to 27. Zero stands for
+	// 22. A long window finds the repetitions of rasters that repeat
+	// themselves at a distance, such as the rows of wide strips of
+	// land-cover classes, at the cost of the memory readers need to
+	// decode; most refuse windows of more than 2^27 bytes.
+	WindowLog int
+	// DictionarySize, if positive, makes the tiles of each image share a
+	// dictionary of up to that many bytes, at most 1 MiB, made of pieces
+	// of tiles spread over the image, against which every tile is
+	// compressed. Small tiles of self-similar rasters then compress much
+	// better, but only this package can read the file: the dictionary is
+	// held in the private ZSTDDictionary field, unknown to other readers.
+	// It does not apply to images stored in a single strip.
+	DictionarySize int
+}
+
+// check reports an error unless the options are valid.
+func (o *ZSTDOptions) check() error {
+	switch {
+	case o.Level < 0 || o.Level > 22:
+		return fmt.Errorf("tiff: invalid ZSTD level %d", o.Level)
+	case o.WindowLog != 0 && (o.WindowLog < 10 || o.WindowLog > 27):
+		return fmt.Errorf("tiff: invalid ZSTD window log %d", o.WindowLog)
+	case o.DictionarySize < 0 || o.DictionarySize > zstdMaxDictionary:
+		return fmt.Errorf("tiff: invalid ZSTD dictionary size %d", o.DictionarySize)
+	}
+	return nil
+}
+
+// The codes of literal and match lengths: the number of extra bits
+// following each code, and the lengths they add to, which are worked out
+// from them.
+var (
+	llBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	}
+	mlBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	}
+	llBase = codeBases(llBits[:], 0)
+	mlBase = codeBases(mlBits[:], 3)
+)
+
+func codeBases(extra []uint8, first uint32) []uint32 {
+	base := make([]uint32, len(extra))
+	for i := range base {
+		base[i] = first
+		first += 1 << extra[i]
+	}
+	return base
+}
+
+// The distributions of the predefined FSE tables of the sequence codes.
+// A count of -1 stands for a probability below 1.
+var (
+	llDefault = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	mlDefault = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	ofDefault = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+)
+
+// The kinds of sequence code tables, which are the predefined one, a
+// table of the counts of one code, a table of counts described in the
+// block and the table of the previous block.
+const (
+	seqPredefined = iota
+	seqRLE
+	seqCompressed
+	seqRepeat
+)
+
+// A seqCodes describes one of the three kinds of codes of sequences.
+type seqCodes struct {
+	maxSymbol, maxLog int
+	defaultLog        int
+	defaults          []int16
+}
+
+var (
+	llCodes = &seqCodes{35, 9, 6, llDefault}
+	ofCodes = &seqCodes{31, 8, 5, ofDefault}
+	mlCodes = &seqCodes{52, 9, 6, mlDefault}
+)
+
+// zstdReps holds the three offsets of sequences last used, which later
+// sequences can repeat by number.
+type zstdReps [3]int
+
+var zstdInitialReps = zstdReps{1, 4, 8}
+
+// offset returns the offset of a sequence of litLen literals with the
+// offset value v, updating the offsets last used. It is 0 if the offset
+// is invalid.
+func (r *zstdReps) offset(v, litLen int) int {
+	if v > 3 {
+		r[2], r[1], r[0] = r[1], r[0], v-3
+		return r[0]
+	}
+	if litLen == 0 {
+		v++
+	}
+	var off int
+	switch v {
+	case 1:
+		return r[0]
+	case 2:
+		off, r[1] = r[1], r[0]
+	case 3:
+		off, r[2], r[1] = r[2], r[1], r[0]
+	case 4:
+		off, r[2], r[1] = r[0]-1, r[1], r[0]
+	}
+	r[0] = off
+	return off
+}
+
+// code returns the offset value of a sequence of litLen literals copying
+// data off bytes back, repeating an offset last used if possible.
+func (r *zstdReps) code(off, litLen int) int {
+	if litLen > 0 {
+		switch off {
+		case r[0]:
+			return 1
+		case r[1]:
+			return 2
+		case r[2]:
+			return 3
+		}
+	} else {
+		switch off {
+		case r[1]:
+			return 1
+		case r[2]:
+			return 2
+		case r[0] - 1:
+			return 3
+		}
+	}
+	return off + 3
+}
+
+// A bitReader reads a bit stream backwards, from its last byte, whose
+// highest set bit marks the start of the stream.
+type bitReader struct {
+	p []byte // Bytes not yet loaded, read from the end.
+	v uint64 // Bits loaded, of which the n lowest are unread.
+	n int    // Negative once more bits were read than the stream holds.
+}
+
+func (b *bitReader) init(p []byte) error {
+	if len(p) == 0 || p[len(p)-1] == 0 {
+		return errZSTD
+	}
+	last := p[len(p)-1]
+	b.p, b.v, b.n = p[:len(p)-1], uint64(last), bits.Len8(last)-1
+	b.fill()
+	return nil
+}
+
+func (b *bitReader) fill() {
+	for b.n <= 56 && len(b.p) > 0 {
+		b.v = b.v<<8 | uint64(b.p[len(b.p)-1])
+		b.p = b.p[:len(b.p)-1]
+		b.n += 8
+	}
+}
+
+// peek returns the next k bits, k being at most 32, zero past the end of
+// the stream.
+func (b *bitReader) peek(k int) int {
+	if b.n < k {
+		b.fill()
+	}
+	var v uint64
+	if b.n >= k {
+		v = b.v >> uint(b.n-k)
+	} else if b.n >= 0 {
+		v = b.v << uint(k-b.n)
+	}
+	return int(v & (1<<k - 1))
+}
+
+func (b *bitReader) read(k int) int {
+	v := b.peek(k)
+	b.n -= k
+	return v
+}
+
+// done reports whether the stream was read exactly.
+func (b *bitReader) done() bool {
+	return b.n == 0 && len(b.p) == 0
+}
+
+// A bitWriter writes the bit streams bitReader reads, as well as the FSE
+// table descriptions, which are read forwards.
+type bitWriter struct {
+	out []byte
+	v   uint64
+	n   uint
+}
+
+// add writes the k low bits of v, k being at most 32.
+func (w *bitWriter) add(v uint64, k uint) {
+	w.v |= (v & (1<<k - 1)) << w.n
+	w.n += k
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.v))
+		w.v >>= 8
+		w.n -= 8
+	}
+}
+
+// flush pads the bits written to a whole number of bytes.
+func (w *bitWriter) flush() []byte {
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.v))
+	}
+	w.v, w.n = 0, 0
+	return w.out
+}
+
+// close ends a stream read backwards with the bit marking its start.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	return w.flush()
+}
+
+// An fseTable decodes FSE data: the symbol of each state and the next
+// state, at base plus the value of the nbBits bits that follow.
+type fseTable struct {
+	log     int
+	entries []fseEntry
+}
+
+type fseEntry struct {
+	symbol uint8
+	nbBits uint8
+	base   uint16
+}
+
+func predefinedTable(c *seqCodes) *fseTable {
+	t := new(fseTable)
+	if err := t.build(c.defaults, c.defaultLog); err != nil {
+		panic(err)
+	}
+	return t
+}
+
+var (
+	llPredefined = predefinedTable(llCodes)
+	ofPredefined = predefinedTable(ofCodes)
+	mlPredefined = predefinedTable(mlCodes)
+)
+
+// spreadSymbols lays out the symbols of the distribution norm over the
+// states of a table of 1<<log states, in symbols.
+func spreadSymbols(symbols []uint8, norm []int16, log int) error {
+	size := 1 << log
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			symbols[pos] = uint8(s)
+			for {
+				pos = (pos + step) & (size - 1)
+				if pos <= high {
+					break
+				}
+			}
+		}
+	}
+	if pos != 0 {
+		return errZSTD
+	}
+	return nil
+}
+
+// build sets up t to decode data of the distribution norm, which sums to
+// 1 << log.
+func (t *fseTable) build(norm []int16, log int) error {
+	size := 1 << log
+	t.log = log
+	if cap(t.entries) < size {
+		t.entries = make([]fseEntry, size)
+	}
+	t.entries = t.entries[:size]
+	var symbols [1 << 9]uint8
+	if err := spreadSymbols(symbols[:size], norm, log); err != nil {
+		return err
+	}
+	var next [64]uint16
+	for s, c := range norm {
+		next[s] = uint16(max(c, 1))
+	}
+	for i := range t.entries {
+		s := symbols[i]
+		n := next[s]
+		next[s]++
+		nb := log + 1 - bits.Len16(n)
+		t.entries[i] = fseEntry{s, uint8(nb), n<<nb - uint16(size)}
+	}
+	return nil
+}
+
+// rle sets up t to decode a single symbol.
+func (t *fseTable) rle(symbol uint8) {
+	t.log = 0
+	t.entries = append(t.entries[:0], fseEntry{symbol: symbol})
+}
+
+// readFSECounts reads the FSE table description at the start of p, of at
+// most maxSymbol+1 symbols and 1<<maxLog states. It returns the
+// distribution, the log of its sum and the size of the description.
+func readFSECounts(p []byte, maxSymbol, maxLog int) (norm []int16, log, size int, err error) {
+	if len(p) == 0 {
+		return nil, 0, 0, errZSTD
+	}
+	pos := 0 // In bits.
+	peek := func() int {
+		var v uint32
+		for i := 0; i < 4 && pos/8+i < len(p); i++ {
+			v |= uint32(p[pos/8+i]) << (8 * i)
+		}
+		return int(v >> (pos % 8))
+	}
+	log = int(p[0]&15) + 5
+	if log > maxLog {
+		return nil, 0, 0, errZSTD
+	}
+	pos = 4
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	for remaining > 1 {
+		if len(norm) > maxSymbol {
+			return nil, 0, 0, errZSTD
+		}
+		v := peek()
+		limit := 2*threshold - 1 - remaining
+		var count int
+		if v&(threshold-1) < limit {
+			count = v & (threshold - 1)
+			pos += nbBits - 1
+		} else {
+			count = v & (2*threshold - 1)
+			if count >= threshold {
+				count -= limit
+			}
+			pos += nbBits
+		}
+		// Counts are stored plus one, so that -1 can be.
+		count--
+		remaining -= max(count, -count)
+		if remaining < 1 {
+			return nil, 0, 0, errZSTD
+		}
+		norm = append(norm, int16(count))
+		if count == 0 {
+			// The number of symbols of probability 0 that follow comes
+			// in 2-bit pieces, each 3 announcing another.
+			for {
+				r := peek() & 3
+				pos += 2
+				norm = append(norm, make([]int16, r)...)
+				if r != 3 {
+					break
+				}
+			}
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if len(norm) > maxSymbol+1 || (pos+7)/8 > len(p) {
+		return nil, 0, 0, errZSTD
+	}
+	return norm, log, (pos + 7) / 8, nil
+}
+
+// appendFSECounts appends the description of the distribution norm, which
+// sums to 1 << log, to dst.
+func appendFSECounts(dst []byte, norm []int16, log int) []byte {
+	w := bitWriter{out: dst}
+	w.add(uint64(log-5), 4)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := uint(log + 1)
+	previous0 := false
+	for s := 0; remaining > 1; {
+		if previous0 {
+			start := s
+			for norm[s] == 0 {
+				s++
+			}
+			for ; s >= start+3; start += 3 {
+				w.add(3, 2)
+			}
+			w.add(uint64(s-start), 2)
+		}
+		count := int(norm[s])
+		s++
+		limit := 2*threshold - 1 - remaining
+		remaining -= max(count, -count)
+		count++
+		if count >= threshold {
+			count += limit
+		}
+		n := nbBits
+		if count < limit {
+			n--
+		}
+		w.add(uint64(count), n)
+		previous0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	return w.flush()
+}
+
+// A huffTable decodes Huffman coded literals by the next maxBits bits.
+type huffTable struct {
+	maxBits int
+	entries []huffEntry
+}
+
+type huffEntry struct {
+	symbol, nbBits uint8
+}
+
+const huffMaxBits = 11
+
+// read reads the Huffman tree description at the start of p into t and
+// returns its size.
+func (t *huffTable) read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, errZSTD
+	}
+	var weights [256]uint8
+	var n, size int
+	if h := int(p[0]); h >= 128 {
+		// The weights are given directly, 4 bits each.
+		n, size = h-127, 1+(h-126)/2
+		if len(p) < size {
+			return 0, errZSTD
+		}
+		for i := 0; i < n; i++ {
+			weights[i] = p[1+i/2] >> (4 * (1 - i%2)) & 15
+		}
+	} else {
+		size = 1 + h
+		if len(p) < size {
+			return 0, errZSTD
+		}
+		var err error
+		if n, err = decodeWeights(p[1:size], weights[:255]); err != nil {
+			return 0, err
+		}
+	}
+	total := 0
+	for _, w := range weights[:n] {
+		if w > huffMaxBits {
+			return 0, errZSTD
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return 0, errZSTD
+	}
+	// The weight of the last symbol is implied: it completes the code.
+	maxBits := bits.Len(uint(total))
+	rest := 1<<maxBits - total
+	if maxBits > huffMaxBits || rest&(rest-1) != 0 {
+		return 0, errZSTD
+	}
+	weights[n] = uint8(bits.Len(uint(rest)))
+	n++
+
+	t.maxBits = maxBits
+	if cap(t.entries) < 1<<maxBits {
+		t.entries = make([]huffEntry, 1<<huffMaxBits)
+	}
+	t.entries = t.entries[:1<<maxBits]
+	// The shortest codes, of the highest weights, come last.
+	pos := 0
+	for w := 1; w <= maxBits; w++ {
+		for s, sw := range weights[:n] {
+			if int(sw) != w {
+				continue
+			}
+			e := huffEntry{uint8(s), uint8(maxBits + 1 - w)}
+			for i := 0; i < 1<<(w-1); i++ {
+				t.entries[pos+i] = e
+			}
+			pos += 1 << (w - 1)
+		}
+	}
+	return size, nil
+}
+
+// decodeWeights decodes the FSE compressed Huffman weights in p into out,
+// returning their number.
+func decodeWeights(p []byte, out []uint8) (int, error) {
+	norm, log, size, err := readFSECounts(p, huffMaxBits, 6)
+	if err != nil {
+		return 0, err
+	}
+	var t fseTable
+	if err := t.build(norm, log); err != nil {
+		return 0, err
+	}
+	var br bitReader
+	if err := br.init(p[size:]); err != nil {
+		return 0, err
+	}
+	// Two states take turns, the stream ending once it is exhausted.
+	s1, s2 := br.read(log), br.read(log)
+	n := 0
+	for {
+		if n+2 > len(out) {
+			return 0, errZSTD
+		}
+		e := t.entries[s1]
+		out[n] = e.symbol
+		n++
+		s1 = int(e.base) + br.read(int(e.nbBits))
+		if br.n < 0 {
+			out[n] = t.entries[s2].symbol
+			return n + 1, nil
+		}
+		e = t.entries[s2]
+		out[n] = e.symbol
+		n++
+		s2 = int(e.base) + br.read(int(e.nbBits))
+		if br.n < 0 {
+			out[n] = t.entries[s1].symbol
+			return n + 1, nil
+		}
+	}
+}
+
+// decode fills dst with the symbols of the Huffman coded stream p.
+func (t *huffTable) decode(dst, p []byte) error {
+	var br bitReader
+	if err := br.init(p); err != nil {
+		return err
+	}
+	mask := 1<<t.maxBits - 1
+	for i := range dst {
+		e := t.entries[br.peek(t.maxBits)&mask]
+		dst[i] = e.symbol
+		br.n -= int(e.nbBits)
+	}
+	if !br.done() {
+		return errZSTD
+	}
+	return nil
+}
+
+// A zstdDecoder holds the state of frames being decoded.
+type zstdDecoder struct {
+	reps       zstdReps
+	huff       huffTable
+	haveHuff   bool
+	ll, of, ml *fseTable
+	tables     [3]fseTable // Described in blocks, for ll, of and ml.
+	lits       []byte
+	hist       []byte // The dictionary, followed by the frame so far.
+	maxBlock   int    // Largest block of the frame, of the window at most.
+}
+
+// decodeZstd decompresses the ZSTD frames making up src, which must not
+// hold more than lim bytes, with the raw content dictionary dict, which
+// may be nil.
+func decodeZstd(src, dict []byte, lim int64) ([]byte, error) {
+	var z zstdDecoder
+	var out []byte
+	if len(src) == 0 {
+		return nil, errZSTD
+	}
+	for len(src) > 0 {
+		if len(src) < 8 {
+			return nil, errZSTD
+		}
+		magic := binary.LittleEndian.Uint32(src)
+		if magic&^15 == zstdSkippableMagic {
+			n := uint64(binary.LittleEndian.Uint32(src[4:]))
+			if n > uint64(len(src)-8) {
+				return nil, errZSTD
+			}
+			src = src[8+n:]
+			continue
+		}
+		if magic != zstdMagic {
+			return nil, errZSTD
+		}
+		var err error
+		if out, src, err = z.frame(out, src[4:], dict, lim-int64(len(out))); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// frame appends the content of the frame at the start of p, less its
+// magic number, to dst, and returns what follows the frame.
+func (z *zstdDecoder) frame(dst, p, dict []byte, lim int64) (out, rest []byte, err error) {
+	fhd := p[0]
+	p = p[1:]
+	if fhd&8 != 0 {
+		return nil, nil, errZSTD
+	}
+	single, checksum := fhd&0x20 != 0, fhd&4 != 0
+	// The window holds the whole frame in memory, but bounds its blocks.
+	z.maxBlock = zstdMaxBlock
+	if !single {
+		if len(p) == 0 {
+			return nil, nil, errZSTD
+		}
+		wlog := 10 + int(p[0]>>3)
+		if wlog < 17 {
+			window := 1<<wlog + 1<<wlog/8*int(p[0]&7)
+			z.maxBlock = min(window, zstdMaxBlock)
+		}
+		p = p[1:]
+	}
+	idSize := [4]int{0, 1, 2, 4}[fhd&3]
+	fcsSize := [4]int{0, 2, 4, 8}[fhd>>6]
+	if fcsSize == 0 && single {
+		fcsSize = 1
+	}
+	if len(p) < idSize+fcsSize {
+		return nil, nil, errZSTD
+	}
+	var id uint32
+	for i := idSize - 1; i >= 0; i-- {
+		id = id<<8 | uint32(p[i])
+	}
+	if id != 0 && dict == nil {
+		return nil, nil, UnsupportedError{Feature: fmt.Sprintf("ZSTD dictionary %d", id)}
+	}
+	p = p[idSize:]
+	var fcs uint64
+	for i := fcsSize - 1; i >= 0; i-- {
+		fcs = fcs<<8 | uint64(p[i])
+	}
+	if fcsSize == 2 {
+		fcs += 256
+	}
+	p = p[fcsSize:]
+	if fcsSize > 0 && fcs > uint64(lim) {
+		return nil, nil, errZSTD
+	}
+	if single {
+		// The window is the content.
+		z.maxBlock = int(min(fcs, zstdMaxBlock))
+	}
+
+	z.reps, z.haveHuff = zstdInitialReps, false
+	z.ll, z.of, z.ml = nil, nil, nil
+	buf := append(z.hist[:0], dict...)
+	for last := false; !last; {
+		if len(p) < 3 {
+			return nil, nil, errZSTD
+		}
+		h := int(p[0]) | int(p[1])<<8 | int(p[2])<<16
+		p = p[3:]
+		last = h&1 != 0
+		size := h >> 3
+		if size > z.maxBlock {
+			return nil, nil, errZSTD
+		}
+		switch h >> 1 & 3 {
+		case 0:
+			if len(p) < size {
+				return nil, nil, errZSTD
+			}
+			buf = append(buf, p[:size]...)
+			p = p[size:]
+		case 1:
+			if len(p) < 1 {
+				return nil, nil, errZSTD
+			}
+			for i := 0; i < size; i++ {
+				buf = append(buf, p[0])
+			}
+			p = p[1:]
+		case 2:
+			if len(p) < size {
+				return nil, nil, errZSTD
+			}
+			if buf, err = z.block(buf, p[:size]); err != nil {
+				return nil, nil, err
+			}
+			p = p[size:]
+		default:
+			return nil, nil, errZSTD
+		}
+		if int64(len(buf)-len(dict)) > lim {
+			return nil, nil, errZSTD
+		}
+	}
+	z.hist = buf
+	content := buf[len(dict):]
+	if fcsSize > 0 && uint64(len(content)) != fcs {
+		return nil, nil, errZSTD
+	}
+	if checksum {
+		if len(p) < 4 {
+			return nil, nil, errZSTD
+		}
+		if uint32(xxhash64(content)) != binary.LittleEndian.Uint32(p) {
+			return nil, nil, FormatError("ZSTD checksum mismatch")
+		}
+		p = p[4:]
+	}
+	return append(dst, content...), p, nil
+}
+
+// block decodes the compressed block p, appending it to buf, which holds
+// what precedes it.
+func (z *zstdDecoder) block(buf, p []byte) ([]byte, error) {
+	start := len(buf)
+	lits, n, err := z.literals(p)
+	if err != nil {
+		return nil, err
+	}
+	p = p[n:]
+	if len(p) == 0 {
+		return nil, errZSTD
+	}
+	nbSeq := int(p[0])
+	p = p[1:]
+	switch {
+	case nbSeq == 255:
+		if len(p) < 2 {
+			return nil, errZSTD
+		}
+		nbSeq = int(p[0]) + int(p[1])<<8 + 0x7f00
+		p = p[2:]
+	case nbSeq >= 128:
+		if len(p) < 1 {
+			return nil, errZSTD
+		}
+		nbSeq = (nbSeq-128)<<8 + int(p[0])
+		p = p[1:]
+	}
+	if nbSeq == 0 {
+		if len(p) != 0 {
+			return nil, errZSTD
+		}
+		return append(buf, lits...), nil
+	}
+	if len(p) == 0 || p[0]&3 != 0 {
+		return nil, errZSTD
+	}
+	modes := p[0]
+	p = p[1:]
+	for i, t := range []struct {
+		cur      **fseTable
+		own      *fseTable
+		shift    uint
+		codes    *seqCodes
+		defaults *fseTable
+	}{
+		{&z.ll, &z.tables[0], 6, llCodes, llPredefined},
+		{&z.of, &z.tables[1], 4, ofCodes, ofPredefined},
+		{&z.ml, &z.tables[2], 2, mlCodes, mlPredefined},
+	} {
+		switch modes >> t.shift & 3 {
+		case seqPredefined:
+			*t.cur = t.defaults
+		case seqRLE:
+			if len(p) == 0 || int(p[0]) > t.codes.maxSymbol {
+				return nil, errZSTD
+			}
+			t.own.rle(p[0])
+			*t.cur, p = t.own, p[1:]
+		case seqCompressed:
+			norm, log, n, err := readFSECounts(p, t.codes.maxSymbol, t.codes.maxLog)
+			if err != nil {
+				return nil, err
+			}
+			if err := t.own.build(norm, log); err != nil {
+				return nil, err
+			}
+			*t.cur, p = t.own, p[n:]
+		case seqRepeat:
+			if *t.cur == nil {
+				return nil, fmt.Errorf("tiff: ZSTD table %d repeated before being set", i)
+			}
+		}
+	}
+
+	var br bitReader
+	if err := br.init(p); err != nil {
+		return nil, err
+	}
+	ll, of, ml := z.ll, z.of, z.ml
+	lls, ofs, mls := br.read(ll.log), br.read(of.log), br.read(ml.log)
+	for i := 0; i < nbSeq; i++ {
+		lc, oc, mc := ll.entries[lls].symbol, of.entries[ofs].symbol, ml.entries[mls].symbol
+		v := 1<<oc + br.read(int(oc))
+		matchLen := int(mlBase[mc]) + br.read(int(mlBits[mc]))
+		litLen := int(llBase[lc]) + br.read(int(llBits[lc]))
+		off := z.reps.offset(v, litLen)
+		if i < nbSeq-1 {
+			e := ll.entries[lls]
+			lls = int(e.base) + br.read(int(e.nbBits))
+			e = ml.entries[mls]
+			mls = int(e.base) + br.read(int(e.nbBits))
+			e = of.entries[ofs]
+			ofs = int(e.base) + br.read(int(e.nbBits))
+		}
+		if litLen > len(lits) || len(buf)-start+litLen+matchLen > z.maxBlock {
+			return nil, errZSTD
+		}
+		buf = append(buf, lits[:litLen]...)
+		lits = lits[litLen:]
+		if off <= 0 || off > len(buf) {
+			return nil, errZSTD
+		}
+		buf = appendMatch(buf, off, matchLen)
+	}
+	if !br.done() || len(buf)-start+len(lits) > z.maxBlock {
+		return nil, errZSTD
+	}
+	return append(buf, lits...), nil
+}
+
+// appendMatch appends the n bytes starting off bytes from the end of buf
+// to it, repeating them if n is larger than off.
+func appendMatch(buf []byte, off, n int) []byte {
+	start := len(buf) - off
+	for n > 0 {
+		k := min(n, len(buf)-start)
+		buf = append(buf, buf[start:start+k]...)
+		n -= k
+	}
+	return buf
+}
+
+// Kinds of literals sections.
+const (
+	litRaw = iota
+	litRLE
+	litCompressed
+	litTreeless // Reusing the Huffman table of the previous block.
+)
+
+// literals decodes the literals section at the start of p, returning the
+// literals and the size of the section.
+func (z *zstdDecoder) literals(p []byte) ([]byte, int, error) {
+	if len(p) == 0 {
+		return nil, 0, errZSTD
+	}
+	kind, format := p[0]&3, p[0]>>2&3
+	if kind == litRaw || kind == litRLE {
+		var regen, header int
+		switch format {
+		case 0, 2:
+			regen, header = int(p[0]>>3), 1
+		case 1:
+			if len(p) < 2 {
+				return nil, 0, errZSTD
+			}
+			regen, header = int(p[0]>>4)|int(p[1])<<4, 2
+		case 3:
+			if len(p) < 3 {
+				return nil, 0, errZSTD
+			}
+			regen, header = int(p[0]>>4)|int(p[1])<<4|int(p[2])<<12, 3
+		}
+		if regen > z.maxBlock {
+			return nil, 0, errZSTD
+		}
+		if kind == litRaw {
+			if len(p) < header+regen {
+				return nil, 0, errZSTD
+			}
+			return p[header : header+regen], header + regen, nil
+		}
+		if len(p) < header+1 {
+			return nil, 0, errZSTD
+		}
+		z.lits = append(z.lits[:0], bytes.Repeat(p[header:header+1], regen)...)
+		return z.lits, header + 1, nil
+	}
+
+	var regen, size, header int
+	streams := 4
+	if len(p) < 5 {
+		// The shortest section has 3 bytes of header and 2 of data.
+		return nil, 0, errZSTD
+	}
+	v := int(binary.LittleEndian.Uint32(p))
+	switch format {
+	case 0, 1:
+		if format == 0 {
+			streams = 1
+		}
+		regen, size, header = v>>4&0x3ff, v>>14&0x3ff, 3
+	case 2:
+		regen, size, header = v>>4&0x3fff, v>>18, 4
+	case 3:
+		regen, size, header = v>>4&0x3ffff, v>>22|int(p[4])<<10, 5
+	}
+	if regen > z.maxBlock || len(p) < header+size {
+		return nil, 0, errZSTD
+	}
+	q := p[header : header+size]
+	if kind == litCompressed {
+		n, err := z.huff.read(q)
+		if err != nil {
+			return nil, 0, err
+		}
+		q, z.haveHuff = q[n:], true
+	} else if !z.haveHuff {
+		return nil, 0, errZSTD
+	}
+	if cap(z.lits) < regen {
+		z.lits = make([]byte, regen)
+	}
+	lits := z.lits[:regen]
+	if streams == 1 {
+		if err := z.huff.decode(lits, q); err != nil {
+			return nil, 0, err
+		}
+		return lits, header + size, nil
+	}
+	if len(q) < 6 {
+		return nil, 0, errZSTD
+	}
+	seg := (regen + 3) / 4
+	ends := [4]int{int(binary.LittleEndian.Uint16(q)), 0, 0, len(q) - 6}
+	ends[1] = ends[0] + int(binary.LittleEndian.Uint16(q[2:]))
+	ends[2] = ends[1] + int(binary.LittleEndian.Uint16(q[4:]))
+	if ends[2] > ends[3] || 3*seg > regen {
+		return nil, 0, errZSTD
+	}
+	q = q[6:]
+	from := 0
+	for i, end := range ends {
+		dst := lits[i*seg : min((i+1)*seg, regen)]
+		if err := z.huff.decode(dst, q[from:end]); err != nil {
+			return nil, 0, err
+		}
+		from = end
+	}
+	return lits, header + size, nil
+}
+
+// The xxHash64 hash of data, with a seed of 0, which ZSTD frames may end
+// with the low 32 bits of.
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, v uint64) uint64 {
+	return bits.RotateLeft64(acc+v*xxPrime2, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	return (acc^xxRound(0, v))*xxPrime1 + xxPrime4
+}
+
+func xxhash64(p []byte) uint64 {
+	n := uint64(len(p))
+	var h uint64
+	if len(p) >= 32 {
+		var seed uint64
+		v1, v2, v3, v4 := seed+xxPrime1+xxPrime2, seed+xxPrime2, seed, seed-xxPrime1
+		for ; len(p) >= 32; p = p[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(p))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(p[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(p[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(p[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMerge(xxMerge(xxMerge(xxMerge(h, v1), v2), v3), v4)
+	} else {
+		h = xxPrime5
+	}
+	h += n
+	for ; len(p) >= 8; p = p[8:] {
+		h = bits.RotateLeft64(h^xxRound(0, binary.LittleEndian.Uint64(p)), 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		h = bits.RotateLeft64(h^uint64(binary.LittleEndian.Uint32(p))*xxPrime1, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h = bits.RotateLeft64(h^uint64(b)*xxPrime5, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	return h ^ h>>32
+}
+
+// checkZSTD records the dictionary of the ZSTD compressed image, if any.
+func (d *decoder) checkZSTD() error {
+	_, dict, ok, err := d.entryData(TagZSTDDictionary)
+	if err != nil || !ok {
+		return err
+	}
+	d.zstdDictionary = dict
+	return nil
+}
+
+// zstdBlock decompresses the n bytes of ZSTD data in r.
+func (d *decoder) zstdBlock(r io.Reader, n int64) (io.ReadCloser, error) {
+	src, err := readBuf(r, nil, n)
+	if err != nil {
+		return nil, err
+	}
+	out, err := decodeZstd(src, d.zstdDictionary, d.blockBytes())
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
+
+// A zstdEncoder compresses blocks into ZSTD frames. It looks for earlier
+// occurrences of the data at each position through a table of the last
+// position of every hash of 4 bytes and a chain linking each position to
+// the previous one of the same hash, following up to depth links, and
+// with lazy matching checks whether a longer match starts at the next
+// lazy positions.
+type zstdEncoder struct {
+	depth, lazy       int
+	hashLog, chainLog int
+	hashShift         uint
+	windowLog         int
+	dict              []byte
+	buf               []byte   // The data being compressed, after dict.
+	joined            []byte   // The dictionary and data, copied.
+	head, chain       []uint32 // Positions plus one, 0 for none.
+	inserted          int      // Positions below are in the tables.
+	reps              zstdReps
+	seqs              []zstdSeq
+	lits              []byte
+	llc, ofc, mlc     []uint8 // Codes of the sequences.
+	tables            [3]fseCTable
+	huffBytes         []byte
+}
+
+// A zstdSeq is a sequence: litLen literals, then matchLen bytes copied
+// from earlier, at the offset of value offset.
+type zstdSeq struct {
+	litLen, matchLen, offset uint32
+}
+
+// newZSTDEncoder returns an encoder with the options o, which have been
+// checked, compressing against dict if not nil.
+func newZSTDEncoder(o *ZSTDOptions, dict []byte) *zstdEncoder {
+	level, wlog := o.Level, o.WindowLog
+	if level == 0 {
+		level = 9
+	}
+	if wlog == 0 {
+		wlog = 22
+	}
+	z := &zstdEncoder{windowLog: wlog, dict: dict}
+	z.depth = 1 << ((level - 1) * 10 / 21)
+	switch {
+	case level >= 7:
+		z.lazy = 2
+	case level >= 4:
+		z.lazy = 1
+	}
+	z.hashLog = min(wlog, 14+level/3)
+	z.chainLog = min(wlog, 16+level/3)
+	return z
+}
+
+// appendFrame compresses src into a frame appended to dst.
+func (z *zstdEncoder) appendFrame(dst, src []byte) []byte {
+	n := uint64(len(src))
+	// The frame is in a single segment, its window being its content, if
+	// no match reaches farther back.
+	single := len(z.dict) == 0 && n <= 1<<z.windowLog
+	var fcs []byte
+	switch {
+	case single && n < 256:
+		fcs = []byte{byte(n)}
+	case n >= 256 && n < 256+1<<16:
+		fcs = binary.LittleEndian.AppendUint16(nil, uint16(n-256))
+	case n <= math.MaxUint32:
+		fcs = binary.LittleEndian.AppendUint32(nil, uint32(n))
+	default:
+		fcs = binary.LittleEndian.AppendUint64(nil, n)
+	}
+	fhd := byte([]int{1: 0, 2: 1, 4: 2, 8: 3}[len(fcs)] << 6)
+	dst = binary.LittleEndian.AppendUint32(dst, zstdMagic)
+	if single {
+		dst = append(dst, fhd|0x20)
+	} else {
+		dst = append(dst, fhd, byte(z.windowLog-10)<<3)
+	}
+	dst = append(dst, fcs...)
+
+	z.buf = src
+	if len(z.dict) > 0 {
+		z.joined = append(append(z.joined[:0], z.dict...), src...)
+		z.buf = z.joined
+	}
+	z.reset()
+	// Blocks are no larger than the window, nor do matches reach beyond it.
+	blockSize := min(1<<z.windowLog, zstdMaxBlock)
+	for start := len(z.dict); ; {
+		end := min(start+blockSize, len(z.buf))
+		dst = z.appendBlock(dst, start, end, end == len(z.buf))
+		if end == len(z.buf) {
+			return dst
+		}
+		start = end
+	}
+}
+
+// reset readies the tables for new data in z.buf.
+func (z *zstdEncoder) reset() {
+	n := max(10, bits.Len(uint(len(z.buf))))
+	size := 1 << min(z.hashLog, n)
+	if cap(z.head) < size {
+		z.head = make([]uint32, size)
+	}
+	z.head = z.head[:size]
+	clear(z.head)
+	z.hashShift = 32 - uint(min(z.hashLog, n))
+	// The chain needs no clearing: the links of positions not inserted
+	// are never followed.
+	size = 1 << min(z.chainLog, n)
+	if cap(z.chain) < size {
+		z.chain = make([]uint32, size)
+	}
+	z.chain = z.chain[:size]
+	z.inserted = 0
+	z.reps = zstdInitialReps
+}
+
+func (z *zstdEncoder) hash(pos int) uint32 {
+	return binary.LittleEndian.Uint32(z.buf[pos:]) * 2654435761 >> z.hashShift
+}
+
+// insert enters the positions below pos into the tables.
+func (z *zstdEncoder) insert(pos int) {
+	mask := len(z.chain) - 1
+	for ; z.inserted < pos && z.inserted+4 <= len(z.buf); z.inserted++ {
+		h := z.hash(z.inserted)
+		z.chain[z.inserted&mask] = z.head[h]
+		z.head[h] = uint32(z.inserted + 1)
+	}
+}
+
+// matchLen returns the length of the common prefix of a and b, which is
+// no longer than a.
+func matchLen(a, b []byte) int {
+	n := 0
+	for len(a) >= 8 && len(b) >= 8 {
+		if x := binary.LittleEndian.Uint64(a) ^ binary.LittleEndian.Uint64(b); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		a, b, n = a[8:], b[8:], n+8
+	}
+	for i := 0; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+		n++
+	}
+	return n
+}
+
+// match returns the best match at pos, after litLen literals, that ends
+// by end, and how much it saves. The length is 0 if there is none.
+func (z *zstdEncoder) match(pos, litLen, end int) (length, off, gain int) {
+	z.insert(pos)
+	maxOff := min(pos, 1<<z.windowLog)
+	// Saving a byte is worth 4, and the offset costs about its bits.
+	try := func(o int) {
+		if o <= 0 || o > maxOff {
+			return
+		}
+		n := matchLen(z.buf[pos:end], z.buf[pos-o:])
+		if n < 4 {
+			return
+		}
+		if g := 4*n - bits.Len(uint(z.reps.code(o, litLen))); g > gain {
+			length, off, gain = n, o, g
+		}
+	}
+	for _, o := range z.reps {
+		try(o)
+	}
+	if litLen == 0 {
+		try(z.reps[0] - 1)
+	}
+	c := z.head[z.hash(pos)]
+	for tries := z.depth; c != 0 && tries > 0 && length < end-pos; tries-- {
+		cand := int(c) - 1
+		o := pos - cand
+		if o > maxOff {
+			break
+		}
+		if z.buf[cand+length] == z.buf[pos+length] {
+			try(o)
+		}
+		if o >= len(z.chain) {
+			// The link may have been overwritten by a later position.
+			break
+		}
+		c = z.chain[cand&(len(z.chain)-1)]
+	}
+	return length, off, gain
+}
+
+// parse splits z.buf[start:end] into sequences and literals.
+func (z *zstdEncoder) parse(start, end int) {
+	z.seqs, z.lits = z.seqs[:0], z.lits[:0]
+	anchor := start
+	for pos := start; pos+4 <= end; {
+		n, off, gain := z.match(pos, pos-anchor, end)
+		if n == 0 {
+			pos++
+			continue
+		}
+		for k := 0; k < z.lazy && pos+5 <= end; k++ {
+			n2, off2, gain2 := z.match(pos+1, pos+1-anchor, end)
+			if gain2 <= gain+4 {
+				break
+			}
+			pos, n, off, gain = pos+1, n2, off2, gain2
+		}
+		litLen := pos - anchor
+		v := z.reps.code(off, litLen)
+		z.reps.offset(v, litLen)
+		z.lits = append(z.lits, z.buf[anchor:pos]...)
+		z.seqs = append(z.seqs, zstdSeq{uint32(litLen), uint32(n), uint32(v)})
+		pos += n
+		anchor = pos
+	}
+	z.lits = append(z.lits, z.buf[anchor:end]...)
+}
+
+// appendBlock appends the block of z.buf[start:end] to dst.
+func (z *zstdEncoder) appendBlock(dst []byte, start, end int, last bool) []byte {
+	header := func(kind, size int) []byte {
+		h := size<<3 | kind<<1
+		if last {
+			h |= 1
+		}
+		return append(dst, byte(h), byte(h>>8), byte(h>>16))
+	}
+	block := z.buf[start:end]
+	if len(block) > 1 && bytes.Count(block, block[:1]) == len(block) {
+		return append(header(1, len(block)), block[0])
+	}
+	reps := z.reps
+	z.parse(start, end)
+	mark := len(dst)
+	dst = header(2, 0)
+	dst = z.appendLiterals(dst)
+	dst = z.appendSequences(dst)
+	if size := len(dst) - mark - 3; size < len(block) {
+		dst = dst[:mark]
+		dst = header(2, size)
+		return dst[:mark+3+size]
+	}
+	// Stored as they are, the sequences found are not used.
+	z.reps = reps
+	dst = dst[:mark]
+	return append(header(0, len(block)), block...)
+}
+
+// appendLiterals appends the literals section of z.lits to dst.
+func (z *zstdEncoder) appendLiterals(dst []byte) []byte {
+	lits := z.lits
+	n := len(lits)
+	header := func(kind int) []byte {
+		switch {
+		case n < 32:
+			return append(dst, byte(kind|n<<3))
+		case n < 1<<12:
+			return append(dst, byte(kind|1<<2|n<<4), byte(n>>4))
+		}
+		return append(dst, byte(kind|3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	if n > 1 && bytes.Count(lits, lits[:1]) == n {
+		return append(header(litRLE), lits[0])
+	}
+	if n >= 64 {
+		if payload, streams := z.huffLiterals(); payload != nil && len(payload)+5 < n {
+			size := len(payload)
+			var v uint64
+			var h int
+			switch {
+			case streams == 1:
+				v, h = uint64(litCompressed|n<<4|size<<14), 3
+			case n < 1<<10 && size < 1<<10:
+				v, h = uint64(litCompressed|1<<2|n<<4|size<<14), 3
+			case n < 1<<14 && size < 1<<14:
+				v, h = uint64(litCompressed|2<<2|n<<4|size<<18), 4
+			default:
+				v, h = uint64(litCompressed|3<<2|n<<4)|uint64(size)<<22, 5
+			}
+			dst = binary.LittleEndian.AppendUint64(dst, v)[:len(dst)+h]
+			return append(dst, payload...)
+		}
+	}
+	return append(header(litRaw), lits...)
+}
+
+// huffLiterals Huffman codes z.lits, returning the tree description and
+// the streams, and the number of streams, or nil if the literals cannot
+// be so coded.
+func (z *zstdEncoder) huffLiterals() ([]byte, int) {
+	var counts [256]int
+	for _, b := range z.lits {
+		counts[b]++
+	}
+	var lengths [256]uint8
+	maxBits := huffLengths(&counts, &lengths)
+	last := 255
+	for lengths[last] == 0 {
+		last--
+	}
+	var weights [256]uint8
+	for s, l := range lengths[:last+1] {
+		if l > 0 {
+			weights[s] = uint8(maxBits + 1 - int(l))
+		}
+	}
+	// The codes follow from the weights, as for huffTable.read.
+	var codes [256]uint16
+	pos := 0
+	for w := 1; w <= maxBits; w++ {
+		for s, sw := range weights[:last+1] {
+			if int(sw) == w {
+				codes[s] = uint16(pos >> (w - 1))
+				pos += 1 << (w - 1)
+			}
+		}
+	}
+
+	// The weight of the last symbol is implied.
+	out := appendWeights(z.huffBytes[:0], weights[:last])
+	if last <= 128 && (out == nil || len(out) > 1+(last+1)/2) {
+		// The weights take less room written directly.
+		out = append(z.huffBytes[:0], byte(127+last))
+		for i := 0; i < last; i += 2 {
+			b := weights[i] << 4
+			if i+1 < last {
+				b |= weights[i+1]
+			}
+			out = append(out, b)
+		}
+	}
+	if out == nil {
+		return nil, 0
+	}
+
+	encode := func(dst, lits []byte) []byte {
+		w := bitWriter{out: dst}
+		for i := len(lits) - 1; i >= 0; i-- {
+			w.add(uint64(codes[lits[i]]), uint(lengths[lits[i]]))
+		}
+		return w.close()
+	}
+	streams := 1
+	if n := len(z.lits); n < 256 {
+		out = encode(out, z.lits)
+	} else {
+		streams = 4
+		seg := (n + 3) / 4
+		jump := len(out)
+		out = append(out, 0, 0, 0, 0, 0, 0)
+		from := len(out)
+		for i := 0; i < 4; i++ {
+			out = encode(out, z.lits[i*seg:min((i+1)*seg, n)])
+			if i < 3 {
+				if len(out)-from >= 1<<16 {
+					return nil, 0
+				}
+				binary.LittleEndian.PutUint16(out[jump+2*i:], uint16(len(out)-from))
+				from = len(out)
+			}
+		}
+	}
+	z.huffBytes = out
+	return out, streams
+}
+
+// huffLengths sets lengths to the lengths of the Huffman codes of the
+// symbols counted, no longer than huffMaxBits, and returns the longest.
+// At least two symbols must be counted.
+func huffLengths(counts *[256]int, lengths *[256]uint8) int {
+	var syms []int
+	for s, c := range counts {
+		if c > 0 {
+			syms = append(syms, s)
+		}
+	}
+	c := *counts
+	for {
+		sort.SliceStable(syms, func(i, j int) bool { return c[syms[i]] < c[syms[j]] })
+		// Leaves and inner nodes, taken in increasing weight from two
+		// queues.
+		n := len(syms)
+		weight := make([]int, 2*n-1)
+		parent := make([]int, 2*n-1)
+		for i, s := range syms {
+			weight[i] = c[s]
+		}
+		leaf, inner := 0, n
+		pick := func(k int) int {
+			if leaf < n && (inner >= k || weight[leaf] <= weight[inner]) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+		for k := n; k < 2*n-1; k++ {
+			a, b := pick(k), pick(k)
+			weight[k] = weight[a] + weight[b]
+			parent[a], parent[b] = k, k
+		}
+		depth := make([]int, 2*n-1)
+		longest := 0
+		for k := 2*n - 3; k >= 0; k-- {
+			depth[k] = depth[parent[k]] + 1
+			longest = max(longest, depth[k])
+		}
+		if longest <= huffMaxBits {
+			for i, s := range syms {
+				lengths[s] = uint8(depth[i])
+			}
+			return longest
+		}
+		// Flattening the counts shortens the longest codes.
+		for _, s := range syms {
+			c[s] = (c[s] + 1) / 2
+		}
+	}
+}
+
+// fseLog returns the log of the size of the table for n symbols, the
+// highest being maxSymbol, of at most 1<<maxLog states.
+func fseLog(n, maxSymbol, maxLog int) int {
+	log := min(maxLog, bits.Len(uint(n-1))-2)
+	return min(maxLog, max(log, bits.Len(uint(maxSymbol))+1, 5))
+}
+
+// normalizeCounts returns counts, of the given total, scaled to sum to
+// 1 << log without losing any symbol.
+func normalizeCounts(norm []int16, counts []int, total, log int) []int16 {
+	size := 1 << log
+	norm = norm[:0]
+	sum, largest := 0, 0
+	for s, c := range counts {
+		v := 0
+		if c > 0 {
+			v = max(1, (c*size+total/2)/total)
+		}
+		norm = append(norm, int16(v))
+		sum += v
+		if v > int(norm[largest]) {
+			largest = s
+		}
+	}
+	for ; sum > size; sum-- {
+		top := 0
+		for s, v := range norm {
+			if v > norm[top] {
+				top = s
+			}
+		}
+		norm[top]--
+	}
+	norm[largest] += int16(size - sum)
+	return norm
+}
+
+// fseCost estimates the number of bits coding counts with the
+// distribution norm takes, or +Inf if it lacks some symbol.
+func fseCost(counts []int, norm []int16, log int) float64 {
+	cost := 0.0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return math.Inf(1)
+		}
+		cost += float64(c) * (float64(log) - math.Log2(float64(max(norm[s], 1))))
+	}
+	return cost
+}
+
+// appendWeights appends the description of the FSE compressed Huffman
+// weights to dst, or returns nil if they cannot be so described.
+func appendWeights(dst []byte, weights []uint8) []byte {
+	var counts [huffMaxBits + 1]int
+	top := 0
+	for _, w := range weights {
+		counts[w]++
+		top = max(top, int(w))
+	}
+	distinct := 0
+	for _, c := range counts {
+		if c > 0 {
+			distinct++
+		}
+	}
+	if len(weights) < 2 || distinct < 2 {
+		return nil
+	}
+	log := fseLog(len(weights), top, 6)
+	norm := normalizeCounts(nil, counts[:top+1], len(weights), log)
+	mark := len(dst)
+	dst = appendFSECounts(append(dst, 0), norm, log)
+	var t fseCTable
+	t.build(norm, log)
+	w := bitWriter{out: dst}
+	// Two states take turns, the first taking the even weights, from the
+	// end as the decoder reads them from the start.
+	n := len(weights)
+	var s1, s2 fseState
+	i := n
+	if n%2 == 1 {
+		s1.init(&t, weights[n-1])
+		s2.init(&t, weights[n-2])
+		s1.encode(&w, weights[n-3])
+		i = n - 3
+	} else {
+		s2.init(&t, weights[n-1])
+		s1.init(&t, weights[n-2])
+		i = n - 2
+	}
+	for i > 0 {
+		s2.encode(&w, weights[i-1])
+		s1.encode(&w, weights[i-2])
+		i -= 2
+	}
+	s2.flush(&w)
+	s1.flush(&w)
+	dst = w.close()
+	if size := len(dst) - mark - 1; size < 128 {
+		dst[mark] = byte(size)
+		return dst
+	}
+	return nil
+}
+
+// An fseCTable encodes FSE data: the states by symbol, and how to find
+// the next state from the current one for each symbol.
+type fseCTable struct {
+	log    int
+	states []uint16
+	trans  [64]struct {
+		deltaFindState int32
+		deltaNbBits    uint32
+	}
+}
+
+// build sets up t to encode data of the distribution norm, which sums to
+// 1 << log, as fseTable.build decodes it.
+func (t *fseCTable) build(norm []int16, log int) {
+	size := 1 << log
+	t.log = log
+	if cap(t.states) < size {
+		t.states = make([]uint16, size)
+	}
+	t.states = t.states[:size]
+	var symbols [1 << 9]uint8
+	spreadSymbols(symbols[:size], norm, log)
+	var cumul [65]int
+	for s, c := range norm {
+		cumul[s+1] = cumul[s] + int(max(c, 1))
+		if c == 0 {
+			cumul[s+1] = cumul[s]
+		}
+	}
+	next := cumul
+	for u, s := range symbols[:size] {
+		t.states[next[s]] = uint16(size + u)
+		next[s]++
+	}
+	for s, c := range norm {
+		tr := &t.trans[s]
+		switch c {
+		case 0:
+			tr.deltaNbBits = uint32((log+1)<<16 - size)
+		case -1, 1:
+			tr.deltaNbBits = uint32(log<<16 - size)
+			tr.deltaFindState = int32(cumul[s] - 1)
+		default:
+			maxBitsOut := log + 1 - bits.Len(uint(c-1))
+			tr.deltaNbBits = uint32(maxBitsOut<<16 - int(c)<<maxBitsOut)
+			tr.deltaFindState = int32(cumul[s] - int(c))
+		}
+	}
+}
+
+// rle sets up t to encode a single symbol, without any bits.
+func (t *fseCTable) rle(symbol uint8) {
+	var norm [64]int16
+	norm[symbol] = 1
+	t.build(norm[:symbol+1], 0)
+}
+
+// An fseState is the state of the encoding of FSE data.
+type fseState struct {
+	t *fseCTable
+	v uint32
+}
+
+// init starts encoding with the last symbol, which needs no bits.
+func (s *fseState) init(t *fseCTable, symbol uint8) {
+	tr := t.trans[symbol]
+	nb := (tr.deltaNbBits + 1<<15) >> 16
+	v := nb<<16 - tr.deltaNbBits
+	s.t, s.v = t, uint32(t.states[int32(v>>nb)+tr.deltaFindState])
+}
+
+func (s *fseState) encode(w *bitWriter, symbol uint8) {
+	tr := s.t.trans[symbol]
+	nb := (s.v + tr.deltaNbBits) >> 16
+	w.add(uint64(s.v), uint(nb))
+	s.v = uint32(s.t.states[int32(s.v>>nb)+tr.deltaFindState])
+}
+
+// flush ends the encoding with the state for the first symbol.
+func (s *fseState) flush(w *bitWriter) {
+	w.add(uint64(s.v), uint(s.t.log))
+}
+
+// seqCode returns the code of v of the given bases.
+func seqCode(base []uint32, v uint32) uint8 {
+	return uint8(sort.Search(len(base), func(i int) bool { return base[i] > v }) - 1)
+}
+
+// appendSequences appends the sequences section of z.seqs to dst.
+func (z *zstdEncoder) appendSequences(dst []byte) []byte {
+	n := len(z.seqs)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7f00:
+		dst = append(dst, byte(n>>8+128), byte(n))
+	default:
+		dst = append(dst, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if n == 0 {
+		return dst
+	}
+	z.llc, z.ofc, z.mlc = z.llc[:0], z.ofc[:0], z.mlc[:0]
+	for _, s := range z.seqs {
+		z.llc = append(z.llc, seqCode(llBase, s.litLen))
+		z.ofc = append(z.ofc, uint8(bits.Len32(s.offset)-1))
+		z.mlc = append(z.mlc, seqCode(mlBase, s.matchLen))
+	}
+	modes := len(dst)
+	dst = append(dst, 0)
+	for i, k := range []struct {
+		codes []uint8
+		c     *seqCodes
+		shift uint
+	}{
+		{z.llc, llCodes, 6},
+		{z.ofc, ofCodes, 4},
+		{z.mlc, mlCodes, 2},
+	} {
+		var mode byte
+		mode, dst = z.tables[i].choose(dst, k.codes, k.c)
+		dst[modes] |= mode << k.shift
+	}
+
+	ll, of, ml := &z.tables[0], &z.tables[1], &z.tables[2]
+	w := bitWriter{out: dst}
+	extra := func(i int) {
+		s, lc, mc, oc := z.seqs[i], z.llc[i], z.mlc[i], z.ofc[i]
+		w.add(uint64(s.litLen-llBase[lc]), uint(llBits[lc]))
+		w.add(uint64(s.matchLen-mlBase[mc]), uint(mlBits[mc]))
+		w.add(uint64(s.offset), uint(oc))
+	}
+	var sll, sof, sml fseState
+	sml.init(ml, z.mlc[n-1])
+	sof.init(of, z.ofc[n-1])
+	sll.init(ll, z.llc[n-1])
+	extra(n - 1)
+	for i := n - 2; i >= 0; i-- {
+		sof.encode(&w, z.ofc[i])
+		sml.encode(&w, z.mlc[i])
+		sll.encode(&w, z.llc[i])
+		extra(i)
+	}
+	sml.flush(&w)
+	sof.flush(&w)
+	sll.flush(&w)
+	return w.close()
+}
+
+// choose sets up t for the codes of a kind, appending the description of
+// the table to dst if it is not predefined, and returns its mode.
+func (t *fseCTable) choose(dst []byte, codes []uint8, c *seqCodes) (byte, []byte) {
+	var counts [64]int
+	top := 0
+	for _, v := range codes {
+		counts[v]++
+		top = max(top, int(v))
+	}
+	if counts[top] == len(codes) {
+		t.rle(uint8(top))
+		return seqRLE, append(dst, uint8(top))
+	}
+	predefined := fseCost(counts[:top+1], c.defaults, c.defaultLog)
+	log := fseLog(len(codes), top, c.maxLog)
+	var buf [64]int16
+	norm := normalizeCounts(buf[:0], counts[:top+1], len(codes), log)
+	desc := appendFSECounts(dst, norm, log)
+	if own := fseCost(counts[:top+1], norm, log) + float64(8*(len(desc)-len(dst))); own < predefined {
+		t.build(norm, log)
+		return seqCompressed, desc
+	}
+	t.build(c.defaults, c.defaultLog)
+	return seqPredefined, dst
+}
+
+// encodeZSTD compresses a block, laid out as if it were uncompressed.
+func (p *page) encodeZSTD(block []byte, _, _ int) ([]byte, error) {
+	return p.zstd.appendFrame(nil, block), nil
+}
+
+// zstdDictionary returns a dictionary of up to size bytes for the tw×th
+// tiles of p: pieces of the tiles, among those spread evenly over the
+// image, from their start, where the data coming after is compressed
+// against them.
+func (p *page) zstdDictionary(size, tw, th int) []byte {
+	dx, dy := p.layout.width, p.layout.height
+	across, down := (dx+tw-1)/tw, (dy+th-1)/th
+	tileBytes := tw * th * p.pixBytes
+	tiles := across * down
+	piece := min(size, tileBytes, 4<<10)
+	k := min(tiles, size/piece)
+	tile := make([]byte, tileBytes)
+	var dict []byte
+	for i := 0; i < k; i++ {
+		t := i * tiles / k
+		tx, ty := t%across*tw, t/across*th
+		w, h := min(tw, dx-tx), min(th, dy-ty)
+		clear(tile)
+		for y := 0; y < h; y++ {
+			p.packRows(tile[y*tw*p.pixBytes:], tx, w, ty+y, ty+y+1)
+		}
+		dict = append(dict, tile[:piece]...)
+	}
+	return dict
+}